@@ -1,16 +1,32 @@
 package baker
 
+import "fmt"
+
 // Data represents raw data consumed by a baker input, possibly
 // containing multiple records before they're parsed.
 type Data struct {
 	Bytes []byte   // Bytes is the slice of raw bytes read by an input
 	Meta  Metadata // Meta is filled by the input and holds metadata that will be associated to the records parsed from Bytes
+
+	// FirstLine is the line number, in the source read by the input, of the
+	// first record in Bytes. Records are then numbered from it, see
+	// MetadataLine. 0 means line numbers are unknown.
+	FirstLine int64
 }
 
 // Metadata about the input data; each Input will directly populate this
 // map as appropriate.  Consumers (filters) will access via Get()
+//
+// Since the same Metadata is shared by the records parsed from a Data, and
+// can be retained by the outputs (see OutputRecord.Meta), inputs must not
+// modify it once the Data has been sent.
 type Metadata map[string]interface{}
 
+// MetadataLine is the metadata key of the line number of a record in its
+// source, an int64 starting at 1. It's only set for LogLine records parsed
+// from a Data having a FirstLine.
+const MetadataLine = "line"
+
 func (m *Metadata) get(key string) (val interface{}, ok bool) {
 	if *m == nil {
 		return nil, false
@@ -25,7 +41,7 @@ func (m *Metadata) get(key string) (val interface{}, ok bool) {
 type InputStats struct {
 	NumProcessedLines int64
 	CustomStats       map[string]string
-	Metrics           MetricsBag
+	Metrics           *MetricsBag
 }
 
 // FilterStats contains statistics about the filter components,
@@ -33,7 +49,7 @@ type InputStats struct {
 type FilterStats struct {
 	NumProcessedLines int64
 	NumFilteredLines  int64
-	Metrics           MetricsBag
+	Metrics           *MetricsBag
 }
 
 // OutputStats contains statistics about the output component,
@@ -42,7 +58,7 @@ type OutputStats struct {
 	NumProcessedLines int64
 	NumErrorLines     int64
 	CustomStats       map[string]string
-	Metrics           MetricsBag
+	Metrics           *MetricsBag
 }
 
 // UploadStats contains statistics about the upload component,
@@ -51,7 +67,7 @@ type UploadStats struct {
 	NumProcessedFiles int64
 	NumErrorFiles     int64
 	CustomStats       map[string]string
-	Metrics           MetricsBag
+	Metrics           *MetricsBag
 }
 
 // Input is an interface representing an object that produces
@@ -90,7 +106,9 @@ type Filter interface {
 	// Process might mutate the Record, adding/modifying/removing fields,
 	// and might decide to throw it away, or pass it to next filter in chain
 	// by calling the next() function. In some cases, a filter might generate
-	// multiple Record in output, by calling next() multiple times.
+	// multiple Record in output, by calling next() multiple times, usually
+	// with copies of the received Record (see Record.Copy). Records passed to
+	// next() must not be retained after Process returns.
 	// next() is guaranteed to be non-nil; for the last filter of the chain,
 	// it points to a function that wraps up the filtering chain and sends
 	// the Record to the output.
@@ -100,6 +118,58 @@ type Filter interface {
 	Stats() FilterStats
 }
 
+// ChainStopper is a Filter that can also send records straight to the
+// outputs, skipping the remaining filters of the chain.
+type ChainStopper interface {
+	Filter
+
+	// ProcessChain is called by the topology instead of Process. It's like
+	// Process, except that the records passed to end() aren't processed by
+	// the next filters of the chain and are directly sent to the outputs.
+	ProcessChain(l Record, next, end func(Record))
+}
+
+// BatchFilter is a Filter that processes records in batches, for example to
+// perform a single external lookup for many records.
+type BatchFilter interface {
+	Filter
+
+	// ProcessBatch is called by the topology instead of Process, with up to
+	// [[filter]] batchsize records; partial batches are processed every
+	// batchinterval and on shutdown. It returns the records to send to
+	// the next filter of the chain, which can be the received ones, modified
+	// or not, a subset of them or new records. ProcessBatch might be called
+	// concurrently and must not retain records after it returns.
+	ProcessBatch(records []Record) []Record
+}
+
+// SerialFilter is a Filter that isn't safe for concurrent use, for example
+// because it keeps state between records.
+type SerialFilter interface {
+	Filter
+
+	// RequiresSerialization reports whether the filter must be run by one
+	// goroutine at a time. When it returns true, the topology serializes the
+	// calls to Process, or ProcessBatch; since Process calls the next filters
+	// of the chain, they're serialized as well.
+	RequiresSerialization() bool
+}
+
+// ReloadableFilter is a Filter that can apply a new configuration while the
+// topology is running, without being recreated. Filters that don't implement
+// it keep their original configuration when the topology is reloaded.
+type ReloadableFilter interface {
+	Filter
+
+	// Reload applies the configuration in cfg, decoded from the reloaded
+	// TOML. Since Reload is called while Process is running, possibly in
+	// multiple goroutines, it must be concurrent-safe with Process. When
+	// Reload returns an error, the filter must keep its old configuration.
+	// If another filter of the chain fails to reload, Reload is called
+	// again with the previous configuration of the filter.
+	Reload(cfg FilterParams) error
+}
+
 // Output is the final end of a topology, it process the records that have
 // reached the end of the filter chain and performs the final action (storing,
 // sending through the wire, counting, etc.)
@@ -142,6 +212,76 @@ type Output interface {
 type OutputRecord struct {
 	Fields []string // Fields are the fields sent to a Baker output.
 	Record []byte   // Record is the data representation of a Record (obtained with Record.ToText())
+
+	// Meta is the metadata attached to the record by the input, like the
+	// file it's been read from. It's shared with other records and must not
+	// be modified. Meta is only set for records implementing MetadataRecord.
+	Meta Metadata
+	Line int64 // Line is the line number of the record in its source, or 0 if unknown (see MetadataLine)
+}
+
+// StartupValidator is implemented by components that can check, before the
+// topology starts, that they have everything they need to run, like access
+// permissions or existing remote resources. Components implementing it are
+// validated when [general] validate_on_start is set in the configuration.
+type StartupValidator interface {
+	// Validate returns an error describing why the component can't run.
+	Validate() error
+}
+
+// ShutdownHook is implemented by components having work of their own to stop
+// during the topology shutdown, like background goroutines or connections to
+// close. A component declares the shutdown phase it belongs to, and Shutdown
+// is called once the other components of that phase have stopped, before the
+// next phase starts.
+type ShutdownHook interface {
+	// ShutdownPhase returns the phase of the shutdown the component belongs to.
+	ShutdownPhase() ShutdownPhase
+
+	// Shutdown stops the component. An error is logged but doesn't abort the
+	// shutdown.
+	Shutdown() error
+}
+
+// ConfigValidator is implemented by component configurations that can check
+// their own validity. Configurations implementing it are checked by
+// Config.Validate, before any component gets created, so that all the errors
+// a configuration contains are reported at once.
+type ConfigValidator interface {
+	// ValidateConfig returns an error describing why the configuration is
+	// invalid. fieldByName gets the index of a field by its name.
+	ValidateConfig(fieldByName func(string) (FieldIndex, bool)) error
+}
+
+// RecordError describes an error that occurred while processing a specific
+// record in a filter or an output, or while parsing it.
+type RecordError struct {
+	Component string   // Component is the name of the component reporting the error, set by the topology
+	Record    []byte   // Record is the data representation of the record, if available
+	Fields    []string // Fields are the record fields received by an output, if any
+	Meta      Metadata // Meta is the metadata of the record, like its source, if available. It must not be modified
+	Line      int64    // Line is the line number of the record in its source, if known (see MetadataLine)
+	Err       error    // Err is the reported error
+}
+
+func (e RecordError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s: line %d: %v", e.Component, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Component, e.Err)
+}
+
+// An ErrorReporter reports per-record errors to the topology, which routes
+// them to the handler installed with Topology.SetErrorHandler, if any.
+type ErrorReporter func(RecordError)
+
+// Report reports a per-record error. Reporting an error doesn't discard or
+// retry the record: the component reporting it is still in charge of that.
+// Report is a no-op if r is nil, so components can call it unconditionally.
+func (r ErrorReporter) Report(e RecordError) {
+	if r != nil {
+		r(e)
+	}
 }
 
 // Upload uploads files created by the topology output to a configured location.
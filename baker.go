@@ -17,6 +17,9 @@ package baker
 
 import (
 	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Main runs the topology corresponding to the provided configuration.
@@ -28,6 +31,17 @@ func Main(cfg *Config) error {
 		return fmt.Errorf("can't create topology: %s", err)
 	}
 
+	// Serve stats over HTTP if required, before starting the topology so
+	// that an unusable address is reported right away.
+	stats := NewStatsDumper(topology)
+	stopServer := func() {}
+	if cfg.General.StatsAddr != "" {
+		stopServer, err = stats.ListenAndServe(cfg.General.StatsAddr)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Start the topology
 	topology.Start()
 
@@ -40,14 +54,38 @@ func Main(cfg *Config) error {
 	}()
 
 	// Begin dump statistics
-	stats := NewStatsDumper(topology)
 	stopStats := stats.Run()
 
 	// Block until topology termination.
 	<-topdone
 
-	// Stop the stats dumping goroutine (this also prints stats one last time).
+	// Stop the stats dumping goroutine (this also prints stats one last time),
+	// then the stats server.
 	stopStats()
+	stopServer()
+
+	// The metrics client may have metrics to send before being closed, now
+	// that the stats have been dumped for the last time.
+	if c, ok := topology.metrics.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.WithError(err).Warn("can't close metrics client")
+		}
+	}
 
 	return topology.Error()
 }
+
+// DryRun creates the topology corresponding to the provided configuration,
+// hence creating all its components, but doesn't start it. It then writes to
+// w the resolved configuration, that is with environment variables replaced
+// and default values filled in, in TOML format.
+func DryRun(cfg *Config, w io.Writer) error {
+	if _, err := NewTopologyFromConfig(cfg); err != nil {
+		return fmt.Errorf("can't create topology: %s", err)
+	}
+
+	if err := cfg.writeTOML(w); err != nil {
+		return fmt.Errorf("can't write configuration: %s", err)
+	}
+	return nil
+}
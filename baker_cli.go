@@ -19,23 +19,30 @@ import (
 //
 // The function includes many utilities that can be configured by command line arguments:
 //  -help: Prints available options and components
+//  -list: Lists all available components
+//  -generate-config: Prints a configuration skeleton for the given components
 //  -v: verbose logging (not compatible with -q)
 //  -q: quiet logging (not compatible with -v)
 //  -pretty: logs in textual format instead of JSON format
 //  -pprof: run a pprof server on the provided host:port address
+//  -dry-run: check the topology can be created and print the resolved configuration
 //
 // The function also expects the first non-positional argument to represent the path to
-// the Baker Topology file
+// the Baker Topology file. On SIGHUP, the file is read again and the new configuration
+// is applied to the filters that support it (see ReloadableFilter).
 func MainCLI(components Components) error {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stderr)
 
 	var (
-		flagHelpConfig = flag.String("help", "", "show help for a `component` (input/filter/output/upload) (use '*' to dump all)")
+		flagHelpConfig = flag.String("help", "", "show help for a `component` (input/filter/output/upload/metrics) (use '*' to dump all)")
 		flagVerbose    = flag.Bool("v", false, "verbose logging (debug level)")
 		flagQuiet      = flag.Bool("q", false, "quiet logging (warn level)")
 		flagPretty     = flag.Bool("pretty", false, "human-readable logging (unstructured logging)")
 		flagPProf      = flag.String("pprof", "", `run pprof server on host port provided (disabled if ""), use "localhost:"  for a free port`)
+		flagDryRun     = flag.Bool("dry-run", false, "create the topology components without running them, then print the resolved configuration")
+		flagList       = flag.Bool("list", false, "list all available components")
+		flagGenConfig  = flag.String("generate-config", "", "print a configuration skeleton for the `components` listed as kind=name, like input=SQS,output=FileWriter")
 	)
 
 	// Seed pseudo-random number generation using seconds since the epoch
@@ -50,6 +57,18 @@ func MainCLI(components Components) error {
 		return RenderHelpMarkdown(os.Stderr, *flagHelpConfig, components)
 	}
 
+	if *flagList {
+		return PrintComponentList(os.Stdout, components)
+	}
+
+	if *flagGenConfig != "" {
+		sk, err := ParseConfigSkeleton(*flagGenConfig)
+		if err != nil {
+			return err
+		}
+		return WriteConfigSkeleton(os.Stdout, sk, components)
+	}
+
 	if *flagPProf != "" {
 		addr, err := checkHostPort(*flagPProf)
 		if err != nil {
@@ -80,16 +99,27 @@ func MainCLI(components Components) error {
 		log.SetFormatter(&log.TextFormatter{})
 	}
 
-	f, err := os.Open(flag.Arg(0))
-	if err != nil {
-		return fmt.Errorf("errors opening config: %v", err)
+	readConfig := func() (*Config, error) {
+		return NewConfigFromTomlFile(flag.Arg(0), components)
 	}
-	defer f.Close()
 
-	cfg, err := NewConfigFromToml(f, components)
+	cfg, err := readConfig()
 	if err != nil {
 		return err
 	}
+	cfg.reload = readConfig
+
+	// Command line flags take precedence over the logging configuration.
+	if *flagVerbose || *flagQuiet {
+		cfg.General.LogLevel = ""
+	}
+	if *flagPretty {
+		cfg.General.LogFormat = ""
+	}
+
+	if *flagDryRun {
+		return DryRun(cfg, os.Stdout)
+	}
 
 	log.WithField("c", cfg.String()).Info("configuration")
 
@@ -124,6 +154,14 @@ Available uploads:
 {{ range .Components.Uploads }}
   * {{ .Name }}{{ end }}
 
+Available metrics:
+{{ range .Components.Metrics }}
+  * {{ .Name }}{{ end }}
+{{ if .Components.Records }}
+Available record types:
+{{ range .Components.Records }}
+  * {{ .Name }}{{ end }}
+{{ end }}
 `))
 
 func displayProgramUsage(components Components) func() {
@@ -0,0 +1,202 @@
+package baker_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// batchFilter records the size of the batches it receives, and drops the
+// records whose first field is "drop".
+type batchFilter struct {
+	filtertest.Base
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (f *batchFilter) ProcessBatch(records []baker.Record) []baker.Record {
+	f.mu.Lock()
+	f.sizes = append(f.sizes, len(records))
+	f.mu.Unlock()
+
+	out := records[:0]
+	for _, l := range records {
+		if string(l.Get(0)) != "drop" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func batchTopology(t *testing.T, toml string, f baker.Filter) (*baker.Topology, *channelInput, error) {
+	t.Helper()
+
+	in := &channelInput{ch: make(chan []byte, 1)}
+	topo, err := batchTopologyWithInput(t, toml, in, f)
+	return topo, in, err
+}
+
+func batchTopologyWithInput(t *testing.T, toml string, in baker.Input, f baker.Filter) (*baker.Topology, error) {
+	t.Helper()
+
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{{
+			Name:   "Batch",
+			New:    func(baker.FilterParams) (baker.Filter, error) { return f, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return baker.NewTopologyFromConfig(cfg)
+}
+
+// recyclingInput is a channelInput overwriting the buffers given back to it
+// with FreeMem, as an input reusing its buffers would.
+type recyclingInput struct {
+	channelInput
+}
+
+func (in *recyclingInput) FreeMem(data *baker.Data) {
+	for i := range data.Bytes {
+		data.Bytes[i] = 'X'
+	}
+}
+
+func TestBatchFilter(t *testing.T) {
+	toml := `
+[fields]
+names=["f0"]
+
+[input]
+name="Channel"
+
+[filterchain]
+procs=1
+
+[[filter]]
+name="Batch"
+batchsize=3
+batchinterval="1h"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0"]
+`
+	f := &batchFilter{}
+	topo, in, err := batchTopology(t, toml, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	in.ch <- []byte("a\nb\ndrop\nc\nd\ne\nf\n")
+	close(in.ch)
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last, partial, batch is processed on shutdown.
+	if want := []int{3, 3, 1}; !reflect.DeepEqual(f.sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", f.sizes, want)
+	}
+	var got []string
+	for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+		got = append(got, r.Fields[0])
+	}
+	if want := []string{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestBatchFilterRecycledBuffers(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="Channel"
+
+[filterchain]
+procs=1
+
+[[filter]]
+name="Batch"
+batchsize=10
+batchinterval="1h"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0", "f1"]
+`
+	// Each buffer holds less records than a batch, so they're batched past
+	// the moment their buffer is given back to the input.
+	in := &recyclingInput{channelInput{ch: make(chan []byte)}}
+	topo, err := batchTopologyWithInput(t, toml, in, &batchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	var want [][]string
+	for i := 0; i < 5; i++ {
+		var buf []byte
+		for j := 0; j < 3; j++ {
+			rec := []string{fmt.Sprintf("r%d", i*3+j), fmt.Sprintf("v%d", j)}
+			want = append(want, rec)
+			buf = append(buf, strings.Join(rec, ",")+"\n"...)
+		}
+		in.ch <- buf
+	}
+	close(in.ch)
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]string
+	for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+		got = append(got, r.Fields)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestBatchConfigOnRegularFilter(t *testing.T) {
+	toml := `
+[fields]
+names=["f0"]
+
+[input]
+name="Channel"
+
+[[filter]]
+name="Batch"
+batchsize=3
+
+[output]
+name="Recorder"
+fields=["f0"]
+`
+	_, _, err := batchTopology(t, toml, &filtertest.Base{})
+	if err == nil || !strings.Contains(err.Error(), "batchsize") {
+		t.Errorf("NewTopologyFromConfig error = %v, want an error about batchsize", err)
+	}
+}
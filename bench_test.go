@@ -242,4 +242,38 @@ func BenchmarkLogLineCopy(b *testing.B) {
 			b.Error("copy != original")
 		}
 	})
+
+	// Simulates a pipeline in which all records are copied (i.e fan-out) but
+	// 90% of the copies remain unchanged, the other 10% having one field set.
+	b.Run("90%-unchanged", func(b *testing.B) {
+		var ll baker.Record
+		ll = &baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		buf := bytes.Repeat([]byte(`hello,world,,`), 200)
+		ll.Parse(buf, nil)
+
+		b.ReportAllocs()
+
+		var cpy baker.Record
+		for n := 0; n < b.N; n++ {
+			cpy = ll.Copy()
+			if n%10 == 0 {
+				cpy.Set(1, []byte("foobar"))
+			}
+		}
+	})
+	b.Run("90%-unchanged/copy-on-write", func(b *testing.B) {
+		ll := &baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		buf := bytes.Repeat([]byte(`hello,world,,`), 200)
+		ll.Parse(buf, nil)
+
+		b.ReportAllocs()
+
+		var cpy baker.Record
+		for n := 0; n < b.N; n++ {
+			cpy = ll.CopyOnWrite()
+			if n%10 == 0 {
+				cpy.Set(1, []byte("foobar"))
+			}
+		}
+	})
 }
@@ -2,14 +2,21 @@ package baker
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/rasky/toml"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker/pkg/tracing"
 )
 
 // The configuration for the topology is parsed from TOML format.
@@ -53,21 +60,38 @@ type ConfigFilterChain struct {
 
 // ConfigFilter specifies the configuration for a single filter component.
 type ConfigFilter struct {
-	Name          string
+	Name string
+	// BatchSize is the maximum number of records passed at once to a filter
+	// implementing BatchFilter, the default value is 100
+	BatchSize int
+	// BatchInterval is the maximum time a record waits for its batch to
+	// fill up before the batch is passed to a filter implementing
+	// BatchFilter, the default value is 1s
+	BatchInterval time.Duration
 	DecodedConfig interface{}
 
 	Config *toml.Primitive
 	desc   *FilterDesc
 }
 
-// ConfigOutput specifies the configuration for the output component.
+// ConfigOutput specifies the configuration for an output component.
 type ConfigOutput struct {
 	Name string
 	// Procs defines the number of baker outputs running concurrently.
 	// Only set Procs to a value greater than 1 if the output is concurrent safe.
-	Procs         int
-	ChanSize      int      // ChanSize represents the size of the channel to send records to the ouput component(s), the default value is 16384
-	Sharding      string   // Sharding is the name of the field used for sharding
+	Procs        int
+	ChanSize     int    // ChanSize represents the size of the channel to send records to the ouput component(s), the default value is 16384
+	Sharding     string // Sharding is the name of the field used for sharding
+	ShardingFunc string // ShardingFunc is the name of the built-in hash function (fnv, crc32 or murmur3) used for sharding, if any
+	// OverflowPolicy is what happens to the records sent to the output when
+	// its channel is full: block (the default) waits, slowing down the whole
+	// topology; drop_newest discards the record being sent; drop_oldest
+	// discards the oldest record in the channel to make room for it.
+	// Defaults to drop_newest for tee outputs.
+	OverflowPolicy string
+	// Tee, if set, makes the output receive a copy of a sample of the
+	// records only, leaving the other outputs untouched.
+	Tee           *ConfigTee
 	Fields        []string // Fields holds the name of the record fields the output receives
 	DecodedConfig interface{}
 
@@ -75,6 +99,19 @@ type ConfigOutput struct {
 	desc   *OutputDesc
 }
 
+// A ConfigTee selects the records sent to a tee output, for example a debug
+// sink receiving a small sample of the live stream. Records are selected by
+// sampling rate and/or by field value.
+type ConfigTee struct {
+	// Rate is the fraction of the (matching) records sent to the output,
+	// between 0 and 1. All of them if 0
+	Rate float64
+	// Field and Value, if set, restrict the records sent to the output to
+	// those whose field Field equals Value
+	Field string
+	Value string
+}
+
 // ConfigUpload specifies the configuration for the upload component.
 type ConfigUpload struct {
 	Name          string
@@ -100,6 +137,105 @@ type ConfigCSV struct {
 type ConfigGeneral struct {
 	// DontValidateFields reports whether records validation is skipped (by not calling Components.Validate)
 	DontValidateFields bool `toml:"dont_validate_fields"`
+	// ValidateOnStart reports whether components implementing StartupValidator are asked to
+	// check their environment (permissions, resources, etc.) when the topology is created
+	ValidateOnStart bool `toml:"validate_on_start"`
+	// LogLevel is the logging level (trace, debug, info, warn, error, fatal or panic),
+	// left unchanged if empty
+	LogLevel string `toml:"log_level"`
+	// LogFormat is the logging format (text or json), left unchanged if empty
+	LogFormat string `toml:"log_format"`
+	// StatsAddr is the address ([host]:port) of an HTTP server serving the
+	// stats of all the components as JSON on /stats. Disabled if empty
+	StatsAddr string `toml:"stats_addr"`
+	// MaxRecordsPerSecond caps the number of records read from the input per
+	// second. When the limit is reached, the input is slowed down rather than
+	// records being dropped. No limit if 0
+	MaxRecordsPerSecond int `toml:"max_records_per_second"`
+	// MinFields, if not 0, is the minimum number of fields of the records
+	// parsed from the input. ExpectedFields, if not 0, is their exact number
+	// of fields. Records not matching are discarded and counted as parse
+	// errors, or kept if DontValidateFields is set. Only applies to the
+	// default LogLine records
+	MinFields      int `toml:"min_fields"`
+	ExpectedFields int `toml:"expected_fields"`
+	// ShutdownTimeout, if not 0, bounds the duration of each phase of the
+	// topology shutdown (see ShutdownPhase). When a phase doesn't complete in
+	// time, the shutdown is aborted and Topology.Error reports it
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	// FailOnRecordError reports whether the topology is stopped, with an
+	// error, by the first record that can't be parsed, doesn't pass the
+	// validation or is reported by a component (see ErrorReporter). By
+	// default, such records are counted and dropped, and the topology goes
+	// on with the next ones
+	FailOnRecordError bool `toml:"fail_on_record_error"`
+	// RecordType is the name of the record type (see Components.Records) of
+	// the records parsed from the input, configured in [record.config]. The
+	// records are LogLine if empty or "LogLine"
+	RecordType string `toml:"record_type"`
+	// FilterConcurrency, if not 0, is the number of goroutines running the
+	// filter chain, like [filterchain] procs. Filters implementing
+	// SerialFilter are run by one goroutine at a time nonetheless
+	FilterConcurrency int `toml:"filter_concurrency"`
+	// MaxRecords and MaxDuration, if not 0, bound the run of the topology:
+	// it's cleanly shut down, without error, once MaxRecords records have
+	// been sent through the filter chain or once it has been running for
+	// MaxDuration. The records read in excess from the input are discarded
+	MaxRecords  int64         `toml:"max_records"`
+	MaxDuration time.Duration `toml:"max_duration"`
+	// TracingEndpoint, if set, is the URL of an OpenTelemetry collector
+	// (OTLP/HTTP, e.g. http://localhost:4318) to which the spans of the
+	// processing of each input file are sent, as spans of the
+	// TracingServiceName service ("baker" by default). Tracing is disabled
+	// if empty
+	TracingEndpoint    string `toml:"tracing_endpoint"`
+	TracingServiceName string `toml:"tracing_service_name"`
+}
+
+// checkFieldCount validates the field count configuration.
+func (c *ConfigGeneral) checkFieldCount() error {
+	for _, opt := range []struct {
+		name string
+		n    int
+	}{{"min_fields", c.MinFields}, {"expected_fields", c.ExpectedFields}} {
+		if opt.n < 0 || opt.n > int(LogLineNumFields) {
+			return fmt.Errorf("[general] %s: must be between 0 and %d, got %d", opt.name, LogLineNumFields, opt.n)
+		}
+	}
+	if c.MinFields > 0 && c.ExpectedFields > 0 && c.ExpectedFields < c.MinFields {
+		return fmt.Errorf("[general] expected_fields (%d) can't be lower than min_fields (%d)", c.ExpectedFields, c.MinFields)
+	}
+	return nil
+}
+
+// checkLogging validates the logging configuration.
+func (c *ConfigGeneral) checkLogging() error {
+	if c.LogLevel != "" {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			return fmt.Errorf("[general] log_level: %v", err)
+		}
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("[general] log_format: must be text or json, got %q", c.LogFormat)
+	}
+	return nil
+}
+
+// applyLogging configures the logger according to the (valid) logging
+// configuration.
+func (c *ConfigGeneral) applyLogging() {
+	if c.LogLevel != "" {
+		lvl, _ := log.ParseLevel(c.LogLevel)
+		log.SetLevel(lvl)
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	}
 }
 
 // ConfigMetrics holds metrics configuration.
@@ -111,6 +247,15 @@ type ConfigMetrics struct {
 	desc   *MetricsDesc
 }
 
+// ConfigRecord holds the configuration of the record type selected with
+// [general] record_type.
+type ConfigRecord struct {
+	DecodedConfig interface{}
+
+	Config *toml.Primitive
+	desc   *RecordDesc
+}
+
 // ConfigFields specifies names for records fields. In addition of being a list
 // of names, the position of each name in the slice also indicates the FieldIndex
 // for that name. In other words, if Names[0] = "address", then a FieldIndex of
@@ -124,21 +269,25 @@ type Config struct {
 	Input       ConfigInput
 	FilterChain ConfigFilterChain
 	Filter      []ConfigFilter
-	Output      ConfigOutput
+	Output      []ConfigOutput // Output is either a single [output] table or an array of [[output]] tables
 	Upload      ConfigUpload
 
 	General ConfigGeneral
 	Fields  ConfigFields
 	Metrics ConfigMetrics
 	CSV     ConfigCSV
+	Record  ConfigRecord
 	User    []ConfigUser
 
 	shardingFuncs map[FieldIndex]ShardingFunc
 	validate      ValidationFunc
 	createRecord  func() Record
+	spanExporter  tracing.Exporter
 
 	fieldByName func(string) (FieldIndex, bool)
 	fieldName   func(FieldIndex) string
+
+	reload func() (*Config, error) // reload re-reads the configuration, if available
 }
 
 // String returns a string representation of the exported fields of c.
@@ -148,16 +297,142 @@ func (c *Config) String() string {
 	for i, f := range c.Filter {
 		s += fmt.Sprintf("Filter-%d:{Name:%s} ", i, f.Name)
 	}
-	s += fmt.Sprintf("Output:{Name:%s, Procs:%d, ChanSize:%d, Sharding:%s, Fields:[%s]} ", c.Output.Name, c.Output.Procs, c.Output.ChanSize, c.Output.Sharding, strings.Join(c.Output.Fields, ","))
+	for i, o := range c.Output {
+		s += fmt.Sprintf("Output-%d:{Name:%s, Procs:%d, ChanSize:%d, Sharding:%s, ShardingFunc:%s, OverflowPolicy:%s, Fields:[%s]} ", i, o.Name, o.Procs, o.ChanSize, o.Sharding, o.ShardingFunc, o.OverflowPolicy, strings.Join(o.Fields, ","))
+	}
 	s += fmt.Sprintf("Upload:{Name:%s}", c.Upload.Name)
 	return s
 }
 
+// writeTOML writes c to w in TOML format, including the decoded
+// configuration of all the components.
+func (c *Config) writeTOML(w io.Writer) error {
+	doc := map[string]interface{}{
+		"general":     componentConfigMap(c.General),
+		"csv":         c.CSV,
+		"fields":      map[string]interface{}{"names": c.Fields.Names},
+		"filterchain": map[string]interface{}{"procs": c.FilterChain.Procs},
+		"input": map[string]interface{}{
+			"name":     c.Input.Name,
+			"chansize": c.Input.ChanSize,
+			"config":   componentConfigMap(c.Input.DecodedConfig),
+		},
+	}
+
+	if len(c.Filter) > 0 {
+		filters := make([]map[string]interface{}, 0, len(c.Filter))
+		for _, f := range c.Filter {
+			fil := map[string]interface{}{
+				"name":   f.Name,
+				"config": componentConfigMap(f.DecodedConfig),
+			}
+			if f.BatchSize != 0 {
+				fil["batchsize"] = f.BatchSize
+			}
+			if f.BatchInterval != 0 {
+				fil["batchinterval"] = f.BatchInterval.String()
+			}
+			filters = append(filters, fil)
+		}
+		doc["filter"] = filters
+	}
+
+	outputs := make([]map[string]interface{}, 0, len(c.Output))
+	for _, o := range c.Output {
+		out := map[string]interface{}{
+			"name":           o.Name,
+			"procs":          o.Procs,
+			"chansize":       o.ChanSize,
+			"sharding":       o.Sharding,
+			"shardingfunc":   o.ShardingFunc,
+			"overflowpolicy": o.OverflowPolicy,
+			"fields":         o.Fields,
+			"config":         componentConfigMap(o.DecodedConfig),
+		}
+		if o.Tee != nil {
+			out["tee"] = map[string]interface{}{
+				"rate":  o.Tee.Rate,
+				"field": o.Tee.Field,
+				"value": o.Tee.Value,
+			}
+		}
+		outputs = append(outputs, out)
+	}
+	doc["output"] = outputs
+
+	if c.Upload.Name != "" {
+		doc["upload"] = map[string]interface{}{
+			"name":   c.Upload.Name,
+			"config": componentConfigMap(c.Upload.DecodedConfig),
+		}
+	}
+	if c.Metrics.Name != "" {
+		doc["metrics"] = map[string]interface{}{
+			"name":   c.Metrics.Name,
+			"config": componentConfigMap(c.Metrics.DecodedConfig),
+		}
+	}
+	if c.Record.desc != nil {
+		doc["record"] = map[string]interface{}{
+			"config": componentConfigMap(c.Record.DecodedConfig),
+		}
+	}
+
+	return toml.NewEncoder(w).Encode(doc)
+}
+
+// componentConfigMap returns the exported fields of a component configuration
+// struct, by name, or by toml tag if they have one. Durations are represented
+// as strings, the way they're written in TOML, while nil pointers and fields
+// of types having no TOML representation are left out.
+func componentConfigMap(cfg interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+
+	v := reflect.ValueOf(cfg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return m
+	}
+
+	durationType := reflect.TypeOf(time.Duration(0))
+	for i := 0; i < v.NumField(); i++ {
+		sf, fv := v.Type().Field(i), v.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+
+		name := sf.Name
+		if tag := strings.Split(sf.Tag.Get("toml"), ",")[0]; tag != "" && tag != "-" {
+			name = tag
+		}
+
+		switch {
+		case sf.Type == durationType:
+			m[name] = fv.Interface().(time.Duration).String()
+		case fv.Kind() == reflect.Func, fv.Kind() == reflect.Chan, fv.Kind() == reflect.Interface:
+		case fv.Kind() == reflect.Ptr && fv.IsNil():
+		default:
+			m[name] = fv.Interface()
+		}
+	}
+	return m
+}
+
 func (c *Config) fillDefaults() error {
 	c.Input.fillDefaults()
+	if c.General.FilterConcurrency != 0 {
+		c.FilterChain.Procs = c.General.FilterConcurrency
+	}
 	c.FilterChain.fillDefaults()
-	c.Output.fillDefaults()
+	for idx := range c.Output {
+		c.Output[idx].fillDefaults()
+	}
 	c.Upload.fillDefaults()
+	if c.General.TracingEndpoint != "" && c.General.TracingServiceName == "" {
+		c.General.TracingServiceName = "baker"
+	}
 	if err := c.fillCreateRecordDefault(); err != nil {
 		return err
 	}
@@ -165,25 +440,46 @@ func (c *Config) fillDefaults() error {
 }
 
 func (c *Config) fillCreateRecordDefault() error {
+	if c.createRecord == nil && c.Record.desc != nil {
+		create, err := c.Record.desc.New(RecordParams{
+			DecodedConfig: c.Record.DecodedConfig,
+			FieldByName:   c.fieldByName,
+			FieldName:     c.fieldName,
+		})
+		if err != nil {
+			return componentError("record", c.Record.desc.Name, "[general] record_type", err)
+		}
+		c.createRecord = create
+	}
 	if c.createRecord == nil {
-		fieldSeparator := DefaultLogLineFieldSeparator
-		if c.CSV.FieldSeparator != "" {
-			sep := []rune(c.CSV.FieldSeparator)
-			if len(sep) != 1 || sep[0] > unicode.MaxASCII {
-				return fmt.Errorf("Separator must be a 1-byte string or hex char")
-			}
-			fieldSeparator = byte(sep[0])
+		fieldSeparator, err := c.CSV.fieldSeparator()
+		if err != nil {
+			return err
 		}
 		// For now, leave Logline as the default
 		c.createRecord = func() Record {
 			return &LogLine{
 				FieldSeparator: fieldSeparator,
+				MinFields:      c.General.MinFields,
+				ExpectedFields: c.General.ExpectedFields,
 			}
 		}
 	}
 	return nil
 }
 
+// fieldSeparator returns the configured field separator, or the default one.
+func (c *ConfigCSV) fieldSeparator() (byte, error) {
+	if c.FieldSeparator == "" {
+		return DefaultLogLineFieldSeparator, nil
+	}
+	sep := []rune(c.FieldSeparator)
+	if len(sep) != 1 || sep[0] > unicode.MaxASCII {
+		return 0, fmt.Errorf("Separator must be a 1-byte string or hex char")
+	}
+	return byte(sep[0]), nil
+}
+
 func (c *ConfigInput) fillDefaults() {
 	if c.ChanSize == 0 {
 		c.ChanSize = 1024
@@ -203,6 +499,13 @@ func (c *ConfigOutput) fillDefaults() {
 	if c.Procs == 0 {
 		c.Procs = 32
 	}
+	if c.OverflowPolicy == "" {
+		c.OverflowPolicy = OverflowBlock
+		if c.Tee != nil {
+			// A tee output mustn't slow down the others.
+			c.OverflowPolicy = OverflowDropNewest
+		}
+	}
 }
 
 func (c *ConfigUpload) fillDefaults() {}
@@ -224,7 +527,7 @@ func replaceEnvVars(f io.Reader, mapper func(string) string) (io.Reader, error)
 	return strings.NewReader(os.Expand(buf.String(), mapper)), nil
 }
 
-func decodeAndCheckConfig(md toml.MetaData, compCfg interface{}) error {
+func decodeConfig(md toml.MetaData, compCfg interface{}) error {
 	var (
 		cfg  *toml.Primitive // config
 		dcfg interface{}     // decoded config
@@ -248,26 +551,49 @@ func decodeAndCheckConfig(md toml.MetaData, compCfg interface{}) error {
 	case ConfigMetrics:
 		cfg, dcfg = t.Config, t.DecodedConfig
 		name, typ = t.Name, "metrics"
+	case ConfigRecord:
+		cfg, dcfg = t.Config, t.DecodedConfig
+		name, typ = t.desc.Name, "record"
 	default:
 		panic(fmt.Sprintf("unexpected type %#v", cfg))
 	}
 
-	if cfg == nil {
-		// No config section was given in the TOML, so we create a pointer to
-		// the zero value of our config struct to check required field
-		tcfg := reflect.TypeOf(dcfg).Elem()
-		dcfg = reflect.New(tcfg).Interface()
-	} else {
+	// Required fields and the like are checked later, by Config.Validate.
+	if cfg != nil {
 		if err := md.PrimitiveDecode(*cfg, dcfg); err != nil {
 			return fmt.Errorf("%s %q: error parsing config: %v", typ, name, err)
 		}
 	}
 
-	if req := CheckRequiredFields(dcfg); req != "" {
-		return fmt.Errorf("%s %q: %w", typ, name, ErrorRequiredField{req})
+	return nil
+}
+
+// decodeTopology decodes the TOML configuration read from r into cfg.
+// Since [output] can either be a single table or an array of tables, its
+// type is checked first so that a single table can be decoded as well into
+// the cfg.Output slice.
+func decodeTopology(r io.Reader, cfg *Config) (toml.MetaData, error) {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return toml.MetaData{}, err
+	}
+
+	var probe struct{ Output interface{} }
+	if _, err := toml.Decode(buf.String(), &probe); err != nil {
+		return toml.MetaData{}, err
 	}
 
-	return nil
+	if _, ok := probe.Output.(map[string]interface{}); !ok {
+		return toml.Decode(buf.String(), cfg)
+	}
+
+	single := struct {
+		*Config
+		Output ConfigOutput
+	}{Config: cfg}
+	md, err := toml.Decode(buf.String(), &single)
+	cfg.Output = []ConfigOutput{single.Output}
+	return md, err
 }
 
 // NewConfigFromToml creates a Config from a reader reading from a TOML
@@ -277,102 +603,64 @@ func NewConfigFromToml(f io.Reader, comp Components) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Can't replace config with env vars: %v", err)
 	}
+	return newConfigFromToml(f, comp)
+}
 
+// newConfigFromToml creates a Config from a TOML configuration in which
+// environment variables have already been replaced.
+func newConfigFromToml(f io.Reader, comp Components) (*Config, error) {
 	// Parse che configuration. Part of the configuration will be
 	// captured as toml.Primitive for deferred parsing (see comment
 	// at top of the file)
 	cfg := Config{}
-	md, err := toml.DecodeReader(f, &cfg)
+	md, err := decodeTopology(f, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing topology: %v", err)
 	}
 
-	// We now go through inputs, filters and outputs, and match the names
-	// to the actual object descriptions provided by each respective package.
-	// Through the description, we also acquire an instance to the actual
-	// custom configuration structure, that will be filled later.
-	for _, inp := range comp.Inputs {
-		if strings.EqualFold(inp.Name, cfg.Input.Name) {
-			cfg.Input.desc = &inp
-			break
-		}
-	}
-	if cfg.Input.desc == nil {
-		return nil, fmt.Errorf("input does not exist: %q", cfg.Input.Name)
-	}
-
-	for idx := range cfg.Filter {
-		cfgfil := &cfg.Filter[idx]
-		for _, fil := range comp.Filters {
-			if strings.EqualFold(fil.Name, cfgfil.Name) {
-				cfgfil.desc = &fil
-				break
-			}
-		}
-		if cfgfil.desc == nil {
-			return nil, fmt.Errorf("filter does not exist: %q", cfgfil.Name)
-		}
-	}
-
-	for _, out := range comp.Outputs {
-		if strings.EqualFold(out.Name, cfg.Output.Name) {
-			cfg.Output.desc = &out
-			break
-		}
-	}
-	if cfg.Output.desc == nil {
-		return nil, fmt.Errorf("output does not exist: %q", cfg.Output.Name)
-	}
-
-	// Upload can be empty
-	for _, upl := range comp.Uploads {
-		if strings.EqualFold(upl.Name, cfg.Upload.Name) {
-			cfg.Upload.desc = &upl
-			break
-		}
-	}
-
-	if cfg.Metrics.Name != "" {
-		for _, mtr := range comp.Metrics {
-			if strings.EqualFold(mtr.Name, cfg.Metrics.Name) {
-				cfg.Metrics.desc = &mtr
-				break
-			}
-		}
-		if cfg.Metrics.desc == nil {
-			return nil, fmt.Errorf("metrics does not exist: %q", cfg.Metrics.Name)
-		}
+	if err := cfg.resolveComponents(comp); err != nil {
+		return nil, err
 	}
 
 	// Copy custom configuration structure, to prepare for re-reading
 	cfg.Input.DecodedConfig = cfg.Input.desc.Config
-	if err := decodeAndCheckConfig(md, cfg.Input); err != nil {
+	if err := decodeConfig(md, cfg.Input); err != nil {
 		return nil, err
 	}
 
 	for idx := range cfg.Filter {
 		// Clone the configuration object to allow the use of multiple instances of the same filter
 		cfg.Filter[idx].DecodedConfig = cloneConfig(cfg.Filter[idx].desc.Config)
-		if err := decodeAndCheckConfig(md, cfg.Filter[idx]); err != nil {
+		if err := decodeConfig(md, cfg.Filter[idx]); err != nil {
 			return nil, err
 		}
 	}
 
-	cfg.Output.DecodedConfig = cfg.Output.desc.Config
-	if err := decodeAndCheckConfig(md, cfg.Output); err != nil {
-		return nil, err
+	for idx := range cfg.Output {
+		// Clone the configuration object to allow the use of multiple instances of the same output
+		cfg.Output[idx].DecodedConfig = cloneConfig(cfg.Output[idx].desc.Config)
+		if err := decodeConfig(md, cfg.Output[idx]); err != nil {
+			return nil, err
+		}
 	}
 
 	if cfg.Upload.Name != "" {
 		cfg.Upload.DecodedConfig = cfg.Upload.desc.Config
-		if err := decodeAndCheckConfig(md, cfg.Upload); err != nil {
+		if err := decodeConfig(md, cfg.Upload); err != nil {
 			return nil, err
 		}
 	}
 
 	if cfg.Metrics.Name != "" {
 		cfg.Metrics.DecodedConfig = cfg.Metrics.desc.Config
-		if err := decodeAndCheckConfig(md, cfg.Metrics); err != nil {
+		if err := decodeConfig(md, cfg.Metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Record.desc != nil {
+		cfg.Record.DecodedConfig = cfg.Record.desc.Config
+		if err := decodeConfig(md, cfg.Record); err != nil {
 			return nil, err
 		}
 	}
@@ -399,19 +687,362 @@ func NewConfigFromToml(f io.Reader, comp Components) (*Config, error) {
 		return nil, fmt.Errorf("invalid keys in configuration file: %v", keys)
 	}
 
-	if err := assignFieldMapping(&cfg, comp); err != nil {
-		return nil, err
-	}
+	// A bad field mapping is reported along with the other errors.
+	mappingErr := assignFieldMapping(&cfg, comp)
 
 	// Copy pluggable functions
 	cfg.shardingFuncs = comp.ShardingFuncs
 	cfg.validate = comp.Validate
 	cfg.createRecord = comp.CreateRecord
+	cfg.spanExporter = comp.SpanExporter
+
+	if err := cfg.validateAfter(mappingErr); err != nil {
+		return nil, err
+	}
 
 	// Fill-in with missing defaults
 	return &cfg, cfg.fillDefaults()
 }
 
+// Validate checks the whole configuration, that is the [general] and [csv]
+// sections as well as the configuration of every component: required fields
+// must be set and configurations implementing ConfigValidator must be valid.
+// Validate doesn't stop at the first error, it returns all the errors it
+// found as a ConfigErrors.
+//
+// NewConfigFromToml and New both validate the configuration, so calling
+// Validate directly is rarely needed.
+func (c *Config) Validate() error {
+	return c.validateAfter(nil)
+}
+
+// validateAfter validates the configuration, like Validate, reporting prev
+// first if not nil.
+func (c *Config) validateAfter(prev error) error {
+	var errs ConfigErrors
+	if prev != nil {
+		errs = append(errs, prev)
+	}
+
+	if err := c.General.checkLogging(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.General.checkFieldCount(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.General.MaxRecordsPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("[general] max_records_per_second: must be positive, got %d", c.General.MaxRecordsPerSecond))
+	}
+	if c.General.FilterConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("[general] filter_concurrency: must be positive, got %d", c.General.FilterConcurrency))
+	}
+	if c.General.FilterConcurrency != 0 && c.FilterChain.Procs != 0 && c.General.FilterConcurrency != c.FilterChain.Procs {
+		errs = append(errs, fmt.Errorf("[general] filter_concurrency: conflicts with [filterchain] procs (%d and %d)", c.General.FilterConcurrency, c.FilterChain.Procs))
+	}
+	if c.General.MaxRecords < 0 {
+		errs = append(errs, fmt.Errorf("[general] max_records: must be positive, got %d", c.General.MaxRecords))
+	}
+	if c.General.MaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("[general] max_duration: must be positive, got %v", c.General.MaxDuration))
+	}
+	if c.General.TracingEndpoint != "" && !strings.HasPrefix(c.General.TracingEndpoint, "http://") && !strings.HasPrefix(c.General.TracingEndpoint, "https://") {
+		errs = append(errs, fmt.Errorf("[general] tracing_endpoint: must be an http or https URL, got %q", c.General.TracingEndpoint))
+	}
+	if c.General.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("[general] shutdown_timeout: must be positive, got %v", c.General.ShutdownTimeout))
+	}
+	if _, err := c.CSV.fieldSeparator(); err != nil {
+		errs = append(errs, fmt.Errorf("[csv] field_separator: %v", err))
+	}
+
+	fieldByName := c.fieldByName
+	if fieldByName == nil {
+		fieldByName = func(name string) (FieldIndex, bool) {
+			for i, n := range c.Fields.Names {
+				if n == name {
+					return FieldIndex(i), true
+				}
+			}
+			return 0, false
+		}
+	}
+
+	check := func(typ, name string, dcfg interface{}) {
+		if dcfg == nil {
+			return
+		}
+		if req := CheckRequiredFields(dcfg); req != "" {
+			errs = append(errs, fmt.Errorf("%s %q: %w", typ, name, ErrorRequiredField{req}))
+		}
+		if v, ok := dcfg.(ConfigValidator); ok {
+			if err := v.ValidateConfig(fieldByName); err != nil {
+				errs = append(errs, fmt.Errorf("%s %q: %v", typ, name, err))
+			}
+		}
+	}
+
+	check("input", c.Input.Name, c.Input.DecodedConfig)
+	for idx, f := range c.Filter {
+		check("filter", f.Name, f.DecodedConfig)
+		if f.BatchSize < 0 {
+			errs = append(errs, fmt.Errorf("[[filter]] #%d batchsize: must be positive, got %d", idx+1, f.BatchSize))
+		}
+		if f.BatchInterval < 0 {
+			errs = append(errs, fmt.Errorf("[[filter]] #%d batchinterval: must be positive, got %v", idx+1, f.BatchInterval))
+		}
+	}
+	for _, o := range c.Output {
+		check("output", o.Name, o.DecodedConfig)
+	}
+	if c.Upload.Name != "" {
+		check("upload", c.Upload.Name, c.Upload.DecodedConfig)
+	}
+	if c.Metrics.Name != "" {
+		check("metrics", c.Metrics.Name, c.Metrics.DecodedConfig)
+	}
+	if c.Record.desc != nil {
+		check("record", c.Record.desc.Name, c.Record.DecodedConfig)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ConfigErrors holds all the errors found in a configuration.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d errors in configuration:", len(e))
+	for _, err := range e {
+		sb.WriteString("\n\t")
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// Is reports whether any of the errors matches target, see errors.Is.
+func (e ConfigErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error that matches target, see errors.As.
+func (e ConfigErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConfigFromTomlFile creates a Config from the TOML configuration file at
+// path. comp describes all the existing components.
+//
+// The file can include other TOML files with a top-level include directive,
+// like include = ["common.toml"]. Relative paths are relative to the
+// directory of the including file. Included files are merged in order, then
+// the including file is merged on top of them, so that later keys override
+// earlier ones: tables are merged key by key while any other value, arrays of
+// tables included, is replaced. Environment variables are replaced in each
+// file before it's parsed, so that they can be used unquoted in included
+// files as well.
+func NewConfigFromTomlFile(path string, comp Components) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("errors opening config: %v", err)
+	}
+	buf = []byte(os.Expand(string(buf), os.Getenv))
+
+	// Files without includes are used as is. The configuration parsing then
+	// reports the errors, if any.
+	var probe struct {
+		Include interface{} `toml:"include"`
+	}
+	if _, err := toml.Decode(string(buf), &probe); err != nil || probe.Include == nil {
+		return newConfigFromToml(bytes.NewReader(buf), comp)
+	}
+
+	doc, err := loadTomlWithIncludes(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &bytes.Buffer{}
+	if err := toml.NewEncoder(merged).Encode(doc); err != nil {
+		return nil, fmt.Errorf("can't merge included configurations: %v", err)
+	}
+	return newConfigFromToml(merged, comp)
+}
+
+// loadTomlWithIncludes decodes the TOML file at path, merged on top of the
+// files it includes, once environment variables are replaced. stack holds the absolute paths of the files currently
+// being included, to detect cycles.
+func loadTomlWithIncludes(path string, stack []string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't include %q: %v", path, err)
+	}
+	for i := range stack {
+		if stack[i] == abs {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), abs)
+		}
+	}
+	stack = append(stack, abs)
+
+	buf, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return nil, fmt.Errorf("errors opening config: %v", err)
+	}
+	doc := make(map[string]interface{})
+	if _, err := toml.Decode(os.Expand(string(buf), os.Getenv), &doc); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", path, err)
+	}
+
+	includes, ok := doc["include"].([]interface{})
+	if _, exists := doc["include"]; exists && !ok {
+		return nil, fmt.Errorf("%q: include must be an array of file paths", path)
+	}
+	delete(doc, "include")
+
+	merged := make(map[string]interface{})
+	for _, inc := range includes {
+		incPath, ok := inc.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q: include must be an array of file paths", path)
+		}
+		if !filepath.IsAbs(incPath) {
+			incPath = filepath.Join(filepath.Dir(abs), incPath)
+		}
+		incDoc, err := loadTomlWithIncludes(incPath, stack)
+		if err != nil {
+			return nil, err
+		}
+		mergeTomlTables(merged, incDoc)
+	}
+	mergeTomlTables(merged, doc)
+
+	return merged, nil
+}
+
+// mergeTomlTables merges src into dst, recursively for tables present in both.
+func mergeTomlTables(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcTable, ok1 := v.(map[string]interface{})
+		dstTable, ok2 := dst[k].(map[string]interface{})
+		if ok1 && ok2 {
+			mergeTomlTables(dstTable, srcTable)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// resolveComponents matches the names of the components in c to the actual
+// component descriptions provided in comp.
+func (c *Config) resolveComponents(comp Components) error {
+	// Go through inputs, filters and outputs, and match the names to the
+	// actual object descriptions provided by each respective package.
+	// Through the description, we also acquire an instance to the actual
+	// custom configuration structure, that will be filled later.
+	for _, inp := range comp.Inputs {
+		if strings.EqualFold(inp.Name, c.Input.Name) {
+			c.Input.desc = &inp
+			break
+		}
+	}
+	if c.Input.desc == nil {
+		return fmt.Errorf("input does not exist: %q", c.Input.Name)
+	}
+
+	for idx := range c.Filter {
+		cfgfil := &c.Filter[idx]
+		for _, fil := range comp.Filters {
+			if strings.EqualFold(fil.Name, cfgfil.Name) {
+				cfgfil.desc = &fil
+				break
+			}
+		}
+		if cfgfil.desc == nil {
+			return fmt.Errorf("filter does not exist: %q", cfgfil.Name)
+		}
+	}
+
+	if len(c.Output) == 0 {
+		// Without output, the records are discarded by the first discarding
+		// output of the components, if any.
+		for _, out := range comp.Outputs {
+			if out.Discard {
+				log.Warnf("no [output] specified, the records are discarded by the %s output", out.Name)
+				c.Output = []ConfigOutput{{Name: out.Name}}
+				break
+			}
+		}
+		if len(c.Output) == 0 {
+			return fmt.Errorf("no [output] specified")
+		}
+	}
+	for idx := range c.Output {
+		cfgout := &c.Output[idx]
+		for _, out := range comp.Outputs {
+			if strings.EqualFold(out.Name, cfgout.Name) {
+				cfgout.desc = &out
+				break
+			}
+		}
+		if cfgout.desc == nil {
+			return fmt.Errorf("output does not exist: %q", cfgout.Name)
+		}
+	}
+
+	// Upload can be empty
+	for _, upl := range comp.Uploads {
+		if strings.EqualFold(upl.Name, c.Upload.Name) {
+			c.Upload.desc = &upl
+			break
+		}
+	}
+
+	if c.Metrics.Name != "" {
+		for _, mtr := range comp.Metrics {
+			if strings.EqualFold(mtr.Name, c.Metrics.Name) {
+				c.Metrics.desc = &mtr
+				break
+			}
+		}
+		if c.Metrics.desc == nil {
+			return fmt.Errorf("metrics does not exist: %q", c.Metrics.Name)
+		}
+	}
+
+	// LogLine is the default record type, it's not in comp.Records.
+	if c.General.RecordType != "" && !strings.EqualFold(c.General.RecordType, "LogLine") {
+		for _, rec := range comp.Records {
+			if strings.EqualFold(rec.Name, c.General.RecordType) {
+				c.Record.desc = &rec
+				break
+			}
+		}
+		if c.Record.desc == nil {
+			return fmt.Errorf("record type does not exist: %q", c.General.RecordType)
+		}
+		if comp.CreateRecord != nil {
+			return fmt.Errorf("[general] record_type %q can't be used along with Components.CreateRecord", c.General.RecordType)
+		}
+	}
+	return nil
+}
+
 // hasConfig returns true if the underlying structure has at least one field.
 func hasConfig(cfg interface{}) bool {
 	tf := reflect.TypeOf(cfg).Elem()
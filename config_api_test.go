@@ -9,6 +9,7 @@ import (
 	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/filter/filtertest"
 	"github.com/AdRoll/baker/input"
+	"github.com/AdRoll/baker/output/outputtest"
 )
 
 func TestRequiredFields(t *testing.T) {
@@ -194,3 +195,42 @@ name = "Dummy"
 	`
 	testNewConfigFromTOMLRequiredFields(t, "case insensitive", toml)
 }
+
+func TestNewTopologyComponentError(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="SQS"
+	[input.config]
+	QueuePrefixes=["queue-"]
+	FilePathFilter=".*"
+
+[output]
+name="Recorder"
+fields=["f0"]
+`
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{input.SQSDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid regexp is caught by the configuration validation, so make
+	// it invalid afterwards in order for NewSQS to fail.
+	cfg.Input.DecodedConfig.(*input.SQSConfig).FilePathFilter = "("
+
+	_, err = baker.NewTopologyFromConfig(cfg)
+	if err == nil {
+		t.Fatal("NewTopologyFromConfig: want an error")
+	}
+	for _, s := range []string{`input "SQS"`, "[input]", "FilePathFilter"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q doesn't mention %s", err, s)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package baker
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A ConfigSkeleton lists, by name, the components of the topology for which
+// WriteConfigSkeleton generates a configuration skeleton.
+type ConfigSkeleton struct {
+	Input   string
+	Filters []string
+	Outputs []string
+	Upload  string
+	Metrics string
+}
+
+// ParseConfigSkeleton parses a comma-separated list of components, each of
+// them having the form kind=name, where kind is either input, filter, output,
+// upload or metrics. For example:
+//
+//	input=SQS,filter=NotNull,output=FileWriter
+func ParseConfigSkeleton(s string) (ConfigSkeleton, error) {
+	var sk ConfigSkeleton
+	for _, comp := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(comp), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return sk, fmt.Errorf("invalid component %q, want kind=name", comp)
+		}
+		kind, name := strings.ToLower(kv[0]), kv[1]
+		switch kind {
+		case "input":
+			sk.Input = name
+		case "filter":
+			sk.Filters = append(sk.Filters, name)
+		case "output":
+			sk.Outputs = append(sk.Outputs, name)
+		case "upload":
+			sk.Upload = name
+		case "metrics":
+			sk.Metrics = name
+		default:
+			return sk, fmt.Errorf("invalid component kind %q", kv[0])
+		}
+	}
+	return sk, nil
+}
+
+// WriteConfigSkeleton writes to w a commented TOML configuration skeleton
+// for the components listed in sk, described in comp. The configuration keys
+// of a component are documented with their help message; required keys are
+// set to a placeholder value to be replaced while the others are commented
+// out and set to their default value.
+func WriteConfigSkeleton(w io.Writer, sk ConfigSkeleton, comp Components) error {
+	if sk.Input == "" {
+		return fmt.Errorf("config skeleton: an input is required")
+	}
+	if len(sk.Outputs) == 0 {
+		return fmt.Errorf("config skeleton: at least an output is required")
+	}
+
+	sw := &skeletonWriter{w: w}
+	sw.printf("[fields]\n")
+	sw.printf("# Names of the record fields, in order, unless the program provides them\n")
+	sw.printf("names = []\n")
+
+	inp, ok := findInputDesc(comp.Inputs, sk.Input)
+	if !ok {
+		return fmt.Errorf("input does not exist: %q", sk.Input)
+	}
+	sw.component("input", "[input]", inp.Name, inp.Help, inp.Config, "")
+
+	for _, name := range sk.Filters {
+		fil, ok := findFilterDesc(comp.Filters, name)
+		if !ok {
+			return fmt.Errorf("filter does not exist: %q", name)
+		}
+		sw.component("filter", "[[filter]]", fil.Name, fil.Help, fil.Config, "")
+	}
+
+	for _, name := range sk.Outputs {
+		out, ok := findOutputDesc(comp.Outputs, name)
+		if !ok {
+			return fmt.Errorf("output does not exist: %q", name)
+		}
+		extra := ""
+		if !out.Raw {
+			extra = "# Names of the record fields the output receives\nfields = []\n"
+		}
+		sw.component("output", "[[output]]", out.Name, out.Help, out.Config, extra)
+	}
+
+	if sk.Upload != "" {
+		upl, ok := findUploadDesc(comp.Uploads, sk.Upload)
+		if !ok {
+			return fmt.Errorf("upload does not exist: %q", sk.Upload)
+		}
+		sw.component("upload", "[upload]", upl.Name, upl.Help, upl.Config, "")
+	}
+
+	if sk.Metrics != "" {
+		mtr, ok := findMetricsDesc(comp.Metrics, sk.Metrics)
+		if !ok {
+			return fmt.Errorf("metrics does not exist: %q", sk.Metrics)
+		}
+		sw.component("metrics", "[metrics]", mtr.Name, "", mtr.Config, "")
+	}
+
+	return sw.err
+}
+
+// skeletonWriter writes a configuration skeleton, retaining the first error.
+type skeletonWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *skeletonWriter) printf(format string, args ...interface{}) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = fmt.Fprintf(sw.w, format, args...)
+}
+
+// comment writes s as TOML comments, with the given indentation. Single-line
+// texts are wrapped, others are kept as they've been formatted.
+func (sw *skeletonWriter) comment(indent, s string) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return
+	}
+	if !strings.Contains(s, "\n") {
+		s = wrapString(s, 80)
+	}
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimRight(l, " ")
+		if l == "" {
+			sw.printf("%s#\n", indent)
+			continue
+		}
+		sw.printf("%s# %s\n", indent, l)
+	}
+}
+
+// summary returns the first paragraph of a component help message.
+func summary(help string) string {
+	help = strings.TrimSpace(help)
+	if i := strings.Index(help, "\n\n"); i >= 0 {
+		help = help[:i]
+	}
+	return help
+}
+
+func (sw *skeletonWriter) component(kind, table, name, help string, cfg interface{}, extra string) {
+	if sw.err != nil {
+		return
+	}
+
+	sw.printf("\n")
+	sw.comment("", summary(help))
+	sw.printf("%s\n", table)
+	sw.printf("name = %q\n", name)
+	sw.printf("%s", extra)
+
+	if cfg == nil {
+		return
+	}
+	keys, err := configKeysFromStruct(cfg)
+	if err != nil {
+		sw.err = fmt.Errorf("%s %q: %v", kind, name, err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	const indent = "    "
+	sw.printf("\n%s[%s.config]\n", indent, kind)
+	for i, k := range keys {
+		if i > 0 {
+			sw.printf("\n")
+		}
+		sw.comment(indent, k.desc)
+		if k.required {
+			sw.printf("%s# Required\n", indent)
+			sw.printf("%s%s = %s\n", indent, k.name, skeletonPlaceholder(k))
+		} else {
+			sw.printf("%s# %s = %s\n", indent, k.name, skeletonDefault(k))
+		}
+	}
+}
+
+// skeletonPlaceholder returns the TOML placeholder value of a required key.
+func skeletonPlaceholder(k helpConfigKey) string {
+	switch k.typ {
+	case "string", "duration":
+		return `""`
+	case "array of strings", "array of ints":
+		return "[]"
+	case "bool":
+		return "false"
+	default:
+		return "0"
+	}
+}
+
+// skeletonDefault returns the TOML default value of an optional key.
+func skeletonDefault(k helpConfigKey) string {
+	if k.def == "" {
+		switch k.typ {
+		case "duration":
+			return `"0s"`
+		case "array of ints":
+			return "[]"
+		case "bool":
+			return "false"
+		default:
+			return "0"
+		}
+	}
+	if k.typ == "duration" {
+		return fmt.Sprintf("%q", k.def)
+	}
+	if k.typ == "string" && strings.Contains(k.def, `\`) {
+		// Use a literal string so that backslashes aren't escape sequences.
+		return "'" + strings.Trim(k.def, `"`) + "'"
+	}
+	// Strings are already quoted and arrays already in TOML syntax.
+	return k.def
+}
+
+func findInputDesc(descs []InputDesc, name string) (InputDesc, bool) {
+	for _, d := range descs {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return InputDesc{}, false
+}
+
+func findFilterDesc(descs []FilterDesc, name string) (FilterDesc, bool) {
+	for _, d := range descs {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return FilterDesc{}, false
+}
+
+func findOutputDesc(descs []OutputDesc, name string) (OutputDesc, bool) {
+	for _, d := range descs {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return OutputDesc{}, false
+}
+
+func findUploadDesc(descs []UploadDesc, name string) (UploadDesc, bool) {
+	for _, d := range descs {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return UploadDesc{}, false
+}
+
+func findMetricsDesc(descs []MetricsDesc, name string) (MetricsDesc, bool) {
+	for _, d := range descs {
+		if strings.EqualFold(d.Name, name) {
+			return d, true
+		}
+	}
+	return MetricsDesc{}, false
+}
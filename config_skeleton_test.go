@@ -0,0 +1,82 @@
+package baker_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter"
+	"github.com/AdRoll/baker/input"
+	"github.com/AdRoll/baker/output"
+	"github.com/AdRoll/baker/upload"
+	"github.com/rasky/toml"
+)
+
+func TestParseConfigSkeleton(t *testing.T) {
+	got, err := baker.ParseConfigSkeleton("input=SQS, filter=NotNull,filter=ClauseFilter,Output=FileWriter,upload=S3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := baker.ConfigSkeleton{
+		Input:   "SQS",
+		Filters: []string{"NotNull", "ClauseFilter"},
+		Outputs: []string{"FileWriter"},
+		Upload:  "S3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseConfigSkeleton() = %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"SQS", "input=", "source=SQS"} {
+		if _, err := baker.ParseConfigSkeleton(s); err == nil {
+			t.Errorf("ParseConfigSkeleton(%q) err = nil, want an error", s)
+		}
+	}
+}
+
+func TestWriteConfigSkeleton(t *testing.T) {
+	comp := baker.Components{
+		Inputs:  input.All,
+		Filters: filter.All,
+		Outputs: output.All,
+		Uploads: upload.All,
+	}
+
+	sk := baker.ConfigSkeleton{
+		Input:   "SQS",
+		Filters: []string{"NotNull"},
+		Outputs: []string{"FileWriter"},
+		Upload:  "S3",
+	}
+	buf := &bytes.Buffer{}
+	if err := baker.WriteConfigSkeleton(buf, sk, comp); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"[input]\nname = \"SQS\"\n",
+		"[[filter]]\nname = \"NotNull\"\n",
+		"[[output]]\nname = \"FileWriter\"\n",
+		"[upload]\nname = \"S3\"\n",
+		"    # Required\n    QueuePrefixes = []\n", // required key, with a placeholder
+		"    # AwsRegion = \"us-west-2\"\n",        // optional key, with its default
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("skeleton doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// The skeleton must be valid TOML.
+	var doc map[string]interface{}
+	if _, err := toml.Decode(out, &doc); err != nil {
+		t.Errorf("invalid TOML skeleton: %v", err)
+	}
+
+	sk.Input = "Unknown"
+	if err := baker.WriteConfigSkeleton(buf, sk, comp); err == nil {
+		t.Errorf("WriteConfigSkeleton() with an unknown input: err = nil, want an error")
+	}
+}
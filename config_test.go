@@ -1,9 +1,15 @@
 package baker
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func TestFillCreateRecordDefault(t *testing.T) {
@@ -226,3 +232,287 @@ func Test_assignFieldMapping(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigLogging(t *testing.T) {
+	tests := []struct {
+		name    string
+		general ConfigGeneral
+		wantErr bool
+	}{
+		{name: "default", general: ConfigGeneral{}},
+		{name: "level", general: ConfigGeneral{LogLevel: "debug"}},
+		{name: "level uppercase", general: ConfigGeneral{LogLevel: "WARN"}},
+		{name: "format json", general: ConfigGeneral{LogFormat: "json"}},
+		{name: "format text", general: ConfigGeneral{LogFormat: "Text"}},
+		{name: "invalid level", general: ConfigGeneral{LogLevel: "verbose"}, wantErr: true},
+		{name: "invalid format", general: ConfigGeneral{LogFormat: "logfmt"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{General: tt.general}
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Config.Validate() err = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigLoggingFromToml(t *testing.T) {
+	const src = `
+[general]
+log_level = "%s"
+log_format = "json"
+
+[input]
+name = "in"
+
+[output]
+name = "out"
+fields = ["f0"]
+
+[fields]
+names = ["f0"]
+`
+	comp := Components{
+		Inputs:  []InputDesc{{Name: "in", New: func(InputParams) (Input, error) { return &dummyInput{}, nil }, Config: &struct{}{}}},
+		Outputs: []OutputDesc{{Name: "out", New: func(OutputParams) (Output, error) { return nil, nil }, Config: &struct{}{}}},
+	}
+
+	if _, err := NewConfigFromToml(strings.NewReader(strings.Replace(src, "%s", "loud", 1)), comp); err == nil {
+		t.Fatalf("NewConfigFromToml() with an invalid log level: err = nil, want an error")
+	}
+
+	cfg, err := NewConfigFromToml(strings.NewReader(strings.Replace(src, "%s", "error", 1)), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(lvl log.Level, f log.Formatter) {
+		log.SetLevel(lvl)
+		log.SetFormatter(f)
+	}(log.GetLevel(), log.StandardLogger().Formatter)
+
+	cfg.General.applyLogging()
+	if lvl := log.GetLevel(); lvl != log.ErrorLevel {
+		t.Errorf("log level = %v, want %v", lvl, log.ErrorLevel)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Errorf("log formatter = %T, want *logrus.JSONFormatter", log.StandardLogger().Formatter)
+	}
+}
+
+// validatedConfig is a component configuration implementing ConfigValidator.
+type validatedConfig struct {
+	Field string
+}
+
+func (c *validatedConfig) ValidateConfig(fieldByName func(string) (FieldIndex, bool)) error {
+	if _, ok := fieldByName(c.Field); !ok {
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+	return nil
+}
+
+func TestConfigValidate(t *testing.T) {
+	const src = `
+[general]
+log_level = "%s"
+
+[input]
+name = "in"
+
+[[filter]]
+name = "fil"
+	[filter.config]
+	field = "%s"
+
+[output]
+name = "out"
+fields = ["f0"]
+
+[fields]
+names = ["f0", "f1"]
+`
+	comp := Components{
+		Inputs:  []InputDesc{{Name: "in", New: func(InputParams) (Input, error) { return &dummyInput{}, nil }, Config: &struct{}{}}},
+		Filters: []FilterDesc{{Name: "fil", New: func(FilterParams) (Filter, error) { return nil, nil }, Config: &validatedConfig{}}},
+		Outputs: []OutputDesc{{Name: "out", New: func(OutputParams) (Output, error) { return nil, nil }, Config: &struct{}{}}},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		toml := fmt.Sprintf(src, "info", "f1")
+		if _, err := NewConfigFromToml(strings.NewReader(toml), comp); err != nil {
+			t.Fatalf("NewConfigFromToml() err = %v, want nil", err)
+		}
+	})
+
+	t.Run("two errors", func(t *testing.T) {
+		toml := fmt.Sprintf(src, "verbose", "f2")
+		_, err := NewConfigFromToml(strings.NewReader(toml), comp)
+		if err == nil {
+			t.Fatal("NewConfigFromToml() err = nil, want an error")
+		}
+
+		var errs ConfigErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("NewConfigFromToml() err = %T, want ConfigErrors", err)
+		}
+		if len(errs) != 2 {
+			t.Fatalf("got %d errors, want 2:\n%v", len(errs), err)
+		}
+		for _, want := range []string{"log_level", `filter "fil": unknown field "f2"`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q doesn't contain %q", err, want)
+			}
+		}
+	})
+}
+
+func TestNewConfigFromTomlFileIncludes(t *testing.T) {
+	comp := Components{
+		Inputs:  []InputDesc{{Name: "in", New: func(InputParams) (Input, error) { return &dummyInput{}, nil }, Config: &struct{}{}}},
+		Outputs: []OutputDesc{{Name: "out", New: func(OutputParams) (Output, error) { return nil, nil }, Config: &struct{}{}}},
+	}
+
+	writeFiles := func(t *testing.T, files map[string]string) string {
+		t.Helper()
+		dir := t.TempDir()
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	t.Run("override", func(t *testing.T) {
+		defer os.Unsetenv("BAKER_TEST_LOG_FORMAT")
+		os.Setenv("BAKER_TEST_LOG_FORMAT", "json")
+
+		dir := writeFiles(t, map[string]string{
+			"common.toml": `
+[general]
+log_level = "warn"
+log_format = "text"
+dont_validate_fields = true
+
+[fields]
+names = ["f0", "f1"]
+`,
+			"main.toml": `
+include = ["common.toml"]
+
+[general]
+log_level = "debug"
+log_format = "${BAKER_TEST_LOG_FORMAT}"
+
+[input]
+name = "in"
+
+[output]
+name = "out"
+fields = ["f1"]
+`,
+		})
+
+		cfg, err := NewConfigFromTomlFile(filepath.Join(dir, "main.toml"), comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ConfigGeneral{LogLevel: "debug", LogFormat: "json", DontValidateFields: true}
+		if cfg.General != want {
+			t.Errorf("[general] = %+v, want %+v", cfg.General, want)
+		}
+		if got := cfg.Fields.Names; len(got) != 2 || got[1] != "f1" {
+			t.Errorf("[fields] names = %v, want [f0 f1]", got)
+		}
+	})
+
+	t.Run("unquoted env var in included file", func(t *testing.T) {
+		defer os.Unsetenv("BAKER_TEST_DONT_VALIDATE")
+		os.Setenv("BAKER_TEST_DONT_VALIDATE", "true")
+
+		dir := writeFiles(t, map[string]string{
+			"common.toml": `
+[general]
+dont_validate_fields = ${BAKER_TEST_DONT_VALIDATE}
+
+[fields]
+names = ["f0", "f1"]
+`,
+			"main.toml": `
+include = ["common.toml"]
+
+[input]
+name = "in"
+
+[output]
+name = "out"
+fields = ["f1"]
+`,
+		})
+
+		cfg, err := NewConfigFromTomlFile(filepath.Join(dir, "main.toml"), comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.General.DontValidateFields {
+			t.Errorf("[general] dont_validate_fields = false, want true")
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"a.toml":    `include = ["b.toml"]`,
+			"b.toml":    `include = ["a.toml"]`,
+			"main.toml": `include = ["a.toml"]`,
+		})
+
+		_, err := NewConfigFromTomlFile(filepath.Join(dir, "main.toml"), comp)
+		if err == nil || !strings.Contains(err.Error(), "include cycle") {
+			t.Fatalf("NewConfigFromTomlFile() err = %v, want an include cycle error", err)
+		}
+	})
+
+	t.Run("missing include", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"main.toml": `include = ["missing.toml"]`,
+		})
+
+		if _, err := NewConfigFromTomlFile(filepath.Join(dir, "main.toml"), comp); err == nil {
+			t.Fatal("NewConfigFromTomlFile() err = nil, want an error")
+		}
+	})
+}
+
+func TestConfigDefaultOutput(t *testing.T) {
+	newOutput := func(OutputParams) (Output, error) { return nil, nil }
+	comp := Components{
+		Inputs: []InputDesc{{Name: "in", New: func(InputParams) (Input, error) { return &dummyInput{}, nil }, Config: &struct{}{}}},
+		Outputs: []OutputDesc{
+			{Name: "Null", New: newOutput, Config: &struct{}{}},
+			{Name: "Drop", New: newOutput, Config: &struct{}{}, Discard: true},
+		},
+	}
+	toml := `
+[fields]
+names = ["f0"]
+
+[input]
+name = "in"
+`
+	cfg, err := NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Output) != 1 || cfg.Output[0].Name != "Drop" {
+		t.Errorf("outputs = %+v, want the Drop output", cfg.Output)
+	}
+
+	comp.Outputs = comp.Outputs[:1]
+	if _, err := NewConfigFromToml(strings.NewReader(toml), comp); err == nil {
+		t.Errorf("NewConfigFromToml without discarding output: got no error")
+	}
+}
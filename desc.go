@@ -1,5 +1,7 @@
 package baker
 
+import "github.com/AdRoll/baker/pkg/tracing"
+
 // Components holds the descriptions of all components one can use
 // to build a topology.
 type Components struct {
@@ -10,6 +12,7 @@ type Components struct {
 
 	Metrics []MetricsDesc // Metrics represents the list of available metrics clients
 	User    []UserDesc    // User represents the list of user-defined configurations
+	Records []RecordDesc  // Records represents the list of available record types, besides LogLine
 
 	ShardingFuncs map[FieldIndex]ShardingFunc // ShardingFuncs are functions to calculate sharding based on field index
 	Validate      ValidationFunc              // Validate is the function used to validate a Record
@@ -17,6 +20,8 @@ type Components struct {
 
 	FieldByName func(string) (FieldIndex, bool) // FieldByName gets a field index by its name
 	FieldName   func(FieldIndex) string         // FieldName gets a field name by its index
+
+	SpanExporter tracing.Exporter // SpanExporter, if set, enables tracing and exports the spans, instead of [general] tracing_endpoint
 }
 
 // ComponentParams holds the common configuration parameters passed to components of all kinds.
@@ -27,6 +32,8 @@ type ComponentParams struct {
 	FieldName      func(FieldIndex) string         // returns the name of a field given its index in the Record
 	ValidateRecord ValidationFunc                  // function to validate a record
 	Metrics        MetricsClient                   // Metrics allows components to add code instrumentation and have metrics exported to the configured backend, if any?
+	ReportError    ErrorReporter                   // ReportError reports per-record errors to the topology (filters and outputs)
+	Tracer         *tracing.Tracer                 // Tracer starts the spans of the processing of the input files (inputs only), nil if tracing is disabled
 }
 
 // InputParams holds the parameters passed to Input constructor.
@@ -82,11 +89,12 @@ type FilterDesc struct {
 
 // OutputDesc describes an Output component to the topology.
 type OutputDesc struct {
-	Name   string                             // Name of the output
-	New    func(OutputParams) (Output, error) // New is the constructor-like function called by the topology to create a new output
-	Config interface{}                        // Config is the component configuration
-	Raw    bool                               // Raw reports whether the output accepts a raw record
-	Help   string                             // Help string
+	Name    string                             // Name of the output
+	New     func(OutputParams) (Output, error) // New is the constructor-like function called by the topology to create a new output
+	Config  interface{}                        // Config is the component configuration
+	Raw     bool                               // Raw reports whether the output accepts a raw record
+	Discard bool                               // Discard reports whether the output discards the records: it needs no fields and is used by the topologies without [output]
+	Help    string                             // Help string
 }
 
 // UploadDesc describes an Upload component to the topology.
@@ -104,6 +112,22 @@ type MetricsDesc struct {
 	New    func(interface{}) (MetricsClient, error) // New is the constructor-like function called by the topology to create a new metrics client
 }
 
+// RecordParams holds the parameters passed to the RecordDesc constructor.
+type RecordParams struct {
+	DecodedConfig interface{}                     // decoded record-specific struct (from the [record.config] section)
+	FieldByName   func(string) (FieldIndex, bool) // translates field names to Record indexes
+	FieldName     func(FieldIndex) string         // returns the name of a field given its index in the Record
+}
+
+// RecordDesc describes a Record implementation to the topology, which uses it
+// instead of LogLine when it's selected by [general] record_type.
+type RecordDesc struct {
+	Name   string                                    // Name of the record type
+	New    func(RecordParams) (func() Record, error) // New returns the factory function creating new empty records
+	Config interface{}                               // Config is the record type configuration
+	Help   string                                    // Help string
+}
+
 // UserDesc describes user-specific configuration sections.
 type UserDesc struct {
 	Name   string
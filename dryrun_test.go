@@ -0,0 +1,134 @@
+package baker_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+type dryRunConfig struct {
+	Name     string        `required:"true"`
+	Interval time.Duration `default:"1m"`
+	Fail     bool
+}
+
+func dryRunComponents() baker.Components {
+	return baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{{
+			Name: "Dry",
+			New: func(cfg baker.FilterParams) (baker.Filter, error) {
+				dcfg := cfg.DecodedConfig.(*dryRunConfig)
+				if dcfg.Fail {
+					return nil, errors.New("filter failure")
+				}
+				if dcfg.Interval == 0 {
+					dcfg.Interval = time.Minute
+				}
+				return &filtertest.Base{}, nil
+			},
+			Config: &dryRunConfig{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	const toml = `
+[fields]
+names = ["f0", "f1"]
+
+[input]
+name = "LogLine"
+
+[[filter]]
+name = "Dry"
+	[filter.config]
+	name = "${DRYRUN_NAME}"
+
+[output]
+name = "Recorder"
+fields = ["f1"]
+`
+	defer os.Unsetenv("DRYRUN_NAME")
+	os.Setenv("DRYRUN_NAME", "dry")
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), dryRunComponents())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := baker.DryRun(cfg, buf); err != nil {
+		t.Fatalf("DryRun() err = %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		`Name = "dry"`,      // environment variable has been replaced
+		`Interval = "1m0s"`, // component default
+		`procs = 32`,        // output default
+		`chansize = 1024`,   // input default
+		`fields = ["f1"]`,   // output fields
+		`names = ["f0", "f1"]`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("resolved configuration doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// The resolved configuration must be valid as well.
+	if _, err := baker.NewConfigFromToml(strings.NewReader(out), dryRunComponents()); err != nil {
+		t.Errorf("can't parse resolved configuration: %v\n%s", err, out)
+	}
+}
+
+func TestDryRunErrors(t *testing.T) {
+	const toml = `
+[fields]
+names = ["f0"]
+
+[input]
+name = "LogLine"
+
+[[filter]]
+name = "Dry"
+	[filter.config]
+	%s
+
+[output]
+name = "Recorder"
+fields = ["f0"]
+`
+
+	t.Run("missing required field", func(t *testing.T) {
+		_, err := baker.NewConfigFromToml(strings.NewReader(strings.Replace(toml, "%s", "", 1)), dryRunComponents())
+		var errReq baker.ErrorRequiredField
+		if !errors.As(err, &errReq) {
+			t.Fatalf("NewConfigFromToml() err = %v, want a ErrorRequiredField", err)
+		}
+	})
+
+	t.Run("component error", func(t *testing.T) {
+		cfg, err := baker.NewConfigFromToml(strings.NewReader(strings.Replace(toml, "%s", `name = "dry"`+"\n\tfail = true", 1)), dryRunComponents())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := baker.DryRun(cfg, buf); err == nil || !strings.Contains(err.Error(), "filter failure") {
+			t.Fatalf("DryRun() err = %v, want filter failure", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("DryRun() wrote %q, want nothing", buf)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package baker_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// channelInput is an input sending the buffers it receives from a channel into
+// the topology, until the channel is closed.
+type channelInput struct {
+	inputtest.Base
+	ch chan []byte
+}
+
+func (in *channelInput) Run(output chan<- *baker.Data) error {
+	for buf := range in.ch {
+		output <- &baker.Data{Bytes: buf}
+	}
+	return nil
+}
+
+// This example shows how to embed baker in a program, building and running a
+// topology without TOML configuration nor MainCLI.
+func ExampleNew() {
+	in := &channelInput{ch: make(chan []byte)}
+
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{filtertest.PassThroughDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+
+	cfg := baker.Config{
+		Input:  baker.ConfigInput{Name: "Channel"},
+		Filter: []baker.ConfigFilter{{Name: "PassThrough"}},
+		// A single filter chain process keeps the records in order.
+		FilterChain: baker.ConfigFilterChain{Procs: 1},
+		Output:      []baker.ConfigOutput{{Name: "Recorder", Procs: 1, Fields: []string{"name", "city"}}},
+		Fields:      baker.ConfigFields{Names: []string{"name", "age", "city"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	topo.Start()
+	in.ch <- []byte("alice,31,paris\nbob,27,rome\n")
+	in.ch <- []byte("carol,45,tokyo\n")
+	close(in.ch)
+	topo.Wait()
+
+	for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+		fmt.Println(r.Fields)
+	}
+
+	// Output:
+	// [alice paris]
+	// [bob rome]
+	// [carol tokyo]
+}
+
+func TestNewErrors(t *testing.T) {
+	type requiredConfig struct {
+		Value string `required:"true"`
+	}
+
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.RecordsDesc},
+		Filters: []baker.FilterDesc{{
+			Name:   "Required",
+			New:    func(baker.FilterParams) (baker.Filter, error) { return filtertest.Base{}, nil },
+			Config: &requiredConfig{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	fields := baker.ConfigFields{Names: []string{"f0"}}
+
+	tests := []struct {
+		name string
+		cfg  baker.Config
+	}{
+		{
+			name: "unknown input",
+			cfg: baker.Config{
+				Input:  baker.ConfigInput{Name: "Unknown"},
+				Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}}},
+				Fields: fields,
+			},
+		},
+		{
+			name: "no output",
+			cfg: baker.Config{
+				Input:  baker.ConfigInput{Name: "Records"},
+				Fields: fields,
+			},
+		},
+		{
+			name: "missing required field",
+			cfg: baker.Config{
+				Input:  baker.ConfigInput{Name: "Records"},
+				Filter: []baker.ConfigFilter{{Name: "Required"}},
+				Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}}},
+				Fields: fields,
+			},
+		},
+		{
+			name: "unknown output field",
+			cfg: baker.Config{
+				Input:  baker.ConfigInput{Name: "Records"},
+				Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f1"}}},
+				Fields: fields,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := baker.New(comp, tt.cfg); err == nil {
+				t.Errorf("New() err = nil, want an error")
+			}
+		})
+	}
+
+	// A provided DecodedConfig is used as is.
+	cfg := baker.Config{
+		Input:  baker.ConfigInput{Name: "Records"},
+		Filter: []baker.ConfigFilter{{Name: "Required", DecodedConfig: &requiredConfig{Value: "v"}}},
+		Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}}},
+		Fields: fields,
+	}
+	if _, err := baker.New(comp, cfg); err != nil {
+		t.Errorf("New() err = %v, want nil", err)
+	}
+}
@@ -0,0 +1,97 @@
+package baker_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+func TestTopologyFanOut(t *testing.T) {
+	toml := `
+[fields]
+names=["id", "list"]
+
+[input]
+name="Records"
+
+[[filter]]
+name="Explode"
+
+	[filter.config]
+	field="list"
+	separator=";"
+
+[output]
+name="Recorder"
+procs=1
+fields=["id", "list"]
+
+[metrics]
+name="recorder"
+`
+	metrics := &recordingMetrics{}
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+		Filters: []baker.FilterDesc{filter.ExplodeDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+		Metrics: []baker.MetricsDesc{{
+			Name:   "recorder",
+			New:    func(interface{}) (baker.MetricsClient, error) { return metrics, nil },
+			Config: &struct{}{},
+		}},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 records exploding in 0, 1 and 4 records.
+	in := topology.Input.(*inputtest.Records)
+	for i, list := range []string{"", "a", "a;b;c;d"} {
+		ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		ll.Set(0, []byte{'0' + byte(i)})
+		ll.Set(1, []byte(list))
+		in.Records = append(in.Records, &ll)
+	}
+
+	sd := baker.NewStatsDumper(topology)
+	sd.SetWriter(ioutil.Discard)
+	stop := sd.Run()
+
+	topology.Start()
+	topology.Wait()
+
+	// StatsDumper does not print anything the first second
+	time.Sleep(1050 * time.Millisecond)
+	stop()
+
+	var got []string
+	for _, r := range topology.Output[0].(*outputtest.Recorder).Records {
+		got = append(got, strings.Join(r.Fields, ":"))
+	}
+	want := "1:a 2:a 2:b 2:c 2:d"
+	if strings.Join(got, " ") != want {
+		t.Errorf("output records = %q, want %q", strings.Join(got, " "), want)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if got := metrics.counters["emitted_lines"]; got != 5 {
+		t.Errorf("emitted_lines = %d, want 5", got)
+	}
+	if got := metrics.counters["filtered_lines"]; got != 1 {
+		t.Errorf("filtered_lines = %d, want 1", got)
+	}
+}
@@ -0,0 +1,109 @@
+package baker_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+func TestFieldCount(t *testing.T) {
+	const lines = "a,b,c\nd,e\nf,g,h,i\nj\n"
+
+	tests := []struct {
+		name    string
+		general baker.ConfigGeneral
+		want    []string // first field of the output records
+	}{
+		{
+			name: "no check",
+			want: []string{"a", "d", "f", "j"},
+		},
+		{
+			name:    "min fields strict",
+			general: baker.ConfigGeneral{MinFields: 3},
+			want:    []string{"a", "f"},
+		},
+		{
+			name:    "expected fields strict",
+			general: baker.ConfigGeneral{ExpectedFields: 3},
+			want:    []string{"a"},
+		},
+		{
+			name:    "min fields lenient",
+			general: baker.ConfigGeneral{MinFields: 3, DontValidateFields: true},
+			want:    []string{"a", "d", "f", "j"},
+		},
+		{
+			name:    "expected fields lenient",
+			general: baker.ConfigGeneral{ExpectedFields: 3, DontValidateFields: true},
+			want:    []string{"a", "d", "f", "j"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &channelInput{ch: make(chan []byte, 1)}
+			comp := baker.Components{
+				Inputs: []baker.InputDesc{{
+					Name:   "Channel",
+					New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+					Config: &struct{}{},
+				}},
+				Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+			}
+			cfg := baker.Config{
+				General:     tt.general,
+				Input:       baker.ConfigInput{Name: "Channel"},
+				FilterChain: baker.ConfigFilterChain{Procs: 1},
+				Output:      []baker.ConfigOutput{{Name: "Recorder", Procs: 1, Fields: []string{"f0"}}},
+				Fields:      baker.ConfigFields{Names: []string{"f0", "f1", "f2", "f3"}},
+			}
+
+			topo, err := baker.New(comp, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topo.Start()
+			in.ch <- []byte(lines)
+			close(in.ch)
+			topo.Wait()
+			if err := topo.Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+				got = append(got, r.Fields[0])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldCountConfigErrors(t *testing.T) {
+	comp := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+
+	for _, general := range []baker.ConfigGeneral{
+		{MinFields: -1},
+		{ExpectedFields: int(baker.LogLineNumFields) + 1},
+		{MinFields: 4, ExpectedFields: 3},
+	} {
+		cfg := baker.Config{
+			General: general,
+			Input:   baker.ConfigInput{Name: "Records"},
+			Output:  []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}}},
+			Fields:  baker.ConfigFields{Names: []string{"f0"}},
+		}
+		if _, err := baker.New(comp, cfg); err == nil {
+			t.Errorf("baker.New() with %+v: err = nil, want an error", general)
+		}
+	}
+}
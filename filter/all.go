@@ -7,14 +7,29 @@ import (
 
 // All is the list of all baker filters.
 var All = []baker.FilterDesc{
+	ChecksumDesc,
 	ClauseFilterDesc,
 	ClearFieldsDesc,
 	ConcatenateDesc,
+	DropAllDesc,
+	ExplodeDesc,
+	ExprDesc,
+	IdentityDesc,
+	JSONExpandDesc,
+	JSONPackDesc,
+	LookupDesc,
+	NormalizeDesc,
 	NotNullDesc,
+	RedactDesc,
+	RegexExtractDesc,
 	RegexMatchDesc,
 	ReplaceFieldsDesc,
 	SetStringFromURLDesc,
+	StopChainDesc,
 	StringMatchDesc,
+	TemplateDesc,
+	TTLDesc,
 	TimestampDesc,
 	TimestampRangeDesc,
+	TokenizeDesc,
 }
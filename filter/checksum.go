@@ -0,0 +1,112 @@
+package filter
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// ChecksumDesc describes the Checksum filter
+var ChecksumDesc = baker.FilterDesc{
+	Name:   "Checksum",
+	New:    NewChecksum,
+	Config: &ChecksumConfig{},
+	Help: "Write into a field the hex-encoded checksum of the record, so that downstream consumers\n" +
+		"can detect corrupted records. The checksum is computed either over the text of the whole\n" +
+		"record, or over the values of a selection of fields.",
+}
+
+// ChecksumConfig holds config parameters of the Checksum filter.
+type ChecksumConfig struct {
+	Algorithm string   `help:"Checksum algorithm, either crc32 (IEEE) or sha1" default:"crc32"`
+	Fields    []string `help:"Names of the fields the checksum is computed over, in order. If empty, the checksum is computed over the whole record"`
+	DstField  string   `help:"Name of the field the checksum is written to" required:"true"`
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32": func() hash.Hash { return crc32.NewIEEE() },
+	"sha1":  sha1.New,
+}
+
+// Checksum filter writes a checksum of a record into one of its fields.
+type Checksum struct {
+	processed int64
+
+	newHash func() hash.Hash
+	fields  []baker.FieldIndex // nil: the whole record
+	dst     baker.FieldIndex
+}
+
+// NewChecksum returns a Checksum filter.
+func NewChecksum(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &ChecksumConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*ChecksumConfig)
+
+	algo := strings.ToLower(dcfg.Algorithm)
+	if algo == "" {
+		algo = "crc32"
+	}
+	newHash, ok := checksumAlgorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("Checksum: unsupported algorithm %q", dcfg.Algorithm)
+	}
+
+	dst, ok := cfg.FieldByName(dcfg.DstField)
+	if !ok {
+		return nil, fmt.Errorf("Checksum: unknown field %s", dcfg.DstField)
+	}
+
+	f := &Checksum{
+		newHash: newHash,
+		dst:     dst,
+	}
+	for _, name := range dcfg.Fields {
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Checksum: Fields: unknown field %s", name)
+		}
+		f.fields = append(f.fields, fidx)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *Checksum) Stats() baker.FilterStats {
+	return baker.FilterStats{NumProcessedLines: atomic.LoadInt64(&f.processed)}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Checksum) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	h := f.newHash()
+	if f.fields == nil {
+		h.Write(l.ToText(nil))
+	} else {
+		// Prefix each value with its length, so that moving bytes from one
+		// field to the next changes the checksum.
+		var n [binary.MaxVarintLen64]byte
+		for _, fidx := range f.fields {
+			val := l.Get(fidx)
+			h.Write(n[:binary.PutUvarint(n[:], uint64(len(val)))])
+			h.Write(val)
+		}
+	}
+
+	sum := h.Sum(nil)
+	buf := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(buf, sum)
+
+	l.Set(f.dst, buf)
+	next(l)
+}
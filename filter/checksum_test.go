@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestChecksum(t *testing.T) {
+	fields := []string{"foo", "bar", "baz", "sum"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	checksum := func(t *testing.T, cfg *ChecksumConfig, record ...string) string {
+		t.Helper()
+		f, err := NewChecksum(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: cfg,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l := &baker.LogLine{FieldSeparator: ','}
+		if err := l.Parse([]byte(strings.Join(record, ",")), nil); err != nil {
+			t.Fatal(err)
+		}
+		kept := false
+		f.Process(l, func(baker.Record) { kept = true })
+		if !kept {
+			t.Fatal("record discarded")
+		}
+		return string(l.Get(3))
+	}
+
+	tests := []struct {
+		name    string
+		cfg     ChecksumConfig
+		wantLen int
+	}{
+		{name: "crc32 whole record", cfg: ChecksumConfig{DstField: "sum"}, wantLen: 8},
+		{name: "sha1 whole record", cfg: ChecksumConfig{Algorithm: "SHA1", DstField: "sum"}, wantLen: 40},
+		{name: "crc32 fields", cfg: ChecksumConfig{Algorithm: "crc32", Fields: []string{"foo", "bar"}, DstField: "sum"}, wantLen: 8},
+		{name: "sha1 fields", cfg: ChecksumConfig{Algorithm: "sha1", Fields: []string{"foo", "bar"}, DstField: "sum"}, wantLen: 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum1 := checksum(t, &tt.cfg, "a", "b", "c")
+			sum2 := checksum(t, &tt.cfg, "a", "b", "c")
+			if sum1 != sum2 {
+				t.Errorf("identical records have different checksums %q and %q", sum1, sum2)
+			}
+			if len(sum1) != tt.wantLen {
+				t.Errorf("checksum %q has length %d, want %d", sum1, len(sum1), tt.wantLen)
+			}
+
+			if sum := checksum(t, &tt.cfg, "a", "x", "c"); sum == sum1 {
+				t.Errorf("changing an included field didn't change the checksum %q", sum)
+			}
+
+			sum := checksum(t, &tt.cfg, "a", "b", "x")
+			if tt.cfg.Fields == nil && sum == sum1 {
+				t.Errorf("changing a field didn't change the whole record checksum %q", sum)
+			}
+			if tt.cfg.Fields != nil && sum != sum1 {
+				t.Errorf("changing an excluded field changed the checksum from %q to %q", sum1, sum)
+			}
+		})
+	}
+
+	t.Run("field boundaries", func(t *testing.T) {
+		cfg := &ChecksumConfig{Fields: []string{"foo", "bar"}, DstField: "sum"}
+		if checksum(t, cfg, "ab", "c") == checksum(t, cfg, "a", "bc") {
+			t.Error("moving bytes between fields didn't change the checksum")
+		}
+	})
+
+	t.Run("known value", func(t *testing.T) {
+		// crc32 (IEEE) of "a,b,c"
+		cfg := &ChecksumConfig{DstField: "sum"}
+		if got, want := checksum(t, cfg, "a", "b", "c"), "2e4dfd64"; got != want {
+			t.Errorf("checksum = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestChecksumErrors(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		return 0, name == "foo"
+	}
+
+	for _, cfg := range []ChecksumConfig{
+		{Algorithm: "md5", DstField: "foo"},
+		{DstField: "nope"},
+		{Fields: []string{"nope"}, DstField: "foo"},
+	} {
+		cfg := cfg
+		_, err := NewChecksum(baker.FilterParams{
+			ComponentParams: baker.ComponentParams{
+				FieldByName:   fieldByName,
+				DecodedConfig: &cfg,
+			},
+		})
+		if err == nil {
+			t.Errorf("NewChecksum(%+v): err = nil, want an error", cfg)
+		}
+	}
+}
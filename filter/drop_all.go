@@ -0,0 +1,43 @@
+package filter
+
+import (
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// DropAllDesc describes the DropAll filter.
+var DropAllDesc = baker.FilterDesc{
+	Name:   "DropAll",
+	New:    NewDropAll,
+	Config: &DropAllConfig{},
+	Help: "Discard all records, counting them. Useful to load-test an input without output,\n" +
+		"or to disable a branch of a topology from its configuration.",
+}
+
+// DropAllConfig holds configuration parameters for the DropAll filter.
+type DropAllConfig struct{}
+
+// DropAll is a baker filter that discards all records.
+type DropAll struct {
+	numProcessedLines int64
+}
+
+// NewDropAll creates a new DropAll filter.
+func NewDropAll(cfg baker.FilterParams) (baker.Filter, error) {
+	return &DropAll{}, nil
+}
+
+// Stats implements baker.Filter.
+func (f *DropAll) Stats() baker.FilterStats {
+	n := atomic.LoadInt64(&f.numProcessedLines)
+	return baker.FilterStats{
+		NumProcessedLines: n,
+		NumFilteredLines:  n,
+	}
+}
+
+// Process implements baker.Filter.
+func (f *DropAll) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+}
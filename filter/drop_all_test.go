@@ -0,0 +1,29 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestDropAll(t *testing.T) {
+	f, err := NewDropAll(baker.FilterParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const nrecords = 10
+	emitted := 0
+	for i := 0; i < nrecords; i++ {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Parse([]byte("a,b,c"), nil)
+		f.Process(l, func(baker.Record) { emitted++ })
+	}
+
+	if emitted != 0 {
+		t.Errorf("emitted %d records, want 0", emitted)
+	}
+	if stats := f.Stats(); stats.NumProcessedLines != nrecords || stats.NumFilteredLines != nrecords {
+		t.Errorf("processed, filtered = %d, %d, want %d, %d", stats.NumProcessedLines, stats.NumFilteredLines, nrecords, nrecords)
+	}
+}
@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// ExplodeDesc describes the Explode filter
+var ExplodeDesc = baker.FilterDesc{
+	Name:   "Explode",
+	New:    NewExplode,
+	Config: &ExplodeConfig{},
+	Help: "Split the value of a field into a list of elements, and emit a copy of the record per element,\n" +
+		"with the field set to that element. Empty elements are ignored, so records where the field is\n" +
+		"empty, or only contains separators, are discarded.",
+}
+
+// ExplodeConfig holds config parameters of the Explode filter.
+type ExplodeConfig struct {
+	Field     string `help:"Name of the field containing the list of elements" required:"true"`
+	Separator string `help:"Separator between elements in the field" default:","`
+}
+
+func (cfg *ExplodeConfig) fillDefaults() {
+	if cfg.Separator == "" {
+		cfg.Separator = ","
+	}
+}
+
+// Explode filter emits a record per element of a list field.
+type Explode struct {
+	numProcessedLines int64
+	numFilteredLines  int64
+	numEmitted        int64
+
+	field baker.FieldIndex
+	sep   []byte
+}
+
+// NewExplode returns an Explode filter.
+func NewExplode(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &ExplodeConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*ExplodeConfig)
+	dcfg.fillDefaults()
+
+	field, ok := cfg.FieldByName(dcfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("Explode: unknown field %s", dcfg.Field)
+	}
+
+	return &Explode{field: field, sep: []byte(dcfg.Separator)}, nil
+}
+
+// Stats returns filter statistics.
+func (f *Explode) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("explode.emitted", atomic.LoadInt64(&f.numEmitted))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.numProcessedLines),
+		NumFilteredLines:  atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Explode) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+
+	elems := bytes.Split(l.Get(f.field), f.sep)
+	n := 0
+	for _, e := range elems {
+		if len(e) != 0 {
+			elems[n] = e
+			n++
+		}
+	}
+	elems = elems[:n]
+
+	if len(elems) == 0 {
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	}
+	atomic.AddInt64(&f.numEmitted, int64(len(elems)))
+
+	// Send copies for all elements but the last one, for which we can reuse
+	// the original record.
+	last := len(elems) - 1
+	for _, e := range elems[:last] {
+		cpy := l.Copy()
+		cpy.Set(f.field, e)
+		next(cpy)
+	}
+	l.Set(f.field, elems[last])
+	next(l)
+}
@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestExplode(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    string
+		separator string
+
+		want    []string // values of field bar in emitted records
+		wantErr bool
+	}{
+		{
+			name:   "single element",
+			record: "abc,x,ghi",
+			want:   []string{"x"},
+		},
+		{
+			name:      "many elements",
+			record:    "abc,x;y;z;w,ghi",
+			separator: ";",
+			want:      []string{"x", "y", "z", "w"},
+		},
+		{
+			name:      "multi-char separator",
+			record:    "abc,x::y::z,ghi",
+			separator: "::",
+			want:      []string{"x", "y", "z"},
+		},
+		{
+			name:      "empty elements are ignored",
+			record:    "abc,;x;;y;,ghi",
+			separator: ";",
+			want:      []string{"x", "y"},
+		},
+		{
+			name:      "empty field",
+			record:    "abc,,ghi",
+			separator: ";",
+			want:      nil,
+		},
+		{
+			name:      "only separators",
+			record:    "abc,;;;,ghi",
+			separator: ";",
+			want:      nil,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "bar":
+			return 1, true
+		case "baz":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewExplode(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &ExplodeConfig{
+						Field:     "bar",
+						Separator: tt.separator,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+
+			// Check the emitted records once all have been emitted, to
+			// ensure they don't share the exploded field.
+			var emitted []baker.Record
+			f.Process(l, func(r baker.Record) { emitted = append(emitted, r) })
+
+			var got []string
+			for _, r := range emitted {
+				got = append(got, string(r.Get(1)))
+				if string(r.Get(0)) != "abc" || string(r.Get(2)) != "ghi" {
+					t.Errorf("other fields modified: got %q %q", r.Get(0), r.Get(2))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emitted %q, want %q", got, tt.want)
+			}
+
+			stats := f.Stats()
+			wantFiltered := int64(0)
+			if len(tt.want) == 0 {
+				wantFiltered = 1
+			}
+			if stats.NumFilteredLines != wantFiltered {
+				t.Errorf("NumFilteredLines = %d, want %d", stats.NumFilteredLines, wantFiltered)
+			}
+			if got := stats.Metrics.Get("c:explode.emitted"); got != int64(len(tt.want)) {
+				t.Errorf("explode.emitted = %v, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestNewExplodeUnknownField(t *testing.T) {
+	_, err := NewExplode(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, false },
+			DecodedConfig: &ExplodeConfig{Field: "foo"},
+		},
+	})
+	if err == nil {
+		t.Errorf("NewExplode() err = nil, want an error")
+	}
+}
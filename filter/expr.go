@@ -0,0 +1,440 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// ExprDesc describes the Expr filter
+var ExprDesc = baker.FilterDesc{
+	Name:   "Expr",
+	New:    NewExpr,
+	Config: &ExprConfig{},
+	Help: "Discard the records for which a boolean expression is false.\n\n" +
+		"The expression has the syntax of Go expressions. Fields are referenced by name, like\n" +
+		"'status', or with field(\"name\") for the names that aren't identifiers, and are strings,\n" +
+		"converted to numbers when compared to or computed with numbers. The supported operators\n" +
+		"are ==, !=, <, <=, >, >=, &&, ||, !, +, -, * and /, and the functions are:\n" +
+		"  * matches(s, \"re\"): whether s matches the regular expression re\n" +
+		"  * contains(s, sub), startsWith(s, prefix), endsWith(s, suffix)\n" +
+		"  * len(s): length of s, in bytes\n\n" +
+		"For example: status >= 500 && matches(path, `^/api/`)\n\n" +
+		"A record whose field can't be converted to a number is discarded, and counted in the\n" +
+		"expr.errors metric.\n",
+}
+
+// ExprConfig holds config parameters of the Expr filter.
+type ExprConfig struct {
+	Expression string `help:"Boolean expression over the record fields, the records for which it's false are discarded" required:"true"`
+}
+
+// Expr is a filter discarding the records for which an expression is false.
+type Expr struct {
+	processed int64
+	discarded int64
+	errors    int64 // records discarded because the expression couldn't be evaluated
+
+	eval func(baker.Record) (bool, error)
+}
+
+// NewExpr returns an Expr filter.
+func NewExpr(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &ExprConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*ExprConfig)
+
+	e, err := compileExpr(dcfg.Expression, cfg.FieldByName)
+	if err != nil {
+		return nil, fmt.Errorf("Expr: Expression: %v", err)
+	}
+	if e.typ != exprBool {
+		return nil, fmt.Errorf("Expr: Expression: got a %s expression, want a boolean", e.typ)
+	}
+	return &Expr{eval: e.bool}, nil
+}
+
+// Stats returns filter statistics.
+func (f *Expr) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("expr.errors", atomic.LoadInt64(&f.errors))
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		NumFilteredLines:  atomic.LoadInt64(&f.discarded),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Expr) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	ok, err := f.eval(l)
+	if err != nil {
+		atomic.AddInt64(&f.errors, 1)
+	}
+	if err != nil || !ok {
+		atomic.AddInt64(&f.discarded, 1)
+		return
+	}
+
+	next(l)
+}
+
+type exprType int
+
+const (
+	exprString exprType = iota
+	exprNumber
+	exprBool
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprString:
+		return "string"
+	case exprNumber:
+		return "number"
+	}
+	return "boolean"
+}
+
+// compiledExpr is a compiled expression of type typ, evaluated by the
+// corresponding function.
+type compiledExpr struct {
+	typ  exprType
+	str  func(baker.Record) []byte
+	num  func(baker.Record) (float64, error)
+	bool func(baker.Record) (bool, error)
+}
+
+// compileExpr compiles expression src, whose identifiers are the names of the
+// fields known by fieldByName.
+func compileExpr(src string, fieldByName func(string) (baker.FieldIndex, bool)) (*compiledExpr, error) {
+	node, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	c := exprCompiler{fieldByName: fieldByName}
+	return c.compile(node)
+}
+
+type exprCompiler struct {
+	fieldByName func(string) (baker.FieldIndex, bool)
+}
+
+func (c exprCompiler) compile(node ast.Expr) (*compiledExpr, error) {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return c.compile(n.X)
+	case *ast.Ident:
+		switch n.Name {
+		case "true", "false":
+			b := n.Name == "true"
+			return &compiledExpr{typ: exprBool, bool: func(baker.Record) (bool, error) { return b, nil }}, nil
+		}
+		return c.field(n.Name)
+	case *ast.BasicLit:
+		return c.literal(n)
+	case *ast.UnaryExpr:
+		return c.unary(n)
+	case *ast.BinaryExpr:
+		return c.binary(n)
+	case *ast.CallExpr:
+		return c.call(n)
+	}
+	return nil, fmt.Errorf("unsupported expression %q", exprSource(node))
+}
+
+func (c exprCompiler) field(name string) (*compiledExpr, error) {
+	idx, ok := c.fieldByName(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	return &compiledExpr{typ: exprString, str: func(l baker.Record) []byte { return l.Get(idx) }}, nil
+}
+
+func (c exprCompiler) literal(n *ast.BasicLit) (*compiledExpr, error) {
+	switch n.Kind {
+	case token.INT, token.FLOAT:
+		v, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", n.Value)
+		}
+		return &compiledExpr{typ: exprNumber, num: func(baker.Record) (float64, error) { return v, nil }}, nil
+	case token.STRING:
+		s, err := strconv.Unquote(n.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", n.Value)
+		}
+		b := []byte(s)
+		return &compiledExpr{typ: exprString, str: func(baker.Record) []byte { return b }}, nil
+	}
+	return nil, fmt.Errorf("unsupported literal %s", n.Value)
+}
+
+func (c exprCompiler) unary(n *ast.UnaryExpr) (*compiledExpr, error) {
+	x, err := c.compile(n.X)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Op {
+	case token.NOT:
+		if x.typ != exprBool {
+			return nil, fmt.Errorf("operator ! requires a boolean, got %q", exprSource(n.X))
+		}
+		return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) {
+			b, err := x.bool(l)
+			return !b, err
+		}}, nil
+	case token.SUB:
+		num, err := x.asNumber(n.X)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: exprNumber, num: func(l baker.Record) (float64, error) {
+			v, err := num(l)
+			return -v, err
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", n.Op)
+}
+
+func (c exprCompiler) binary(n *ast.BinaryExpr) (*compiledExpr, error) {
+	x, err := c.compile(n.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := c.compile(n.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.Op {
+	case token.LAND, token.LOR:
+		if x.typ != exprBool || y.typ != exprBool {
+			return nil, fmt.Errorf("operator %s requires booleans, in %q", n.Op, exprSource(n))
+		}
+		and := n.Op == token.LAND
+		return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) {
+			b, err := x.bool(l)
+			if err != nil || b != and {
+				return b, err
+			}
+			return y.bool(l)
+		}}, nil
+
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		return compareExprs(n, x, y)
+
+	case token.ADD, token.SUB, token.MUL, token.QUO:
+		xn, err := x.asNumber(n.X)
+		if err != nil {
+			return nil, err
+		}
+		yn, err := y.asNumber(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		op := n.Op
+		return &compiledExpr{typ: exprNumber, num: func(l baker.Record) (float64, error) {
+			a, err := xn(l)
+			if err != nil {
+				return 0, err
+			}
+			b, err := yn(l)
+			if err != nil {
+				return 0, err
+			}
+			switch op {
+			case token.ADD:
+				return a + b, nil
+			case token.SUB:
+				return a - b, nil
+			case token.MUL:
+				return a * b, nil
+			}
+			return a / b, nil
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", n.Op)
+}
+
+// compareExprs compiles the comparison n of x and y. Strings are compared as
+// strings, unless compared to a number.
+func compareExprs(n *ast.BinaryExpr, x, y *compiledExpr) (*compiledExpr, error) {
+	op := n.Op
+	cmp := func(c int) bool {
+		switch op {
+		case token.EQL:
+			return c == 0
+		case token.NEQ:
+			return c != 0
+		case token.LSS:
+			return c < 0
+		case token.LEQ:
+			return c <= 0
+		case token.GTR:
+			return c > 0
+		}
+		return c >= 0
+	}
+
+	switch {
+	case x.typ == exprBool || y.typ == exprBool:
+		if x.typ != y.typ || (op != token.EQL && op != token.NEQ) {
+			return nil, fmt.Errorf("invalid comparison %q", exprSource(n))
+		}
+		return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) {
+			a, err := x.bool(l)
+			if err != nil {
+				return false, err
+			}
+			b, err := y.bool(l)
+			return (a == b) == (op == token.EQL), err
+		}}, nil
+
+	case x.typ == exprString && y.typ == exprString:
+		return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) {
+			return cmp(bytes.Compare(x.str(l), y.str(l))), nil
+		}}, nil
+	}
+
+	xn, _ := x.asNumber(n.X)
+	yn, _ := y.asNumber(n.Y)
+	return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) {
+		a, err := xn(l)
+		if err != nil {
+			return false, err
+		}
+		b, err := yn(l)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case a < b:
+			return cmp(-1), nil
+		case a > b:
+			return cmp(1), nil
+		}
+		return cmp(0), nil
+	}}, nil
+}
+
+func (c exprCompiler) call(n *ast.CallExpr) (*compiledExpr, error) {
+	fun, ok := n.Fun.(*ast.Ident)
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %q", exprSource(n.Fun))
+	}
+	nargs := map[string]int{"field": 1, "len": 1, "matches": 2, "contains": 2, "startsWith": 2, "endsWith": 2}
+	want, ok := nargs[fun.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", fun.Name)
+	}
+	if len(n.Args) != want {
+		return nil, fmt.Errorf("%s requires %d arguments, got %d", fun.Name, want, len(n.Args))
+	}
+
+	// The arguments that must be known when compiling.
+	constString := func(arg ast.Expr) (string, error) {
+		lit, ok := arg.(*ast.BasicLit)
+		if ok && lit.Kind == token.STRING {
+			if s, err := strconv.Unquote(lit.Value); err == nil {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("%s requires a string literal, got %q", fun.Name, exprSource(arg))
+	}
+
+	switch fun.Name {
+	case "field":
+		name, err := constString(n.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return c.field(name)
+	case "matches":
+		pattern, err := constString(n.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("matches: %v", err)
+		}
+		s, err := c.stringArg(fun.Name, n.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) { return re.Match(s(l)), nil }}, nil
+	case "len":
+		s, err := c.stringArg(fun.Name, n.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: exprNumber, num: func(l baker.Record) (float64, error) { return float64(len(s(l))), nil }}, nil
+	}
+
+	s, err := c.stringArg(fun.Name, n.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	sub, err := c.stringArg(fun.Name, n.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	test := map[string]func(s, sub []byte) bool{
+		"contains":   bytes.Contains,
+		"startsWith": bytes.HasPrefix,
+		"endsWith":   bytes.HasSuffix,
+	}[fun.Name]
+	return &compiledExpr{typ: exprBool, bool: func(l baker.Record) (bool, error) { return test(s(l), sub(l)), nil }}, nil
+}
+
+func (c exprCompiler) stringArg(fun string, arg ast.Expr) (func(baker.Record) []byte, error) {
+	e, err := c.compile(arg)
+	if err != nil {
+		return nil, err
+	}
+	if e.typ != exprString {
+		return nil, fmt.Errorf("%s requires strings, got %q", fun, exprSource(arg))
+	}
+	return e.str, nil
+}
+
+// asNumber returns the function evaluating e, the compilation of node, as a
+// number. Strings are parsed as numbers at evaluation.
+func (e *compiledExpr) asNumber(node ast.Expr) (func(baker.Record) (float64, error), error) {
+	switch e.typ {
+	case exprNumber:
+		return e.num, nil
+	case exprString:
+		errNaN := fmt.Errorf("%q is not a number", exprSource(node))
+		return func(l baker.Record) (float64, error) {
+			v, err := strconv.ParseFloat(string(e.str(l)), 64)
+			if err != nil {
+				return 0, errNaN
+			}
+			return v, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%q is not a number", exprSource(node))
+}
+
+// exprSource returns the source of node, for error messages.
+func exprSource(node ast.Expr) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, token.NewFileSet(), node); err != nil {
+		return fmt.Sprintf("%T", node)
+	}
+	return buf.String()
+}
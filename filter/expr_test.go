@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestExpr(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "status":
+			return 0, true
+		case "path":
+			return 1, true
+		case "user-agent":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	tests := []struct {
+		expr    string
+		record  string
+		want    bool   // true: kept, false: discarded
+		wantErr string // error returned by NewExpr
+	}{
+		// numeric comparisons
+		{expr: "status >= 500", record: "503,/api,curl", want: true},
+		{expr: "status >= 500", record: "404,/api,curl", want: false},
+		{expr: "status == 200.0", record: "200,/,curl", want: true},
+		{expr: "status*2 > 300 && status < 400", record: "301,/,curl", want: true},
+		{expr: "-status < -100", record: "99,/,curl", want: false},
+		{expr: "len(path) > 3", record: "200,/api,curl", want: true},
+		{expr: "status > 0", record: "abc,/,curl", want: false}, // not a number
+
+		// string matches
+		{expr: `path == "/api"`, record: "200,/api,curl", want: true},
+		{expr: `path != "/api"`, record: "200,/api,curl", want: false},
+		{expr: `path < "/b"`, record: "200,/api,curl", want: true},
+		{expr: "matches(path, `^/api/v[0-9]+`)", record: "200,/api/v2/users,curl", want: true},
+		{expr: "matches(path, `^/api/v[0-9]+`)", record: "200,/api/users,curl", want: false},
+		{expr: `contains(field("user-agent"), "bot")`, record: "200,/,googlebot", want: true},
+		{expr: `startsWith(path, "/api") || endsWith(path, ".html")`, record: "200,/index.html,curl", want: true},
+		{expr: `!startsWith(path, "/api") && status == 200`, record: "200,/api,curl", want: false},
+		{expr: `(status == 200) == true`, record: "200,/,curl", want: true},
+
+		// compile errors
+		{expr: "size > 10", wantErr: `unknown field "size"`},
+		{expr: `field("size") == ""`, wantErr: `unknown field "size"`},
+		{expr: "status >", wantErr: "expected operand"},
+		{expr: "status", wantErr: "want a boolean"},
+		{expr: "status && path", wantErr: "requires booleans"},
+		{expr: "matches(path, path)", wantErr: "string literal"},
+		{expr: `matches(path, "(")`, wantErr: "matches:"},
+		{expr: `lower(path) == "a"`, wantErr: `unknown function "lower"`},
+		{expr: `true < false`, wantErr: "invalid comparison"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := NewExpr(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   fieldByName,
+					DecodedConfig: &ExprConfig{Expression: tt.expr},
+				},
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewExpr error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewExpr: %v", err)
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+			if kept != tt.want {
+				t.Errorf("got record kept=%t, want %t", kept, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprStats(t *testing.T) {
+	f, err := NewExpr(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, true },
+			DecodedConfig: &ExprConfig{Expression: "n > 1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"1", "2", "x"} {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Parse([]byte(rec), nil)
+		f.Process(l, func(baker.Record) {})
+	}
+
+	stats := f.Stats()
+	if stats.NumProcessedLines != 3 || stats.NumFilteredLines != 2 {
+		t.Errorf("processed, filtered = %d, %d, want 3, 2", stats.NumProcessedLines, stats.NumFilteredLines)
+	}
+	if got := stats.Metrics.Get("c:expr.errors"); got != int64(1) {
+		t.Errorf("expr.errors = %v, want 1", got)
+	}
+}
@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// IdentityDesc describes the Identity filter.
+var IdentityDesc = baker.FilterDesc{
+	Name:   "Identity",
+	New:    NewIdentity,
+	Config: &IdentityConfig{},
+	Help:   "Pass all records through, unchanged. Useful to compose and test topologies.",
+}
+
+// IdentityConfig holds configuration parameters for the Identity filter.
+type IdentityConfig struct{}
+
+// Identity is a baker filter that passes all records through.
+type Identity struct {
+	numProcessedLines int64
+}
+
+// NewIdentity creates a new Identity filter.
+func NewIdentity(cfg baker.FilterParams) (baker.Filter, error) {
+	return &Identity{}, nil
+}
+
+// Stats implements baker.Filter.
+func (f *Identity) Stats() baker.FilterStats {
+	return baker.FilterStats{NumProcessedLines: atomic.LoadInt64(&f.numProcessedLines)}
+}
+
+// Process implements baker.Filter.
+func (f *Identity) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+	next(l)
+}
@@ -0,0 +1,45 @@
+package filter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestIdentity(t *testing.T) {
+	f, err := NewIdentity(baker.FilterParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []string{
+		"a,b,c",
+		",,",
+		`with "quotes",été,` + "\ttab",
+		"",
+	}
+	for _, rec := range records {
+		l := &baker.LogLine{FieldSeparator: ','}
+		if err := l.Parse([]byte(rec), nil); err != nil {
+			t.Fatal(err)
+		}
+		want := l.ToText(nil)
+
+		var (
+			got  []byte
+			kept bool
+		)
+		f.Process(l, func(r baker.Record) { got, kept = r.ToText(nil), true })
+		if !kept {
+			t.Fatalf("record %q discarded", rec)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ToText() = %q, want %q", got, want)
+		}
+	}
+
+	if stats := f.Stats(); stats.NumProcessedLines != int64(len(records)) || stats.NumFilteredLines != 0 {
+		t.Errorf("processed, filtered = %d, %d, want %d, 0", stats.NumProcessedLines, stats.NumFilteredLines, len(records))
+	}
+}
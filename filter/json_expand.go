@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// JSONExpandDesc describes the JSONExpand filter
+var JSONExpandDesc = baker.FilterDesc{
+	Name:   "JSONExpand",
+	New:    NewJSONExpand,
+	Config: &JSONExpandConfig{},
+	Help: "Parse a field containing a JSON object and write the values found at the configured paths\n" +
+		"into other fields. Nested values are referred to with dotted paths like user.id.\n" +
+		"Missing or null values leave their field empty; objects and arrays are written as JSON.",
+}
+
+// JSONExpandConfig holds config parameters of the JSONExpand filter.
+type JSONExpandConfig struct {
+	Field         string   `help:"Name of the field containing the JSON object" required:"true"`
+	Fields        []string `help:"List of JSON path, field pairs, for example [\"user.id\", \"userID\", \"ts\", \"timestamp\"]" required:"true"`
+	DropOnInvalid bool     `help:"If true, records whose field isn't a valid JSON object are discarded, otherwise they're left unchanged" default:"false"`
+}
+
+// JSONExpand filter parses a JSON object field and writes some of its values
+// into other fields.
+type JSONExpand struct {
+	processed int64
+	discarded int64
+	invalid   int64
+
+	field baker.FieldIndex
+	paths [][]string // paths[i] is the JSON path of the value written to dsts[i]
+	dsts  []baker.FieldIndex
+	drop  bool
+}
+
+// NewJSONExpand returns a JSONExpand filter.
+func NewJSONExpand(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &JSONExpandConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*JSONExpandConfig)
+
+	field, ok := cfg.FieldByName(dcfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("JSONExpand: unknown field %s", dcfg.Field)
+	}
+
+	if len(dcfg.Fields) == 0 || len(dcfg.Fields)%2 != 0 {
+		return nil, fmt.Errorf("JSONExpand: Fields must be a non-empty list of JSON path, field pairs")
+	}
+
+	f := &JSONExpand{
+		field: field,
+		drop:  dcfg.DropOnInvalid,
+	}
+	for i := 0; i < len(dcfg.Fields); i += 2 {
+		path, name := dcfg.Fields[i], dcfg.Fields[i+1]
+		if path == "" {
+			return nil, fmt.Errorf("JSONExpand: Fields: empty JSON path for field %s", name)
+		}
+		dst, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("JSONExpand: Fields: unknown field %s", name)
+		}
+		f.paths = append(f.paths, strings.Split(path, "."))
+		f.dsts = append(f.dsts, dst)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *JSONExpand) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("json_expand.invalid", atomic.LoadInt64(&f.invalid))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		NumFilteredLines:  atomic.LoadInt64(&f.discarded),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *JSONExpand) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(l.Get(f.field)))
+	dec.UseNumber() // keep numbers as they're written
+	if err := dec.Decode(&obj); err != nil || obj == nil || dec.More() {
+		atomic.AddInt64(&f.invalid, 1)
+		if f.drop {
+			atomic.AddInt64(&f.discarded, 1)
+			return
+		}
+		next(l)
+		return
+	}
+
+	// The values are decoded into new buffers, so the source field may also
+	// be a destination.
+	for i, path := range f.paths {
+		l.Set(f.dsts[i], jsonValue(lookupJSONPath(obj, path)))
+	}
+
+	next(l)
+}
+
+// lookupJSONPath returns the value found at the given path in obj, or nil.
+func lookupJSONPath(obj map[string]interface{}, path []string) interface{} {
+	var v interface{} = obj
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+// jsonValue returns the field value of a decoded JSON value: strings,
+// numbers and booleans as they're written, nothing for null and the JSON
+// encoding of objects and arrays.
+func jsonValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case json.Number:
+		return []byte(v)
+	case bool:
+		if v {
+			return []byte("true")
+		}
+		return []byte("false")
+	default:
+		buf, _ := json.Marshal(v)
+		return buf
+	}
+}
@@ -0,0 +1,185 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestJSONExpand(t *testing.T) {
+	tests := []struct {
+		name   string
+		json   string
+		fields []string
+		drop   bool
+
+		want    []string // nil: discarded
+		wantErr bool
+	}{
+		{
+			name:   "top-level keys",
+			json:   `{"a": "x", "b": 42}`,
+			fields: []string{"a", "bar", "b", "baz"},
+			want:   []string{`{"a": "x", "b": 42}`, "x", "42"},
+		},
+		{
+			name:   "nested paths",
+			json:   `{"user": {"id": 1234567890123, "name": "bob", "tags": ["a", "b"]}}`,
+			fields: []string{"user.id", "bar", "user.tags", "baz"},
+			want:   []string{`{"user": {"id": 1234567890123, "name": "bob", "tags": ["a", "b"]}}`, "1234567890123", `["a","b"]`},
+		},
+		{
+			name:   "objects, booleans and floats",
+			json:   `{"user": {"ok": true, "geo": {"lat": 1.5, "lon": -2}}}`,
+			fields: []string{"user.ok", "bar", "user.geo", "baz"},
+			want:   []string{`{"user": {"ok": true, "geo": {"lat": 1.5, "lon": -2}}}`, "true", `{"lat":1.5,"lon":-2}`},
+		},
+		{
+			name:   "missing and null values",
+			json:   `{"user": {"id": null}, "a": "x"}`,
+			fields: []string{"user.id", "bar", "user.name.first", "baz"},
+			want:   []string{`{"user": {"id": null}, "a": "x"}`, "", ""},
+		},
+		{
+			name:   "path through a scalar",
+			json:   `{"user": "bob"}`,
+			fields: []string{"user.id", "bar"},
+			want:   []string{`{"user": "bob"}`, "", "old"},
+		},
+		{
+			name:   "source is also destination",
+			json:   `{"a": "x", "b": "y"}`,
+			fields: []string{"a", "foo", "b", "bar"},
+			want:   []string{"x", "y", "old"},
+		},
+		{
+			name:   "invalid JSON pass-through",
+			json:   `{"a": `,
+			fields: []string{"a", "bar"},
+			want:   []string{`{"a": `, "old", "old"},
+		},
+		{
+			name:   "not an object pass-through",
+			json:   `["a", "b"]`,
+			fields: []string{"a", "bar"},
+			want:   []string{`["a", "b"]`, "old", "old"},
+		},
+		{
+			name:   "trailing data dropped",
+			json:   `{"a": "x"} {"a": "y"}`,
+			fields: []string{"a", "bar"},
+			drop:   true,
+			want:   nil,
+		},
+		{
+			name:   "empty field dropped",
+			json:   ``,
+			fields: []string{"a", "bar"},
+			drop:   true,
+			want:   nil,
+		},
+
+		// errors
+		{
+			name:    "odd number of fields",
+			fields:  []string{"a", "bar", "b"},
+			wantErr: true,
+		},
+		{
+			name:    "no fields",
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination field",
+			fields:  []string{"a", "qux"},
+			wantErr: true,
+		},
+		{
+			name:    "empty path",
+			fields:  []string{"", "bar"},
+			wantErr: true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "bar":
+			return 1, true
+		case "baz":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewJSONExpand(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &JSONExpandConfig{
+						Field:         "foo",
+						Fields:        tt.fields,
+						DropOnInvalid: tt.drop,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			l.Set(0, []byte(tt.json))
+			l.Set(1, []byte("old"))
+			l.Set(2, []byte("old"))
+
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+
+			if kept != (tt.want != nil) {
+				t.Fatalf("got record kept=%t, want %t", kept, tt.want != nil)
+			}
+			for i, want := range tt.want {
+				if got := string(l.Get(baker.FieldIndex(i))); got != want {
+					t.Errorf("field %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONExpandStats(t *testing.T) {
+	f, err := NewJSONExpand(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(name string) (baker.FieldIndex, bool) { return 0, true },
+			DecodedConfig: &JSONExpandConfig{
+				Field:         "foo",
+				Fields:        []string{"a", "foo"},
+				DropOnInvalid: true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, js := range []string{`{"a": 1}`, `not json`, `{"a": 2}`, `null`} {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(js))
+		f.Process(l, func(baker.Record) {})
+	}
+
+	stats := f.Stats()
+	if stats.NumProcessedLines != 4 || stats.NumFilteredLines != 2 {
+		t.Errorf("processed, filtered = %d, %d, want 4, 2", stats.NumProcessedLines, stats.NumFilteredLines)
+	}
+	if n := stats.Metrics.Get("c:json_expand.invalid"); n != int64(2) {
+		t.Errorf("json_expand.invalid = %v, want 2", n)
+	}
+}
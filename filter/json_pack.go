@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// JSONPackDesc describes the JSONPack filter
+var JSONPackDesc = baker.FilterDesc{
+	Name:   "JSONPack",
+	New:    NewJSONPack,
+	Config: &JSONPackConfig{},
+	Help: "Write into a field a JSON object whose keys are the names of the source fields and whose\n" +
+		"values are their string values, like {\"field1\": \"value1\", \"field2\": \"value2\"}.\n" +
+		"This is the inverse of the JSONExpand filter.",
+}
+
+// JSONPackConfig holds config parameters of the JSONPack filter.
+type JSONPackConfig struct {
+	Fields    []string `help:"Names of the fields to write into the JSON object" required:"true"`
+	DstField  string   `help:"Name of the field the JSON object is written to" required:"true"`
+	OmitEmpty bool     `help:"If true, empty fields are omitted from the JSON object, otherwise they're written as empty strings" default:"false"`
+}
+
+// JSONPack filter writes some fields of a record into another field, as a
+// JSON object.
+type JSONPack struct {
+	processed int64
+
+	names     [][]byte // JSON-encoded names of the fields
+	fields    []baker.FieldIndex
+	dst       baker.FieldIndex
+	omitEmpty bool
+}
+
+// NewJSONPack returns a JSONPack filter.
+func NewJSONPack(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &JSONPackConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*JSONPackConfig)
+
+	if len(dcfg.Fields) == 0 {
+		return nil, fmt.Errorf("JSONPack: Fields can't be empty")
+	}
+
+	dst, ok := cfg.FieldByName(dcfg.DstField)
+	if !ok {
+		return nil, fmt.Errorf("JSONPack: unknown field %s", dcfg.DstField)
+	}
+
+	f := &JSONPack{
+		dst:       dst,
+		omitEmpty: dcfg.OmitEmpty,
+	}
+	seen := make(map[string]bool)
+	for _, name := range dcfg.Fields {
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("JSONPack: Fields: unknown field %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("JSONPack: Fields: duplicate field %s", name)
+		}
+		seen[name] = true
+
+		buf, _ := json.Marshal(name)
+		f.names = append(f.names, buf)
+		f.fields = append(f.fields, fidx)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *JSONPack) Stats() baker.FilterStats {
+	return baker.FilterStats{NumProcessedLines: atomic.LoadInt64(&f.processed)}
+}
+
+// Process is where the actual filtering takes place.
+func (f *JSONPack) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	n := 0
+	for i, fidx := range f.fields {
+		val := l.Get(fidx)
+		if len(val) == 0 && f.omitEmpty {
+			continue
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		n++
+		buf.Write(f.names[i])
+		buf.WriteByte(':')
+		// Marshaling a string never fails.
+		enc, _ := json.Marshal(string(val))
+		buf.Write(enc)
+	}
+	buf.WriteByte('}')
+
+	l.Set(f.dst, buf.Bytes())
+	next(l)
+}
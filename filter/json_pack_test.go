@@ -0,0 +1,189 @@
+package filter
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestJSONPack(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    []string
+		fields    []string
+		dst       string
+		omitEmpty bool
+
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "all fields",
+			record: []string{"a", "b", "c", ""},
+			fields: []string{"foo", "bar", "baz"},
+			dst:    "qux",
+			want:   map[string]string{"foo": "a", "bar": "b", "baz": "c"},
+		},
+		{
+			name:   "fields order",
+			record: []string{"a", "b", "c", ""},
+			fields: []string{"baz", "foo", "bar"},
+			dst:    "qux",
+			want:   map[string]string{"foo": "a", "bar": "b", "baz": "c"},
+		},
+		{
+			name:   "escaped values",
+			record: []string{`say "hi"`, "tab\there", "été", ""},
+			fields: []string{"foo", "bar", "baz"},
+			dst:    "qux",
+			want:   map[string]string{"foo": `say "hi"`, "bar": "tab\there", "baz": "été"},
+		},
+		{
+			name:   "empty fields kept",
+			record: []string{"a", "", "", ""},
+			fields: []string{"foo", "bar", "baz"},
+			dst:    "qux",
+			want:   map[string]string{"foo": "a", "bar": "", "baz": ""},
+		},
+		{
+			name:      "empty fields omitted",
+			record:    []string{"a", "", "c", ""},
+			fields:    []string{"foo", "bar", "baz"},
+			dst:       "qux",
+			omitEmpty: true,
+			want:      map[string]string{"foo": "a", "baz": "c"},
+		},
+		{
+			name:      "all fields empty",
+			record:    []string{"", "", "", ""},
+			fields:    []string{"foo", "bar"},
+			dst:       "qux",
+			omitEmpty: true,
+			want:      map[string]string{},
+		},
+		{
+			name:   "destination is also a source",
+			record: []string{"a", "b", "", ""},
+			fields: []string{"foo", "bar"},
+			dst:    "foo",
+			want:   map[string]string{"foo": "a", "bar": "b"},
+		},
+
+		// errors
+		{
+			name:    "no fields",
+			dst:     "qux",
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			fields:  []string{"foo", "nope"},
+			dst:     "qux",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate field",
+			fields:  []string{"foo", "foo"},
+			dst:     "qux",
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination",
+			fields:  []string{"foo"},
+			dst:     "nope",
+			wantErr: true,
+		},
+	}
+
+	fields := []string{"foo", "bar", "baz", "qux"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewJSONPack(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &JSONPackConfig{
+						Fields:    tt.fields,
+						DstField:  tt.dst,
+						OmitEmpty: tt.omitEmpty,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			for i, v := range tt.record {
+				l.Set(baker.FieldIndex(i), []byte(v))
+			}
+
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+			if !kept {
+				t.Fatal("record discarded")
+			}
+
+			dst, _ := fieldByName(tt.dst)
+			got := make(map[string]string)
+			if err := json.Unmarshal(l.Get(dst), &got); err != nil {
+				t.Fatalf("invalid JSON %q: %v", l.Get(dst), err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("JSON = %q, want %v", l.Get(dst), tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPackExpandRoundTrip(t *testing.T) {
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		i, ok := map[string]baker.FieldIndex{"foo": 0, "bar": 1, "json": 2, "foo2": 3, "bar2": 4}[name]
+		return i, ok
+	}
+
+	pack, err := NewJSONPack(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   fieldByName,
+			DecodedConfig: &JSONPackConfig{Fields: []string{"foo", "bar"}, DstField: "json"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expand, err := NewJSONExpand(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   fieldByName,
+			DecodedConfig: &JSONExpandConfig{Field: "json", Fields: []string{"foo", "foo2", "bar", "bar2"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &baker.LogLine{FieldSeparator: ','}
+	l.Set(0, []byte(`a "quoted", value`))
+	l.Set(1, []byte("123"))
+	pack.Process(l, func(r baker.Record) { expand.Process(r, func(baker.Record) {}) })
+
+	for src, dst := range map[baker.FieldIndex]baker.FieldIndex{0: 3, 1: 4} {
+		if got, want := string(l.Get(dst)), string(l.Get(src)); got != want {
+			t.Errorf("field %d = %q, want %q", dst, got, want)
+		}
+	}
+}
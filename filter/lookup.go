@@ -0,0 +1,239 @@
+package filter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+// LookupDesc describes the Lookup filter
+var LookupDesc = baker.FilterDesc{
+	Name:   "Lookup",
+	New:    NewLookup,
+	Config: &LookupConfig{},
+	Help: "Look up the value of a field in a table loaded from a CSV file, and write the matching value\n" +
+		"into another field (for example to turn country codes into country names).\n" +
+		"The first line of the CSV file holds the column names; KeyColumn and ValueColumn name the\n" +
+		"columns of the keys and of the values. If a key appears multiple times, the last row wins.\n" +
+		"Records whose value isn't in the table get Default, empty by default.\n" +
+		"With ReloadInterval, the file is periodically loaded again, so that it can be updated while\n" +
+		"the topology is running; if it can't be loaded, the current table is kept.",
+}
+
+// LookupConfig holds config parameters of the Lookup filter.
+type LookupConfig struct {
+	CSVPath        string        `help:"Path of the CSV file of the lookup table" required:"true"`
+	KeyColumn      string        `help:"Name of the CSV column holding the keys" required:"true"`
+	ValueColumn    string        `help:"Name of the CSV column holding the values" required:"true"`
+	Separator      string        `help:"Field separator of the CSV file, a single character" default:","`
+	Field          string        `help:"Name of the field whose value is looked up in the table" required:"true"`
+	DstField       string        `help:"Name of the field the matching value is written to. It can be Field itself" required:"true"`
+	Default        string        `help:"Value written to DstField when the key isn't in the table" default:""`
+	ReloadInterval time.Duration `help:"If greater than 0, interval between 2 loads of CSVPath" default:"0"`
+}
+
+// Lookup filter writes into a field the value matching another field in a
+// lookup table.
+type Lookup struct {
+	processed    int64
+	hits         int64
+	misses       int64
+	reloadErrors int64
+
+	cfg   *LookupConfig
+	sep   rune
+	field baker.FieldIndex
+	dst   baker.FieldIndex
+	def   []byte
+
+	mu    sync.RWMutex // protects table
+	table map[string][]byte
+
+	stop chan struct{} // closed by Shutdown, if ReloadInterval is set
+	done chan struct{} // closed once the reloading goroutine has returned
+}
+
+// NewLookup returns a Lookup filter.
+func NewLookup(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &LookupConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*LookupConfig)
+
+	field, ok := cfg.FieldByName(dcfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("Lookup: unknown field %s", dcfg.Field)
+	}
+	dst, ok := cfg.FieldByName(dcfg.DstField)
+	if !ok {
+		return nil, fmt.Errorf("Lookup: unknown field %s", dcfg.DstField)
+	}
+
+	if dcfg.Separator == "" {
+		dcfg.Separator = ","
+	}
+	sep := []rune(dcfg.Separator)
+	if len(sep) != 1 {
+		return nil, fmt.Errorf("Lookup: Separator must be a single character, got %q", dcfg.Separator)
+	}
+
+	f := &Lookup{
+		cfg:   dcfg,
+		sep:   sep[0],
+		field: field,
+		dst:   dst,
+		def:   []byte(dcfg.Default),
+	}
+
+	table, err := f.load()
+	if err != nil {
+		return nil, fmt.Errorf("Lookup: %v", err)
+	}
+	f.table = table
+
+	if dcfg.ReloadInterval > 0 {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.reloadLoop()
+	}
+
+	return f, nil
+}
+
+// load reads the lookup table from CSVPath.
+func (f *Lookup) load() (map[string][]byte, error) {
+	file, err := os.Open(f.cfg.CSVPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = f.sep
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s: empty file", f.cfg.CSVPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.cfg.CSVPath, err)
+	}
+	keyCol, valCol := -1, -1
+	for i, name := range header {
+		if name == f.cfg.KeyColumn {
+			keyCol = i
+		}
+		if name == f.cfg.ValueColumn {
+			valCol = i
+		}
+	}
+	if keyCol == -1 {
+		return nil, fmt.Errorf("%s: no %q column", f.cfg.CSVPath, f.cfg.KeyColumn)
+	}
+	if valCol == -1 {
+		return nil, fmt.Errorf("%s: no %q column", f.cfg.CSVPath, f.cfg.ValueColumn)
+	}
+
+	table := make(map[string][]byte)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.cfg.CSVPath, err)
+		}
+		table[row[keyCol]] = []byte(row[valCol])
+	}
+	return table, nil
+}
+
+// reload loads the lookup table again, keeping the current one on error.
+func (f *Lookup) reload() error {
+	table, err := f.load()
+	if err != nil {
+		atomic.AddInt64(&f.reloadErrors, 1)
+		return err
+	}
+
+	f.mu.Lock()
+	f.table = table
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Lookup) reloadLoop() {
+	defer close(f.done)
+
+	ticker := time.NewTicker(f.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.reload(); err != nil {
+				log.WithError(err).WithField("path", f.cfg.CSVPath).Error("can't reload lookup table, keeping the current one")
+			}
+		}
+	}
+}
+
+// ShutdownPhase implements baker.ShutdownHook.
+func (f *Lookup) ShutdownPhase() baker.ShutdownPhase { return baker.ShutdownFilters }
+
+// Shutdown implements baker.ShutdownHook, it stops reloading the table.
+func (f *Lookup) Shutdown() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+	}
+	return nil
+}
+
+// Stats returns filter statistics.
+func (f *Lookup) Stats() baker.FilterStats {
+	f.mu.RLock()
+	size := len(f.table)
+	f.mu.RUnlock()
+
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("lookup.hits", atomic.LoadInt64(&f.hits))
+	bag.AddRawCounter("lookup.misses", atomic.LoadInt64(&f.misses))
+	bag.AddGauge("lookup.table_size", float64(size))
+	if f.cfg.ReloadInterval > 0 {
+		bag.AddRawCounter("lookup.reload_errors", atomic.LoadInt64(&f.reloadErrors))
+	}
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Lookup) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	f.mu.RLock()
+	val, ok := f.table[string(l.Get(f.field))]
+	f.mu.RUnlock()
+
+	if ok {
+		atomic.AddInt64(&f.hits, 1)
+	} else {
+		atomic.AddInt64(&f.misses, 1)
+		val = f.def
+	}
+	l.Set(f.dst, val)
+
+	next(l)
+}
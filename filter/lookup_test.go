@@ -0,0 +1,203 @@
+package filter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+const lookupCSV = `code,name,continent
+fr,France,Europe
+it,Italy,Europe
+us,"United States, of America",America
+`
+
+func lookupFieldByName(name string) (baker.FieldIndex, bool) {
+	i, ok := map[string]baker.FieldIndex{"code": 0, "country": 1}[name]
+	return i, ok
+}
+
+func writeLookupCSV(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "countries.csv")
+	writeLookupCSV(t, path, lookupCSV)
+
+	tests := []struct {
+		name     string
+		cfg      LookupConfig
+		code     string
+		want     string
+		wantMiss bool
+		wantErr  bool
+	}{
+		{
+			name: "hit",
+			cfg:  LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country"},
+			code: "it",
+			want: "Italy",
+		},
+		{
+			name: "quoted value",
+			cfg:  LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country"},
+			code: "us",
+			want: "United States, of America",
+		},
+		{
+			name: "other columns",
+			cfg:  LookupConfig{CSVPath: path, KeyColumn: "name", ValueColumn: "continent", Field: "code", DstField: "country"},
+			code: "France",
+			want: "Europe",
+		},
+		{
+			name: "in place",
+			cfg:  LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "code"},
+			code: "fr",
+			want: "France",
+		},
+		{
+			name:     "miss",
+			cfg:      LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country"},
+			code:     "de",
+			want:     "",
+			wantMiss: true,
+		},
+		{
+			name:     "miss with default",
+			cfg:      LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country", Default: "unknown"},
+			code:     "de",
+			want:     "unknown",
+			wantMiss: true,
+		},
+
+		// errors
+		{
+			name:    "missing file",
+			cfg:     LookupConfig{CSVPath: filepath.Join(t.TempDir(), "nope.csv"), KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country"},
+			wantErr: true,
+		},
+		{
+			name:    "missing key column",
+			cfg:     LookupConfig{CSVPath: path, KeyColumn: "iso", ValueColumn: "name", Field: "code", DstField: "country"},
+			wantErr: true,
+		},
+		{
+			name:    "missing value column",
+			cfg:     LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "label", Field: "code", DstField: "country"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			cfg:     LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "nope", DstField: "country"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown destination",
+			cfg:     LookupConfig{CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "nope"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			f, err := NewLookup(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName:   lookupFieldByName,
+					DecodedConfig: &cfg,
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			l.Set(0, []byte(tt.code))
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+			if !kept {
+				t.Fatal("record discarded")
+			}
+
+			dst, _ := lookupFieldByName(tt.cfg.DstField)
+			if got := string(l.Get(dst)); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.cfg.DstField, got, tt.want)
+			}
+
+			metrics := f.Stats().Metrics
+			wantHits, wantMisses := int64(1), int64(0)
+			if tt.wantMiss {
+				wantHits, wantMisses = 0, 1
+			}
+			if metrics.Get("c:lookup.hits") != wantHits || metrics.Get("c:lookup.misses") != wantMisses {
+				t.Errorf("lookup.hits = %v, lookup.misses = %v, want %d and %d", metrics.Get("c:lookup.hits"), metrics.Get("c:lookup.misses"), wantHits, wantMisses)
+			}
+		})
+	}
+}
+
+func TestLookupReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "countries.csv")
+	writeLookupCSV(t, path, lookupCSV)
+
+	f, err := NewLookup(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: lookupFieldByName,
+			DecodedConfig: &LookupConfig{
+				CSVPath: path, KeyColumn: "code", ValueColumn: "name", Field: "code", DstField: "country",
+				ReloadInterval: 10 * time.Millisecond,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.(*Lookup).Shutdown()
+
+	lookup := func(code string) string {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(code))
+		f.Process(l, func(baker.Record) {})
+		return string(l.Get(1))
+	}
+	waitFor := func(code, want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for lookup(code) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("lookup(%q) = %q, want %q", code, lookup(code), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	writeLookupCSV(t, path, "code,name\nde,Germany\n")
+	waitFor("de", "Germany")
+	if got := lookup("fr"); got != "" {
+		t.Errorf("lookup(fr) = %q after reload, want a miss", got)
+	}
+
+	// An invalid file is ignored, the current table is kept.
+	writeLookupCSV(t, path, "code,label\nes,Spain\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Stats().Metrics.Get("c:lookup.reload_errors") == int64(0) {
+		if time.Now().After(deadline) {
+			t.Fatal("no reload error")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := lookup("de"); got != "Germany" {
+		t.Errorf("lookup(de) = %q after failed reload, want %q", got, "Germany")
+	}
+}
@@ -0,0 +1,207 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdRoll/baker"
+)
+
+// NormalizeDesc describes the Normalize filter
+var NormalizeDesc = baker.FilterDesc{
+	Name:   "Normalize",
+	New:    NewNormalize,
+	Config: &NormalizeConfig{},
+	Help: "Normalize the value of a set of fields, applying a sequence of operations. Available operations are:\n" +
+		" - lower: convert to lowercase (Unicode simple case mapping)\n" +
+		" - upper: convert to uppercase (Unicode simple case mapping)\n" +
+		" - trim: remove leading and trailing white space\n" +
+		" - trim_left: remove leading white space\n" +
+		" - trim_right: remove trailing white space\n" +
+		" - collapse_spaces: replace each run of white space with a single space\n" +
+		"Operations are applied in order. Empty fields are left untouched.",
+}
+
+// NormalizeConfig holds config parameters of the Normalize filter.
+type NormalizeConfig struct {
+	Fields     []string `help:"Names of the fields to normalize" required:"true"`
+	Operations []string `help:"Operations to apply, in order, among lower, upper, trim, trim_left, trim_right and collapse_spaces" required:"true"`
+}
+
+// normalizeOps maps operation names to their implementation. An operation
+// returns its input when there's nothing to change.
+var normalizeOps = map[string]func([]byte) []byte{
+	"lower":           toLower,
+	"upper":           toUpper,
+	"trim":            bytes.TrimSpace,
+	"trim_left":       func(b []byte) []byte { return bytes.TrimLeftFunc(b, unicode.IsSpace) },
+	"trim_right":      func(b []byte) []byte { return bytes.TrimRightFunc(b, unicode.IsSpace) },
+	"collapse_spaces": collapseSpaces,
+}
+
+// Normalize filter applies a sequence of string operations to a set of fields.
+type Normalize struct {
+	numProcessedLines int64
+
+	fields []baker.FieldIndex
+	ops    []func([]byte) []byte
+}
+
+// NewNormalize returns a Normalize filter.
+func NewNormalize(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &NormalizeConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*NormalizeConfig)
+
+	if len(dcfg.Fields) == 0 {
+		return nil, fmt.Errorf("Normalize: at least one field must be defined in Fields")
+	}
+	if len(dcfg.Operations) == 0 {
+		return nil, fmt.Errorf("Normalize: at least one operation must be defined in Operations")
+	}
+
+	f := &Normalize{}
+	for _, name := range dcfg.Fields {
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Normalize: unknown field %s", name)
+		}
+		f.fields = append(f.fields, fidx)
+	}
+
+	for _, name := range dcfg.Operations {
+		op, ok := normalizeOps[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("Normalize: unknown operation %q", name)
+		}
+		f.ops = append(f.ops, op)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *Normalize) Stats() baker.FilterStats {
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.numProcessedLines),
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Normalize) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+
+	for _, fidx := range f.fields {
+		v := l.Get(fidx)
+		if len(v) == 0 {
+			continue
+		}
+		for _, op := range f.ops {
+			v = op(v)
+		}
+		l.Set(fidx, v)
+	}
+
+	next(l)
+}
+
+// toLower returns b converted to lowercase. It doesn't allocate if b is
+// already lowercase ASCII.
+func toLower(b []byte) []byte {
+	isASCII, hasUpper := true, false
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			isASCII = false
+			break
+		}
+		hasUpper = hasUpper || ('A' <= c && c <= 'Z')
+	}
+	if !isASCII {
+		return bytes.ToLower(b)
+	}
+	if !hasUpper {
+		return b
+	}
+	lb := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lb[i] = c
+	}
+	return lb
+}
+
+// toUpper returns b converted to uppercase. It doesn't allocate if b is
+// already uppercase ASCII.
+func toUpper(b []byte) []byte {
+	isASCII, hasLower := true, false
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			isASCII = false
+			break
+		}
+		hasLower = hasLower || ('a' <= c && c <= 'z')
+	}
+	if !isASCII {
+		return bytes.ToUpper(b)
+	}
+	if !hasLower {
+		return b
+	}
+	ub := make([]byte, len(b))
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		ub[i] = c
+	}
+	return ub
+}
+
+// collapseSpaces replaces each run of white space characters in b with a
+// single ASCII space. It doesn't allocate if there's nothing to replace.
+func collapseSpaces(b []byte) []byte {
+	var (
+		out     []byte
+		inSpace bool
+	)
+	for i := 0; i < len(b); {
+		r, size := rune(b[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRune(b[i:])
+		}
+		if unicode.IsSpace(r) {
+			switch {
+			case inSpace:
+				// Skip all white space after the first one.
+				if out == nil {
+					out = append(make([]byte, 0, len(b)), b[:i]...)
+				}
+			case r != ' ':
+				if out == nil {
+					out = append(make([]byte, 0, len(b)), b[:i]...)
+				}
+				out = append(out, ' ')
+			case out != nil:
+				out = append(out, ' ')
+			}
+			inSpace = true
+		} else {
+			if out != nil {
+				out = append(out, b[i:i+size]...)
+			}
+			inSpace = false
+		}
+		i += size
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
@@ -0,0 +1,223 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		fields []string
+		ops    []string
+
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "lower",
+			record: "AbC,DeF,gHi",
+			fields: []string{"foo", "baz"},
+			ops:    []string{"lower"},
+			want:   []string{"abc", "DeF", "ghi"},
+		},
+		{
+			name:   "upper",
+			record: "AbC,DeF,gHi",
+			fields: []string{"bar", "baz"},
+			ops:    []string{"upper"},
+			want:   []string{"AbC", "DEF", "GHI"},
+		},
+		{
+			name:   "lower utf-8",
+			record: "ÀÉÎÕÜ,ΑΒΓ ΣΊΣΥΦΟΣ,İSTANBUL",
+			fields: []string{"foo", "bar", "baz"},
+			ops:    []string{"lower"},
+			want:   []string{"àéîõü", "αβγ σίσυφοσ", "istanbul"},
+		},
+		{
+			name:   "upper utf-8",
+			record: "àéîõü,straße,ǆ",
+			fields: []string{"foo", "bar", "baz"},
+			ops:    []string{"upper"},
+			want:   []string{"ÀÉÎÕÜ", "STRAßE", "Ǆ"},
+		},
+		{
+			name:   "trims",
+			record: "  abc  ,  def  ,  ghi  ",
+			fields: []string{"foo", "bar", "baz"},
+			ops:    []string{"trim"},
+			want:   []string{"abc", "def", "ghi"},
+		},
+		{
+			name:   "trim_left",
+			record: " \tabc \t,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"trim_left"},
+			want:   []string{"abc \t", "def", "ghi"},
+		},
+		{
+			name:   "trim_right",
+			record: " \tabc \t,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"trim_right"},
+			want:   []string{" \tabc", "def", "ghi"},
+		},
+		{
+			name:   "trim unicode spaces",
+			record: "  abc　,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"trim"},
+			want:   []string{"abc", "def", "ghi"},
+		},
+		{
+			name:   "collapse_spaces",
+			record: "a  b \t c,a b c,\ta b\t\t",
+			fields: []string{"foo", "bar", "baz"},
+			ops:    []string{"collapse_spaces"},
+			want:   []string{"a b c", "a b c", " a b "},
+		},
+		{
+			name:   "operations in order",
+			record: "  Hello   WORLD  ,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"collapse_spaces", "trim", "lower"},
+			want:   []string{"hello world", "def", "ghi"},
+		},
+		{
+			name:   "operations order matters",
+			record: "abc,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"lower", "upper"},
+			want:   []string{"ABC", "def", "ghi"},
+		},
+		{
+			name:   "empty fields are skipped",
+			record: ",def,",
+			fields: []string{"foo", "baz"},
+			ops:    []string{"upper"},
+			want:   []string{"", "def", ""},
+		},
+		{
+			name:   "case insensitive operation names",
+			record: " ABC ,def,ghi",
+			fields: []string{"foo"},
+			ops:    []string{"Trim", "LOWER"},
+			want:   []string{"abc", "def", "ghi"},
+		},
+
+		// errors
+		{
+			name:    "no fields",
+			ops:     []string{"lower"},
+			wantErr: true,
+		},
+		{
+			name:    "no operations",
+			fields:  []string{"foo"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			fields:  []string{"non-existent"},
+			ops:     []string{"lower"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown operation",
+			fields:  []string{"foo"},
+			ops:     []string{"lower", "reverse"},
+			wantErr: true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "bar":
+			return 1, true
+		case "baz":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewNormalize(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &NormalizeConfig{
+						Fields:     tt.fields,
+						Operations: tt.ops,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+
+			f.Process(l, func(baker.Record) {})
+
+			for i, want := range tt.want {
+				if got := string(l.Get(baker.FieldIndex(i))); got != want {
+					t.Errorf("field %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNormalizeTrimLower(b *testing.B) {
+	benchs := []struct {
+		name  string
+		value string
+	}{
+		{"noop", "already-normalized"},
+		{"ascii", "  Some Mixed Case VALUE  "},
+		{"utf-8", "  Ünïcödé Mixed Case VALUE  "},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) { return 0, name == "foo" }
+
+	for _, bb := range benchs {
+		b.Run(bb.name, func(b *testing.B) {
+			f, err := NewNormalize(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &NormalizeConfig{
+						Fields:     []string{"foo"},
+						Operations: []string{"trim", "lower"},
+					},
+				},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			buf := []byte(strings.Join([]string{bb.value, "bar", "baz"}, ","))
+			l := &baker.LogLine{FieldSeparator: ','}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				l.Parse(buf, nil)
+				f.Process(l, func(baker.Record) {})
+			}
+		})
+	}
+}
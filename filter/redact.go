@@ -0,0 +1,155 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/AdRoll/baker"
+)
+
+// RedactDesc describes the Redact filter
+var RedactDesc = baker.FilterDesc{
+	Name:   "Redact",
+	New:    NewRedact,
+	Config: &RedactConfig{},
+	Help: "Redact fields containing personal data, like emails or IP addresses. Each field is redacted\n" +
+		"with one of these strategies:\n" +
+		" - hash: replace the value with the hex-encoded SHA256 of the salted value, so that identical\n" +
+		"   values give identical tokens\n" +
+		" - mask: replace each character with *\n" +
+		" - truncate_ip: zero the last octet of IPv4 addresses, the last 80 bits of IPv6 addresses\n" +
+		"   (values that aren't IP addresses are removed)\n" +
+		" - remove: empty the field\n" +
+		"Empty fields are left empty.",
+}
+
+// RedactConfig holds config parameters of the Redact filter.
+type RedactConfig struct {
+	Fields     []string `help:"Names of the fields to redact" required:"true"`
+	Strategies []string `help:"Redaction strategy of each field (hash, mask, truncate_ip or remove), in the order of Fields. A single strategy applies to all fields" required:"true"`
+	Salt       string   `help:"Salt prepended to the values before hashing them, so that tokens can't be reversed by hashing known values"`
+}
+
+// List of the strategies of the Redact filter.
+const (
+	redactHash       = "hash"
+	redactMask       = "mask"
+	redactTruncateIP = "truncate_ip"
+	redactRemove     = "remove"
+)
+
+// Redact filter redacts fields containing personal data.
+type Redact struct {
+	processed  int64
+	invalidIPs int64
+
+	fields     []baker.FieldIndex
+	strategies []string // strategies[i] is the strategy of fields[i]
+	salt       []byte
+}
+
+// NewRedact returns a Redact filter.
+func NewRedact(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &RedactConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*RedactConfig)
+
+	if len(dcfg.Fields) == 0 {
+		return nil, fmt.Errorf("Redact: Fields can't be empty")
+	}
+	if len(dcfg.Strategies) != 1 && len(dcfg.Strategies) != len(dcfg.Fields) {
+		return nil, fmt.Errorf("Redact: Strategies must have either 1 strategy or 1 per field, got %d for %d fields", len(dcfg.Strategies), len(dcfg.Fields))
+	}
+
+	f := &Redact{salt: []byte(dcfg.Salt)}
+	for i, name := range dcfg.Fields {
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Redact: Fields: unknown field %s", name)
+		}
+
+		strategy := dcfg.Strategies[0]
+		if len(dcfg.Strategies) > 1 {
+			strategy = dcfg.Strategies[i]
+		}
+		switch strategy {
+		case redactHash, redactMask, redactTruncateIP, redactRemove:
+		default:
+			return nil, fmt.Errorf("Redact: Strategies: unknown strategy %q for field %s", strategy, name)
+		}
+
+		f.fields = append(f.fields, fidx)
+		f.strategies = append(f.strategies, strategy)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *Redact) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("redact.invalid_ips", atomic.LoadInt64(&f.invalidIPs))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Redact) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	for i, fidx := range f.fields {
+		val := l.Get(fidx)
+		if len(val) == 0 {
+			continue
+		}
+		l.Set(fidx, f.redact(f.strategies[i], val))
+	}
+
+	next(l)
+}
+
+// redact returns the redacted value of a non-empty field.
+func (f *Redact) redact(strategy string, val []byte) []byte {
+	switch strategy {
+	case redactHash:
+		h := sha256.New()
+		h.Write(f.salt)
+		h.Write(val)
+		sum := h.Sum(nil)
+		buf := make([]byte, hex.EncodedLen(len(sum)))
+		hex.Encode(buf, sum)
+		return buf
+	case redactMask:
+		return bytes.Repeat([]byte{'*'}, utf8.RuneCount(val))
+	case redactTruncateIP:
+		ip := truncateIP(net.ParseIP(string(val)))
+		if ip == nil {
+			atomic.AddInt64(&f.invalidIPs, 1)
+			return nil
+		}
+		return []byte(ip.String())
+	default:
+		return nil
+	}
+}
+
+// truncateIP returns ip with its last octet zeroed if it's an IPv4 address,
+// or its last 80 bits zeroed if it's an IPv6 address.
+func truncateIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	if ip != nil {
+		return ip.Mask(net.CIDRMask(48, 128))
+	}
+	return nil
+}
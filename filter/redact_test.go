@@ -0,0 +1,229 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     []string
+		fields     []string
+		strategies []string
+		salt       string
+
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:       "hash",
+			record:     []string{"bob@example.com", "x", ""},
+			fields:     []string{"foo"},
+			strategies: []string{"hash"},
+			want:       []string{"5ff860bf1190596c7188ab851db691f0f3169c453936e9e1eba2f9a47f7a0018", "x", ""},
+		},
+		{
+			name:       "salted hash",
+			record:     []string{"bob@example.com", "x", ""},
+			fields:     []string{"foo"},
+			strategies: []string{"hash"},
+			salt:       "pepper",
+			want:       []string{"40f27281a6f2d75f9690f415970debe57e538178a2ef93d532ee09f0fb0c90da", "x", ""},
+		},
+		{
+			name:       "mask",
+			record:     []string{"bob@example.com", "été", ""},
+			fields:     []string{"foo", "bar"},
+			strategies: []string{"mask"},
+			want:       []string{"***************", "***", ""},
+		},
+		{
+			name:       "truncate IPv4",
+			record:     []string{"192.168.12.34", "10.0.0.1", "x"},
+			fields:     []string{"foo", "bar"},
+			strategies: []string{"truncate_ip"},
+			want:       []string{"192.168.12.0", "10.0.0.0", "x"},
+		},
+		{
+			name:       "truncate IPv6",
+			record:     []string{"2001:db8:85a3:1234:5678:8a2e:370:7334", "::ffff:192.168.12.34", "x"},
+			fields:     []string{"foo", "bar"},
+			strategies: []string{"truncate_ip"},
+			want:       []string{"2001:db8:85a3::", "192.168.12.0", "x"},
+		},
+		{
+			name:       "truncate invalid IP",
+			record:     []string{"not-an-ip", "1.2.3", "x"},
+			fields:     []string{"foo", "bar"},
+			strategies: []string{"truncate_ip"},
+			want:       []string{"", "", "x"},
+		},
+		{
+			name:       "remove",
+			record:     []string{"bob@example.com", "x", "y"},
+			fields:     []string{"foo", "baz"},
+			strategies: []string{"remove"},
+			want:       []string{"", "x", ""},
+		},
+		{
+			name:       "strategy per field",
+			record:     []string{"bob@example.com", "1.2.3.4", "secret"},
+			fields:     []string{"foo", "bar", "baz"},
+			strategies: []string{"remove", "truncate_ip", "mask"},
+			want:       []string{"", "1.2.3.0", "******"},
+		},
+		{
+			name:       "empty fields left empty",
+			record:     []string{"", "", ""},
+			fields:     []string{"foo", "bar", "baz"},
+			strategies: []string{"hash", "mask", "truncate_ip"},
+			want:       []string{"", "", ""},
+		},
+
+		// errors
+		{
+			name:       "no fields",
+			strategies: []string{"hash"},
+			wantErr:    true,
+		},
+		{
+			name:    "no strategies",
+			fields:  []string{"foo"},
+			wantErr: true,
+		},
+		{
+			name:       "strategies count",
+			fields:     []string{"foo", "bar", "baz"},
+			strategies: []string{"hash", "mask"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown strategy",
+			fields:     []string{"foo"},
+			strategies: []string{"scramble"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown field",
+			fields:     []string{"nope"},
+			strategies: []string{"hash"},
+			wantErr:    true,
+		},
+	}
+
+	fields := []string{"foo", "bar", "baz"}
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewRedact(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &RedactConfig{
+						Fields:     tt.fields,
+						Strategies: tt.strategies,
+						Salt:       tt.salt,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			for i, v := range tt.record {
+				l.Set(baker.FieldIndex(i), []byte(v))
+			}
+
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+			if !kept {
+				t.Fatal("record discarded")
+			}
+
+			for i, want := range tt.want {
+				if got := string(l.Get(baker.FieldIndex(i))); got != want {
+					t.Errorf("field %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactHashStable(t *testing.T) {
+	f, err := NewRedact(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				return map[string]baker.FieldIndex{"foo": 0, "bar": 1}[name], true
+			},
+			DecodedConfig: &RedactConfig{Fields: []string{"foo", "bar"}, Strategies: []string{"hash"}, Salt: "s"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := make(map[string]string)
+	for _, rec := range [][2]string{{"alice", "bob"}, {"bob", "carol"}, {"carol", "alice"}} {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(rec[0]))
+		l.Set(1, []byte(rec[1]))
+		f.Process(l, func(baker.Record) {})
+
+		for i, v := range rec {
+			token := string(l.Get(baker.FieldIndex(i)))
+			if prev, ok := tokens[v]; ok && prev != token {
+				t.Errorf("%q hashed to %q, then to %q", v, prev, token)
+			}
+			tokens[v] = token
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token] {
+			t.Errorf("different values hashed to the same token %q", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestRedactStats(t *testing.T) {
+	f, err := NewRedact(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(name string) (baker.FieldIndex, bool) { return 0, true },
+			DecodedConfig: &RedactConfig{Fields: []string{"ip"}, Strategies: []string{"truncate_ip"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"1.2.3.4", "nope", "::1", "", "1.2.3.4.5"} {
+		l := &baker.LogLine{FieldSeparator: ','}
+		l.Set(0, []byte(ip))
+		f.Process(l, func(baker.Record) {})
+	}
+
+	stats := f.Stats()
+	if stats.NumProcessedLines != 5 {
+		t.Errorf("processed = %d, want 5", stats.NumProcessedLines)
+	}
+	if n := stats.Metrics.Get("c:redact.invalid_ips"); n != int64(2) {
+		t.Errorf("redact.invalid_ips = %v, want 2", n)
+	}
+}
@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// RegexExtractDesc describes the RegexExtract filter
+var RegexExtractDesc = baker.FilterDesc{
+	Name:   "RegexExtract",
+	New:    NewRegexExtract,
+	Config: &RegexExtractConfig{},
+	Help: "Extract the named capture groups of a regular expression applied to a field, and write each\n" +
+		"captured group into the field having the same name as the group.\n" +
+		"Groups that didn't participate in the match leave their field empty.",
+}
+
+// RegexExtractConfig holds config parameters of the RegexExtract filter.
+type RegexExtractConfig struct {
+	Field          string `help:"Name of the field the regular expression is applied to" required:"true"`
+	Pattern        string `help:"Regular expression with named capture groups, like (?P<name>...). Each group name must be a field name" required:"true"`
+	DropOnMismatch bool   `help:"If true, records not matching Pattern are discarded, otherwise they're left unchanged" default:"false"`
+}
+
+// RegexExtract filter extracts the named capture groups of a regular
+// expression applied to a field, into other fields.
+type RegexExtract struct {
+	processed int64
+	discarded int64
+	unmatched int64
+
+	field  baker.FieldIndex
+	re     *regexp.Regexp
+	groups []baker.FieldIndex // groups[i] is the field for the capture group i+1
+	drop   bool
+}
+
+// NewRegexExtract returns a RegexExtract filter.
+func NewRegexExtract(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &RegexExtractConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*RegexExtractConfig)
+
+	field, ok := cfg.FieldByName(dcfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("RegexExtract: unknown field %s", dcfg.Field)
+	}
+
+	re, err := regexp.Compile(dcfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("RegexExtract: Pattern: %s", err)
+	}
+
+	var groups []baker.FieldIndex
+	for i, name := range re.SubexpNames()[1:] {
+		if name == "" {
+			return nil, fmt.Errorf("RegexExtract: Pattern: capture group %d is not named, use (?:...) for non-capturing groups", i+1)
+		}
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("RegexExtract: Pattern: capture group %q doesn't match any field", name)
+		}
+		groups = append(groups, fidx)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("RegexExtract: Pattern: no named capture group")
+	}
+
+	return &RegexExtract{
+		field:  field,
+		re:     re,
+		groups: groups,
+		drop:   dcfg.DropOnMismatch,
+	}, nil
+}
+
+// Stats returns filter statistics.
+func (f *RegexExtract) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("regex_extract.unmatched", atomic.LoadInt64(&f.unmatched))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		NumFilteredLines:  atomic.LoadInt64(&f.discarded),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *RegexExtract) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	src := l.Get(f.field)
+	m := f.re.FindSubmatchIndex(src)
+	if m == nil {
+		atomic.AddInt64(&f.unmatched, 1)
+		if f.drop {
+			atomic.AddInt64(&f.discarded, 1)
+			return
+		}
+		next(l)
+		return
+	}
+
+	// Copy the matches before setting any field, since the source field
+	// may also be the destination of a group.
+	vals := make([][]byte, len(f.groups))
+	for i := range f.groups {
+		if s, e := m[2*i+2], m[2*i+3]; s >= 0 {
+			vals[i] = append([]byte(nil), src[s:e]...)
+		}
+	}
+	for i, fidx := range f.groups {
+		l.Set(fidx, vals[i])
+	}
+
+	next(l)
+}
@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestRegexExtract(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  string
+		field   string
+		pattern string
+		drop    bool
+
+		want    []string // nil: discarded
+		wantErr bool
+	}{
+		{
+			name:    "full match",
+			record:  "user=bob id=42,,",
+			field:   "foo",
+			pattern: `user=(?P<bar>\w+) id=(?P<baz>\d+)`,
+			want:    []string{"user=bob id=42", "bob", "42"},
+		},
+		{
+			name:    "partial match",
+			record:  "xx user=bob yy,,",
+			field:   "foo",
+			pattern: `user=(?P<bar>\w+)`,
+			want:    []string{"xx user=bob yy", "bob", ""},
+		},
+		{
+			name:    "optional group absent",
+			record:  "user=bob,old,old",
+			field:   "foo",
+			pattern: `user=(?P<bar>\w+)(?: id=(?P<baz>\d+))?`,
+			want:    []string{"user=bob", "bob", ""},
+		},
+		{
+			name:    "source is also destination",
+			record:  "user=bob,,",
+			field:   "foo",
+			pattern: `user=(?P<foo>\w+)`,
+			want:    []string{"bob", "", ""},
+		},
+		{
+			name:    "mismatch pass-through",
+			record:  "nothing here,old,old",
+			field:   "foo",
+			pattern: `user=(?P<bar>\w+)`,
+			want:    []string{"nothing here", "old", "old"},
+		},
+		{
+			name:    "mismatch dropped",
+			record:  "nothing here,old,old",
+			field:   "foo",
+			pattern: `user=(?P<bar>\w+)`,
+			drop:    true,
+			want:    nil,
+		},
+
+		// errors
+		{
+			name:    "unknown field",
+			field:   "non-existent",
+			pattern: `(?P<bar>\w+)`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			field:   "foo",
+			pattern: `(?P<bar>\w+`,
+			wantErr: true,
+		},
+		{
+			name:    "no named group",
+			field:   "foo",
+			pattern: `\w+`,
+			wantErr: true,
+		},
+		{
+			name:    "unnamed group",
+			field:   "foo",
+			pattern: `(?P<bar>\w+)(\d+)`,
+			wantErr: true,
+		},
+		{
+			name:    "group name not a field",
+			field:   "foo",
+			pattern: `(?P<qux>\w+)`,
+			wantErr: true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "bar":
+			return 1, true
+		case "baz":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewRegexExtract(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &RegexExtractConfig{
+						Field:          tt.field,
+						Pattern:        tt.pattern,
+						DropOnMismatch: tt.drop,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+
+			if kept != (tt.want != nil) {
+				t.Fatalf("got record kept=%t, want %t", kept, tt.want != nil)
+			}
+			for i, want := range tt.want {
+				if got := string(l.Get(baker.FieldIndex(i))); got != want {
+					t.Errorf("field %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
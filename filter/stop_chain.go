@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// StopChainDesc describes the StopChain filter
+var StopChainDesc = baker.FilterDesc{
+	Name:   "StopChain",
+	New:    NewStopChain,
+	Config: &StopChainConfig{},
+	Help: "Send the records whose field matches any of the provided strings straight to the outputs,\n" +
+		"skipping the next filters of the chain. Other records go through the next filters as usual.\n" +
+		"This can be used, for example, to bypass the rest of the chain for an allowlist of records.",
+}
+
+// StopChainConfig holds config parameters of the StopChain filter.
+type StopChainConfig struct {
+	Field       string   `help:"name of the field which value is used for string comparison" required:"true"`
+	Strings     []string `help:"list of strings to match." required:"true"`
+	InvertMatch bool     `help:"Invert the match outcome, so that records skip the next filters if they don't match any of the strings" default:"false"`
+}
+
+// StopChain filter sends the records matching a field value straight to the
+// outputs.
+type StopChain struct {
+	field   baker.FieldIndex
+	strings [][]byte
+	invert  bool
+
+	processed int64
+	stopped   int64
+}
+
+// NewStopChain returns a StopChain filter.
+func NewStopChain(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &StopChainConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*StopChainConfig)
+
+	if len(dcfg.Strings) == 0 {
+		return nil, fmt.Errorf("StopChain: at least one string must be defined in Strings")
+	}
+
+	fidx, ok := cfg.FieldByName(dcfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("StopChain: unknown field %s", dcfg.Field)
+	}
+
+	var strings [][]byte
+	for i := range dcfg.Strings {
+		strings = append(strings, []byte(dcfg.Strings[i]))
+	}
+
+	return &StopChain{field: fidx, strings: strings, invert: dcfg.InvertMatch}, nil
+}
+
+// Stats returns filter statistics.
+func (f *StopChain) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("stop_chain.stopped", atomic.LoadInt64(&f.stopped))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		Metrics:           bag,
+	}
+}
+
+func (f *StopChain) isMatchAny(l baker.Record) bool {
+	buf := l.Get(f.field)
+	for i := range f.strings {
+		if bytes.Equal(buf, f.strings[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Process forwards all records to the next filter. It's only called when
+// the filter is used outside of a topology, since the topology calls
+// ProcessChain.
+func (f *StopChain) Process(l baker.Record, next func(baker.Record)) {
+	f.ProcessChain(l, next, next)
+}
+
+// ProcessChain is where the actual filtering takes place.
+func (f *StopChain) ProcessChain(l baker.Record, next, end func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	if f.isMatchAny(l) == !f.invert {
+		atomic.AddInt64(&f.stopped, 1)
+		end(l)
+		return
+	}
+
+	next(l)
+}
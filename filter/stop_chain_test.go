@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestStopChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		strings []string
+		invert  bool
+
+		wantNext, wantEnd bool
+		wantErr           bool
+	}{
+		{
+			name:    "match",
+			value:   "foo",
+			strings: []string{"foo", "bar"},
+			wantEnd: true,
+		},
+		{
+			name:     "no match",
+			value:    "baz",
+			strings:  []string{"foo", "bar"},
+			wantNext: true,
+		},
+		{
+			name:     "inverted match",
+			value:    "foo",
+			strings:  []string{"foo", "bar"},
+			invert:   true,
+			wantNext: true,
+		},
+		{
+			name:    "inverted no match",
+			value:   "baz",
+			strings: []string{"foo", "bar"},
+			invert:  true,
+			wantEnd: true,
+		},
+		{
+			name:    "no strings",
+			wantErr: true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		if name == "field" {
+			return 0, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewStopChain(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &StopChainConfig{
+						Field:       "field",
+						Strings:     tt.strings,
+						InvertMatch: tt.invert,
+					},
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			l.Set(0, []byte(tt.value))
+
+			var gotNext, gotEnd bool
+			f.(baker.ChainStopper).ProcessChain(l,
+				func(baker.Record) { gotNext = true },
+				func(baker.Record) { gotEnd = true })
+			if gotNext != tt.wantNext || gotEnd != tt.wantEnd {
+				t.Errorf("next called = %t, end called = %t, want %t and %t", gotNext, gotEnd, tt.wantNext, tt.wantEnd)
+			}
+
+			// Outside of a topology, records are always forwarded.
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+			if !kept {
+				t.Error("Process: record discarded")
+			}
+		})
+	}
+}
+
+func TestStopChainUnknownField(t *testing.T) {
+	_, err := NewStopChain(baker.FilterParams{
+		ComponentParams: baker.ComponentParams{
+			FieldByName:   func(string) (baker.FieldIndex, bool) { return 0, false },
+			DecodedConfig: &StopChainConfig{Field: "nope", Strings: []string{"foo"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("got no error")
+	}
+}
@@ -0,0 +1,153 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// TemplateDesc describes the Template filter
+var TemplateDesc = baker.FilterDesc{
+	Name:   "Template",
+	New:    NewTemplate,
+	Config: &TemplateConfig{},
+	Help: "Build a field from a template string, where each {field_name} placeholder is replaced\n" +
+		"with the value of the field in the current record. The rest of the template is copied as-is;\n" +
+		"use {{ and }} for literal braces.\n" +
+		"For example, with Template=\"{country}/{date}\", a record with country=\"fr\" and date=\"2020-05-01\"\n" +
+		"gets the \"fr/2020-05-01\" value in DstField.",
+}
+
+// TemplateConfig holds config parameters of the Template filter.
+type TemplateConfig struct {
+	DstField       string `help:"The field name to save the built value to" required:"true"`
+	Template       string `help:"The template string, with {field_name} placeholders" required:"true"`
+	ErrorOnMissing bool   `help:"If true, a placeholder referring to a field not in [fields] is a configuration error, otherwise it resolves to an empty string" default:"false"`
+}
+
+// templateChunk is either a literal, or a placeholder for a field value.
+type templateChunk struct {
+	lit     []byte
+	field   baker.FieldIndex
+	isField bool
+}
+
+// Template filter builds a field from a template string.
+type Template struct {
+	numProcessedLines int64
+
+	dst    baker.FieldIndex
+	chunks []templateChunk
+	litlen int // total length of literal chunks
+}
+
+// NewTemplate returns a Template filter.
+func NewTemplate(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &TemplateConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*TemplateConfig)
+
+	dst, ok := cfg.FieldByName(dcfg.DstField)
+	if !ok {
+		return nil, fmt.Errorf("Template: unknown field %s", dcfg.DstField)
+	}
+
+	chunks, err := parseTemplate(dcfg.Template, cfg.FieldByName, dcfg.ErrorOnMissing)
+	if err != nil {
+		return nil, fmt.Errorf("Template: %s", err)
+	}
+
+	f := &Template{dst: dst, chunks: chunks}
+	for _, c := range chunks {
+		f.litlen += len(c.lit)
+	}
+	return f, nil
+}
+
+// parseTemplate splits tmpl into literal and field chunks. Placeholders
+// referring to unknown fields are either an error, if strict is true, or
+// removed from the template.
+func parseTemplate(tmpl string, fieldByName func(string) (baker.FieldIndex, bool), strict bool) ([]templateChunk, error) {
+	var (
+		chunks []templateChunk
+		lit    []byte
+	)
+
+	flushLit := func() {
+		if len(lit) != 0 {
+			chunks = append(chunks, templateChunk{lit: lit})
+			lit = nil
+		}
+	}
+
+	for i := 0; i < len(tmpl); i++ {
+		switch c := tmpl[i]; c {
+		case '{':
+			if i+1 < len(tmpl) && tmpl[i+1] == '{' {
+				lit = append(lit, '{')
+				i++
+				continue
+			}
+			end := strings.IndexByte(tmpl[i+1:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed placeholder at offset %d", i)
+			}
+			name := tmpl[i+1 : i+1+end]
+			if name == "" {
+				return nil, fmt.Errorf("empty placeholder at offset %d", i)
+			}
+			i += end + 1
+
+			fidx, ok := fieldByName(name)
+			if !ok {
+				if strict {
+					return nil, fmt.Errorf("unknown field %s", name)
+				}
+				continue
+			}
+			flushLit()
+			chunks = append(chunks, templateChunk{field: fidx, isField: true})
+		case '}':
+			if i+1 < len(tmpl) && tmpl[i+1] == '}' {
+				lit = append(lit, '}')
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected '}' at offset %d, use '}}' for a literal brace", i)
+		default:
+			lit = append(lit, c)
+		}
+	}
+	flushLit()
+
+	return chunks, nil
+}
+
+// Stats returns filter statistics.
+func (f *Template) Stats() baker.FilterStats {
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.numProcessedLines),
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Template) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+
+	// The destination field can also be referenced by the template, so
+	// always build the value in a new buffer.
+	buf := make([]byte, 0, f.litlen+64)
+	for _, c := range f.chunks {
+		if c.isField {
+			buf = append(buf, l.Get(c.field)...)
+		} else {
+			buf = append(buf, c.lit...)
+		}
+	}
+
+	l.Set(f.dst, buf)
+	next(l)
+}
@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   string
+		dst      string
+		template string
+		strict   bool
+
+		want    string
+		wantErr bool
+	}{
+		{
+			name:     "single placeholder",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "{foo}",
+			want:     "abc",
+		},
+		{
+			name:     "interleaved literals",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "<{foo}/{bar}-{foo}>",
+			want:     "<abc/def-abc>",
+		},
+		{
+			name:     "adjacent placeholders",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "{foo}{bar}",
+			want:     "abcdef",
+		},
+		{
+			name:     "literal only",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "constant",
+			want:     "constant",
+		},
+		{
+			name:     "escaped braces",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "{{{foo}}}",
+			want:     "{abc}",
+		},
+		{
+			name:     "destination referenced in template",
+			record:   "abc,def,ghi",
+			dst:      "foo",
+			template: "{foo}.{foo}",
+			want:     "abc.abc",
+		},
+		{
+			name:     "destination created",
+			record:   "abc,def",
+			dst:      "qux",
+			template: "{bar}:{foo}",
+			want:     "def:abc",
+		},
+		{
+			name:     "empty field",
+			record:   "abc,,ghi",
+			dst:      "qux",
+			template: "{foo}/{bar}/{baz}",
+			want:     "abc//ghi",
+		},
+		{
+			name:     "unknown field resolves to empty",
+			record:   "abc,def,ghi",
+			dst:      "baz",
+			template: "{foo}/{unknown}/{bar}",
+			want:     "abc//def",
+		},
+
+		// errors
+		{
+			name:     "unknown field strict",
+			dst:      "baz",
+			template: "{foo}/{unknown}",
+			strict:   true,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown destination",
+			dst:      "unknown",
+			template: "{foo}",
+			wantErr:  true,
+		},
+		{
+			name:     "unclosed placeholder",
+			dst:      "baz",
+			template: "{foo",
+			wantErr:  true,
+		},
+		{
+			name:     "empty placeholder",
+			dst:      "baz",
+			template: "a{}b",
+			wantErr:  true,
+		},
+		{
+			name:     "unexpected closing brace",
+			dst:      "baz",
+			template: "a}b",
+			wantErr:  true,
+		},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "bar":
+			return 1, true
+		case "baz":
+			return 2, true
+		case "qux":
+			return 5, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewTemplate(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &TemplateConfig{
+						DstField:       tt.dst,
+						Template:       tt.template,
+						ErrorOnMissing: tt.strict,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+
+			f.Process(l, func(baker.Record) {})
+
+			dst, _ := fieldByName(tt.dst)
+			if got := string(l.Get(dst)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// TokenizeDesc describes the Tokenize filter
+var TokenizeDesc = baker.FilterDesc{
+	Name:   "Tokenize",
+	New:    NewTokenize,
+	Config: &TokenizeConfig{},
+	Help: "Split a field, or the whole record text, into fields with a regular expression: the capture\n" +
+		"groups of Pattern are written, in order, into the fields listed in DstFields.\n" +
+		"This allows to parse log lines that can't be split with a plain separator.\n" +
+		"Groups that didn't participate in the match leave their field empty.",
+}
+
+// TokenizeConfig holds config parameters of the Tokenize filter.
+type TokenizeConfig struct {
+	Field          string   `help:"Name of the field the regular expression is applied to. If not set, it's applied to the whole record text"`
+	Pattern        string   `help:"Regular expression with as many capture groups as DstFields" required:"true"`
+	DstFields      []string `help:"Names of the fields receiving the capture groups of Pattern, in order" required:"true"`
+	DropOnMismatch bool     `help:"If true, records not matching Pattern are discarded, otherwise they're left unchanged" default:"false"`
+}
+
+// Tokenize filter splits a field, or the whole record, into fields with the
+// capture groups of a regular expression.
+type Tokenize struct {
+	processed int64
+	discarded int64
+	unmatched int64
+
+	field    baker.FieldIndex
+	hasField bool // if false, the regular expression is applied to the record text
+	re       *regexp.Regexp
+	dsts     []baker.FieldIndex // dsts[i] is the field for the capture group i+1
+	drop     bool
+}
+
+// NewTokenize returns a Tokenize filter.
+func NewTokenize(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &TokenizeConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*TokenizeConfig)
+
+	f := &Tokenize{drop: dcfg.DropOnMismatch}
+
+	if dcfg.Field != "" {
+		field, ok := cfg.FieldByName(dcfg.Field)
+		if !ok {
+			return nil, fmt.Errorf("Tokenize: unknown field %s", dcfg.Field)
+		}
+		f.field, f.hasField = field, true
+	}
+
+	re, err := regexp.Compile(dcfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Tokenize: Pattern: %s", err)
+	}
+	if n := re.NumSubexp(); n != len(dcfg.DstFields) {
+		return nil, fmt.Errorf("Tokenize: Pattern has %d capture groups but DstFields has %d fields", n, len(dcfg.DstFields))
+	}
+	f.re = re
+
+	for _, name := range dcfg.DstFields {
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Tokenize: unknown field %s", name)
+		}
+		f.dsts = append(f.dsts, fidx)
+	}
+
+	return f, nil
+}
+
+// Stats returns filter statistics.
+func (f *Tokenize) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("tokenize.unmatched", atomic.LoadInt64(&f.unmatched))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.processed),
+		NumFilteredLines:  atomic.LoadInt64(&f.discarded),
+		Metrics:           bag,
+	}
+}
+
+// Process is where the actual filtering takes place.
+func (f *Tokenize) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.processed, 1)
+
+	var src []byte
+	if f.hasField {
+		src = l.Get(f.field)
+	} else {
+		src = l.ToText(nil)
+	}
+	m := f.re.FindSubmatchIndex(src)
+	if m == nil {
+		atomic.AddInt64(&f.unmatched, 1)
+		if f.drop {
+			atomic.AddInt64(&f.discarded, 1)
+			return
+		}
+		next(l)
+		return
+	}
+
+	// Copy the matches before setting any field, since the source field
+	// may also be one of the destinations.
+	vals := make([][]byte, len(f.dsts))
+	for i := range f.dsts {
+		if s, e := m[2*i+2], m[2*i+3]; s >= 0 {
+			vals[i] = append([]byte(nil), src[s:e]...)
+		}
+	}
+	for i, fidx := range f.dsts {
+		l.Set(fidx, vals[i])
+	}
+
+	next(l)
+}
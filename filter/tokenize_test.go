@@ -0,0 +1,162 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestTokenize(t *testing.T) {
+	// Apache-like access log, the user and the size are optional.
+	const accessLog = `^(\S+) (?:(\S+) )?"(\w+) (\S+)" (\d{3})(?: (\d+))?$`
+	accessFields := []string{"ip", "user", "method", "path", "status", "size"}
+
+	tests := []struct {
+		name      string
+		record    string
+		field     string
+		pattern   string
+		dstFields []string
+		drop      bool
+
+		want    []string // nil: discarded
+		wantErr bool
+	}{
+		{
+			name:      "all groups",
+			record:    `10.0.0.1 bob "GET /index.html" 200 512`,
+			field:     "line",
+			pattern:   accessLog,
+			dstFields: accessFields,
+			want:      []string{`10.0.0.1 bob "GET /index.html" 200 512`, "10.0.0.1", "bob", "GET", "/index.html", "200", "512"},
+		},
+		{
+			name:      "optional groups absent",
+			record:    `10.0.0.1 "POST /login" 302`,
+			field:     "line",
+			pattern:   accessLog,
+			dstFields: accessFields,
+			want:      []string{`10.0.0.1 "POST /login" 302`, "10.0.0.1", "", "POST", "/login", "302", ""},
+		},
+		{
+			name:      "whole record",
+			record:    `10.0.0.1 "GET /" 404`,
+			pattern:   accessLog,
+			dstFields: accessFields,
+			want:      []string{`10.0.0.1 "GET /" 404`, "10.0.0.1", "", "GET", "/", "404", ""},
+		},
+		{
+			name:      "source is also destination",
+			record:    "a:b",
+			field:     "line",
+			pattern:   `(\w+):(\w+)`,
+			dstFields: []string{"ip", "line"},
+			want:      []string{"b", "a"},
+		},
+		{
+			name:      "mismatch pass-through",
+			record:    "garbage,old,old",
+			field:     "line",
+			pattern:   accessLog,
+			dstFields: accessFields,
+			want:      []string{"garbage", "old", "old"},
+		},
+		{
+			name:      "mismatch dropped",
+			record:    "garbage,old,old",
+			field:     "line",
+			pattern:   accessLog,
+			dstFields: accessFields,
+			drop:      true,
+			want:      nil,
+		},
+
+		// errors
+		{
+			name:      "unknown field",
+			field:     "non-existent",
+			pattern:   `(\w+)`,
+			dstFields: []string{"ip"},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid pattern",
+			field:     "line",
+			pattern:   `(\w+`,
+			dstFields: []string{"ip"},
+			wantErr:   true,
+		},
+		{
+			name:      "too few groups",
+			field:     "line",
+			pattern:   `(\w+)`,
+			dstFields: []string{"ip", "user"},
+			wantErr:   true,
+		},
+		{
+			name:      "too many groups",
+			field:     "line",
+			pattern:   `(\w+) (\w+)`,
+			dstFields: []string{"ip"},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown destination field",
+			field:     "line",
+			pattern:   `(\w+)`,
+			dstFields: []string{"non-existent"},
+			wantErr:   true,
+		},
+	}
+
+	fields := append([]string{"line"}, accessFields...)
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		for i, f := range fields {
+			if f == name {
+				return baker.FieldIndex(i), true
+			}
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewTokenize(baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					FieldByName: fieldByName,
+					DecodedConfig: &TokenizeConfig{
+						Field:          tt.field,
+						Pattern:        tt.pattern,
+						DstFields:      tt.dstFields,
+						DropOnMismatch: tt.drop,
+					},
+				},
+			})
+
+			if (err != nil) != (tt.wantErr) {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			l := &baker.LogLine{FieldSeparator: ','}
+			if err := l.Parse([]byte(tt.record), nil); err != nil {
+				t.Fatalf("parse error: %q", err)
+			}
+
+			kept := false
+			f.Process(l, func(baker.Record) { kept = true })
+
+			if kept != (tt.want != nil) {
+				t.Fatalf("got record kept=%t, want %t", kept, tt.want != nil)
+			}
+			for i, want := range tt.want {
+				if got := string(l.Get(baker.FieldIndex(i))); got != want {
+					t.Errorf("field %d (%s) = %q, want %q", i, fields[i], got, want)
+				}
+			}
+		})
+	}
+}
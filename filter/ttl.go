@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+// TTLDesc describes the TTL filter.
+var TTLDesc = baker.FilterDesc{
+	Name:   "TTL",
+	New:    NewTTL,
+	Config: &TTLConfig{},
+	Help: "Discard records whose timestamp is older than MaxAge, that is records having been in the\n" +
+		"pipeline for too long. Records at exactly MaxAge are kept.",
+}
+
+// TTLConfig holds configuration parameters for the TTL filter.
+type TTLConfig struct {
+	TimestampField string        `help:"Name of the field containing the record timestamp" required:"true"`
+	Layout         string        `help:"Layout of the timestamp, either 'unix' for a Unix EPOCH timestamp in seconds, or a Go time layout (https://golang.org/pkg/time/#pkg-constants)" default:"unix"`
+	MaxAge         time.Duration `help:"Maximum age of a record, records older than that are discarded" required:"true"`
+	Unparseable    string        `help:"What to do with records with an unparseable timestamp: 'drop' or 'pass'" default:"drop"`
+}
+
+func (cfg *TTLConfig) fillDefaults() {
+	if cfg.Layout == "" {
+		cfg.Layout = "unix"
+	}
+	if cfg.Unparseable == "" {
+		cfg.Unparseable = "drop"
+	}
+}
+
+// TTL is a baker filter that discards records older than a given age.
+type TTL struct {
+	numProcessedLines int64
+	numFilteredLines  int64
+	numExpired        int64
+	numUnparseable    int64
+
+	fidx            baker.FieldIndex
+	layout          string
+	maxAge          time.Duration
+	dropUnparseable bool
+
+	now func() time.Time
+}
+
+// NewTTL creates and configures a TTL filter.
+func NewTTL(cfg baker.FilterParams) (baker.Filter, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &TTLConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*TTLConfig)
+	dcfg.fillDefaults()
+
+	fidx, ok := cfg.FieldByName(dcfg.TimestampField)
+	if !ok {
+		return nil, fmt.Errorf("TTL: unknown field %s", dcfg.TimestampField)
+	}
+
+	if dcfg.MaxAge <= 0 {
+		return nil, fmt.Errorf("TTL: MaxAge must be positive, got %s", dcfg.MaxAge)
+	}
+
+	var drop bool
+	switch dcfg.Unparseable {
+	case "drop":
+		drop = true
+	case "pass":
+	default:
+		return nil, fmt.Errorf("TTL: Unparseable must be 'drop' or 'pass', got %q", dcfg.Unparseable)
+	}
+
+	f := &TTL{
+		fidx:            fidx,
+		layout:          dcfg.Layout,
+		maxAge:          dcfg.MaxAge,
+		dropUnparseable: drop,
+		now:             time.Now,
+	}
+
+	return f, nil
+}
+
+// Stats implements baker.Filter.
+func (f *TTL) Stats() baker.FilterStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("ttl.expired", atomic.LoadInt64(&f.numExpired))
+	bag.AddRawCounter("ttl.unparseable", atomic.LoadInt64(&f.numUnparseable))
+
+	return baker.FilterStats{
+		NumProcessedLines: atomic.LoadInt64(&f.numProcessedLines),
+		NumFilteredLines:  atomic.LoadInt64(&f.numFilteredLines),
+		Metrics:           bag,
+	}
+}
+
+func (f *TTL) parse(buf []byte) (time.Time, error) {
+	if f.layout == "unix" {
+		sec, err := strconv.ParseInt(string(buf), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(f.layout, string(buf))
+}
+
+// Process implements baker.Filter.
+func (f *TTL) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.numProcessedLines, 1)
+
+	ts, err := f.parse(l.Get(f.fidx))
+	if err != nil {
+		atomic.AddInt64(&f.numUnparseable, 1)
+		if f.dropUnparseable {
+			atomic.AddInt64(&f.numFilteredLines, 1)
+			return
+		}
+		next(l)
+		return
+	}
+
+	if ts.Before(f.now().Add(-f.maxAge)) {
+		atomic.AddInt64(&f.numExpired, 1)
+		atomic.AddInt64(&f.numFilteredLines, 1)
+		return
+	}
+
+	next(l)
+}
@@ -0,0 +1,159 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestTTL(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		ts          string
+		layout      string
+		maxAge      time.Duration
+		unparseable string
+		want        bool // true: kept, false: discarded
+	}{
+		{
+			name:   "fresh",
+			ts:     "1591012790", // now - 10s
+			maxAge: time.Minute,
+			want:   true,
+		},
+		{
+			name:   "expired",
+			ts:     "1591012739", // now - 61s
+			maxAge: time.Minute,
+			want:   false,
+		},
+		{
+			name:   "on boundary",
+			ts:     "1591012740", // now - 60s
+			maxAge: time.Minute,
+			want:   true,
+		},
+		{
+			name:   "in the future",
+			ts:     "1591016400", // now + 1h
+			maxAge: time.Minute,
+			want:   true,
+		},
+		{
+			name:   "layout on boundary",
+			ts:     "2020-06-01T11:00:00Z",
+			layout: time.RFC3339,
+			maxAge: time.Hour,
+			want:   true,
+		},
+		{
+			name:   "layout expired",
+			ts:     "2020-06-01T13:59:59+03:00",
+			layout: time.RFC3339,
+			maxAge: time.Hour,
+			want:   false,
+		},
+		{
+			name:   "unparseable dropped by default",
+			ts:     "not a timestamp",
+			maxAge: time.Minute,
+			want:   false,
+		},
+		{
+			name:        "unparseable passed",
+			ts:          "",
+			maxAge:      time.Minute,
+			unparseable: "pass",
+			want:        true,
+		},
+		{
+			name:        "unparseable layout dropped",
+			ts:          "1591012790",
+			layout:      time.RFC3339,
+			maxAge:      time.Minute,
+			unparseable: "drop",
+			want:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &TTLConfig{
+						TimestampField: "timestamp",
+						Layout:         tt.layout,
+						MaxAge:         tt.maxAge,
+						Unparseable:    tt.unparseable,
+					},
+					FieldByName: func(name string) (baker.FieldIndex, bool) { return 0, true },
+				},
+			}
+			filter, err := NewTTL(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.(*TTL).now = func() time.Time { return now }
+
+			kept := false
+			ll := &baker.LogLine{FieldSeparator: ','}
+			ll.Set(0, []byte(tt.ts))
+			filter.Process(ll, func(baker.Record) { kept = true })
+
+			if kept != tt.want {
+				t.Errorf("got record kept=%t, want %t", kept, tt.want)
+			}
+
+			wantFiltered := int64(0)
+			if !tt.want {
+				wantFiltered = 1
+			}
+			if got := filter.Stats().NumFilteredLines; got != wantFiltered {
+				t.Errorf("NumFilteredLines = %d, want %d", got, wantFiltered)
+			}
+		})
+	}
+}
+
+func TestNewTTLErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  TTLConfig
+	}{
+		{
+			desc: "unknown field",
+			cfg:  TTLConfig{TimestampField: "foobar", MaxAge: time.Minute},
+		},
+		{
+			desc: "no MaxAge",
+			cfg:  TTLConfig{TimestampField: "timestamp"},
+		},
+		{
+			desc: "negative MaxAge",
+			cfg:  TTLConfig{TimestampField: "timestamp", MaxAge: -time.Minute},
+		},
+		{
+			desc: "invalid Unparseable",
+			cfg:  TTLConfig{TimestampField: "timestamp", MaxAge: time.Minute, Unparseable: "keep"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := baker.FilterParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &tt.cfg,
+					FieldByName: func(name string) (baker.FieldIndex, bool) {
+						return 0, name == "timestamp"
+					},
+				},
+			}
+			if _, err := NewTTL(cfg); err == nil {
+				t.Errorf("NewTTL() err = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package baker
+
+import (
+	"sync"
+	"time"
+)
+
+// Default batching of the filters implementing BatchFilter, see
+// ConfigFilter.BatchSize and ConfigFilter.BatchInterval.
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+)
+
+// filterBatcher accumulates the records received by a BatchFilter, and
+// passes them to it when the batch is full, when the batch interval
+// elapsed or on shutdown.
+type filterBatcher struct {
+	process  func([]Record) []Record
+	next     func(Record)
+	size     int
+	interval time.Duration
+
+	mu    sync.Mutex
+	batch []Record
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newFilterBatcher(process func([]Record) []Record, next func(Record), size int, interval time.Duration) *filterBatcher {
+	return &filterBatcher{
+		process:  process,
+		next:     next,
+		size:     size,
+		interval: interval,
+		batch:    make([]Record, 0, size),
+		done:     make(chan struct{}),
+	}
+}
+
+// add adds l to the current batch, processing it if it's full.
+//
+// Once add returns, the caller recycles l and the input may overwrite the
+// buffer l was parsed from (see Input.FreeMem), so the batch holds a deep
+// copy of l, sharing no memory with it (record copies which share the parsed
+// buffer, like LogLine.CopyOnWrite, can't be used here).
+func (b *filterBatcher) add(l Record) {
+	b.mu.Lock()
+	b.batch = append(b.batch, l.Copy())
+	var full []Record
+	if len(b.batch) >= b.size {
+		full = b.batch
+		b.batch = make([]Record, 0, b.size)
+	}
+	b.mu.Unlock()
+
+	if full != nil {
+		b.run(full)
+	}
+}
+
+// flush processes the current batch, if not empty.
+func (b *filterBatcher) flush() {
+	b.mu.Lock()
+	batch := b.batch
+	b.batch = make([]Record, 0, b.size)
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.run(batch)
+	}
+}
+
+func (b *filterBatcher) run(batch []Record) {
+	for _, l := range b.process(batch) {
+		b.next(l)
+	}
+}
+
+// start starts flushing the partial batches every interval, until stop is
+// called.
+func (b *filterBatcher) start() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		tick := time.NewTicker(b.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				b.flush()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the periodic flushes started by start, waiting for the
+// ongoing one, if any.
+func (b *filterBatcher) stop() {
+	close(b.done)
+	b.wg.Wait()
+}
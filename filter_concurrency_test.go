@@ -0,0 +1,167 @@
+package baker_test
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// busyFilter is a CPU-heavy filter, simulated by sleeping, that tracks
+// how many goroutines are running it at once.
+type busyFilter struct {
+	serial        bool
+	running, peak int64
+}
+
+func (f *busyFilter) Process(l baker.Record, next func(baker.Record)) {
+	n := atomic.AddInt64(&f.running, 1)
+	for {
+		peak := atomic.LoadInt64(&f.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&f.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt64(&f.running, -1)
+	next(l)
+}
+
+func (f *busyFilter) RequiresSerialization() bool { return f.serial }
+func (f *busyFilter) Stats() baker.FilterStats    { return baker.FilterStats{} }
+
+// runConcurrentChain runs records through f with the given filter
+// concurrency, and returns the records received by the output and the time
+// it took.
+func runConcurrentChain(t *testing.T, concurrency, records int, f baker.Filter) ([]baker.OutputRecord, time.Duration) {
+	t.Helper()
+
+	toml := fmt.Sprintf(`
+[general]
+filter_concurrency=%d
+
+[fields]
+names=["id"]
+
+[input]
+name="Channel"
+
+[[filter]]
+name="Slow"
+
+[output]
+name="Recorder"
+procs=1
+fields=["id"]
+`, concurrency)
+	in := &channelInput{ch: make(chan []byte, 1)}
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{{
+			Name:   "Slow",
+			New:    func(baker.FilterParams) (baker.Filter, error) { return f, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the records one per chunk, so that they can be spread among the
+	// filter goroutines.
+	start := time.Now()
+	topo.Start()
+	for i := 0; i < records; i++ {
+		in.ch <- []byte(fmt.Sprintf("%d\n", i))
+	}
+	close(in.ch)
+	topo.Wait()
+	elapsed := time.Since(start)
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return topo.Output[0].(*outputtest.Recorder).Records, elapsed
+}
+
+func TestFilterConcurrency(t *testing.T) {
+	const records = 200
+
+	_, serialTime := runConcurrentChain(t, 1, records, &busyFilter{})
+	f := &busyFilter{}
+	got, concTime := runConcurrentChain(t, 8, records, f)
+
+	if concTime*2 > serialTime {
+		t.Errorf("filter chain took %v with 8 goroutines, %v with 1, want it at least twice faster", concTime, serialTime)
+	}
+	if peak := atomic.LoadInt64(&f.peak); peak < 2 {
+		t.Errorf("filter run by at most %d goroutines at once, want more with filter_concurrency=8", peak)
+	}
+
+	// Each record is sent exactly once to the output.
+	seen := make(map[string]int)
+	for _, r := range got {
+		seen[r.Fields[0]]++
+	}
+	for i := 0; i < records; i++ {
+		if n := seen[fmt.Sprint(i)]; n != 1 {
+			t.Errorf("record %d received %d times by the output, want 1", i, n)
+		}
+	}
+	if len(got) != records {
+		t.Errorf("output received %d records, want %d", len(got), records)
+	}
+}
+
+func TestFilterConcurrencySerialFilter(t *testing.T) {
+	f := &busyFilter{serial: true}
+	got, _ := runConcurrentChain(t, 8, 50, f)
+
+	if peak := atomic.LoadInt64(&f.peak); peak != 1 {
+		t.Errorf("serial filter run by %d goroutines at once, want 1", peak)
+	}
+	if len(got) != 50 {
+		t.Errorf("output received %d records, want 50", len(got))
+	}
+}
+
+func TestFilterConcurrencyConfig(t *testing.T) {
+	toml := `
+[general]
+filter_concurrency=4
+
+[filterchain]
+procs=8
+
+[input]
+name="Channel"
+
+[output]
+name="Recorder"
+`
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return &channelInput{}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	_, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err == nil || !strings.Contains(err.Error(), "filter_concurrency") {
+		t.Errorf("NewConfigFromToml error = %v, want a filter_concurrency error", err)
+	}
+}
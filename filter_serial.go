@@ -0,0 +1,24 @@
+package baker
+
+import "sync"
+
+// serialize returns a function calling process by one goroutine at a time.
+func serialize(process func(Record)) func(Record) {
+	var mu sync.Mutex
+	return func(l Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		process(l)
+	}
+}
+
+// serializeBatch is like serialize, for the ProcessBatch method of a
+// BatchFilter.
+func serializeBatch(process func([]Record) []Record) func([]Record) []Record {
+	var mu sync.Mutex
+	return func(batch []Record) []Record {
+		mu.Lock()
+		defer mu.Unlock()
+		return process(batch)
+	}
+}
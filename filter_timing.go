@@ -0,0 +1,79 @@
+package baker
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// filterTiming holds the execution stats of a filter of the chain, measured
+// by the topology rather than reported by the filter itself.
+type filterTiming struct {
+	processed int64 // number of records received
+	dropped   int64 // number of records received that weren't sent to the next filter
+	nanos     int64 // time spent in the filter, excluding the next filters
+}
+
+// wrap returns a function calling f with the given next function, and end
+// function if f is a ChainStopper, and measuring its execution.
+func (ft *filterTiming) wrap(f Filter, next, end func(Record)) func(Record) {
+	cs, _ := f.(ChainStopper)
+	return func(l Record) {
+		var (
+			forwarded  bool
+			downstream time.Duration // time spent in the next filters, or outputs
+		)
+		forward := func(dst func(Record)) func(Record) {
+			return func(r Record) {
+				forwarded = true
+				t := time.Now()
+				dst(r)
+				downstream += time.Since(t)
+			}
+		}
+		start := time.Now()
+		if cs != nil {
+			cs.ProcessChain(l, forward(next), forward(end))
+		} else {
+			f.Process(l, forward(next))
+		}
+		elapsed := time.Since(start) - downstream
+
+		atomic.AddInt64(&ft.processed, 1)
+		if !forwarded {
+			atomic.AddInt64(&ft.dropped, 1)
+		}
+		atomic.AddInt64(&ft.nanos, int64(elapsed))
+	}
+}
+
+// wrapBatch returns a function calling f.ProcessBatch and measuring its
+// execution.
+func (ft *filterTiming) wrapBatch(f BatchFilter) func([]Record) []Record {
+	return func(batch []Record) []Record {
+		start := time.Now()
+		out := f.ProcessBatch(batch)
+		elapsed := time.Since(start)
+
+		atomic.AddInt64(&ft.processed, int64(len(batch)))
+		if len(out) < len(batch) {
+			atomic.AddInt64(&ft.dropped, int64(len(batch)-len(out)))
+		}
+		atomic.AddInt64(&ft.nanos, int64(elapsed))
+		return out
+	}
+}
+
+// report sends the stats of the filter at position idx in the chain, and
+// named name, to metrics.
+func (ft *filterTiming) report(metrics MetricsClient, idx int, name string) {
+	tags := []string{"filter:" + name, "filter_index:" + strconv.Itoa(idx)}
+
+	processed := atomic.LoadInt64(&ft.processed)
+	metrics.RawCountWithTags("filter.processed_lines", processed, tags)
+	metrics.RawCountWithTags("filter.dropped_lines", atomic.LoadInt64(&ft.dropped), tags)
+	if processed > 0 {
+		perRecord := time.Duration(atomic.LoadInt64(&ft.nanos) / processed)
+		metrics.GaugeWithTags("filter.processing_time_per_record", perRecord.Seconds(), tags)
+	}
+}
@@ -4,15 +4,13 @@ go 1.14
 
 require (
 	github.com/DataDog/datadog-go v3.2.0+incompatible
-	github.com/aws/aws-sdk-go v1.25.6-0.20191003182926-f28610301a1e
+	github.com/aws/aws-sdk-go v1.34.0
 	github.com/bmizerany/perks v0.0.0-20141205001514-d9a9656a3a4b
 	github.com/charmbracelet/glamour v0.2.0
 	github.com/google/uuid v1.1.2-0.20190416172445-c2e93f3ae59f
 	github.com/jpillora/backoff v0.0.0-20160301230512-f85df8d02bdf
 	github.com/juju/ratelimit v0.0.0-20151125201925-77ed1c8a0121
-	github.com/klauspost/compress v0.0.0-20160229075208-2d3d403f37d2
-	github.com/klauspost/cpuid v0.0.0-20160302075316-09cded8978dc // indirect
-	github.com/klauspost/crc32 v0.0.0-20160219142609-19b0b332c9e4 // indirect
+	github.com/klauspost/compress v1.10.5
 	github.com/mattn/go-sqlite3 v1.14.3
 	github.com/nsf/sexp v0.0.0-20130620094510-d3d2f2591f1d
 	github.com/pierrec/lz4/v3 v3.3.2
@@ -20,5 +18,7 @@ require (
 	github.com/sirupsen/logrus v1.4.2
 	github.com/valyala/gozstd v1.7.0
 	github.com/vmware/vmware-go-kcl v0.0.0-20200605022506-bd2980e951b3
-	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	golang.org/x/net v0.0.0-20200222125558-5a598a2470a0
 )
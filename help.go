@@ -104,6 +104,28 @@ func PrintHelp(w io.Writer, name string, comp Components, format HelpFormat) err
 		}
 	}
 
+	for _, rec := range comp.Records {
+		if strings.EqualFold(rec.Name, name) || dumpall {
+			if err := generateHelp(w, rec); err != nil {
+				return fmt.Errorf("can't print help for %q record: %v", rec.Name, err)
+			}
+			if !dumpall {
+				return nil
+			}
+		}
+	}
+
+	for _, mtr := range comp.Metrics {
+		if strings.EqualFold(mtr.Name, name) || dumpall {
+			if err := generateHelp(w, mtr); err != nil {
+				return fmt.Errorf("can't print help for %q metrics: %v", mtr.Name, err)
+			}
+			if !dumpall {
+				return nil
+			}
+		}
+	}
+
 	if !dumpall {
 		return fmt.Errorf("component not found: %s", name)
 	}
@@ -14,6 +14,7 @@ type baseDoc struct {
 type inputDoc struct{ baseDoc }
 type filterDoc struct{ baseDoc }
 type uploadDoc struct{ baseDoc }
+type recordDoc struct{ baseDoc }
 
 type outputDoc struct {
 	baseDoc
@@ -98,6 +99,24 @@ func newUploadDoc(desc UploadDesc) (uploadDoc, error) {
 	return doc, nil
 }
 
+func newRecordDoc(desc RecordDesc) (recordDoc, error) {
+	doc := recordDoc{
+		baseDoc{
+			name: desc.Name,
+			help: desc.Help,
+		},
+	}
+
+	var err error
+
+	doc.keys, err = configKeysFromStruct(desc.Config)
+	if err != nil {
+		return doc, fmt.Errorf("record %q: %v", desc.Name, err)
+	}
+
+	return doc, nil
+}
+
 func newMetricsDoc(desc MetricsDesc) (metricsDoc, error) {
 	doc := metricsDoc{
 		name: desc.Name,
@@ -177,6 +196,8 @@ func newHelpConfigKeyFromField(f reflect.StructField) (helpConfigKey, error) {
 		}
 	case reflect.Bool:
 		h.typ = "bool"
+	case reflect.Float64:
+		h.typ = "float"
 	default:
 		return h, fmt.Errorf("config key %q: unsupported type", f.Type.Name())
 	}
@@ -0,0 +1,69 @@
+package baker
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PrintComponentList prints the list of all the components, by type, along
+// with the first line of their help message. Use PrintHelp to print the
+// detailed help message of a component, including its configuration keys.
+func PrintComponentList(w io.Writer, comp Components) error {
+	type entry struct{ name, help string }
+
+	sections := []struct {
+		title   string
+		entries []entry
+	}{
+		{title: "Inputs"},
+		{title: "Filters"},
+		{title: "Outputs"},
+		{title: "Uploads"},
+		{title: "Metrics"},
+		{title: "Record types"},
+	}
+
+	for _, d := range comp.Inputs {
+		sections[0].entries = append(sections[0].entries, entry{d.Name, d.Help})
+	}
+	for _, d := range comp.Filters {
+		sections[1].entries = append(sections[1].entries, entry{d.Name, d.Help})
+	}
+	for _, d := range comp.Outputs {
+		sections[2].entries = append(sections[2].entries, entry{d.Name, d.Help})
+	}
+	for _, d := range comp.Uploads {
+		sections[3].entries = append(sections[3].entries, entry{d.Name, d.Help})
+	}
+	for _, d := range comp.Metrics {
+		sections[4].entries = append(sections[4].entries, entry{d.Name, ""})
+	}
+	for _, d := range comp.Records {
+		sections[5].entries = append(sections[5].entries, entry{d.Name, d.Help})
+	}
+
+	for _, s := range sections {
+		if len(s.entries) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s:\n", s.title); err != nil {
+			return err
+		}
+		for _, e := range s.entries {
+			summary := strings.TrimSpace(e.help)
+			if nl := strings.IndexByte(summary, '\n'); nl >= 0 {
+				summary = summary[:nl]
+			}
+			line := strings.TrimRight(fmt.Sprintf("  %-24s %s", e.name, summary), " ")
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -107,6 +107,12 @@ func GenerateMarkdownHelp(w io.Writer, desc interface{}) error {
 			return err
 		}
 		genUploadMarkdown(w, doc)
+	case RecordDesc:
+		doc, err := newRecordDoc(d)
+		if err != nil {
+			return err
+		}
+		genRecordMarkdown(w, doc)
 	case MetricsDesc:
 		doc, err := newMetricsDoc(d)
 		if err != nil {
@@ -201,6 +207,21 @@ func genUploadMarkdown(w io.Writer, doc uploadDoc) {
 	}
 }
 
+func genRecordMarkdown(w io.Writer, doc recordDoc) {
+	fmt.Fprintf(w, "## Record *%s*\n", doc.name)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "### Overview")
+	fmt.Fprintln(w, breakAfterDots(doc.help))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "### Configuration")
+	if len(doc.keys) == 0 {
+		fmt.Fprintf(w, "No configuration available")
+	} else {
+		fmt.Fprintf(w, "\nKeys available in the `[record.config]` section:\n\n")
+		genConfigKeysMarkdown(w, doc.keys)
+	}
+}
+
 func genMetricsMarkdown(w io.Writer, doc metricsDoc) {
 	fmt.Fprintf(w, "## Metrics *%s*\n", doc.name)
 	fmt.Fprintln(w)
@@ -1,11 +1,15 @@
 package baker_test
 
 import (
+	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/filter"
 	"github.com/AdRoll/baker/input"
+	"github.com/AdRoll/baker/metrics"
 	"github.com/AdRoll/baker/output"
 	"github.com/AdRoll/baker/upload"
 )
@@ -54,3 +58,55 @@ func TestAllUploadsHaveConfigHelp(t *testing.T) {
 		assertValidConfigHelp(t, upload.Name, upload.Config)
 	}
 }
+
+func TestAllMetricsHaveConfigHelp(t *testing.T) {
+	for _, metrics := range metrics.All {
+		assertValidConfigHelp(t, metrics.Name, metrics.Config)
+	}
+}
+
+func TestSQSHelp(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := baker.GenerateTextHelp(buf, input.SQSDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	var line string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(l, "QueuePrefixes ") {
+			line = l
+			break
+		}
+	}
+	if line == "" {
+		t.Fatalf("help doesn't contain QueuePrefixes:\n%s", buf)
+	}
+
+	// Columns are name, type, default, required and help.
+	cols := strings.Split(line, "|")
+	if len(cols) < 4 || strings.TrimSpace(cols[3]) != "true" {
+		t.Errorf("QueuePrefixes isn't marked as required:\n%s", line)
+	}
+}
+
+func TestPrintComponentList(t *testing.T) {
+	comp := baker.Components{
+		Inputs:  input.All,
+		Filters: filter.All,
+		Outputs: output.All,
+		Uploads: upload.All,
+		Metrics: metrics.All,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := baker.PrintComponentList(buf, comp); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"Inputs:\n", "Filters:\n", "Outputs:\n", "Uploads:\n", "Metrics:\n", "  SQS ", "  ReplaceFields "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("component list doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
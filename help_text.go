@@ -46,6 +46,12 @@ func GenerateTextHelp(w io.Writer, desc interface{}) error {
 			return err
 		}
 		genUploadText(w, doc)
+	case RecordDesc:
+		doc, err := newRecordDoc(d)
+		if err != nil {
+			return err
+		}
+		genRecordText(w, doc)
 	case MetricsDesc:
 		doc, err := newMetricsDoc(d)
 		if err != nil {
@@ -143,6 +149,23 @@ func genUploadText(w io.Writer, doc uploadDoc) {
 	fmt.Fprintln(w)
 }
 
+func genRecordText(w io.Writer, doc recordDoc) {
+	fmt.Fprintf(w, "=============================================\n")
+	fmt.Fprintf(w, "Record: %s\n", doc.name)
+	fmt.Fprintf(w, "=============================================\n")
+	fmt.Fprintf(w, doc.help)
+
+	if len(doc.keys) == 0 {
+		fmt.Fprintf(w, "\n(no configuration available)\n\n")
+	} else {
+		fmt.Fprintf(w, "\nKeys available in the [record.config] section:\n\n")
+		genConfigKeysText(w, doc.keys)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w)
+}
+
 func genMetricsText(w io.Writer, doc metricsDoc) {
 	fmt.Fprintf(w, "=============================================\n")
 	fmt.Fprintf(w, "Metrics: %s\n", doc.name)
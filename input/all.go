@@ -7,9 +7,14 @@ import (
 
 // All is the list of all baker inputs.
 var All = []baker.InputDesc{
+	AzureQueueDesc,
+	ChannelDesc,
+	HTTPDesc,
 	KCLDesc,
 	KinesisDesc,
 	ListDesc,
+	PubSubDesc,
+	StdinDesc,
 	SQSDesc,
 	TCPDesc,
 }
@@ -0,0 +1,195 @@
+package input
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the version of the Azure Storage REST API used by the
+// Azure clients.
+const azureAPIVersion = "2019-12-12"
+
+// azureError is an error response of the Azure Storage REST API.
+type azureError struct {
+	Status  int    // HTTP status code
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *azureError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure storage: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("azure storage: %s (HTTP %d): %s", e.Code, e.Status, strings.TrimSpace(e.Message))
+}
+
+// azureStorage sends requests to an Azure Storage service (queue or blob),
+// authenticated with a shared access signature.
+type azureStorage struct {
+	endpoint string // URL of the service, like https://ACCOUNT.queue.core.windows.net
+	sas      url.Values
+	client   *http.Client
+}
+
+// newAzureStorage returns an azureStorage sending requests to endpoint, with
+// the given shared access signature token (a query string, with or without
+// a leading '?').
+func newAzureStorage(endpoint, sasToken string, client *http.Client) (*azureStorage, error) {
+	sas, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAS token: %v", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &azureStorage{endpoint: strings.TrimSuffix(endpoint, "/"), sas: sas, client: client}, nil
+}
+
+// url returns the URL of the resource at path (already escaped) with the
+// given query parameters.
+func (s *azureStorage) url(path string, query url.Values) string {
+	q := url.Values{}
+	for k, v := range s.sas {
+		q[k] = v
+	}
+	for k, v := range query {
+		q[k] = v
+	}
+	u := s.endpoint + "/" + path
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// do sends a request and returns its response, or an *azureError if its
+// status code isn't the expected one.
+func (s *azureStorage) do(ctx context.Context, method, path string, query url.Values, want int) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(path, query), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		defer resp.Body.Close()
+		aerr := &azureError{Status: resp.StatusCode}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(body, aerr)
+		if aerr.Code == "" {
+			aerr.Code = resp.Header.Get("x-ms-error-code")
+		}
+		return nil, aerr
+	}
+	return resp, nil
+}
+
+// azureMessage is a message of an Azure Storage queue.
+type azureMessage struct {
+	ID           string `xml:"MessageId"`
+	PopReceipt   string `xml:"PopReceipt"`
+	DequeueCount int    `xml:"DequeueCount"`
+	Text         string `xml:"MessageText"`
+}
+
+// azureQueueClient receives and deletes messages of an Azure Storage queue.
+// It's an interface so that tests can use a fake queue.
+type azureQueueClient interface {
+	// ReceiveMessages receives up to n messages, which become invisible for
+	// the given duration.
+	ReceiveMessages(ctx context.Context, n int, visibility time.Duration) ([]azureMessage, error)
+
+	// DeleteMessage deletes a received message.
+	DeleteMessage(ctx context.Context, msg azureMessage) error
+}
+
+// azureQueue is the azureQueueClient of an Azure Storage queue.
+type azureQueue struct {
+	storage *azureStorage
+	name    string
+}
+
+func (q *azureQueue) ReceiveMessages(ctx context.Context, n int, visibility time.Duration) ([]azureMessage, error) {
+	query := url.Values{
+		"numofmessages":     {strconv.Itoa(n)},
+		"visibilitytimeout": {strconv.Itoa(int(visibility / time.Second))},
+	}
+	resp, err := q.storage.do(ctx, http.MethodGet, url.PathEscape(q.name)+"/messages", query, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Messages []azureMessage `xml:"QueueMessage"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid Get Messages response: %v", err)
+	}
+	return list.Messages, nil
+}
+
+func (q *azureQueue) DeleteMessage(ctx context.Context, msg azureMessage) error {
+	path := url.PathEscape(q.name) + "/messages/" + url.PathEscape(msg.ID)
+	resp, err := q.storage.do(ctx, http.MethodDelete, path, url.Values{"popreceipt": {msg.PopReceipt}}, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureContainer is the inpututils.BlobReader of the blobs of an Azure
+// Storage container, identified by their name.
+type azureContainer struct {
+	storage *azureStorage
+	name    string
+}
+
+// blobPath returns the escaped path of a blob.
+func (c *azureContainer) blobPath(blob string) string {
+	segs := strings.Split(blob, "/")
+	for i := range segs {
+		segs[i] = url.PathEscape(segs[i])
+	}
+	return url.PathEscape(c.name) + "/" + strings.Join(segs, "/")
+}
+
+// OpenBlob implements inpututils.BlobReader.
+func (c *azureContainer) OpenBlob(ctx context.Context, blob string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+	path := c.blobPath(blob)
+	resp, err := c.storage.do(ctx, http.MethodGet, path, nil, http.StatusOK)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, err
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	u, err := url.Parse(c.storage.endpoint + "/" + path)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, time.Time{}, nil, err
+	}
+	return resp.Body, resp.ContentLength, lastModified, u, nil
+}
+
+// BlobSize implements inpututils.BlobReader.
+func (c *azureContainer) BlobSize(ctx context.Context, blob string) (int64, error) {
+	resp, err := c.storage.do(ctx, http.MethodHead, c.blobPath(blob), nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
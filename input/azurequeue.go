@@ -0,0 +1,384 @@
+package input
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inpututils"
+)
+
+var AzureQueueDesc = baker.InputDesc{
+	Name:   "AzureQueue",
+	New:    NewAzureQueue,
+	Config: &AzureQueueConfig{},
+	Help: "This input listens on an Azure Storage queue for new incoming log files in a blob\n" +
+		"container, like the SQS input does for S3 files: the queue is typically populated by Event\n" +
+		"Grid with the BlobCreated events of the container. The blobs are read like the S3 files\n" +
+		"(gzip or zstd compressed) and the messages are deleted once their blobs have been processed.\n" +
+		"Requests are authenticated with a shared access signature (SAS) token.\n" +
+		"It never exits.\n",
+}
+
+const (
+	azureFormatEventGrid = "eventgrid"
+	azureFormatPlain     = "plain"
+
+	azureEncodingBase64 = "base64"
+	azureEncodingNone   = "none"
+)
+
+type AzureQueueConfig struct {
+	Account           string        `help:"Name of the Azure Storage account" required:"true"`
+	Queue             string        `help:"Name of the queue to monitor" required:"true"`
+	Container         string        `help:"Name of the container of the blobs notified on the queue" required:"true"`
+	SASToken          string        `help:"Shared access signature token granting the read permission on the container and the process permission on the queue. Defaults to the AZURE_STORAGE_SAS_TOKEN environment variable"`
+	QueueEndpoint     string        `help:"If provided, URL of the queue service (e.g. Azurite), instead of https://ACCOUNT.queue.core.windows.net"`
+	BlobEndpoint      string        `help:"If provided, URL of the blob service (e.g. Azurite), instead of https://ACCOUNT.blob.core.windows.net"`
+	MessageFormat     string        `help:"The format of the queue messages.\n'eventgrid' the messages are Event Grid events, the BlobCreated events of Container are processed.\n'plain' the messages are the names of the blobs in Container." default:"eventgrid"`
+	MessageEncoding   string        `help:"The encoding of the queue messages: 'base64' (as sent by Event Grid) or 'none'" default:"base64"`
+	FilePathFilter    string        `help:"If provided, will only use the blobs whose name matches this regular expression"`
+	PollWorkers       int           `help:"Number of workers concurrently polling the queue" default:"1"`
+	VisibilityTimeout time.Duration `help:"Time during which a received message is invisible to the other readers, which should be enough to process its blobs. Must be at least 1s" default:"5m"`
+	IdleDelay         time.Duration `help:"Time to wait before polling the queue again after it returned no message" default:"1s"`
+}
+
+func (cfg *AzureQueueConfig) fillDefaults() {
+	if cfg.SASToken == "" {
+		cfg.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	if cfg.QueueEndpoint == "" {
+		cfg.QueueEndpoint = "https://" + cfg.Account + ".queue.core.windows.net"
+	}
+	if cfg.BlobEndpoint == "" {
+		cfg.BlobEndpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	if cfg.MessageFormat == "" {
+		cfg.MessageFormat = azureFormatEventGrid
+	} else {
+		cfg.MessageFormat = strings.ToLower(cfg.MessageFormat)
+	}
+	if cfg.MessageEncoding == "" {
+		cfg.MessageEncoding = azureEncodingBase64
+	} else {
+		cfg.MessageEncoding = strings.ToLower(cfg.MessageEncoding)
+	}
+	if cfg.PollWorkers <= 0 {
+		cfg.PollWorkers = 1
+	}
+	if cfg.VisibilityTimeout == 0 {
+		cfg.VisibilityTimeout = 5 * time.Minute
+	}
+	if cfg.IdleDelay <= 0 {
+		cfg.IdleDelay = time.Second
+	}
+}
+
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *AzureQueueConfig) ValidateConfig(func(string) (baker.FieldIndex, bool)) error {
+	switch strings.ToLower(cfg.MessageFormat) {
+	case "", azureFormatEventGrid, azureFormatPlain:
+	default:
+		return fmt.Errorf("MessageFormat: unsupported format %q", cfg.MessageFormat)
+	}
+	switch strings.ToLower(cfg.MessageEncoding) {
+	case "", azureEncodingBase64, azureEncodingNone:
+	default:
+		return fmt.Errorf("MessageEncoding: unsupported encoding %q", cfg.MessageEncoding)
+	}
+	if _, err := regexp.Compile(cfg.FilePathFilter); err != nil {
+		return fmt.Errorf("FilePathFilter: %v", err)
+	}
+	if cfg.PollWorkers < 0 {
+		return fmt.Errorf("PollWorkers: must be positive, got %d", cfg.PollWorkers)
+	}
+	if cfg.VisibilityTimeout != 0 && cfg.VisibilityTimeout < time.Second {
+		return fmt.Errorf("VisibilityTimeout: must be at least 1s, got %v", cfg.VisibilityTimeout)
+	}
+	return nil
+}
+
+// AzureQueue is an input reading the blobs notified on an Azure Storage queue.
+type AzureQueue struct {
+	Cfg            *AzureQueueConfig
+	FilePathRegexp *regexp.Regexp
+
+	queue azureQueueClient // an interface, so that tests can use a fake queue
+	blobs *inpututils.CompressedInput
+	done  chan struct{}
+
+	// sleep waits for the given duration, unless ctx is done. If nil, it
+	// defaults to a timer.
+	sleep func(ctx context.Context, d time.Duration)
+
+	receivedn     int64 // number of received messages
+	deletedn      int64 // number of deleted messages
+	parseErrorsn  int64 // number of messages that couldn't be parsed
+	deleteErrorsn int64 // number of failed message deletions
+	failedn       int64 // number of messages not deleted because their blobs couldn't be processed
+}
+
+func NewAzureQueue(cfg baker.InputParams) (baker.Input, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &AzureQueueConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*AzureQueueConfig)
+	if err := dcfg.ValidateConfig(nil); err != nil {
+		return nil, err
+	}
+	dcfg.fillDefaults()
+
+	queueStorage, err := newAzureStorage(dcfg.QueueEndpoint, dcfg.SASToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	blobStorage, err := newAzureStorage(dcfg.BlobEndpoint, dcfg.SASToken, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAzureQueue(dcfg,
+		&azureQueue{storage: queueStorage, name: dcfg.Queue},
+		&azureContainer{storage: blobStorage, name: dcfg.Container})
+}
+
+// newAzureQueue returns an AzureQueue input receiving the messages of queue
+// and reading the blobs of container.
+func newAzureQueue(cfg *AzureQueueConfig, queue azureQueueClient, container inpututils.BlobReader) (*AzureQueue, error) {
+	var re *regexp.Regexp
+	if cfg.FilePathFilter != "" {
+		var err error
+		re, err = regexp.Compile(cfg.FilePathFilter)
+		if err != nil {
+			return nil, fmt.Errorf("FilePathFilter: %v", err)
+		}
+	}
+
+	blobs := inpututils.NewBlobInput(container)
+	blobs.FileMetadata = func(blob string) baker.Metadata {
+		return baker.Metadata{inpututils.MetadataAzureContainer: cfg.Container, inpututils.MetadataAzureBlob: blob}
+	}
+
+	return &AzureQueue{
+		Cfg:            cfg,
+		FilePathRegexp: re,
+		queue:          queue,
+		blobs:          blobs,
+		done:           make(chan struct{}),
+	}, nil
+}
+
+// wait waits for d and returns false if ctx is done.
+func (a *AzureQueue) wait(ctx context.Context, d time.Duration) bool {
+	if a.sleep != nil {
+		a.sleep(ctx, d)
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pollWorker polls the queue as long as the given context is alive.
+func (a *AzureQueue) pollWorker(ctx context.Context) {
+	ctxLog := log.WithFields(log.Fields{"f": "AzureQueue.pollWorker", "queue": a.Cfg.Queue})
+
+	b := &backoff.Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2, Jitter: true}
+	for ctx.Err() == nil {
+		n, err := a.poll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ctxLog.WithError(err).Error("error receiving messages")
+			a.wait(ctx, b.Duration())
+			continue
+		}
+		b.Reset()
+		if n == 0 {
+			// There's no long polling: wait so that an empty queue isn't
+			// polled in a busy loop.
+			a.wait(ctx, a.Cfg.IdleDelay)
+		}
+	}
+}
+
+// poll receives a message from the queue, once, and processes it. It returns
+// the number of received messages.
+func (a *AzureQueue) poll(ctx context.Context) (int, error) {
+	ctxLog := log.WithFields(log.Fields{"f": "AzureQueue.poll", "queue": a.Cfg.Queue})
+
+	// Receive only 1 message at a time, for the same reason as the SQS
+	// input: its blobs could take a while to process, and other messages
+	// would stay invisible to the other readers in the meantime.
+	msgs, err := a.queue.ReceiveMessages(ctx, 1, a.Cfg.VisibilityTimeout)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&a.receivedn, int64(len(msgs)))
+
+	fctx := inpututils.ContextWithMetadata(ctx, baker.Metadata{inpututils.MetadataAzureQueue: a.Cfg.Queue})
+	for _, msg := range msgs {
+		blobs, err := a.parseMessage(msg.Text)
+		if err != nil {
+			atomic.AddInt64(&a.parseErrorsn, 1)
+			ctxLog.WithError(err).WithField("id", msg.ID).Error("error parsing message")
+			continue
+		}
+
+		processed := true
+		for _, blob := range blobs {
+			if a.FilePathRegexp != nil && !a.FilePathRegexp.MatchString(blob) {
+				continue
+			}
+			if err := a.blobs.ParseFileContext(fctx, blob); err != nil {
+				if ctx.Err() != nil {
+					return len(msgs), nil
+				}
+				ctxLog.WithError(err).WithField("blob", blob).Error("error processing blob")
+				processed = false
+			}
+		}
+
+		// Only delete the message once all its blobs have been entirely
+		// read, otherwise it's received again after the visibility timeout.
+		if !processed {
+			atomic.AddInt64(&a.failedn, 1)
+			ctxLog.WithField("id", msg.ID).Warn("not deleting message, some of its blobs couldn't be processed")
+			continue
+		}
+		if err := a.queue.DeleteMessage(ctx, msg); err != nil {
+			atomic.AddInt64(&a.deleteErrorsn, 1)
+			ctxLog.WithError(err).WithField("id", msg.ID).Error("error deleting message")
+			continue
+		}
+		atomic.AddInt64(&a.deletedn, 1)
+	}
+	return len(msgs), nil
+}
+
+// azureBlobSubject matches the subject of the Event Grid events of a blob,
+// capturing its container and its name.
+var azureBlobSubject = regexp.MustCompile(`^/blobServices/default/containers/([^/]+)/blobs/(.+)$`)
+
+// parseMessage parses the text of a queue message and returns the names of
+// the blobs it refers to.
+func (a *AzureQueue) parseMessage(text string) ([]string, error) {
+	if a.Cfg.MessageEncoding == azureEncodingBase64 {
+		buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %v", err)
+		}
+		text = string(buf)
+	}
+
+	switch a.Cfg.MessageFormat {
+	case azureFormatPlain:
+		return []string{text}, nil
+
+	case azureFormatEventGrid:
+		type event struct {
+			Subject   string `json:"subject"`
+			EventType string `json:"eventType"`
+		}
+		// A message is a single event, but accept arrays of events too,
+		// as posted to Event Grid webhooks.
+		var events []event
+		if strings.HasPrefix(strings.TrimSpace(text), "[") {
+			if err := json.Unmarshal([]byte(text), &events); err != nil {
+				return nil, fmt.Errorf("invalid Event Grid events: %v", err)
+			}
+		} else {
+			var ev event
+			if err := json.Unmarshal([]byte(text), &ev); err != nil {
+				return nil, fmt.Errorf("invalid Event Grid event: %v", err)
+			}
+			events = append(events, ev)
+		}
+
+		var blobs []string
+		for _, ev := range events {
+			if ev.EventType != "Microsoft.Storage.BlobCreated" {
+				continue
+			}
+			m := azureBlobSubject.FindStringSubmatch(ev.Subject)
+			if m == nil {
+				return nil, fmt.Errorf("invalid BlobCreated event subject: %q", ev.Subject)
+			}
+			if m[1] != a.Cfg.Container {
+				log.WithFields(log.Fields{"container": m[1], "blob": m[2]}).Warn("ignoring blob of another container")
+				continue
+			}
+			blobs = append(blobs, m[2])
+		}
+		return blobs, nil
+	}
+
+	return nil, fmt.Errorf("unsupported message format: %q", a.Cfg.MessageFormat)
+}
+
+func (a *AzureQueue) Run(inch chan<- *baker.Data) error {
+	a.blobs.SetOutputChannel(inch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < a.Cfg.PollWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.pollWorker(ctx)
+		}()
+	}
+
+	// Stop like the SQS input: stop polling, then wait for the blobs being
+	// read before exiting.
+	<-a.done
+	cancel()
+	wg.Wait()
+	a.blobs.NoMoreFiles()
+	a.blobs.Stop()
+	<-a.blobs.Done
+	return nil
+}
+
+func (a *AzureQueue) Stop() {
+	close(a.done)
+}
+
+func (a *AzureQueue) Stats() baker.InputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("azurequeue.messages_received", atomic.LoadInt64(&a.receivedn))
+	bag.AddRawCounter("azurequeue.messages_deleted", atomic.LoadInt64(&a.deletedn))
+	bag.AddRawCounter("azurequeue.parse_errors", atomic.LoadInt64(&a.parseErrorsn))
+	bag.AddRawCounter("azurequeue.delete_errors", atomic.LoadInt64(&a.deleteErrorsn))
+	bag.AddRawCounter("azurequeue.failed_messages", atomic.LoadInt64(&a.failedn))
+
+	stats := a.blobs.Stats()
+	if stats.Metrics == nil {
+		stats.Metrics = &baker.MetricsBag{}
+	}
+	stats.Metrics.Merge(bag)
+	return stats
+}
+
+func (a *AzureQueue) FreeMem(data *baker.Data) {
+	a.blobs.FreeMem(data)
+}
@@ -0,0 +1,367 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inpututils"
+)
+
+// fakeAzureQueue is a fake Azure Storage queue, returning its messages one at
+// a time.
+type fakeAzureQueue struct {
+	mu       sync.Mutex
+	messages []azureMessage
+	deleted  []string // ids of the deleted messages
+}
+
+func (q *fakeAzureQueue) ReceiveMessages(ctx context.Context, n int, visibility time.Duration) ([]azureMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.messages) == 0 {
+		return nil, nil
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return []azureMessage{msg}, nil
+}
+
+func (q *fakeAzureQueue) DeleteMessage(ctx context.Context, msg azureMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, msg.ID)
+	return nil
+}
+
+func (q *fakeAzureQueue) deletedMessages() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.deleted...)
+}
+
+// fakeBlobs is a fake blob store serving gzipped blobs.
+type fakeBlobs map[string]string
+
+func (b fakeBlobs) OpenBlob(ctx context.Context, path string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+	content, ok := b[path]
+	if !ok {
+		return nil, 0, time.Time{}, nil, fmt.Errorf("%s: no such blob", path)
+	}
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(content))
+	w.Close()
+	u, _ := url.Parse("https://account.blob.core.windows.net/container/" + path)
+	return ioutil.NopCloser(buf), int64(buf.Len()), time.Now(), u, nil
+}
+
+func (b fakeBlobs) BlobSize(ctx context.Context, path string) (int64, error) {
+	return int64(len(b[path])), nil
+}
+
+// blobCreated returns the base64-encoded Event Grid event of a new blob.
+func blobCreated(container, blob string) string {
+	ev := fmt.Sprintf(`{"topic": "/subscriptions/id/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/account",
+		"subject": "/blobServices/default/containers/%s/blobs/%s",
+		"eventType": "Microsoft.Storage.BlobCreated",
+		"data": {"api": "PutBlob", "url": "https://account.blob.core.windows.net/%[1]s/%[2]s"}}`, container, blob)
+	return base64.StdEncoding.EncodeToString([]byte(ev))
+}
+
+func TestAzureQueue(t *testing.T) {
+	queue := &fakeAzureQueue{
+		messages: []azureMessage{
+			{ID: "1", Text: blobCreated("container", "logs/a.log.gz")},
+			{ID: "2", Text: blobCreated("other", "logs/b.log.gz")}, // ignored
+			{ID: "3", Text: "not base64!"},                         // not deleted
+			{ID: "4", Text: blobCreated("container", "logs/missing.log.gz")},
+			{ID: "5", Text: blobCreated("container", "logs/c.log.gz")},
+		},
+	}
+	blobs := fakeBlobs{
+		"logs/a.log.gz": "a1\na2\n",
+		"logs/b.log.gz": "b1\n",
+		"logs/c.log.gz": "c1\n",
+	}
+	cfg := &AzureQueueConfig{Account: "account", Queue: "queue", Container: "container"}
+	cfg.fillDefaults()
+	in, err := newAzureQueue(cfg, queue, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.sleep = func(context.Context, time.Duration) {}
+
+	ch := make(chan *baker.Data)
+	errc := make(chan error, 1)
+	go func() { errc <- in.Run(ch) }()
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case data := <-ch:
+				mu.Lock()
+				lines = append(lines, strings.Fields(string(data.Bytes))...)
+				mu.Unlock()
+				if c := data.Meta[inpututils.MetadataAzureContainer]; c != "container" {
+					t.Errorf("container metadata = %v, want %q", c, "container")
+				}
+				in.FreeMem(data)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Wait for the last message to be deleted.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue.deletedMessages()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	in.Stop()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(lines)
+	if want := []string{"a1", "a2", "c1"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if got, want := queue.deletedMessages(), []string{"1", "2", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted messages = %q, want %q", got, want)
+	}
+
+	stats := in.Stats()
+	for name, want := range map[string]int64{
+		"c:azurequeue.messages_received": 5,
+		"c:azurequeue.messages_deleted":  3,
+		"c:azurequeue.parse_errors":      1,
+		"c:azurequeue.failed_messages":   1,
+	} {
+		if got := stats.Metrics.Get(name); got != want {
+			t.Errorf("%s = %v, want %d", name, got, want)
+		}
+	}
+}
+
+func TestAzureQueueParseMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		encoding string
+		text     string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:   "event",
+			format: azureFormatEventGrid, encoding: azureEncodingNone,
+			text: `{"subject": "/blobServices/default/containers/c/blobs/dir/file.gz", "eventType": "Microsoft.Storage.BlobCreated"}`,
+			want: []string{"dir/file.gz"},
+		},
+		{
+			name:   "array of events",
+			format: azureFormatEventGrid, encoding: azureEncodingNone,
+			text: `[{"subject": "/blobServices/default/containers/c/blobs/a.gz", "eventType": "Microsoft.Storage.BlobCreated"},
+				{"subject": "/blobServices/default/containers/c/blobs/b.gz", "eventType": "Microsoft.Storage.BlobDeleted"},
+				{"subject": "/blobServices/default/containers/c/blobs/c.gz", "eventType": "Microsoft.Storage.BlobCreated"}]`,
+			want: []string{"a.gz", "c.gz"},
+		},
+		{
+			name:   "base64 event",
+			format: azureFormatEventGrid, encoding: azureEncodingBase64,
+			text: blobCreated("c", "file.gz"),
+			want: []string{"file.gz"},
+		},
+		{
+			name:   "plain",
+			format: azureFormatPlain, encoding: azureEncodingNone,
+			text: "dir/file.gz",
+			want: []string{"dir/file.gz"},
+		},
+		{
+			name:   "plain base64",
+			format: azureFormatPlain, encoding: azureEncodingBase64,
+			text: base64.StdEncoding.EncodeToString([]byte("dir/file.gz")),
+			want: []string{"dir/file.gz"},
+		},
+
+		// errors
+		{
+			name:   "invalid json",
+			format: azureFormatEventGrid, encoding: azureEncodingNone,
+			text:    `{"subject": `,
+			wantErr: true,
+		},
+		{
+			name:   "invalid subject",
+			format: azureFormatEventGrid, encoding: azureEncodingNone,
+			text:    `{"subject": "/c/file.gz", "eventType": "Microsoft.Storage.BlobCreated"}`,
+			wantErr: true,
+		},
+		{
+			name:   "invalid base64",
+			format: azureFormatPlain, encoding: azureEncodingBase64,
+			text:    "dir/file.gz",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AzureQueue{Cfg: &AzureQueueConfig{Container: "c", MessageFormat: tt.format, MessageEncoding: tt.encoding}}
+			got, err := a.parseMessage(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error = %v, want error = %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blobs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAzureStorage(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+		mu.Unlock()
+
+		if r.URL.Query().Get("sig") != "secret" || r.Header.Get("x-ms-version") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>AuthenticationFailed</Code><Message>Signature did not match</Message></Error>`)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/queue/messages":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><QueueMessagesList><QueueMessage>
+				<MessageId>id-1</MessageId><PopReceipt>AgAAAAMAAAA+/=</PopReceipt><DequeueCount>2</DequeueCount><MessageText>dGV4dA==</MessageText>
+				</QueueMessage></QueueMessagesList>`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/queue/messages/id-1":
+			if r.URL.Query().Get("popreceipt") != "AgAAAAMAAAA+/=" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/container/dir/file name.gz":
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			w.Header().Set("Content-Length", "7")
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, "content")
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	storage, err := newAzureStorage(srv.URL, "?sv=2019-12-12&sig=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &azureQueue{storage: storage, name: "queue"}
+	msgs, err := q.ReceiveMessages(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []azureMessage{{ID: "id-1", PopReceipt: "AgAAAAMAAAA+/=", DequeueCount: 2, Text: "dGV4dA=="}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("messages = %+v, want %+v", msgs, want)
+	}
+	if err := q.DeleteMessage(ctx, msgs[0]); err != nil {
+		t.Errorf("DeleteMessage: %v", err)
+	}
+
+	c := &azureContainer{storage: storage, name: "container"}
+	rc, size, lastModified, u, err := c.OpenBlob(ctx, "dir/file name.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(buf) != "content" || size != 7 {
+		t.Errorf("blob = %q (size %d), want %q (size 7)", buf, size, "content")
+	}
+	if want := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC); !lastModified.Equal(want) {
+		t.Errorf("last modified = %v, want %v", lastModified, want)
+	}
+	if want := srv.URL + "/container/dir/file%20name.gz"; u.String() != want {
+		t.Errorf("url = %s, want %s", u, want)
+	}
+	if size, err := c.BlobSize(ctx, "dir/file name.gz"); err != nil || size != 7 {
+		t.Errorf("BlobSize = %d, %v, want 7, nil", size, err)
+	}
+
+	_, err = c.BlobSize(ctx, "missing.gz")
+	if aerr, ok := err.(*azureError); !ok || aerr.Status != http.StatusNotFound {
+		t.Errorf("BlobSize error = %v, want a 404 azureError", err)
+	}
+	_, _, _, _, err = c.OpenBlob(ctx, "missing.gz")
+	if aerr, ok := err.(*azureError); !ok || aerr.Code != "BlobNotFound" {
+		t.Errorf("OpenBlob error = %v, want a BlobNotFound azureError", err)
+	}
+
+	unauthorized, _ := newAzureStorage(srv.URL, "sig=wrong", nil)
+	_, err = (&azureQueue{storage: unauthorized, name: "queue"}).ReceiveMessages(ctx, 1, time.Minute)
+	if aerr, ok := err.(*azureError); !ok || aerr.Code != "AuthenticationFailed" {
+		t.Errorf("ReceiveMessages error = %v, want an AuthenticationFailed azureError", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(requests[0], "numofmessages=1") || !strings.Contains(requests[0], "visibilitytimeout=60") {
+		t.Errorf("Get Messages request = %s, want numofmessages=1 and visibilitytimeout=60", requests[0])
+	}
+}
+
+func TestAzureQueueConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     AzureQueueConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: AzureQueueConfig{}},
+		{name: "plain format", cfg: AzureQueueConfig{MessageFormat: "Plain", MessageEncoding: "none"}},
+		{name: "unsupported format", cfg: AzureQueueConfig{MessageFormat: "sns"}, wantErr: true},
+		{name: "unsupported encoding", cfg: AzureQueueConfig{MessageEncoding: "gzip"}, wantErr: true},
+		{name: "invalid FilePathFilter", cfg: AzureQueueConfig{FilePathFilter: "("}, wantErr: true},
+		{name: "negative PollWorkers", cfg: AzureQueueConfig{PollWorkers: -1}, wantErr: true},
+		{name: "short VisibilityTimeout", cfg: AzureQueueConfig{VisibilityTimeout: time.Millisecond}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.ValidateConfig(nil); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() = %v, want error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// ChannelDesc describes the Channel input.
+var ChannelDesc = baker.InputDesc{
+	Name:   "Channel",
+	New:    NewChannel,
+	Config: &ChannelConfig{},
+	Help: "This input receives records from the program running the topology, through its Push method.\n" +
+		"It's meant for tests and programs embedding baker, and exits once its Close method is called.\n",
+}
+
+// ChannelConfig holds the configuration of the Channel input.
+type ChannelConfig struct {
+	BufferSize int `help:"Number of buffers Push can queue before blocking" default:"0"`
+}
+
+// ErrChannelClosed is returned by Channel.Push after the input has been
+// closed or stopped.
+var ErrChannelClosed = errors.New("channel input closed")
+
+// Channel is an input sending into the topology the records pushed by the
+// program. Retrieve it from the topology Input field to call its Push and
+// Close methods.
+type Channel struct {
+	ch     chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex // protects closed and ch closing
+	closed bool
+
+	numLines int64
+}
+
+// NewChannel returns a new Channel input.
+func NewChannel(cfg baker.InputParams) (baker.Input, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &ChannelConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*ChannelConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Channel{
+		ch:     make(chan []byte, dcfg.BufferSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Push sends buf into the topology. buf contains one or more records,
+// separated by newlines, and must not be modified after Push returns.
+// Push blocks until buf is accepted by the input, and returns
+// ErrChannelClosed if the input has been closed or stopped.
+func (c *Channel) Push(buf []byte) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return ErrChannelClosed
+	}
+	select {
+	case c.ch <- buf:
+		return nil
+	case <-c.ctx.Done():
+		return ErrChannelClosed
+	}
+}
+
+// Close signals that no more records will be pushed. Run returns, thus
+// starting the topology shutdown, once all pushed records have been sent.
+func (c *Channel) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+// Run implements baker.Input.
+func (c *Channel) Run(inch chan<- *baker.Data) error {
+	for {
+		select {
+		case buf, ok := <-c.ch:
+			if !ok {
+				return nil
+			}
+			nlines := bytes.Count(buf, []byte{'\n'})
+			if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+				nlines++
+			}
+			select {
+			case inch <- &baker.Data{Bytes: buf}:
+				atomic.AddInt64(&c.numLines, int64(nlines))
+			case <-c.ctx.Done():
+				return nil
+			}
+		case <-c.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Stop implements baker.Input. Records pushed but not sent yet are
+// discarded and pending Push calls return ErrChannelClosed.
+func (c *Channel) Stop() { c.cancel() }
+
+// Stats implements baker.Input.
+func (c *Channel) Stats() baker.InputStats {
+	return baker.InputStats{
+		NumProcessedLines: atomic.LoadInt64(&c.numLines),
+	}
+}
+
+// FreeMem implements baker.Input.
+func (c *Channel) FreeMem(data *baker.Data) {}
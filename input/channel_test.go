@@ -0,0 +1,100 @@
+package input
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+func TestChannel(t *testing.T) {
+	comp := baker.Components{
+		Inputs:  []baker.InputDesc{ChannelDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg := baker.Config{
+		Input:  baker.ConfigInput{Name: "Channel"},
+		Output: []baker.ConfigOutput{{Name: "Recorder", Procs: 1, Fields: []string{"f0"}}},
+		Fields: baker.ConfigFields{Names: []string{"f0", "f1"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+
+	const nrecords = 1000
+	in := topo.Input.(*Channel)
+	for i := 0; i < nrecords; i += 2 {
+		// Push 2 records at a time.
+		if err := in.Push([]byte(fmt.Sprintf("%d,a\n%d,b", i, i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in.Close()
+	topo.Wait()
+
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := topo.Output[0].(*outputtest.Recorder).Records
+	if len(recs) != nrecords {
+		t.Fatalf("got %d records, want %d", len(recs), nrecords)
+	}
+	seen := make(map[string]bool)
+	for _, r := range recs {
+		seen[r.Fields[0]] = true
+	}
+	if len(seen) != nrecords {
+		t.Errorf("got %d distinct records, want %d", len(seen), nrecords)
+	}
+	if got := in.Stats().NumProcessedLines; got != nrecords {
+		t.Errorf("NumProcessedLines = %d, want %d", got, nrecords)
+	}
+
+	if err := in.Push([]byte("late,record")); err != ErrChannelClosed {
+		t.Errorf("Push() after Close: err = %v, want %v", err, ErrChannelClosed)
+	}
+	// Close is idempotent.
+	in.Close()
+}
+
+func TestChannelStop(t *testing.T) {
+	input, err := NewChannel(baker.InputParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := input.(*Channel)
+
+	// Nobody is reading from the input, so Push blocks until Stop is called.
+	errc := make(chan error)
+	go func() { errc <- in.Push([]byte("foo")) }()
+
+	time.Sleep(10 * time.Millisecond)
+	in.Stop()
+
+	select {
+	case err := <-errc:
+		if err != ErrChannelClosed {
+			t.Errorf("Push() err = %v, want %v", err, ErrChannelClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push still blocked after Stop")
+	}
+
+	// Run returns immediately once stopped.
+	done := make(chan error)
+	go func() { done <- in.Run(make(chan *baker.Data)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run still running after Stop")
+	}
+}
@@ -0,0 +1,316 @@
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataTokenURL is the URL of the GCE metadata server returning access
+// tokens of the default service account.
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpError is an error response of a Google Cloud REST API.
+type gcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e *gcpError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("google cloud: HTTP %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("google cloud: %s (HTTP %d): %s", e.Status, e.Code, e.Message)
+}
+
+// gcpTokenSource provides the OAuth2 access tokens of the requests to Google
+// Cloud: either a static token, or the tokens of the default service account
+// fetched from the metadata server, which are cached until they expire.
+type gcpTokenSource struct {
+	static      string
+	metadataURL string
+	client      *http.Client
+
+	mu     sync.Mutex // protects token and expiry
+	token  string
+	expiry time.Time
+}
+
+// Token returns a valid access token.
+func (ts *gcpTokenSource) Token(ctx context.Context) (string, error) {
+	if ts.static != "" {
+		return ts.static, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.metadataURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("can't get access token from metadata server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can't get access token from metadata server: HTTP %d", resp.StatusCode)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("invalid access token from metadata server: %v", err)
+	}
+	// Renew the token a bit before it expires, so that it doesn't expire
+	// while a request is in flight.
+	ts.token = tok.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
+
+// gcpService sends requests to a Google Cloud REST API.
+type gcpService struct {
+	endpoint string // like https://pubsub.googleapis.com
+	tokens   *gcpTokenSource
+	client   *http.Client
+}
+
+// do sends a request, with a JSON body if in isn't nil, and returns its
+// response, or a *gcpError if it failed.
+func (s *gcpService) do(ctx context.Context, method, path string, query url.Values, in interface{}) (*http.Response, error) {
+	u := strings.TrimSuffix(s.endpoint, "/") + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error gcpError `json:"error"`
+		}
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		json.Unmarshal(buf, &errResp)
+		errResp.Error.Code = resp.StatusCode
+		return nil, &errResp.Error
+	}
+	return resp, nil
+}
+
+// doJSON sends a request like do, decoding the JSON response into out.
+func (s *gcpService) doJSON(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	resp, err := s.do(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// pubsubMessage is a message received from a Pub/Sub subscription.
+type pubsubMessage struct {
+	AckID      string
+	ID         string
+	Data       []byte
+	Attributes map[string]string
+}
+
+// pubsubClient pulls and acknowledges the messages of a Pub/Sub subscription.
+// It's an interface so that tests can use a fake subscription.
+type pubsubClient interface {
+	// Pull receives up to n messages.
+	Pull(ctx context.Context, n int) ([]pubsubMessage, error)
+
+	// ModifyAckDeadline sets the time left to acknowledge received messages
+	// before they're delivered again.
+	ModifyAckDeadline(ctx context.Context, deadline time.Duration, ackIDs ...string) error
+
+	// Acknowledge acknowledges received messages, so that they're not
+	// delivered again.
+	Acknowledge(ctx context.Context, ackIDs ...string) error
+
+	// Backlog returns the number of messages of the subscription that
+	// haven't been acknowledged yet.
+	Backlog(ctx context.Context) (int64, error)
+}
+
+// pubsubSubscription is the pubsubClient of a Pub/Sub subscription, using the
+// Cloud Monitoring API for the backlog.
+type pubsubSubscription struct {
+	pubsub     *gcpService
+	monitoring *gcpService
+	project    string
+	name       string
+}
+
+func (s *pubsubSubscription) path() string {
+	return "/v1/projects/" + url.PathEscape(s.project) + "/subscriptions/" + url.PathEscape(s.name)
+}
+
+func (s *pubsubSubscription) Pull(ctx context.Context, n int) ([]pubsubMessage, error) {
+	var resp struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				MessageID  string            `json:"messageId"`
+				Data       []byte            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := s.pubsub.doJSON(ctx, http.MethodPost, s.path()+":pull", nil, map[string]int{"maxMessages": n}, &resp); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]pubsubMessage, len(resp.ReceivedMessages))
+	for i, m := range resp.ReceivedMessages {
+		msgs[i] = pubsubMessage{AckID: m.AckID, ID: m.Message.MessageID, Data: m.Message.Data, Attributes: m.Message.Attributes}
+	}
+	return msgs, nil
+}
+
+func (s *pubsubSubscription) ModifyAckDeadline(ctx context.Context, deadline time.Duration, ackIDs ...string) error {
+	req := struct {
+		AckIDs             []string `json:"ackIds"`
+		AckDeadlineSeconds int      `json:"ackDeadlineSeconds"`
+	}{ackIDs, int(deadline / time.Second)}
+	return s.pubsub.doJSON(ctx, http.MethodPost, s.path()+":modifyAckDeadline", nil, req, nil)
+}
+
+func (s *pubsubSubscription) Acknowledge(ctx context.Context, ackIDs ...string) error {
+	return s.pubsub.doJSON(ctx, http.MethodPost, s.path()+":acknowledge", nil, map[string][]string{"ackIds": ackIDs}, nil)
+}
+
+func (s *pubsubSubscription) Backlog(ctx context.Context) (int64, error) {
+	// The metric is sampled every minute, look at the last few minutes to
+	// be sure to get a point.
+	now := time.Now().UTC()
+	query := url.Values{
+		"filter":             {fmt.Sprintf(`metric.type="pubsub.googleapis.com/subscription/num_undelivered_messages" AND resource.labels.subscription_id=%q`, s.name)},
+		"interval.startTime": {now.Add(-5 * time.Minute).Format(time.RFC3339)},
+		"interval.endTime":   {now.Format(time.RFC3339)},
+	}
+	var resp struct {
+		TimeSeries []struct {
+			Points []struct {
+				Value struct {
+					Int64Value string `json:"int64Value"`
+				} `json:"value"`
+			} `json:"points"`
+		} `json:"timeSeries"`
+	}
+	path := "/v3/projects/" + url.PathEscape(s.project) + "/timeSeries"
+	if err := s.monitoring.doJSON(ctx, http.MethodGet, path, query, nil, &resp); err != nil {
+		return 0, err
+	}
+	// Points are returned newest first.
+	if len(resp.TimeSeries) == 0 || len(resp.TimeSeries[0].Points) == 0 {
+		return 0, fmt.Errorf("no backlog data for subscription %s", s.name)
+	}
+	return strconv.ParseInt(resp.TimeSeries[0].Points[0].Value.Int64Value, 10, 64)
+}
+
+// gcsPath returns the path of a GCS object, as read by gcsStorage.
+func gcsPath(bucket, object string) string {
+	return "gs://" + bucket + "/" + object
+}
+
+// parseGCSPath returns the bucket and the name of the object at path, see
+// gcsPath.
+func parseGCSPath(path string) (bucket, object string, err error) {
+	p := strings.TrimPrefix(path, "gs://")
+	i := strings.IndexByte(p, '/')
+	if p == path || i <= 0 || i == len(p)-1 {
+		return "", "", fmt.Errorf("invalid GCS path: %q", path)
+	}
+	return p[:i], p[i+1:], nil
+}
+
+// gcsStorage is the inpututils.BlobReader of the objects of Google Cloud
+// Storage, identified by their gs://BUCKET/OBJECT path.
+type gcsStorage struct {
+	svc *gcpService
+}
+
+func gcsObjectPath(bucket, object string) string {
+	return "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object)
+}
+
+// OpenBlob implements inpututils.BlobReader.
+func (s *gcsStorage) OpenBlob(ctx context.Context, path string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+	bucket, object, err := parseGCSPath(path)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, err
+	}
+	resp, err := s.svc.do(ctx, http.MethodGet, gcsObjectPath(bucket, object), url.Values{"alt": {"media"}}, nil)
+	if err != nil {
+		return nil, 0, time.Time{}, nil, err
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	u := &url.URL{Scheme: "gs", Host: bucket, Path: "/" + object}
+	return resp.Body, resp.ContentLength, lastModified, u, nil
+}
+
+// BlobSize implements inpututils.BlobReader.
+func (s *gcsStorage) BlobSize(ctx context.Context, path string) (int64, error) {
+	bucket, object, err := parseGCSPath(path)
+	if err != nil {
+		return 0, err
+	}
+	var obj struct {
+		Size string `json:"size"`
+	}
+	if err := s.svc.doJSON(ctx, http.MethodGet, gcsObjectPath(bucket, object), nil, nil, &obj); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(obj.Size, 10, 64)
+}
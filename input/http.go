@@ -0,0 +1,276 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+// HTTPDesc describes the HTTP input.
+var HTTPDesc = baker.InputDesc{
+	Name:   "HTTP",
+	New:    NewHTTP,
+	Config: &HTTPConfig{},
+	Help: "This input runs an HTTP server receiving records posted by webhooks, one or more records\n" +
+		"per request body, separated by newlines. Bodies can be gzip-compressed (Content-Encoding: gzip).\n" +
+		"The server is secured with TLS by setting TLSCertFile and TLSKeyFile, and requests are\n" +
+		"authenticated with a bearer token (AuthToken) and/or an HMAC-SHA256 signature of the body\n" +
+		"(HMACSecret), sent in the X-Signature header as 'sha256=<hex digest>'.\n" +
+		"It never exits.\n",
+}
+
+// HTTPConfig holds the configuration of the HTTP input.
+type HTTPConfig struct {
+	Listener    string `help:"Host:Port to bind to" default:":8080"`
+	Path        string `help:"Path on which records are posted" default:"/"`
+	MaxBodySize int64  `help:"Maximum size of a request body, in bytes. Larger requests are rejected with 413" default:"10485760"`
+	TLSCertFile string `help:"If provided, along with TLSKeyFile, path of the PEM certificate file used to serve HTTPS instead of plain HTTP"`
+	TLSKeyFile  string `help:"If provided, along with TLSCertFile, path of the PEM private key file used to serve HTTPS"`
+	AuthToken   string `help:"If provided, requests must have an 'Authorization: Bearer <AuthToken>' header, or are rejected with 401"`
+	HMACSecret  string `help:"If provided, requests must have an X-Signature header holding the HMAC-SHA256 of the body with that secret, as 'sha256=<hex digest>', or are rejected with 403"`
+}
+
+func (cfg *HTTPConfig) fillDefaults() {
+	if cfg.Listener == "" {
+		cfg.Listener = ":8080"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 10 << 20
+	}
+}
+
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *HTTPConfig) ValidateConfig(func(string) (baker.FieldIndex, bool)) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("TLSCertFile and TLSKeyFile must be provided together")
+	}
+	if cfg.MaxBodySize < 0 {
+		return fmt.Errorf("MaxBodySize must be positive, got %d", cfg.MaxBodySize)
+	}
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		return fmt.Errorf("Path must start with /, got %q", cfg.Path)
+	}
+	return nil
+}
+
+// signatureHeader is the header holding the HMAC signature of the body.
+const signatureHeader = "X-Signature"
+
+// HTTP is an input receiving records posted to an HTTP server.
+type HTTP struct {
+	Cfg *HTTPConfig
+
+	data     chan<- *baker.Data
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	numLines      int64
+	requestsn     int64 // number of accepted requests
+	unauthorizedn int64 // number of requests rejected by authentication
+	errorsn       int64 // number of invalid requests
+}
+
+// NewHTTP returns a new HTTP input.
+func NewHTTP(cfg baker.InputParams) (baker.Input, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &HTTPConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*HTTPConfig)
+	dcfg.fillDefaults()
+	if err := dcfg.ValidateConfig(nil); err != nil {
+		return nil, fmt.Errorf("HTTP: %v", err)
+	}
+
+	return &HTTP{
+		Cfg:  dcfg,
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Run implements baker.Input.
+func (s *HTTP) Run(inch chan<- *baker.Data) error {
+	s.data = inch
+
+	l, err := net.Listen("tcp", s.Cfg.Listener)
+	if err != nil {
+		return err
+	}
+	return s.serve(l)
+}
+
+// serve serves HTTP, or HTTPS if configured to, on l until the input is
+// stopped.
+func (s *HTTP) serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(s.Cfg.Path, s)
+	srv := &http.Server{Handler: mux}
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.Cfg.TLSCertFile != "" {
+			errc <- srv.ServeTLS(l, s.Cfg.TLSCertFile, s.Cfg.TLSKeyFile)
+		} else {
+			errc <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-s.stop:
+	}
+
+	// Let the requests in progress complete.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP handles a request posting records.
+func (s *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctxLog := log.WithFields(log.Fields{"f": "HTTP.ServeHTTP", "addr": r.RemoteAddr})
+
+	if r.Method != http.MethodPost {
+		atomic.AddInt64(&s.errorsn, 1)
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.checkToken(r) {
+		atomic.AddInt64(&s.unauthorizedn, 1)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.Cfg.MaxBodySize+1))
+	if err != nil {
+		atomic.AddInt64(&s.errorsn, 1)
+		ctxLog.WithError(err).Warn("can't read request body")
+		http.Error(w, "can't read request body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.Cfg.MaxBodySize {
+		atomic.AddInt64(&s.errorsn, 1)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The signature covers the body as sent, before decompression.
+	if !s.checkSignature(r, body) {
+		atomic.AddInt64(&s.unauthorizedn, 1)
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if body, err = gunzip(body, s.Cfg.MaxBodySize); err != nil {
+			atomic.AddInt64(&s.errorsn, 1)
+			ctxLog.WithError(err).Warn("can't decompress request body")
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(body) > 0 {
+		atomic.AddInt64(&s.numLines, int64(bytes.Count(body, []byte{'\n'})))
+		select {
+		case s.data <- &baker.Data{Bytes: body}:
+		case <-s.stop:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	atomic.AddInt64(&s.requestsn, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkToken reports whether r has the configured bearer token, if any.
+func (s *HTTP) checkToken(r *http.Request) bool {
+	if s.Cfg.AuthToken == "" {
+		return true
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.Cfg.AuthToken)) == 1
+}
+
+// checkSignature reports whether r has a valid signature of body, if
+// configured to check it.
+func (s *HTTP) checkSignature(r *http.Request, body []byte) bool {
+	if s.Cfg.HMACSecret == "" {
+		return true
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(signatureHeader), "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.Cfg.HMACSecret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// gunzip decompresses body, up to maxSize bytes.
+func gunzip(body []byte, maxSize int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > maxSize {
+		return nil, fmt.Errorf("decompressed body larger than %d bytes", maxSize)
+	}
+	return buf, nil
+}
+
+// Stop implements baker.Input.
+func (s *HTTP) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// FreeMem implements baker.Input.
+func (s *HTTP) FreeMem(data *baker.Data) {}
+
+// Stats implements baker.Input.
+func (s *HTTP) Stats() baker.InputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("http.requests", atomic.LoadInt64(&s.requestsn))
+	bag.AddRawCounter("http.unauthorized", atomic.LoadInt64(&s.unauthorizedn))
+	bag.AddRawCounter("http.errors", atomic.LoadInt64(&s.errorsn))
+	return baker.InputStats{
+		NumProcessedLines: atomic.LoadInt64(&s.numLines),
+		Metrics:           bag,
+	}
+}
@@ -0,0 +1,276 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+// postHTTP posts body to s with the given headers, and returns the response
+// status code and the data sent by s, if any.
+func postHTTP(t *testing.T, s *HTTP, body []byte, headers map[string]string) (int, *baker.Data) {
+	t.Helper()
+
+	ch := make(chan *baker.Data, 1)
+	s.data = ch
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	select {
+	case data := <-ch:
+		return rec.Code, data
+	default:
+		return rec.Code, nil
+	}
+}
+
+func newTestHTTP(t *testing.T, cfg *HTTPConfig) *HTTP {
+	t.Helper()
+	in, err := NewHTTP(baker.InputParams{ComponentParams: baker.ComponentParams{DecodedConfig: cfg}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in.(*HTTP)
+}
+
+func TestHTTPAuthToken(t *testing.T) {
+	s := newTestHTTP(t, &HTTPConfig{AuthToken: "s3cr3t"})
+	body := []byte("a,b,c\n")
+
+	tests := []struct {
+		name string
+		auth string
+		want int
+	}{
+		{name: "valid", auth: "Bearer s3cr3t", want: http.StatusNoContent},
+		{name: "case-insensitive scheme", auth: "bearer s3cr3t", want: http.StatusNoContent},
+		{name: "invalid", auth: "Bearer s3cr3u", want: http.StatusUnauthorized},
+		{name: "prefix", auth: "Bearer s3cr3", want: http.StatusUnauthorized},
+		{name: "basic", auth: "Basic czNjcjN0", want: http.StatusUnauthorized},
+		{name: "missing", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.auth != "" {
+				headers["Authorization"] = tt.auth
+			}
+			code, data := postHTTP(t, s, body, headers)
+			if code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+			if accepted := tt.want == http.StatusNoContent; accepted != (data != nil) {
+				t.Errorf("records sent = %t, want %t", data != nil, accepted)
+			}
+		})
+	}
+}
+
+func TestHTTPSignature(t *testing.T) {
+	const secret = "shared-secret"
+	s := newTestHTTP(t, &HTTPConfig{HMACSecret: secret})
+
+	body := []byte("a,b,c\nd,e,f\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	tampered := append([]byte(nil), body...)
+	tampered[0] = 'z'
+
+	tests := []struct {
+		name string
+		body []byte
+		sig  string
+		want int
+	}{
+		{name: "valid", body: body, sig: "sha256=" + sig, want: http.StatusNoContent},
+		{name: "valid without prefix", body: body, sig: sig, want: http.StatusNoContent},
+		{name: "tampered body", body: tampered, sig: "sha256=" + sig, want: http.StatusForbidden},
+		{name: "wrong secret", body: body, sig: "sha256=" + hex.EncodeToString(hmac.New(sha256.New, []byte("other")).Sum(nil)), want: http.StatusForbidden},
+		{name: "not hex", body: body, sig: "sha256=xyz", want: http.StatusForbidden},
+		{name: "missing", body: body, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.sig != "" {
+				headers["X-Signature"] = tt.sig
+			}
+			code, data := postHTTP(t, s, tt.body, headers)
+			if code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+			if tt.want != http.StatusNoContent {
+				if data != nil {
+					t.Errorf("records of a rejected request sent")
+				}
+				return
+			}
+			if data == nil || !bytes.Equal(data.Bytes, body) {
+				t.Errorf("sent data = %v, want %q", data, body)
+			}
+		})
+	}
+
+	stats := s.Stats()
+	if got := stats.Metrics.Get("c:http.unauthorized"); got != int64(4) {
+		t.Errorf("http.unauthorized = %v, want 4", got)
+	}
+	if stats.NumProcessedLines != 4 {
+		t.Errorf("NumProcessedLines = %d, want 4", stats.NumProcessedLines)
+	}
+}
+
+func TestHTTPRequests(t *testing.T) {
+	s := newTestHTTP(t, &HTTPConfig{MaxBodySize: 64})
+
+	// Without authentication configured, any post is accepted.
+	code, data := postHTTP(t, s, []byte("a,b,c\n"), nil)
+	if code != http.StatusNoContent || data == nil || string(data.Bytes) != "a,b,c\n" {
+		t.Errorf("plain post: status = %d, data = %v", code, data)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("d,e,f\n"))
+	zw.Close()
+	code, data = postHTTP(t, s, buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	if code != http.StatusNoContent || data == nil || string(data.Bytes) != "d,e,f\n" {
+		t.Errorf("gzip post: status = %d, data = %v", code, data)
+	}
+
+	if code, _ := postHTTP(t, s, []byte("not gzip"), map[string]string{"Content-Encoding": "gzip"}); code != http.StatusBadRequest {
+		t.Errorf("invalid gzip post: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := postHTTP(t, s, bytes.Repeat([]byte("a\n"), 64), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large post: status = %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPConfigValidate(t *testing.T) {
+	if err := (&HTTPConfig{TLSCertFile: "cert.pem"}).ValidateConfig(nil); err == nil {
+		t.Errorf("TLSCertFile without TLSKeyFile accepted")
+	}
+	if err := (&HTTPConfig{Path: "records"}).ValidateConfig(nil); err == nil {
+		t.Errorf("relative Path accepted")
+	}
+	if err := (&HTTPConfig{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", AuthToken: "t"}).ValidateConfig(nil); err != nil {
+		t.Errorf("valid configuration rejected: %v", err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// in dir, and returns their paths and the certificate.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "baker test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestHTTPTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t, t.TempDir())
+	s := newTestHTTP(t, &HTTPConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, AuthToken: "token"})
+	ch := make(chan *baker.Data, 1)
+	s.data = ch
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.serve(l) }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://"+l.Addr().String()+"/", strings.NewReader("a,b,c\n"))
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if data := <-ch; string(data.Bytes) != "a,b,c\n" {
+		t.Errorf("sent data = %q, want %q", data.Bytes, "a,b,c\n")
+	}
+
+	// Plain HTTP requests are refused by the HTTPS server.
+	if resp, err := http.Post("http://"+l.Addr().String()+"/", "text/plain", strings.NewReader("a,b,c\n")); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			t.Errorf("plain HTTP request accepted by the HTTPS server")
+		}
+	}
+
+	s.Stop()
+	if err := <-errc; err != nil {
+		t.Errorf("serve returned %v after Stop, want nil", err)
+	}
+}
@@ -13,8 +13,9 @@ var LogLineDesc = baker.InputDesc{
 
 // LogLineConfig holds the log lines to be fed to the Baker topology.
 type LogLineConfig struct {
-	Lines    []*baker.LogLine // Lines to pipe into the filter chain.
-	Metadata baker.Metadata   // Metadata to assign to every log line.
+	Lines     []*baker.LogLine // Lines to pipe into the filter chain.
+	Metadata  baker.Metadata   // Metadata to assign to every log line.
+	FirstLine int64            // If not 0, line number of the first log line.
 }
 
 // A LogLine input is a Baker input used for testing.
@@ -42,7 +43,7 @@ func (in *LogLine) Run(output chan<- *baker.Data) error {
 		buf = append(buf, '\n')
 	}
 
-	output <- &baker.Data{Bytes: buf, Meta: in.Metadata}
+	output <- &baker.Data{Bytes: buf, Meta: in.Metadata, FirstLine: in.FirstLine}
 
 	return nil
 }
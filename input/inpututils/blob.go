@@ -0,0 +1,36 @@
+package inpututils
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+)
+
+// A BlobReader gives access to the files of a storage service (S3 objects,
+// Azure blobs, GCS objects...), identified by a path whose meaning depends on
+// the service, like the name of the file in its container.
+type BlobReader interface {
+	// OpenBlob opens the file at path and returns its content, its size,
+	// the time it was last modified and its URL.
+	OpenBlob(ctx context.Context, path string) (io.ReadCloser, int64, time.Time, *url.URL, error)
+
+	// BlobSize returns the size of the file at path.
+	BlobSize(ctx context.Context, path string) (int64, error)
+}
+
+// NewBlobInput returns a CompressedInput reading the files of r, so that they
+// go through the same decompression and record splitting as the S3 files of
+// S3Input. The files are gzip-compressed, or zstd-compressed if their path
+// ends with .zst or .zstd.
+func NewBlobInput(r BlobReader) *CompressedInput {
+	open := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		return r.OpenBlob(context.Background(), fn)
+	}
+	size := func(fn string) (int64, error) {
+		return r.BlobSize(context.Background(), fn)
+	}
+	s := NewCompressedInput(open, size, make(chan bool, 1))
+	s.OpenerContext = r.OpenBlob
+	return s
+}
@@ -3,19 +3,20 @@ package inpututils
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
 	log "github.com/sirupsen/logrus"
-	zstd "github.com/valyala/gozstd"
 
 	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/pkg/tracing"
 )
 
 const (
@@ -28,22 +29,60 @@ const (
 	kMaxLineLength = 4 * 1024
 )
 
-type compressionType int
-
-// List of compression types supported by this module.
-const (
-	gzipCompression compressionType = iota
-	zstdCompression
-)
+// errStopped is returned by ParseFile when the input is stopped before the
+// end of the file.
+var errStopped = errors.New("input stopped before the end of the file")
 
 // These keys identify values in the record Metadata cache
 const (
-	MetadataLastModified = "last_modified"
-	MetadataURL          = "url"
+	MetadataLastModified       = "last_modified"
+	MetadataURL                = "url"
+	MetadataS3Bucket           = "s3_bucket"           // set for files read from S3
+	MetadataS3Key              = "s3_key"              // set for files read from S3
+	MetadataSQSQueue           = "sqs_queue"           // URL of the queue the file has been notified on, set by the SQS input
+	MetadataAzureQueue         = "azure_queue"         // name of the queue the blob has been notified on, set by the AzureQueue input
+	MetadataAzureContainer     = "azure_container"     // set for blobs read from Azure Storage
+	MetadataAzureBlob          = "azure_blob"          // set for blobs read from Azure Storage
+	MetadataGCSBucket          = "gcs_bucket"          // set for objects read from Google Cloud Storage
+	MetadataGCSObject          = "gcs_object"          // set for objects read from Google Cloud Storage
+	MetadataPubSubSubscription = "pubsub_subscription" // name of the subscription the object has been notified on, set by the PubSub input
 )
 
+type metadataKey struct{}
+
+// ContextWithMetadata returns a copy of ctx carrying meta. When such a
+// context is passed to ParseFileContext, meta is added to the metadata of
+// the records of the file.
+func ContextWithMetadata(ctx context.Context, meta baker.Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, meta)
+}
+
+// fileMetadata returns the metadata of the records read from file fn.
+func (s *CompressedInput) fileMetadata(ctx context.Context, fn string, lastModified time.Time, u *url.URL) baker.Metadata {
+	md := baker.Metadata{
+		MetadataLastModified: lastModified,
+		MetadataURL:          u,
+	}
+	if s.FileMetadata != nil {
+		for k, v := range s.FileMetadata(fn) {
+			md[k] = v
+		}
+	}
+	if extra, ok := ctx.Value(metadataKey{}).(baker.Metadata); ok {
+		for k, v := range extra {
+			md[k] = v
+		}
+	}
+	if span := tracing.SpanFromContext(ctx); span != nil {
+		md[tracing.MetadataKey] = span
+	}
+	return md
+}
+
 // CompressedInput is a base for creating input components that processes
-// multiple gzip or zstd-compressed logs coming from arbitrary sources.
+// multiple compressed logs coming from arbitrary sources. Files are
+// decompressed by the decompressor registered for their suffix (see
+// RegisterDecompressor), gzip by default.
 //
 // This class implements an internal queue of files (expressed by filenames)
 // and instantiates a number of workers to process them. Subclasses can
@@ -51,20 +90,70 @@ const (
 //
 // It must be configured with an Opener function that is able to open
 // a file given its filename and returns a io.ReadCloser instance for
-// that file.
+// that file. If OpenerContext is set, it's used instead of Opener so that
+// opening the file can be aborted.
 type CompressedInput struct {
-	Opener func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error)
-	Sizer  func(fn string) (int64, error)
-	Done   chan bool
-
-	files    chan string
+	Opener        func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error)
+	OpenerContext func(ctx context.Context, fn string) (io.ReadCloser, int64, time.Time, *url.URL, error)
+	Sizer         func(fn string) (int64, error)
+	Done          chan bool
+
+	// FileMetadata, if set, returns metadata added to the records of the
+	// file fn, like the location of the file.
+	FileMetadata func(fn string) baker.Metadata
+
+	// Compression, if set, is the name of the decompressor of all the files,
+	// whatever their suffix.
+	Compression string
+
+	// FileDone, if set, is called once a file enqueued with ProcessFile has
+	// been parsed, with the error returned by ParseFile. When err is nil,
+	// all the records of the file have been sent to the output channel.
+	FileDone func(fn string, err error)
+
+	// Tracer, if set, traces the processing of each file with a "file"
+	// span, child of the span or remote parent carried by the context
+	// passed to ParseFileContext, if any. Its children trace the download,
+	// the parsing and, down the topology, each chunk of the file. The file
+	// span ends once all the chunks have been through the filter chain.
+	Tracer *tracing.Tracer
+
+	files    chan *queuedFile
 	pool     sync.Pool
 	data     chan<- *baker.Data
 	stopNow  chan struct{}
 	stopping int64
 
+	wg       sync.WaitGroup
+	nworkers int           // number of workers processing the enqueued files
+	readers  chan struct{} // if not nil, bounds the number of files parsed concurrently
+
+	// With readahead, the enqueued files are also sent to ahead, in the same
+	// order, to be downloaded before the workers get to them.
+	ahead       chan *queuedFile
+	aheadSlots  chan struct{} // bounds the number of files downloaded ahead and not parsed yet
+	aheadCtx    context.Context
+	aheadCancel context.CancelFunc // cancels the downloads in progress when stopped
+	enqueueMu   sync.Mutex         // keeps files and ahead in the same order
+
 	stats             *inputStats
 	numProcessedLines int64
+	inflight          int64 // number of files being parsed
+	decompressErrors  int64 // number of files whose decompression failed before their end
+}
+
+// queuedFile is a file enqueued with ProcessFile.
+type queuedFile struct {
+	fn string
+
+	// With readahead, ready is closed once the file has been downloaded in
+	// buf, or couldn't be with err.
+	ready        chan struct{}
+	buf          []byte
+	sz           int64
+	lastModified time.Time
+	url          *url.URL
+	err          error
 }
 
 type inputStats struct {
@@ -107,6 +196,35 @@ func (i *inputStatsReader) Close() error {
 	return i.r.Close()
 }
 
+// sourceReader records the first error, other than io.EOF, returned by the
+// reader of a compressed file, to tell the read errors of the file itself
+// (e.g. a truncated network connection) from its decompression errors.
+type sourceReader struct {
+	r io.Reader
+
+	mu  sync.Mutex // the decompressor may read from another goroutine
+	err error
+}
+
+func (sr *sourceReader) Read(data []byte) (int, error) {
+	n, err := sr.r.Read(data)
+	if err != nil && err != io.EOF {
+		sr.mu.Lock()
+		if sr.err == nil {
+			sr.err = err
+		}
+		sr.mu.Unlock()
+	}
+	return n, err
+}
+
+// failed returns the first error returned by the file reader, if any.
+func (sr *sourceReader) failed() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.err
+}
+
 func newInputStats() *inputStats {
 	s := new(inputStats)
 	s.beginTime = time.Now()
@@ -151,7 +269,7 @@ func NewCompressedInput(opener func(fn string) (io.ReadCloser, int64, time.Time,
 		Sizer:   sizer,
 		Done:    done,
 		stats:   newInputStats(),
-		files:   make(chan string, 1024),
+		files:   make(chan *queuedFile, 1024),
 		stopNow: make(chan struct{}),
 		pool: sync.Pool{
 			New: func() interface{} {
@@ -162,23 +280,102 @@ func NewCompressedInput(opener func(fn string) (io.ReadCloser, int64, time.Time,
 
 	// Start workers, that will read incoming files in the queue
 	// and process them.
-	var wg sync.WaitGroup
-	for i := 0; i < 4; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			s.worker()
-		}()
-	}
+	s.startWorkers(4)
 
 	go func() {
-		wg.Wait()
+		s.wg.Wait()
 		close(s.Done)
 	}()
 
 	return s
 }
 
+// startWorkers starts workers until there are n of them.
+func (s *CompressedInput) startWorkers(n int) {
+	for ; s.nworkers < n; s.nworkers++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.worker()
+		}()
+	}
+}
+
+// SetReaderConcurrency sets the maximum number of files parsed concurrently,
+// whether they've been enqueued with ProcessFile or are parsed with
+// ParseFile. n must be at least 1. By default, 4 enqueued files are parsed
+// concurrently and ParseFile calls are not limited.
+//
+// SetReaderConcurrency must be called before any file is processed.
+func (s *CompressedInput) SetReaderConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("reader concurrency must be at least 1, got %d", n)
+	}
+	s.readers = make(chan struct{}, n)
+	s.startWorkers(n)
+	return nil
+}
+
+// SetReadahead enables the download of up to depth enqueued files ahead
+// of their parsing, so that the next files are already downloaded (or being
+// downloaded) while the records of the current ones are sent to the output
+// channel. It hides the download latency of many small files, at the cost of
+// buffering up to depth whole files in memory; depth must be at least 1.
+// Files parsed with ParseFile are not downloaded ahead.
+//
+// SetReadahead must be called before any file is processed.
+func (s *CompressedInput) SetReadahead(depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("readahead depth must be at least 1, got %d", depth)
+	}
+	s.ahead = make(chan *queuedFile, cap(s.files))
+	s.aheadSlots = make(chan struct{}, depth)
+	s.aheadCtx, s.aheadCancel = context.WithCancel(context.Background())
+	go s.prefetch()
+	return nil
+}
+
+// prefetch starts downloading the enqueued files, in order, as long as
+// fewer than the readahead depth are waiting to be parsed.
+func (s *CompressedInput) prefetch() {
+	for q := range s.ahead {
+		select {
+		case s.aheadSlots <- struct{}{}:
+		case <-s.stopNow:
+			return
+		}
+		go s.download(q)
+	}
+}
+
+// download reads the whole enqueued file q in memory.
+func (s *CompressedInput) download(q *queuedFile) {
+	defer close(q.ready)
+
+	var r io.ReadCloser
+	r, q.sz, q.lastModified, q.url, q.err = s.open(s.aheadCtx, q.fn)
+	if q.err != nil {
+		return
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if q.sz > 0 {
+		buf.Grow(int(q.sz))
+	}
+	if _, q.err = buf.ReadFrom(r); q.err == nil {
+		q.buf = buf.Bytes()
+	}
+}
+
+// open opens file fn with the configured opener.
+func (s *CompressedInput) open(ctx context.Context, fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+	if s.OpenerContext != nil {
+		return s.OpenerContext(ctx, fn)
+	}
+	return s.Opener(fn)
+}
+
 func (s *CompressedInput) worker() {
 	// Process incoming files on the s.files channel.
 	// If the channel is closed, it means that we processed all the
@@ -187,18 +384,43 @@ func (s *CompressedInput) worker() {
 	// as soon as possible.
 	for {
 		select {
-		case fn, ok := <-s.files:
+		case q, ok := <-s.files:
 			if !ok {
 				// Channel is closed, we're done
 				return
 			}
-			s.ParseFile(fn)
+			err := s.parseQueued(q)
+			if s.FileDone != nil {
+				s.FileDone(q.fn, err)
+			}
 		case <-s.stopNow:
 			return
 		}
 	}
 }
 
+// parseQueued parses an enqueued file, from memory if it's been downloaded
+// ahead.
+func (s *CompressedInput) parseQueued(q *queuedFile) error {
+	if q.ready == nil {
+		return s.ParseFile(q.fn)
+	}
+	select {
+	case <-q.ready:
+	case <-s.stopNow:
+		return errStopped
+	}
+	// Once downloaded, the file holds a slot until its parsing is done.
+	defer func() { <-s.aheadSlots }()
+	open := func(context.Context, string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		if q.err != nil {
+			return nil, 0, time.Time{}, nil, q.err
+		}
+		return ioutil.NopCloser(bytes.NewReader(q.buf)), q.sz, q.lastModified, q.url, nil
+	}
+	return s.parseFile(context.Background(), q.fn, open)
+}
+
 func (s *CompressedInput) SetOutputChannel(data chan<- *baker.Data) {
 	s.data = data
 }
@@ -207,6 +429,8 @@ func (s *CompressedInput) send(data *baker.Data) {
 	nlines := int64(bytes.Count(data.Bytes, []byte{'\n'}))
 	atomic.AddInt64(&s.numProcessedLines, nlines)
 
+	// The file span ends once the topology is done with all its chunks.
+	tracing.FromMetadata(data.Meta).Hold()
 	s.data <- data
 }
 
@@ -222,7 +446,17 @@ func (s *CompressedInput) ProcessFile(fn string) error {
 		return err
 	}
 	s.stats.NewFile(sz)
-	s.files <- fn
+
+	q := &queuedFile{fn: fn}
+	if s.ahead == nil {
+		s.files <- q
+		return nil
+	}
+	q.ready = make(chan struct{})
+	s.enqueueMu.Lock()
+	defer s.enqueueMu.Unlock()
+	s.ahead <- q
+	s.files <- q
 	return nil
 }
 
@@ -231,80 +465,128 @@ func (s *CompressedInput) ProcessFile(fn string) error {
 // be used by an input which has a fixed set of files to process.
 func (s *CompressedInput) NoMoreFiles() {
 	close(s.files)
+	if s.ahead != nil {
+		close(s.ahead)
+	}
 }
 
 func (s *CompressedInput) Stop() {
 	close(s.stopNow)
 	atomic.StoreInt64(&s.stopping, 1)
+	if s.aheadCancel != nil {
+		// Abort the files being downloaded ahead, those already
+		// downloaded are dropped.
+		s.aheadCancel()
+	}
+}
+
+// ParseFile reads the file, sending its records to the output channel, and
+// returns once the file has been entirely read. It returns an error if the
+// file couldn't be opened or read until the end, including when the input is
+// stopped in the middle of the file.
+func (s *CompressedInput) ParseFile(fn string) error {
+	return s.ParseFileContext(context.Background(), fn)
+}
+
+// ParseFileContext is like ParseFile but aborts reading the file as soon as
+// ctx is done, in which case it returns ctx.Err().
+func (s *CompressedInput) ParseFileContext(ctx context.Context, fn string) error {
+	return s.parseFile(ctx, fn, s.open)
 }
 
-func (s *CompressedInput) ParseFile(fn string) {
-	if strings.HasSuffix(fn, ".zst") || strings.HasSuffix(fn, ".zstd") {
-		s.parseFileTyped(fn, zstdCompression)
-	} else {
-		s.parseFileTyped(fn, gzipCompression)
+// parseFile parses file fn, opened with open.
+func (s *CompressedInput) parseFile(ctx context.Context, fn string, open func(context.Context, string) (io.ReadCloser, int64, time.Time, *url.URL, error)) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "file", tracing.String("file", fn))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if s.readers != nil {
+		select {
+		case s.readers <- struct{}{}:
+			defer func() { <-s.readers }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	decompress, err := decompressorFor(s.Compression, fn)
+	if err != nil {
+		return err
+	}
+	err = s.parseFileTyped(ctx, fn, decompress, open)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
+	return err
 }
 
-func (s *CompressedInput) parseFileTyped(fn string, comp compressionType) {
+func (s *CompressedInput) parseFileTyped(ctx context.Context, fn string, decompress Decompressor, open func(context.Context, string) (io.ReadCloser, int64, time.Time, *url.URL, error)) error {
 
-	ctx := log.WithFields(log.Fields{"f": "compressedInput.parseFile", "fn": fn})
-	stream, sz, lastModified, url, err := s.Opener(fn)
+	ctxLog := log.WithFields(log.Fields{"f": "compressedInput.parseFile", "fn": fn})
 
+	var (
+		stream       io.ReadCloser
+		sz           int64
+		lastModified time.Time
+		url          *url.URL
+		err          error
+	)
+	span := tracing.SpanFromContext(ctx)
+	download := span.StartChild("download")
+	stream, sz, lastModified, url, err = open(ctx, fn)
+	download.SetError(err)
+	download.End()
+
+	raw := stream
 	stream = s.stats.NewStatsReader(stream, sz)
 	if err != nil {
 		log.WithFields(log.Fields{"f": "compressedInput.parseFile", "fn": fn}).WithError(err).Error("Error while opening stream")
-		return
+		return err
 	}
 	defer stream.Close()
 
-	var r io.Reader
-
-	switch comp {
-	case gzipCompression:
-		if sz > 1000000 {
-			rgz, err := newFastGzReader(stream)
-			if err != nil {
-				// Sometimes the fast gz reader fails to initialize due to
-				// memory pressure. We'd still like to run so try the
-				// slower (and less memory hungry) gzip.
-				ctx.WithError(err).Error("error initializing fast gzip, will attempt slow gzip")
-				r, err = gzip.NewReader(stream)
-				if err != nil {
-					ctx.WithError(err).Fatal("both fast and slow gzip readers failed to initialize")
-					return
-				}
-			} else {
-				defer rgz.Close()
-				r = rgz
-			}
-		} else {
-			rgz, err := gzip.NewReader(stream)
-			if err != nil {
-				ctx.WithError(err).Fatal("error initializing gzip")
-				return
-			}
-			defer rgz.Close()
-			r = rgz
+	// Abort the reads in progress as soon as ctx is done, by closing the
+	// underlying stream.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.Close()
+		case <-finished:
 		}
-	case zstdCompression:
-		rzst := zstd.NewReader(stream)
-		defer rzst.Release()
-		r = rzst
-	default:
-		ctx.WithError(err).Fatal("Unknown compression type specified.")
+	}()
+
+	// A file that can't be decompressed only fails itself, not the input.
+	src := &sourceReader{r: stream}
+	r, err := decompress(src, sz)
+	if err != nil {
+		if ctx.Err() == nil && src.failed() == nil {
+			atomic.AddInt64(&s.decompressErrors, 1)
+			ctxLog.WithError(err).Error("error initializing decompression")
+		}
+		return err
 	}
+	defer r.Close()
 
-	ctx.Info("begin reading")
+	ctxLog.Info("begin reading")
+
+	parse := span.StartChild("parse", tracing.Int("size", sz))
+	defer parse.End()
 
 	rbuf := bufio.NewReaderSize(r, kChunkBuffer)
 
-	for atomic.LoadInt64(&s.stopping) == 0 {
+	eof := false
+	line := int64(1) // line number of the first record of the next chunk
+	for atomic.LoadInt64(&s.stopping) == 0 && ctx.Err() == nil {
 		bakerData := s.pool.Get().(*baker.Data)
-		bakerData.Meta = baker.Metadata{
-			MetadataLastModified: lastModified,
-			MetadataURL:          url,
-		}
+		bakerData.Meta = s.fileMetadata(ctx, fn, lastModified, url)
+		bakerData.FirstLine = line
 
 		// Read a big chunk of data (but keeping kMaxLineLength
 		// bytes available for completing the last line).
@@ -312,12 +594,16 @@ func (s *CompressedInput) parseFileTyped(fn string, comp compressionType) {
 		if err == io.EOF {
 			bakerData.Bytes = bakerData.Bytes[:n]
 			s.send(bakerData)
+			eof = true
 			break
 		}
 
 		if err != nil {
-			ctx.WithError(err).Error("error reading file")
-			return
+			if ctx.Err() == nil && src.failed() == nil {
+				atomic.AddInt64(&s.decompressErrors, 1)
+			}
+			ctxLog.WithError(err).Error("error reading file")
+			return err
 		}
 
 		// We need to send a batch of complete lines to the filter
@@ -330,9 +616,16 @@ func (s *CompressedInput) parseFileTyped(fn string, comp compressionType) {
 		// will be handled back when we begin the loop again.
 		if bakerData.Bytes[n-1] != '\n' {
 			endl, err := rbuf.ReadBytes('\n')
-			if err != nil {
-				ctx.WithError(err).Error("error searching newline")
-				return
+			if err == io.EOF {
+				// The last line of the file isn't terminated: endl holds
+				// its remaining bytes, if any.
+				eof = true
+			} else if err != nil {
+				if ctx.Err() == nil && src.failed() == nil {
+					atomic.AddInt64(&s.decompressErrors, 1)
+				}
+				ctxLog.WithError(err).Error("error searching newline")
+				return err
 			}
 
 			// If there is no space in the buffer to complete the
@@ -347,19 +640,30 @@ func (s *CompressedInput) parseFileTyped(fn string, comp compressionType) {
 				// up to the endline
 				bakerData2 := s.pool.Get().(*baker.Data)
 				bakerData2.Meta = bakerData.Meta
+				bakerData2.FirstLine = line + int64(bytes.Count(bakerData.Bytes[:n], []byte{'\n'}))
 				bakerData2.Bytes = append(bakerData2.Bytes[:0], bakerData.Bytes[n:lastn]...)
 				bakerData2.Bytes = append(bakerData2.Bytes, endl...)
 				s.send(bakerData2)
+				line++ // the huge line
 			} else {
 				copy(bakerData.Bytes[n:], endl)
 				n += len(endl)
 			}
 		}
 		bakerData.Bytes = bakerData.Bytes[:n]
+		line += int64(bytes.Count(bakerData.Bytes, []byte{'\n'}))
 		s.send(bakerData)
+		if eof {
+			break
+		}
 	}
 
-	ctx.Info("end")
+	if !eof {
+		ctxLog.Info("stopped before the end of the file")
+		return errStopped
+	}
+	ctxLog.Info("end")
+	return nil
 }
 
 func (s *CompressedInput) FreeMem(data *baker.Data) {
@@ -368,8 +672,11 @@ func (s *CompressedInput) FreeMem(data *baker.Data) {
 }
 
 func (s *CompressedInput) Stats() baker.InputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("input.decompression_errors", atomic.LoadInt64(&s.decompressErrors))
 	return baker.InputStats{
 		NumProcessedLines: atomic.LoadInt64(&s.numProcessedLines),
 		CustomStats:       s.stats.Stats(),
+		Metrics:           bag,
 	}
 }
@@ -3,8 +3,13 @@ package inpututils
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -91,3 +96,167 @@ func TestGzipStream(t *testing.T) {
 		t.Errorf("invalid num lines, want:30, got:%d", numlines)
 	}
 }
+
+func TestParseFileError(t *testing.T) {
+	errOpen := errors.New("can't open")
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		switch fn {
+		case "missing":
+			return nil, 0, time.Time{}, nil, errOpen
+		case "truncated":
+			// A gzip stream cut in the middle.
+			buf := &bytes.Buffer{}
+			w := gzip.NewWriter(buf)
+			w.Write(bytes.Repeat([]byte("a line\n"), 1000))
+			w.Close()
+			return ioutil.NopCloser(bytes.NewReader(buf.Bytes()[:buf.Len()/2])), 0, time.Time{}, nil, nil
+		}
+		panic(fn)
+	}
+	sizer := func(fn string) (int64, error) {
+		return 0, nil
+	}
+
+	data := make(chan *baker.Data, 10)
+	gz := NewCompressedInput(opener, sizer, make(chan bool, 1))
+	gz.SetOutputChannel(data)
+
+	if err := gz.ParseFile("missing"); err != errOpen {
+		t.Errorf("ParseFile(missing) = %v, want %v", err, errOpen)
+	}
+	if err := gz.ParseFile("truncated"); err == nil {
+		t.Errorf("ParseFile(truncated) = nil, want an error")
+	}
+}
+
+func TestParseFileNoTrailingNewline(t *testing.T) {
+	var file bytes.Buffer
+	w := gzip.NewWriter(&file)
+	w.Write([]byte("a,1\nb,2"))
+	w.Close()
+
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		return ioutil.NopCloser(bytes.NewReader(file.Bytes())), int64(file.Len()), time.Time{}, &url.URL{}, nil
+	}
+	sizer := func(fn string) (int64, error) { return int64(file.Len()), nil }
+
+	data := make(chan *baker.Data, 10)
+	gz := NewCompressedInput(opener, sizer, make(chan bool, 1))
+	gz.SetOutputChannel(data)
+
+	if err := gz.ParseFile("file.gz"); err != nil {
+		t.Fatalf("ParseFile() = %v, want nil", err)
+	}
+	close(data)
+
+	var got []byte
+	for d := range data {
+		got = append(got, d.Bytes...)
+	}
+	if want := "a,1\nb,2"; string(got) != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestParseFileContext(t *testing.T) {
+	// The file is never written, so reading it blocks until it's closed.
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		r, _ := io.Pipe()
+		return r, 0, time.Time{}, &url.URL{}, nil
+	}
+	sizer := func(fn string) (int64, error) {
+		return 0, nil
+	}
+
+	gz := NewCompressedInput(opener, sizer, make(chan bool, 1))
+	gz.SetOutputChannel(make(chan *baker.Data))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error)
+	go func() { errc <- gz.ParseFileContext(ctx, "stuck") }()
+
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Errorf("ParseFileContext() = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ParseFileContext() not aborted once the context is done")
+	}
+}
+
+func TestParseFileMetadata(t *testing.T) {
+	// Many short lines, spanning several chunks, with a huge one in the
+	// middle that's sent in a chunk of its own.
+	var file bytes.Buffer
+	w := gzip.NewWriter(&file)
+	var lines []string
+	for i := 0; i < 30000; i++ {
+		line := fmt.Sprintf("line %d", i+1)
+		if i == 15000 {
+			line += strings.Repeat("x", 200*1024)
+		}
+		lines = append(lines, line)
+		fmt.Fprintln(w, line)
+	}
+	w.Close()
+
+	lastModified := time.Unix(1234, 5678)
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		u, _ := url.Parse(fn)
+		return ioutil.NopCloser(bytes.NewReader(file.Bytes())), int64(file.Len()), lastModified, u, nil
+	}
+	sizer := func(fn string) (int64, error) { return int64(file.Len()), nil }
+
+	gz := NewCompressedInput(opener, sizer, make(chan bool, 1))
+	gz.FileMetadata = func(fn string) baker.Metadata {
+		return baker.Metadata{MetadataS3Bucket: "bucket", MetadataS3Key: "some/key.log.gz"}
+	}
+	data := make(chan *baker.Data)
+	gz.SetOutputChannel(data)
+
+	errc := make(chan error, 1)
+	go func() {
+		ctx := ContextWithMetadata(context.Background(), baker.Metadata{MetadataSQSQueue: "queue-url"})
+		errc <- gz.ParseFileContext(ctx, "s3://bucket/some/key.log.gz")
+		close(data)
+	}()
+
+	nlines := 0
+	for d := range data {
+		wantMeta := map[string]interface{}{
+			MetadataS3Bucket: "bucket",
+			MetadataS3Key:    "some/key.log.gz",
+			MetadataSQSQueue: "queue-url",
+		}
+		for k, want := range wantMeta {
+			if got := d.Meta[k]; got != want {
+				t.Errorf("metadata %s = %v, want %v", k, got, want)
+			}
+		}
+		if got := d.Meta[MetadataLastModified]; got != lastModified {
+			t.Errorf("metadata %s = %v, want %v", MetadataLastModified, got, lastModified)
+		}
+
+		// Each record is numbered after the first line of its chunk.
+		if len(d.Bytes) == 0 {
+			continue // the EOF chunk
+		}
+		for i, line := range strings.Split(strings.TrimSuffix(string(d.Bytes), "\n"), "\n") {
+			n := d.FirstLine + int64(i)
+			if n < 1 || n > int64(len(lines)) || lines[n-1] != line {
+				t.Fatalf("chunk starting at line %d: record %d isn't line %d", d.FirstLine, i, n)
+			}
+			nlines++
+		}
+		gz.FreeMem(d)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if nlines != len(lines) {
+		t.Errorf("got %d records, want %d", nlines, len(lines))
+	}
+}
@@ -0,0 +1,151 @@
+package inpututils
+
+import (
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/pierrec/lz4/v3"
+	log "github.com/sirupsen/logrus"
+	zstd "github.com/valyala/gozstd"
+)
+
+// A Decompressor returns a reader of the decompressed content of r. size is
+// the size of the compressed file, or 0 if it's unknown.
+type Decompressor func(r io.Reader, size int64) (io.ReadCloser, error)
+
+// Names of the built-in decompressors.
+const (
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+	CompressionLZ4   = "lz4"
+)
+
+type decompressor struct {
+	suffixes []string
+	new      Decompressor
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = map[string]decompressor{}
+)
+
+func init() {
+	RegisterDecompressor(CompressionGzip, []string{".gz"}, newGzipReader)
+	RegisterDecompressor(CompressionZstd, []string{".zst", ".zstd"}, func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		return zstdReader{zstd.NewReader(r)}, nil
+	})
+	RegisterDecompressor(CompressionBzip2, []string{".bz2"}, func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	})
+	RegisterDecompressor(CompressionLZ4, []string{".lz4"}, func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	})
+}
+
+// RegisterDecompressor registers a decompressor under the given name, used
+// for the files whose name ends with one of suffixes, or for all the files of
+// a CompressedInput whose Compression is name. It panics if a decompressor is
+// already registered under that name.
+func RegisterDecompressor(name string, suffixes []string, d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	if _, dup := decompressors[name]; dup {
+		panic("inpututils: RegisterDecompressor called twice for " + name)
+	}
+	decompressors[name] = decompressor{suffixes: suffixes, new: d}
+}
+
+// Decompressors returns the sorted names of the registered decompressors.
+func Decompressors() []string {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	names := make([]string, 0, len(decompressors))
+	for name := range decompressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCompression returns an error if no decompressor is registered
+// under name. An empty name is valid: the decompressor is then chosen by the
+// suffix of the files.
+func ValidateCompression(name string) error {
+	if name == "" {
+		return nil
+	}
+	decompressorsMu.RLock()
+	_, ok := decompressors[name]
+	decompressorsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unsupported compression %q, must be one of %s", name, strings.Join(Decompressors(), ", "))
+	}
+	return nil
+}
+
+// decompressorFor returns the decompressor registered under name or, if name
+// is empty, the one of the suffix of fn.
+func decompressorFor(name, fn string) (Decompressor, error) {
+	if name == "" {
+		name = compressionOf(fn)
+	}
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	d, ok := decompressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", name)
+	}
+	return d.new, nil
+}
+
+// compressionOf returns the name of the decompressor whose suffix matches fn.
+// The files with an unknown suffix are gzip-compressed.
+func compressionOf(fn string) string {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	name, bestLen := CompressionGzip, 0
+	for n, d := range decompressors {
+		for _, suffix := range d.suffixes {
+			// The longest matching suffix wins, so that a decompressor can
+			// be registered for .tar.gz files for example.
+			if len(suffix) > bestLen && strings.HasSuffix(fn, suffix) {
+				name, bestLen = n, len(suffix)
+			}
+		}
+	}
+	return name
+}
+
+// newGzipReader returns a gzip reader of r, using an external process for the
+// big files.
+func newGzipReader(r io.Reader, size int64) (io.ReadCloser, error) {
+	if size > 1000000 {
+		rgz, err := newFastGzReader(r)
+		if err == nil {
+			return rgz, nil
+		}
+		// Sometimes the fast gz reader fails to initialize due to memory
+		// pressure. We'd still like to run so try the slower (and less
+		// memory hungry) gzip.
+		log.WithError(err).Error("error initializing fast gzip, will attempt slow gzip")
+	}
+	return gzip.NewReader(r)
+}
+
+// zstdReader is the io.ReadCloser of a zstd reader.
+type zstdReader struct {
+	*zstd.Reader
+}
+
+func (r zstdReader) Close() error {
+	r.Release()
+	return nil
+}
@@ -0,0 +1,180 @@
+package inpututils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+)
+
+// readFixture reads file fn with ci and returns its records.
+func readFixture(t *testing.T, ci *CompressedInput, fn string) ([]byte, error) {
+	t.Helper()
+
+	data := make(chan *baker.Data)
+	ci.SetOutputChannel(data)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ci.ParseFile(fn)
+		close(data)
+	}()
+
+	var buf bytes.Buffer
+	for d := range data {
+		buf.Write(d.Bytes)
+		ci.FreeMem(d)
+	}
+	return buf.Bytes(), <-errc
+}
+
+func newFixtureInput(open func(fn string) ([]byte, error)) *CompressedInput {
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		buf, err := open(fn)
+		if err != nil {
+			return nil, 0, time.Time{}, nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(buf)), int64(len(buf)), time.Time{}, &url.URL{Path: fn}, nil
+	}
+	sizer := func(fn string) (int64, error) { return 0, nil }
+	return NewCompressedInput(opener, sizer, make(chan bool, 1))
+}
+
+func TestDecompressFixtures(t *testing.T) {
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "records.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		fn          string // name of the file, as given to ParseFile
+		fixture     string // file in testdata
+		compression string
+	}{
+		{name: "bzip2 by suffix", fn: "records.csv.bz2", fixture: "records.csv.bz2"},
+		{name: "lz4 by suffix", fn: "records.csv.lz4", fixture: "records.csv.lz4"},
+		{name: "bzip2 forced", fn: "records.dat", fixture: "records.csv.bz2", compression: CompressionBzip2},
+		{name: "lz4 forced", fn: "records.csv.gz", fixture: "records.csv.lz4", compression: CompressionLZ4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ci := newFixtureInput(func(string) ([]byte, error) {
+				return ioutil.ReadFile(filepath.Join("testdata", tt.fixture))
+			})
+			ci.Compression = tt.compression
+
+			got, err := readFixture(t, ci, tt.fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded records don't match testdata/records.csv: got %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// failingReader is a reader always failing with err.
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestDecompressError(t *testing.T) {
+	ci := newFixtureInput(func(fn string) ([]byte, error) {
+		buf, err := ioutil.ReadFile(filepath.Join("testdata", strings.TrimPrefix(fn, "truncated/")))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(fn, "truncated/") {
+			buf = buf[:len(buf)/2]
+		}
+		return buf, nil
+	})
+
+	if _, err := readFixture(t, ci, "truncated/records.csv.bz2"); err == nil {
+		t.Errorf("ParseFile(truncated bzip2) = nil, want an error")
+	}
+	if _, err := readFixture(t, ci, "truncated/records.csv.lz4"); err == nil {
+		t.Errorf("ParseFile(truncated lz4) = nil, want an error")
+	}
+
+	// The input keeps reading the other files.
+	if _, err := readFixture(t, ci, "records.csv.bz2"); err != nil {
+		t.Errorf("ParseFile(bzip2) = %v, want nil", err)
+	}
+	if got := ci.Stats().Metrics.Get("c:input.decompression_errors"); got != int64(2) {
+		t.Errorf("decompression errors = %v, want 2", got)
+	}
+
+	// A file failing to be read isn't a decompression error.
+	errRead := errors.New("connection reset")
+	opener := func(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		buf, err := ioutil.ReadFile(filepath.Join("testdata", "records.csv.bz2"))
+		if err != nil {
+			return nil, 0, time.Time{}, nil, err
+		}
+		r := io.MultiReader(bytes.NewReader(buf[:len(buf)/2]), failingReader{errRead})
+		return ioutil.NopCloser(r), int64(len(buf)), time.Time{}, &url.URL{Path: fn}, nil
+	}
+	ci.Opener = opener
+	if _, err := readFixture(t, ci, "records.csv.bz2"); err == nil {
+		t.Errorf("ParseFile(reset bzip2) = nil, want an error")
+	}
+	if got := ci.Stats().Metrics.Get("c:input.decompression_errors"); got != int64(2) {
+		t.Errorf("decompression errors after a read error = %v, want 2", got)
+	}
+
+	ci.Compression = "rar"
+	if _, err := readFixture(t, ci, "records.csv.bz2"); err == nil {
+		t.Errorf("ParseFile with an unsupported compression = nil, want an error")
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	// Files are "compressed" by lower-casing them.
+	RegisterDecompressor("test-upper", []string{".csv.up"}, func(r io.Reader, _ int64) (io.ReadCloser, error) {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(buf))), nil
+	})
+
+	ci := newFixtureInput(func(string) ([]byte, error) { return []byte("a,b\nc,d\n"), nil })
+	got, err := readFixture(t, ci, "file.csv.up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A,B\nC,D\n"; string(got) != want {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+
+	if err := ValidateCompression("test-upper"); err != nil {
+		t.Errorf("ValidateCompression(test-upper) = %v", err)
+	}
+	if err := ValidateCompression("rar"); err == nil {
+		t.Errorf("ValidateCompression(rar) = nil, want an error")
+	}
+}
+
+func TestCompressionOf(t *testing.T) {
+	for fn, want := range map[string]string{
+		"a.log.gz":   CompressionGzip,
+		"a.log":      CompressionGzip,
+		"a.log.zst":  CompressionZstd,
+		"a.log.zstd": CompressionZstd,
+		"a.log.bz2":  CompressionBzip2,
+		"a.log.lz4":  CompressionLZ4,
+	} {
+		if got := compressionOf(fn); got != want {
+			t.Errorf("compressionOf(%q) = %q, want %q", fn, got, want)
+		}
+	}
+}
@@ -1,15 +1,24 @@
 package inpututils
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 type S3Input struct {
@@ -17,21 +26,102 @@ type S3Input struct {
 
 	Bucket string
 
-	svc *s3.S3
+	svc    s3iface.S3API
+	region string // region of svc
+
+	// newClient creates a client for the given region, used for the buckets
+	// located in another region than svc. If nil, svc is used for all
+	// buckets.
+	newClient func(region string) s3iface.S3API
+
+	mu      sync.Mutex
+	regions map[string]string        // resolved regions, by bucket
+	clients map[string]s3iface.S3API // clients, by region
+
+	crossRegionn int64 // number of downloads from buckets of another region
 }
 
 func NewS3Input(region, bucket string) *S3Input {
-	sess := session.New(&aws.Config{Region: aws.String(region)})
-	svc := s3.New(sess)
+	return NewS3InputWithSession(session.New(&aws.Config{Region: aws.String(region)}), bucket)
+}
+
+// NewS3InputWithSession is like NewS3Input but uses the given AWS session,
+// to configure custom endpoints or credentials.
+//
+// The buckets located in other regions than the session one are accessed
+// with a client of their region, sharing the session.
+func NewS3InputWithSession(sess *session.Session, bucket string) *S3Input {
+	s := NewS3InputWithClient(s3.New(sess), bucket)
+	s.region = aws.StringValue(sess.Config.Region)
+	s.newClient = func(region string) s3iface.S3API {
+		return s3.New(sess, aws.NewConfig().WithRegion(region))
+	}
+	return s
+}
 
+// NewS3InputWithClient is like NewS3Input but uses the given S3 client, which
+// can be a fake one in tests.
+func NewS3InputWithClient(svc s3iface.S3API, bucket string) *S3Input {
 	s := &S3Input{
-		Bucket: bucket,
-		svc:    svc,
+		Bucket:  bucket,
+		svc:     svc,
+		regions: make(map[string]string),
+		clients: make(map[string]s3iface.S3API),
 	}
 	s.CompressedInput = NewCompressedInput(s.openS3File, s.sizeS3File, make(chan bool, 1))
+	s.OpenerContext = s.openS3FileContext
+	s.FileMetadata = s.fileMetadata
 	return s
 }
 
+// s3PathEscaper escapes the characters of an S3 key that would otherwise be
+// interpreted when the S3 path is parsed as an URL.
+var s3PathEscaper = strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23")
+
+// S3Path returns the full S3 path of the object with the given bucket and
+// (decoded) key. S3Input reads objects from their bucket when given such a
+// path, whatever its configured bucket.
+func S3Path(bucket, key string) string {
+	return "s3://" + bucket + "/" + s3PathEscaper.Replace(key)
+}
+
+// ParseObject is like ParseFileContext, for the object with the given key in
+// the given bucket, which may not be the configured one.
+func (s *S3Input) ParseObject(ctx context.Context, bucket, key string) error {
+	return s.ParseFileContext(ctx, S3Path(bucket, key))
+}
+
+// GetObject returns the content of the object with the given key in the
+// given bucket, as-is.
+func (s *S3Input) GetObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	svc, _ := s.client(ctx, bucket)
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// DeleteObject deletes the object with the given key in the given bucket.
+func (s *S3Input) DeleteObject(ctx context.Context, bucket, key string) error {
+	svc, _ := s.client(ctx, bucket)
+	_, err := svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// CheckBucket verifies that the configured bucket exists and can be accessed.
+func (s *S3Input) CheckBucket() error {
+	_, err := s.svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.Bucket)})
+	return err
+}
+
 // ProcessDirectory enqueues all files matching a specific prefix for
 // processing by s3Input. If prefix is actually a s3 url use the bucket
 // there instead of the one provided at creation time.
@@ -69,12 +159,17 @@ func (s *S3Input) ProcessDirectory(prefix string) error {
 }
 
 func (s *S3Input) openS3File(fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+	return s.openS3FileContext(context.Background(), fn)
+}
+
+func (s *S3Input) openS3FileContext(ctx context.Context, fn string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
 	_, s3Bucket, s3Key, err := s.choosePathComponents(fn)
 	if err != nil {
 		return nil, 0, time.Time{}, nil, err
 	}
 
-	resp, err := s.svc.GetObject(&s3.GetObjectInput{
+	svc, crossRegion := s.client(ctx, s3Bucket)
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(s3Key),
 	})
@@ -82,6 +177,10 @@ func (s *S3Input) openS3File(fn string) (io.ReadCloser, int64, time.Time, *url.U
 		return nil, 0, time.Time{}, nil, err
 	}
 
+	if crossRegion {
+		atomic.AddInt64(&s.crossRegionn, 1)
+	}
+
 	urlObject, err := url.Parse(fn)
 	if err != nil {
 		return nil, 0, time.Time{}, nil, err
@@ -90,13 +189,23 @@ func (s *S3Input) openS3File(fn string) (io.ReadCloser, int64, time.Time, *url.U
 	return resp.Body, *resp.ContentLength, *resp.LastModified, urlObject, nil
 }
 
+// fileMetadata returns the S3 location of file fn, as metadata.
+func (s *S3Input) fileMetadata(fn string) baker.Metadata {
+	_, bucket, key, err := s.choosePathComponents(fn)
+	if err != nil {
+		return nil
+	}
+	return baker.Metadata{MetadataS3Bucket: bucket, MetadataS3Key: key}
+}
+
 func (s *S3Input) sizeS3File(fn string) (int64, error) {
 	_, s3Bucket, s3Key, err := s.choosePathComponents(fn)
 	if err != nil {
 		return 0, err
 	}
 
-	resp, err := s.svc.HeadObject(&s3.HeadObjectInput{
+	svc, _ := s.client(context.Background(), s3Bucket)
+	resp, err := svc.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(s3Key),
 	})
@@ -106,6 +215,61 @@ func (s *S3Input) sizeS3File(fn string) (int64, error) {
 	return *resp.ContentLength, nil
 }
 
+// client returns the client to access the given bucket, and whether the
+// bucket is in another region than the default client. The region of each
+// bucket is resolved once, falling back to the default region in case of
+// error.
+func (s *S3Input) client(ctx context.Context, bucket string) (s3iface.S3API, bool) {
+	if s.newClient == nil {
+		return s.svc, false
+	}
+
+	s.mu.Lock()
+	region, ok := s.regions[bucket]
+	s.mu.Unlock()
+
+	// The region is resolved without holding the lock, so that a slow
+	// request doesn't block the accesses to the other buckets.
+	if !ok {
+		region = s.region
+		resp, err := s.svc.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"bucket": bucket, "region": region}).Warn("can't resolve bucket region, using the default one")
+		} else {
+			region = s3.NormalizeBucketLocation(aws.StringValue(resp.LocationConstraint))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the region resolved first, if it's been resolved concurrently.
+	if r, ok := s.regions[bucket]; ok {
+		region = r
+	} else {
+		s.regions[bucket] = region
+	}
+
+	if region == s.region {
+		return s.svc, false
+	}
+	svc, ok := s.clients[region]
+	if !ok {
+		svc = s.newClient(region)
+		s.clients[region] = svc
+	}
+	return svc, true
+}
+
+// Stats implements baker.Input.
+func (s *S3Input) Stats() baker.InputStats {
+	stats := s.CompressedInput.Stats()
+	stats.Metrics = &baker.MetricsBag{}
+	stats.Metrics.AddRawCounter("s3.cross_region_downloads", atomic.LoadInt64(&s.crossRegionn))
+	stats.Metrics.AddGauge("s3.inflight_files", float64(atomic.LoadInt64(&s.inflight)))
+	return stats
+}
+
 // Check if scheme is s3 or s3a or s3n
 func isValidScheme(scheme string) (bool, error) {
 	return regexp.MatchString(`^s3[an]?$`, scheme)
@@ -117,7 +281,7 @@ type errUnsupportedURLScheme string
 
 // Error implements the error interface.
 func (e errUnsupportedURLScheme) Error() string {
-	return fmt.Sprintf("%s unsupported, should be s3[a]://BUCKET/DIR_PATH/FILE_NAME or DIR_PATH/FILE_NAME (no scheme)", string(e))
+	return fmt.Sprintf("%s unsupported, should be s3[a|n]://BUCKET/DIR_PATH/FILE_NAME or DIR_PATH/FILE_NAME (no scheme)", string(e))
 }
 
 // If the path is a full s3/s3a/s3n url the extract the bucket, key and scheme from
@@ -1,9 +1,25 @@
 package inpututils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net/url"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 const DefaultS3Scheme = "s3"
@@ -75,3 +91,587 @@ func TestS3ListChoosePathComponentsErrType(t *testing.T) {
 		})
 	}
 }
+
+// fakeS3 is a fake S3 service, serving gzip-compressed objects from memory.
+type fakeS3 struct {
+	s3iface.S3API
+
+	objects map[string]string // uncompressed content, by bucket/key
+
+	locations map[string]string // location constraints, by bucket
+	located   map[string]int    // number of GetBucketLocation calls, by bucket
+}
+
+func (f *fakeS3) GetBucketLocationWithContext(_ aws.Context, in *s3.GetBucketLocationInput, _ ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	bucket := aws.StringValue(in.Bucket)
+	if f.located == nil {
+		f.located = make(map[string]int)
+	}
+	f.located[bucket]++
+
+	loc, ok := f.locations[bucket]
+	if !ok {
+		return nil, awserr.New("AccessDenied", "Access Denied", nil)
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: aws.String(loc)}, nil
+}
+
+func (f *fakeS3) object(bucket, key *string) ([]byte, error) {
+	content, ok := f.objects[aws.StringValue(bucket)+"/"+aws.StringValue(key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(content))
+	w.Close()
+	return buf.Bytes(), nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	obj, err := f.object(in.Bucket, in.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(obj)),
+		ContentLength: aws.Int64(int64(len(obj))),
+		LastModified:  aws.Time(time.Now()),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	obj, err := f.object(in.Bucket, in.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(obj)))}, nil
+}
+
+func TestS3InputFakeClient(t *testing.T) {
+	svc := &fakeS3{
+		objects: map[string]string{
+			"some-bucket/dir/a.gz": "a1\na2\n",
+			"some-bucket/dir/b.gz": "b1\nb2\nb3\n",
+		},
+	}
+
+	s := NewS3InputWithClient(svc, "some-bucket")
+	data := make(chan *baker.Data)
+	s.SetOutputChannel(data)
+
+	var (
+		wg    sync.WaitGroup
+		lines []string
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for d := range data {
+			if len(d.Bytes) == 0 {
+				continue
+			}
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(d.Bytes), "\n"), "\n")...)
+		}
+	}()
+
+	for _, fn := range []string{"dir/a.gz", "s3://some-bucket/dir/b.gz"} {
+		if err := s.ProcessFile(fn); err != nil {
+			t.Fatalf("ProcessFile(%q): %v", fn, err)
+		}
+	}
+	if err := s.ProcessFile("dir/missing.gz"); err == nil {
+		t.Errorf("ProcessFile(missing) = nil, want an error")
+	}
+	s.NoMoreFiles()
+	<-s.Done
+	close(data)
+	wg.Wait()
+
+	sort.Strings(lines)
+	if want := []string{"a1", "a2", "b1", "b2", "b3"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("records = %q, want %q", lines, want)
+	}
+}
+
+func TestS3InputMultipleBuckets(t *testing.T) {
+	svc := &fakeS3{
+		objects: map[string]string{
+			"bucket-a/dir/file.gz":      "a1\na2\n",
+			"bucket-b/dir/file 100%.gz": "b1\n",
+		},
+	}
+
+	s := NewS3InputWithClient(svc, "")
+	data := make(chan *baker.Data, 10)
+	s.SetOutputChannel(data)
+
+	for _, obj := range []struct{ bucket, key string }{
+		{"bucket-a", "dir/file.gz"},
+		{"bucket-b", "dir/file 100%.gz"},
+	} {
+		if err := s.ParseObject(context.Background(), obj.bucket, obj.key); err != nil {
+			t.Fatalf("ParseObject(%q, %q): %v", obj.bucket, obj.key, err)
+		}
+	}
+	close(data)
+
+	var lines []string
+	for d := range data {
+		if len(d.Bytes) != 0 {
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(d.Bytes), "\n"), "\n")...)
+		}
+	}
+	if want := []string{"a1", "a2", "b1"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("records = %q, want %q", lines, want)
+	}
+}
+
+func TestS3InputParseFileURL(t *testing.T) {
+	svc := &fakeS3{
+		objects: map[string]string{
+			"bucket-a/dir/file.gz":          "a1\n",
+			"configured-bucket/dir/file.gz": "c1\n",
+		},
+	}
+
+	// Whatever the configured bucket, the bucket of a full S3 URL is the one
+	// the file is downloaded from.
+	for _, bucket := range []string{"", "configured-bucket"} {
+		s := NewS3InputWithClient(svc, bucket)
+		data := make(chan *baker.Data, 10)
+		s.SetOutputChannel(data)
+
+		if err := s.ParseFile("s3n://bucket-a/dir/file.gz"); err != nil {
+			t.Fatalf("bucket %q: ParseFile: %v", bucket, err)
+		}
+		close(data)
+
+		var lines []string
+		for d := range data {
+			if len(d.Bytes) == 0 {
+				continue
+			}
+			lines = append(lines, strings.TrimSuffix(string(d.Bytes), "\n"))
+			if got := d.Meta[MetadataS3Bucket]; got != "bucket-a" {
+				t.Errorf("bucket %q: %s metadata = %v, want bucket-a", bucket, MetadataS3Bucket, got)
+			}
+			if got := d.Meta[MetadataS3Key]; got != "dir/file.gz" {
+				t.Errorf("bucket %q: %s metadata = %v, want dir/file.gz", bucket, MetadataS3Key, got)
+			}
+		}
+		if want := []string{"a1"}; !reflect.DeepEqual(lines, want) {
+			t.Errorf("bucket %q: records = %q, want %q", bucket, lines, want)
+		}
+	}
+}
+
+func TestS3InputCrossRegion(t *testing.T) {
+	west := &fakeS3{
+		objects: map[string]string{
+			"bucket-west/file.gz":    "w1\n",
+			"bucket-unknown/file.gz": "u1\n",
+		},
+		locations: map[string]string{
+			"bucket-west": "us-west-2",
+			"bucket-eu":   "EU",
+			"bucket-east": "",
+		},
+	}
+	regional := map[string]*fakeS3{
+		"eu-west-1": {objects: map[string]string{"bucket-eu/file.gz": "e1\n"}},
+		"us-east-1": {objects: map[string]string{"bucket-east/file.gz": "a1\n"}},
+	}
+
+	s := NewS3InputWithClient(west, "")
+	s.region = "us-west-2"
+	created := make(map[string]int)
+	s.newClient = func(region string) s3iface.S3API {
+		created[region]++
+		return regional[region]
+	}
+	data := make(chan *baker.Data, 20)
+	s.SetOutputChannel(data)
+
+	// The region of bucket-unknown can't be resolved, so the default client
+	// is used.
+	buckets := []string{"bucket-west", "bucket-eu", "bucket-east", "bucket-unknown", "bucket-eu", "bucket-east"}
+	for _, bucket := range buckets {
+		if err := s.ParseObject(context.Background(), bucket, "file.gz"); err != nil {
+			t.Fatalf("ParseObject(%q): %v", bucket, err)
+		}
+	}
+	close(data)
+
+	var lines []string
+	for d := range data {
+		if len(d.Bytes) != 0 {
+			lines = append(lines, strings.TrimSuffix(string(d.Bytes), "\n"))
+		}
+	}
+	if want := []string{"w1", "e1", "a1", "u1", "e1", "a1"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("records = %q, want %q", lines, want)
+	}
+
+	// Regions are resolved and clients created once.
+	for _, bucket := range buckets {
+		if n := west.located[bucket]; n != 1 {
+			t.Errorf("region of %s resolved %d times, want 1", bucket, n)
+		}
+	}
+	if want := map[string]int{"eu-west-1": 1, "us-east-1": 1}; !reflect.DeepEqual(created, want) {
+		t.Errorf("created clients = %v, want %v", created, want)
+	}
+
+	if n := s.Stats().Metrics.Get("c:s3.cross_region_downloads"); n != int64(4) {
+		t.Errorf("s3.cross_region_downloads = %v, want 4", n)
+	}
+}
+
+// slowLocationS3 is a fakeS3 whose GetBucketLocation blocks, for slow-bucket,
+// until released.
+type slowLocationS3 struct {
+	*fakeS3
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *slowLocationS3) GetBucketLocationWithContext(ctx aws.Context, in *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	if aws.StringValue(in.Bucket) == "slow-bucket" {
+		close(f.started)
+		<-f.release
+		return &s3.GetBucketLocationOutput{LocationConstraint: aws.String("EU")}, nil
+	}
+	return f.fakeS3.GetBucketLocationWithContext(ctx, in, opts...)
+}
+
+func TestS3InputSlowBucketLocation(t *testing.T) {
+	svc := &slowLocationS3{
+		fakeS3:  &fakeS3{locations: map[string]string{"bucket-eu": "EU"}},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s := NewS3InputWithClient(svc, "")
+	s.region = "us-west-2"
+	eu := &fakeS3{}
+	s.newClient = func(region string) s3iface.S3API { return eu }
+
+	if _, cross := s.client(context.Background(), "bucket-eu"); !cross {
+		t.Fatalf("bucket-eu client isn't cross-region")
+	}
+
+	slow := make(chan s3iface.S3API)
+	go func() {
+		svc, _ := s.client(context.Background(), "slow-bucket")
+		slow <- svc
+	}()
+	<-svc.started
+
+	// The client of a bucket whose region is known is returned while the
+	// region of slow-bucket is being resolved.
+	got := make(chan s3iface.S3API)
+	go func() {
+		svc, _ := s.client(context.Background(), "bucket-eu")
+		got <- svc
+	}()
+	select {
+	case svc := <-got:
+		if svc != eu {
+			t.Errorf("bucket-eu client = %v, want the eu-west-1 client", svc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client(bucket-eu) blocked by the resolution of another bucket region")
+	}
+
+	close(svc.release)
+	if svc := <-slow; svc != eu {
+		t.Errorf("slow-bucket client = %v, want the eu-west-1 client", svc)
+	}
+}
+
+// slowS3 is a fakeS3 whose downloads block until released, or aborted.
+type slowS3 struct {
+	*fakeS3
+	started chan struct{}
+	release chan struct{}
+	aborted chan struct{} // if not nil, signaled when a download is aborted
+}
+
+func (f *slowS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.started <- struct{}{}
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		if f.aborted != nil {
+			f.aborted <- struct{}{}
+		}
+		return nil, ctx.Err()
+	}
+	return f.fakeS3.GetObjectWithContext(ctx, in, opts...)
+}
+
+func TestS3InputInflightFiles(t *testing.T) {
+	svc := &slowS3{
+		fakeS3: &fakeS3{
+			objects: map[string]string{
+				"some-bucket/a.gz": "a1\n",
+				"some-bucket/b.gz": "b1\n",
+			},
+		},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	s := NewS3InputWithClient(svc, "some-bucket")
+	data := make(chan *baker.Data, 10)
+	s.SetOutputChannel(data)
+
+	inflight := func() interface{} { return s.Stats().Metrics.Get("g:s3.inflight_files") }
+
+	if n := inflight(); n != float64(0) {
+		t.Fatalf("s3.inflight_files = %v before any download, want 0", n)
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"a.gz", "b.gz"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := s.ParseObject(context.Background(), "some-bucket", key); err != nil {
+				t.Errorf("ParseObject(%q): %v", key, err)
+			}
+		}(key)
+	}
+	<-svc.started
+	<-svc.started
+
+	if n := inflight(); n != float64(2) {
+		t.Errorf("s3.inflight_files = %v during the downloads, want 2", n)
+	}
+
+	close(svc.release)
+	wg.Wait()
+
+	if n := inflight(); n != float64(0) {
+		t.Errorf("s3.inflight_files = %v after the downloads, want 0", n)
+	}
+}
+
+func TestS3InputReaderConcurrency(t *testing.T) {
+	const concurrency, nfiles = 2, 5
+
+	svc := &slowS3{
+		fakeS3:  &fakeS3{objects: make(map[string]string)},
+		started: make(chan struct{}, nfiles),
+		release: make(chan struct{}),
+	}
+	for i := 0; i < nfiles; i++ {
+		svc.objects[fmt.Sprintf("some-bucket/%d.gz", i)] = "line\n"
+	}
+
+	s := NewS3InputWithClient(svc, "some-bucket")
+	if err := s.SetReaderConcurrency(0); err == nil {
+		t.Errorf("SetReaderConcurrency(0) = nil, want an error")
+	}
+	if err := s.SetReaderConcurrency(concurrency); err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan *baker.Data, 2*nfiles)
+	s.SetOutputChannel(data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < nfiles; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := s.ParseObject(context.Background(), "some-bucket", key); err != nil {
+				t.Errorf("ParseObject(%q): %v", key, err)
+			}
+		}(fmt.Sprintf("%d.gz", i))
+	}
+
+	for i := 0; i < concurrency; i++ {
+		<-svc.started
+	}
+	// Give the other files a chance to start, which they shouldn't.
+	time.Sleep(50 * time.Millisecond)
+	if n := len(svc.started); n != 0 {
+		t.Errorf("%d more downloads started, want none", n)
+	}
+	if n := s.Stats().Metrics.Get("g:s3.inflight_files"); n != float64(concurrency) {
+		t.Errorf("s3.inflight_files = %v, want %d", n, concurrency)
+	}
+
+	close(svc.release)
+	wg.Wait()
+	if n := s.Stats().Metrics.Get("g:s3.inflight_files"); n != float64(0) {
+		t.Errorf("s3.inflight_files = %v after the downloads, want 0", n)
+	}
+}
+
+// collectLines reads the records sent to data until it's closed, and sets
+// lines to them once done.
+func collectLines(data <-chan *baker.Data, lines *[]string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for d := range data {
+		if len(d.Bytes) != 0 {
+			*lines = append(*lines, strings.Split(strings.TrimSuffix(string(d.Bytes), "\n"), "\n")...)
+		}
+	}
+}
+
+func TestS3InputReadahead(t *testing.T) {
+	const depth, nfiles = 2, 5
+
+	svc := &slowS3{
+		fakeS3:  &fakeS3{objects: make(map[string]string)},
+		started: make(chan struct{}, nfiles),
+		release: make(chan struct{}),
+	}
+	for i := 0; i < nfiles; i++ {
+		svc.objects[fmt.Sprintf("some-bucket/%d.gz", i)] = fmt.Sprintf("line%d\n", i)
+	}
+
+	s := NewS3InputWithClient(svc, "some-bucket")
+	if err := s.SetReadahead(0); err == nil {
+		t.Errorf("SetReadahead(0) = nil, want an error")
+	}
+	if err := s.SetReadahead(depth); err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan *baker.Data)
+	s.SetOutputChannel(data)
+
+	var (
+		wg    sync.WaitGroup
+		lines []string
+	)
+	wg.Add(1)
+	go collectLines(data, &lines, &wg)
+
+	for i := 0; i < nfiles; i++ {
+		if err := s.ProcessFile(fmt.Sprintf("%d.gz", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.NoMoreFiles()
+
+	for i := 0; i < depth; i++ {
+		<-svc.started
+	}
+	// Give the other files a chance to start, which they shouldn't.
+	time.Sleep(50 * time.Millisecond)
+	if n := len(svc.started); n != 0 {
+		t.Errorf("%d more downloads started, want at most %d files downloaded ahead", n, depth)
+	}
+
+	close(svc.release)
+	<-s.Done
+	close(data)
+	wg.Wait()
+
+	sort.Strings(lines)
+	if want := []string{"line0", "line1", "line2", "line3", "line4"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("records = %q, want %q", lines, want)
+	}
+}
+
+func TestS3InputReadaheadStop(t *testing.T) {
+	const depth = 2
+
+	svc := &slowS3{
+		fakeS3:  &fakeS3{objects: map[string]string{"some-bucket/a.gz": "a\n", "some-bucket/b.gz": "b\n", "some-bucket/c.gz": "c\n"}},
+		started: make(chan struct{}, 3),
+		release: make(chan struct{}),
+		aborted: make(chan struct{}, 3),
+	}
+
+	s := NewS3InputWithClient(svc, "some-bucket")
+	if err := s.SetReadahead(depth); err != nil {
+		t.Fatal(err)
+	}
+	s.SetOutputChannel(make(chan *baker.Data, 10))
+	for _, fn := range []string{"a.gz", "b.gz", "c.gz"} {
+		if err := s.ProcessFile(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < depth; i++ {
+		<-svc.started
+	}
+
+	// Stopping the input aborts the downloads in progress.
+	s.Stop()
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < depth; i++ {
+		select {
+		case <-svc.aborted:
+		case <-timeout:
+			t.Fatalf("%d downloads aborted by Stop, want %d", i, depth)
+		}
+	}
+	select {
+	case <-s.Done:
+	case <-timeout:
+		t.Fatalf("workers still running after Stop")
+	}
+}
+
+// latencyS3 is a fakeS3 whose downloads take some time to start.
+type latencyS3 struct {
+	*fakeS3
+	latency time.Duration
+}
+
+func (f *latencyS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	time.Sleep(f.latency)
+	return f.fakeS3.GetObjectWithContext(ctx, in, opts...)
+}
+
+func BenchmarkS3InputReadahead(b *testing.B) {
+	const nfiles = 50
+
+	svc := &latencyS3{fakeS3: &fakeS3{objects: make(map[string]string)}, latency: time.Millisecond}
+	for i := 0; i < nfiles; i++ {
+		svc.objects[fmt.Sprintf("some-bucket/%d.gz", i)] = strings.Repeat(fmt.Sprintf("a,b,c,%d\n", i), 100)
+	}
+
+	for _, depth := range []int{0, 1, 4, 16} {
+		name := "sequential"
+		if depth > 0 {
+			name = fmt.Sprintf("readahead=%d", depth)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// A single file is parsed at a time, so that, without readahead,
+				// each file is downloaded once the previous one is parsed.
+				s := NewS3InputWithClient(svc, "some-bucket")
+				if err := s.SetReaderConcurrency(1); err != nil {
+					b.Fatal(err)
+				}
+				if depth > 0 {
+					if err := s.SetReadahead(depth); err != nil {
+						b.Fatal(err)
+					}
+				}
+				data := make(chan *baker.Data, 16)
+				s.SetOutputChannel(data)
+				go func() {
+					for d := range data {
+						s.FreeMem(d)
+					}
+				}()
+
+				for f := 0; f < nfiles; f++ {
+					if err := s.ProcessFile(fmt.Sprintf("%d.gz", f)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				s.NoMoreFiles()
+				<-s.Done
+				close(data)
+			}
+		})
+	}
+}
@@ -231,7 +231,7 @@ func (k *KCL) Run(inch chan<- *baker.Data) error {
 
 // Stats implements baker.Input
 func (k *KCL) Stats() baker.InputStats {
-	bag := make(baker.MetricsBag)
+	bag := &baker.MetricsBag{}
 	bag.AddGauge("kcl.shards", float64(atomic.LoadInt64(&k.nshards)))
 
 	return baker.InputStats{
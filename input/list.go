@@ -48,6 +48,16 @@ var ListDesc = baker.InputDesc{
 		"    walked, and all files matching the \"MatchPath\" option regexp will be processed as logfiles\n" +
 		"  * \"-\": the contents of a log file will be read from stdin and processed\n" +
 		"  * \"@-\": each line read from stdin will be parsed as a \"file specifier\"\n\n" +
+		"When walking directories, MinTimestamp and MaxTimestamp can be used to only process the\n" +
+		"files whose last modification time is within a time window, for example to backfill the\n" +
+		"logs written to a S3 prefix during a given period.\n\n" +
+		"If CheckpointFile is provided, the files completely read are periodically saved to it,\n" +
+		"and skipped when the input is restarted, so that a long backfill resumes where it\n" +
+		"stopped. Since a file is completed once its records have been sent to the filters, the\n" +
+		"records still in the topology when the process is killed are lost.\n\n" +
+		"With Readahead, the next files are downloaded while the records of the current one are\n" +
+		"being processed, which improves the throughput when reading many small files from S3 or\n" +
+		"HTTP. Up to Readahead files are then kept in memory.\n\n" +
 		"All records produced by this input contain 2 metadata values:\n" +
 		"  * url: the files that originally contained the record\n" +
 		"  * last_modified: the last modification datetime of the above file\n",
@@ -59,6 +69,15 @@ type ListConfig struct {
 	Files     []string `help:"List of log-files, directories and/or list-files to process" default:"[\"-\"]"`
 	MatchPath string   `help:"regexp to filter files in specified directories" default:".*\\.log\\.gz"`
 	Region    string   `help:"AWS Region for fetching from S3" default:"us-west-2"`
+
+	MinTimestamp string `help:"If provided (RFC3339), files found in directories and modified before that time are skipped"`
+	MaxTimestamp string `help:"If provided (RFC3339), files found in directories and modified after that time are skipped"`
+
+	CheckpointFile     string        `help:"If provided, local path or S3 URL of the file in which the completely read files are saved, so that they're skipped after a restart"`
+	CheckpointInterval time.Duration `help:"How often the completely read files are saved to CheckpointFile" default:"10s"`
+
+	Compression string `help:"If provided, decompressor of all the files (gzip, zstd, bzip2 or lz4), instead of choosing it by file suffix (.gz, .zst, .bz2, .lz4, gzip otherwise)"`
+	Readahead   int    `help:"Number of files downloaded ahead of their parsing, to hide the latency of many small remote files. The downloaded files are buffered in memory. 0:disabled" default:"0"`
 }
 
 func (cfg *ListConfig) fillDefaults() {
@@ -73,6 +92,10 @@ func (cfg *ListConfig) fillDefaults() {
 	if len(cfg.Files) == 0 {
 		cfg.Files = []string{"-"}
 	}
+
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = 10 * time.Second
+	}
 }
 
 type List struct {
@@ -82,6 +105,15 @@ type List struct {
 	matchPath *regexp.Regexp
 	fatalErr  atomic.Value
 	stopOnce  sync.Once
+
+	window timeWindow // time window of the files found in directories
+
+	checkpoint *listCheckpoint // completed files, if CheckpointFile is set
+
+	discoveredn int64 // number of files found in directories, matching MatchPath
+	skippedn    int64 // number of files skipped because of the time window
+	processedn  int64 // number of files enqueued for processing
+	checkpointn int64 // number of files skipped because they were completed before a restart
 }
 
 func (s *List) openFile(fn string, sizeOnly bool) (io.ReadCloser, int64, time.Time, *url.URL, error) {
@@ -156,12 +188,34 @@ func (s *List) openFile(fn string, sizeOnly bool) (io.ReadCloser, int64, time.Ti
 func (s *List) ProcessDirectory(dir string, matchPath *regexp.Regexp) error {
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err == nil && matchPath.MatchString(path) {
-			s.ci.ProcessFile(path)
+			s.processFile(path)
 		}
 		return nil
 	})
 }
 
+// processDirFile enqueues a file found in a directory for processing, if its
+// last modification time is within the configured time window.
+func (s *List) processDirFile(path string, lastModified time.Time) {
+	atomic.AddInt64(&s.discoveredn, 1)
+	if !s.window.contains(lastModified) {
+		atomic.AddInt64(&s.skippedn, 1)
+		return
+	}
+	s.processFile(path)
+}
+
+// processFile enqueues a file for processing, unless it's been completed
+// before a restart.
+func (s *List) processFile(path string) {
+	if s.checkpoint != nil && s.checkpoint.Contains(path) {
+		atomic.AddInt64(&s.checkpointn, 1)
+		return
+	}
+	atomic.AddInt64(&s.processedn, 1)
+	s.ci.ProcessFile(path)
+}
+
 func NewList(cfg baker.InputParams) (baker.Input, error) {
 	inpututils.SetGCPercentIfNotSet(800)
 
@@ -186,12 +240,59 @@ func NewList(cfg baker.InputParams) (baker.Input, error) {
 		return sz, err
 	}
 
+	var err error
+	if l.window, err = parseTimeWindow(dcfg.MinTimestamp, dcfg.MaxTimestamp); err != nil {
+		return nil, fmt.Errorf("List: %v", err)
+	}
+	if err := inpututils.ValidateCompression(dcfg.Compression); err != nil {
+		return nil, fmt.Errorf("List: Compression: %v", err)
+	}
+	if dcfg.CheckpointInterval < 0 {
+		return nil, fmt.Errorf("List: CheckpointInterval must be positive, got %v", dcfg.CheckpointInterval)
+	}
+	if dcfg.Readahead < 0 {
+		return nil, fmt.Errorf("List: Readahead must be positive, got %d", dcfg.Readahead)
+	}
+	if dcfg.CheckpointFile != "" {
+		if l.checkpoint, err = newListCheckpoint(dcfg.CheckpointFile, s3end); err != nil {
+			return nil, fmt.Errorf("List: CheckpointFile: %v", err)
+		}
+	}
+
 	l.ci = inpututils.NewCompressedInput(opener, sizer, make(chan bool, 1))
+	l.ci.FileMetadata = fileMetadata
+	l.ci.Compression = dcfg.Compression
+	l.ci.Tracer = cfg.Tracer
+	if dcfg.Readahead > 0 {
+		if err := l.ci.SetReadahead(dcfg.Readahead); err != nil {
+			return nil, fmt.Errorf("List: Readahead: %v", err)
+		}
+	}
+	if l.checkpoint != nil {
+		l.ci.FileDone = func(fn string, err error) {
+			if err == nil {
+				l.checkpoint.Add(fn)
+			}
+		}
+	}
 	l.matchPath = regexp.MustCompile(dcfg.MatchPath)
 
 	return l, nil
 }
 
+// fileMetadata returns the S3 location of file fn, as metadata, if it's a S3
+// URL.
+func fileMetadata(fn string) baker.Metadata {
+	u, err := url.Parse(fn)
+	if err != nil || u.Scheme != "s3" {
+		return nil
+	}
+	return baker.Metadata{
+		inpututils.MetadataS3Bucket: u.Host,
+		inpututils.MetadataS3Key:    strings.TrimPrefix(u.Path, "/"),
+	}
+}
+
 // Set this error as fatal: it will make List stop doing any processing,
 // and Run() will report this error as return value
 func (s *List) setFatalErr(err error) {
@@ -267,8 +368,8 @@ func (s *List) processList(fn string) error {
 			return err
 		} else if fi.IsDir() {
 			return filepath.Walk(u.Path, func(path string, info os.FileInfo, err error) error {
-				if err == nil && s.matchPath.MatchString(path) {
-					s.ci.ProcessFile(path)
+				if err == nil && !info.IsDir() && s.matchPath.MatchString(path) {
+					s.processDirFile(path, info.ModTime())
 				}
 				return nil
 			})
@@ -286,11 +387,11 @@ func (s *List) processList(fn string) error {
 			// ListObjectsV2Input prefix must not start with /
 			prefix := strings.TrimLeft(u.Path, "/")
 
-			paths := make(chan string)
+			objs := make(chan *s3.Object)
 			errCh := make(chan error)
 
 			go func() {
-				defer close(paths)
+				defer close(objs)
 
 				var nextToken *string
 				input := &s3.ListObjectsV2Input{
@@ -309,10 +410,16 @@ func (s *List) processList(fn string) error {
 						return
 					}
 
+					// Objects are sent one at a time, so that only a page
+					// of the listing is kept in memory.
 					for _, obj := range resp.Contents {
-						path := *obj.Key
-						if s.matchPath.MatchString(path) {
-							paths <- path
+						if !s.matchPath.MatchString(*obj.Key) {
+							continue
+						}
+						select {
+						case objs <- obj:
+						case <-s.ci.Done:
+							return
 						}
 					}
 
@@ -327,11 +434,11 @@ func (s *List) processList(fn string) error {
 				select {
 				case err := <-errCh:
 					return err
-				case line, ok := <-paths:
+				case obj, ok := <-objs:
 					if !ok {
 						return nil
 					}
-					s.ci.ProcessFile(fmt.Sprintf("s3://%s/%s", u.Host, line))
+					s.processDirFile(fmt.Sprintf("s3://%s/%s", u.Host, *obj.Key), aws.TimeValue(obj.LastModified))
 				case <-s.ci.Done:
 					return nil
 				}
@@ -372,12 +479,15 @@ func (s *List) processFileOrList(f string) {
 		}
 	} else {
 		// Regular file, just enqueue for processing
-		s.ci.ProcessFile(f)
+		s.processFile(f)
 	}
 }
 
 func (s *List) Run(inch chan<- *baker.Data) error {
 	s.ci.SetOutputChannel(inch)
+	if s.checkpoint != nil {
+		s.checkpoint.start(s.Cfg.CheckpointInterval)
+	}
 
 	for _, f := range s.Cfg.Files {
 		s.processFileOrList(f)
@@ -396,6 +506,12 @@ func (s *List) Run(inch chan<- *baker.Data) error {
 	s.ci.NoMoreFiles()
 	<-s.ci.Done
 
+	if s.checkpoint != nil {
+		if err := s.checkpoint.stop(); err != nil {
+			log.WithError(err).Error("can't save List checkpoint")
+		}
+	}
+
 	log.WithFields(log.Fields{"f": "List.Run"}).Info("terminating")
 	if ferr := s.fatalErr.Load(); ferr != nil {
 		return ferr.(error)
@@ -408,7 +524,22 @@ func (s *List) FreeMem(data *baker.Data) {
 }
 
 func (s *List) Stats() baker.InputStats {
-	return s.ci.Stats()
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("list.discovered_files", atomic.LoadInt64(&s.discoveredn))
+	bag.AddRawCounter("list.processed_files", atomic.LoadInt64(&s.processedn))
+	if s.window.isSet() {
+		bag.AddRawCounter("list.skipped_by_time", atomic.LoadInt64(&s.skippedn))
+	}
+	if s.checkpoint != nil {
+		bag.AddRawCounter("list.skipped_by_checkpoint", atomic.LoadInt64(&s.checkpointn))
+	}
+
+	stats := s.ci.Stats()
+	if stats.Metrics == nil {
+		stats.Metrics = &baker.MetricsBag{}
+	}
+	stats.Metrics.Merge(bag)
+	return stats
 }
 
 func (s *List) Stop() {
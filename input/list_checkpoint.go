@@ -0,0 +1,213 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	log "github.com/sirupsen/logrus"
+)
+
+// listCheckpoint remembers the files completely read by a List input, and
+// saves them to a local file or a S3 object, one per line, so that they're
+// skipped after a restart.
+type listCheckpoint struct {
+	mu    sync.Mutex
+	done  map[string]struct{}
+	files []string // completed files, in completion order
+	dirty bool     // files have been completed since the last save
+
+	saveMu sync.Mutex // serializes the saves
+	read   func() (io.ReadCloser, error)
+	write  func(buf []byte) error
+
+	stopc chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newListCheckpoint creates a checkpoint saved at location, a local path or
+// a S3 URL, and loads the files already completed, if any.
+func newListCheckpoint(location string, svc s3iface.S3API) (*listCheckpoint, error) {
+	c := &listCheckpoint{
+		done:  make(map[string]struct{}),
+		stopc: make(chan struct{}),
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		c.read = func() (io.ReadCloser, error) {
+			f, err := os.Open(u.Path)
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return f, err
+		}
+		c.write = func(buf []byte) error { return writeFileAtomic(u.Path, buf) }
+	case "s3":
+		key := strings.TrimPrefix(u.Path, "/")
+		c.read = func() (io.ReadCloser, error) {
+			resp, err := svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(u.Host),
+				Key:    aws.String(key),
+			})
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		}
+		// S3 objects are replaced atomically.
+		c.write = func(buf []byte) error {
+			_, err := svc.PutObject(&s3.PutObjectInput{
+				Bucket: aws.String(u.Host),
+				Key:    aws.String(key),
+				Body:   bytes.NewReader(buf),
+			})
+			return err
+		}
+	default:
+		return nil, fmt.Errorf("unknown scheme: %q", u.Scheme)
+	}
+
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("can't read %s: %v", location, err)
+	}
+	return c, nil
+}
+
+func (c *listCheckpoint) load() error {
+	r, err := c.read()
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if fn := scanner.Text(); fn != "" {
+			c.add(fn)
+		}
+	}
+	c.dirty = false
+	return scanner.Err()
+}
+
+// Contains reports whether file fn has been completed.
+func (c *listCheckpoint) Contains(fn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.done[fn]
+	return ok
+}
+
+// Add records that file fn has been completed.
+func (c *listCheckpoint) Add(fn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(fn)
+}
+
+func (c *listCheckpoint) add(fn string) {
+	if _, ok := c.done[fn]; ok {
+		return
+	}
+	c.done[fn] = struct{}{}
+	c.files = append(c.files, fn)
+	c.dirty = true
+}
+
+// Save saves the completed files, if some have been added since the last
+// save.
+func (c *listCheckpoint) Save() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, fn := range c.files {
+		buf.WriteString(fn)
+		buf.WriteByte('\n')
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	if err := c.write(buf.Bytes()); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// start saves the checkpoint every interval, until stop is called.
+func (c *listCheckpoint) start(interval time.Duration) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := c.Save(); err != nil {
+					log.WithError(err).Error("can't save List checkpoint")
+				}
+			case <-c.stopc:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the periodic saves and saves the checkpoint a last time.
+func (c *listCheckpoint) stop() error {
+	close(c.stopc)
+	c.wg.Wait()
+	return c.Save()
+}
+
+// writeFileAtomic writes buf to file path, through a temporary file renamed
+// to path so that path is never partially written.
+func writeFileAtomic(path string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
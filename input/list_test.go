@@ -8,8 +8,13 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -21,9 +26,11 @@ import (
 
 	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/testutil"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 func randomLogLine() baker.Record {
@@ -392,3 +399,363 @@ func mockS3Service(t *testing.T, generatedFiles, generatedRecords int, getManife
 
 	return svc, len(buf), &counter
 }
+
+func TestListS3FolderTimeWindow(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	t0 := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// The listing is returned in 3 pages of 4 objects, one modified every
+	// hour starting from t0.
+	const pages, perPage = 3, 4
+	var (
+		mu       sync.Mutex
+		listed   int
+		gotFiles []string
+	)
+	lastModified := func(key string) time.Time {
+		var i int
+		fmt.Sscanf(strings.TrimPrefix(key, "/"), "path-prefix/file-%d.log.zst", &i)
+		return t0.Add(time.Duration(i) * time.Hour)
+	}
+	record := zstd.Compress(nil, []byte("a,b,c\n"))
+
+	svc := s3.New(unit.Session)
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.UnmarshalError.Clear()
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		r.HTTPResponse = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		switch data := r.Data.(type) {
+		case *s3.ListObjectsV2Output:
+			page := 0
+			if tok := r.Params.(*s3.ListObjectsV2Input).ContinuationToken; tok != nil {
+				page, _ = strconv.Atoi(*tok)
+			}
+			listed++
+			for i := page * perPage; i < (page+1)*perPage; i++ {
+				key := fmt.Sprintf("path-prefix/file-%d.log.zst", i)
+				data.Contents = append(data.Contents, &s3.Object{
+					Key:          aws.String(key),
+					LastModified: aws.Time(lastModified(key)),
+				})
+			}
+			data.IsTruncated = aws.Bool(page < pages-1)
+			data.NextContinuationToken = aws.String(strconv.Itoa(page + 1))
+
+		case *s3.HeadObjectOutput:
+			key := *r.Params.(*s3.HeadObjectInput).Key
+			data.ContentLength = aws.Int64(int64(len(record)))
+			data.LastModified = aws.Time(lastModified(key))
+
+		case *s3.GetObjectOutput:
+			key := *r.Params.(*s3.GetObjectInput).Key
+			gotFiles = append(gotFiles, key)
+			data.ContentLength = aws.Int64(int64(len(record)))
+			data.LastModified = aws.Time(lastModified(key))
+			data.Body = ioutil.NopCloser(bytes.NewReader(record))
+		}
+	})
+
+	cfg := baker.InputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &ListConfig{
+				Files:        []string{"@s3://bucket-name/path-prefix/"},
+				MatchPath:    ".*\\.log\\.zst",
+				MinTimestamp: t0.Add(3 * time.Hour).Format(time.RFC3339),
+				MaxTimestamp: t0.Add(9 * time.Hour).Format(time.RFC3339),
+			},
+		},
+	}
+	list, err := NewList(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list.(*List).svc = svc
+
+	ch := make(chan *baker.Data)
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+	if err := list.Run(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	<-done
+
+	if listed != pages {
+		t.Errorf("ListObjectsV2 called %d times, want %d", listed, pages)
+	}
+
+	// Only files 3 to 9 (included) are within the time window.
+	want := map[string]bool{}
+	for i := 3; i <= 9; i++ {
+		want[fmt.Sprintf("/path-prefix/file-%d.log.zst", i)] = true
+	}
+	got := map[string]bool{}
+	for _, f := range gotFiles {
+		got[f] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processed files = %v, want %v", got, want)
+	}
+
+	metrics := list.Stats().Metrics
+	for name, want := range map[string]int64{
+		"c:list.discovered_files": pages * perPage,
+		"c:list.processed_files":  7,
+		"c:list.skipped_by_time":  pages*perPage - 7,
+	} {
+		if got := metrics.Get(name); got != want {
+			t.Errorf("%s = %v, want %d", name, got, want)
+		}
+	}
+}
+
+func TestListInvalidTimeWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max string
+	}{
+		{name: "invalid min", min: "yesterday"},
+		{name: "invalid max", max: "2020-06-01"},
+		{name: "max before min", min: "2020-06-02T00:00:00Z", max: "2020-06-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := baker.InputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &ListConfig{MinTimestamp: tt.min, MaxTimestamp: tt.max},
+				},
+			}
+			if _, err := NewList(cfg); err == nil {
+				t.Error("NewList: got no error")
+			}
+		})
+	}
+}
+
+func TestListCheckpoint(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	makeTestLog(t, dir, "a.log.gz", 10)
+	makeTestLog(t, dir, "b.log.gz", 20)
+	makeTestLog(t, dir, "c.log.gz", 30)
+
+	// d.log.gz is served over HTTP, and its content is held back until
+	// release is closed, so that the first run can't complete it.
+	d, err := ioutil.ReadFile(makeTestLog(t, dir, "d.log.gz", 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(d)
+	}))
+	defer srv.Close()
+
+	manifest := filepath.Join(dir, "manifest")
+	files := []string{dir + "/a.log.gz", dir + "/b.log.gz", dir + "/c.log.gz", srv.URL + "/d.log.gz"}
+	if err := ioutil.WriteFile(manifest, []byte(strings.Join(files, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(checkpoint string) (baker.Input, chan error, *int64) {
+		t.Helper()
+		in, err := NewList(baker.InputParams{
+			ComponentParams: baker.ComponentParams{
+				DecodedConfig: &ListConfig{
+					Files:              []string{"@" + manifest},
+					CheckpointFile:     checkpoint,
+					CheckpointInterval: 10 * time.Millisecond,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan *baker.Data)
+		lines := new(int64)
+		go func() {
+			for data := range ch {
+				atomic.AddInt64(lines, int64(bytes.Count(data.Bytes, []byte{'\n'})))
+				in.FreeMem(data)
+			}
+		}()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- in.Run(ch)
+			close(ch)
+		}()
+		return in, errc, lines
+	}
+
+	// Wait for the first run to save the local files as completed, then
+	// simulate a crash by restarting from the checkpoint as it is on disk.
+	checkpoint := filepath.Join(dir, "checkpoint")
+	_, errc, _ := run(checkpoint)
+	want := strings.Join(files[:3], "\n") + "\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf, _ := ioutil.ReadFile(checkpoint)
+		if sortedLines(string(buf)) == sortedLines(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("checkpoint = %q, want %q", buf, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	crashed := filepath.Join(dir, "crashed")
+	if err := os.Rename(checkpoint, crashed); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	in, errc, lines := run(crashed)
+	if err := <-errc; err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if got := atomic.LoadInt64(lines); got != 40 {
+		t.Errorf("second run read %d lines, want the 40 lines of d.log.gz", got)
+	}
+	if got := in.Stats().Metrics.Get("c:list.skipped_by_checkpoint"); got != int64(3) {
+		t.Errorf("list.skipped_by_checkpoint = %v, want 3", got)
+	}
+	buf, err := ioutil.ReadFile(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedLines(string(buf)), sortedLines(strings.Join(files, "\n")); got != want {
+		t.Errorf("checkpoint after the second run = %q, want %q", got, want)
+	}
+}
+
+// sortedLines returns the non-empty lines of s, sorted.
+func sortedLines(s string) string {
+	lines := strings.Fields(s)
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// checkpointS3 is a fake S3 client storing the objects written by a
+// listCheckpoint in memory.
+type checkpointS3 struct {
+	s3iface.S3API
+	objects map[string]string // "bucket/key" -> content
+}
+
+func (c *checkpointS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	obj, ok := c.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(obj))}, nil
+}
+
+func (c *checkpointS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	buf, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.objects[*in.Bucket+"/"+*in.Key] = string(buf)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestListCheckpointS3(t *testing.T) {
+	svc := &checkpointS3{objects: map[string]string{
+		"bucket/path/to/checkpoint": "s3://bucket/a.log.gz\n",
+	}}
+
+	c, err := newListCheckpoint("s3://bucket/path/to/checkpoint", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Contains("s3://bucket/a.log.gz") {
+		t.Errorf("the checkpoint doesn't contain the file loaded from S3")
+	}
+	c.Add("s3://bucket/b.log.gz")
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bucket/path/to/checkpoint": "s3://bucket/a.log.gz\ns3://bucket/b.log.gz\n",
+	}
+	if !reflect.DeepEqual(svc.objects, want) {
+		t.Errorf("S3 objects = %q, want %q", svc.objects, want)
+	}
+}
+
+func TestListCheckpointConfig(t *testing.T) {
+	for name, cfg := range map[string]*ListConfig{
+		"negative interval": {CheckpointFile: filepath.Join(t.TempDir(), "checkpoint"), CheckpointInterval: -time.Second},
+		"unknown scheme":    {CheckpointFile: "ftp://host/checkpoint"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewList(baker.InputParams{ComponentParams: baker.ComponentParams{DecodedConfig: cfg}})
+			if err == nil || !strings.Contains(err.Error(), "Checkpoint") {
+				t.Errorf("NewList error = %v, want a Checkpoint error", err)
+			}
+		})
+	}
+}
+
+func TestListReadahead(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("test%d.log.gz", i)
+		makeTestLog(t, dir, name, 10*i)
+		files = append(files, filepath.Join(dir, name))
+	}
+
+	if _, err := NewList(baker.InputParams{ComponentParams: baker.ComponentParams{
+		DecodedConfig: &ListConfig{Files: files, Readahead: -1},
+	}}); err == nil {
+		t.Errorf("NewList with a negative Readahead: want an error")
+	}
+
+	list, err := NewList(baker.InputParams{ComponentParams: baker.ComponentParams{
+		DecodedConfig: &ListConfig{Files: files, Readahead: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *baker.Data)
+	var lines int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for data := range ch {
+			lines += bytes.Count(data.Bytes, []byte{'\n'})
+		}
+	}()
+	if err := list.Run(ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	<-done
+
+	if lines != 150 {
+		t.Errorf("got %d lines, want 150", lines)
+	}
+}
@@ -0,0 +1,357 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inpututils"
+)
+
+var PubSubDesc = baker.InputDesc{
+	Name:   "PubSub",
+	New:    NewPubSub,
+	Config: &PubSubConfig{},
+	Help: "This input listens on a Google Cloud Pub/Sub subscription for new incoming log files in\n" +
+		"Google Cloud Storage, like the SQS input does for S3 files: the subscription's topic receives\n" +
+		"the notifications of a bucket, and the OBJECT_FINALIZE notifications are processed.\n" +
+		"The objects are read like the S3 files (gzip or zstd compressed) and the messages are\n" +
+		"acknowledged once their object has been processed. Messages that can't be parsed are\n" +
+		"logged, counted in pubsub.parse_errors and acknowledged, so that they aren't delivered again.\n" +
+		"Requests are authenticated with an OAuth2 access token, either given in the configuration\n" +
+		"or obtained from the metadata server of the instance (Compute Engine, GKE...).\n" +
+		"It never exits.\n",
+}
+
+type PubSubConfig struct {
+	ProjectID       string        `help:"ID of the Google Cloud project of the subscription" required:"true"`
+	Subscription    string        `help:"Name of the subscription to pull notifications from" required:"true"`
+	Bucket          string        `help:"If provided, only the objects of this bucket are processed, the notifications of the other buckets are acknowledged and ignored"`
+	AccessToken     string        `help:"OAuth2 access token. Defaults to the GOOGLE_OAUTH_ACCESS_TOKEN environment variable, or to the tokens of the default service account given by the metadata server"`
+	PubSubEndpoint  string        `help:"If provided, URL of the Pub/Sub service (e.g. the emulator), instead of https://pubsub.googleapis.com"`
+	StorageEndpoint string        `help:"If provided, URL of the Cloud Storage service, instead of https://storage.googleapis.com"`
+	FilePathFilter  string        `help:"If provided, will only use the objects whose name matches this regular expression"`
+	PollWorkers     int           `help:"Number of workers concurrently pulling the subscription" default:"1"`
+	AckDeadline     time.Duration `help:"Time given to process the object of a received message before the message is delivered again. Between 10s and 10m" default:"5m"`
+	BacklogInterval time.Duration `help:"Interval between 2 queries of the subscription backlog to Cloud Monitoring, reported in the pubsub.backlog gauge. A negative interval disables the backlog gauge" default:"1m"`
+}
+
+func (cfg *PubSubConfig) fillDefaults() {
+	if cfg.AccessToken == "" {
+		cfg.AccessToken = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	if cfg.PubSubEndpoint == "" {
+		cfg.PubSubEndpoint = "https://pubsub.googleapis.com"
+	}
+	if cfg.StorageEndpoint == "" {
+		cfg.StorageEndpoint = "https://storage.googleapis.com"
+	}
+	if cfg.PollWorkers <= 0 {
+		cfg.PollWorkers = 1
+	}
+	if cfg.AckDeadline == 0 {
+		cfg.AckDeadline = 5 * time.Minute
+	}
+	if cfg.BacklogInterval == 0 {
+		cfg.BacklogInterval = time.Minute
+	}
+}
+
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *PubSubConfig) ValidateConfig(func(string) (baker.FieldIndex, bool)) error {
+	if _, err := regexp.Compile(cfg.FilePathFilter); err != nil {
+		return fmt.Errorf("FilePathFilter: %v", err)
+	}
+	if cfg.PollWorkers < 0 {
+		return fmt.Errorf("PollWorkers: must be positive, got %d", cfg.PollWorkers)
+	}
+	if cfg.AckDeadline != 0 && (cfg.AckDeadline < 10*time.Second || cfg.AckDeadline > 10*time.Minute) {
+		return fmt.Errorf("AckDeadline: must be between 10s and 10m, got %v", cfg.AckDeadline)
+	}
+	return nil
+}
+
+// PubSub is an input reading the GCS objects notified on a Pub/Sub
+// subscription.
+type PubSub struct {
+	Cfg            *PubSubConfig
+	FilePathRegexp *regexp.Regexp
+
+	sub     pubsubClient // an interface, so that tests can use a fake subscription
+	objects *inpututils.CompressedInput
+	done    chan struct{}
+
+	// sleep waits for the given duration, unless ctx is done. If nil, it
+	// defaults to a timer.
+	sleep func(ctx context.Context, d time.Duration)
+
+	receivedn    int64 // number of received messages
+	ackedn       int64 // number of acknowledged messages
+	ignoredn     int64 // number of acknowledged messages that weren't about a new object to process
+	parseErrorsn int64 // number of messages that couldn't be parsed
+	ackErrorsn   int64 // number of failed acknowledgements
+	failedn      int64 // number of messages not acknowledged because their object couldn't be processed
+	backlog      int64 // last known number of undelivered messages of the subscription
+}
+
+func NewPubSub(cfg baker.InputParams) (baker.Input, error) {
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &PubSubConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*PubSubConfig)
+	if err := dcfg.ValidateConfig(nil); err != nil {
+		return nil, err
+	}
+	dcfg.fillDefaults()
+
+	tokens := &gcpTokenSource{static: dcfg.AccessToken, metadataURL: gcpMetadataTokenURL, client: http.DefaultClient}
+	sub := &pubsubSubscription{
+		pubsub:     &gcpService{endpoint: dcfg.PubSubEndpoint, tokens: tokens, client: http.DefaultClient},
+		monitoring: &gcpService{endpoint: "https://monitoring.googleapis.com", tokens: tokens, client: http.DefaultClient},
+		project:    dcfg.ProjectID,
+		name:       dcfg.Subscription,
+	}
+	storage := &gcsStorage{svc: &gcpService{endpoint: dcfg.StorageEndpoint, tokens: tokens, client: http.DefaultClient}}
+
+	return newPubSub(dcfg, sub, storage)
+}
+
+// newPubSub returns a PubSub input receiving the messages of sub and reading
+// the objects of storage.
+func newPubSub(cfg *PubSubConfig, sub pubsubClient, storage inpututils.BlobReader) (*PubSub, error) {
+	var re *regexp.Regexp
+	if cfg.FilePathFilter != "" {
+		var err error
+		re, err = regexp.Compile(cfg.FilePathFilter)
+		if err != nil {
+			return nil, fmt.Errorf("FilePathFilter: %v", err)
+		}
+	}
+
+	objects := inpututils.NewBlobInput(storage)
+	objects.FileMetadata = func(path string) baker.Metadata {
+		bucket, object, err := parseGCSPath(path)
+		if err != nil {
+			return nil
+		}
+		return baker.Metadata{inpututils.MetadataGCSBucket: bucket, inpututils.MetadataGCSObject: object}
+	}
+
+	return &PubSub{
+		Cfg:            cfg,
+		FilePathRegexp: re,
+		sub:            sub,
+		objects:        objects,
+		done:           make(chan struct{}),
+		backlog:        -1,
+	}, nil
+}
+
+// wait waits for d and returns false if ctx is done.
+func (p *PubSub) wait(ctx context.Context, d time.Duration) bool {
+	if p.sleep != nil {
+		p.sleep(ctx, d)
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pollWorker pulls the subscription as long as the given context is alive.
+func (p *PubSub) pollWorker(ctx context.Context) {
+	ctxLog := log.WithFields(log.Fields{"f": "PubSub.pollWorker", "subscription": p.Cfg.Subscription})
+
+	b := &backoff.Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2, Jitter: true}
+	for ctx.Err() == nil {
+		err := p.poll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ctxLog.WithError(err).Error("error pulling messages")
+			p.wait(ctx, b.Duration())
+			continue
+		}
+		b.Reset()
+	}
+}
+
+// poll pulls a message from the subscription, once, and processes it. Pull
+// requests wait for messages, so there's no need to wait between 2 polls.
+func (p *PubSub) poll(ctx context.Context) error {
+	ctxLog := log.WithFields(log.Fields{"f": "PubSub.poll", "subscription": p.Cfg.Subscription})
+
+	// Pull only 1 message at a time, for the same reason as the SQS input:
+	// its object could take a while to process, and other messages would
+	// wait for their ack deadline in the meantime.
+	msgs, err := p.sub.Pull(ctx, 1)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&p.receivedn, int64(len(msgs)))
+
+	fctx := inpututils.ContextWithMetadata(ctx, baker.Metadata{inpututils.MetadataPubSubSubscription: p.Cfg.Subscription})
+	for _, msg := range msgs {
+		mlog := ctxLog.WithField("id", msg.ID)
+		path, err := p.parseMessage(msg)
+		switch {
+		case err != nil:
+			// A message that can't be parsed never will be, acknowledge it
+			// rather than having it delivered again after each ack deadline.
+			atomic.AddInt64(&p.parseErrorsn, 1)
+			mlog.WithError(err).Error("error parsing message, acknowledging it")
+		case path == "":
+			atomic.AddInt64(&p.ignoredn, 1)
+		default:
+			// The default ack deadline of a subscription is as short as
+			// 10s, extend it for the time it takes to read the object.
+			if err := p.sub.ModifyAckDeadline(ctx, p.Cfg.AckDeadline, msg.AckID); err != nil {
+				mlog.WithError(err).Warn("error extending message ack deadline")
+			}
+			if err := p.objects.ParseFileContext(fctx, path); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				// Only acknowledge the message once its object has been
+				// entirely read, otherwise it's delivered again after the ack
+				// deadline.
+				atomic.AddInt64(&p.failedn, 1)
+				mlog.WithError(err).WithField("object", path).Error("not acknowledging message, its object couldn't be processed")
+				continue
+			}
+		}
+
+		if err := p.sub.Acknowledge(ctx, msg.AckID); err != nil {
+			atomic.AddInt64(&p.ackErrorsn, 1)
+			mlog.WithError(err).Error("error acknowledging message")
+			continue
+		}
+		atomic.AddInt64(&p.ackedn, 1)
+	}
+	return nil
+}
+
+// parseMessage returns the gs:// path of the object notified by a Cloud
+// Storage notification, or an empty path if the message must be acknowledged
+// without processing any object.
+func (p *PubSub) parseMessage(msg pubsubMessage) (string, error) {
+	// The notification is described by the message attributes, the payload
+	// (the object metadata) is optional.
+	eventType := msg.Attributes["eventType"]
+	if eventType == "" {
+		return "", fmt.Errorf("not a Cloud Storage notification: no eventType attribute")
+	}
+	if eventType != "OBJECT_FINALIZE" {
+		return "", nil
+	}
+
+	bucket, object := msg.Attributes["bucketId"], msg.Attributes["objectId"]
+	if bucket == "" || object == "" {
+		return "", fmt.Errorf("invalid OBJECT_FINALIZE notification: bucketId=%q objectId=%q", bucket, object)
+	}
+	if p.Cfg.Bucket != "" && bucket != p.Cfg.Bucket {
+		log.WithFields(log.Fields{"bucket": bucket, "object": object}).Warn("ignoring object of another bucket")
+		return "", nil
+	}
+	if p.FilePathRegexp != nil && !p.FilePathRegexp.MatchString(object) {
+		return "", nil
+	}
+	return gcsPath(bucket, object), nil
+}
+
+// backlogWorker periodically updates the backlog of the subscription, as long
+// as the given context is alive.
+func (p *PubSub) backlogWorker(ctx context.Context) {
+	ctxLog := log.WithFields(log.Fields{"f": "PubSub.backlogWorker", "subscription": p.Cfg.Subscription})
+
+	for {
+		n, err := p.sub.Backlog(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ctxLog.WithError(err).Warn("error getting subscription backlog")
+		} else {
+			atomic.StoreInt64(&p.backlog, n)
+		}
+		if !p.wait(ctx, p.Cfg.BacklogInterval) {
+			return
+		}
+	}
+}
+
+func (p *PubSub) Run(inch chan<- *baker.Data) error {
+	p.objects.SetOutputChannel(inch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.Cfg.PollWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.pollWorker(ctx)
+		}()
+	}
+	if p.Cfg.BacklogInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.backlogWorker(ctx)
+		}()
+	}
+
+	// Stop like the SQS input: stop polling, then wait for the objects
+	// being read before exiting.
+	<-p.done
+	cancel()
+	wg.Wait()
+	p.objects.NoMoreFiles()
+	p.objects.Stop()
+	<-p.objects.Done
+	return nil
+}
+
+func (p *PubSub) Stop() {
+	close(p.done)
+}
+
+func (p *PubSub) Stats() baker.InputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("pubsub.messages_received", atomic.LoadInt64(&p.receivedn))
+	bag.AddRawCounter("pubsub.messages_acked", atomic.LoadInt64(&p.ackedn))
+	bag.AddRawCounter("pubsub.messages_ignored", atomic.LoadInt64(&p.ignoredn))
+	bag.AddRawCounter("pubsub.parse_errors", atomic.LoadInt64(&p.parseErrorsn))
+	bag.AddRawCounter("pubsub.ack_errors", atomic.LoadInt64(&p.ackErrorsn))
+	bag.AddRawCounter("pubsub.failed_messages", atomic.LoadInt64(&p.failedn))
+	if backlog := atomic.LoadInt64(&p.backlog); backlog >= 0 {
+		bag.AddGauge("pubsub.backlog", float64(backlog))
+	}
+
+	stats := p.objects.Stats()
+	if stats.Metrics == nil {
+		stats.Metrics = &baker.MetricsBag{}
+	}
+	stats.Metrics.Merge(bag)
+	return stats
+}
+
+func (p *PubSub) FreeMem(data *baker.Data) {
+	p.objects.FreeMem(data)
+}
@@ -0,0 +1,337 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inpututils"
+)
+
+// fakePubSub is a fake Pub/Sub subscription, returning its messages one at a
+// time.
+type fakePubSub struct {
+	mu       sync.Mutex
+	messages []pubsubMessage
+	acked    []string // ack ids of the acknowledged messages
+	extended []string // ack ids of the messages whose ack deadline has been modified
+}
+
+func (s *fakePubSub) Pull(ctx context.Context, n int) ([]pubsubMessage, error) {
+	s.mu.Lock()
+	if len(s.messages) == 0 {
+		s.mu.Unlock()
+		// Pull requests wait for messages, don't let the workers spin.
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Millisecond):
+		}
+		return nil, nil
+	}
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	s.mu.Unlock()
+	return []pubsubMessage{msg}, nil
+}
+
+func (s *fakePubSub) ModifyAckDeadline(ctx context.Context, deadline time.Duration, ackIDs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extended = append(s.extended, ackIDs...)
+	return nil
+}
+
+func (s *fakePubSub) Acknowledge(ctx context.Context, ackIDs ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, ackIDs...)
+	return nil
+}
+
+func (s *fakePubSub) Backlog(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.messages)), nil
+}
+
+func (s *fakePubSub) ackedMessages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.acked...)
+}
+
+// objectFinalize returns the Cloud Storage notification of a new object.
+func objectFinalize(id, bucket, object string) pubsubMessage {
+	return pubsubMessage{
+		AckID: "ack-" + id,
+		ID:    id,
+		Data:  []byte(fmt.Sprintf(`{"kind": "storage#object", "bucket": %q, "name": %q}`, bucket, object)),
+		Attributes: map[string]string{
+			"eventType":     "OBJECT_FINALIZE",
+			"bucketId":      bucket,
+			"objectId":      object,
+			"payloadFormat": "JSON_API_V1",
+		},
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	deleted := objectFinalize("3", "bucket", "logs/a.log.gz")
+	deleted.Attributes["eventType"] = "OBJECT_DELETE"
+
+	sub := &fakePubSub{
+		messages: []pubsubMessage{
+			objectFinalize("1", "bucket", "logs/a.log.gz"),
+			objectFinalize("2", "other", "logs/b.log.gz"), // ignored
+			deleted, // ignored
+			{AckID: "ack-4", ID: "4", Data: []byte("hello")},     // can't be parsed
+			objectFinalize("5", "bucket", "logs/missing.log.gz"), // not acknowledged
+			objectFinalize("6", "bucket", "logs/c.log.gz"),
+		},
+	}
+	objects := fakeBlobs{
+		"gs://bucket/logs/a.log.gz": "a1\na2\n",
+		"gs://other/logs/b.log.gz":  "b1\n",
+		"gs://bucket/logs/c.log.gz": "c1\n",
+	}
+	cfg := &PubSubConfig{ProjectID: "project", Subscription: "sub", Bucket: "bucket", BacklogInterval: time.Millisecond}
+	cfg.fillDefaults()
+	in, err := newPubSub(cfg, sub, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *baker.Data)
+	errc := make(chan error, 1)
+	go func() { errc <- in.Run(ch) }()
+
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case data := <-ch:
+				mu.Lock()
+				lines = append(lines, strings.Fields(string(data.Bytes))...)
+				mu.Unlock()
+				if b := data.Meta[inpututils.MetadataGCSBucket]; b != "bucket" {
+					t.Errorf("bucket metadata = %v, want %q", b, "bucket")
+				}
+				if s := data.Meta[inpututils.MetadataPubSubSubscription]; s != "sub" {
+					t.Errorf("subscription metadata = %v, want %q", s, "sub")
+				}
+				in.FreeMem(data)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Wait for the last message to be acknowledged, and the backlog to be
+	// updated.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(sub.ackedMessages()) == 5 && in.Stats().Metrics.Get("g:pubsub.backlog") == float64(0) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	in.Stop()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(lines)
+	if want := []string{"a1", "a2", "c1"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if got, want := sub.ackedMessages(), []string{"ack-1", "ack-2", "ack-3", "ack-4", "ack-6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("acknowledged messages = %q, want %q", got, want)
+	}
+	if want := []string{"ack-1", "ack-5", "ack-6"}; !reflect.DeepEqual(sub.extended, want) {
+		t.Errorf("messages with extended ack deadline = %q, want %q", sub.extended, want)
+	}
+
+	stats := in.Stats()
+	for name, want := range map[string]interface{}{
+		"c:pubsub.messages_received": int64(6),
+		"c:pubsub.messages_acked":    int64(5),
+		"c:pubsub.messages_ignored":  int64(2),
+		"c:pubsub.parse_errors":      int64(1),
+		"c:pubsub.failed_messages":   int64(1),
+		"g:pubsub.backlog":           float64(0),
+	} {
+		if got := stats.Metrics.Get(name); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestGCPServices(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		tokens   int
+	)
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		tokens++
+		mu.Unlock()
+		fmt.Fprint(w, `{"access_token": "secret", "expires_in": 3600, "token_type": "Bearer"}`)
+	}))
+	defer metadata.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+" "+string(body))
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"code": 401, "message": "Request had invalid authentication credentials.", "status": "UNAUTHENTICATED"}}`)
+			return
+		}
+		switch r.Method + " " + r.URL.EscapedPath() {
+		case "POST /v1/projects/project/subscriptions/sub:pull":
+			fmt.Fprint(w, `{"receivedMessages": [{"ackId": "ack-1", "message": {"data": "aGVsbG8=", "messageId": "1",
+				"attributes": {"eventType": "OBJECT_FINALIZE", "bucketId": "bucket", "objectId": "dir/file.gz"}}}]}`)
+		case "POST /v1/projects/project/subscriptions/sub:modifyAckDeadline",
+			"POST /v1/projects/project/subscriptions/sub:acknowledge":
+			fmt.Fprint(w, `{}`)
+		case "GET /v3/projects/project/timeSeries":
+			if !strings.Contains(r.URL.Query().Get("filter"), `subscription_id="sub"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"timeSeries": [{"points": [{"value": {"int64Value": "42"}}, {"value": {"int64Value": "12"}}]}]}`)
+		case "GET /storage/v1/b/bucket/o/dir%2Ffile%20name.gz":
+			if r.URL.Query().Get("alt") != "media" {
+				fmt.Fprint(w, `{"name": "dir/file name.gz", "size": "7"}`)
+				return
+			}
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			fmt.Fprint(w, "content")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "No such object", "status": "NOT_FOUND"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	ts := &gcpTokenSource{metadataURL: metadata.URL, client: http.DefaultClient}
+	svc := &gcpService{endpoint: srv.URL, tokens: ts, client: http.DefaultClient}
+
+	sub := &pubsubSubscription{pubsub: svc, monitoring: svc, project: "project", name: "sub"}
+	msgs, err := sub.Pull(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pubsubMessage{{
+		AckID:      "ack-1",
+		ID:         "1",
+		Data:       []byte("hello"),
+		Attributes: map[string]string{"eventType": "OBJECT_FINALIZE", "bucketId": "bucket", "objectId": "dir/file.gz"},
+	}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("messages = %+v, want %+v", msgs, want)
+	}
+	if err := sub.ModifyAckDeadline(ctx, time.Minute, "ack-1"); err != nil {
+		t.Errorf("ModifyAckDeadline: %v", err)
+	}
+	if err := sub.Acknowledge(ctx, "ack-1"); err != nil {
+		t.Errorf("Acknowledge: %v", err)
+	}
+	if n, err := sub.Backlog(ctx); err != nil || n != 42 {
+		t.Errorf("Backlog = %d, %v, want 42, nil", n, err)
+	}
+
+	storage := &gcsStorage{svc: svc}
+	rc, size, lastModified, u, err := storage.OpenBlob(ctx, "gs://bucket/dir/file name.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(buf) != "content" || size != 7 {
+		t.Errorf("object = %q (size %d), want %q (size 7)", buf, size, "content")
+	}
+	if want := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC); !lastModified.Equal(want) {
+		t.Errorf("last modified = %v, want %v", lastModified, want)
+	}
+	if want := "gs://bucket/dir/file%20name.gz"; u.String() != want {
+		t.Errorf("url = %s, want %s", u, want)
+	}
+	if size, err := storage.BlobSize(ctx, "gs://bucket/dir/file name.gz"); err != nil || size != 7 {
+		t.Errorf("BlobSize = %d, %v, want 7, nil", size, err)
+	}
+
+	_, _, _, _, err = storage.OpenBlob(ctx, "gs://bucket/missing.gz")
+	if gerr, ok := err.(*gcpError); !ok || gerr.Status != "NOT_FOUND" || gerr.Code != http.StatusNotFound {
+		t.Errorf("OpenBlob error = %v, want a NOT_FOUND gcpError", err)
+	}
+	if _, err := storage.BlobSize(ctx, "bucket/file.gz"); err == nil {
+		t.Errorf("BlobSize of an invalid path: got nil error")
+	}
+
+	unauthorized := &gcpService{endpoint: srv.URL, tokens: &gcpTokenSource{static: "wrong"}, client: http.DefaultClient}
+	_, err = (&pubsubSubscription{pubsub: unauthorized, project: "project", name: "sub"}).Pull(ctx, 1)
+	if gerr, ok := err.(*gcpError); !ok || gerr.Status != "UNAUTHENTICATED" {
+		t.Errorf("Pull error = %v, want an UNAUTHENTICATED gcpError", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokens != 1 {
+		t.Errorf("got %d tokens from the metadata server, want 1", tokens)
+	}
+	if want := `{"maxMessages":1}`; !strings.HasSuffix(requests[0], want) {
+		t.Errorf("pull request = %s, want body %s", requests[0], want)
+	}
+	if want := `{"ackIds":["ack-1"],"ackDeadlineSeconds":60}`; !strings.HasSuffix(requests[1], want) {
+		t.Errorf("modifyAckDeadline request = %s, want body %s", requests[1], want)
+	}
+}
+
+func TestPubSubConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     PubSubConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: PubSubConfig{}},
+		{name: "AckDeadline", cfg: PubSubConfig{AckDeadline: time.Minute}},
+		{name: "invalid FilePathFilter", cfg: PubSubConfig{FilePathFilter: "("}, wantErr: true},
+		{name: "negative PollWorkers", cfg: PubSubConfig{PollWorkers: -1}, wantErr: true},
+		{name: "short AckDeadline", cfg: PubSubConfig{AckDeadline: time.Second}, wantErr: true},
+		{name: "long AckDeadline", cfg: PubSubConfig{AckDeadline: time.Hour}, wantErr: true},
+		{name: "disabled backlog", cfg: PubSubConfig{BacklogInterval: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.ValidateConfig(nil); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() = %v, want error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,12 +1,20 @@
 package input
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,9 +22,12 @@ import (
 	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/input/inpututils"
 	"github.com/AdRoll/baker/pkg/awsutils"
+	"github.com/AdRoll/baker/pkg/tracing"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/jpillora/backoff"
 )
 
 var SQSDesc = baker.InputDesc{
@@ -31,25 +42,172 @@ var SQSDesc = baker.InputDesc{
 const (
 	sqsFormatPlain = "plain"
 	sqsFormatSNS   = "sns"
+
+	sqsEncodingNone       = "none"
+	sqsEncodingGzipBase64 = "gzip+base64"
+	sqsEncodingAuto       = "auto"
 )
 
 type SQSConfig struct {
-	AwsRegion      string   `help:"AWS region to connect to" default:"us-west-2"`
-	Bucket         string   `help:"S3 Bucket to use for processing" default:""`
-	QueuePrefixes  []string `help:"Prefixes of the names of the SQS queues to monitor" required:"true"`
-	MessageFormat  string   `help:"The format of the SQS messages.\n'plain' the SQS messages received have the S3 file path as a plain string.\n'sns' the SQS messages were produced by a SNS notification." default:"sns"`
-	FilePathFilter string   `help:"If provided, will only use S3 files with the given path."`
+	AwsRegion            string        `help:"AWS region to connect to" default:"us-west-2"`
+	Endpoint             string        `help:"If provided, custom endpoint URL of the SQS and S3 services (e.g. LocalStack). Also enables S3 path-style addressing."`
+	Profile              string        `help:"If provided, name of the AWS profile to use from the shared credentials and config files"`
+	RoleARN              string        `help:"If provided, ARN of the IAM role to assume via STS"`
+	HTTPProxy            string        `help:"If provided, URL of the proxy the SQS and S3 requests go through, overriding the HTTP_PROXY and HTTPS_PROXY environment variables"`
+	CABundlePath         string        `help:"If provided, path of a PEM file of the certificate authorities trusted for the SQS and S3 connections, instead of the system ones"`
+	ConnectTimeout       time.Duration `help:"If greater than 0, maximum time to establish a connection to SQS or S3" default:"0"`
+	ReadTimeout          time.Duration `help:"If greater than 0, maximum time to wait for the response headers of a SQS or S3 request" default:"0"`
+	Bucket               string        `help:"S3 Bucket to use for processing" default:""`
+	QueuePrefixes        []string      `help:"Prefixes of the names of the SQS queues to monitor" required:"true"`
+	MessageFormat        string        `help:"The format of the SQS messages.\n'plain' the SQS messages received have the S3 file path as a plain string.\n'sns' the SQS messages were produced by a SNS notification, whose message is either the S3 file URL or an S3 event notification." default:"sns"`
+	BodyEncoding         string        `help:"The encoding of the SQS message bodies.\n'none' the bodies are not encoded.\n'gzip+base64' the bodies are gzip-compressed then base64-encoded.\n'auto' the bodies are decoded if they're gzip-compressed then base64-encoded, used as-is otherwise." default:"none"`
+	ResolveLargePayloads bool          `help:"If true, the message bodies stored in S3 by the SQS extended client library are fetched from S3" default:"false"`
+	DeleteLargePayloads  bool          `help:"If true, along with ResolveLargePayloads, the message bodies stored in S3 are deleted along with their message" default:"false"`
+	FilePathFilter       string        `help:"If provided, will only use S3 files with the given path."`
+	Compression          string        `help:"If provided, decompressor of all the S3 files (gzip, zstd, bzip2 or lz4), instead of choosing it by file suffix (.gz, .zst, .bz2, .lz4, gzip otherwise)"`
+	PollWorkers          int           `help:"Number of workers concurrently polling the queues. 0 means as many as the number of queues found at startup." default:"0"`
+	ReaderConcurrency    int           `help:"Maximum number of S3 files parsed into records concurrently, at least 1. 0 means as many as the poll workers" default:"0"`
+	Readahead            int           `help:"Number of S3 files downloaded ahead of their parsing, to hide the download latency of many small files. The downloaded files are buffered in memory. 0:disabled" default:"0"`
+	QueueRefreshInterval time.Duration `help:"Interval between 2 discoveries of the queues matching QueuePrefixes, so that new queues are polled and deleted ones are not anymore" default:"5m"`
+	BacklogInterval      time.Duration `help:"If greater than 0, interval between 2 reads of the ApproximateNumberOfMessages of each queue, so that the queues with a larger backlog are polled by more of the PollWorkers. Backlogs are reported as the sqs.backlog.<queue name> gauges" default:"0"`
+	ShortPolling         bool          `help:"If true, ReceiveMessage returns immediately when a queue is empty instead of waiting up to 20s for a message (long polling)" default:"false"`
+	IdleDelay            time.Duration `help:"With ShortPolling, time to wait before polling a queue again after it returned no message" default:"1s"`
+	MinTimestamp         string        `help:"If provided (RFC3339), SNS notifications older than that time are skipped. Requires the sns message format."`
+	MaxTimestamp         string        `help:"If provided (RFC3339), SNS notifications newer than that time are skipped. Requires the sns message format."`
+	DeleteSkipped        bool          `help:"Whether messages skipped because of MinTimestamp/MaxTimestamp are deleted from the queue. If false, they're received again after the queue visibility timeout." default:"false"`
+	DeleteMaxAttempts    int           `help:"Maximum number of attempts to delete a processed message, waiting with the configured backoff between attempts. A message that can't be deleted is received again and its files processed twice" default:"3"`
+	DeleteBatchSize      int           `help:"If greater than 1, processed messages are deleted in batches of up to that many messages of the same queue (at most 10), with DeleteMessageBatch" default:"0"`
+	DeleteBatchDelay     time.Duration `help:"With DeleteBatchSize, maximum time a processed message waits for its batch to be full before being deleted. It should be well below the queue visibility timeout" default:"1s"`
+	BackoffMin           time.Duration `help:"Time to wait before polling a queue again after a first error. The wait time then grows with each consecutive error" default:"1s"`
+	BackoffMax           time.Duration `help:"Maximum time to wait before polling a queue again after an error" default:"10s"`
+	BackoffFactor        float64       `help:"Factor by which the wait time is multiplied after each consecutive error" default:"2"`
+	NoBackoffJitter      bool          `help:"If true, wait times after errors are not randomized" default:"false"`
+	FileProcessTimeout   time.Duration `help:"If greater than 0, maximum time to download and process a single S3 file, after which it's aborted and the message is received again later" default:"0"`
+	MaxProcessingTime    time.Duration `help:"If greater than 0, the visibility timeout of the messages whose files are being processed is periodically extended, so that they're not received again by another reader, up to that total processing time" default:"0"`
+	VisibilityTimeout    time.Duration `help:"Visibility timeout set on the messages being processed each time it's extended, see MaxProcessingTime. Must be at least 1s" default:"1m"`
+	MaxReceiveCount      int           `help:"If greater than 0, messages received more than that many times (according to their ApproximateReceiveCount) are considered poison: they're not processed but sent to DeadLetterQueue and deleted" default:"0"`
+	DeadLetterQueue      string        `help:"URL of the SQS queue the poison messages are sent to, required by MaxReceiveCount"`
+	DedupCacheSize       int           `help:"If greater than 0, number of the most recently processed S3 files to remember, so that the SQS messages redelivered for them are deleted without processing the files again" default:"0"`
+	DedupCacheFile       string        `help:"If provided, file in which the processed S3 files remembered with DedupCacheSize are persisted, so that they're remembered after a restart"`
 }
 
 func (cfg *SQSConfig) fillDefaults() {
 	if cfg.AwsRegion == "" {
 		cfg.AwsRegion = "us-west-2"
 	}
+	if cfg.QueueRefreshInterval <= 0 {
+		cfg.QueueRefreshInterval = 5 * time.Minute
+	}
+	if cfg.IdleDelay <= 0 {
+		cfg.IdleDelay = time.Second
+	}
+	if cfg.BackoffMin <= 0 {
+		cfg.BackoffMin = awsutils.DefaultBackoff.Min
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = awsutils.DefaultBackoff.Max
+	}
+	if cfg.BackoffFactor <= 0 {
+		cfg.BackoffFactor = awsutils.DefaultBackoff.Factor
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = time.Minute
+	}
+	if cfg.DeleteMaxAttempts <= 0 {
+		cfg.DeleteMaxAttempts = 3
+	}
+	if cfg.DeleteBatchDelay <= 0 {
+		cfg.DeleteBatchDelay = time.Second
+	}
 	if cfg.MessageFormat == "" {
 		cfg.MessageFormat = sqsFormatSNS
 	} else {
 		cfg.MessageFormat = strings.ToLower(cfg.MessageFormat)
 	}
+	if cfg.BodyEncoding == "" {
+		cfg.BodyEncoding = sqsEncodingNone
+	} else {
+		cfg.BodyEncoding = strings.ToLower(cfg.BodyEncoding)
+	}
+}
+
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *SQSConfig) ValidateConfig(func(string) (baker.FieldIndex, bool)) error {
+	switch strings.ToLower(cfg.MessageFormat) {
+	case "", sqsFormatPlain, sqsFormatSNS:
+	default:
+		return fmt.Errorf("MessageFormat: unsupported format %q", cfg.MessageFormat)
+	}
+	switch strings.ToLower(cfg.BodyEncoding) {
+	case "", sqsEncodingNone, sqsEncodingGzipBase64, sqsEncodingAuto:
+	default:
+		return fmt.Errorf("BodyEncoding: unsupported encoding %q", cfg.BodyEncoding)
+	}
+	if err := inpututils.ValidateCompression(cfg.Compression); err != nil {
+		return fmt.Errorf("Compression: %v", err)
+	}
+	if cfg.DeleteLargePayloads && !cfg.ResolveLargePayloads {
+		return fmt.Errorf("DeleteLargePayloads requires ResolveLargePayloads")
+	}
+	if _, err := regexp.Compile(cfg.FilePathFilter); err != nil {
+		return fmt.Errorf("FilePathFilter: %v", err)
+	}
+	if cfg.BackoffMin > 0 && cfg.BackoffMax > 0 && cfg.BackoffMin > cfg.BackoffMax {
+		return fmt.Errorf("BackoffMin (%v) can't be greater than BackoffMax (%v)", cfg.BackoffMin, cfg.BackoffMax)
+	}
+	if cfg.BackoffFactor < 0 {
+		return fmt.Errorf("BackoffFactor must be positive, got %v", cfg.BackoffFactor)
+	}
+	if cfg.FileProcessTimeout < 0 {
+		return fmt.Errorf("FileProcessTimeout must be positive, got %v", cfg.FileProcessTimeout)
+	}
+	if cfg.MaxProcessingTime < 0 {
+		return fmt.Errorf("MaxProcessingTime must be positive, got %v", cfg.MaxProcessingTime)
+	}
+	if cfg.VisibilityTimeout != 0 && cfg.VisibilityTimeout < time.Second {
+		return fmt.Errorf("VisibilityTimeout must be at least 1s, got %v", cfg.VisibilityTimeout)
+	}
+	if cfg.DeleteMaxAttempts < 0 {
+		return fmt.Errorf("DeleteMaxAttempts must be at least 1, got %d", cfg.DeleteMaxAttempts)
+	}
+	if cfg.DeleteBatchSize < 0 || cfg.DeleteBatchSize > maxDeleteBatchSize {
+		return fmt.Errorf("DeleteBatchSize must be between 0 and %d, got %d", maxDeleteBatchSize, cfg.DeleteBatchSize)
+	}
+	if cfg.DeleteBatchDelay < 0 {
+		return fmt.Errorf("DeleteBatchDelay must be positive, got %v", cfg.DeleteBatchDelay)
+	}
+	if cfg.MaxReceiveCount < 0 {
+		return fmt.Errorf("MaxReceiveCount must be positive, got %d", cfg.MaxReceiveCount)
+	}
+	if cfg.MaxReceiveCount > 0 && cfg.DeadLetterQueue == "" {
+		return fmt.Errorf("MaxReceiveCount requires DeadLetterQueue")
+	}
+	if cfg.DedupCacheSize < 0 {
+		return fmt.Errorf("DedupCacheSize must be positive, got %d", cfg.DedupCacheSize)
+	}
+	if cfg.BacklogInterval < 0 {
+		return fmt.Errorf("BacklogInterval must be positive, got %v", cfg.BacklogInterval)
+	}
+	if cfg.ReaderConcurrency < 0 {
+		return fmt.Errorf("ReaderConcurrency must be at least 1, got %d", cfg.ReaderConcurrency)
+	}
+	if cfg.Readahead < 0 {
+		return fmt.Errorf("Readahead must be positive, got %d", cfg.Readahead)
+	}
+	if cfg.DedupCacheFile != "" && cfg.DedupCacheSize == 0 {
+		return fmt.Errorf("DedupCacheFile requires DedupCacheSize")
+	}
+	return nil
+}
+
+// backoff returns the backoff configured by cfg.
+func (cfg *SQSConfig) backoff() backoff.Backoff {
+	return backoff.Backoff{
+		Min:    cfg.BackoffMin,
+		Max:    cfg.BackoffMax,
+		Factor: cfg.BackoffFactor,
+		Jitter: !cfg.NoBackoffJitter,
+	}
 }
 
 type SQS struct {
@@ -57,11 +215,60 @@ type SQS struct {
 
 	Cfg            *SQSConfig
 	FilePathRegexp *regexp.Regexp
-	svc            *sqs.SQS
+	svc            sqsiface.SQSAPI // an interface, so that tests can use a fake SQS
 	wg             sync.WaitGroup
 	done           chan bool
 
-	minSnsTimestamp time.Time
+	// minSnsTimestamp is the minimum timestamp (unix nanoseconds) of the SNS
+	// notifications received since the last call to Stats, 0 if none. It's
+	// accessed atomically since it's updated by all poll workers.
+	minSnsTimestamp int64
+
+	// newBackoff creates the backoff used by a poll worker after errors, and
+	// sleep waits for the duration it returns. If nil, they default to the
+	// configured backoff and time.Sleep.
+	newBackoff func() awsutils.Backoff
+	sleep      func(time.Duration)
+
+	// parseFile processes an S3 file, it defaults to s3Input.ParseFileContext.
+	parseFile func(context.Context, string) error
+
+	// heartbeat is the interval between 2 extensions of the visibility
+	// timeout of a message being processed, it defaults to half the
+	// configured VisibilityTimeout.
+	heartbeat   time.Duration
+	extensionsn int64 // number of visibility timeout extensions
+
+	processed   *keyCache // recently processed S3 files, if DedupCacheSize is set
+	duplicatesn int64     // number of S3 files not processed again thanks to processed
+	failedn     int64     // number of messages not deleted because their files couldn't be processed
+	timeoutsn   int64     // number of S3 files aborted after FileProcessTimeout
+
+	receivedn      int64 // number of received messages
+	deletedn       int64 // number of deleted messages
+	parseErrorsn   int64 // number of messages that couldn't be parsed
+	deleteErrorsn  int64 // number of failed message deletions
+	undeletedn     int64 // number of messages that couldn't be deleted after all attempts
+	decodeErrorsn  int64 // number of message bodies that couldn't be decoded
+	payloadErrorsn int64 // number of message bodies that couldn't be fetched from or deleted in S3
+
+	deleter        *deleteBatcher // batches message deletions, if DeleteBatchSize is set
+	deleteBatchesn int64          // number of DeleteMessageBatch calls
+
+	deadLetteredn    int64 // number of poison messages sent to the dead-letter queue
+	deadLetterErrorn int64 // number of poison messages that couldn't be sent to the dead-letter queue
+
+	tracer *tracing.Tracer // traces the files, also used by s3Input, nil if tracing is disabled
+
+	window   timeWindow // time window of SNS notifications
+	skippedn int64      // number of messages skipped because of the time window
+
+	mu            sync.Mutex       // protects queues, nextq, pollers and backlogs
+	queues        []string         // URLs of the queues to poll
+	nextq         int              // index of the next queue to poll
+	pollers       map[string]int   // number of workers polling each queue, by URL
+	backlogs      map[string]int64 // approximate number of messages by queue URL, if BacklogInterval is set
+	activePollers int64            // number of workers currently polling a queue
 }
 
 func NewSQS(cfg baker.InputParams) (baker.Input, error) {
@@ -71,118 +278,732 @@ func NewSQS(cfg baker.InputParams) (baker.Input, error) {
 	dcfg := cfg.DecodedConfig.(*SQSConfig)
 	dcfg.fillDefaults()
 
-	sess := session.New(&aws.Config{Region: aws.String(dcfg.AwsRegion)})
+	sess, err := awsutils.NewSession(awsutils.SessionConfig{
+		Region:   dcfg.AwsRegion,
+		Endpoint: dcfg.Endpoint,
+		Profile:  dcfg.Profile,
+		RoleARN:  dcfg.RoleARN,
+		HTTP: awsutils.HTTPConfig{
+			Proxy:          dcfg.HTTPProxy,
+			CABundlePath:   dcfg.CABundlePath,
+			ConnectTimeout: dcfg.ConnectTimeout,
+			ReadTimeout:    dcfg.ReadTimeout,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't create AWS session: %v", err)
+	}
 	svc := sqs.New(sess)
 
 	var filePathRegexp *regexp.Regexp
 	if dcfg.FilePathFilter != "" {
-		var err error
 		filePathRegexp, err = regexp.Compile(dcfg.FilePathFilter)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("FilePathFilter: %v", err)
 		}
 	} else {
 		filePathRegexp = nil
 	}
 
-	return &SQS{
-		s3Input:         inpututils.NewS3Input(dcfg.AwsRegion, dcfg.Bucket),
-		Cfg:             dcfg,
-		svc:             svc,
-		FilePathRegexp:  filePathRegexp,
-		minSnsTimestamp: time.Time{},
-		done:            make(chan bool),
-	}, nil
+	s := &SQS{
+		s3Input:        inpututils.NewS3InputWithSession(sess, dcfg.Bucket),
+		Cfg:            dcfg,
+		svc:            svc,
+		FilePathRegexp: filePathRegexp,
+		done:           make(chan bool),
+	}
+	s.s3Input.Compression = dcfg.Compression
+	s.s3Input.Tracer = cfg.Tracer
+	s.tracer = cfg.Tracer
+
+	if err := s.parseTimeWindow(); err != nil {
+		return nil, err
+	}
+
+	if dcfg.ReaderConcurrency != 0 {
+		if err := s.s3Input.SetReaderConcurrency(dcfg.ReaderConcurrency); err != nil {
+			return nil, fmt.Errorf("ReaderConcurrency: %v", err)
+		}
+	}
+	if dcfg.Readahead > 0 {
+		if err := s.s3Input.SetReadahead(dcfg.Readahead); err != nil {
+			return nil, fmt.Errorf("Readahead: %v", err)
+		}
+	}
+
+	if dcfg.DeleteBatchSize > 1 {
+		s.deleter = newDeleteBatcher(s, dcfg.DeleteBatchSize, dcfg.DeleteBatchDelay)
+	}
+
+	if dcfg.DedupCacheSize > 0 {
+		s.processed, err = newKeyCache(dcfg.DedupCacheSize, dcfg.DedupCacheFile)
+		if err != nil {
+			return nil, fmt.Errorf("DedupCacheFile: %v", err)
+		}
+	}
+
+	return s, nil
 }
 
-// pollQueue polls the given queue as long as the given context is alive.
-func (s *SQS) pollQueue(ctx context.Context, sqsurl string) {
-	ctxLog := log.WithFields(log.Fields{"f": "SQS.pollQueue", "url": sqsurl})
-	backoff := awsutils.DefaultBackoff
+// parseTimeWindow parses the MinTimestamp and MaxTimestamp configuration.
+func (s *SQS) parseTimeWindow() error {
+	if s.Cfg.MinTimestamp == "" && s.Cfg.MaxTimestamp == "" {
+		return nil
+	}
+	if s.Cfg.MessageFormat != sqsFormatSNS {
+		return fmt.Errorf("MinTimestamp and MaxTimestamp require the %q message format", sqsFormatSNS)
+	}
+
+	var err error
+	s.window, err = parseTimeWindow(s.Cfg.MinTimestamp, s.Cfg.MaxTimestamp)
+	return err
+}
+
+// pollWorker polls the discovered queues as long as the given context is
+// alive. Queues are picked by nextQueue, and a queue which has just returned
+// messages is polled again by the same worker until it's empty, so that busy
+// queues can be polled by multiple workers at the same time.
+func (s *SQS) pollWorker(ctx context.Context) {
+	ctxLog := log.WithFields(log.Fields{"f": "SQS.pollWorker"})
+	sleep := s.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	backoff := s.backoff()
+	for ctx.Err() == nil {
+		sqsurl := s.nextQueue()
+		if sqsurl == "" {
+			// No queue to poll yet.
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		atomic.AddInt64(&s.activePollers, 1)
+		for ctx.Err() == nil {
+			n, err := s.pollQueue(ctx, sqsurl)
+			if ctx.Err() != nil {
+				break
+			}
+			if isQueueDoesNotExist(err) {
+				// The queue has been deleted: stop polling it, without
+				// backing off. If it's recreated, it's discovered again
+				// by the next refresh.
+				if s.removeQueue(sqsurl) {
+					ctxLog.WithError(err).WithField("url", sqsurl).Warn("queue doesn't exist anymore, not polling it")
+				}
+				break
+			}
+			if err != nil {
+				ctxLog.WithError(err).WithField("url", sqsurl).Error("error from ReceiveMessage")
+				sleep(backoff.Duration())
+				break
+			}
+			if n == 0 {
+				// The queue is empty. With long polling, ReceiveMessage
+				// has already waited for a message; otherwise wait here
+				// so that empty queues aren't polled in a busy loop.
+				if s.Cfg.ShortPolling {
+					sleep(s.Cfg.IdleDelay)
+				}
+				break
+			}
+			// Only reset the backoff once messages are received, since
+			// empty responses may alternate with errors.
+			backoff.Reset()
+		}
+		atomic.AddInt64(&s.activePollers, -1)
+		s.releaseQueue(sqsurl)
+	}
+}
+
+// backoff returns a new backoff, created by newBackoff if set.
+func (s *SQS) backoff() awsutils.Backoff {
+	if s.newBackoff != nil {
+		return s.newBackoff()
+	}
+	b := s.Cfg.backoff()
+	return &b
+}
+
+// wait waits for d, with sleep if set, and returns false if ctx is done.
+func (s *SQS) wait(ctx context.Context, d time.Duration) bool {
+	if s.sleep != nil {
+		s.sleep(d)
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// nextQueue returns the next queue to poll, or "" if no queue has been
+// discovered, and counts the calling worker as one of its pollers until
+// releaseQueue is called.
+//
+// Queues are polled in turn, unless their backlogs are known: queues without
+// any poller are then picked first, the one with the largest backlog first,
+// and the other ones in proportion to their backlog, so that busier queues
+// get more pollers.
+func (s *SQS) nextQueue() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queues) == 0 {
+		return ""
+	}
+	if s.backlogs == nil {
+		s.nextq = (s.nextq + 1) % len(s.queues)
+	} else {
+		// Scan the queues starting after the last picked one, so that
+		// ties are broken in turn.
+		best, bestIdle, bestScore := -1, false, 0.0
+		for i := 1; i <= len(s.queues); i++ {
+			idx := (s.nextq + i) % len(s.queues)
+			url := s.queues[idx]
+			idle := s.pollers[url] == 0
+			score := float64(s.backlogs[url]+1) / float64(s.pollers[url]+1)
+			if best == -1 || (idle && !bestIdle) || (idle == bestIdle && score > bestScore) {
+				best, bestIdle, bestScore = idx, idle, score
+			}
+		}
+		s.nextq = best
+	}
+
+	url := s.queues[s.nextq]
+	if s.pollers == nil {
+		s.pollers = make(map[string]int)
+	}
+	s.pollers[url]++
+	return url
+}
+
+// releaseQueue is called once a worker stops polling a queue returned by
+// nextQueue.
+func (s *SQS) releaseQueue(sqsurl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pollers[sqsurl]--; s.pollers[sqsurl] <= 0 {
+		delete(s.pollers, sqsurl)
+	}
+}
+
+// removeQueue removes a queue from the set of queues to poll, reporting
+// whether it was there.
+func (s *SQS) removeQueue(sqsurl string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, q := range s.queues {
+		if q != sqsurl {
+			continue
+		}
+		s.queues = append(s.queues[:i], s.queues[i+1:]...)
+		if s.nextq >= i && s.nextq > 0 {
+			s.nextq--
+		}
+		return true
+	}
+	return false
+}
+
+// isQueueDoesNotExist reports whether err is the error returned by SQS for
+// a queue that doesn't exist.
+func isQueueDoesNotExist(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == sqs.ErrCodeQueueDoesNotExist
+}
+
+// discoverQueues lists the queues matching the configured prefixes and
+// replaces the set of queues to poll. Since workers pick the queue to poll
+// from that set, new queues start being polled and the ones that disappeared
+// stop being polled, without any duplicate.
+func (s *SQS) discoverQueues(ctx context.Context) error {
+	var queues []string
+	seen := make(map[string]bool)
+	for _, prefix := range s.Cfg.QueuePrefixes {
+		// ListQueues returns at most 1000 queues at once, follow NextToken
+		// to get all of them.
+		var token *string
+		for {
+			resp, err := s.svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{
+				QueueNamePrefix: aws.String(prefix),
+				MaxResults:      aws.Int64(1000),
+				NextToken:       token,
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, url := range resp.QueueUrls {
+				if !seen[*url] {
+					seen[*url] = true
+					queues = append(queues, *url)
+				}
+			}
+
+			if aws.StringValue(resp.NextToken) == "" {
+				break
+			}
+			token = resp.NextToken
+		}
+	}
+
+	s.mu.Lock()
+	s.queues = queues
+	s.mu.Unlock()
+	return nil
+}
+
+// refreshQueues periodically discovers the queues to poll, as long as the
+// given context is alive.
+func (s *SQS) refreshQueues(ctx context.Context) {
+	ticker := time.NewTicker(s.Cfg.QueueRefreshInterval)
+	defer ticker.Stop()
+
 	for {
-		resp, err := s.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
-			QueueUrl:        aws.String(sqsurl),
-			WaitTimeSeconds: aws.Int64(20),
-			// We ask only for 1 message at a time, because the
-			// parseFile() call below could block, and we want to
-			// receive messages and not process them immediately,
-			// or they could get rescheduled to other readers.
-			MaxNumberOfMessages: aws.Int64(1),
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.discoverQueues(ctx); err != nil && ctx.Err() == nil {
+				log.WithError(err).Error("error refreshing SQS queues, keeping the current ones")
+			}
+		}
+	}
+}
+
+// refreshBacklogs reads the approximate number of messages of each queue to
+// poll. The previous backlog of a queue is kept if it can't be read.
+func (s *SQS) refreshBacklogs(ctx context.Context) {
+	s.mu.Lock()
+	queues := append([]string(nil), s.queues...)
+	prev := s.backlogs
+	s.mu.Unlock()
+
+	backlogs := make(map[string]int64, len(queues))
+	for _, url := range queues {
+		resp, err := s.svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(url),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
 		})
-		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithError(err).WithField("url", url).Warn("can't read SQS queue backlog")
+			backlogs[url] = prev[url]
+			continue
+		}
+		n, err := strconv.ParseInt(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]), 10, 64)
+		if err != nil {
+			log.WithError(err).WithField("url", url).Warn("invalid SQS queue backlog")
+			backlogs[url] = prev[url]
+			continue
+		}
+		backlogs[url] = n
+	}
+
+	s.mu.Lock()
+	s.backlogs = backlogs
+	s.mu.Unlock()
+}
+
+// watchBacklogs periodically reads the backlog of the queues to poll, as long
+// as the given context is alive.
+func (s *SQS) watchBacklogs(ctx context.Context) {
+	ticker := time.NewTicker(s.Cfg.BacklogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			s.refreshBacklogs(ctx)
 		}
+	}
+}
 
+// pollQueue receives messages from the given queue, once, and processes
+// them. It returns the number of received messages.
+func (s *SQS) pollQueue(ctx context.Context, sqsurl string) (int, error) {
+	ctxLog := log.WithFields(log.Fields{"f": "SQS.pollQueue", "url": sqsurl})
+	waitTime := int64(20)
+	if s.Cfg.ShortPolling {
+		waitTime = 0
+	}
+	in := &sqs.ReceiveMessageInput{
+		QueueUrl:        aws.String(sqsurl),
+		WaitTimeSeconds: aws.Int64(waitTime),
+		// We ask only for 1 message at a time, because the
+		// parseFile() call below could block, and we want to
+		// receive messages and not process them immediately,
+		// or they could get rescheduled to other readers.
+		MaxNumberOfMessages: aws.Int64(1),
+	}
+	if s.Cfg.MaxReceiveCount > 0 {
+		in.AttributeNames = []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)}
+		in.MessageAttributeNames = []*string{aws.String("All")}
+	} else if s.tracer != nil {
+		in.MessageAttributeNames = []*string{aws.String(traceparentAttribute)}
+	}
+	resp, err := s.svc.ReceiveMessageWithContext(ctx, in)
+	if err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&s.receivedn, int64(len(resp.Messages)))
+
+	// The records of the files notified on the queue carry its URL.
+	fctx := inpututils.ContextWithMetadata(ctx, baker.Metadata{inpututils.MetadataSQSQueue: sqsurl})
+	for _, msg := range resp.Messages {
+		if s.isPoison(msg) {
+			s.deadLetter(ctx, sqsurl, msg, ctxLog)
+			if ctx.Err() != nil {
+				return len(resp.Messages), nil
+			}
+			continue
+		}
+
+		body, payload, err := s.resolvePayload(ctx, aws.StringValue(msg.Body))
 		if err != nil {
-			ctxLog.WithError(err).Error("error from ReceiveMessage")
-			time.Sleep(backoff.Duration())
+			if ctx.Err() != nil {
+				return len(resp.Messages), nil
+			}
+			atomic.AddInt64(&s.payloadErrorsn, 1)
+			ctxLog.WithError(err).Error("error fetching message body from S3")
 			continue
 		}
-		backoff.Reset()
 
-		for _, msg := range resp.Messages {
-			var s3FilePath string
-			var snsMsgTimestamp string
+		s3FilePaths, snsMsgTimestamp, err := s.parseMessage(&body, ctxLog)
+		if err != nil {
+			atomic.AddInt64(&s.parseErrorsn, 1)
+			continue
+		}
 
-			s3FilePath, snsMsgTimestamp, err := s.parseMessage(msg.Body, ctxLog)
+		outOfWindow := false
+		if snsMsgTimestamp != "" {
+			// Track the minimum timestamp of the SNS
+			// notification. Stats() will reset it once a second, so
+			// in practice we track the minimum ts seen in each
+			// second.
+			ts, err := time.Parse(time.RFC3339, snsMsgTimestamp)
 			if err != nil {
+				atomic.AddInt64(&s.parseErrorsn, 1)
+				ctxLog.WithError(err).Error("error parsing Timestamp in SNS message")
 				continue
 			}
 
-			if snsMsgTimestamp != "" {
-				// Track the minimum timestamp of the SNS
-				// notification. Stats() will reset it once a second, so
-				// in practice we track the minimum ts seen in each
-				// second.
-				ts, err := time.Parse(time.RFC3339, snsMsgTimestamp)
-				if err != nil {
-					ctxLog.WithError(err).Error("error parsing Timestamp in SNS message")
+			s.trackSnsTimestamp(ts)
+
+			if !s.window.contains(ts) {
+				atomic.AddInt64(&s.skippedn, 1)
+				if !s.Cfg.DeleteSkipped {
 					continue
 				}
+				outOfWindow = true
+			}
+		}
 
-				if s.minSnsTimestamp.IsZero() || ts.Unix() < s.minSnsTimestamp.Unix() {
-					s.minSnsTimestamp = ts
+		// The files continue the trace of the message producer, if any.
+		mctx := fctx
+		if s.tracer != nil {
+			mctx = s.continueTrace(fctx, msg, ctxLog)
+		}
+
+		stopHeartbeat := s.keepInvisible(ctx, sqsurl, msg.ReceiptHandle, ctxLog)
+		processed := true
+		for _, s3FilePath := range s3FilePaths {
+			// Skip the file if it doesn't match the filter provided.
+			if !outOfWindow && (s.FilePathRegexp == nil || s.FilePathRegexp.MatchString(s3FilePath)) {
+				if err := s.processFile(mctx, s3FilePath, ctxLog); err != nil {
+					processed = false
 				}
 			}
+		}
 
-			// Skip the file if it doesn't match the filter provided.
-			if s.FilePathRegexp == nil || s.FilePathRegexp.MatchString(s3FilePath) {
-				// FIXME: we should check if the bucket matches what was configured
-				// or even better, change s3Input to not be limited to a single bucket
-				s.s3Input.ParseFile(s3FilePath)
+		stopHeartbeat()
+
+		// Only delete the message once all its files have been entirely
+		// read, otherwise it's received again after the queue visibility
+		// timeout and the files are processed again.
+		if !processed {
+			atomic.AddInt64(&s.failedn, 1)
+			ctxLog.Warn("not deleting message, some of its files couldn't be processed")
+			continue
+		}
+
+		s.deleteProcessed(ctx, sqsurl, msg.ReceiptHandle, payload, ctxLog)
+		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
+			return len(resp.Messages), nil
+		}
+	}
+
+	return len(resp.Messages), nil
+}
+
+// traceparentAttribute is the message attribute holding the W3C trace
+// context of the message producer.
+const traceparentAttribute = "traceparent"
+
+// continueTrace returns a copy of ctx in which the spans of the files of msg
+// continue the trace found in its traceparent attribute, if any.
+func (s *SQS) continueTrace(ctx context.Context, msg *sqs.Message, ctxLog *log.Entry) context.Context {
+	attr, ok := msg.MessageAttributes[traceparentAttribute]
+	if !ok || attr.StringValue == nil {
+		return ctx
+	}
+	sc, err := tracing.ParseTraceparent(*attr.StringValue)
+	if err != nil {
+		ctxLog.WithError(err).Warn("ignoring trace context of message")
+		return ctx
+	}
+	return tracing.ContextWithRemoteParent(ctx, sc)
+}
+
+// isPoison reports whether msg has been received more than MaxReceiveCount
+// times.
+func (s *SQS) isPoison(msg *sqs.Message) bool {
+	if s.Cfg.MaxReceiveCount <= 0 {
+		return false
+	}
+	count, err := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return err == nil && count > s.Cfg.MaxReceiveCount
+}
+
+// deadLetter sends a poison message to the dead-letter queue, with its body
+// and attributes left as they are, then deletes it. If it can't be sent, the
+// message is left in its queue.
+func (s *SQS) deadLetter(ctx context.Context, sqsurl string, msg *sqs.Message, ctxLog *log.Entry) {
+	ctxLog = ctxLog.WithField("receive_count", aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	_, err := s.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(s.Cfg.DeadLetterQueue),
+		MessageBody:       msg.Body,
+		MessageAttributes: msg.MessageAttributes,
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&s.deadLetterErrorn, 1)
+		ctxLog.WithError(err).Error("can't send poison message to the dead-letter queue")
+		return
+	}
+
+	atomic.AddInt64(&s.deadLetteredn, 1)
+	ctxLog.Warn("poison message sent to the dead-letter queue")
+	// The message body stored in S3, if any, is now referenced by the
+	// dead-lettered message: it's kept.
+	s.deleteProcessed(ctx, sqsurl, msg.ReceiptHandle, nil, ctxLog)
+}
+
+// deleteProcessed deletes a processed message, in a batch if configured to.
+func (s *SQS) deleteProcessed(ctx context.Context, sqsurl string, receiptHandle *string, payload *payloadPointer, ctxLog *log.Entry) {
+	if s.deleter != nil {
+		s.deleter.add(sqsurl, receiptHandle, func(ctx context.Context, err error) {
+			s.messageDeleted(ctx, err, payload, ctxLog)
+		})
+		return
+	}
+
+	err := s.deleteMessage(ctx, sqsurl, receiptHandle, ctxLog)
+	s.messageDeleted(ctx, err, payload, ctxLog)
+}
+
+// messageDeleted is called once a processed message has been deleted, if err
+// is nil, or couldn't be. It then deletes the message body stored in S3, if
+// any and if configured to.
+func (s *SQS) messageDeleted(ctx context.Context, err error, payload *payloadPointer, ctxLog *log.Entry) {
+	if err == nil {
+		atomic.AddInt64(&s.deletedn, 1)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&s.undeletedn, 1)
+		ctxLog.WithError(err).Error("can't delete message")
+		return
+	}
+
+	if payload != nil && s.Cfg.DeleteLargePayloads {
+		if err := s.s3Input.DeleteObject(ctx, payload.Bucket, payload.Key); err != nil && ctx.Err() == nil {
+			atomic.AddInt64(&s.payloadErrorsn, 1)
+			ctxLog.WithError(err).WithField("key", payload.Key).Error("error deleting message body from S3")
+		}
+	}
+}
+
+// deleteMessage deletes the message with the given receipt handle. Failed
+// attempts are retried with backoff, up to DeleteMaxAttempts, unless the
+// receipt handle is invalid or ctx is done.
+func (s *SQS) deleteMessage(ctx context.Context, sqsurl string, receiptHandle *string, ctxLog *log.Entry) error {
+	var backoff awsutils.Backoff
+	for attempt := 1; ; attempt++ {
+		_, err := s.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(sqsurl),
+			ReceiptHandle: receiptHandle,
+		})
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		atomic.AddInt64(&s.deleteErrorsn, 1)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == sqs.ErrCodeReceiptHandleIsInvalid {
+			return err
+		}
+		if attempt >= s.Cfg.DeleteMaxAttempts {
+			return err
+		}
+
+		if backoff == nil {
+			backoff = s.backoff()
+		}
+		d := backoff.Duration()
+		ctxLog.WithError(err).WithField("backoff", d).Warn("error from DeleteMessage, retrying")
+		if !s.wait(ctx, d) {
+			return ctx.Err()
+		}
+	}
+}
+
+// keepInvisible periodically extends the visibility timeout of the message
+// with the given receipt handle, so that it's not received again while its
+// files are being processed, until the configured MaxProcessingTime. The
+// returned function stops the extensions and must be called once the message
+// has been processed.
+func (s *SQS) keepInvisible(ctx context.Context, sqsurl string, receiptHandle *string, ctxLog *log.Entry) (stop func()) {
+	if s.Cfg.MaxProcessingTime <= 0 {
+		return func() {}
+	}
+
+	heartbeat := s.heartbeat
+	if heartbeat <= 0 {
+		heartbeat = s.Cfg.VisibilityTimeout / 2
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		deadline := time.Now().Add(s.Cfg.MaxProcessingTime)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
 			}
 
-			_, err = s.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
-				QueueUrl:      aws.String(sqsurl),
-				ReceiptHandle: msg.ReceiptHandle,
-			})
-			if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
+			// Never extend the visibility timeout past the deadline.
+			timeout := s.Cfg.VisibilityTimeout
+			if left := time.Until(deadline); left < timeout {
+				timeout = left
+			}
+			if timeout < time.Second {
+				ctxLog.WithField("max", s.Cfg.MaxProcessingTime).Warn("message processing is taking longer than MaxProcessingTime")
 				return
 			}
+
+			_, err := s.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(sqsurl),
+				ReceiptHandle:     receiptHandle,
+				VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+			})
 			if err != nil {
-				ctxLog.WithError(err).Error("error from DeleteMessage")
+				if ctx.Err() == nil {
+					ctxLog.WithError(err).Error("error from ChangeMessageVisibility")
+				}
+				continue
 			}
+			atomic.AddInt64(&s.extensionsn, 1)
 		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
 	}
 }
 
-func (s *SQS) parseMessage(Body *string, ctxLog *log.Entry) (string, string, error) {
-	var s3FilePath string
-	var snsMsgTimestamp string
+// processFile processes an S3 file, unless it's been processed recently and
+// the message referring to it has been redelivered. It returns once the file
+// has been entirely read, or with an error if it couldn't be, in particular
+// if ctx is done or FileProcessTimeout has elapsed.
+func (s *SQS) processFile(ctx context.Context, s3FilePath string, ctxLog *log.Entry) error {
+	if s.processed != nil && s.processed.Contains(s3FilePath) {
+		ctxLog.WithField("file", s3FilePath).Debug("skipping already processed S3 file")
+		atomic.AddInt64(&s.duplicatesn, 1)
+		return nil
+	}
+
+	parseFile := s.parseFile
+	if parseFile == nil {
+		parseFile = s.s3Input.ParseFileContext
+	}
+	if s.Cfg.FileProcessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Cfg.FileProcessTimeout)
+		defer cancel()
+	}
+	if err := parseFile(ctx, s3FilePath); err != nil {
+		if err == context.DeadlineExceeded {
+			atomic.AddInt64(&s.timeoutsn, 1)
+			ctxLog.WithField("file", s3FilePath).WithField("timeout", s.Cfg.FileProcessTimeout).Error("S3 file processing timed out")
+		}
+		return err
+	}
+
+	if s.processed != nil {
+		if err := s.processed.Add(s3FilePath); err != nil {
+			ctxLog.WithError(err).Error("error persisting processed S3 file")
+		}
+	}
+	return nil
+}
+
+// parseMessage parses the body of an SQS message and returns the paths of
+// the S3 files it refers to and, for SNS notifications, their timestamp.
+func (s *SQS) parseMessage(Body *string, ctxLog *log.Entry) ([]string, string, error) {
+	if s.Cfg.BodyEncoding != "" && s.Cfg.BodyEncoding != sqsEncodingNone {
+		body, err := decodeBody(*Body, s.Cfg.BodyEncoding)
+		if err != nil {
+			atomic.AddInt64(&s.decodeErrorsn, 1)
+			ctxLog.WithError(err).Error("error decoding SQS message body")
+			return nil, "", err
+		}
+		Body = &body
+	}
 
 	switch s.Cfg.MessageFormat {
 	case sqsFormatPlain:
 		// The SQS queue is populated by a lambda function that
 		// just provides the path to the S3 file in the message's
 		// body.
-		s3FilePath = string(*Body)
-		snsMsgTimestamp = ""
+		return []string{*Body}, "", nil
 
 	case sqsFormatSNS:
 		// The SQS queue is populated by SNS messages. So the
 		// body is a JSON document with several fields; we only
-		// care about one field: "Message", which is the URL of
-		// the file on S3 that was generated.
+		// care about one field: "Message", which is either the URL of
+		// the file on S3 that was generated or an S3 event notification.
 		type SNSMessage struct {
 			Message   string
 			Timestamp string // time SNS notification was received by SNS
@@ -190,26 +1011,191 @@ func (s *SQS) parseMessage(Body *string, ctxLog *log.Entry) (string, string, err
 		snsMsg := SNSMessage{}
 		if err := json.Unmarshal([]byte(*Body), &snsMsg); err != nil {
 			ctxLog.WithError(err).Error("error parsing SNS message in SQS")
-			return "", "", err
+			return nil, "", err
 		}
 
 		// The URL sent through SNS is something like:
 		//   s3n://BUCKET/path
-		// So we just extract the path and use it as filename
+		//   s3://BUCKET/path
+		//   https://BUCKET.s3.amazonaws.com/path
+		//   https://s3.amazonaws.com/BUCKET/path
+		// So we extract the bucket and the path, used as filename
 		parsedUrl, err := url.Parse(snsMsg.Message)
+		if err == nil && parsedUrl.Scheme != "" && parsedUrl.Host != "" {
+			ctxLog.Debug("SNS message contains an URL")
+			bucket, key, err := parseS3URL(parsedUrl)
+			if err != nil {
+				ctxLog.WithError(err).Error("error parsing SNS message in SQS")
+				return nil, "", err
+			}
+			return []string{s.filePath(bucket, key)}, snsMsg.Timestamp, nil
+		}
+
+		// Otherwise the message should be an S3 event notification,
+		// containing one or more records.
+		paths, err := s.parseS3Event(snsMsg.Message)
 		if err != nil {
-			ctxLog.WithError(err).Error("error parsing URL in SNS message in SQS")
-			return "", "", err
+			ctxLog.WithError(err).Error("error parsing SNS message in SQS: neither an URL nor an S3 event")
+			return nil, "", err
+		}
+		ctxLog.WithField("records", len(paths)).Debug("SNS message contains an S3 event")
+		return paths, snsMsg.Timestamp, nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported message format: %q", s.Cfg.MessageFormat)
+}
+
+// gzipMagic starts all gzip streams.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decodeBody decodes a message body with the given encoding. With the auto
+// encoding, bodies that aren't gzip-compressed then base64-encoded are
+// returned as-is.
+func decodeBody(body, encoding string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+	if encoding == sqsEncodingAuto && (err != nil || !bytes.HasPrefix(buf, gzipMagic)) {
+		return body, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %v", err)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return "", fmt.Errorf("invalid gzip: %v", err)
+	}
+	defer r.Close()
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("invalid gzip: %v", err)
+	}
+	return string(decoded), nil
+}
+
+// parseS3URL returns the bucket and the key of the S3 object identified by u,
+// either an s3://, s3a:// or s3n:// URL, or an HTTP(S) URL, virtual-hosted
+// style (https://BUCKET.s3.REGION.amazonaws.com/KEY) or path-style
+// (https://s3.REGION.amazonaws.com/BUCKET/KEY).
+func parseS3URL(u *url.URL) (bucket, key string, err error) {
+	path := strings.TrimPrefix(u.Path, "/")
+
+	switch strings.ToLower(u.Scheme) {
+	case "s3", "s3a", "s3n":
+		bucket, key = u.Host, path
+	case "http", "https":
+		host := strings.ToLower(u.Hostname())
+		if !strings.HasSuffix(host, ".amazonaws.com") {
+			return "", "", fmt.Errorf("not an S3 URL: %s", u)
 		}
-		// If bucket isn't hardcoded, find it from S3 path.
-		if s.Cfg.Bucket == "" {
-			s3FilePath = snsMsg.Message
+		host = strings.TrimSuffix(host, ".amazonaws.com")
+		if i := strings.LastIndex(host, ".s3"); i >= 0 && isS3Endpoint(host[i+1:]) {
+			// Virtual-hosted style, with the bucket in the host.
+			bucket, key = u.Hostname()[:i], path
+		} else if isS3Endpoint(host) {
+			// Path-style, with the bucket as the first path component.
+			i := strings.IndexByte(path, '/')
+			if i < 0 {
+				return "", "", fmt.Errorf("no key in S3 URL: %s", u)
+			}
+			bucket, key = path[:i], path[i+1:]
 		} else {
-			s3FilePath = parsedUrl.Path[1:]
+			return "", "", fmt.Errorf("not an S3 URL: %s", u)
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported URL scheme: %s", u)
+	}
+
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("no bucket or key in S3 URL: %s", u)
+	}
+	return bucket, key, nil
+}
+
+// filePath returns the path of the S3 file to process: just the key if the
+// object is in the configured bucket, the full S3 path otherwise, so that
+// s3Input reads it from its own bucket.
+func (s *SQS) filePath(bucket, key string) string {
+	if s.Cfg.Bucket != "" && bucket == s.Cfg.Bucket {
+		return key
+	}
+	return inpututils.S3Path(bucket, key)
+}
+
+// isS3Endpoint reports whether host, stripped of its amazonaws.com domain, is
+// an S3 endpoint such as s3, s3.us-west-2, s3-us-west-2 or s3.dualstack.us-west-2.
+func isS3Endpoint(host string) bool {
+	return host == "s3" || strings.HasPrefix(host, "s3.") || strings.HasPrefix(host, "s3-")
+}
+
+// parseS3Event parses an S3 event notification and returns the paths of the
+// contained objects.
+func (s *SQS) parseS3Event(msg string) ([]string, error) {
+	type S3Event struct {
+		Records []struct {
+			S3 struct {
+				Bucket struct {
+					Name string
+				}
+				Object struct {
+					Key string
+				}
+			}
+		}
+	}
+
+	ev := S3Event{}
+	if err := json.Unmarshal([]byte(msg), &ev); err != nil {
+		return nil, err
+	}
+	if len(ev.Records) == 0 {
+		return nil, fmt.Errorf("no records in S3 event")
+	}
+
+	paths := make([]string, 0, len(ev.Records))
+	for _, rec := range ev.Records {
+		// Object keys are URL-encoded in S3 events.
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid object key %q: %v", rec.S3.Object.Key, err)
 		}
-		snsMsgTimestamp = snsMsg.Timestamp
+		paths = append(paths, s.filePath(rec.S3.Bucket.Name, key))
 	}
-	return s3FilePath, snsMsgTimestamp, nil
+	return paths, nil
+}
+
+// Validate implements baker.StartupValidator. It checks that the queues
+// matching the configured prefixes can be listed and accessed and, if a
+// bucket is configured, that it can be accessed as well.
+func (s *SQS) Validate() error {
+	ctx := context.Background()
+	if err := s.discoverQueues(ctx); err != nil {
+		return fmt.Errorf("can't list queues (check IAM permissions): %v", err)
+	}
+
+	s.mu.Lock()
+	queues := append([]string(nil), s.queues...)
+	s.mu.Unlock()
+
+	if len(queues) == 0 {
+		log.WithField("prefixes", s.Cfg.QueuePrefixes).Warn("no SQS queue matching the configured prefixes")
+	}
+	for _, url := range queues {
+		_, err := s.svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(url),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+		})
+		if err != nil {
+			return fmt.Errorf("can't access queue %s (check IAM permissions): %v", url, err)
+		}
+	}
+
+	if s.Cfg.Bucket != "" {
+		if err := s.s3Input.CheckBucket(); err != nil {
+			return fmt.Errorf("can't access bucket %q (check IAM permissions): %v", s.Cfg.Bucket, err)
+		}
+	}
+
+	return nil
 }
 
 func (s *SQS) Run(inch chan<- *baker.Data) error {
@@ -218,24 +1204,43 @@ func (s *SQS) Run(inch chan<- *baker.Data) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var wg sync.WaitGroup
-	for _, prefix := range s.Cfg.QueuePrefixes {
+	if err := s.discoverQueues(ctx); err != nil {
+		return err
+	}
 
-		resp, err := s.svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{
-			QueueNamePrefix: aws.String(prefix),
-		})
-		if err != nil {
-			return err
+	nworkers := s.Cfg.PollWorkers
+	if nworkers == 0 {
+		s.mu.Lock()
+		nworkers = len(s.queues)
+		s.mu.Unlock()
+		if nworkers == 0 {
+			nworkers = 1
 		}
+	}
 
-		for _, url := range resp.QueueUrls {
-			wg.Add(1)
-			go func(url string) {
-				defer wg.Done()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.refreshQueues(ctx)
+	}()
 
-				s.pollQueue(ctx, url)
-			}(*url)
-		}
+	if s.Cfg.BacklogInterval > 0 {
+		// Know the backlogs before the workers pick their first queue.
+		s.refreshBacklogs(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.watchBacklogs(ctx)
+		}()
+	}
+
+	for i := 0; i < nworkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pollWorker(ctx)
+		}()
 	}
 
 	// The correct order of operation to cleanly stop the whole pipeline is the
@@ -250,9 +1255,18 @@ func (s *SQS) Run(inch chan<- *baker.Data) error {
 	<-s.done
 	cancel()
 	wg.Wait()
+	if s.deleter != nil {
+		// Delete the messages processed since the last batches.
+		s.deleter.flush()
+	}
 	s.s3Input.NoMoreFiles()
 	s.s3Input.Stop()
 	<-s.s3Input.Done
+	if s.processed != nil {
+		if err := s.processed.Close(); err != nil {
+			log.WithError(err).Error("error closing DedupCacheFile")
+		}
+	}
 	return nil
 }
 
@@ -262,19 +1276,74 @@ func (s *SQS) Stop() {
 	close(s.done)
 }
 
+// trackSnsTimestamp records ts as the minimum SNS notification timestamp if
+// it's older than the current minimum.
+func (s *SQS) trackSnsTimestamp(ts time.Time) {
+	nsec := ts.UnixNano()
+	for {
+		cur := atomic.LoadInt64(&s.minSnsTimestamp)
+		if cur != 0 && cur <= nsec {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.minSnsTimestamp, cur, nsec) {
+			return
+		}
+	}
+}
+
 func (s *SQS) Stats() baker.InputStats {
-	bag := make(baker.MetricsBag)
+	bag := &baker.MetricsBag{}
 
-	if !s.minSnsTimestamp.IsZero() {
-		bag.AddGauge("sqs.lag", time.Since(s.minSnsTimestamp).Seconds())
+	// Reset on each poll, which in practice means we'll get the minimum of
+	// each second.
+	if ts := atomic.SwapInt64(&s.minSnsTimestamp, 0); ts != 0 {
+		bag.AddGauge("sqs.lag", time.Since(time.Unix(0, ts)).Seconds())
+	}
+	if s.window.isSet() {
+		bag.AddRawCounter("sqs.skipped_by_time", atomic.LoadInt64(&s.skippedn))
+	}
+
+	bag.AddRawCounter("sqs.messages_received", atomic.LoadInt64(&s.receivedn))
+	bag.AddRawCounter("sqs.messages_deleted", atomic.LoadInt64(&s.deletedn))
+	bag.AddRawCounter("sqs.parse_errors", atomic.LoadInt64(&s.parseErrorsn))
+	bag.AddRawCounter("sqs.delete_errors", atomic.LoadInt64(&s.deleteErrorsn))
+	bag.AddRawCounter("sqs.undeleted_messages", atomic.LoadInt64(&s.undeletedn))
+	if s.deleter != nil {
+		bag.AddRawCounter("sqs.delete_batches", atomic.LoadInt64(&s.deleteBatchesn))
+	}
+	if s.Cfg.MaxReceiveCount > 0 {
+		bag.AddRawCounter("sqs.dead_lettered", atomic.LoadInt64(&s.deadLetteredn))
+		bag.AddRawCounter("sqs.dead_letter_errors", atomic.LoadInt64(&s.deadLetterErrorn))
+	}
+	if s.Cfg.ResolveLargePayloads {
+		bag.AddRawCounter("sqs.payload_errors", atomic.LoadInt64(&s.payloadErrorsn))
+	}
+	if s.Cfg.BodyEncoding != "" && s.Cfg.BodyEncoding != sqsEncodingNone {
+		bag.AddRawCounter("sqs.decode_errors", atomic.LoadInt64(&s.decodeErrorsn))
+	}
+	bag.AddRawCounter("sqs.failed_messages", atomic.LoadInt64(&s.failedn))
+	if s.Cfg.FileProcessTimeout > 0 {
+		bag.AddRawCounter("sqs.file_timeouts", atomic.LoadInt64(&s.timeoutsn))
+	}
+	if s.Cfg.MaxProcessingTime > 0 {
+		bag.AddRawCounter("sqs.visibility_extensions", atomic.LoadInt64(&s.extensionsn))
+	}
+	if s.processed != nil {
+		bag.AddRawCounter("sqs.duplicates", atomic.LoadInt64(&s.duplicatesn))
+	}
 
-		// Reset on each poll, which in practice means we'll get the
-		// minimum of each second.
-		s.minSnsTimestamp = time.Time{}
+	bag.AddGauge("sqs.active_pollers", float64(atomic.LoadInt64(&s.activePollers)))
+	s.mu.Lock()
+	for url, n := range s.backlogs {
+		bag.AddGauge("sqs.backlog."+path.Base(url), float64(n))
 	}
+	s.mu.Unlock()
 
 	stats := s.s3Input.Stats()
-	stats.Metrics = bag
+	if stats.Metrics == nil {
+		stats.Metrics = &baker.MetricsBag{}
+	}
+	stats.Metrics.Merge(bag)
 	return stats
 }
 
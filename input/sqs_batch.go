@@ -0,0 +1,231 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker/pkg/awsutils"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxDeleteBatchSize is the maximum number of entries of a DeleteMessageBatch
+// request.
+const maxDeleteBatchSize = 10
+
+// pendingDelete is a processed message waiting to be deleted.
+type pendingDelete struct {
+	handle *string
+	// done is called once the message has been deleted, with a nil error, or
+	// couldn't be.
+	done func(ctx context.Context, err error)
+	err  error // error of the last attempt
+}
+
+// deleteBatcher groups the deletions of the processed messages by queue, so
+// that they're deleted with DeleteMessageBatch. A batch is deleted once it's
+// full or once DeleteBatchDelay has elapsed since its first message was added.
+//
+// Since the messages have been processed, they're deleted even when the input
+// is stopping, but failed deletions aren't retried anymore once flush has been
+// called.
+type deleteBatcher struct {
+	s       *SQS
+	size    int
+	delay   time.Duration
+	closing chan struct{} // closed by flush
+
+	mu      sync.Mutex
+	pending map[string][]pendingDelete // by queue URL
+	timers  map[string]*time.Timer     // by queue URL, for non-empty pending batches
+	wg      sync.WaitGroup             // batches being deleted
+}
+
+func newDeleteBatcher(s *SQS, size int, delay time.Duration) *deleteBatcher {
+	return &deleteBatcher{
+		s:       s,
+		size:    size,
+		delay:   delay,
+		closing: make(chan struct{}),
+		pending: make(map[string][]pendingDelete),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// add adds a message to the batch of its queue, deleting the batch if it's
+// full. done is called when the message has been deleted, or couldn't be.
+func (b *deleteBatcher) add(sqsurl string, handle *string, done func(context.Context, error)) {
+	b.mu.Lock()
+	b.pending[sqsurl] = append(b.pending[sqsurl], pendingDelete{handle: handle, done: done})
+	var batch []pendingDelete
+	if len(b.pending[sqsurl]) >= b.size {
+		batch = b.take(sqsurl)
+	} else if b.timers[sqsurl] == nil {
+		b.timers[sqsurl] = time.AfterFunc(b.delay, func() {
+			b.mu.Lock()
+			batch := b.take(sqsurl)
+			b.mu.Unlock()
+			if batch != nil {
+				b.deleteBatch(sqsurl, batch)
+				b.wg.Done()
+			}
+		})
+	}
+	b.mu.Unlock()
+
+	if batch != nil {
+		b.deleteBatch(sqsurl, batch)
+		b.wg.Done()
+	}
+}
+
+// take removes and returns the pending batch of a queue, if any, which must
+// then be deleted before calling wg.Done. b.mu must be held.
+func (b *deleteBatcher) take(sqsurl string) []pendingDelete {
+	if t := b.timers[sqsurl]; t != nil {
+		t.Stop()
+		delete(b.timers, sqsurl)
+	}
+	batch := b.pending[sqsurl]
+	delete(b.pending, sqsurl)
+	if len(batch) == 0 {
+		return nil
+	}
+	b.wg.Add(1)
+	return batch
+}
+
+// flush deletes all the pending batches, without retrying failed deletions so
+// that the shutdown isn't delayed, and waits for the batches being deleted.
+// add must not be called anymore.
+func (b *deleteBatcher) flush() {
+	close(b.closing)
+
+	b.mu.Lock()
+	batches := make(map[string][]pendingDelete)
+	for sqsurl := range b.pending {
+		batches[sqsurl] = b.take(sqsurl)
+	}
+	b.mu.Unlock()
+
+	for sqsurl, batch := range batches {
+		b.deleteBatch(sqsurl, batch)
+		b.wg.Done()
+	}
+	b.wg.Wait()
+}
+
+// wait waits for d, with SQS.sleep if set, and returns false if flush has been
+// called.
+func (b *deleteBatcher) wait(d time.Duration) bool {
+	if b.s.sleep != nil {
+		b.s.sleep(d)
+	} else {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-b.closing:
+		case <-t.C:
+		}
+	}
+	return !b.closed()
+}
+
+// closed reports whether flush has been called.
+func (b *deleteBatcher) closed() bool {
+	select {
+	case <-b.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// deleteBatch deletes a batch of messages of a queue. The entries that failed
+// to be deleted are retried with backoff, up to DeleteMaxAttempts, unless the
+// failure is caused by the request itself (like an invalid receipt handle) or
+// flush has been called.
+func (b *deleteBatcher) deleteBatch(sqsurl string, batch []pendingDelete) {
+	ctxLog := log.WithFields(log.Fields{"f": "SQS.deleteBatch", "url": sqsurl})
+	ctx := context.Background()
+
+	var backoff awsutils.Backoff
+	for attempt := 1; ; attempt++ {
+		// Entries are identified by their index in batch.
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+		for i, d := range batch {
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: d.handle}
+		}
+		atomic.AddInt64(&b.s.deleteBatchesn, 1)
+		resp, err := b.s.svc.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(sqsurl),
+			Entries:  entries,
+		})
+
+		var retry []pendingDelete
+		if err != nil {
+			atomic.AddInt64(&b.s.deleteErrorsn, int64(len(batch)))
+			for _, d := range batch {
+				d.err = err
+				retry = append(retry, d)
+			}
+		} else {
+			for _, e := range resp.Successful {
+				if d, ok := batchEntry(batch, e.Id); ok {
+					d.done(ctx, nil)
+				}
+			}
+			for _, e := range resp.Failed {
+				d, ok := batchEntry(batch, e.Id)
+				if !ok {
+					continue
+				}
+				atomic.AddInt64(&b.s.deleteErrorsn, 1)
+				d.err = fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+				if aws.BoolValue(e.SenderFault) {
+					d.done(ctx, d.err)
+					continue
+				}
+				retry = append(retry, d)
+			}
+		}
+
+		if len(retry) == 0 {
+			return
+		}
+		if attempt >= b.s.Cfg.DeleteMaxAttempts || b.closed() {
+			for _, d := range retry {
+				d.done(ctx, d.err)
+			}
+			return
+		}
+
+		if backoff == nil {
+			backoff = b.s.backoff()
+		}
+		wait := backoff.Duration()
+		ctxLog.WithError(retry[0].err).WithFields(log.Fields{"backoff": wait, "entries": len(retry)}).Warn("error from DeleteMessageBatch, retrying")
+		if !b.wait(wait) {
+			for _, d := range retry {
+				d.done(ctx, d.err)
+			}
+			return
+		}
+		batch = retry
+	}
+}
+
+// batchEntry returns the message of batch with the given entry id.
+func batchEntry(batch []pendingDelete, id *string) (pendingDelete, bool) {
+	i, err := strconv.Atoi(aws.StringValue(id))
+	if err != nil || i < 0 || i >= len(batch) {
+		return pendingDelete{}, false
+	}
+	return batch[i], true
+}
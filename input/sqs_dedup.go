@@ -0,0 +1,152 @@
+package input
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// keyCache remembers the most recently added keys, up to a maximum number.
+// If it's backed by a file, added keys are appended to it so that they're
+// remembered after a restart; the file is compacted once it holds twice as
+// many keys as the cache.
+type keyCache struct {
+	mu    sync.Mutex
+	size  int
+	keys  map[string]*list.Element
+	lru   *list.List // keys, most recently added first
+	path  string     // backing file, if any
+	f     *os.File
+	lines int // number of keys written to f
+}
+
+// newKeyCache creates a cache holding at most size keys. If path is not
+// empty, the keys it contains are loaded and the added ones appended to it.
+func newKeyCache(size int, path string) (*keyCache, error) {
+	c := &keyCache{
+		size: size,
+		keys: make(map[string]*list.Element),
+		lru:  list.New(),
+		path: path,
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if key := scanner.Text(); key != "" {
+				c.insert(key)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("can't read %s: %v", path, err)
+		}
+	}
+
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Contains reports whether key has been added and not evicted yet.
+func (c *keyCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.keys[key]
+	return ok
+}
+
+// Add adds key to the cache, evicting the oldest key if it's full.
+func (c *keyCache) Add(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.insert(key)
+	if c.f == nil {
+		return nil
+	}
+	if c.lines >= 2*c.size {
+		return c.compact()
+	}
+	if _, err := fmt.Fprintln(c.f, key); err != nil {
+		return err
+	}
+	c.lines++
+	return nil
+}
+
+// Close closes the backing file, if any.
+func (c *keyCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func (c *keyCache) insert(key string) {
+	if e, ok := c.keys[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.keys[key] = c.lru.PushFront(key)
+	if c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.keys, e.Value.(string))
+	}
+}
+
+// compact rewrites the backing file with the cached keys only, oldest first,
+// and reopens it for appending.
+func (c *keyCache) compact() error {
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		fmt.Fprintln(w, e.Value.(string))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.f, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	c.lines = c.lru.Len()
+	return nil
+}
@@ -0,0 +1,71 @@
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// payloadPointer is the S3 location of a message body offloaded by the SQS
+// extended client library. The message body is then a JSON array like:
+//
+//	["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "bucket", "s3Key": "key"}]
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// Class names of the pointers of the extended client libraries.
+var payloadPointerClasses = []string{
+	"software.amazon.payloadoffloading.PayloadS3Pointer",
+	"com.amazon.sqs.javamessaging.MessageS3Pointer",
+}
+
+// parsePayloadPointer returns the S3 location of the offloaded message body,
+// or nil if body isn't a pointer.
+func parsePayloadPointer(body string) *payloadPointer {
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, "[") {
+		return nil
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &elems); err != nil || len(elems) != 2 {
+		return nil
+	}
+	var class string
+	if err := json.Unmarshal(elems[0], &class); err != nil {
+		return nil
+	}
+	known := false
+	for _, c := range payloadPointerClasses {
+		known = known || class == c
+	}
+	if !known {
+		return nil
+	}
+
+	ptr := &payloadPointer{}
+	if err := json.Unmarshal(elems[1], ptr); err != nil || ptr.Bucket == "" || ptr.Key == "" {
+		return nil
+	}
+	return ptr
+}
+
+// resolvePayload returns the body of a message, fetched from S3 if it's been
+// offloaded there, in which case the S3 location is returned as well.
+func (s *SQS) resolvePayload(ctx context.Context, body string) (string, *payloadPointer, error) {
+	if !s.Cfg.ResolveLargePayloads {
+		return body, nil, nil
+	}
+	ptr := parsePayloadPointer(body)
+	if ptr == nil {
+		return body, nil, nil
+	}
+
+	buf, err := s.s3Input.GetObject(ctx, ptr.Bucket, ptr.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(buf), ptr, nil
+}
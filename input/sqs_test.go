@@ -1,10 +1,42 @@
 package input
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inpututils"
+	"github.com/AdRoll/baker/pkg/awsutils"
+	"github.com/AdRoll/baker/pkg/tracing"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
+var testLog = log.WithField("test", true)
+
 func TestParseMessagePlain(t *testing.T) {
 	S3Bucket := ""
 	Cfg := &SQSConfig{
@@ -17,8 +49,9 @@ func TestParseMessagePlain(t *testing.T) {
 	}
 
 	Message := "s3://some-bucket/log/2015-01-23/l-20150123.gz"
-	ActualPath, ActualTs, err := s.parseMessage(&Message, nil)
-	assertEqual(t, Message, ActualPath)
+	ActualPath, ActualTs, err := s.parseMessage(&Message, testLog)
+	assertEqual(t, 1, len(ActualPath))
+	assertEqual(t, Message, ActualPath[0])
 	assertEqual(t, "", ActualTs)
 	assertEqual(t, nil, err)
 }
@@ -42,14 +75,15 @@ func TestParseMessageSNSFullS3Url(t *testing.T) {
 `
 	ExpectedPath := "s3://some-bucket/log/2015-01-23/l-20150123.gz"
 	ExpectedTs := "2020-05-22T23:21:09.550Z"
-	ActualPath, ActualTs, err := s.parseMessage(&Message, nil)
-	assertEqual(t, ExpectedPath, ActualPath)
+	ActualPath, ActualTs, err := s.parseMessage(&Message, testLog)
+	assertEqual(t, 1, len(ActualPath))
+	assertEqual(t, ExpectedPath, ActualPath[0])
 	assertEqual(t, ExpectedTs, ActualTs)
 	assertEqual(t, nil, err)
 }
 
 func TestParseMessageSNSParsedUrl(t *testing.T) {
-	S3Bucket := "baker-omfg"
+	S3Bucket := "some-bucket"
 	Cfg := &SQSConfig{
 		MessageFormat: "sns",
 		Bucket:        S3Bucket,
@@ -67,15 +101,2101 @@ func TestParseMessageSNSParsedUrl(t *testing.T) {
 `
 	ExpectedPath := "log/2015-01-23/l-20150123.gz"
 	ExpectedTs := "2020-05-22T23:21:09.550Z"
-	ActualPath, ActualTs, err := s.parseMessage(&Message, nil)
-	assertEqual(t, ExpectedPath, ActualPath)
+	ActualPath, ActualTs, err := s.parseMessage(&Message, testLog)
+	assertEqual(t, 1, len(ActualPath))
+	assertEqual(t, ExpectedPath, ActualPath[0])
 	assertEqual(t, ExpectedTs, ActualTs)
 	assertEqual(t, nil, err)
 }
 
+func TestParseMessageSNSOtherBucket(t *testing.T) {
+	s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns", Bucket: "baker-omfg"}}
+
+	// Files of another bucket than the configured one are read from their
+	// own bucket.
+	Message := `{
+  "Type" : "Notification",
+  "Message" : "s3://some-bucket/log/2015-01-23/l-20150123.gz",
+  "Timestamp" : "2020-05-22T23:21:09.550Z"
+}
+`
+	paths, _, err := s.parseMessage(&Message, testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"s3://some-bucket/log/2015-01-23/l-20150123.gz"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %q, want %q", paths, want)
+	}
+}
+
+func TestParseMessageBodyEncoding(t *testing.T) {
+	const body = `{
+  "Type" : "Notification",
+  "Message" : "s3://some-bucket/log/2015-01-23/l-20150123.gz",
+  "Timestamp" : "2020-05-22T23:21:09.550Z"
+}`
+	encode := func(s string) string {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		w.Write([]byte(s))
+		w.Close()
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		wantErr  bool
+	}{
+		{name: "gzip+base64", encoding: "gzip+base64", body: encode(body)},
+		{name: "gzip+base64 with newline", encoding: "gzip+base64", body: encode(body) + "\n"},
+		{name: "auto encoded", encoding: "auto", body: encode(body)},
+		{name: "auto plain", encoding: "auto", body: body},
+		{name: "none", encoding: "none", body: body},
+
+		{name: "not base64", encoding: "gzip+base64", body: body, wantErr: true},
+		{name: "not gzip", encoding: "gzip+base64", body: base64.StdEncoding.EncodeToString([]byte(body)), wantErr: true},
+		{name: "truncated gzip", encoding: "gzip+base64", body: encode(body)[:40], wantErr: true},
+		{name: "none encoded", encoding: "none", body: encode(body), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns", BodyEncoding: tt.encoding}}
+
+			paths, ts, err := s.parseMessage(&tt.body, testLog)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMessage() err = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if n := atomic.LoadInt64(&s.decodeErrorsn); tt.encoding != "none" && n != 1 {
+					t.Errorf("%d decode errors, want 1", n)
+				}
+				return
+			}
+			if want := []string{"s3://some-bucket/log/2015-01-23/l-20150123.gz"}; !reflect.DeepEqual(paths, want) {
+				t.Errorf("paths = %q, want %q", paths, want)
+			}
+			assertEqual(t, "2020-05-22T23:21:09.550Z", ts)
+		})
+	}
+}
+
+func TestParseS3URL(t *testing.T) {
+	tests := []struct {
+		url     string
+		bucket  string
+		key     string
+		wantErr bool
+	}{
+		{url: "s3://b/k", bucket: "b", key: "k"},
+		{url: "s3n://b/k", bucket: "b", key: "k"},
+		{url: "s3a://b/dir/k.gz", bucket: "b", key: "dir/k.gz"},
+		{url: "https://b.s3.amazonaws.com/k", bucket: "b", key: "k"},
+		{url: "https://my.bucket.s3.us-west-2.amazonaws.com/dir/k.gz", bucket: "my.bucket", key: "dir/k.gz"},
+		{url: "https://b.s3-us-west-2.amazonaws.com/k", bucket: "b", key: "k"},
+		{url: "https://s3.amazonaws.com/b/k", bucket: "b", key: "k"},
+		{url: "https://s3.us-west-2.amazonaws.com/b/dir/k.gz", bucket: "b", key: "dir/k.gz"},
+		{url: "http://s3-us-west-2.amazonaws.com/b/k", bucket: "b", key: "k"},
+
+		{url: "https://s3.amazonaws.com/b", wantErr: true},
+		{url: "https://b.s3.amazonaws.com/", wantErr: true},
+		{url: "https://example.com/b/k", wantErr: true},
+		{url: "https://sqs.us-west-2.amazonaws.com/b/k", wantErr: true},
+		{url: "s3://b/", wantErr: true},
+		{url: "ftp://b/k", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, key, err := parseS3URL(u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseS3URL() err = %v, wantErr %t", err, tt.wantErr)
+			}
+			if bucket != tt.bucket || key != tt.key {
+				t.Errorf("parseS3URL() = (%q, %q), want (%q, %q)", bucket, key, tt.bucket, tt.key)
+			}
+		})
+	}
+}
+
+func TestParseMessageSNSHTTPSUrl(t *testing.T) {
+	Message := `{
+  "Type" : "Notification",
+  "Message" : "https://some-bucket.s3.us-west-2.amazonaws.com/log/2015-01-23/l-20150123.gz",
+  "Timestamp" : "2020-05-22T23:21:09.550Z"
+}
+`
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{bucket: "", want: "s3://some-bucket/log/2015-01-23/l-20150123.gz"},
+		{bucket: "some-bucket", want: "log/2015-01-23/l-20150123.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run("bucket="+tt.bucket, func(t *testing.T) {
+			s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns", Bucket: tt.bucket}}
+
+			paths, _, err := s.parseMessage(&Message, testLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(paths, want) {
+				t.Errorf("paths = %q, want %q", paths, want)
+			}
+		})
+	}
+}
+
+func TestParseMessageDecodedKeys(t *testing.T) {
+	s3Event := func(key string) string {
+		return `{\"Records\":[{\"s3\":{\"bucket\":{\"name\":\"some-bucket\"},\"object\":{\"key\":\"` + key + `\"}}}]}`
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		key     string
+	}{
+		{"url/spaces", "s3://some-bucket/path/with%20spaces/file.gz", "path/with spaces/file.gz"},
+		{"url/unicode", "s3://some-bucket/path/caf%C3%A9.gz", "path/café.gz"},
+		{"url/reserved", "https://some-bucket.s3.amazonaws.com/path/100%25%3Fa%23b+c.gz", "path/100%?a#b+c.gz"},
+		{"event/spaces", s3Event("path/with+spaces/file.gz"), "path/with spaces/file.gz"},
+		{"event/unicode", s3Event("path/caf%C3%A9.gz"), "path/café.gz"},
+		{"event/reserved", s3Event("path/100%25%3Fa%23b%2Bc.gz"), "path/100%?a#b+c.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Message := `{"Type": "Notification", "Message": "` + tt.message + `"}`
+
+			// With a configured bucket, the decoded key is used.
+			s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns", Bucket: "some-bucket"}}
+			paths, _, err := s.parseMessage(&Message, testLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{tt.key}; !reflect.DeepEqual(paths, want) {
+				t.Errorf("paths = %q, want %q", paths, want)
+			}
+
+			// Otherwise, the full S3 path gives back the decoded key once
+			// parsed, as S3Input does.
+			s = &SQS{Cfg: &SQSConfig{MessageFormat: "sns"}}
+			paths, _, err = s.parseMessage(&Message, testLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(paths) != 1 {
+				t.Fatalf("paths = %q, want 1 path", paths)
+			}
+			u, err := url.Parse(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != "some-bucket" || u.Path[1:] != tt.key {
+				t.Errorf("path %q is bucket %q and key %q, want %q and %q", paths[0], u.Host, u.Path[1:], "some-bucket", tt.key)
+			}
+		})
+	}
+}
+
+func TestParseMessageSNSS3Event(t *testing.T) {
+	Message := `{
+  "Type" : "Notification",
+  "Message" : "{\"Records\":[{\"eventName\":\"ObjectCreated:Put\",\"s3\":{\"bucket\":{\"name\":\"some-bucket\"},\"object\":{\"key\":\"log/2015-01-23/l-20150123.gz\"}}},{\"eventName\":\"ObjectCreated:Put\",\"s3\":{\"bucket\":{\"name\":\"some-bucket\"},\"object\":{\"key\":\"log/2015-01-23/l+with%3Dspecial.gz\"}}}]}",
+  "Timestamp" : "2020-05-22T23:21:09.550Z"
+}
+`
+	tests := []struct {
+		bucket string
+		want   []string
+	}{
+		{
+			bucket: "",
+			want:   []string{"s3://some-bucket/log/2015-01-23/l-20150123.gz", "s3://some-bucket/log/2015-01-23/l with=special.gz"},
+		},
+		{
+			bucket: "some-bucket",
+			want:   []string{"log/2015-01-23/l-20150123.gz", "log/2015-01-23/l with=special.gz"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("bucket="+tt.bucket, func(t *testing.T) {
+			s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns", Bucket: tt.bucket}}
+
+			paths, ts, err := s.parseMessage(&Message, testLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("paths = %q, want %q", paths, tt.want)
+			}
+			assertEqual(t, "2020-05-22T23:21:09.550Z", ts)
+		})
+	}
+}
+
+func TestParseMessageSNSInvalid(t *testing.T) {
+	s := &SQS{Cfg: &SQSConfig{MessageFormat: "sns"}}
+
+	for _, msg := range []string{"not-an-url", `{\"Records\":[]}`} {
+		Message := `{"Type": "Notification", "Message": "` + msg + `"}`
+		if _, _, err := s.parseMessage(&Message, testLog); err == nil {
+			t.Errorf("parseMessage(%q) err = nil, want an error", Message)
+		}
+	}
+}
+
+func TestNewSQSCustomEndpoint(t *testing.T) {
+	const endpoint = "http://localhost:4566"
+	in, err := NewSQS(baker.InputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &SQSConfig{
+				AwsRegion:     "us-east-1",
+				Endpoint:      endpoint,
+				QueuePrefixes: []string{"queue"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := in.(*SQS).svc.(*sqs.SQS)
+	if svc.Endpoint != endpoint {
+		t.Errorf("SQS endpoint = %q, want %q", svc.Endpoint, endpoint)
+	}
+}
+
+func TestSQSTimeWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SQSConfig
+		ts      string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "no window",
+			cfg:  SQSConfig{MessageFormat: "sns"},
+			ts:   "2020-05-22T23:21:09.550Z",
+			want: true,
+		},
+		{
+			name: "within window",
+			cfg:  SQSConfig{MessageFormat: "sns", MinTimestamp: "2020-05-22T00:00:00Z", MaxTimestamp: "2020-05-23T00:00:00Z"},
+			ts:   "2020-05-22T23:21:09.550Z",
+			want: true,
+		},
+		{
+			name: "before window",
+			cfg:  SQSConfig{MessageFormat: "sns", MinTimestamp: "2020-05-23T00:00:00Z"},
+			ts:   "2020-05-22T23:21:09.550Z",
+			want: false,
+		},
+		{
+			name: "after window",
+			cfg:  SQSConfig{MessageFormat: "sns", MaxTimestamp: "2020-05-22T00:00:00Z"},
+			ts:   "2020-05-22T23:21:09.550Z",
+			want: false,
+		},
+		{
+			name:    "invalid timestamp",
+			cfg:     SQSConfig{MessageFormat: "sns", MinTimestamp: "yesterday"},
+			wantErr: true,
+		},
+		{
+			name:    "empty window",
+			cfg:     SQSConfig{MessageFormat: "sns", MinTimestamp: "2020-05-23T00:00:00Z", MaxTimestamp: "2020-05-22T00:00:00Z"},
+			wantErr: true,
+		},
+		{
+			name:    "plain format",
+			cfg:     SQSConfig{MessageFormat: "plain", MinTimestamp: "2020-05-22T00:00:00Z"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SQS{Cfg: &tt.cfg}
+			err := s.parseTimeWindow()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			ts, err := time.Parse(time.RFC3339, tt.ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.window.contains(ts); got != tt.want {
+				t.Errorf("window.contains(%s) = %v, want %v", tt.ts, got, tt.want)
+			}
+		})
+	}
+}
+
 func assertEqual(t *testing.T, a interface{}, b interface{}) {
 	if a == b {
 		return
 	}
 	t.Fatal(fmt.Sprintf("Assert: %v != %v", a, b))
 }
+
+// fakeSQS is a fake SQS service, with empty queues unless messages are
+// provided.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu       sync.Mutex
+	queues   []string        // URLs of existing queues
+	pageSize int             // max number of queues returned by ListQueues, if not 0
+	received map[string]int  // number of ReceiveMessage calls, by queue URL
+	denied   bool            // whether GetQueueAttributes is denied
+	backlogs map[string]int  // ApproximateNumberOfMessages returned by GetQueueAttributes, by queue URL
+	failures int             // number of ReceiveMessage calls failing before the first success
+	missing  map[string]bool // URLs of queues deleted after having been listed
+
+	messages    map[string][]*sqs.Message // messages to receive, one at a time, by queue URL
+	deleted     []string                  // receipt handles of the deleted messages
+	undeletable map[string]bool           // receipt handles of the messages DeleteMessage fails to delete
+	throttled   int                       // number of DeleteMessage calls failing with a throttling error before the first success
+	batchFails  map[string]int            // number of DeleteMessageBatch failures of an entry before it's deleted, by receipt handle
+	batches     []int                     // sizes of the DeleteMessageBatch calls
+	extended    map[string][]int64        // visibility timeouts set, by receipt handle
+	waitTime    int64                     // WaitTimeSeconds of the last ReceiveMessage call
+	attrNames   []string                  // AttributeNames of the last ReceiveMessage call
+	sent        map[string][]string       // bodies of the sent messages, by queue URL
+	sendDenied  bool                      // whether SendMessage is denied
+}
+
+func (f *fakeSQS) GetQueueAttributesWithContext(_ aws.Context, in *sqs.GetQueueAttributesInput, _ ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	if f.denied {
+		return nil, awserr.New("AccessDenied", "Access to the resource is denied", nil)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &sqs.GetQueueAttributesOutput{Attributes: make(map[string]*string)}
+	for _, name := range aws.StringValueSlice(in.AttributeNames) {
+		if name == sqs.QueueAttributeNameApproximateNumberOfMessages {
+			out.Attributes[name] = aws.String(strconv.Itoa(f.backlogs[aws.StringValue(in.QueueUrl)]))
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) ListQueuesWithContext(_ aws.Context, in *sqs.ListQueuesInput, _ ...request.Option) (*sqs.ListQueuesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var urls []*string
+	for _, q := range f.queues {
+		if strings.HasPrefix(path.Base(q), aws.StringValue(in.QueueNamePrefix)) {
+			urls = append(urls, aws.String(q))
+		}
+	}
+
+	// The NextToken is the index of the first queue of the page.
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	urls = urls[start:]
+
+	out := &sqs.ListQueuesOutput{QueueUrls: urls}
+	if f.pageSize != 0 && len(urls) > f.pageSize {
+		out.QueueUrls = urls[:f.pageSize]
+		out.NextToken = aws.String(strconv.Itoa(start + f.pageSize))
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	f.received[aws.StringValue(in.QueueUrl)]++
+	f.waitTime = aws.Int64Value(in.WaitTimeSeconds)
+	f.attrNames = aws.StringValueSlice(in.AttributeNames)
+	missing := f.missing[aws.StringValue(in.QueueUrl)]
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	var msgs []*sqs.Message
+	if q := f.messages[aws.StringValue(in.QueueUrl)]; !fail && len(q) != 0 {
+		msgs = q[:1]
+		f.messages[aws.StringValue(in.QueueUrl)] = q[1:]
+	}
+	f.mu.Unlock()
+
+	if missing {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist for this wsdl version.", nil)
+	}
+	if fail {
+		return nil, awserr.New("ServiceUnavailable", "The request has failed due to a temporary failure of the server", nil)
+	}
+	if msgs != nil {
+		return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+	}
+
+	// Simulate a (short) long-polling.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Millisecond):
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(_ aws.Context, in *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.undeletable[aws.StringValue(in.ReceiptHandle)] {
+		return nil, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "The input receipt handle is invalid.", nil)
+	}
+	if f.throttled > 0 {
+		f.throttled--
+		return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+	f.deleted = append(f.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageBatchWithContext(_ aws.Context, in *sqs.DeleteMessageBatchInput, _ ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, len(in.Entries))
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		handle := aws.StringValue(e.ReceiptHandle)
+		switch {
+		case f.undeletable[handle]:
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: e.Id, Code: aws.String(sqs.ErrCodeReceiptHandleIsInvalid), SenderFault: aws.Bool(true),
+			})
+		case f.batchFails[handle] > 0:
+			f.batchFails[handle]--
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id: e.Id, Code: aws.String("InternalError"), SenderFault: aws.Bool(false),
+			})
+		default:
+			f.deleted = append(f.deleted, handle)
+			out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeSQS) SendMessageWithContext(_ aws.Context, in *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendDenied {
+		return nil, awserr.New("AccessDenied", "Access to the resource is denied", nil)
+	}
+	if f.sent == nil {
+		f.sent = make(map[string][]string)
+	}
+	url := aws.StringValue(in.QueueUrl)
+	f.sent[url] = append(f.sent[url], aws.StringValue(in.MessageBody))
+	return &sqs.SendMessageOutput{}, nil
+}
+
+// deleteBatches returns the sizes of the DeleteMessageBatch calls.
+func (f *fakeSQS) deleteBatches() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.batches...)
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityWithContext(_ aws.Context, in *sqs.ChangeMessageVisibilityInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.extended == nil {
+		f.extended = make(map[string][]int64)
+	}
+	handle := aws.StringValue(in.ReceiptHandle)
+	f.extended[handle] = append(f.extended[handle], aws.Int64Value(in.VisibilityTimeout))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// extensions returns the number of visibility timeout extensions of the
+// message with the given receipt handle.
+func (f *fakeSQS) extensions(handle string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.extended[handle])
+}
+
+// deletedMessages returns the receipt handles of the deleted messages.
+func (f *fakeSQS) deletedMessages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+// polled returns the number of queues that have been polled at least once.
+func (f *fakeSQS) polled() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.received)
+}
+
+func TestSQSPollWorkers(t *testing.T) {
+	svc := &fakeSQS{
+		queues: []string{
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-a",
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-b",
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-c",
+			"https://sqs.us-west-2.amazonaws.com/123456789012/other",
+		},
+		received: make(map[string]int),
+	}
+	s := &SQS{
+		Cfg: &SQSConfig{QueuePrefixes: []string{"queue-"}},
+		svc: svc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fewer workers than queues.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pollWorker(ctx)
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.polled() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := svc.polled(); n != 3 {
+		t.Errorf("%d queues have been polled, want 3: %v", n, svc.received)
+	}
+	if n := svc.received["https://sqs.us-west-2.amazonaws.com/123456789012/other"]; n != 0 {
+		t.Errorf("queue not matching the prefix has been polled %d times", n)
+	}
+	if n := atomic.LoadInt64(&s.activePollers); n != 0 {
+		t.Errorf("active pollers = %d after stop, want 0", n)
+	}
+}
+
+func TestSQSBacklogPollers(t *testing.T) {
+	const (
+		busy  = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-busy"
+		quiet = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-quiet"
+	)
+
+	svc := &fakeSQS{
+		queues:   []string{busy, quiet},
+		backlogs: map[string]int{busy: 1000, quiet: 10},
+		received: make(map[string]int),
+	}
+	s := &SQS{
+		s3Input: inpututils.NewS3Input("us-west-2", "bucket"),
+		Cfg:     &SQSConfig{QueuePrefixes: []string{"queue-"}, PollWorkers: 4, BacklogInterval: time.Minute},
+		svc:     svc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.refreshBacklogs(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.Cfg.PollWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pollWorker(ctx)
+		}()
+	}
+
+	// Sample the number of workers polling each queue.
+	var busyPollers, quietPollers int
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		busyPollers += s.pollers[busy]
+		quietPollers += s.pollers[quiet]
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if busyPollers <= 2*quietPollers {
+		t.Errorf("busy queue had %d pollers over time, quiet queue %d, want more than twice as many", busyPollers, quietPollers)
+	}
+	svc.mu.Lock()
+	if svc.received[quiet] == 0 {
+		t.Errorf("quiet queue never polled")
+	}
+	svc.mu.Unlock()
+
+	metrics := s.Stats().Metrics
+	if got := metrics.Get("g:sqs.backlog.queue-busy"); got != float64(1000) {
+		t.Errorf("sqs.backlog.queue-busy = %v, want 1000", got)
+	}
+	if got := metrics.Get("g:sqs.backlog.queue-quiet"); got != float64(10) {
+		t.Errorf("sqs.backlog.queue-quiet = %v, want 10", got)
+	}
+}
+
+func TestSQSRefreshQueues(t *testing.T) {
+	const (
+		queueA = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+		queueB = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-b"
+	)
+
+	svc := &fakeSQS{
+		queues:   []string{queueA},
+		received: make(map[string]int),
+	}
+	s := &SQS{
+		Cfg: &SQSConfig{
+			QueuePrefixes:        []string{"queue-"},
+			QueueRefreshInterval: 10 * time.Millisecond,
+		},
+		svc: svc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.refreshQueues(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.pollWorker(ctx)
+	}()
+
+	waitPolled := func(url string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			svc.mu.Lock()
+			n := svc.received[url]
+			svc.mu.Unlock()
+			if n > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("%s has not been polled", url)
+	}
+
+	waitPolled(queueA)
+
+	// A new queue is created, while queueA is deleted.
+	svc.mu.Lock()
+	svc.queues = []string{queueB}
+	svc.mu.Unlock()
+	waitPolled(queueB)
+
+	s.mu.Lock()
+	queues := append([]string(nil), s.queues...)
+	s.mu.Unlock()
+	if !reflect.DeepEqual(queues, []string{queueB}) {
+		t.Errorf("queues = %q, want %q", queues, []string{queueB})
+	}
+
+	// The refresh goroutine must stop with the context.
+	cancel()
+	wg.Wait()
+}
+
+func TestSQSDiscoverQueuesPagination(t *testing.T) {
+	svc := &fakeSQS{
+		queues: []string{
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-a",
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-b",
+			"https://sqs.us-west-2.amazonaws.com/123456789012/queue-c",
+		},
+		pageSize: 2,
+		received: make(map[string]int),
+	}
+	s := &SQS{
+		Cfg: &SQSConfig{QueuePrefixes: []string{"queue-"}},
+		svc: svc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.queues, svc.queues) {
+		t.Fatalf("queues = %q, want %q", s.queues, svc.queues)
+	}
+
+	// Queues of both pages get polled.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.pollWorker(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.polled() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := svc.polled(); n != 3 {
+		t.Errorf("%d queues have been polled, want 3: %v", n, svc.received)
+	}
+}
+
+func TestSQSValidate(t *testing.T) {
+	for _, denied := range []bool{false, true} {
+		t.Run(fmt.Sprintf("denied=%t", denied), func(t *testing.T) {
+			s := &SQS{
+				Cfg: &SQSConfig{QueuePrefixes: []string{"queue-"}},
+				svc: &fakeSQS{
+					queues: []string{"https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"},
+					denied: denied,
+				},
+			}
+
+			err := s.Validate()
+			if denied && err == nil {
+				t.Errorf("Validate() err = nil, want an error")
+			}
+			if !denied && err != nil {
+				t.Errorf("Validate() err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSQSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SQSConfig
+		wantErr bool
+	}{
+		{name: "default", cfg: SQSConfig{}},
+		{name: "plain", cfg: SQSConfig{MessageFormat: "Plain", FilePathFilter: `^logs/.*\.gz$`}},
+		{name: "bad format", cfg: SQSConfig{MessageFormat: "json"}, wantErr: true},
+		{name: "bad filter", cfg: SQSConfig{FilePathFilter: "logs/("}, wantErr: true},
+		{name: "backoff min > max", cfg: SQSConfig{BackoffMin: time.Minute, BackoffMax: time.Second}, wantErr: true},
+		{name: "negative backoff factor", cfg: SQSConfig{BackoffFactor: -1}, wantErr: true},
+		{name: "body encoding", cfg: SQSConfig{BodyEncoding: "GZIP+base64"}},
+		{name: "bad body encoding", cfg: SQSConfig{BodyEncoding: "zstd"}, wantErr: true},
+		{name: "large payloads", cfg: SQSConfig{ResolveLargePayloads: true, DeleteLargePayloads: true}},
+		{name: "delete unresolved large payloads", cfg: SQSConfig{DeleteLargePayloads: true}, wantErr: true},
+		{name: "reader concurrency", cfg: SQSConfig{ReaderConcurrency: 8}},
+		{name: "negative reader concurrency", cfg: SQSConfig{ReaderConcurrency: -1}, wantErr: true},
+		{name: "negative delete attempts", cfg: SQSConfig{DeleteMaxAttempts: -1}, wantErr: true},
+		{name: "delete batches", cfg: SQSConfig{DeleteBatchSize: 10, DeleteBatchDelay: time.Second}},
+		{name: "delete batches too large", cfg: SQSConfig{DeleteBatchSize: 11}, wantErr: true},
+		{name: "max receive count", cfg: SQSConfig{MaxReceiveCount: 5, DeadLetterQueue: "https://sqs.us-west-2.amazonaws.com/123456789012/dlq"}},
+		{name: "max receive count without dead-letter queue", cfg: SQSConfig{MaxReceiveCount: 5}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.ValidateConfig(nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() err = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSQSConfigBackoff(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg := &SQSConfig{}
+		cfg.fillDefaults()
+		b := cfg.backoff()
+		def := awsutils.DefaultBackoff
+		if b.Min != def.Min || b.Max != def.Max || b.Factor != def.Factor || b.Jitter != def.Jitter {
+			t.Errorf("backoff = %+v, want %+v", b, def)
+		}
+	})
+
+	t.Run("max caps durations", func(t *testing.T) {
+		cfg := &SQSConfig{
+			BackoffMin:      10 * time.Millisecond,
+			BackoffMax:      50 * time.Millisecond,
+			BackoffFactor:   3,
+			NoBackoffJitter: true,
+		}
+		cfg.fillDefaults()
+		b := cfg.backoff()
+
+		want := []time.Duration{10, 30, 50, 50, 50, 50}
+		for i, w := range want {
+			if d := b.Duration(); d != w*time.Millisecond {
+				t.Errorf("Duration() call #%d = %v, want %v", i, d, w*time.Millisecond)
+			}
+		}
+
+		// With jitter, durations are randomized but still capped.
+		cfg.NoBackoffJitter = false
+		b = cfg.backoff()
+		for i := 0; i < 20; i++ {
+			if d := b.Duration(); d > cfg.BackoffMax {
+				t.Errorf("Duration() call #%d = %v, want at most %v", i, d, cfg.BackoffMax)
+			}
+		}
+	})
+}
+
+// fakeBackoff is an awsutils.Backoff recording calls, which always returns
+// the same duration.
+type fakeBackoff struct {
+	durations, resets int
+	onReset           func()
+}
+
+func (b *fakeBackoff) Duration() time.Duration {
+	b.durations++
+	return time.Second
+}
+
+func (b *fakeBackoff) Reset() {
+	b.resets++
+	if b.onReset != nil {
+		b.onReset()
+	}
+}
+
+func TestSQSPollWorkerBackoff(t *testing.T) {
+	const failures = 5
+
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+	svc := &fakeSQS{
+		queues:   []string{queue},
+		received: make(map[string]int),
+		failures: failures,
+		messages: map[string][]*sqs.Message{
+			queue: {{Body: aws.String("path/file.gz"), ReceiptHandle: aws.String("1")}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stop polling after the first successful poll.
+	backoff := &fakeBackoff{onReset: cancel}
+	var slept []time.Duration
+	s := &SQS{
+		Cfg:        &SQSConfig{QueuePrefixes: []string{"queue-"}, MessageFormat: sqsFormatPlain},
+		svc:        svc,
+		newBackoff: func() awsutils.Backoff { return backoff },
+		sleep:      func(d time.Duration) { slept = append(slept, d) },
+		parseFile:  func(context.Context, string) error { return nil },
+	}
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.pollWorker(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pollWorker didn't return")
+	}
+
+	if backoff.durations != failures {
+		t.Errorf("Duration() called %d times, want %d", backoff.durations, failures)
+	}
+	if backoff.resets != 1 {
+		t.Errorf("Reset() called %d times, want 1", backoff.resets)
+	}
+	if len(slept) != failures {
+		t.Errorf("slept %d times, want %d", len(slept), failures)
+	}
+	if n := svc.received[queue]; n != failures+1 {
+		t.Errorf("ReceiveMessage called %d times, want %d", n, failures+1)
+	}
+}
+
+func TestSQSQueueDoesNotExist(t *testing.T) {
+	const (
+		queueA = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+		queueB = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-b"
+	)
+	svc := &fakeSQS{
+		queues:   []string{queueA, queueB},
+		received: make(map[string]int),
+		missing:  map[string]bool{queueA: true},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backoff := &fakeBackoff{}
+	s := &SQS{
+		Cfg:        &SQSConfig{QueuePrefixes: []string{"queue-"}},
+		svc:        svc,
+		newBackoff: func() awsutils.Backoff { return backoff },
+	}
+	if err := s.discoverQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.pollWorker(ctx)
+		close(done)
+	}()
+
+	// Wait for queueB to be polled a few times, queueA must have been
+	// polled once, then forgotten.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		svc.mu.Lock()
+		n := svc.received[queueB]
+		svc.mu.Unlock()
+		if n >= 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pollWorker didn't return")
+	}
+
+	if n := svc.received[queueA]; n != 1 {
+		t.Errorf("deleted queue polled %d times, want 1", n)
+	}
+	if n := svc.received[queueB]; n < 5 {
+		t.Errorf("queue polled %d times, want at least 5", n)
+	}
+	if !reflect.DeepEqual(s.queues, []string{queueB}) {
+		t.Errorf("queues = %q, want %q", s.queues, []string{queueB})
+	}
+	if backoff.durations != 0 {
+		t.Errorf("backed off %d times, want 0", backoff.durations)
+	}
+
+	// Once recreated, the queue is polled again after a refresh.
+	svc.missing = nil
+	if err := s.discoverQueues(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.queues, []string{queueA, queueB}) {
+		t.Errorf("queues = %q, want %q", s.queues, []string{queueA, queueB})
+	}
+}
+
+func TestSQSMinSnsTimestamp(t *testing.T) {
+	s := &SQS{
+		Cfg:     &SQSConfig{},
+		s3Input: inpututils.NewS3Input("us-west-2", "bucket"),
+	}
+
+	lag := func(stats baker.InputStats) (float64, bool) {
+		v := stats.Metrics.Get("g:sqs.lag")
+		if v == nil {
+			return 0, false
+		}
+		return v.(float64), true
+	}
+
+	// Timestamps tracked by the workers are between 1 and 2 hours old.
+	now := time.Now()
+	oldest, newest := now.Add(-2*time.Hour), now.Add(-time.Hour)
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				offset := time.Duration((i*1000+j)%3600) * time.Second
+				s.trackSnsTimestamp(newest.Add(-offset))
+			}
+		}(i)
+	}
+
+	// Concurrently call Stats, which resets the minimum.
+	stop := make(chan struct{})
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if l, ok := lag(s.Stats()); ok {
+				if l < time.Since(newest).Seconds()-1 || l > time.Since(oldest).Seconds()+1 {
+					t.Errorf("sqs.lag = %vs, want between %v and %v", l, time.Since(newest), time.Since(oldest))
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-statsDone
+
+	// Without concurrent Stats calls, the minimum is the oldest timestamp.
+	s.Stats()
+	s.trackSnsTimestamp(newest)
+	s.trackSnsTimestamp(oldest)
+	s.trackSnsTimestamp(newest.Add(-time.Minute))
+	l, ok := lag(s.Stats())
+	if !ok {
+		t.Fatal("sqs.lag not reported")
+	}
+	if want := time.Since(oldest).Seconds(); l < want-1 || l > want+1 {
+		t.Errorf("sqs.lag = %vs, want %vs", l, want)
+	}
+
+	// Stats resets the minimum.
+	if l, ok := lag(s.Stats()); ok {
+		t.Errorf("sqs.lag = %vs after reset, want no value", l)
+	}
+}
+
+func TestSQSDedupCache(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+	msg := func(handle, path string) *sqs.Message {
+		return &sqs.Message{Body: aws.String(path), ReceiptHandle: aws.String(handle)}
+	}
+
+	cacheFile := filepath.Join(t.TempDir(), "processed")
+
+	newSQS := func(svc *fakeSQS, parsed *[]string) *SQS {
+		cfg := &SQSConfig{
+			MessageFormat:  sqsFormatPlain,
+			DedupCacheSize: 2,
+			DedupCacheFile: cacheFile,
+		}
+		processed, err := newKeyCache(cfg.DedupCacheSize, cfg.DedupCacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &SQS{
+			Cfg:       cfg,
+			svc:       svc,
+			s3Input:   inpututils.NewS3Input("us-west-2", "bucket"),
+			processed: processed,
+			parseFile: func(_ context.Context, fn string) error {
+				*parsed = append(*parsed, fn)
+				return nil
+			},
+		}
+	}
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {
+				msg("1", "path/a"),
+				msg("2", "path/b"),
+				msg("3", "path/a"), // redelivered
+				msg("4", "path/c"), // evicts path/a
+				msg("5", "path/a"),
+			},
+		},
+	}
+	var parsed []string
+	s := newSQS(svc, &parsed)
+	for i := 0; i < 5; i++ {
+		if _, err := s.pollQueue(context.Background(), queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"path/a", "path/b", "path/c", "path/a"}; !reflect.DeepEqual(parsed, want) {
+		t.Errorf("parsed files = %q, want %q", parsed, want)
+	}
+	if want := []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(svc.deleted, want) {
+		t.Errorf("deleted messages = %q, want %q", svc.deleted, want)
+	}
+	if n := s.Stats().Metrics.Get("c:sqs.duplicates"); n != int64(1) {
+		t.Errorf("sqs.duplicates = %v, want 1", n)
+	}
+	if err := s.processed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, the most recently processed files are remembered.
+	svc = &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {
+				msg("6", "path/a"),
+				msg("7", "path/c"),
+				msg("8", "path/b"),
+			},
+		},
+	}
+	parsed = nil
+	s = newSQS(svc, &parsed)
+	defer s.processed.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := s.pollQueue(context.Background(), queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"path/b"}; !reflect.DeepEqual(parsed, want) {
+		t.Errorf("parsed files after restart = %q, want %q", parsed, want)
+	}
+	if want := []string{"6", "7", "8"}; !reflect.DeepEqual(svc.deleted, want) {
+		t.Errorf("deleted messages after restart = %q, want %q", svc.deleted, want)
+	}
+}
+
+func TestSQSDeleteAfterProcessing(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {
+				{Body: aws.String("path/slow"), ReceiptHandle: aws.String("1")},
+				{Body: aws.String("path/broken"), ReceiptHandle: aws.String("2")},
+			},
+		},
+	}
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	s := &SQS{
+		Cfg:     &SQSConfig{MessageFormat: sqsFormatPlain},
+		svc:     svc,
+		s3Input: inpututils.NewS3Input("us-west-2", "bucket"),
+		parseFile: func(_ context.Context, fn string) error {
+			if fn == "path/broken" {
+				return fmt.Errorf("can't read %s", fn)
+			}
+			close(started)
+			<-finish
+			return nil
+		},
+	}
+
+	// The message of a file being processed is not deleted.
+	errc := make(chan error)
+	go func() {
+		_, err := s.pollQueue(context.Background(), queue)
+		errc <- err
+	}()
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	if deleted := svc.deletedMessages(); len(deleted) != 0 {
+		t.Fatalf("deleted messages = %q while processing, want none", deleted)
+	}
+
+	// It's deleted once the file has been processed.
+	close(finish)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+		t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+	}
+
+	// The message of a file that couldn't be processed is not deleted.
+	if _, err := s.pollQueue(context.Background(), queue); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+		t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+	}
+	if n := s.Stats().Metrics.Get("c:sqs.failed_messages"); n != int64(1) {
+		t.Errorf("sqs.failed_messages = %v, want 1", n)
+	}
+}
+
+func TestSQSTraceContext(t *testing.T) {
+	const (
+		queue       = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+		traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	)
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {
+				{
+					Body:          aws.String("path/traced"),
+					ReceiptHandle: aws.String("1"),
+					MessageAttributes: map[string]*sqs.MessageAttributeValue{
+						"traceparent": {DataType: aws.String("String"), StringValue: aws.String(traceparent)},
+					},
+				},
+				{Body: aws.String("path/untraced"), ReceiptHandle: aws.String("2")},
+			},
+		},
+	}
+
+	exp := tracing.NewMemoryExporter()
+	s := &SQS{
+		Cfg:     &SQSConfig{MessageFormat: sqsFormatPlain},
+		svc:     svc,
+		s3Input: inpututils.NewS3Input("us-west-2", "bucket"),
+	}
+	s.tracer = tracing.NewTracer(exp)
+	s.parseFile = func(ctx context.Context, fn string) error {
+		_, span := s.tracer.Start(ctx, fn)
+		span.End()
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.pollQueue(context.Background(), queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	remote, _ := tracing.ParseTraceparent(traceparent)
+	if traced := spans[0]; traced.Name != "path/traced" || traced.SpanContext.TraceID != remote.TraceID || traced.Parent != remote.SpanID {
+		t.Errorf("span %q has trace %s and parent %s, want it to continue %s", traced.Name, traced.SpanContext.TraceID, traced.Parent, traceparent)
+	}
+	if untraced := spans[1]; untraced.SpanContext.TraceID == remote.TraceID || untraced.Parent.IsValid() {
+		t.Errorf("span %q has trace %s and parent %s, want a new trace", untraced.Name, untraced.SpanContext.TraceID, untraced.Parent)
+	}
+}
+
+func TestSQSVisibilityHeartbeat(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {{Body: aws.String("path/slow"), ReceiptHandle: aws.String("1")}},
+		},
+	}
+
+	finish := make(chan struct{})
+	s := &SQS{
+		Cfg: &SQSConfig{
+			MessageFormat:     sqsFormatPlain,
+			MaxProcessingTime: time.Hour,
+			VisibilityTimeout: 5 * time.Minute,
+		},
+		svc:       svc,
+		s3Input:   inpututils.NewS3Input("us-west-2", "bucket"),
+		heartbeat: time.Millisecond,
+		parseFile: func(context.Context, string) error {
+			<-finish
+			return nil
+		},
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := s.pollQueue(context.Background(), queue)
+		errc <- err
+	}()
+
+	// The visibility timeout is extended while the file is processed.
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.extensions("1") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("visibility timeout extended %d times, want at least 3", svc.extensions("1"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if deleted := svc.deletedMessages(); len(deleted) != 0 {
+		t.Fatalf("deleted messages = %q while processing, want none", deleted)
+	}
+
+	close(finish)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// And not anymore once the message has been processed.
+	n := svc.extensions("1")
+	time.Sleep(10 * time.Millisecond)
+	if svc.extensions("1") != n {
+		t.Errorf("visibility timeout extended after the message has been processed")
+	}
+
+	svc.mu.Lock()
+	for _, timeout := range svc.extended["1"] {
+		if timeout != 300 {
+			t.Errorf("visibility timeout set to %ds, want 300s", timeout)
+		}
+	}
+	svc.mu.Unlock()
+
+	if got := s.Stats().Metrics.Get("c:sqs.visibility_extensions"); got != int64(n) {
+		t.Errorf("sqs.visibility_extensions = %v, want %d", got, n)
+	}
+}
+
+func TestSQSVisibilityMaxProcessingTime(t *testing.T) {
+	svc := &fakeSQS{}
+	s := &SQS{
+		Cfg: &SQSConfig{
+			MaxProcessingTime: 1100 * time.Millisecond,
+			VisibilityTimeout: time.Minute,
+		},
+		svc:       svc,
+		heartbeat: 10 * time.Millisecond,
+	}
+
+	// The visibility timeout set never exceeds MaxProcessingTime, after
+	// which the extensions stop.
+	stop := s.keepInvisible(context.Background(), "queue", aws.String("1"), testLog)
+	time.Sleep(300 * time.Millisecond)
+	n := svc.extensions("1")
+	time.Sleep(50 * time.Millisecond)
+	if svc.extensions("1") != n {
+		t.Errorf("visibility timeout extended past MaxProcessingTime")
+	}
+	stop()
+
+	if n == 0 {
+		t.Fatal("visibility timeout never extended")
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for _, timeout := range svc.extended["1"] {
+		if timeout != 1 {
+			t.Errorf("visibility timeout set to %ds, want 1s", timeout)
+		}
+	}
+}
+
+func TestSQSFileProcessTimeout(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {{Body: aws.String("path/stuck.gz"), ReceiptHandle: aws.String("1")}},
+		},
+	}
+
+	// The S3 file download never progresses.
+	s3Input := inpututils.NewS3Input("us-west-2", "bucket")
+	s3Input.OpenerContext = nil
+	s3Input.Opener = func(string) (io.ReadCloser, int64, time.Time, *url.URL, error) {
+		r, _ := io.Pipe()
+		return r, 0, time.Time{}, &url.URL{}, nil
+	}
+
+	s := &SQS{
+		Cfg: &SQSConfig{
+			MessageFormat:      sqsFormatPlain,
+			FileProcessTimeout: 10 * time.Millisecond,
+		},
+		svc:     svc,
+		s3Input: s3Input,
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := s.pollQueue(context.Background(), queue)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("S3 file processing not aborted after FileProcessTimeout")
+	}
+
+	if n := s.Stats().Metrics.Get("c:sqs.file_timeouts"); n != int64(1) {
+		t.Errorf("sqs.file_timeouts = %v, want 1", n)
+	}
+	if deleted := svc.deletedMessages(); len(deleted) != 0 {
+		t.Errorf("deleted messages = %q, want none", deleted)
+	}
+}
+
+func TestSQSRun(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		queues:   []string{queue},
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {{
+				Body: aws.String(`{
+  "Type" : "Notification",
+  "Message" : "s3://some-bucket/log/2015-01-23/l-20150123.gz",
+  "Timestamp" : "2020-05-22T23:21:09.550Z"
+}`),
+				ReceiptHandle: aws.String("1"),
+			}},
+		},
+	}
+
+	var (
+		mu     sync.Mutex
+		parsed []string
+	)
+	s := &SQS{
+		Cfg: &SQSConfig{
+			QueuePrefixes:        []string{"queue-"},
+			MessageFormat:        sqsFormatSNS,
+			QueueRefreshInterval: time.Minute,
+		},
+		svc:     svc,
+		s3Input: inpututils.NewS3Input("us-west-2", ""),
+		done:    make(chan bool),
+		parseFile: func(_ context.Context, fn string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			parsed = append(parsed, fn)
+			return nil
+		},
+	}
+
+	errc := make(chan error)
+	go func() { errc <- s.Run(make(chan *baker.Data)) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.deletedMessages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"s3://some-bucket/log/2015-01-23/l-20150123.gz"}; !reflect.DeepEqual(parsed, want) {
+		t.Errorf("parsed files = %q, want %q", parsed, want)
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+		t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+	}
+}
+
+func TestSQSMessageCounters(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+	sns := func(handle, message, ts string) *sqs.Message {
+		body := fmt.Sprintf(`{"Type": "Notification", "Message": %q, "Timestamp": %q}`, message, ts)
+		return &sqs.Message{Body: aws.String(body), ReceiptHandle: aws.String(handle)}
+	}
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {
+				sns("1", "s3://some-bucket/a.gz", "2020-05-22T23:21:09.550Z"),
+				sns("2", "not-an-url", "2020-05-22T23:21:09.550Z"),
+				sns("3", "s3://some-bucket/b.gz", "not-a-timestamp"),
+				sns("4", "s3://some-bucket/c.gz", "2020-05-22T23:21:09.550Z"),
+				sns("5", "s3://some-bucket/d.gz", "2020-05-22T23:21:09.550Z"),
+			},
+		},
+		undeletable: map[string]bool{"4": true},
+	}
+	s := &SQS{
+		Cfg:       &SQSConfig{MessageFormat: sqsFormatSNS},
+		svc:       svc,
+		s3Input:   inpututils.NewS3Input("us-west-2", ""),
+		parseFile: func(context.Context, string) error { return nil },
+	}
+
+	// Poll the queue concurrently, as workers do.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.pollQueue(context.Background(), queue); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// An empty receive.
+	if _, err := s.pollQueue(context.Background(), queue); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := s.Stats().Metrics
+	want := map[string]int64{
+		"c:sqs.messages_received": 5,
+		"c:sqs.messages_deleted":  2,
+		"c:sqs.parse_errors":      2,
+		"c:sqs.delete_errors":     1,
+	}
+	for name, n := range want {
+		if metrics.Get(name) != n {
+			t.Errorf("%s = %v, want %d", name, metrics.Get(name), n)
+		}
+	}
+}
+
+func TestSQSPollWorkerEmptyQueue(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	tests := []struct {
+		name         string
+		shortPolling bool
+		waitTime     int64
+	}{
+		{name: "long polling", waitTime: 20},
+		{name: "short polling", shortPolling: true, waitTime: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 2 errors, then empty responses.
+			svc := &fakeSQS{
+				queues:   []string{queue},
+				received: make(map[string]int),
+				failures: 2,
+			}
+
+			var (
+				mu    sync.Mutex
+				slept []time.Duration
+			)
+			backoff := &fakeBackoff{}
+			s := &SQS{
+				Cfg: &SQSConfig{
+					QueuePrefixes: []string{"queue-"},
+					ShortPolling:  tt.shortPolling,
+					IdleDelay:     time.Minute,
+				},
+				svc:        svc,
+				newBackoff: func() awsutils.Backoff { return backoff },
+				sleep: func(d time.Duration) {
+					mu.Lock()
+					defer mu.Unlock()
+					slept = append(slept, d)
+				},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if err := s.discoverQueues(ctx); err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				s.pollWorker(ctx)
+				close(done)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			<-done
+
+			svc.mu.Lock()
+			received, waitTime := svc.received[queue], svc.waitTime
+			svc.mu.Unlock()
+			mu.Lock()
+			defer mu.Unlock()
+
+			if waitTime != tt.waitTime {
+				t.Errorf("WaitTimeSeconds = %d, want %d", waitTime, tt.waitTime)
+			}
+			if backoff.durations != 2 {
+				t.Errorf("backoff Duration() called %d times, want 2", backoff.durations)
+			}
+			// Empty responses don't reset the backoff.
+			if backoff.resets != 0 {
+				t.Errorf("backoff Reset() called %d times, want 0", backoff.resets)
+			}
+
+			idle := 0
+			for _, d := range slept {
+				if d == time.Minute {
+					idle++
+				}
+			}
+			empty := received - 2
+			if empty < 2 {
+				t.Fatalf("%d empty responses, want more", empty)
+			}
+			if tt.shortPolling {
+				// Every empty response is followed by IdleDelay, except
+				// maybe the last one, interrupted by the cancellation.
+				if idle < empty-1 || idle > empty {
+					t.Errorf("waited IdleDelay %d times after %d empty responses", idle, empty)
+				}
+			} else if idle != 0 {
+				t.Errorf("waited IdleDelay %d times with long polling, want 0", idle)
+			}
+		})
+	}
+}
+
+// fakeS3 is an S3 client serving objects from memory.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string]string // object contents, by "bucket/key"
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(obj))}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(_ aws.Context, in *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, *in.Bucket+"/"+*in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestSQSLargePayloads(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+	pointer := func(class, key string) string {
+		return fmt.Sprintf(`[%q, {"s3BucketName": "payloads", "s3Key": %q}]`, class, key)
+	}
+	sns := `{"Type": "Notification", "Message": "s3://some-bucket/%s", "Timestamp": "2020-05-22T23:21:09.550Z"}`
+
+	for _, del := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delete=%t", del), func(t *testing.T) {
+			svc := &fakeSQS{
+				received: make(map[string]int),
+				messages: map[string][]*sqs.Message{
+					queue: {
+						{ReceiptHandle: aws.String("1"), Body: aws.String(pointer("software.amazon.payloadoffloading.PayloadS3Pointer", "a"))},
+						{ReceiptHandle: aws.String("2"), Body: aws.String(pointer("com.amazon.sqs.javamessaging.MessageS3Pointer", "b"))},
+						{ReceiptHandle: aws.String("3"), Body: aws.String(fmt.Sprintf(sns, "c.gz"))},
+						{ReceiptHandle: aws.String("4"), Body: aws.String(pointer("software.amazon.payloadoffloading.PayloadS3Pointer", "missing"))},
+					},
+				},
+			}
+			s3svc := &fakeS3{
+				objects: map[string]string{
+					"payloads/a": fmt.Sprintf(sns, "a.gz"),
+					"payloads/b": fmt.Sprintf(sns, "b.gz"),
+				},
+			}
+
+			var (
+				mu     sync.Mutex
+				parsed []string
+			)
+			s := &SQS{
+				Cfg: &SQSConfig{
+					Bucket:               "some-bucket",
+					MessageFormat:        sqsFormatSNS,
+					ResolveLargePayloads: true,
+					DeleteLargePayloads:  del,
+				},
+				svc:     svc,
+				s3Input: inpututils.NewS3InputWithClient(s3svc, "some-bucket"),
+				parseFile: func(_ context.Context, path string) error {
+					mu.Lock()
+					defer mu.Unlock()
+					parsed = append(parsed, path)
+					return nil
+				},
+			}
+
+			for i := 0; i < 4; i++ {
+				if _, err := s.pollQueue(context.Background(), queue); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if want := []string{"a.gz", "b.gz", "c.gz"}; !reflect.DeepEqual(parsed, want) {
+				t.Errorf("parsed files = %q, want %q", parsed, want)
+			}
+			if want := []string{"1", "2", "3"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+				t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+			}
+			if n := s.Stats().Metrics.Get("c:sqs.payload_errors"); n != int64(1) {
+				t.Errorf("sqs.payload_errors = %v, want 1", n)
+			}
+
+			wantObjects := 2
+			if del {
+				wantObjects = 0
+			}
+			if len(s3svc.objects) != wantObjects {
+				t.Errorf("S3 objects left = %v, want %d", s3svc.objects, wantObjects)
+			}
+		})
+	}
+}
+
+func TestSQSDeleteRetries(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	tests := []struct {
+		name        string
+		throttled   int
+		wantDeleted bool
+		wantErrors  int64
+	}{
+		{name: "no error", throttled: 0, wantDeleted: true, wantErrors: 0},
+		{name: "deleted after retries", throttled: 2, wantDeleted: true, wantErrors: 2},
+		{name: "attempts exhausted", throttled: 3, wantDeleted: false, wantErrors: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeSQS{
+				received: make(map[string]int),
+				messages: map[string][]*sqs.Message{
+					queue: {{Body: aws.String("path/file.gz"), ReceiptHandle: aws.String("1")}},
+				},
+				throttled: tt.throttled,
+			}
+			backoff := &fakeBackoff{}
+			var slept []time.Duration
+			s := &SQS{
+				Cfg:        &SQSConfig{MessageFormat: sqsFormatPlain, DeleteMaxAttempts: 3},
+				svc:        svc,
+				s3Input:    inpututils.NewS3Input("us-west-2", "bucket"),
+				newBackoff: func() awsutils.Backoff { return backoff },
+				sleep:      func(d time.Duration) { slept = append(slept, d) },
+				parseFile:  func(context.Context, string) error { return nil },
+			}
+
+			if _, err := s.pollQueue(context.Background(), queue); err != nil {
+				t.Fatal(err)
+			}
+
+			if deleted := len(svc.deletedMessages()) == 1; deleted != tt.wantDeleted {
+				t.Errorf("message deleted = %t, want %t", deleted, tt.wantDeleted)
+			}
+			// No wait after the last attempt.
+			wantWaits := int(tt.wantErrors)
+			if !tt.wantDeleted {
+				wantWaits--
+			}
+			if len(slept) != wantWaits || backoff.durations != wantWaits {
+				t.Errorf("waited %d times (%d backoff durations), want %d", len(slept), backoff.durations, wantWaits)
+			}
+
+			metrics := s.Stats().Metrics
+			if n := metrics.Get("c:sqs.delete_errors"); n != tt.wantErrors {
+				t.Errorf("sqs.delete_errors = %v, want %d", n, tt.wantErrors)
+			}
+			wantUndeleted := int64(0)
+			if !tt.wantDeleted {
+				wantUndeleted = 1
+			}
+			if n := metrics.Get("c:sqs.undeleted_messages"); n != wantUndeleted {
+				t.Errorf("sqs.undeleted_messages = %v, want %d", n, wantUndeleted)
+			}
+		})
+	}
+}
+
+func TestSQSDeleteRetriesCanceled(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {{Body: aws.String("path/file.gz"), ReceiptHandle: aws.String("1")}},
+		},
+		throttled: 100,
+	}
+	s := &SQS{
+		Cfg:        &SQSConfig{MessageFormat: sqsFormatPlain, DeleteMaxAttempts: 100},
+		svc:        svc,
+		s3Input:    inpututils.NewS3Input("us-west-2", "bucket"),
+		newBackoff: func() awsutils.Backoff { return &fakeBackoff{} }, // 1s between attempts
+		parseFile:  func(context.Context, string) error { return nil },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := s.pollQueue(ctx, queue); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("pollQueue returned after %v, want the retries to stop on cancellation", d)
+	}
+	if n := s.Stats().Metrics.Get("c:sqs.delete_errors"); n != int64(1) {
+		t.Errorf("sqs.delete_errors = %v, want 1", n)
+	}
+}
+
+func TestSQSDeleteBatch(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+	msg := func(handle, path string) *sqs.Message {
+		return &sqs.Message{Body: aws.String(path), ReceiptHandle: aws.String(handle)}
+	}
+
+	tests := []struct {
+		name        string
+		messages    []*sqs.Message
+		batchFails  map[string]int
+		undeletable map[string]bool
+
+		wantBatches    []int // sizes of the DeleteMessageBatch calls, before flush
+		wantFlushed    []int // and after
+		wantDeleted    []string
+		wantErrors     int64
+		wantUndeleted  int64
+		wantRetryWaits int
+	}{
+		{
+			name: "batches",
+			messages: []*sqs.Message{
+				msg("1", "path/a"), msg("2", "path/b"), msg("3", "path/c"),
+				msg("4", "path/d"), msg("5", "path/e"), msg("6", "path/f"), msg("7", "path/g"),
+			},
+			wantBatches: []int{3, 3},
+			wantFlushed: []int{3, 3, 1},
+			wantDeleted: []string{"1", "2", "3", "4", "5", "6", "7"},
+		},
+		{
+			name: "unprocessed messages",
+			messages: []*sqs.Message{
+				msg("1", "path/a"), msg("2", "path/broken"), msg("3", "path/c"), msg("4", "path/d"),
+			},
+			wantBatches: []int{3},
+			wantFlushed: []int{3},
+			wantDeleted: []string{"1", "3", "4"},
+		},
+		{
+			name: "partial failures",
+			messages: []*sqs.Message{
+				msg("1", "path/a"), msg("2", "path/b"), msg("3", "path/c"),
+			},
+			batchFails:     map[string]int{"1": 1, "2": 2},
+			undeletable:    map[string]bool{"3": true},
+			wantBatches:    []int{3, 2, 1}, // only the failed entries are retried
+			wantFlushed:    []int{3, 2, 1},
+			wantDeleted:    []string{"1", "2"},
+			wantErrors:     4,
+			wantUndeleted:  1,
+			wantRetryWaits: 2,
+		},
+		{
+			name: "attempts exhausted",
+			messages: []*sqs.Message{
+				msg("1", "path/a"), msg("2", "path/b"), msg("3", "path/c"),
+			},
+			batchFails:     map[string]int{"2": 3},
+			wantBatches:    []int{3, 1, 1},
+			wantFlushed:    []int{3, 1, 1},
+			wantDeleted:    []string{"1", "3"},
+			wantErrors:     3,
+			wantUndeleted:  1,
+			wantRetryWaits: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeSQS{
+				received:    make(map[string]int),
+				messages:    map[string][]*sqs.Message{queue: tt.messages},
+				batchFails:  tt.batchFails,
+				undeletable: tt.undeletable,
+			}
+			var slept []time.Duration
+			s := &SQS{
+				Cfg:        &SQSConfig{MessageFormat: sqsFormatPlain, DeleteMaxAttempts: 3},
+				svc:        svc,
+				s3Input:    inpututils.NewS3Input("us-west-2", "bucket"),
+				newBackoff: func() awsutils.Backoff { return &fakeBackoff{} },
+				sleep:      func(d time.Duration) { slept = append(slept, d) },
+				parseFile: func(_ context.Context, fn string) error {
+					if fn == "path/broken" {
+						return fmt.Errorf("can't read %s", fn)
+					}
+					return nil
+				},
+			}
+			// A long delay, so that only full batches are deleted until flush.
+			s.deleter = newDeleteBatcher(s, 3, time.Hour)
+
+			for range tt.messages {
+				if _, err := s.pollQueue(context.Background(), queue); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := svc.deleteBatches(); !reflect.DeepEqual(got, tt.wantBatches) {
+				t.Errorf("batches = %v, want %v", got, tt.wantBatches)
+			}
+
+			s.deleter.flush()
+			if got := svc.deleteBatches(); !reflect.DeepEqual(got, tt.wantFlushed) {
+				t.Errorf("batches after flush = %v, want %v", got, tt.wantFlushed)
+			}
+
+			deleted := svc.deletedMessages()
+			sort.Strings(deleted)
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted messages = %q, want %q", deleted, tt.wantDeleted)
+			}
+			if len(slept) != tt.wantRetryWaits {
+				t.Errorf("waited %d times before retrying, want %d", len(slept), tt.wantRetryWaits)
+			}
+
+			metrics := s.Stats().Metrics
+			want := map[string]int64{
+				"c:sqs.messages_deleted":   int64(len(tt.wantDeleted)),
+				"c:sqs.delete_errors":      tt.wantErrors,
+				"c:sqs.undeleted_messages": tt.wantUndeleted,
+				"c:sqs.delete_batches":     int64(len(tt.wantFlushed)),
+			}
+			for name, n := range want {
+				if metrics.Get(name) != n {
+					t.Errorf("%s = %v, want %d", name, metrics.Get(name), n)
+				}
+			}
+		})
+	}
+}
+
+func TestSQSDeleteBatchDelay(t *testing.T) {
+	const queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+
+	svc := &fakeSQS{
+		received: make(map[string]int),
+		messages: map[string][]*sqs.Message{
+			queue: {{Body: aws.String("path/file.gz"), ReceiptHandle: aws.String("1")}},
+		},
+	}
+	s := &SQS{
+		Cfg:       &SQSConfig{MessageFormat: sqsFormatPlain, DeleteMaxAttempts: 3},
+		svc:       svc,
+		s3Input:   inpututils.NewS3Input("us-west-2", "bucket"),
+		parseFile: func(context.Context, string) error { return nil },
+	}
+	s.deleter = newDeleteBatcher(s, 10, 10*time.Millisecond)
+
+	if _, err := s.pollQueue(context.Background(), queue); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch isn't full, it's deleted after the delay.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.deletedMessages()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not deleted after the batch delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := svc.deleteBatches(), []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batches = %v, want %v", got, want)
+	}
+}
+
+func TestSQSPoisonMessages(t *testing.T) {
+	const (
+		queue = "https://sqs.us-west-2.amazonaws.com/123456789012/queue-a"
+		dlq   = "https://sqs.us-west-2.amazonaws.com/123456789012/dlq"
+	)
+	msg := func(handle, path, receiveCount string) *sqs.Message {
+		return &sqs.Message{
+			Body:          aws.String(path),
+			ReceiptHandle: aws.String(handle),
+			Attributes:    map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(receiveCount)},
+		}
+	}
+
+	for _, sendDenied := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sendDenied=%t", sendDenied), func(t *testing.T) {
+			svc := &fakeSQS{
+				received: make(map[string]int),
+				messages: map[string][]*sqs.Message{
+					queue: {
+						msg("1", "path/a", "1"),
+						msg("2", "path/poison", "6"),
+						msg("3", "path/c", "5"),
+					},
+				},
+				sendDenied: sendDenied,
+			}
+			var parsed []string
+			s := &SQS{
+				Cfg:     &SQSConfig{MessageFormat: sqsFormatPlain, MaxReceiveCount: 5, DeadLetterQueue: dlq},
+				svc:     svc,
+				s3Input: inpututils.NewS3Input("us-west-2", "bucket"),
+				parseFile: func(_ context.Context, fn string) error {
+					parsed = append(parsed, fn)
+					return nil
+				},
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err := s.pollQueue(context.Background(), queue); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if want := []string{sqs.MessageSystemAttributeNameApproximateReceiveCount}; !reflect.DeepEqual(svc.attrNames, want) {
+				t.Errorf("ReceiveMessage AttributeNames = %q, want %q", svc.attrNames, want)
+			}
+			// The poison message isn't processed.
+			if want := []string{"path/a", "path/c"}; !reflect.DeepEqual(parsed, want) {
+				t.Errorf("parsed files = %q, want %q", parsed, want)
+			}
+
+			metrics := s.Stats().Metrics
+			if sendDenied {
+				// It's left in the queue.
+				if want := []string{"1", "3"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+					t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+				}
+				if n := metrics.Get("c:sqs.dead_letter_errors"); n != int64(1) {
+					t.Errorf("sqs.dead_letter_errors = %v, want 1", n)
+				}
+				return
+			}
+
+			// It's sent to the dead-letter queue, then deleted.
+			if want := []string{"path/poison"}; !reflect.DeepEqual(svc.sent[dlq], want) {
+				t.Errorf("dead-lettered messages = %q, want %q", svc.sent[dlq], want)
+			}
+			if want := []string{"1", "2", "3"}; !reflect.DeepEqual(svc.deletedMessages(), want) {
+				t.Errorf("deleted messages = %q, want %q", svc.deletedMessages(), want)
+			}
+			if n := metrics.Get("c:sqs.dead_lettered"); n != int64(1) {
+				t.Errorf("sqs.dead_lettered = %v, want 1", n)
+			}
+		})
+	}
+}
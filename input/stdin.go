@@ -0,0 +1,149 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// StdinDesc describes the Stdin input.
+var StdinDesc = baker.InputDesc{
+	Name:   "Stdin",
+	New:    NewStdin,
+	Config: &StdinConfig{},
+	Help: "This input reads newline-separated records from the standard input, gzip-compressed or not,\n" +
+		"so that baker can be used in Unix pipelines (cat file | baker ...). It exits at the end of the input.\n",
+}
+
+// stdinChunkBuffer is the size of the buffers the records are read into.
+// Records longer than that are read into a larger buffer.
+const stdinChunkBuffer = 128 * 1024
+
+// StdinConfig holds the configuration of the Stdin input.
+type StdinConfig struct{}
+
+// Stdin is an input reading records from the standard input.
+type Stdin struct {
+	r io.Reader // os.Stdin, or a reader set by tests
+
+	data     chan<- *baker.Data
+	pool     sync.Pool
+	numLines int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewStdin returns a new Stdin input.
+func NewStdin(cfg baker.InputParams) (baker.Input, error) {
+	return &Stdin{
+		r: os.Stdin,
+		pool: sync.Pool{
+			New: func() interface{} {
+				return &baker.Data{Bytes: make([]byte, stdinChunkBuffer)}
+			},
+		},
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Run reads the standard input until its end, or until the input is stopped.
+func (s *Stdin) Run(inch chan<- *baker.Data) error {
+	s.data = inch
+
+	// Reads from the standard input can't be interrupted, so they're done
+	// in another goroutine, which is abandoned if the input is stopped.
+	chunks := make(chan *baker.Data)
+	errc := make(chan error, 1)
+	go func() { errc <- s.read(chunks) }()
+
+	for {
+		select {
+		case data := <-chunks:
+			s.send(data)
+		case err := <-errc:
+			// All the chunks have been received, the chunks channel being
+			// unbuffered.
+			return err
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+// read reads the standard input, decompressing it if it's gzip-compressed,
+// into chunks of whole records.
+func (s *Stdin) read(chunks chan<- *baker.Data) error {
+	r := bufio.NewReaderSize(s.r, stdinChunkBuffer)
+	if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("stdin: %v", err)
+		}
+		defer gz.Close()
+		r = bufio.NewReaderSize(gz, stdinChunkBuffer)
+	}
+
+	for {
+		data := s.pool.Get().(*baker.Data)
+		n, err := r.Read(data.Bytes[:stdinChunkBuffer])
+		data.Bytes = data.Bytes[:n]
+
+		// Complete the last record of the chunk, so that records aren't
+		// split across chunks.
+		if err == nil && n > 0 && data.Bytes[n-1] != '\n' {
+			var end []byte
+			end, err = r.ReadBytes('\n')
+			data.Bytes = append(data.Bytes, end...)
+		}
+
+		if len(data.Bytes) > 0 {
+			select {
+			case chunks <- data:
+			case <-s.stop:
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("stdin: %v", err)
+		}
+	}
+}
+
+func (s *Stdin) send(data *baker.Data) {
+	nlines := int64(bytes.Count(data.Bytes, []byte{'\n'}))
+	if data.Bytes[len(data.Bytes)-1] != '\n' {
+		nlines++ // last record, not terminated
+	}
+	data.FirstLine = atomic.AddInt64(&s.numLines, nlines) - nlines + 1
+
+	s.data <- data
+}
+
+// Stop makes Run return, even if the standard input is still open.
+func (s *Stdin) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// FreeMem implements baker.Input.
+func (s *Stdin) FreeMem(data *baker.Data) {
+	data.Bytes = data.Bytes[:stdinChunkBuffer]
+	s.pool.Put(data)
+}
+
+// Stats implements baker.Input.
+func (s *Stdin) Stats() baker.InputStats {
+	return baker.InputStats{
+		NumProcessedLines: atomic.LoadInt64(&s.numLines),
+	}
+}
@@ -0,0 +1,120 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+func newStdinTopology(t *testing.T, r io.Reader) *baker.Topology {
+	t.Helper()
+
+	toml := `
+	[fields]
+	names = ["f0", "f1"]
+
+	[input]
+	name="Stdin"
+
+	[output]
+	name="RawRecorder"
+	procs=1
+	`
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{StdinDesc},
+		Outputs: []baker.OutputDesc{outputtest.RawRecorderDesc},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology.Input.(*Stdin).r = r
+	return topology
+}
+
+func TestStdin(t *testing.T) {
+	// Records longer than the read buffer are read whole.
+	long := strings.Repeat("x", 2*stdinChunkBuffer)
+
+	var lines []string
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, "a"+strconv.Itoa(i)+",b")
+	}
+	lines = append(lines, long+",b")
+	plain := strings.Join(lines, "\n") // no trailing newline
+
+	gzipped := &bytes.Buffer{}
+	w := gzip.NewWriter(gzipped)
+	w.Write([]byte(plain))
+	w.Close()
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "plain", input: []byte(plain)},
+		{name: "gzip", input: gzipped.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := newStdinTopology(t, bytes.NewReader(tt.input))
+			topology.Start()
+			// The topology exits by itself at the end of the input.
+			topology.Wait()
+			if err := topology.Error(); err != nil {
+				t.Fatalf("topology error: %v", err)
+			}
+
+			out := topology.Output[0].(*outputtest.Recorder)
+			if len(out.Records) != len(lines) {
+				t.Fatalf("got %d records, want %d", len(out.Records), len(lines))
+			}
+			// A single filter chain process would be needed to keep the
+			// records in order, so compare the sets of records.
+			got := make(map[string]bool)
+			for _, r := range out.Records {
+				got[string(r.Record)] = true
+			}
+			for _, l := range lines {
+				if !got[l] {
+					t.Fatalf("record %.20q not received", l)
+				}
+			}
+			if n := topology.Input.Stats().NumProcessedLines; n != int64(len(lines)) {
+				t.Errorf("NumProcessedLines = %d, want %d", n, len(lines))
+			}
+		})
+	}
+}
+
+func TestStdinStop(t *testing.T) {
+	// The standard input stays open, nothing is ever written to it.
+	r, w := io.Pipe()
+	defer w.Close()
+
+	topology := newStdinTopology(t, r)
+	topology.Start()
+	topology.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		topology.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("topology didn't stop")
+	}
+}
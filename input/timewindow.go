@@ -0,0 +1,51 @@
+package input
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeWindow is the time window set by the MinTimestamp and MaxTimestamp
+// options of an input. A zero bound is unset.
+type timeWindow struct {
+	min, max time.Time
+}
+
+// parseTimeWindow parses the MinTimestamp and MaxTimestamp options, RFC3339
+// timestamps that are empty if unset.
+func parseTimeWindow(minTimestamp, maxTimestamp string) (timeWindow, error) {
+	var (
+		w   timeWindow
+		err error
+	)
+	if minTimestamp != "" {
+		if w.min, err = time.Parse(time.RFC3339, minTimestamp); err != nil {
+			return timeWindow{}, fmt.Errorf("MinTimestamp: %v", err)
+		}
+	}
+	if maxTimestamp != "" {
+		if w.max, err = time.Parse(time.RFC3339, maxTimestamp); err != nil {
+			return timeWindow{}, fmt.Errorf("MaxTimestamp: %v", err)
+		}
+	}
+	if !w.min.IsZero() && !w.max.IsZero() && w.max.Before(w.min) {
+		return timeWindow{}, fmt.Errorf("MaxTimestamp (%s) is before MinTimestamp (%s)", maxTimestamp, minTimestamp)
+	}
+	return w, nil
+}
+
+// isSet reports whether at least one of the bounds of w is set.
+func (w timeWindow) isSet() bool {
+	return !w.min.IsZero() || !w.max.IsZero()
+}
+
+// contains reports whether ts is within w.
+func (w timeWindow) contains(ts time.Time) bool {
+	if !w.min.IsZero() && ts.Before(w.min) {
+		return false
+	}
+	if !w.max.IsZero() && ts.After(w.max) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package baker_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// endlessInput sends chunks of 10 records until it's stopped, and then, like
+// many inputs, returns an error.
+type endlessInput struct {
+	stop chan struct{}
+}
+
+func (in *endlessInput) Run(output chan<- *baker.Data) error {
+	for i := 0; ; i += 10 {
+		var buf []byte
+		for j := i; j < i+10; j++ {
+			buf = append(buf, fmt.Sprintf("%d\n", j)...)
+		}
+		select {
+		case output <- &baker.Data{Bytes: buf}:
+		case <-in.stop:
+			return errors.New("input stopped")
+		}
+	}
+}
+
+func (in *endlessInput) Stop()                    { close(in.stop) }
+func (in *endlessInput) Stats() baker.InputStats  { return baker.InputStats{} }
+func (in *endlessInput) FreeMem(data *baker.Data) {}
+
+func runLimited(t *testing.T, general string) (*baker.Topology, time.Duration) {
+	t.Helper()
+
+	toml := `
+[general]
+` + general + `
+
+[fields]
+names=["id"]
+
+[input]
+name="Endless"
+
+[output]
+name="Recorder"
+procs=1
+fields=["id"]
+`
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Endless",
+			New:    func(baker.InputParams) (baker.Input, error) { return &endlessInput{stop: make(chan struct{})}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	topo.Start()
+	done := make(chan struct{})
+	go func() {
+		topo.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the topology didn't stop")
+	}
+	return topo, time.Since(start)
+}
+
+func TestMaxRecords(t *testing.T) {
+	topo, _ := runLimited(t, "max_records=1000")
+	if err := topo.Error(); err != nil {
+		t.Fatalf("topology error = %v, want nil", err)
+	}
+
+	records := topo.Output[0].(*outputtest.Recorder).Records
+	if len(records) != 1000 {
+		t.Errorf("output received %d records, want 1000", len(records))
+	}
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if seen[r.Fields[0]] {
+			t.Errorf("record %s received twice", r.Fields[0])
+		}
+		seen[r.Fields[0]] = true
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	topo, elapsed := runLimited(t, `max_duration="100ms"`)
+	if err := topo.Error(); err != nil {
+		t.Fatalf("topology error = %v, want nil", err)
+	}
+	if elapsed < 100*time.Millisecond {
+		t.Errorf("topology stopped after %v, want at least 100ms", elapsed)
+	}
+	if len(topo.Output[0].(*outputtest.Recorder).Records) == 0 {
+		t.Errorf("output received no records")
+	}
+}
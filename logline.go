@@ -45,6 +45,7 @@ type LogLine struct {
 	// debugging info or other metadata.  Values can be accessed by filters or
 	// output to perform checks, transformations, etc.
 	meta Metadata
+	line int64 // line number of the record in its source, 0 if unknown
 
 	// This triplet handles in-memory modifications to LogLines (through
 	// LogLine.Set()).
@@ -69,6 +70,11 @@ type LogLine struct {
 
 	// FieldSeparator is the byte used to separate fields value.
 	FieldSeparator byte
+
+	// MinFields, if not 0, is the minimum number of fields of a parsed line.
+	// ExpectedFields, if not 0, is the exact number of fields of a parsed
+	// line. Parse returns ErrLogLineFieldCount for the lines that don't match.
+	MinFields, ExpectedFields int
 }
 
 // Get the value of a field (either standard or custom)
@@ -85,7 +91,10 @@ func (l *LogLine) Get(f FieldIndex) []byte {
 	if e-s < 1 {
 		return nil
 	}
-	return l.data[s:e]
+	// Limit the capacity of the returned slice so that appending to it
+	// never writes into the parsed buffer, which might be shared with
+	// copies of this log line (see CopyOnWrite).
+	return l.data[s:e:e]
 }
 
 // Set changes the value of a field (either standard or custom) to a new value
@@ -104,6 +113,11 @@ func (l *LogLine) Set(f FieldIndex, data []byte) {
 
 var errLogLineTooManyFields = errors.New("LogLine has too many fields")
 
+// ErrLogLineFieldCount is returned by LogLine.Parse when the number of fields
+// of the line doesn't match MinFields or ExpectedFields. The line is parsed
+// nevertheless, so that the caller can decide to use it anyway.
+var ErrLogLineFieldCount = errors.New("LogLine has an unexpected number of fields")
+
 // Parse finds the next newline in data and parse log line fields from it into
 // the current LogLine.
 //
@@ -125,6 +139,7 @@ func (l *LogLine) Parse(text []byte, meta Metadata) error {
 			fc++
 		}
 	}
+	nfields := int(fc)
 	for ; fc <= LogLineNumFields; fc++ {
 		l.idx[fc] = int32(len(text))
 	}
@@ -133,6 +148,9 @@ func (l *LogLine) Parse(text []byte, meta Metadata) error {
 		l.meta = meta
 	}
 
+	if (l.MinFields > 0 && nfields < l.MinFields) || (l.ExpectedFields > 0 && nfields != l.ExpectedFields) {
+		return ErrLogLineFieldCount
+	}
 	return nil
 }
 
@@ -194,20 +212,37 @@ func (l *LogLine) ToText(buf []byte) []byte {
 
 // Clear clears the logline
 func (l *LogLine) Clear() {
-	*l = LogLine{FieldSeparator: l.FieldSeparator}
+	*l = LogLine{
+		FieldSeparator: l.FieldSeparator,
+		MinFields:      l.MinFields,
+		ExpectedFields: l.ExpectedFields,
+	}
 }
 
 // Meta returns the metadata having the given specific key, if any.
 func (l *LogLine) Meta(key string) (interface{}, bool) {
+	if key == MetadataLine && l.line > 0 {
+		return l.line, true
+	}
 	return l.meta.get(key)
 }
 
+// Metadata returns the metadata attached to the record by the input. The
+// line number isn't part of it, see Meta.
+func (l *LogLine) Metadata() Metadata {
+	return l.meta
+}
+
 // Cache returns the cache that is local to the current log line.
 func (l *LogLine) Cache() *Cache {
 	return &l.cache
 }
 
 // Copy creates and returns a copy of the current log line.
+//
+// The copy doesn't share any memory with l, so it remains valid after the
+// buffer passed to Parse has been reused (see CopyOnWrite for a cheaper copy
+// without that guarantee).
 func (l *LogLine) Copy() Record {
 	// Copy metadata
 	md := make(Metadata)
@@ -218,7 +253,10 @@ func (l *LogLine) Copy() Record {
 	cpy := &LogLine{
 		cache:          l.cache,
 		meta:           md,
+		line:           l.line,
 		FieldSeparator: l.FieldSeparator,
+		MinFields:      l.MinFields,
+		ExpectedFields: l.ExpectedFields,
 	}
 
 	if l.wcnt != 0 {
@@ -242,3 +280,33 @@ func (l *LogLine) Copy() Record {
 	}
 	return cpy
 }
+
+// CopyOnWrite is like Copy but, rather than duplicating the parsed buffer,
+// the returned LogLine shares it with l, and only duplicates the (small)
+// table of modified fields. Since LogLine never writes into the parsed
+// buffer, a Set on either record only affects that record.
+//
+// Since the parsed buffer is shared, the copy must not outlive the buffer
+// originally passed to Parse: in a filter, the copy is only valid until the
+// processing of the original record has finished, since the topology then
+// gives the buffer back to the input, which may reuse it.
+func (l *LogLine) CopyOnWrite() Record {
+	md := make(Metadata)
+	for k, v := range l.meta {
+		md[k] = v
+	}
+
+	return &LogLine{
+		idx:            l.idx,
+		data:           l.data,
+		meta:           md,
+		line:           l.line,
+		wmask:          l.wmask,
+		wdata:          l.wdata,
+		wcnt:           l.wcnt,
+		cache:          l.cache,
+		FieldSeparator: l.FieldSeparator,
+		MinFields:      l.MinFields,
+		ExpectedFields: l.ExpectedFields,
+	}
+}
@@ -216,3 +216,94 @@ func BenchmarkToText(b *testing.B) {
 		}
 	})
 }
+
+func TestLogLineCopyOnWrite(t *testing.T) {
+	org := &LogLine{FieldSeparator: ','}
+	if err := org.Parse([]byte("a,b,c"), nil); err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	cpy1 := org.CopyOnWrite()
+	cpy2 := org.CopyOnWrite()
+
+	cpy1.Set(0, []byte("foo"))
+	cpy2.Set(1, []byte("bar"))
+
+	// Appending to a field value must not write into the shared buffer.
+	_ = append(cpy2.Get(2), "xyz"...)
+	cpy2.Set(2, append(cpy2.Get(2), "baz"...))
+
+	tests := []struct {
+		name string
+		l    Record
+		want string
+	}{
+		{name: "original", l: org, want: "a,b,c"},
+		{name: "copy1", l: cpy1, want: "foo,b,c"},
+		{name: "copy2", l: cpy2, want: "a,bar,cbaz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.l.ToText(nil); !bytes.HasPrefix(got, []byte(tt.want)) {
+				t.Errorf("ToText() = %q, want prefix %q", got, tt.want)
+			}
+		})
+	}
+
+	// Modifying the original after the copies must not affect them either.
+	org.Set(2, []byte("modified"))
+	if got := cpy1.Get(2); !bytes.Equal(got, []byte("c")) {
+		t.Errorf("cpy1.Get(2) = %q, want %q", got, "c")
+	}
+}
+
+func TestLogLineParseFieldCount(t *testing.T) {
+	tests := []struct {
+		line          string
+		min, expected int
+		wantErr       bool
+	}{
+		{line: "a,b,c", min: 3},
+		{line: "a,b,c", min: 2},
+		{line: "a,b", min: 3, wantErr: true},
+		{line: "a,b,c", expected: 3},
+		{line: "a,b", expected: 3, wantErr: true},
+		{line: "a,b,c,d", expected: 3, wantErr: true},
+		{line: "a,,", expected: 3},
+		{line: "a,b,c,d", min: 2, expected: 4},
+		{line: "a,b,c", min: 2, expected: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ll := LogLine{FieldSeparator: ',', MinFields: tt.min, ExpectedFields: tt.expected}
+		err := ll.Parse([]byte(tt.line), nil)
+		if (err == ErrLogLineFieldCount) != tt.wantErr {
+			t.Errorf("Parse(%q) with min=%d expected=%d: err = %v, wantErr %t", tt.line, tt.min, tt.expected, err, tt.wantErr)
+		}
+		// The line is parsed anyway.
+		if got := string(ll.Get(0)); got != "a" {
+			t.Errorf("Parse(%q): field 0 = %q, want %q", tt.line, got, "a")
+		}
+	}
+}
+
+func TestLogLineCopyOwnsBuffer(t *testing.T) {
+	buf := []byte("a,b,c")
+	org := &LogLine{FieldSeparator: ','}
+	if err := org.Parse(buf, nil); err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	unchanged := org.Copy()
+	org.Set(1, org.Get(0)) // points into buf
+	modified := org.Copy()
+
+	// The input reuses the buffer once the record has been processed.
+	copy(buf, "x,y,z")
+
+	if got := unchanged.ToText(nil); string(got) != "a,b,c" {
+		t.Errorf("copy of the unchanged record = %q, want %q", got, "a,b,c")
+	}
+	if got := modified.ToText(nil); !bytes.HasPrefix(got, []byte("a,a,c")) {
+		t.Errorf("copy of the modified record = %q, want prefix %q", got, "a,a,c")
+	}
+}
@@ -0,0 +1,117 @@
+package baker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/input/inpututils"
+	"github.com/AdRoll/baker/output"
+	"github.com/AdRoll/baker/output/outputtest"
+	"github.com/AdRoll/baker/testutil"
+)
+
+// metaFilter copies the line number of the records in their second field.
+type metaFilter struct{ filtertest.Base }
+
+func (f *metaFilter) Process(l baker.Record, next func(baker.Record)) {
+	if line, ok := l.Meta(baker.MetadataLine); ok {
+		l.Set(1, []byte(strconv.FormatInt(line.(int64), 10)))
+	}
+	next(l)
+}
+
+func TestRecordMetadata(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var lines []*baker.LogLine
+	for _, id := range []string{"a", "b", "c"} {
+		ll := &baker.LogLine{FieldSeparator: ','}
+		ll.Set(0, []byte(id))
+		lines = append(lines, ll)
+	}
+	meta := baker.Metadata{
+		inpututils.MetadataS3Bucket: "bucket",
+		inpututils.MetadataS3Key:    "path/to/file.log.gz",
+	}
+
+	dir := t.TempDir()
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.LogLineDesc},
+		Filters: []baker.FilterDesc{{
+			Name:   "Meta",
+			New:    func(baker.FilterParams) (baker.Filter, error) { return &metaFilter{}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc, output.FileWriterDesc},
+	}
+	cfg := baker.Config{
+		Input: baker.ConfigInput{
+			Name:          "LogLine",
+			DecodedConfig: &inputtest.LogLineConfig{Lines: lines, Metadata: meta, FirstLine: 10},
+		},
+		Filter: []baker.ConfigFilter{{Name: "Meta"}},
+		Output: []baker.ConfigOutput{
+			{Name: "Recorder", Procs: 1, Fields: []string{"id", "line"}},
+			{
+				Name:  "FileWriter",
+				Procs: 1,
+				DecodedConfig: &output.FileWriterConfig{
+					PathString:     filepath.Join(dir, "{{.Meta.s3_bucket}}", "{{.Meta.s3_key}}", "{{.Meta.missing}}.log"),
+					Compression:    "none",
+					RotateInterval: -1,
+				},
+			},
+		},
+		Fields: baker.ConfigFields{Names: []string{"id", "line"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata set by the input is readable by the filters and the
+	// outputs, and records are numbered after the first line.
+	var got []string
+	for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+		if key := r.Meta[inpututils.MetadataS3Key]; key != "path/to/file.log.gz" {
+			t.Errorf("record %v: s3 key metadata = %v, want %q", r.Fields, key, "path/to/file.log.gz")
+		}
+		if strconv.FormatInt(r.Line, 10) != r.Fields[1] {
+			t.Errorf("record %v: line = %d, want %s", r.Fields, r.Line, r.Fields[1])
+		}
+		got = append(got, strings.Join(r.Fields, ":"))
+	}
+	sort.Strings(got)
+	if want := "a:10 b:11 c:12"; strings.Join(got, " ") != want {
+		t.Errorf("output records = %q, want %q", strings.Join(got, " "), want)
+	}
+
+	// The FileWriter path is resolved with the metadata.
+	path := filepath.Join(dir, "bucket", "path/to/file.log.gz", "__default__.log")
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		var files []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			files = append(files, path)
+			return nil
+		})
+		t.Fatalf("%v, files written: %q", err, files)
+	}
+	if n := strings.Count(string(buf), "\n"); n != 3 {
+		t.Errorf("%s has %d records, want 3", path, n)
+	}
+}
@@ -1,7 +1,9 @@
 package baker
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -9,63 +11,148 @@ import (
 // every Baker components, through their Stats method.
 // Stats() is called once per second, and contains a MetricsBag filled
 // with values relative to that last second.
-type MetricsBag map[string]interface{}
+//
+// A MetricsBag is safe for concurrent use, so that a component may add
+// values to a bag from multiple goroutines. The zero value is an empty bag,
+// ready to use. A MetricsBag must not be copied after first use.
+type MetricsBag struct {
+	mu      sync.Mutex
+	metrics map[string]interface{}
+}
+
+// set sets the value of key, bag.mu must be held.
+func (bag *MetricsBag) set(key string, value interface{}) {
+	if bag.metrics == nil {
+		bag.metrics = make(map[string]interface{})
+	}
+	bag.metrics[key] = value
+}
 
 // AddRawCounter adds a counter that always increments.
-func (bag MetricsBag) AddRawCounter(name string, value int64) {
-	bag["c:"+name] = value
+func (bag *MetricsBag) AddRawCounter(name string, value int64) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	bag.set("c:"+name, value)
 }
 
 // AddDeltaCounter adds a count of something that happened in the last second
-func (bag MetricsBag) AddDeltaCounter(name string, delta int64) {
-	bag["d:"+name] = delta
+func (bag *MetricsBag) AddDeltaCounter(name string, delta int64) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	bag.set("d:"+name, delta)
 }
 
 // AddGauge takes a snapshot of a value.
-func (bag MetricsBag) AddGauge(name string, value float64) {
-	bag["g:"+name] = value
+func (bag *MetricsBag) AddGauge(name string, value float64) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	bag.set("g:"+name, value)
 }
 
-// AddHistogram adds a set of values to track their statistical distribution.
-func (bag MetricsBag) AddHistogram(name string, values []float64) {
-	bag["h:"+name] = values
+// AddHistogram adds an observation of a value, to track the statistical
+// distribution of the values of name. Each value is reported as a sample via
+// MetricsClient.Histogram, so that percentiles can be computed by the metrics
+// backend.
+func (bag *MetricsBag) AddHistogram(name string, value float64) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	key := "h:" + name
+	values, _ := bag.metrics[key].([]float64)
+	bag.set(key, append(values, value))
+}
+
+// SetHistogramBuckets declares the boundaries of the buckets of the name
+// histogram, that is the upper bounds of its buckets, in increasing order.
+// They're passed to the metrics clients counting the histogram samples in
+// fixed buckets (see HistogramBucketer), the other clients ignore them.
+func (bag *MetricsBag) SetHistogramBuckets(name string, buckets []float64) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	bag.set("b:"+name, buckets)
 }
 
 // AddTimings adds a set of timings to track their statistical distribution.
-func (bag MetricsBag) AddTimings(name string, values []time.Duration) {
-	bag["t:"+name] = values
+// Each timing is reported as a sample via MetricsClient.Duration.
+func (bag *MetricsBag) AddTimings(name string, values []time.Duration) {
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	bag.set("t:"+name, values)
+}
+
+// Get returns the value of the metric with the given key, that is its name
+// prefixed by its type ("c:" for raw counters, "d:" for delta counters, "g:"
+// for gauges, "h:" for histograms, "b:" for histogram buckets and "t:" for
+// timings), or nil if there's none.
+func (bag *MetricsBag) Get(key string) interface{} {
+	if bag == nil {
+		return nil
+	}
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	return bag.metrics[key]
+}
+
+// Snapshot returns a copy of all the metrics of the bag, by key (see Get).
+func (bag *MetricsBag) Snapshot() map[string]interface{} {
+	if bag == nil {
+		return nil
+	}
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	snap := make(map[string]interface{}, len(bag.metrics))
+	for k, v := range bag.metrics {
+		snap[k] = v
+	}
+	return snap
+}
+
+// MarshalJSON implements json.Marshaler, encoding the metrics by key (see
+// Get).
+func (bag *MetricsBag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bag.Snapshot())
 }
 
 // Merge merges another MetricsBag into this 'bag'.
-func (bag MetricsBag) Merge(other MetricsBag) {
-	for key, val := range other {
+func (bag *MetricsBag) Merge(other *MetricsBag) {
+	// Both bags are never locked at the same time.
+	metrics := other.Snapshot()
+
+	bag.mu.Lock()
+	defer bag.mu.Unlock()
+	for key, val := range metrics {
 		switch key[0] {
 		case 'c', 'd':
 			// Counters and deltas should be summed
-			if _, ok := bag[key]; !ok {
-				bag[key] = int64(0)
+			if _, ok := bag.metrics[key]; !ok {
+				bag.set(key, int64(0))
 			}
-			bag[key] = bag[key].(int64) + val.(int64)
+			bag.set(key, bag.metrics[key].(int64)+val.(int64))
 		case 'g':
 			// Gauges must be averaged
-			if _, ok := bag[key]; !ok {
-				bag[key] = val.(float64)
+			if _, ok := bag.metrics[key]; !ok {
+				bag.set(key, val.(float64))
 			}
-			bag[key] = (bag[key].(float64) + val.(float64)) / 2
+			bag.set(key, (bag.metrics[key].(float64)+val.(float64))/2)
 
 		case 'h':
 			// Histograms are concatenated
-			if _, ok := bag[key]; !ok {
-				bag[key] = []float64{}
+			if _, ok := bag.metrics[key]; !ok {
+				bag.set(key, []float64{})
+			}
+			bag.set(key, append(bag.metrics[key].([]float64), val.([]float64)...))
+
+		case 'b':
+			// Histogram buckets are all the same, keep the first ones
+			if _, ok := bag.metrics[key]; !ok {
+				bag.set(key, val)
 			}
-			bag[key] = append(bag[key].([]float64), val.([]float64)...)
 
 		case 't':
 			// timings are concatenated
-			if _, ok := bag[key]; !ok {
-				bag[key] = []time.Duration{}
+			if _, ok := bag.metrics[key]; !ok {
+				bag.set(key, []time.Duration{})
 			}
-			bag[key] = append(bag[key].([]time.Duration), val.([]time.Duration)...)
+			bag.set(key, append(bag.metrics[key].([]time.Duration), val.([]time.Duration)...))
 
 		default:
 			panic(fmt.Errorf("unsupported key %q", key))
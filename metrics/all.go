@@ -4,9 +4,11 @@ package metrics
 import (
 	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/metrics/datadog"
+	"github.com/AdRoll/baker/metrics/statsd"
 )
 
 // All is the list of all metrics client supported by Baker.
 var All = []baker.MetricsDesc{
 	datadog.Desc,
+	statsd.Desc,
 }
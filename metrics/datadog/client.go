@@ -22,10 +22,10 @@ var Desc = baker.MetricsDesc{
 
 // Config is the configuration of the Datadog metrics client.
 type Config struct {
-	Prefix   string   // Prefix is the prefix of all metric names. defaults to baker.
-	Host     string   // Host is the address (host:port) of the statsd host to send log to (in UDP). defaults to 127.0.0.1:8125.
-	Tags     []string // Tags is the list of tags to attach to all metrics.
-	SendLogs bool     `toml:"send_logs"` // SendLogs indicates whether logs should be sent (as statds events) to the statsd client at Host.
+	Prefix   string   `help:"Prefix of all metric names" default:"baker."`
+	Host     string   `help:"Address (host:port) of the statsd host to send metrics to (in UDP)" default:"127.0.0.1:8125"`
+	Tags     []string `help:"List of tags to attach to all metrics"`
+	SendLogs bool     `toml:"send_logs" help:"Whether logs should be sent (as statsd events) to the statsd host"`
 }
 
 // Client allows to instrument code and export the metrics to a dogstatds client.
@@ -70,6 +70,12 @@ func newClient(icfg interface{}) (baker.MetricsClient, error) {
 	return dd, nil
 }
 
+// Close sends the pending metrics and closes the connection to the dogstatsd
+// client.
+func (c *Client) Close() error {
+	return c.dog.Close()
+}
+
 // Gauge sets the value of a metric of type gauge. A Gauge represents a
 // single numerical data point that can arbitrarily go up and down.
 func (c *Client) Gauge(name string, value float64) {
@@ -0,0 +1,253 @@
+// Package statsd provides types and functions to export metrics to a
+// vanilla StatsD server (or any server understanding the StatsD line
+// protocol, like Telegraf).
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ddstatsd "github.com/DataDog/datadog-go/statsd"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+// Desc describes the StatsD metrics client inteface.
+var Desc = baker.MetricsDesc{
+	Name:   "StatsD",
+	Config: &Config{},
+	New:    newClient,
+}
+
+// maxPacketSize is the maximum size of a UDP packet sent to the StatsD
+// server, it's chosen so that packets fit in the ethernet MTU.
+const maxPacketSize = 1432
+
+// Config is the configuration of the StatsD metrics client.
+type Config struct {
+	Host          string        `help:"Host of the StatsD server to send metrics to (in UDP)" default:"127.0.0.1"`
+	Port          int           `help:"Port of the StatsD server to send metrics to (in UDP)" default:"8125"`
+	Prefix        string        `help:"Prefix of all metric names" default:"baker."`
+	FlushInterval time.Duration `help:"Period at which buffered metrics are sent to the StatsD server" default:"1s"`
+}
+
+func (cfg *Config) fillDefaults() {
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8125
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "baker."
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Second
+	}
+}
+
+// Client allows to instrument code and export the metrics to a StatsD server.
+//
+// Client shares the buffering and the flush loop of the Datadog client, both
+// being based on the datadog-go client: metrics are buffered and sent in
+// batches, each UDP packet containing as many metrics as it can without
+// exceeding the MTU. Failing to send a packet never blocks the caller, the
+// metrics contained in that packet are then dropped, a warning is logged and
+// they're counted in the statsd.dropped_metrics counter.
+//
+// Since StatsD doesn't support tags, the *WithTags methods ignore them.
+type Client struct {
+	dog *ddstatsd.Client
+	w   *udpWriter
+
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+// newClient creates a baker.MetricsClient that pushes metrics to a StatsD
+// server, using the StatsD line protocol over UDP. All exported metrics have
+// a name prepended with the configured prefix.
+func newClient(icfg interface{}) (baker.MetricsClient, error) {
+	cfg := icfg.(*Config)
+	cfg.fillDefaults()
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't create statsd metrics client: %s", err)
+	}
+
+	w := &udpWriter{conn: conn}
+	dog, err := ddstatsd.NewWithWriter(w,
+		ddstatsd.WithNamespace(cfg.Prefix),
+		ddstatsd.WithMaxBytesPerPayload(maxPacketSize),
+		ddstatsd.WithBufferPoolSize(ddstatsd.DefaultUDPBufferPoolSize),
+		ddstatsd.WithSenderQueueSize(ddstatsd.DefaultUDPBufferPoolSize),
+		ddstatsd.WithBufferFlushInterval(cfg.FlushInterval))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can't create statsd metrics client: %s", err)
+	}
+	// StatsD doesn't support tags, not even the ones datadog-go may add to
+	// all the metrics.
+	dog.Tags = nil
+
+	return &Client{
+		dog:      dog,
+		w:        w,
+		counters: make(map[string]int64),
+	}, nil
+}
+
+// Close sends the pending metrics, stops the flush loop and closes the
+// connection to the StatsD server.
+func (c *Client) Close() error {
+	return c.dog.Close()
+}
+
+// telemetryPrefix prefixes the names of the metrics datadog-go periodically
+// reports about itself. They have Datadog tags, which StatsD doesn't support.
+const telemetryPrefix = "datadog.dogstatsd.client."
+
+// udpWriter writes the metrics payloads built by the datadog-go client to the
+// StatsD server, counting the metrics it couldn't send.
+type udpWriter struct {
+	conn net.Conn
+
+	mu  sync.Mutex // Write may be called by concurrent flushes
+	buf []byte
+
+	dropped    int64 // number of metrics that couldn't be sent
+	unreported int64 // number of dropped metrics, not reported yet
+}
+
+func (w *udpWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = w.buf[:0]
+	nmetrics := int64(0)
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 || bytes.HasPrefix(line, []byte(telemetryPrefix)) {
+			continue
+		}
+		if len(w.buf) > 0 {
+			w.buf = append(w.buf, '\n')
+		}
+		w.buf = append(w.buf, line...)
+		nmetrics++
+	}
+	if nmetrics == 0 {
+		return len(data), nil
+	}
+
+	// Do not let a slow network block the flushes.
+	w.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := w.conn.Write(w.buf); err != nil {
+		dropped := atomic.AddInt64(&w.dropped, nmetrics)
+		atomic.AddInt64(&w.unreported, nmetrics)
+		log.WithError(err).WithFields(log.Fields{"metrics": nmetrics, "total_dropped": dropped}).Warn("statsd: can't send metrics")
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *udpWriter) SetWriteTimeout(time.Duration) error { return nil }
+
+func (w *udpWriter) Close() error { return w.conn.Close() }
+
+// reportDropped reports the number of metrics dropped since its last call,
+// if any. Metrics can't be sent from the udpWriter, which is called by the
+// client while it's locked, so they're reported with the next metric sent.
+func (c *Client) reportDropped() {
+	if n := atomic.SwapInt64(&c.w.unreported, 0); n > 0 {
+		c.dog.Count("statsd.dropped_metrics", n, nil, 1)
+	}
+}
+
+// rawToDelta converts the current value of a cumulative counter into the
+// increment since the last time it has been reported.
+func (c *Client) rawToDelta(name string, value int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delta := value - c.counters[name]
+	if delta < 0 {
+		delta = 0
+	}
+	c.counters[name] = value
+	return delta
+}
+
+// Gauge sets the value of a metric of type gauge. A Gauge represents a
+// single numerical data point that can arbitrarily go up and down.
+func (c *Client) Gauge(name string, value float64) {
+	c.reportDropped()
+	c.dog.Gauge(name, value, nil, 1)
+}
+
+// DeltaCount increments the value of a metric of type counter by delta.
+// delta must be positive.
+func (c *Client) DeltaCount(name string, delta int64) {
+	c.reportDropped()
+	c.dog.Count(name, delta, nil, 1)
+}
+
+// RawCount sets the value of a metric of type counter. A counter is a
+// cumulative metrics that can only increase. RawCount sets the current
+// value of the counter.
+func (c *Client) RawCount(name string, value int64) {
+	c.DeltaCount(name, c.rawToDelta(name, value))
+}
+
+// Histogram adds a sample to a metric of type histogram. A histogram
+// samples observations and counts them in different 'buckets' in order
+// to track and show the statistical distribution of a set of values.
+//
+// In StatsD, this is sent as a 'timer', on which percentiles, mean and
+// other info are calculated.
+func (c *Client) Histogram(name string, value float64) {
+	c.reportDropped()
+	c.dog.TimeInMilliseconds(name, value, nil, 1)
+}
+
+// Duration adds a duration to a metric of type histogram. A histogram
+// samples observations and counts them in different 'buckets'. Duration
+// is basically an histogram but allows to sample values of type time.Duration.
+//
+// In StatsD, this is sent as a 'timer', in milliseconds.
+func (c *Client) Duration(name string, value time.Duration) {
+	c.reportDropped()
+	c.dog.TimeInMilliseconds(name, float64(value)/float64(time.Millisecond), nil, 1)
+}
+
+// GaugeWithTags is equivalent to Gauge, tags are ignored.
+func (c *Client) GaugeWithTags(name string, value float64, tags []string) {
+	c.Gauge(name, value)
+}
+
+// DeltaCountWithTags is equivalent to DeltaCount, tags are ignored.
+func (c *Client) DeltaCountWithTags(name string, delta int64, tags []string) {
+	c.DeltaCount(name, delta)
+}
+
+// RawCountWithTags is equivalent to RawCount, tags are ignored.
+func (c *Client) RawCountWithTags(name string, value int64, tags []string) {
+	c.RawCount(name, value)
+}
+
+// HistogramWithTags is equivalent to Histogram, tags are ignored.
+func (c *Client) HistogramWithTags(name string, value float64, tags []string) {
+	c.Histogram(name, value)
+}
+
+// DurationWithTags is equivalent to Duration, tags are ignored.
+func (c *Client) DurationWithTags(name string, value time.Duration, tags []string) {
+	c.Duration(name, value)
+}
@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker/testutil"
+)
+
+// listen starts a fake StatsD server, listening on UDP, and returns its
+// address as well as a function that, when called, stops the server and
+// returns all received packets.
+func listen(t *testing.T) (host string, port int, stop func() []string) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen on udp: %v", err)
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	var packets []string
+
+	go func() {
+		defer close(done)
+
+		p := make([]byte, 32*1024)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+				conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+				n, _, err := conn.ReadFrom(p)
+				if err != nil {
+					break
+				}
+				packets = append(packets, string(p[:n]))
+			}
+		}
+	}()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	return addr.IP.String(), addr.Port, func() []string {
+		close(quit)
+		<-done
+		conn.Close()
+		return packets
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	host, port, stop := listen(t)
+
+	c, err := newClient(&Config{
+		Host:          host,
+		Port:          port,
+		Prefix:        "prefix.",
+		FlushInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("can't create statsd metrics client: %v", err)
+	}
+
+	c.DeltaCount("delta", 1)
+	c.DeltaCountWithTags("delta-with-tags", 2, []string{"tag1:1"})
+	c.Duration("duration", 3*time.Millisecond)
+	c.Gauge("gauge", 5.5)
+	c.Histogram("histogram", 7)
+	c.RawCount("raw-count", 17)
+	c.RawCount("raw-count", 20)
+	c.(*Client).Close()
+
+	time.Sleep(300 * time.Millisecond)
+	packets := stop()
+
+	want := []string{
+		"prefix.delta:1|c",
+		"prefix.delta-with-tags:2|c",
+		"prefix.duration:3.000000|ms",
+		"prefix.gauge:5.5|g",
+		"prefix.histogram:7.000000|ms",
+		"prefix.raw-count:17|c",
+		"prefix.raw-count:3|c",
+	}
+
+	var got []string
+	for _, p := range packets {
+		got = append(got, strings.Split(p, "\n")...)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestClientBatching(t *testing.T) {
+	host, port, stop := listen(t)
+
+	c, err := newClient(&Config{
+		Host:          host,
+		Port:          port,
+		FlushInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("can't create statsd metrics client: %v", err)
+	}
+
+	const nmetrics = 500
+	for i := 0; i < nmetrics; i++ {
+		c.Gauge("gauge"+strconv.Itoa(i), float64(i))
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	packets := stop()
+
+	if len(packets) < 2 {
+		t.Errorf("got %d packets, want metrics to be split in multiple packets", len(packets))
+	}
+
+	n := 0
+	for _, p := range packets {
+		if len(p) > maxPacketSize {
+			t.Errorf("packet size = %d, want <= %d", len(p), maxPacketSize)
+		}
+		n += len(strings.Split(p, "\n"))
+	}
+	if n != nmetrics {
+		t.Errorf("received %d metrics, want %d", n, nmetrics)
+	}
+}
+
+func TestClientDropOnError(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	host, port, stop := listen(t)
+
+	mc, err := newClient(&Config{
+		Host:          host,
+		Port:          port,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("can't create statsd metrics client: %v", err)
+	}
+	c := mc.(*Client)
+
+	// Closing the connection makes the next flush fail.
+	conn := c.w.conn
+	closed, err := net.Dial("udp", conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	c.w.mu.Lock()
+	c.w.conn = closed
+	c.w.mu.Unlock()
+
+	c.Gauge("gauge1", 1)
+	c.Gauge("gauge2", 2)
+	c.dog.Flush()
+
+	if got := atomic.LoadInt64(&c.w.dropped); got != 2 {
+		t.Errorf("dropped = %d, want 2", got)
+	}
+
+	// The dropped metrics are reported along with the next metrics.
+	c.w.mu.Lock()
+	c.w.conn = conn
+	c.w.mu.Unlock()
+	c.Gauge("gauge3", 3)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	packets := stop()
+
+	var got []string
+	for _, p := range packets {
+		got = append(got, strings.Split(p, "\n")...)
+	}
+	if want := []string{"baker.statsd.dropped_metrics:2|c", "baker.gauge3:3|g"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	host, port, stop := listen(t)
+	defer stop()
+
+	mc, err := newClient(&Config{Host: host, Port: port})
+	if err != nil {
+		t.Fatalf("can't create statsd metrics client: %v", err)
+	}
+	c := mc.(*Client)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	// The connection to the server is closed.
+	if _, err := c.w.conn.Write([]byte("gauge:1|g")); err == nil {
+		t.Errorf("connection still open after Close")
+	}
+}
+
+func TestUDPWriterTelemetry(t *testing.T) {
+	host, port, stop := listen(t)
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &udpWriter{conn: conn}
+	defer w.Close()
+
+	// datadog-go reports metrics about itself, with Datadog tags.
+	w.Write([]byte("a:1|c\ndatadog.dogstatsd.client.packets_sent:3|c|#client:go\nb:2|g"))
+	w.Write([]byte("datadog.dogstatsd.client.bytes_sent:10|c|#client:go"))
+
+	time.Sleep(300 * time.Millisecond)
+	packets := stop()
+
+	if want := []string{"a:1|c\nb:2|g"}; !reflect.DeepEqual(packets, want) {
+		t.Errorf("received %q, want %q", packets, want)
+	}
+}
@@ -8,7 +8,24 @@ import (
 // metrics to the metrics backend that is configured in Baker.
 //
 // New metrics backends must implement this interface and register their
-// description as a MetricDesc in Components.Metrics. See ./examples/metrics.
+// description as a MetricsDesc in Components.Metrics, exactly as it's done for
+// the other components. The client is then chosen by its name, in the
+// [metrics] section of the TOML configuration, and created by calling
+// MetricsDesc.New with the decoded [metrics.config] section.
+// See ./examples/metrics.
+//
+// Components can directly use the client they receive in ComponentParams.
+// Besides, every second, Baker gathers the MetricsBag reported by all
+// components and forwards each metric to the client:
+//   - AddRawCounter values are reported with RawCount
+//   - AddDeltaCounter values are reported with DeltaCount
+//   - AddGauge values are reported with Gauge
+//   - AddHistogram values are reported, one by one, with Histogram (after
+//     SetHistogramBuckets buckets, for a HistogramBucketer client)
+//   - AddTimings values are reported, one by one, with Duration
+//
+// A MetricsClient may implement io.Closer, in which case Main closes it once
+// the topology is done and the stats have been dumped one last time.
 type MetricsClient interface {
 
 	// Gauge sets the value of a metric of type gauge. A Gauge represents a
@@ -54,3 +71,15 @@ type MetricsClient interface {
 	// duration with a set of tags.
 	DurationWithTags(name string, value time.Duration, tags []string)
 }
+
+// A HistogramBucketer is a MetricsClient counting the samples of its
+// histograms in fixed buckets, like Prometheus histograms do. Before
+// reporting the samples of an histogram, Baker passes it the buckets declared
+// with MetricsBag.SetHistogramBuckets, if any.
+type HistogramBucketer interface {
+	MetricsClient
+
+	// SetHistogramBuckets sets the upper bounds of the buckets of the
+	// histogram name, in increasing order.
+	SetHistogramBuckets(name string, buckets []float64)
+}
@@ -3,13 +3,14 @@ package baker
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestMerge(t *testing.T) {
-	b1 := MetricsBag{}
-	b2 := MetricsBag{}
+	b1 := &MetricsBag{}
+	b2 := &MetricsBag{}
 
 	b1.AddDeltaCounter("delta1", 1)
 	b1.AddGauge("gauge1", 2.2)
@@ -29,131 +30,184 @@ func TestMerge(t *testing.T) {
 
 	b1.Merge(b2)
 
-	if b1["d:delta1"] != int64(8) {
-		t.Errorf("got %d want 8", b1["d:delta1"])
+	if b1.Get("d:delta1") != int64(8) {
+		t.Errorf("got %d want 8", b1.Get("d:delta1"))
 	}
-	if b1["d:delta2"] != int64(4) {
-		t.Errorf("got %d want 4", b1["d:delta2"])
+	if b1.Get("d:delta2") != int64(4) {
+		t.Errorf("got %d want 4", b1.Get("d:delta2"))
 	}
-	if b1["d:delta3"] != int64(10) {
-		t.Errorf("got %d want 10", b1["d:delta3"])
+	if b1.Get("d:delta3") != int64(10) {
+		t.Errorf("got %d want 10", b1.Get("d:delta3"))
 	}
 
-	if b1["g:gauge1"] != float64(5.5) {
-		t.Errorf("got %d want 5.5", b1["d:gauge1"])
+	if b1.Get("g:gauge1") != float64(5.5) {
+		t.Errorf("got %d want 5.5", b1.Get("d:gauge1"))
 	}
-	if b1["g:gauge2"] != float64(5.5) {
-		t.Errorf("got %d want 5.5", b1["d:gauge2"])
+	if b1.Get("g:gauge2") != float64(5.5) {
+		t.Errorf("got %d want 5.5", b1.Get("d:gauge2"))
 	}
-	if b1["g:gauge3"] != float64(11.11) {
-		t.Errorf("got %d want 11.11", b1["d:gauge3"])
+	if b1.Get("g:gauge3") != float64(11.11) {
+		t.Errorf("got %d want 11.11", b1.Get("d:gauge3"))
 	}
 
-	if b1["c:raw1"] != int64(12) {
-		t.Errorf("got %d want 12", b1["d:raw1"])
+	if b1.Get("c:raw1") != int64(12) {
+		t.Errorf("got %d want 12", b1.Get("d:raw1"))
 	}
-	if b1["c:raw2"] != int64(6) {
-		t.Errorf("got %d want 6", b1["d:raw2"])
+	if b1.Get("c:raw2") != int64(6) {
+		t.Errorf("got %d want 6", b1.Get("d:raw2"))
 	}
-	if b1["c:raw3"] != int64(12) {
-		t.Errorf("got %d want 12", b1["d:raw3"])
+	if b1.Get("c:raw3") != int64(12) {
+		t.Errorf("got %d want 12", b1.Get("d:raw3"))
 	}
 }
 
 func TestMergeHistogram(t *testing.T) {
 	t.Run("both non-nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
-		b1.AddHistogram("hist", []float64{1, 2})
-		b2.AddHistogram("hist", []float64{3, 4})
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
+		for _, v := range []float64{1, 2} {
+			b1.AddHistogram("hist", v)
+		}
+		for _, v := range []float64{3, 4} {
+			b2.AddHistogram("hist", v)
+		}
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["h:hist"], []float64{1, 2, 3, 4}) {
-			t.Errorf("got %v want [1, 2, 3, 4]", b1["h:hist"])
+		if !reflect.DeepEqual(b1.Get("h:hist"), []float64{1, 2, 3, 4}) {
+			t.Errorf("got %v want [1, 2, 3, 4]", b1.Get("h:hist"))
 		}
 	})
 
 	t.Run("b1 nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
-		b2.AddHistogram("hist", []float64{3, 4})
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
+		for _, v := range []float64{3, 4} {
+			b2.AddHistogram("hist", v)
+		}
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["h:hist"], []float64{3, 4}) {
-			t.Errorf("got %v want [3, 4]", b1["h:hist"])
+		if !reflect.DeepEqual(b1.Get("h:hist"), []float64{3, 4}) {
+			t.Errorf("got %v want [3, 4]", b1.Get("h:hist"))
 		}
 	})
 
 	t.Run("b2 nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
-		b1.AddHistogram("hist", []float64{1, 2})
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
+		for _, v := range []float64{1, 2} {
+			b1.AddHistogram("hist", v)
+		}
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["h:hist"], []float64{1, 2}) {
-			t.Errorf("got %v want [1, 2]", b1["h:hist"])
+		if !reflect.DeepEqual(b1.Get("h:hist"), []float64{1, 2}) {
+			t.Errorf("got %v want [1, 2]", b1.Get("h:hist"))
 		}
 	})
 
 	t.Run("both nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
 		b1.Merge(b2)
 
-		if _, ok := b1["h:hist"]; ok {
-			t.Errorf("got %v want nil", b1["h:hist"])
+		if b1.Get("h:hist") != nil {
+			t.Errorf("got %v want nil", b1.Get("h:hist"))
 		}
 	})
 }
 
+func TestMergeHistogramBuckets(t *testing.T) {
+	b1 := &MetricsBag{}
+	b2 := &MetricsBag{}
+	b2.SetHistogramBuckets("hist", []float64{1, 10})
+	b2.SetHistogramBuckets("other", []float64{5})
+	b1.SetHistogramBuckets("other", []float64{2, 4})
+
+	b1.Merge(b2)
+
+	if !reflect.DeepEqual(b1.Get("b:hist"), []float64{1, 10}) {
+		t.Errorf("got %v want [1, 10]", b1.Get("b:hist"))
+	}
+	if !reflect.DeepEqual(b1.Get("b:other"), []float64{2, 4}) {
+		t.Errorf("got %v want [2, 4]", b1.Get("b:other"))
+	}
+}
+
+func TestMetricsBagConcurrentAdds(t *testing.T) {
+	const goroutines, adds = 8, 100
+
+	bag := &MetricsBag{}
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			other := &MetricsBag{}
+			other.AddDeltaCounter("delta", 1)
+			for j := 0; j < adds; j++ {
+				bag.AddHistogram("hist", float64(j))
+				bag.AddGauge(fmt.Sprintf("gauge%d", i), float64(j))
+			}
+			bag.Merge(other)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(bag.Get("h:hist").([]float64)); got != goroutines*adds {
+		t.Errorf("histogram has %d values, want %d", got, goroutines*adds)
+	}
+	if got := bag.Get("d:delta"); got != int64(goroutines) {
+		t.Errorf("delta = %v, want %d", got, goroutines)
+	}
+}
+
 func TestMergeTimings(t *testing.T) {
 	t.Run("both non-nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
 		b1.AddTimings("time", []time.Duration{1, 2})
 		b2.AddTimings("time", []time.Duration{3, 4})
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["t:time"], []time.Duration{1, 2, 3, 4}) {
-			t.Errorf("got %v want [1, 2, 3, 4]", b1["t:time"])
+		if !reflect.DeepEqual(b1.Get("t:time"), []time.Duration{1, 2, 3, 4}) {
+			t.Errorf("got %v want [1, 2, 3, 4]", b1.Get("t:time"))
 		}
 	})
 
 	t.Run("b1 nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
 		b2.AddTimings("time", []time.Duration{3, 4})
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["t:time"], []time.Duration{3, 4}) {
-			t.Errorf("got %v want [3, 4]", b1["t:time"])
+		if !reflect.DeepEqual(b1.Get("t:time"), []time.Duration{3, 4}) {
+			t.Errorf("got %v want [3, 4]", b1.Get("t:time"))
 		}
 	})
 
 	t.Run("b2 nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
 		b1.AddTimings("time", []time.Duration{1, 2})
 
 		b1.Merge(b2)
 
-		if !reflect.DeepEqual(b1["t:time"], []time.Duration{1, 2}) {
-			t.Errorf("got %v want [1, 2]", b1["t:time"])
+		if !reflect.DeepEqual(b1.Get("t:time"), []time.Duration{1, 2}) {
+			t.Errorf("got %v want [1, 2]", b1.Get("t:time"))
 		}
 	})
 
 	t.Run("both nil", func(t *testing.T) {
-		b1 := MetricsBag{}
-		b2 := MetricsBag{}
+		b1 := &MetricsBag{}
+		b2 := &MetricsBag{}
 		b1.Merge(b2)
 
-		if _, ok := b1["t:time"]; ok {
-			t.Errorf("got %v want nil", b1["t:time"])
+		if b1.Get("t:time") != nil {
+			t.Errorf("got %v want nil", b1.Get("t:time"))
 		}
 	})
 }
@@ -171,9 +225,9 @@ func TestPanicMerge(t *testing.T) {
 		}
 	}()
 
-	b1 := MetricsBag{}
-	b2 := MetricsBag{}
-	b2["pippo"] = 3
+	b1 := &MetricsBag{}
+	b2 := &MetricsBag{}
+	b2.set("pippo", 3)
 
 	// The following is the code under test
 	b1.Merge(b2)
@@ -0,0 +1,316 @@
+package baker_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+func TestMultipleOutputs(t *testing.T) {
+	toml := `
+[fields]
+names=["field0", "field1"]
+
+[input]
+name="Records"
+
+[[output]]
+name="Recorder"
+procs=1
+fields=["field1"]
+
+[[output]]
+name="RawRecorder"
+procs=1
+fields=["field0", "field1"]
+`
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc, outputtest.RawRecorderDesc},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Output) != 2 {
+		t.Fatalf("got %d outputs in config, want 2", len(cfg.Output))
+	}
+
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := topology.Input.(*inputtest.Records)
+	for i := 0; i < 10; i++ {
+		ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		ll.Set(0, []byte("value0"))
+		ll.Set(1, []byte("value1"))
+		in.Records = append(in.Records, &ll)
+	}
+
+	topology.Start()
+	topology.Wait()
+
+	if len(topology.Output) != 2 {
+		t.Fatalf("got %d output instances, want 2", len(topology.Output))
+	}
+
+	rec := topology.Output[0].(*outputtest.Recorder)
+	if len(rec.Records) != 10 {
+		t.Fatalf("Recorder got %d records, want 10", len(rec.Records))
+	}
+	for _, r := range rec.Records {
+		if len(r.Fields) != 1 || r.Fields[0] != "value1" {
+			t.Errorf("Recorder got fields %q, want %q", r.Fields, []string{"value1"})
+		}
+		if r.Record != nil {
+			t.Errorf("Recorder got raw record %q, want nil", r.Record)
+		}
+	}
+
+	raw := topology.Output[1].(*outputtest.Recorder)
+	if len(raw.Records) != 10 {
+		t.Fatalf("RawRecorder got %d records, want 10", len(raw.Records))
+	}
+	for _, r := range raw.Records {
+		if len(r.Fields) != 2 || r.Fields[0] != "value0" || r.Fields[1] != "value1" {
+			t.Errorf("RawRecorder got fields %q, want %q", r.Fields, []string{"value0", "value1"})
+		}
+		if !strings.HasPrefix(string(r.Record), "value0,value1") {
+			t.Errorf("RawRecorder got raw record %q, want prefix %q", r.Record, "value0,value1")
+		}
+	}
+}
+
+// releaseOutput closes release once it has received n records.
+type releaseOutput struct {
+	outputtest.Recorder
+	n       int
+	release chan struct{}
+}
+
+func (o *releaseOutput) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	for lldata := range input {
+		o.Records = append(o.Records, lldata)
+		if len(o.Records) == o.n {
+			close(o.release)
+		}
+	}
+	return nil
+}
+
+// stuckOutput doesn't read any records until release is closed.
+type stuckOutput struct {
+	outputtest.Recorder
+	release chan struct{}
+}
+
+func (o *stuckOutput) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	<-o.release
+	return o.Recorder.Run(input, upch)
+}
+
+func TestMultipleOutputsOverflowPolicy(t *testing.T) {
+	const nrecords = 100
+
+	toml := `
+[fields]
+names=["field0"]
+
+[input]
+name="Records"
+
+[filterchain]
+procs=1
+
+[[output]]
+name="Stuck"
+procs=1
+chansize=2
+overflowpolicy="drop_newest"
+fields=["field0"]
+
+[[output]]
+name="Release"
+procs=1
+fields=["field0"]
+`
+	release := make(chan struct{})
+	stuck := &stuckOutput{release: release}
+	c := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{
+			{
+				Name:   "Stuck",
+				New:    func(baker.OutputParams) (baker.Output, error) { return stuck, nil },
+				Config: &struct{}{},
+			},
+			{
+				Name: "Release",
+				New: func(baker.OutputParams) (baker.Output, error) {
+					return &releaseOutput{n: nrecords, release: release}, nil
+				},
+				Config: &struct{}{},
+			},
+		},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := topology.Input.(*inputtest.Records)
+	for i := 0; i < nrecords; i++ {
+		ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		ll.Set(0, []byte(strconv.Itoa(i)))
+		in.Records = append(in.Records, &ll)
+	}
+
+	// The stuck output doesn't stall the other one, which gets all the
+	// records, and so releases the stuck output.
+	topology.Start()
+	topology.Wait()
+
+	if got := len(topology.Output[1].(*releaseOutput).Records); got != nrecords {
+		t.Errorf("Release got %d records, want %d", got, nrecords)
+	}
+
+	// The stuck output only gets the records buffered before its channel
+	// got full.
+	var got []string
+	for _, r := range stuck.Records {
+		got = append(got, r.Fields[0])
+	}
+	if want := []string{"0", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stuck got records %q, want %q", got, want)
+	}
+}
+
+func TestOutputOverflowPolicyInvalid(t *testing.T) {
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	cfg := baker.Config{
+		Input:  baker.ConfigInput{Name: "Records"},
+		Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}, OverflowPolicy: "drop_random"}},
+		Fields: baker.ConfigFields{Names: []string{"f0"}},
+	}
+	if _, err := baker.New(c, cfg); err == nil {
+		t.Fatal("baker.New() with an unsupported overflow policy: err = nil, want an error")
+	}
+}
+
+func TestOutputTee(t *testing.T) {
+	tests := []struct {
+		name     string
+		tee      string
+		min, max int // expected range of records in the tee output
+	}{
+		{name: "rate", tee: "rate=0.5", min: 4500, max: 5500},
+		{name: "field", tee: `field="country"` + "\n" + `value="FR"`, min: 2500, max: 2500},
+		{name: "field and rate", tee: `rate=0.5` + "\n" + `field="country"` + "\n" + `value="FR"`, min: 1000, max: 1500},
+	}
+
+	const nrecords = 10000
+	countries := []string{"FR", "IT", "ES", "DE"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toml := `
+[fields]
+names=["id", "country"]
+
+[input]
+name="Records"
+
+[[output]]
+name="Recorder"
+procs=1
+fields=["id", "country"]
+
+[[output]]
+name="RawRecorder"
+procs=1
+fields=["country"]
+
+	[output.tee]
+	` + tt.tee + `
+`
+			c := baker.Components{
+				Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+				Outputs: []baker.OutputDesc{outputtest.RecorderDesc, outputtest.RawRecorderDesc},
+			}
+			cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topology, err := baker.NewTopologyFromConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in := topology.Input.(*inputtest.Records)
+			for i := 0; i < nrecords; i++ {
+				ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+				ll.Set(0, []byte(strconv.Itoa(i)))
+				ll.Set(1, []byte(countries[i%len(countries)]))
+				in.Records = append(in.Records, &ll)
+			}
+
+			topology.Start()
+			topology.Wait()
+
+			// The main output receives all the records, the tee one a sample.
+			if n := len(topology.Output[0].(*outputtest.Recorder).Records); n != nrecords {
+				t.Errorf("main output got %d records, want %d", n, nrecords)
+			}
+			tee := topology.Output[1].(*outputtest.Recorder).Records
+			if n := len(tee); n < tt.min || n > tt.max {
+				t.Errorf("tee output got %d records, want between %d and %d", n, tt.min, tt.max)
+			}
+			if strings.Contains(tt.tee, "field") {
+				for _, r := range tee {
+					if r.Fields[0] != "FR" {
+						t.Fatalf("tee output got country %q, want FR", r.Fields[0])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOutputTeeInvalid(t *testing.T) {
+	c := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+	}
+	for _, tee := range []baker.ConfigTee{
+		{},
+		{Rate: 1.5},
+		{Rate: -0.1},
+		{Field: "unknown", Value: "x"},
+	} {
+		tee := tee
+		cfg := baker.Config{
+			Input:  baker.ConfigInput{Name: "Records"},
+			Output: []baker.ConfigOutput{{Name: "Recorder", Fields: []string{"f0"}, Tee: &tee}},
+			Fields: baker.ConfigFields{Names: []string{"f0"}},
+		}
+		if _, err := baker.New(c, cfg); err == nil {
+			t.Errorf("baker.New() with tee %+v: err = nil, want an error", tee)
+		}
+	}
+}
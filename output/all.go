@@ -7,10 +7,14 @@ import (
 
 // All is the list of all baker outputs.
 var All = []baker.OutputDesc{
+	CSVDesc,
 	DynamoDBDesc,
 	FileWriterDesc,
+	MemoryDesc,
 	NopDesc,
+	NullDesc,
 	OpLogDesc,
+	ParquetDesc,
 	StatsDesc,
 	WebSocketDesc,
 }
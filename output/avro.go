@@ -0,0 +1,249 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	"github.com/AdRoll/baker"
+)
+
+// avroField is a field of an Avro record schema, mapped to a field of the
+// output's fields list.
+type avroField struct {
+	name     string
+	typ      string // primitive type
+	nullable bool   // whether the type is a union of null and typ
+	nullIdx  int64  // index of null in the union
+	idx      int    // index in baker.OutputRecord.Fields
+}
+
+// avroPrimitives are the Avro primitive types the serializer can encode from
+// a string field value.
+var avroPrimitives = map[string]bool{
+	"string": true, "bytes": true, "int": true, "long": true,
+	"float": true, "double": true, "boolean": true,
+}
+
+// parseAvroSchema parses a JSON Avro record schema and maps its fields to the
+// output's fields, by name.
+func parseAvroSchema(schema string, params baker.OutputParams) ([]avroField, error) {
+	var rec struct {
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(schema), &rec); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	if rec.Type != "record" || rec.Name == "" {
+		return nil, fmt.Errorf("invalid Avro schema: must be a named record")
+	}
+	if len(rec.Fields) == 0 {
+		return nil, fmt.Errorf("invalid Avro schema: no fields")
+	}
+	if params.FieldName == nil {
+		return nil, fmt.Errorf("avro format requires field names")
+	}
+
+	fields := make([]avroField, 0, len(rec.Fields))
+	for _, f := range rec.Fields {
+		af := avroField{name: f.Name, idx: -1}
+		for i, fidx := range params.Fields {
+			if params.FieldName(fidx) == f.Name {
+				af.idx = i
+				break
+			}
+		}
+		if af.idx == -1 {
+			return nil, fmt.Errorf("Avro schema field %q isn't in the output's fields list", f.Name)
+		}
+
+		var union []string
+		if err := json.Unmarshal(f.Type, &af.typ); err == nil {
+			// primitive type
+		} else if err := json.Unmarshal(f.Type, &union); err == nil && len(union) == 2 && (union[0] == "null") != (union[1] == "null") {
+			af.nullable = true
+			af.typ = union[1]
+			if union[1] == "null" {
+				af.typ, af.nullIdx = union[0], 1
+			}
+		} else {
+			return nil, fmt.Errorf("Avro schema field %q: only primitive types and unions of null and a primitive type are supported", f.Name)
+		}
+		if !avroPrimitives[af.typ] {
+			return nil, fmt.Errorf("Avro schema field %q: unsupported type %q", f.Name, af.typ)
+		}
+		fields = append(fields, af)
+	}
+	return fields, nil
+}
+
+// newAvroSerializerFunc returns a SerializerFunc writing Avro object container
+// files with the given schema.
+func newAvroSerializerFunc(schema string, params baker.OutputParams) (SerializerFunc, error) {
+	if schema == "" {
+		return nil, fmt.Errorf("avro format requires AvroSchema")
+	}
+	fields, err := parseAvroSchema(schema, params)
+	if err != nil {
+		return nil, err
+	}
+	return func(w io.Writer) RecordSerializer {
+		return &avroSerializer{w: w, schema: schema, fields: fields, sync: uuid.New()}
+	}, nil
+}
+
+// avroBlockSize is the size after which a block of records is written in an
+// Avro file.
+const avroBlockSize = 64 * 1024
+
+// avroSerializer writes an Avro object container file, with the null codec:
+// compression is left to the FileWriter.
+type avroSerializer struct {
+	w      io.Writer
+	schema string
+	fields []avroField
+	sync   [16]byte
+
+	wroteHeader bool
+	block       bytes.Buffer // encoded records of the current block
+	nblock      int64        // number of records in block
+}
+
+func (s *avroSerializer) WriteRecord(rec baker.OutputRecord) error {
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+
+	start := s.block.Len()
+	for _, f := range s.fields {
+		if err := f.encode(&s.block, rec.Fields[f.idx]); err != nil {
+			s.block.Truncate(start)
+			return err
+		}
+	}
+	s.nblock++
+
+	if s.block.Len() >= avroBlockSize {
+		return s.flushBlock()
+	}
+	return nil
+}
+
+func (s *avroSerializer) Finalize(io.Writer) error {
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+	if s.nblock > 0 {
+		return s.flushBlock()
+	}
+	return nil
+}
+
+func (s *avroSerializer) writeHeader() error {
+	if s.wroteHeader {
+		return nil
+	}
+	s.wroteHeader = true
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("Obj\x01")
+	avroWriteLong(buf, 2) // file metadata entries
+	avroWriteString(buf, "avro.schema")
+	avroWriteString(buf, s.schema)
+	avroWriteString(buf, "avro.codec")
+	avroWriteString(buf, "null")
+	avroWriteLong(buf, 0)
+	buf.Write(s.sync[:])
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+func (s *avroSerializer) flushBlock() error {
+	buf := &bytes.Buffer{}
+	avroWriteLong(buf, s.nblock)
+	avroWriteLong(buf, int64(s.block.Len()))
+	buf.Write(s.block.Bytes())
+	buf.Write(s.sync[:])
+	s.block.Reset()
+	s.nblock = 0
+
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// encode writes the Avro binary encoding of the field value v into buf. For
+// nullable fields, an empty v is null.
+func (f *avroField) encode(buf *bytes.Buffer, v string) error {
+	if f.nullable {
+		if v == "" {
+			avroWriteLong(buf, f.nullIdx)
+			return nil
+		}
+		avroWriteLong(buf, 1-f.nullIdx)
+	}
+
+	switch f.typ {
+	case "string", "bytes":
+		avroWriteString(buf, v)
+	case "int", "long":
+		bits := 64
+		if f.typ == "int" {
+			bits = 32
+		}
+		n, err := strconv.ParseInt(v, 10, bits)
+		if err != nil {
+			return fmt.Errorf("field %q: %v", f.name, err)
+		}
+		avroWriteLong(buf, n)
+	case "float":
+		x, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return fmt.Errorf("field %q: %v", f.name, err)
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(x)))
+		buf.Write(b[:])
+	case "double":
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("field %q: %v", f.name, err)
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(x))
+		buf.Write(b[:])
+	case "boolean":
+		x, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("field %q: %v", f.name, err)
+		}
+		if x {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	}
+	return nil
+}
+
+// avroWriteLong writes n as an Avro long: a zig-zag encoded varint.
+func avroWriteLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+// avroWriteString writes s as an Avro string: its length followed by its bytes.
+func avroWriteString(buf *bytes.Buffer, s string) {
+	avroWriteLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
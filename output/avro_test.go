@@ -0,0 +1,267 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/testutil"
+)
+
+// readAvroFile decodes an Avro object container file written with the null
+// codec, using the schema stored in the file, into a map per record.
+func readAvroFile(t *testing.T, buf []byte) []map[string]interface{} {
+	t.Helper()
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	readLong := func() int64 {
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			t.Fatalf("reading long: %v", err)
+		}
+		return n
+	}
+	readBytes := func(n int64) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("reading %d bytes: %v", n, err)
+		}
+		return b
+	}
+	readString := func() string { return string(readBytes(readLong())) }
+
+	if magic := readBytes(4); string(magic) != "Obj\x01" {
+		t.Fatalf("magic = %q", magic)
+	}
+	meta := make(map[string]string)
+	for n := readLong(); n != 0; n = readLong() {
+		for ; n > 0; n-- {
+			k := readString()
+			meta[k] = readString()
+		}
+	}
+	if meta["avro.codec"] != "null" {
+		t.Fatalf("avro.codec = %q", meta["avro.codec"])
+	}
+	var schema struct {
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(meta["avro.schema"]), &schema); err != nil {
+		t.Fatalf("avro.schema: %v", err)
+	}
+	sync := readBytes(16)
+
+	decode := func(typ string) interface{} {
+		switch typ {
+		case "null":
+			return nil
+		case "string", "bytes":
+			return readString()
+		case "int", "long":
+			return readLong()
+		case "float":
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(readBytes(4))))
+		case "double":
+			return math.Float64frombits(binary.LittleEndian.Uint64(readBytes(8)))
+		case "boolean":
+			return readBytes(1)[0] == 1
+		}
+		t.Fatalf("unexpected type %q", typ)
+		return nil
+	}
+
+	var records []map[string]interface{}
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+		count := readLong()
+		readLong() // block size
+		for ; count > 0; count-- {
+			rec := make(map[string]interface{})
+			for _, f := range schema.Fields {
+				var typ string
+				var union []string
+				if err := json.Unmarshal(f.Type, &typ); err != nil {
+					json.Unmarshal(f.Type, &union)
+					typ = union[readLong()]
+				}
+				rec[f.Name] = decode(typ)
+			}
+			records = append(records, rec)
+		}
+		if got := readBytes(16); !bytes.Equal(got, sync) {
+			t.Fatalf("sync marker = %x, want %x", got, sync)
+		}
+	}
+	return records
+}
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": "string"},
+		{"name": "score", "type": ["null", "double"]},
+		{"name": "ok", "type": "boolean"},
+		{"name": "n", "type": ["int", "null"]},
+		{"name": "ratio", "type": "float"}
+	]
+}`
+
+func TestFileWriterAvro(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	// The schema fields don't have to follow the fields list order.
+	fieldNames := []string{"name", "id", "score", "ok", "n", "ratio", "unused"}
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "out.{{.Rotation}}.avro"),
+				RotateInterval: -1,
+				MaxRecords:     2,
+				Format:         "avro",
+				AvroSchema:     testAvroSchema,
+			},
+			FieldName: func(f baker.FieldIndex) string { return fieldNames[f] },
+		},
+		Fields: []baker.FieldIndex{0, 1, 2, 3, 4, 5, 6},
+	}
+	out, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan baker.OutputRecord, 10)
+	in <- baker.OutputRecord{Fields: []string{"alice", "1", "0.5", "true", "12", "0.25", "x"}}
+	in <- baker.OutputRecord{Fields: []string{"", "-2", "", "false", "", "1", "x"}}
+	in <- baker.OutputRecord{Fields: []string{"bob", "not a number", "", "true", "", "0", "x"}} // discarded
+	in <- baker.OutputRecord{Fields: []string{"carol, \"jr\"", "3", "-1e3", "1", "-7", "-0.5", "x"}}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := out.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	var files []string
+	for f := range upch {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	want := [][]map[string]interface{}{
+		{
+			{"id": int64(1), "name": "alice", "score": 0.5, "ok": true, "n": int64(12), "ratio": 0.25},
+			{"id": int64(-2), "name": "", "score": nil, "ok": false, "n": nil, "ratio": 1.0},
+		},
+		{
+			{"id": int64(3), "name": "carol, \"jr\"", "score": -1e3, "ok": true, "n": int64(-7), "ratio": -0.5},
+		},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files %q, want %d", len(files), files, len(want))
+	}
+	for i, f := range files {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAvroFile(t, buf); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("file %q records:\n got %v\nwant %v", f, got, want[i])
+		}
+	}
+}
+
+func TestAvroSerializerBlocks(t *testing.T) {
+	fields, err := parseAvroSchema(`{"type": "record", "name": "r", "fields": [{"name": "f", "type": "string"}]}`, baker.OutputParams{
+		ComponentParams: baker.ComponentParams{FieldName: func(baker.FieldIndex) string { return "f" }},
+		Fields:          []baker.FieldIndex{0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write enough records to fill several blocks.
+	buf := &bytes.Buffer{}
+	s := &avroSerializer{w: buf, schema: `{"type": "record", "name": "r", "fields": [{"name": "f", "type": "string"}]}`, fields: fields}
+	value := string(bytes.Repeat([]byte("x"), 1000))
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := s.WriteRecord(baker.OutputRecord{Fields: []string{fmt.Sprint(i, value)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Finalize(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAvroFile(t, buf.Bytes())
+	if len(records) != n {
+		t.Fatalf("got %d records, want %d", len(records), n)
+	}
+	for i, rec := range records {
+		if want := fmt.Sprint(i, value); rec["f"] != want {
+			t.Fatalf("record %d = %.10q..., want %.10q...", i, rec["f"], want)
+		}
+	}
+}
+
+func TestFileWriterAvroConfigErrors(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	tests := []struct {
+		name   string
+		schema string
+		cfg    FileWriterConfig
+	}{
+		{name: "no schema"},
+		{name: "invalid JSON", schema: `{"type": "record"`},
+		{name: "not a record", schema: `{"type": "string"}`},
+		{name: "no fields", schema: `{"type": "record", "name": "r", "fields": []}`},
+		{name: "unknown field", schema: `{"type": "record", "name": "r", "fields": [{"name": "nope", "type": "string"}]}`},
+		{name: "complex type", schema: `{"type": "record", "name": "r", "fields": [{"name": "f", "type": {"type": "array", "items": "string"}}]}`},
+		{name: "union without null", schema: `{"type": "record", "name": "r", "fields": [{"name": "f", "type": ["int", "string"]}]}`},
+		{name: "unsupported type", schema: `{"type": "record", "name": "r", "fields": [{"name": "f", "type": "fixed"}]}`},
+		{
+			name:   "compression",
+			schema: `{"type": "record", "name": "r", "fields": [{"name": "f", "type": "string"}]}`,
+			cfg:    FileWriterConfig{Compression: "gzip"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.PathString = filepath.Join(t.TempDir(), "out.avro")
+			cfg.Format = "avro"
+			cfg.AvroSchema = tt.schema
+			_, err := NewFileWriter(baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &cfg,
+					FieldName:     func(baker.FieldIndex) string { return "f" },
+				},
+				Fields: []baker.FieldIndex{0},
+			})
+			if err == nil {
+				t.Fatal("NewFileWriter: want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package output
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker"
+)
+
+// CSVDesc describes the CSV output.
+var CSVDesc = baker.OutputDesc{
+	Name:   "CSV",
+	New:    NewCSV,
+	Config: &CSVConfig{},
+	Raw:    false,
+	Help: "This output writes the fields listed in the output's fields list, in that order, into CSV files.\n" +
+		"Values containing the separator, double quotes or newlines are quoted. The files are written,\n" +
+		"compressed and rotated as done by the FileWriter output (see its help for PathString placeholders).\n" +
+		"When WriteHeader is set, each file starts with the names of the fields, including after rotation.",
+}
+
+// CSVConfig holds the configuration parameters of the CSV output.
+type CSVConfig struct {
+	PathString     string        `help:"Template to describe location of the output files. See FileWriter PathString" default:"/tmp/baker/ologs/csv/{{.Year}}/{{.Month}}/{{.Day}}/baker/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.csv.gz"`
+	RotateInterval time.Duration `help:"Time after which data will be rotated. If -1, it will not rotate until the end." default:"60s"`
+	MaxRecords     int           `help:"Maximum number of records written in a file before it gets rotated. See FileWriter MaxRecords. 0:disabled." default:"0"`
+	Compression    string        `help:"Compression of the written files: none, gzip or zstd. See FileWriter Compression"`
+	Separator      string        `help:"Field separator, a single ASCII character. Use \"\\t\" for TSV files" default:","`
+	WriteHeader    bool          `help:"Write the field names as first line of each file" default:"false"`
+}
+
+func (cfg *CSVConfig) fillDefaults() {
+	if cfg.PathString == "" {
+		cfg.PathString = "/tmp/baker/ologs/csv/{{.Year}}/{{.Month}}/{{.Day}}/baker/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.csv.gz"
+	}
+	if cfg.Separator == "" {
+		cfg.Separator = ","
+	}
+}
+
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *CSVConfig) ValidateConfig(fieldByName func(string) (baker.FieldIndex, bool)) error {
+	if err := checkFieldNames(cfg.PathString, fieldByName); err != nil {
+		return err
+	}
+	if cfg.Separator == "" {
+		return nil
+	}
+	sep := []rune(cfg.Separator)
+	if len(sep) != 1 || sep[0] > unicode.MaxASCII || sep[0] == '"' || sep[0] == '\r' || sep[0] == '\n' {
+		return fmt.Errorf("Separator must be a single ASCII character, other than a double quote or a newline, got %q", cfg.Separator)
+	}
+	return nil
+}
+
+// CSV is an output writing records into CSV files.
+type CSV struct {
+	fw *FileWriter
+}
+
+// NewCSV returns a new CSV output.
+func NewCSV(cfg baker.OutputParams) (baker.Output, error) {
+	log.WithFields(log.Fields{"fn": "NewCSV", "idx": cfg.Index}).Info("Initializing")
+
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &CSVConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*CSVConfig)
+	dcfg.fillDefaults()
+
+	if err := dcfg.ValidateConfig(cfg.FieldByName); err != nil {
+		return nil, err
+	}
+	sep := []rune(dcfg.Separator)
+
+	if dcfg.WriteHeader && cfg.FieldName == nil {
+		return nil, fmt.Errorf("WriteHeader requires field names")
+	}
+
+	fwcfg := cfg
+	fwcfg.DecodedConfig = &FileWriterConfig{
+		PathString:     dcfg.PathString,
+		RotateInterval: dcfg.RotateInterval,
+		MaxRecords:     dcfg.MaxRecords,
+		Compression:    dcfg.Compression,
+	}
+	fw, err := NewFileWriter(fwcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var header []string
+	if dcfg.WriteHeader {
+		header = make([]string, len(cfg.Fields))
+		for i, f := range cfg.Fields {
+			header[i] = cfg.FieldName(f)
+		}
+	}
+
+	w := &CSV{fw: fw.(*FileWriter)}
+	w.fw.NewSerializer = CSVSerializer(sep[0], header)
+
+	return w, nil
+}
+
+// Run implements baker.Output.
+func (w *CSV) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	log.WithFields(log.Fields{"idx": w.fw.index}).Info("CSV ready to log")
+
+	for lldata := range input {
+		w.fw.worker(lldata.Fields, lldata.Meta, upch).Write(lldata)
+		atomic.AddInt64(&w.fw.totaln, int64(1))
+	}
+
+	log.WithFields(log.Fields{"idx": w.fw.index}).Info("CSV Terminating")
+	w.fw.closeWorkers()
+
+	return nil
+}
+
+// Stats implements baker.Output.
+func (w *CSV) Stats() baker.OutputStats { return w.fw.Stats() }
+
+// CanShard implements baker.Output.
+func (w *CSV) CanShard() bool { return false }
@@ -0,0 +1,150 @@
+package output
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/testutil"
+)
+
+func TestCSV(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fieldNames := []string{"id", "country", "name"}
+
+	tests := []struct {
+		name        string
+		separator   string
+		writeHeader bool
+		fields      []baker.FieldIndex
+		want        []string // content of each file
+	}{
+		{
+			name:        "header",
+			writeHeader: true,
+			fields:      []baker.FieldIndex{0, 1, 2},
+			want: []string{
+				"id,country,name\n1,us,alice\n2,fr,bob\n",
+				"id,country,name\n3,it,\"carol, jr\"\n",
+			},
+		},
+		{
+			name:   "no header",
+			fields: []baker.FieldIndex{0, 1, 2},
+			want: []string{
+				"1,us,alice\n2,fr,bob\n",
+				"3,it,\"carol, jr\"\n",
+			},
+		},
+		{
+			name:        "tsv with fields order",
+			separator:   "\t",
+			writeHeader: true,
+			fields:      []baker.FieldIndex{2, 0},
+			want: []string{
+				"name\tid\nalice\t1\nbob\t2\n",
+				"name\tid\ncarol, jr\t3\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &CSVConfig{
+						PathString:     filepath.Join(dir, "out.{{.Rotation}}.csv"),
+						Compression:    "none",
+						RotateInterval: -1,
+						MaxRecords:     2,
+						Separator:      tt.separator,
+						WriteHeader:    tt.writeHeader,
+					},
+					FieldName: func(f baker.FieldIndex) string { return fieldNames[f] },
+				},
+				Fields: tt.fields,
+			}
+			out, err := NewCSV(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := [][]string{
+				{"1", "us", "alice"},
+				{"2", "fr", "bob"},
+				{"3", "it", "carol, jr"},
+			}
+			in := make(chan baker.OutputRecord, len(records))
+			for _, r := range records {
+				// Mimic the topology, sending the fields in the output's fields order.
+				fields := make([]string, len(tt.fields))
+				for i, f := range tt.fields {
+					fields[i] = r[f]
+				}
+				in <- baker.OutputRecord{Fields: fields}
+			}
+			close(in)
+
+			upch := make(chan string, 10)
+			if err := out.Run(in, upch); err != nil {
+				t.Fatal(err)
+			}
+			close(upch)
+
+			var files []string
+			for f := range upch {
+				files = append(files, f)
+			}
+			sort.Strings(files)
+
+			if len(files) != len(tt.want) {
+				t.Fatalf("got %d files %q, want %d", len(files), files, len(tt.want))
+			}
+			for i, f := range files {
+				buf, err := ioutil.ReadFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf) != tt.want[i] {
+					t.Errorf("file %q content:\n%q\nwant:\n%q", f, buf, tt.want[i])
+				}
+			}
+
+			if got := out.Stats().NumProcessedLines; got != int64(len(records)) {
+				t.Errorf("NumProcessedLines = %d, want %d", got, len(records))
+			}
+		})
+	}
+}
+
+func TestCSVConfigErrors(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	tests := []struct {
+		name string
+		cfg  CSVConfig
+	}{
+		{name: "multi-char separator", cfg: CSVConfig{Separator: ",,"}},
+		{name: "non-ascii separator", cfg: CSVConfig{Separator: "§"}},
+		{name: "quote separator", cfg: CSVConfig{Separator: `"`}},
+		{name: "header without field names", cfg: CSVConfig{WriteHeader: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.PathString = filepath.Join(t.TempDir(), "out.csv")
+			tt.cfg.Compression = "none"
+			cfg := baker.OutputParams{
+				ComponentParams: baker.ComponentParams{DecodedConfig: &tt.cfg},
+				Fields:          []baker.FieldIndex{0},
+			}
+			if _, err := NewCSV(cfg); err == nil {
+				t.Errorf("NewCSV() err = nil, want an error")
+			}
+		})
+	}
+}
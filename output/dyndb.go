@@ -395,7 +395,7 @@ func (b *DynamoDB) Run(input <-chan baker.OutputRecord, _ chan<- string) error {
 
 func (b *DynamoDB) Stats() baker.OutputStats {
 
-	bag := make(baker.MetricsBag)
+	bag := &baker.MetricsBag{}
 	for _, dbproc := range b.dbprocs {
 		name := "dynamodb.retries." + dbproc.region
 		value := atomic.LoadInt64(&dbproc.Stats.TotalRetries)
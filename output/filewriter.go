@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"errors"
+	"container/list"
 	"fmt"
 	"html/template"
 	"io"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,14 +25,46 @@ import (
 )
 
 const helpMsg = `This output writes the records into compressed files in a directory.
-Files will be compressed using Gzip or Zstandard based on the filename extension in PathString.
+Files will be compressed using Gzip or Zstandard depending on the Compression option. If not set,
+the compression is chosen based on the filename extension in PathString.
 The file names can contain placeholders that are populated by the output (see the keys help below).
-When the special {{.Field0}} placeholder is used, then the user must specify the field name to
-use for replacement in the fields configuration list.
-The value of that field, extracted from each record, is used as replacement and, moreover, this
-also means that each created file will contain only records with that same value for the field.
+When the special {{.Field0}}, {{.Field1}}, ... {{.FieldN}} placeholders are used, then the user
+must specify the field names to use for replacement in the fields configuration list: {{.Field0}}
+is replaced by the first field in the list, {{.Field1}} by the second, and so on.
+The values of those fields, extracted from each record, are used as replacement and, moreover, this
+also means that each created file will contain only records with the same values for those fields
+(for example "country={{.Field0}}/" creates Hive-style partitions). Empty values are replaced
+by "__default__".
+Fields can also be referred to by name, with {field:name} placeholders: the named field must be in
+the output's fields list, and "country={field:country}/" is then equivalent to the above.
 Note that, with this option, the FileWriter creates as many workers as the different values
-of the field, and each one of these workers concurrently writes to a different file.
+of the fields, and each one of these workers concurrently writes to a different file. To limit the
+number of simultaneously open files, use MaxOpenFiles: when the limit is reached, the least recently
+used worker is closed (and its file is sent to upload). In that case, PathString should contain
+{{.UUID}} to avoid overwriting files.
+Similarly, {{.Meta.key}} placeholders are replaced by the value of the record metadata having
+that key, as set by the input (for example "{{.Meta.s3_bucket}}/" partitions the records by
+the S3 bucket they've been read from).
+By default, the date placeholders ({{.Year}}, {{.Month}}, {{.Day}} and {{.Hour}}) are replaced with
+the time at which each file is created. With TimestampField, they're rather replaced with the
+event time of the records, read from that field (parsed with TimestampLayout), so that late
+records land in the partition of their event time: the records are then partitioned by the
+values of the date placeholders used in PathString, as they are by the {{.FieldN}} values.
+Records whose TimestampField is empty or can't be parsed fall back to the current time. Files of
+past partitions being kept open, MaxOpenFiles should be set.
+The Format option sets how the records are encoded: by default, they're written as they are, one
+per line. With the csv format, the fields of the output's fields list are written as CSV lines
+(see the CSV output for more options). With the avro format, the files are Avro object container
+files, with the schema set in AvroSchema: the schema is a record whose fields are named after
+fields of the output's fields list, of a primitive type or of a union of null and a primitive
+type (empty values are then written as null). Avro files aren't compressed by the FileWriter, so
+Compression must be none.
+With ManifestPath, the FileWriter writes a manifest listing every file it produces, as soon as the
+file is finalized (before being sent to upload): its path, number of records, size in bytes and
+SHA-256 checksum, as JSON lines or as CSV (see ManifestFormat). The manifest is finalized, and
+sent to upload after all the other files, when the output terminates, so that a subsequent job
+can consume exactly the files of the run. ManifestPath supports the {{.Index}}, {{.UUID}} and
+date placeholders, and should contain {{.Index}} if the output has several procs.
 `
 
 var FileWriterDesc = baker.OutputDesc{
@@ -42,10 +76,31 @@ var FileWriterDesc = baker.OutputDesc{
 }
 
 type FileWriterConfig struct {
-	PathString           string        `help:"Template to describe location of the output directory: supports .Year, .Month, .Day and .Rotation. Also .Field0 if a field name has been specified in the output's fields list."`
+	PathString           string        `help:"Template to describe location of the output directory: supports .Year, .Month, .Day and .Rotation. Also .Field0 if a field name has been specified in the output's fields list, {field:name} for a field of that list, and .Meta.key for the record metadata."`
 	RotateInterval       time.Duration `help:"Time after which data will be rotated. If -1, it will not rotate until the end." default:"60s"`
+	MaxRecords           int           `help:"Maximum number of records written in a file before it gets rotated. When both MaxRecords and RotateInterval are set, files are rotated as soon as one of the two thresholds is hit (the records count is reset at each rotation). PathString should then contain {{.Rotation}} or {{.UUID}} to avoid name collisions. 0:disabled." default:"0"`
 	ZstdCompressionLevel int           `help:"zstd compression level, ranging from 1 (best speed) to 19 (best compression)." default:"3"`
 	ZstdWindowLog        int           `help:"Enable zstd long distance matching. Increase memory usage for both compressor/decompressor. If more than 27 the decompressor requires special treatment. 0:disabled." default:"0"`
+	MaxOpenFiles         int           `help:"Maximum number of files open at the same time when using {{.FieldN}} or {field:name} placeholders. When exceeded, the least recently used file is closed. 0:unlimited." default:"0"`
+	Compression          string        `help:"Compression of the written files: none, gzip or zstd. If not set, zstd is used if PathString ends with .zst or .zstd, gzip otherwise (none with the avro format). PathString is never modified, so it should end with the extension of the codec"`
+	Format               string        `help:"Format of the written records: line (the records as they are, one per line), csv (the fields of the output's fields list) or avro (see AvroSchema)" default:"line"`
+	AvroSchema           string        `help:"JSON Avro schema of the records, required by the avro format. It must be a record whose fields are named after fields of the output's fields list"`
+	TimestampField       string        `help:"Name of a field of the output's fields list holding the event time of the records. If set, the date placeholders of PathString are replaced with the event time rather than with the current time"`
+	TimestampLayout      string        `help:"Layout of TimestampField values, in the format of Go time.Parse" default:"2006-01-02T15:04:05Z07:00"`
+	ManifestPath         string        `help:"If set, path of the manifest listing the files produced by the output. Placed under the uploader SourceBasePath, it's uploaded with them"`
+	ManifestFormat       string        `help:"Format of the manifest: jsonl (a JSON object per file) or csv (with a header line)" default:"jsonl"`
+}
+
+// List of compression codecs supported by the FileWriter.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// hasZstdExt reports whether path has a Zstandard file extension.
+func hasZstdExt(path string) bool {
+	return strings.HasSuffix(path, ".zst") || strings.HasSuffix(path, ".zstd")
 }
 
 type FileWriter struct {
@@ -54,12 +109,47 @@ type FileWriter struct {
 	Fields []baker.FieldIndex
 	totaln int64
 
-	workers map[string]*fileWorker
+	workers map[string]*list.Element // elements of lru, by partition key
+	lru     *list.List               // *fileWorker, most recently used first
+	openn   int64                    // number of open workers
 	index   int
 
-	useReplField bool
+	pathTemplate *template.Template // PathString, with {field:name} placeholders resolved
+
+	nreplFields int      // number of fields used as replacement in PathString
+	replFields  []int    // indexes in Fields of the fields used as replacement in PathString
+	replMeta    []string // metadata keys used as replacement in PathString
+
+	tsField     int      // index of TimestampField in Fields, -1 if not set
+	replDates   []string // layouts of the date placeholders used in PathString, with tsField
+	tsFallbacks int64    // number of records whose timestamp couldn't be parsed
+
+	manifest *manifest // nil if ManifestPath isn't set
+
+	// NewSerializer creates the serializer of each written file, according
+	// to the configured Format.
+	NewSerializer SerializerFunc
 }
 
+// defaultPartition replaces empty field values in paths.
+const defaultPartition = "__default__"
+
+// replFieldRx matches the {{.FieldN}} placeholders in a path template.
+var replFieldRx = regexp.MustCompile(`{{\s*\.Field(\d+)\s*}}`)
+
+// replNameRx matches the {field:name} placeholders in a path template.
+var replNameRx = regexp.MustCompile(`{field:([^{}]+)}`)
+
+// replMetaRx matches the {{.Meta.key}} placeholders in a path template.
+var replMetaRx = regexp.MustCompile(`{{\s*\.Meta\.(\w+)\s*}}`)
+
+// replDateRx matches the date placeholders in a path template that can be
+// replaced with the event time of the records.
+var replDateRx = regexp.MustCompile(`{{\s*\.(Year|Month|Day|Hour)\s*}}`)
+
+// dateLayouts are the time layouts of the date placeholders.
+var dateLayouts = map[string]string{"Year": "2006", "Month": "01", "Day": "02", "Hour": "15"}
+
 func NewFileWriter(cfg baker.OutputParams) (baker.Output, error) {
 	log.WithFields(log.Fields{"fn": "NewFileWriter", "idx": cfg.Index}).Info("Initializing")
 
@@ -69,57 +159,258 @@ func NewFileWriter(cfg baker.OutputParams) (baker.Output, error) {
 	dcfg := cfg.DecodedConfig.(*FileWriterConfig)
 
 	dcfg.fillDefaults()
+	if err := dcfg.checkCompression(); err != nil {
+		return nil, err
+	}
+	if err := dcfg.ValidateConfig(cfg.FieldByName); err != nil {
+		return nil, err
+	}
+
+	if dcfg.Format == formatAvro && dcfg.Compression != compressionNone {
+		return nil, fmt.Errorf("compression %q isn't supported by the avro format", dcfg.Compression)
+	}
+
+	if dcfg.MaxOpenFiles < 0 {
+		return nil, fmt.Errorf("MaxOpenFiles: invalid number: %d", dcfg.MaxOpenFiles)
+	}
+
+	manifestFormat, err := checkManifestFormat(dcfg.ManifestFormat)
+	if err != nil {
+		return nil, err
+	}
+	dcfg.ManifestFormat = manifestFormat
+
+	newSerializer, err := newSerializerFunc(dcfg, cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	fw := &FileWriter{
-		Cfg:          dcfg,
-		Fields:       cfg.Fields,
-		workers:      make(map[string]*fileWorker),
-		index:        cfg.Index,
-		useReplField: strings.Contains(dcfg.PathString, "{{.Field0}}"),
+		Cfg:           dcfg,
+		Fields:        cfg.Fields,
+		workers:       make(map[string]*list.Element),
+		lru:           list.New(),
+		index:         cfg.Index,
+		NewSerializer: newSerializer,
+		tsField:       -1,
 	}
 
-	if fw.useReplField && len(cfg.Fields) != 1 {
-		return nil, errors.New("cannot use {{.Field0}} without an entry in the output's fields list")
+	pathString, err := resolveFieldNames(dcfg.PathString, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if fw.pathTemplate, err = template.New("fileWorkerType").Parse(pathString); err != nil {
+		return nil, fmt.Errorf("PathString: %v", err)
+	}
+
+	seenFields := make(map[int]bool)
+	for _, m := range replFieldRx.FindAllStringSubmatch(pathString, -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n >= len(cfg.Fields) {
+			return nil, fmt.Errorf("cannot use {{.Field%d}} without a corresponding entry in the output's fields list", n)
+		}
+		if n+1 > fw.nreplFields {
+			fw.nreplFields = n + 1
+		}
+		if !seenFields[n] {
+			seenFields[n] = true
+			fw.replFields = append(fw.replFields, n)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, m := range replMetaRx.FindAllStringSubmatch(pathString, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			fw.replMeta = append(fw.replMeta, m[1])
+		}
+	}
+
+	if dcfg.TimestampField != "" {
+		if cfg.FieldName != nil {
+			for i, fidx := range cfg.Fields {
+				if cfg.FieldName(fidx) == dcfg.TimestampField {
+					fw.tsField = i
+					break
+				}
+			}
+		}
+		if fw.tsField == -1 {
+			return nil, fmt.Errorf("TimestampField %q isn't in the output's fields list", dcfg.TimestampField)
+		}
+		seen := make(map[string]bool)
+		for _, m := range replDateRx.FindAllStringSubmatch(pathString, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				fw.replDates = append(fw.replDates, dateLayouts[m[1]])
+			}
+		}
+	}
+
+	if dcfg.ManifestPath != "" {
+		tmpl, err := template.New("manifest").Parse(dcfg.ManifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("ManifestPath: %v", err)
+		}
+		path := renderPath(tmpl, cfg.Index, uuid.New().String(), 0, time.Time{}, nil, nil)
+		if fw.manifest, err = newManifest(path, dcfg.ManifestFormat); err != nil {
+			return nil, err
+		}
 	}
 
 	return fw, nil
 }
 
+// resolveFieldNames replaces the {field:name} placeholders of a path template
+// with the {{.FieldN}} placeholders of the same fields of the output's fields
+// list.
+func resolveFieldNames(pathString string, cfg baker.OutputParams) (string, error) {
+	var err error
+	resolved := replNameRx.ReplaceAllStringFunc(pathString, func(m string) string {
+		name := replNameRx.FindStringSubmatch(m)[1]
+		if cfg.FieldByName != nil {
+			if fidx, ok := cfg.FieldByName(name); ok {
+				for i, f := range cfg.Fields {
+					if f == fidx {
+						return "{{.Field" + strconv.Itoa(i) + "}}"
+					}
+				}
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("cannot use {field:%s} without a corresponding entry in the output's fields list", name)
+		}
+		return m
+	})
+	return resolved, err
+}
+
+// checkFieldNames checks that the {field:name} placeholders of a path template
+// refer to existing fields. It doesn't check anything if fieldByName is nil.
+func checkFieldNames(pathString string, fieldByName func(string) (baker.FieldIndex, bool)) error {
+	if fieldByName == nil {
+		return nil
+	}
+	for _, m := range replNameRx.FindAllStringSubmatch(pathString, -1) {
+		if _, ok := fieldByName(m[1]); !ok {
+			return fmt.Errorf("PathString: {field:%s}: unknown field", m[1])
+		}
+	}
+	return nil
+}
+
 func (w *FileWriter) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
 	log.WithFields(log.Fields{"idx": w.index}).Info("FileWriter ready to log")
 
 	for lldata := range input {
-		wname := ""
-		if w.useReplField {
-			wname = lldata.Fields[0]
-		}
-		worker, ok := w.workers[wname]
-		if !ok {
-			// Unique UUID for the output processes
-			uid := uuid.New().String()
-			worker = newWorker(w.Cfg, wname, w.index, uid, upch)
-			w.workers[wname] = worker
+		w.worker(lldata.Fields, lldata.Meta, upch).Write(lldata)
+		atomic.AddInt64(&w.totaln, int64(1))
+	}
+
+	log.WithFields(log.Fields{"idx": w.index}).Info("FileWriter Terminating")
+	w.closeWorkers()
+
+	if w.manifest != nil {
+		if err := w.manifest.close(); err != nil {
+			return fmt.Errorf("can't finalize manifest: %v", err)
 		}
+		upch <- w.manifest.path
+	}
 
-		worker.Write(lldata.Record)
+	return nil
+}
 
-		atomic.AddInt64(&w.totaln, int64(1))
+// closeWorkers closes all workers and waits for them to finish writing.
+func (w *FileWriter) closeWorkers() {
+	for e := w.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*fileWorker).Close()
 	}
+	for e := w.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*fileWorker).Wait()
+	}
+	atomic.StoreInt64(&w.openn, 0)
+}
 
-	log.WithFields(log.Fields{"idx": w.index}).Info("FileWriter Terminating")
-	for _, worker := range w.workers {
-		worker.Close()
+// worker returns the worker responsible for the partition the given fields
+// and metadata belong to, creating it if necessary.
+func (w *FileWriter) worker(fields []string, meta baker.Metadata, upch chan<- string) *fileWorker {
+	// Fields that aren't used as replacement are left empty, so that they
+	// don't split the partitions.
+	values := make([]string, w.nreplFields, w.nreplFields+len(w.replMeta))
+	for _, i := range w.replFields {
+		values[i] = fields[i]
+		if values[i] == "" {
+			values[i] = defaultPartition
+		}
+	}
+	var metaValues map[string]string
+	if len(w.replMeta) > 0 {
+		metaValues = make(map[string]string, len(w.replMeta))
+		for _, k := range w.replMeta {
+			v := ""
+			if mv, ok := meta[k]; ok && mv != nil {
+				v = fmt.Sprint(mv)
+			}
+			if v == "" {
+				v = defaultPartition
+			}
+			metaValues[k] = v
+			values = append(values, v)
+		}
 	}
-	for _, worker := range w.workers {
-		worker.Wait()
+	var eventTime time.Time
+	if w.tsField != -1 {
+		eventTime = w.eventTime(fields[w.tsField])
+		for _, layout := range w.replDates {
+			values = append(values, eventTime.Format(layout))
+		}
 	}
+	key := strings.Join(values, "\x00")
 
-	return nil
+	if e, ok := w.workers[key]; ok {
+		w.lru.MoveToFront(e)
+		return e.Value.(*fileWorker)
+	}
+
+	if w.Cfg.MaxOpenFiles > 0 && w.lru.Len() >= w.Cfg.MaxOpenFiles {
+		// Close the least recently used worker.
+		e := w.lru.Back()
+		lru := e.Value.(*fileWorker)
+		lru.Close()
+		lru.Wait()
+		w.lru.Remove(e)
+		delete(w.workers, lru.key)
+	}
+
+	// Unique UUID for the output processes
+	uid := uuid.New().String()
+	worker := newWorker(w.Cfg, w.pathTemplate, key, values[:w.nreplFields], metaValues, eventTime, w.NewSerializer, w.manifest, w.index, uid, upch)
+	w.workers[key] = w.lru.PushFront(worker)
+	atomic.StoreInt64(&w.openn, int64(w.lru.Len()))
+	return worker
+}
+
+// eventTime parses the timestamp of a record, returning the current time if
+// it's empty or can't be parsed.
+func (w *FileWriter) eventTime(ts string) time.Time {
+	if ts != "" {
+		if t, err := time.Parse(w.Cfg.TimestampLayout, ts); err == nil {
+			return t.UTC()
+		}
+	}
+	atomic.AddInt64(&w.tsFallbacks, 1)
+	return time.Now().UTC()
 }
 
 func (w *FileWriter) Stats() baker.OutputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddGauge("filewriter.open_files", float64(atomic.LoadInt64(&w.openn)))
+	if w.tsField != -1 {
+		bag.AddRawCounter("filewriter.timestamp_fallbacks", atomic.LoadInt64(&w.tsFallbacks))
+	}
+
 	return baker.OutputStats{
 		NumProcessedLines: atomic.LoadInt64(&w.totaln),
+		Metrics:           bag,
 	}
 }
 
@@ -127,6 +418,11 @@ func (w *FileWriter) CanShard() bool {
 	return false
 }
 
+// ValidateConfig implements baker.ConfigValidator.
+func (cfg *FileWriterConfig) ValidateConfig(fieldByName func(string) (baker.FieldIndex, bool)) error {
+	return checkFieldNames(cfg.PathString, fieldByName)
+}
+
 func (cfg *FileWriterConfig) fillDefaults() {
 	if cfg.PathString == "" {
 		cfg.PathString = "/tmp/baker/ologs/logs/{{.Year}}/{{.Month}}/{{.Day}}/baker/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.log.gz"
@@ -139,6 +435,50 @@ func (cfg *FileWriterConfig) fillDefaults() {
 	if cfg.ZstdCompressionLevel == 0 {
 		cfg.ZstdCompressionLevel = 3
 	}
+
+	if cfg.TimestampLayout == "" {
+		cfg.TimestampLayout = time.RFC3339
+	}
+
+	cfg.Format = strings.ToLower(cfg.Format)
+	if cfg.Format == "" {
+		cfg.Format = formatLine
+	}
+
+	cfg.Compression = strings.ToLower(cfg.Compression)
+	if cfg.Compression == "" {
+		cfg.Compression = compressionGzip
+		if cfg.Format == formatAvro {
+			cfg.Compression = compressionNone
+		} else if hasZstdExt(cfg.PathString) {
+			cfg.Compression = compressionZstd
+		}
+	}
+}
+
+// checkCompression validates the compression codec and makes sure that it
+// doesn't contradict the extension of PathString, if any. PathString is left
+// as configured.
+func (cfg *FileWriterConfig) checkCompression() error {
+	hasGzipExt := strings.HasSuffix(cfg.PathString, ".gz")
+
+	switch cfg.Compression {
+	case compressionNone:
+		if hasGzipExt || hasZstdExt(cfg.PathString) {
+			return fmt.Errorf("compression %q but PathString has a compressed file extension: %q", cfg.Compression, cfg.PathString)
+		}
+	case compressionGzip:
+		if hasZstdExt(cfg.PathString) {
+			return fmt.Errorf("compression %q but PathString has a zstd extension: %q", cfg.Compression, cfg.PathString)
+		}
+	case compressionZstd:
+		if hasGzipExt {
+			return fmt.Errorf("compression %q but PathString has a gzip extension: %q", cfg.Compression, cfg.PathString)
+		}
+	default:
+		return fmt.Errorf("unsupported compression: %q", cfg.Compression)
+	}
+	return nil
 }
 
 // Internal object only.
@@ -147,87 +487,114 @@ func (cfg *FileWriterConfig) fillDefaults() {
 // it periodically.
 
 type fileWorker struct {
-	in   chan []byte
+	in   chan baker.OutputRecord
 	done chan bool
+	stop chan struct{} // closed when the worker has finished writing
 	upch chan<- string
 
 	cfg *FileWriterConfig
 
-	pathTemplate   *template.Template
-	replFieldValue string
-	index          int
-	uid            string
-	rotateIdx      int64
+	pathTemplate    *template.Template
+	key             string            // partition key, in FileWriter.workers
+	replFieldValues []string          // values of the {{.FieldN}} placeholders
+	replMetaValues  map[string]string // values of the {{.Meta.key}} placeholders
+	eventTime       time.Time         // time of the date placeholders, the current time if zero
+	newSerializer   SerializerFunc
+	manifest        *manifest // nil if disabled
+	index           int
+	uid             string
+	rotateIdx       int64
 
 	currentPath string
 	fd          *os.File
-	lock        sync.Mutex
+	nrecords    int        // number of records written in the current file
+	lock        sync.Mutex // protects fd, writers and rotation state
 
 	ticker  *time.Ticker
 	writer  *bufio.Writer
 	cwriter io.WriteCloser
-
-	useZstd bool
+	ser     RecordSerializer // serializer of the current file
+	digest  *digestWriter    // size and checksum of the current file, with a manifest
 }
 
 const (
 	fileWorkerChunkBuffer = 128 * 1024
 )
 
-func newWorker(cfg *FileWriterConfig, replFieldValue string, index int, uid string, upch chan<- string) *fileWorker {
-	pathTemplate, err := template.New("fileWorkerType").Parse(cfg.PathString)
-	if err != nil {
-		panic(err.Error())
-	}
-
+func newWorker(cfg *FileWriterConfig, pathTemplate *template.Template, key string, replFieldValues []string, replMetaValues map[string]string, eventTime time.Time, newSerializer SerializerFunc, manifest *manifest, index int, uid string, upch chan<- string) *fileWorker {
 	fw := &fileWorker{
-		in:             make(chan []byte, 1),
-		done:           make(chan bool, 1),
-		upch:           upch,
-		cfg:            cfg,
-		pathTemplate:   pathTemplate,
-		replFieldValue: replFieldValue,
-		index:          index,
-		uid:            uid,
-		useZstd:        false,
-		rotateIdx:      0,
-	}
-
-	if strings.HasSuffix(cfg.PathString, ".zst") || strings.HasSuffix(cfg.PathString, ".zstd") {
-		fw.useZstd = true
+		in:              make(chan baker.OutputRecord, 1),
+		done:            make(chan bool, 1),
+		stop:            make(chan struct{}),
+		upch:            upch,
+		cfg:             cfg,
+		pathTemplate:    pathTemplate,
+		key:             key,
+		replFieldValues: replFieldValues,
+		replMetaValues:  replMetaValues,
+		eventTime:       eventTime,
+		newSerializer:   newSerializer,
+		manifest:        manifest,
+		index:           index,
+		uid:             uid,
+		rotateIdx:       0,
 	}
 
 	fw.Rotate()
 	go fw.run()
 
-	fw.ticker = time.NewTicker(cfg.RotateInterval)
-	go func() {
-		for range fw.ticker.C {
-			fw.Rotate()
-		}
-	}()
+	if cfg.RotateInterval > 0 {
+		fw.ticker = time.NewTicker(cfg.RotateInterval)
+		go func() {
+			for {
+				select {
+				case <-fw.ticker.C:
+					fw.Rotate()
+				case <-fw.stop:
+					return
+				}
+			}
+		}()
+	}
 
 	return fw
 }
 
 func (fw *fileWorker) makePath() string {
+	return renderPath(fw.pathTemplate, fw.index, fw.uid, fw.rotateIdx, fw.eventTime, fw.replFieldValues, fw.replMetaValues)
+}
+
+// renderPath executes a path template with the placeholders supported by the
+// outputs writing files, and creates the directory of the resulting path.
+// If eventTime isn't zero, it replaces the date placeholders (down to the
+// hour) rather than the current time.
+func renderPath(tmpl *template.Template, index int, uid string, rotateIdx int64, eventTime time.Time, replFieldValues []string, replMetaValues map[string]string) string {
 	now := time.Now().UTC()
+	date := now
+	if !eventTime.IsZero() {
+		date = eventTime
+	}
 	var doc bytes.Buffer
 
-	replacementVars := map[string]string{
-		"Index":    fmt.Sprintf("%04d", fw.index),
-		"Year":     fmt.Sprintf("%04d", now.Year()),
-		"Month":    fmt.Sprintf("%02d", now.Month()),
-		"Day":      fmt.Sprintf("%02d", now.Day()),
-		"Hour":     fmt.Sprintf("%02d", now.Hour()),
+	replacementVars := map[string]interface{}{
+		"Index":    fmt.Sprintf("%04d", index),
+		"Year":     fmt.Sprintf("%04d", date.Year()),
+		"Month":    fmt.Sprintf("%02d", date.Month()),
+		"Day":      fmt.Sprintf("%02d", date.Day()),
+		"Hour":     fmt.Sprintf("%02d", date.Hour()),
 		"Minute":   fmt.Sprintf("%02d", now.Minute()),
 		"Second":   fmt.Sprintf("%02d", now.Second()),
-		"UUID":     fw.uid,
-		"Rotation": fmt.Sprintf("%06d", fw.rotateIdx),
-		"Field0":   fw.replFieldValue,
+		"UUID":     uid,
+		"Rotation": fmt.Sprintf("%06d", rotateIdx),
+	}
+	for i, v := range replFieldValues {
+		replacementVars["Field"+strconv.Itoa(i)] = v
+	}
+	if replMetaValues != nil {
+		replacementVars["Meta"] = replMetaValues
 	}
 
-	err := fw.pathTemplate.Execute(&doc, replacementVars)
+	err := tmpl.Execute(&doc, replacementVars)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -240,7 +607,15 @@ func (fw *fileWorker) makePath() string {
 	return replacedPath
 }
 
+// Rotate closes the current file, sends it to upload and opens a new one.
 func (fw *fileWorker) Rotate() {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	fw.rotate()
+}
+
+// rotate performs the actual rotation, fw.lock must be held.
+func (fw *fileWorker) rotate() {
 	ctxLog := log.WithFields(log.Fields{"current": fw.currentPath, "idx": fw.index})
 
 	ctxLog.Info("Rotating")
@@ -252,15 +627,24 @@ func (fw *fileWorker) Rotate() {
 		ctxLog.Fatal("failed to rotate")
 		panic(err)
 	}
-	w := bufio.NewWriterSize(fd, fileWorkerChunkBuffer)
+	var dst io.Writer = fd
+	var digest *digestWriter
+	if fw.manifest != nil {
+		digest = newDigestWriter(fd)
+		dst = digest
+	}
+	w := bufio.NewWriterSize(dst, fileWorkerChunkBuffer)
 	var cwriter io.WriteCloser
-	if fw.useZstd {
+	switch fw.cfg.Compression {
+	case compressionZstd:
 		params := &zstd.WriterParams{
 			CompressionLevel: fw.cfg.ZstdCompressionLevel,
 			WindowLog:        fw.cfg.ZstdWindowLog,
 		}
-		cwriter = zstd.NewWriterParams(w, params)
-	} else {
+		cwriter = &zstdWriteCloser{zstd.NewWriterParams(w, params)}
+	case compressionNone:
+		cwriter = nopWriteCloser{w}
+	default:
 		cwriter, err = gzip.NewWriterLevel(w, gzip.BestSpeed)
 	}
 	if err != nil {
@@ -268,25 +652,58 @@ func (fw *fileWorker) Rotate() {
 		panic(err)
 	}
 
-	fw.lock.Lock()
-	defer fw.lock.Unlock()
 	fw.closeall()
 	fw.upload(oldPath)
 	fw.fd = fd
 	fw.writer = w
 	fw.cwriter = cwriter
+	fw.digest = digest
+	fw.ser = fw.newSerializer(cwriter)
 	fw.rotateIdx++
+	fw.nrecords = 0
+
 	ctxLog.Info("Rotated")
 }
 
+// zstdWriteCloser is a zstd writer whose Close method finalizes
+// the compressed stream (i.e. writes the zstd footer) and releases the
+// resources associated to the writer.
+type zstdWriteCloser struct{ *zstd.Writer }
+
+func (w *zstdWriteCloser) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Release()
+	return err
+}
+
+// nopWriteCloser is an io.Writer with a no-op Close method, used to write
+// uncompressed files.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// upload sends a finalized file to upload, after adding it to the manifest
+// if any.
 func (fw *fileWorker) upload(filepath string) {
-	if filepath != "" {
-		fw.upch <- filepath
+	if filepath == "" {
+		return
 	}
+	if fw.manifest != nil {
+		entry := manifestEntry{
+			Path:    filepath,
+			Records: fw.nrecords,
+			Bytes:   fw.digest.size,
+			SHA256:  fw.digest.sum(),
+		}
+		if err := fw.manifest.add(entry); err != nil {
+			log.WithFields(log.Fields{"idx": fw.index, "manifest": fw.manifest.path}).WithError(err).Error("can't add file to manifest")
+		}
+	}
+	fw.upch <- filepath
 }
 
-func (fw *fileWorker) Write(req []byte) {
-	fw.in <- req
+func (fw *fileWorker) Write(rec baker.OutputRecord) {
+	fw.in <- rec
 }
 
 func (fw *fileWorker) Close() {
@@ -299,6 +716,11 @@ func (fw *fileWorker) Wait() bool {
 }
 
 func (fw *fileWorker) closeall() {
+	if fw.ser != nil {
+		if err := fw.ser.Finalize(fw.cwriter); err != nil {
+			log.WithError(err).Error("error finalizing file")
+		}
+	}
 	if fw.cwriter != nil {
 		fw.cwriter.Close()
 	}
@@ -310,22 +732,36 @@ func (fw *fileWorker) closeall() {
 	}
 }
 
-func (fw *fileWorker) write(line []byte) error {
+func (fw *fileWorker) write(rec baker.OutputRecord) error {
 	fw.lock.Lock()
 	defer fw.lock.Unlock()
 
-	_, err := fw.cwriter.Write(line)
-	fw.cwriter.Write([]byte("\n"))
-	return err
+	// Rotate lazily, when the next record comes in, so that we never produce
+	// an empty file when the last record exactly fills the current file.
+	if fw.cfg.MaxRecords > 0 && fw.nrecords >= fw.cfg.MaxRecords {
+		fw.rotate()
+	}
+
+	if err := fw.ser.WriteRecord(rec); err != nil {
+		return err
+	}
+	fw.nrecords++
+	return nil
 }
 
 func (fw *fileWorker) run() {
-	for line := range fw.in {
-		if err := fw.write(line); err != nil {
+	for rec := range fw.in {
+		if err := fw.write(rec); err != nil {
 			log.WithError(err).Error("error writing to file")
 		}
 	}
-	fw.ticker.Stop()
+	if fw.ticker != nil {
+		fw.ticker.Stop()
+	}
+	close(fw.stop)
+
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
 	fw.closeall()
 	fw.upload(fw.currentPath)
 	fw.done <- true
@@ -1,12 +1,31 @@
 package output
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	zstd "github.com/valyala/gozstd"
 
 	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/testutil"
 )
 
 func TestFileWriterConfig(t *testing.T) {
+	dir := t.TempDir()
 	tests := []struct {
 		name    string
 		cfg     *FileWriterConfig
@@ -33,6 +52,130 @@ func TestFileWriterConfig(t *testing.T) {
 			fields:  []baker.FieldIndex{1},
 			wantErr: false,
 		},
+		{
+			name: "with multiple splits / not enough fields",
+			cfg: &FileWriterConfig{
+				PathString: "/path/{{.Field0}}/{{.Field1}}/file.gz",
+			},
+			fields:  []baker.FieldIndex{1},
+			wantErr: true,
+		},
+		{
+			name: "with multiple splits / with fields",
+			cfg: &FileWriterConfig{
+				PathString: "/path/{{.Field0}}/{{.Field1}}/file.gz",
+			},
+			fields:  []baker.FieldIndex{1, 2},
+			wantErr: false,
+		},
+		{
+			name: "field name placeholder",
+			cfg: &FileWriterConfig{
+				PathString: "/path/{field:f2}/file.gz",
+			},
+			fields:  []baker.FieldIndex{1, 2},
+			wantErr: false,
+		},
+		{
+			name: "field name placeholder / not in fields",
+			cfg: &FileWriterConfig{
+				PathString: "/path/{field:f2}/file.gz",
+			},
+			fields:  []baker.FieldIndex{1},
+			wantErr: true,
+		},
+		{
+			name: "field name placeholder / unknown field",
+			cfg: &FileWriterConfig{
+				PathString: "/path/{field:country}/file.gz",
+			},
+			fields:  []baker.FieldIndex{1},
+			wantErr: true,
+		},
+		{
+			name: "negative MaxOpenFiles",
+			cfg: &FileWriterConfig{
+				MaxOpenFiles: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "zstd compression",
+			cfg: &FileWriterConfig{
+				PathString:  "/path/file.log",
+				Compression: "zstd",
+			},
+			wantErr: false,
+		},
+		{
+			name: "unsupported compression",
+			cfg: &FileWriterConfig{
+				Compression: "lzma",
+			},
+			wantErr: true,
+		},
+		{
+			name: "compression/extension mismatch",
+			cfg: &FileWriterConfig{
+				PathString:  "/path/file.gz",
+				Compression: "zstd",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no compression with compressed extension",
+			cfg: &FileWriterConfig{
+				PathString:  "/path/file.zst",
+				Compression: "none",
+			},
+			wantErr: true,
+		},
+		{
+			name: "csv format",
+			cfg: &FileWriterConfig{
+				Format: "CSV",
+			},
+			wantErr: false,
+		},
+		{
+			name: "unsupported format",
+			cfg: &FileWriterConfig{
+				Format: "orc",
+			},
+			wantErr: true,
+		},
+		{
+			name: "timestamp field",
+			cfg: &FileWriterConfig{
+				TimestampField: "f1",
+			},
+			fields:  []baker.FieldIndex{0, 1},
+			wantErr: false,
+		},
+		{
+			name: "csv manifest",
+			cfg: &FileWriterConfig{
+				ManifestPath:   filepath.Join(dir, "manifest.csv"),
+				ManifestFormat: "CSV",
+			},
+			wantErr: false,
+		},
+		{
+			name: "unsupported manifest format",
+			cfg: &FileWriterConfig{
+				ManifestPath:   filepath.Join(dir, "manifest.xml"),
+				ManifestFormat: "xml",
+			},
+			wantErr: true,
+		},
+		{
+			name: "timestamp field not in fields",
+			cfg: &FileWriterConfig{
+				TimestampField: "f2",
+			},
+			fields:  []baker.FieldIndex{0, 1},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -40,6 +183,11 @@ func TestFileWriterConfig(t *testing.T) {
 			cfg := baker.OutputParams{
 				ComponentParams: baker.ComponentParams{
 					DecodedConfig: tt.cfg,
+					FieldName:     func(f baker.FieldIndex) string { return "f" + strconv.Itoa(int(f)) },
+					FieldByName: func(name string) (baker.FieldIndex, bool) {
+						n, err := strconv.Atoi(strings.TrimPrefix(name, "f"))
+						return baker.FieldIndex(n), strings.HasPrefix(name, "f") && err == nil
+					},
 				},
 				Fields: tt.fields,
 			}
@@ -54,3 +202,544 @@ func TestFileWriterConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestFileWriterCompression(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	gunzip := func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	unzstd := func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r), nil }
+
+	tests := []struct {
+		name        string
+		compression string
+		ext         string
+		decompress  func(r io.Reader) (io.Reader, error)
+	}{
+		{
+			name:        "none",
+			compression: "none",
+			ext:         ".log",
+			decompress:  func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+		{
+			name:        "gzip",
+			compression: "gzip",
+			ext:         ".log.gz",
+			decompress:  gunzip,
+		},
+		{
+			name:        "zstd",
+			compression: "zstd",
+			ext:         ".log.zst",
+			decompress:  unzstd,
+		},
+		{
+			name:       "gzip from extension",
+			ext:        ".log.gz",
+			decompress: gunzip,
+		},
+		{
+			name:       "zstd from extension",
+			ext:        ".log.zstd",
+			decompress: unzstd,
+		},
+		{
+			name:       "default without extension",
+			ext:        ".log",
+			decompress: gunzip,
+		},
+		{
+			name:        "zstd without extension",
+			compression: "zstd",
+			ext:         ".log",
+			decompress:  unzstd,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &FileWriterConfig{
+						PathString:     filepath.Join(dir, "out"+tt.ext),
+						Compression:    tt.compression,
+						RotateInterval: time.Hour,
+					},
+				},
+			}
+			fw, err := NewFileWriter(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := [][]byte{[]byte("a,b,c"), []byte("d,e,f"), []byte("g,h,i")}
+			in := make(chan baker.OutputRecord, len(records))
+			for _, r := range records {
+				in <- baker.OutputRecord{Record: r}
+			}
+			close(in)
+
+			upch := make(chan string, 10)
+			if err := fw.Run(in, upch); err != nil {
+				t.Fatal(err)
+			}
+
+			fname := filepath.Join(dir, "out"+tt.ext)
+			if got := <-upch; got != fname {
+				t.Fatalf("uploaded file = %q, want %q", got, fname)
+			}
+
+			f, err := os.Open(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			r, err := tt.decompress(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(bytes.Join(records, []byte("\n")), '\n')
+			if !bytes.Equal(got, want) {
+				t.Errorf("decompressed content = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFileWriterMaxRecords(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "out.{{.Rotation}}.log"),
+				Compression:    "none",
+				RotateInterval: -1,
+				MaxRecords:     100,
+			},
+		},
+	}
+	fw, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const nrecords = 250
+	in := make(chan baker.OutputRecord, nrecords)
+	for i := 0; i < nrecords; i++ {
+		in <- baker.OutputRecord{Record: []byte("a,b,c")}
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := fw.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	var files []string
+	for f := range upch {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	want := []int{100, 100, 50}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files %q, want %d", len(files), files, len(want))
+	}
+	for i, f := range files {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(buf), "\n"); n != want[i] {
+			t.Errorf("file %q has %d records, want %d", f, n, want[i])
+		}
+	}
+}
+
+func TestFileWriterManifest(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	// readManifest parses a manifest in the given format.
+	readManifest := map[string]func(t *testing.T, buf []byte) []manifestEntry{
+		"jsonl": func(t *testing.T, buf []byte) []manifestEntry {
+			var entries []manifestEntry
+			dec := json.NewDecoder(bytes.NewReader(buf))
+			for dec.More() {
+				var e manifestEntry
+				if err := dec.Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, e)
+			}
+			return entries
+		},
+		"csv": func(t *testing.T, buf []byte) []manifestEntry {
+			lines, err := csv.NewReader(bytes.NewReader(buf)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) == 0 || strings.Join(lines[0], ",") != "path,records,bytes,sha256" {
+				t.Fatalf("manifest header = %q", lines)
+			}
+			var entries []manifestEntry
+			for _, l := range lines[1:] {
+				nrecords, _ := strconv.Atoi(l[1])
+				size, _ := strconv.ParseInt(l[2], 10, 64)
+				entries = append(entries, manifestEntry{Path: l[0], Records: nrecords, Bytes: size, SHA256: l[3]})
+			}
+			return entries
+		},
+	}
+
+	for format, read := range readManifest {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &FileWriterConfig{
+						PathString:     filepath.Join(dir, "out.{{.Rotation}}.log.gz"),
+						RotateInterval: -1,
+						MaxRecords:     100,
+						ManifestPath:   filepath.Join(dir, "manifest.{{.Index}}."+format),
+						ManifestFormat: format,
+					},
+				},
+			}
+			fw, err := NewFileWriter(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const nrecords = 250
+			in := make(chan baker.OutputRecord, nrecords)
+			for i := 0; i < nrecords; i++ {
+				in <- baker.OutputRecord{Record: []byte(strconv.Itoa(i))}
+			}
+			close(in)
+
+			upch := make(chan string, 10)
+			if err := fw.Run(in, upch); err != nil {
+				t.Fatal(err)
+			}
+			close(upch)
+
+			var files []string
+			for f := range upch {
+				files = append(files, f)
+			}
+			// The manifest is sent to upload after the files it lists.
+			manifestPath := filepath.Join(dir, "manifest.0000."+format)
+			if len(files) != 4 || files[3] != manifestPath {
+				t.Fatalf("uploaded files = %q, want 3 files and then %q", files, manifestPath)
+			}
+			buf, err := ioutil.ReadFile(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries := read(t, buf)
+			want := []int{100, 100, 50}
+			if len(entries) != len(want) {
+				t.Fatalf("manifest has %d entries, want %d:\n%s", len(entries), len(want), buf)
+			}
+			for i, e := range entries {
+				if e.Path != files[i] {
+					t.Errorf("entry %d path = %q, want %q", i, e.Path, files[i])
+				}
+				if e.Records != want[i] {
+					t.Errorf("entry %d records = %d, want %d", i, e.Records, want[i])
+				}
+				content, err := ioutil.ReadFile(files[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Bytes != int64(len(content)) {
+					t.Errorf("entry %d bytes = %d, want %d", i, e.Bytes, len(content))
+				}
+				if sum := sha256.Sum256(content); e.SHA256 != hex.EncodeToString(sum[:]) {
+					t.Errorf("entry %d sha256 = %s, want %x", i, e.SHA256, sum)
+				}
+			}
+		})
+	}
+}
+
+func TestFileWriterPartitions(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "country={{.Field0}}", "{{.Field1}}.{{.UUID}}.log"),
+				Compression:    "none",
+				RotateInterval: -1,
+				MaxOpenFiles:   2,
+			},
+		},
+		Fields: []baker.FieldIndex{0, 1},
+	}
+	fw, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := [][]string{
+		{"us", "a"},
+		{"fr", "a"},
+		{"us", "a"},
+		{"", "b"},   // evicts fr/a
+		{"fr", "a"}, // evicts us/a
+		{"us", "a"}, // evicts __default__/b
+	}
+	in := make(chan baker.OutputRecord, len(records))
+	for _, r := range records {
+		in <- baker.OutputRecord{Fields: r, Record: []byte(strings.Join(r, ","))}
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := fw.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	// Count the records written to each partition.
+	got := make(map[string]int)
+	nfiles := 0
+	for f := range upch {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dir, filepath.Dir(f))
+		got[rel+"/"+strings.SplitN(filepath.Base(f), ".", 2)[0]] += strings.Count(string(buf), "\n")
+		nfiles++
+	}
+
+	want := map[string]int{
+		"country=us/a":          3,
+		"country=fr/a":          2,
+		"country=__default__/b": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records per partition = %v, want %v", got, want)
+	}
+	// us/a and fr/a have been closed once, then reopened.
+	if nfiles != 5 {
+		t.Errorf("got %d files, want 5", nfiles)
+	}
+	if n := fw.Stats().Metrics.Get("g:filewriter.open_files"); n != 0.0 {
+		t.Errorf("open files gauge = %v, want 0", n)
+	}
+}
+
+func TestFileWriterMetaPartitions(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "{{.Meta.src}}", "{{.Field0}}.log"),
+				Compression:    "none",
+				RotateInterval: -1,
+			},
+		},
+		Fields: []baker.FieldIndex{0},
+	}
+	fw, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []baker.OutputRecord{
+		{Fields: []string{"a"}, Meta: baker.Metadata{"src": "x"}},
+		{Fields: []string{"a"}, Meta: baker.Metadata{"src": "y"}},
+		{Fields: []string{"b"}, Meta: baker.Metadata{"src": "x"}},
+		{Fields: []string{"a"}, Meta: baker.Metadata{"src": "x"}},
+		{Fields: []string{"a"}}, // no metadata
+	}
+	in := make(chan baker.OutputRecord, len(records))
+	for _, r := range records {
+		r.Record = []byte(r.Fields[0])
+		in <- r
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := fw.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	got := make(map[string]int)
+	for f := range upch {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dir, f)
+		got[rel] += strings.Count(string(buf), "\n")
+	}
+	want := map[string]int{
+		"x/a.log":           2,
+		"x/b.log":           1,
+		"y/a.log":           1,
+		"__default__/a.log": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records per partition = %v, want %v", got, want)
+	}
+}
+
+func TestFileWriterFieldNamePartitions(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	names := map[string]baker.FieldIndex{"id": 3, "country": 7}
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "country={field:country}", "part.log"),
+				Compression:    "none",
+				RotateInterval: -1,
+			},
+			FieldByName: func(name string) (baker.FieldIndex, bool) {
+				f, ok := names[name]
+				return f, ok
+			},
+		},
+		Fields: []baker.FieldIndex{3, 7},
+	}
+	fw, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := [][]string{
+		{"1", "us"},
+		{"2", "fr"},
+		{"3", "us"},
+		{"4", ""},
+	}
+	in := make(chan baker.OutputRecord, len(records))
+	for _, r := range records {
+		in <- baker.OutputRecord{Fields: r, Record: []byte(r[0])}
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := fw.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	got := make(map[string]string)
+	for f := range upch {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dir, f)
+		got[rel] = string(buf)
+	}
+	want := map[string]string{
+		"country=us/part.log":          "1\n3\n",
+		"country=fr/part.log":          "2\n",
+		"country=__default__/part.log": "4\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records per partition = %q, want %q", got, want)
+	}
+
+	// Unknown field names are rejected by the configuration validation.
+	fwcfg := &FileWriterConfig{PathString: "/path/{field:city}/part.log"}
+	if err := fwcfg.ValidateConfig(cfg.FieldByName); err == nil {
+		t.Errorf("ValidateConfig(%q) = nil, want an error", fwcfg.PathString)
+	}
+}
+
+func TestFileWriterEventTimePartitions(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &FileWriterConfig{
+				PathString:     filepath.Join(dir, "{{.Year}}-{{.Month}}-{{.Day}}", "{{.UUID}}.log"),
+				Compression:    "none",
+				RotateInterval: -1,
+				TimestampField: "ts",
+			},
+			FieldName: func(f baker.FieldIndex) string { return []string{"id", "ts"}[f] },
+		},
+		Fields: []baker.FieldIndex{0, 1},
+	}
+	fw, err := NewFileWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	yesterday := now.AddDate(0, 0, -1)
+	records := [][]string{
+		{"a", now.Format(time.RFC3339)},
+		{"b", yesterday.Format(time.RFC3339)},
+		{"c", now.Format(time.RFC3339)},
+		{"d", ""},        // no timestamp
+		{"e", "garbage"}, // invalid timestamp
+		{"f", yesterday.Format(time.RFC3339)},
+	}
+	in := make(chan baker.OutputRecord, len(records))
+	for _, r := range records {
+		in <- baker.OutputRecord{Fields: r, Record: []byte(r[0])}
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := fw.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	got := make(map[string]string)
+	for f := range upch {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dir, filepath.Dir(f))
+		got[rel] += strings.Replace(string(buf), "\n", "", -1)
+	}
+
+	yday := yesterday.Format("2006-01-02")
+	if got[yday] != "bf" {
+		t.Errorf("records of %s = %q, want %q", yday, got[yday], "bf")
+	}
+	// The other records, including those without a valid timestamp that fall
+	// back to the current time, are in today's partition (or tomorrow's, if
+	// the test runs across midnight).
+	n := 0
+	for day, recs := range got {
+		if day != yday {
+			n += len(recs)
+		}
+	}
+	if n != 4 {
+		t.Errorf("got %d records out of %s, want 4: %q", n, yday, got)
+	}
+	if n := fw.Stats().Metrics.Get("c:filewriter.timestamp_fallbacks"); n != int64(2) {
+		t.Errorf("timestamp fallbacks = %v, want 2", n)
+	}
+}
@@ -0,0 +1,127 @@
+package output
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// List of manifest formats supported by the FileWriter.
+const (
+	manifestJSONL = "jsonl"
+	manifestCSV   = "csv"
+)
+
+// manifestEntry describes a file finalized by the FileWriter.
+type manifestEntry struct {
+	Path    string `json:"path"`
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// manifest lists the files produced by the FileWriter workers, one entry
+// per line, as JSON objects or as CSV records. Each entry is written as soon
+// as the file it describes is finalized, so that the manifest is always up
+// to date with the files sent to upload.
+type manifest struct {
+	path string
+
+	mu   sync.Mutex // protects the writes to f
+	f    *os.File
+	enc  *json.Encoder // with the jsonl format
+	csvw *csv.Writer   // with the csv format
+}
+
+// newManifest creates the manifest file at path, truncating it if it exists.
+func newManifest(path, format string) (*manifest, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("can't create manifest: %v", err)
+	}
+
+	m := &manifest{path: path, f: f}
+	switch format {
+	case manifestCSV:
+		m.csvw = csv.NewWriter(f)
+		m.csvw.Write([]string{"path", "records", "bytes", "sha256"})
+		m.csvw.Flush()
+		err = m.csvw.Error()
+	default:
+		m.enc = json.NewEncoder(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't write manifest: %v", err)
+	}
+	return m, nil
+}
+
+// add writes an entry to the manifest.
+func (m *manifest) add(e manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.csvw != nil {
+		m.csvw.Write([]string{e.Path, strconv.Itoa(e.Records), strconv.FormatInt(e.Bytes, 10), e.SHA256})
+		m.csvw.Flush()
+		return m.csvw.Error()
+	}
+	return m.enc.Encode(e)
+}
+
+// close finalizes the manifest, once all the files have been added.
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.f.Sync(); err != nil {
+		m.f.Close()
+		return err
+	}
+	return m.f.Close()
+}
+
+// checkManifestFormat returns the normalized manifest format, or an error if
+// it isn't supported.
+func checkManifestFormat(format string) (string, error) {
+	switch format = strings.ToLower(format); format {
+	case "":
+		return manifestJSONL, nil
+	case manifestJSONL, manifestCSV:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported ManifestFormat: %q", format)
+}
+
+// digestWriter is an io.Writer computing the size and the SHA-256 checksum
+// of the data written to the underlying writer.
+type digestWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter(w io.Writer) *digestWriter {
+	return &digestWriter{w: w, hash: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// sum returns the hex encoded checksum of the data written so far.
+func (d *digestWriter) sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package output
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// MemoryDesc describes the Memory output.
+var MemoryDesc = baker.OutputDesc{
+	Name:   "Memory",
+	New:    NewMemory,
+	Config: &MemoryConfig{},
+	Raw:    true,
+	Help: "This output keeps all the records it receives in memory, both as raw text and as the list\n" +
+		"of fields of the output's fields list. It's meant for tests and programs embedding baker, that\n" +
+		"can get the records with the Records method, once the topology is done or while it's running.\n",
+}
+
+// MemoryConfig holds the configuration of the Memory output.
+type MemoryConfig struct{}
+
+// Memory is an output collecting records in memory.
+type Memory struct {
+	mu      sync.Mutex
+	records []baker.OutputRecord
+
+	totaln int64
+}
+
+// NewMemory returns a new Memory output.
+func NewMemory(cfg baker.OutputParams) (baker.Output, error) {
+	return &Memory{}, nil
+}
+
+// Run implements baker.Output.
+func (m *Memory) Run(input <-chan baker.OutputRecord, _ chan<- string) error {
+	for rec := range input {
+		// Copy the record, since its buffer may be reused once we return.
+		cpy := rec
+		cpy.Record = append([]byte(nil), rec.Record...)
+		cpy.Fields = append([]string(nil), rec.Fields...)
+
+		m.mu.Lock()
+		m.records = append(m.records, cpy)
+		m.mu.Unlock()
+		atomic.AddInt64(&m.totaln, 1)
+	}
+
+	return nil
+}
+
+// Records returns the records received so far. It's safe to call Records
+// while the topology is running.
+func (m *Memory) Records() []baker.OutputRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]baker.OutputRecord(nil), m.records...)
+}
+
+// Stats implements baker.Output.
+func (m *Memory) Stats() baker.OutputStats {
+	return baker.OutputStats{
+		NumProcessedLines: atomic.LoadInt64(&m.totaln),
+	}
+}
+
+// CanShard implements baker.Output.
+func (m *Memory) CanShard() bool { return true }
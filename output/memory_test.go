@@ -0,0 +1,102 @@
+package output
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+)
+
+// recyclingInput is an input sending many records through a small pool of
+// buffers, which are overwritten as soon as they're given back with FreeMem.
+// Record i is sent alone, as line i+1, with the recyclingMeta metadata.
+type recyclingInput struct {
+	inputtest.Base
+
+	nrecords int
+	pool     sync.Pool
+}
+
+var recyclingMeta = baker.Metadata{"src": "recycling"}
+
+func (in *recyclingInput) Run(output chan<- *baker.Data) error {
+	for i := 0; i < in.nrecords; i++ {
+		data := in.pool.Get().(*baker.Data)
+		data.Bytes = append(data.Bytes[:0], fmt.Sprintf("record%d,%d", i, i)...)
+		data.Meta = recyclingMeta
+		data.FirstLine = int64(i + 1)
+		output <- data
+	}
+	return nil
+}
+
+func (in *recyclingInput) FreeMem(data *baker.Data) {
+	// Scribble over the buffer, to detect any reference kept to it.
+	for i := range data.Bytes {
+		data.Bytes[i] = 'X'
+	}
+	in.pool.Put(data)
+}
+
+func TestMemory(t *testing.T) {
+	const nrecords = 10000
+
+	in := &recyclingInput{
+		nrecords: nrecords,
+		pool: sync.Pool{
+			New: func() interface{} { return &baker.Data{Bytes: make([]byte, 0, 64)} },
+		},
+	}
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Recycling",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{MemoryDesc},
+	}
+	cfg := baker.Config{
+		Input:  baker.ConfigInput{Name: "Recycling"},
+		Output: []baker.ConfigOutput{{Name: "Memory", Procs: 1, Fields: []string{"id"}}},
+		Fields: baker.ConfigFields{Names: []string{"name", "id"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	topo.Wait()
+
+	mem := topo.Output[0].(*Memory)
+	recs := mem.Records()
+	if len(recs) != nrecords {
+		t.Fatalf("got %d records, want %d", len(recs), nrecords)
+	}
+
+	seen := make(map[string]bool, nrecords)
+	for _, r := range recs {
+		name := strings.TrimPrefix(string(r.Record), "record")
+		ids := strings.SplitN(name, ",", 2)
+		if len(ids) != 2 || ids[0] != ids[1] || r.Fields[0] != ids[0] {
+			t.Fatalf("corrupted record: raw=%q fields=%q", r.Record, r.Fields)
+		}
+		if r.Meta["src"] != "recycling" {
+			t.Fatalf("record %s: meta = %v, want %v", ids[0], r.Meta, recyclingMeta)
+		}
+		if n, _ := strconv.ParseInt(ids[0], 10, 64); r.Line != n+1 {
+			t.Fatalf("record %s: line = %d, want %d", ids[0], r.Line, n+1)
+		}
+		seen[r.Fields[0]] = true
+	}
+	if len(seen) != nrecords {
+		t.Errorf("got %d distinct records, want %d", len(seen), nrecords)
+	}
+	if got := mem.Stats().NumProcessedLines; got != nrecords {
+		t.Errorf("NumProcessedLines = %d, want %d", got, nrecords)
+	}
+}
@@ -0,0 +1,47 @@
+package output
+
+import (
+	"sync/atomic"
+
+	"github.com/AdRoll/baker"
+)
+
+// NullDesc describes the Null output.
+var NullDesc = baker.OutputDesc{
+	Name:    "Null",
+	New:     NewNull,
+	Config:  &NullConfig{},
+	Discard: true,
+	Help: "This output counts the records it receives and discards them, without serializing nor\n" +
+		"writing anything. It's meant for benchmarking inputs and filters, or for topologies whose\n" +
+		"filters only have side effects. It's the output of the topologies without [output] section.\n",
+}
+
+// NullConfig holds the (empty) configuration of the Null output.
+type NullConfig struct{}
+
+// Null is an output discarding the records.
+type Null struct {
+	totaln int64
+}
+
+// NewNull returns a new Null output.
+func NewNull(cfg baker.OutputParams) (baker.Output, error) {
+	return &Null{}, nil
+}
+
+// Run implements baker.Output.
+func (n *Null) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	for range input {
+		atomic.AddInt64(&n.totaln, 1)
+	}
+	return nil
+}
+
+// Stats implements baker.Output.
+func (n *Null) Stats() baker.OutputStats {
+	return baker.OutputStats{NumProcessedLines: atomic.LoadInt64(&n.totaln)}
+}
+
+// CanShard implements baker.Output.
+func (n *Null) CanShard() bool { return true }
@@ -0,0 +1,93 @@
+package output
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/upload/uploadtest"
+)
+
+// pathsUpload is an upload recording the paths it receives.
+type pathsUpload struct {
+	uploadtest.Base
+	paths []string
+}
+
+func (u *pathsUpload) Run(upch <-chan string) error {
+	for p := range upch {
+		u.paths = append(u.paths, p)
+	}
+	return nil
+}
+
+func TestNullDefaultOutput(t *testing.T) {
+	const nrecords = 10000
+
+	in := &recyclingInput{
+		nrecords: nrecords,
+		pool: sync.Pool{
+			New: func() interface{} { return &baker.Data{Bytes: make([]byte, 0, 64)} },
+		},
+	}
+	upl := &pathsUpload{}
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Recycling",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{NullDesc},
+		Uploads: []baker.UploadDesc{{
+			Name:   "Paths",
+			New:    func(baker.UploadParams) (baker.Upload, error) { return upl, nil },
+			Config: &struct{}{},
+		}},
+	}
+
+	// Without [output], the records go to the Null output.
+	toml := `
+[fields]
+names=["name", "id"]
+
+[input]
+name="Recycling"
+
+[upload]
+name="Paths"
+`
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Output) != 1 || cfg.Output[0].Name != "Null" {
+		t.Fatalf("outputs = %+v, want the Null output", cfg.Output)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	for _, out := range topo.Output {
+		n += out.(*Null).Stats().NumProcessedLines
+	}
+	if n != nrecords {
+		t.Errorf("Null output counted %d records, want %d", n, nrecords)
+	}
+	if len(upl.paths) != 0 {
+		t.Errorf("Null output sent %q to upload, want nothing", upl.paths)
+	}
+
+	// Without Null output among the components, an output is required.
+	comp.Outputs = []baker.OutputDesc{NopDesc}
+	if _, err := baker.NewConfigFromToml(strings.NewReader(toml), comp); err == nil {
+		t.Errorf("configuration without [output] accepted without Null output")
+	}
+}
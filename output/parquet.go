@@ -0,0 +1,310 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/AdRoll/baker"
+)
+
+// ParquetDesc describes the Parquet output.
+var ParquetDesc = baker.OutputDesc{
+	Name:   "Parquet",
+	New:    NewParquet,
+	Config: &ParquetConfig{},
+	Raw:    false,
+	Help: "This output writes records into Parquet files, following the schema described by the Schema option.\n" +
+		"Each column of the schema corresponds to a field of the output's fields list, and has one of\n" +
+		"the following types: string, int64, double or bool. All columns are optional: values that\n" +
+		"can't be converted to the column type are written as null.\n" +
+		"PathString supports the same placeholders as the FileWriter output, except {{.FieldN}} and {field:name}.",
+}
+
+// ParquetConfig holds the configuration parameters of the Parquet output.
+type ParquetConfig struct {
+	PathString     string        `help:"Template to describe location of the output files. See FileWriter PathString" default:"/tmp/baker/ologs/parquet/{{.Year}}/{{.Month}}/{{.Day}}/baker/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.parquet"`
+	Schema         []string      `help:"Columns of the Parquet files, in the 'field:type' form, where field is in the output's fields list and type is string, int64, double or bool" required:"true"`
+	RotateInterval time.Duration `help:"Time after which data will be rotated. If -1, it will not rotate until the end." default:"60s"`
+	MaxRecords     int           `help:"Maximum number of records written in a file before it gets rotated. 0:disabled." default:"0"`
+	RowGroupSize   int64         `help:"Approximate size, in bytes, of the row groups buffered in memory before being written" default:"134217728"`
+	Compression    string        `help:"Compression codec of the column chunks: none, snappy or gzip" default:"snappy"`
+}
+
+func (cfg *ParquetConfig) fillDefaults() {
+	if cfg.PathString == "" {
+		cfg.PathString = "/tmp/baker/ologs/parquet/{{.Year}}/{{.Month}}/{{.Day}}/baker/{{.Year}}{{.Month}}{{.Day}}-{{.Hour}}{{.Minute}}{{.Second}}.{{.Index}}.parquet"
+	}
+	if cfg.RotateInterval == 0 {
+		cfg.RotateInterval = 60 * time.Second
+	}
+	if cfg.RowGroupSize == 0 {
+		cfg.RowGroupSize = 128 * 1024 * 1024
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "snappy"
+	}
+}
+
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+}
+
+// parquetTypes maps the supported column types to the parquet-go schema
+// metadata and the function converting record values to that type.
+var parquetTypes = map[string]struct {
+	md      string
+	convert func(string) (interface{}, error)
+}{
+	"string": {
+		md:      "type=UTF8",
+		convert: func(s string) (interface{}, error) { return s, nil },
+	},
+	"int64": {
+		md:      "type=INT64",
+		convert: func(s string) (interface{}, error) { return strconv.ParseInt(s, 10, 64) },
+	},
+	"double": {
+		md:      "type=DOUBLE",
+		convert: func(s string) (interface{}, error) { return strconv.ParseFloat(s, 64) },
+	},
+	"bool": {
+		md:      "type=BOOLEAN",
+		convert: func(s string) (interface{}, error) { return strconv.ParseBool(s) },
+	},
+}
+
+// parquetColumn is a column of the written Parquet files.
+type parquetColumn struct {
+	idx     int // index in OutputRecord.Fields
+	convert func(string) (interface{}, error)
+}
+
+// Parquet is an output writing records into Parquet files.
+type Parquet struct {
+	cfg          *ParquetConfig
+	index        int
+	uid          string
+	pathTemplate *template.Template
+	codec        parquet.CompressionCodec
+
+	md      []string // parquet-go schema metadata
+	columns []parquetColumn
+
+	// state of the current file
+	rotateIdx int64
+	path      string
+	fd        *os.File
+	bw        *bufio.Writer
+	pw        *writer.CSVWriter
+	nrecords  int
+
+	totaln   int64
+	errn     int64
+	convErrn int64
+}
+
+// NewParquet returns a new Parquet output.
+func NewParquet(cfg baker.OutputParams) (baker.Output, error) {
+	log.WithFields(log.Fields{"fn": "NewParquet", "idx": cfg.Index}).Info("Initializing")
+
+	if cfg.DecodedConfig == nil {
+		cfg.DecodedConfig = &ParquetConfig{}
+	}
+	dcfg := cfg.DecodedConfig.(*ParquetConfig)
+	dcfg.fillDefaults()
+
+	pathTemplate, err := template.New("parquet").Parse(dcfg.PathString)
+	if err != nil {
+		return nil, fmt.Errorf("PathString: %s", err)
+	}
+	if replFieldRx.MatchString(dcfg.PathString) || replNameRx.MatchString(dcfg.PathString) {
+		return nil, fmt.Errorf("PathString: {{.FieldN}} and {field:name} placeholders are not supported")
+	}
+	if replMetaRx.MatchString(dcfg.PathString) {
+		return nil, fmt.Errorf("PathString: {{.Meta.key}} placeholders are not supported")
+	}
+
+	codec, ok := parquetCodecs[strings.ToLower(dcfg.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression: %q", dcfg.Compression)
+	}
+
+	if len(dcfg.Schema) == 0 {
+		return nil, fmt.Errorf("Schema must contain at least one column")
+	}
+
+	w := &Parquet{
+		cfg:          dcfg,
+		index:        cfg.Index,
+		uid:          uuid.New().String(),
+		pathTemplate: pathTemplate,
+		codec:        codec,
+	}
+
+	for _, col := range dcfg.Schema {
+		name, typ := col, ""
+		if i := strings.LastIndexByte(col, ':'); i != -1 {
+			name, typ = col[:i], col[i+1:]
+		}
+		pt, ok := parquetTypes[strings.ToLower(typ)]
+		if !ok {
+			return nil, fmt.Errorf("Schema: column %q: unsupported type %q", col, typ)
+		}
+
+		fidx, ok := cfg.FieldByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Schema: column %q: unknown field %s", col, name)
+		}
+		idx := -1
+		for i, f := range cfg.Fields {
+			if f == fidx {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return nil, fmt.Errorf("Schema: column %q: field %s is not in the output's fields list", col, name)
+		}
+
+		w.md = append(w.md, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", name, pt.md))
+		w.columns = append(w.columns, parquetColumn{idx: idx, convert: pt.convert})
+	}
+
+	return w, nil
+}
+
+// Run implements baker.Output.
+func (w *Parquet) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	log.WithFields(log.Fields{"idx": w.index}).Info("Parquet ready to log")
+
+	var tick <-chan time.Time
+	if w.cfg.RotateInterval > 0 {
+		ticker := time.NewTicker(w.cfg.RotateInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case rec, ok := <-input:
+			if !ok {
+				log.WithFields(log.Fields{"idx": w.index}).Info("Parquet Terminating")
+				return w.close(upch)
+			}
+			if w.cfg.MaxRecords > 0 && w.nrecords >= w.cfg.MaxRecords {
+				if err := w.rotate(upch); err != nil {
+					return err
+				}
+			}
+			if err := w.write(rec.Fields); err != nil {
+				return err
+			}
+		case <-tick:
+			if err := w.rotate(upch); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *Parquet) write(fields []string) error {
+	row := make([]interface{}, len(w.columns))
+	for i, col := range w.columns {
+		v, err := col.convert(fields[col.idx])
+		if err != nil {
+			// Leave it null.
+			atomic.AddInt64(&w.convErrn, 1)
+			continue
+		}
+		row[i] = v
+	}
+
+	if err := w.pw.Write(row); err != nil {
+		atomic.AddInt64(&w.errn, 1)
+		return fmt.Errorf("can't write to %s: %s", w.path, err)
+	}
+	w.nrecords++
+	atomic.AddInt64(&w.totaln, 1)
+	return nil
+}
+
+// open creates a new Parquet file.
+func (w *Parquet) open() error {
+	w.path = renderPath(w.pathTemplate, w.index, w.uid, w.rotateIdx, time.Time{}, nil, nil)
+	w.rotateIdx++
+	w.nrecords = 0
+
+	fd, err := os.Create(w.path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(fd, fileWorkerChunkBuffer)
+	pw, err := writer.NewCSVWriterFromWriter(w.md, bw, 1)
+	if err != nil {
+		fd.Close()
+		return fmt.Errorf("can't create Parquet writer for %s: %s", w.path, err)
+	}
+	pw.RowGroupSize = w.cfg.RowGroupSize
+	pw.CompressionType = w.codec
+
+	w.fd, w.bw, w.pw = fd, bw, pw
+	return nil
+}
+
+// close finalizes the current file, writing its footer, and sends it to upload.
+func (w *Parquet) close(upch chan<- string) error {
+	if err := w.pw.WriteStop(); err != nil {
+		w.fd.Close()
+		return fmt.Errorf("can't finalize %s: %s", w.path, err)
+	}
+	if err := w.bw.Flush(); err != nil {
+		w.fd.Close()
+		return fmt.Errorf("can't flush %s: %s", w.path, err)
+	}
+	if err := w.fd.Close(); err != nil {
+		return err
+	}
+	upch <- w.path
+	return nil
+}
+
+// rotate closes the current file and opens a new one.
+func (w *Parquet) rotate(upch chan<- string) error {
+	log.WithFields(log.Fields{"current": w.path, "idx": w.index}).Info("Rotating")
+	if err := w.close(upch); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Stats implements baker.Output.
+func (w *Parquet) Stats() baker.OutputStats {
+	bag := &baker.MetricsBag{}
+	bag.AddRawCounter("parquet.conversion_errors", atomic.LoadInt64(&w.convErrn))
+
+	return baker.OutputStats{
+		NumProcessedLines: atomic.LoadInt64(&w.totaln),
+		NumErrorLines:     atomic.LoadInt64(&w.errn),
+		Metrics:           bag,
+	}
+}
+
+// CanShard implements baker.Output.
+func (w *Parquet) CanShard() bool { return false }
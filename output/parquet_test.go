@@ -0,0 +1,175 @@
+package output
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/testutil"
+)
+
+func TestParquet(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "name":
+			return 0, true
+		case "age":
+			return 1, true
+		case "score":
+			return 2, true
+		case "active":
+			return 3, true
+		}
+		return 0, false
+	}
+
+	dir := t.TempDir()
+	cfg := baker.OutputParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &ParquetConfig{
+				PathString:     filepath.Join(dir, "out.{{.Rotation}}.parquet"),
+				Schema:         []string{"name:string", "age:int64", "score:double", "active:bool"},
+				RotateInterval: -1,
+				MaxRecords:     2,
+			},
+			FieldByName: fieldByName,
+		},
+		// Different order than the schema, to check columns are mapped by name.
+		Fields: []baker.FieldIndex{3, 2, 1, 0},
+	}
+	out, err := NewParquet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := [][]string{
+		{"true", "1.5", "31", "alice"},
+		{"false", "2", "not a number", "bob"},
+		{"1", "nan?", "27", "carol"},
+	}
+	in := make(chan baker.OutputRecord, len(records))
+	for _, r := range records {
+		in <- baker.OutputRecord{Fields: r}
+	}
+	close(in)
+
+	upch := make(chan string, 10)
+	if err := out.Run(in, upch); err != nil {
+		t.Fatal(err)
+	}
+	close(upch)
+
+	var files []string
+	for f := range upch {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	if len(files) != 2 {
+		t.Fatalf("got %d files %q, want 2", len(files), files)
+	}
+
+	// Expected columns, per file.
+	want := [][][]interface{}{
+		{
+			{"alice", "bob"},
+			{int64(31), nil},
+			{1.5, 2.0},
+			{true, false},
+		},
+		{
+			{"carol"},
+			{int64(27)},
+			{nil},
+			{true},
+		},
+	}
+
+	for i, f := range files {
+		pf, err := local.NewLocalFileReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, err := reader.NewParquetColumnReader(pf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for i := 1; i < len(pr.SchemaHandler.Infos); i++ {
+			names = append(names, pr.SchemaHandler.GetExName(i))
+		}
+		if wantNames := []string{"name", "age", "score", "active"}; !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("%s: schema columns = %q, want %q", f, names, wantNames)
+		}
+
+		nrows := pr.GetNumRows()
+		for col := range want[i] {
+			values, _, _, err := pr.ReadColumnByIndex(int64(col), nrows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, want[i][col]) {
+				t.Errorf("%s: column %d = %#v, want %#v", f, col, values, want[i][col])
+			}
+		}
+		pr.ReadStop()
+		pf.Close()
+	}
+
+	stats := out.Stats()
+	if stats.NumProcessedLines != 3 {
+		t.Errorf("NumProcessedLines = %d, want 3", stats.NumProcessedLines)
+	}
+	if got := stats.Metrics.Get("c:parquet.conversion_errors"); got != int64(2) {
+		t.Errorf("parquet.conversion_errors = %v, want 2", got)
+	}
+}
+
+func TestParquetConfigErrors(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	tests := []struct {
+		name string
+		cfg  ParquetConfig
+	}{
+		{name: "no schema", cfg: ParquetConfig{}},
+		{name: "unknown type", cfg: ParquetConfig{Schema: []string{"foo:int32"}}},
+		{name: "no type", cfg: ParquetConfig{Schema: []string{"foo"}}},
+		{name: "unknown field", cfg: ParquetConfig{Schema: []string{"bar:string"}}},
+		{name: "field not in output fields", cfg: ParquetConfig{Schema: []string{"baz:string"}}},
+		{name: "unknown compression", cfg: ParquetConfig{Schema: []string{"foo:string"}, Compression: "lz4"}},
+		{name: "field placeholder", cfg: ParquetConfig{Schema: []string{"foo:string"}, PathString: "/tmp/{{.Field0}}.parquet"}},
+	}
+
+	fieldByName := func(name string) (baker.FieldIndex, bool) {
+		switch name {
+		case "foo":
+			return 0, true
+		case "baz":
+			return 2, true
+		}
+		return 0, false
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := baker.OutputParams{
+				ComponentParams: baker.ComponentParams{
+					DecodedConfig: &tt.cfg,
+					FieldByName:   fieldByName,
+				},
+				Fields: []baker.FieldIndex{0},
+			}
+			if _, err := NewParquet(cfg); err == nil {
+				t.Errorf("NewParquet() err = nil, want an error")
+			}
+		})
+	}
+}
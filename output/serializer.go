@@ -0,0 +1,98 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+
+	"github.com/AdRoll/baker"
+)
+
+// A RecordSerializer encodes the records written into a file by the
+// FileWriter output (and the outputs built on it, like CSV). A serializer is
+// created for each file, see SerializerFunc, so that it can hold per-file
+// state like a header or buffered records.
+type RecordSerializer interface {
+	// WriteRecord encodes a record into the file.
+	WriteRecord(rec baker.OutputRecord) error
+
+	// Finalize writes into w whatever the file still lacks, like buffered
+	// records or a footer. w is the writer the serializer has been created
+	// with, the serializer isn't used after Finalize has been called.
+	Finalize(w io.Writer) error
+}
+
+// A SerializerFunc returns a new serializer writing a file into w. Writes to w
+// are buffered and compressed by the FileWriter.
+type SerializerFunc func(w io.Writer) RecordSerializer
+
+// List of formats supported by the FileWriter.
+const (
+	formatLine = "line"
+	formatCSV  = "csv"
+	formatAvro = "avro"
+)
+
+// newSerializerFunc returns the SerializerFunc corresponding to the format
+// configured in cfg.
+func newSerializerFunc(cfg *FileWriterConfig, params baker.OutputParams) (SerializerFunc, error) {
+	switch cfg.Format {
+	case formatLine:
+		return LineSerializer, nil
+	case formatCSV:
+		return CSVSerializer(',', nil), nil
+	case formatAvro:
+		return newAvroSerializerFunc(cfg.AvroSchema, params)
+	}
+	return nil, fmt.Errorf("unsupported format: %q", cfg.Format)
+}
+
+// LineSerializer is the SerializerFunc of the FileWriter default format: each
+// record is written as is (see baker.OutputRecord.Record), followed by a newline.
+func LineSerializer(w io.Writer) RecordSerializer { return lineSerializer{w} }
+
+type lineSerializer struct{ w io.Writer }
+
+func (s lineSerializer) WriteRecord(rec baker.OutputRecord) error {
+	if _, err := s.w.Write(rec.Record); err != nil {
+		return err
+	}
+	_, err := s.w.Write([]byte("\n"))
+	return err
+}
+
+func (lineSerializer) Finalize(io.Writer) error { return nil }
+
+// CSVSerializer returns a SerializerFunc writing the record fields (see
+// baker.OutputRecord.Fields) as CSV lines, using sep as separator. If header
+// isn't nil, it's written as first line of each file.
+func CSVSerializer(sep rune, header []string) SerializerFunc {
+	return func(w io.Writer) RecordSerializer {
+		cw := csv.NewWriter(w)
+		cw.Comma = sep
+		return &csvSerializer{cw: cw, header: header}
+	}
+}
+
+type csvSerializer struct {
+	cw     *csv.Writer
+	header []string // not nil until written
+}
+
+func (s *csvSerializer) writeHeader() {
+	if s.header != nil {
+		s.cw.Write(s.header)
+		s.header = nil
+	}
+}
+
+func (s *csvSerializer) WriteRecord(rec baker.OutputRecord) error {
+	s.writeHeader()
+	return s.cw.Write(rec.Fields)
+}
+
+func (s *csvSerializer) Finalize(io.Writer) error {
+	s.writeHeader()
+	s.cw.Flush()
+	return s.cw.Error()
+}
@@ -0,0 +1,51 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AdRoll/baker"
+)
+
+func TestLineSerializer(t *testing.T) {
+	records := [][]byte{
+		[]byte("a,b,c"),
+		[]byte(""),
+		[]byte("quoted \"value\",\t,"),
+	}
+
+	// The FileWriter used to write each record followed by a newline.
+	want := &bytes.Buffer{}
+	for _, r := range records {
+		want.Write(r)
+		want.WriteString("\n")
+	}
+
+	got := &bytes.Buffer{}
+	s := LineSerializer(got)
+	for _, r := range records {
+		if err := s.WriteRecord(baker.OutputRecord{Record: r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Finalize(got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCSVSerializerEmptyFile(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := CSVSerializer(';', []string{"id", "name"})(buf)
+	if err := s.Finalize(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files with no records still have a header.
+	if got, want := buf.String(), "id;name\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
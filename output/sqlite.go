@@ -41,6 +41,8 @@ type SQLiteConfig struct {
 	Vacuum     bool     `help:"Should we run VACUUM at the end? Note that PostRun can't take VACUUM commands because it's run inside a transaction. If you want to vacuum, pass this argument. (Useful if your PostRun command deletes lots of data, and you want to shrink the file size)."`
 	Wal        bool     `help:"Send PRAGMA journal_mode=wal; before starting. This turns on write-ahead logging for the SQLite file. This mode is usually more friendly to bulk I/O operations."`
 	PageSize   int64    `help:"The page size to use for SQLite. By default, we use whatever SQLite decides to use as default."`
+	Columns    []string `help:"Names of the table columns the output fields are written to, in the order of the output's fields list. A column name can be followed by its type, as in \"price:REAL\" (TEXT, INTEGER, REAL, NUMERIC or BLOB), otherwise the column is TEXT. If empty, the columns are named after the fields and untyped."`
+	BatchSize  int      `help:"Number of records inserted per transaction. By default, all the records are inserted in a single transaction, committed at exit." default:"0"`
 }
 
 // convert to raw config, which is a superset, so that the sqlite output can
@@ -55,6 +57,8 @@ func (cfg *SQLiteConfig) convert() *SQLiteRawWriterConfig {
 		Vacuum:     cfg.Vacuum,
 		Wal:        cfg.Wal,
 		PageSize:   cfg.PageSize,
+		Columns:    cfg.Columns,
+		BatchSize:  cfg.BatchSize,
 	}
 }
 
@@ -69,19 +73,59 @@ type SQLiteRawWriterConfig struct {
 	Vacuum         bool     `help:"Should we run VACUUM at the end? Note that PostRun can't take VACUUM commands because it's run inside a transaction. If you want to vacuum, pass this argument. (Useful if your PostRun command deletes lots of data, and you want to shrink the file size)."`
 	Wal            bool     `help:"Send PRAGMA journal_mode=wal; before starting. This turns on write-ahead logging for the SQLite file. This mode is usually more friendly to bulk I/O operations."`
 	PageSize       int64    `help:"The page size to use for SQLite. By default, we use whatever SQLite decides to use as default."`
+	Columns        []string `help:"Names of the table columns the output fields are written to, in the order of the output's fields list. A column name can be followed by its type, as in \"price:REAL\" (TEXT, INTEGER, REAL, NUMERIC or BLOB), otherwise the column is TEXT. If empty, the columns are named after the fields and untyped."`
+	BatchSize      int      `help:"Number of records inserted per transaction. By default, all the records are inserted in a single transaction, committed at exit." default:"0"`
 	RecordBlobName string   `help:"Name of the column in which the whole raw record should be put." required:"true"`
 }
 
 type SQLite struct {
 	cfg        *SQLiteRawWriterConfig
 	pathString string
-	fieldNames []string
+	columns    []sqliteColumn // columns of the output fields
 	nEvents    int64
 	isRaw      bool    // are we a raw sqlite writer?
 	tx         *sql.Tx // main transaction
 	conn       *sql.DB
 }
 
+// sqliteColumn is a table column an output field is written to.
+type sqliteColumn struct {
+	name string
+	typ  string // empty if untyped
+}
+
+// sqliteTypes are the column types supported in Columns.
+var sqliteTypes = map[string]bool{"TEXT": true, "INTEGER": true, "REAL": true, "NUMERIC": true, "BLOB": true}
+
+// parseSQLiteColumns returns the columns the output fields are written to.
+func parseSQLiteColumns(columns, fieldNames []string) ([]sqliteColumn, error) {
+	var cols []sqliteColumn
+	if len(columns) == 0 {
+		for _, f := range fieldNames {
+			cols = append(cols, sqliteColumn{name: f})
+		}
+		return cols, nil
+	}
+
+	if len(columns) != len(fieldNames) {
+		return nil, fmt.Errorf("Columns: got %d columns for %d fields", len(columns), len(fieldNames))
+	}
+	for _, col := range columns {
+		c := sqliteColumn{name: col, typ: "TEXT"}
+		if i := strings.LastIndexByte(col, ':'); i >= 0 {
+			c.name, c.typ = col[:i], strings.ToUpper(col[i+1:])
+			if !sqliteTypes[c.typ] {
+				return nil, fmt.Errorf("Columns: column %q has an unsupported type", col)
+			}
+		}
+		if c.name == "" {
+			return nil, fmt.Errorf("Columns: empty column name")
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
 func renderSQLitePathString(pathString string, shardID int, field string) (string, error) {
 	// This function substitutes {{ShardId}} and {{Field}} in PathString.
 	var templ *template.Template
@@ -149,10 +193,18 @@ func NewSQLite(isRaw bool) func(baker.OutputParams) (baker.Output, error) {
 			fieldNames = append(fieldNames, cfg.FieldName(fidx))
 		}
 
+		columns, err := parseSQLiteColumns(dcfg.Columns, fieldNames)
+		if err != nil {
+			return nil, err
+		}
+		if dcfg.BatchSize < 0 {
+			return nil, fmt.Errorf("BatchSize: invalid number: %d", dcfg.BatchSize)
+		}
+
 		sqlw := &SQLite{
 			cfg:        dcfg,
 			pathString: path,
-			fieldNames: fieldNames,
+			columns:    columns,
 			isRaw:      isRaw,
 		}
 
@@ -224,8 +276,8 @@ func (c *SQLite) vetIdentifiers() error {
 		"RecordBlobName": c.cfg.RecordBlobName,
 	}
 
-	for _, f := range c.fieldNames {
-		ids["field "+f] = f
+	for _, col := range c.columns {
+		ids["column "+col.name] = col.name
 	}
 
 	for name, id := range ids {
@@ -260,15 +312,17 @@ func sqliteQuote(str string) string {
 
 // prepInsertStatement prepares and returns the statement inserting records.
 func (c *SQLite) prepInsertStatement(tx *sql.Tx) (*sql.Stmt, error) {
-	var qmarks []string
-	for range c.fieldNames {
+	var names, qmarks []string
+	for _, col := range c.columns {
+		names = append(names, sqliteQuote(col.name))
 		qmarks = append(qmarks, "?")
 	}
 	if c.isRaw {
+		names = append(names, sqliteQuote(c.cfg.RecordBlobName))
 		qmarks = append(qmarks, "?")
 	}
 
-	stmt := fmt.Sprintf("INSERT INTO %s VALUES(%s)", sqliteQuote(c.cfg.TableName), strings.Join(qmarks, ","))
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s)", sqliteQuote(c.cfg.TableName), strings.Join(names, ","), strings.Join(qmarks, ","))
 	return tx.Prepare(stmt)
 }
 
@@ -311,8 +365,12 @@ func (c *SQLite) setupTable(tx *sql.Tx) error {
 	// Build the SQL statement that creates the table.
 	// CREATE TABLE IF NOT EXISTS ? ( ?, ?, ... )
 	var fields []string
-	for _, f := range c.fieldNames {
-		fields = append(fields, sqliteQuote(f))
+	for _, col := range c.columns {
+		if col.typ == "" {
+			fields = append(fields, sqliteQuote(col.name))
+		} else {
+			fields = append(fields, sqliteQuote(col.name)+" "+col.typ)
+		}
 	}
 	if c.isRaw {
 		// Raw record is a BLOB column.
@@ -343,7 +401,7 @@ func (c *SQLite) doRun(input <-chan baker.OutputRecord) error {
 	// run if commit is successful.
 	commitDone := false
 	defer func() {
-		if !commitDone {
+		if !commitDone && c.tx != nil {
 			c.tx.Rollback()
 		}
 	}()
@@ -356,7 +414,7 @@ func (c *SQLite) doRun(input <-chan baker.OutputRecord) error {
 		return fmt.Errorf("build insert statement: %s", err)
 	}
 
-	ncols := len(c.fieldNames)
+	ncols := len(c.columns)
 	if c.isRaw {
 		ncols++
 	}
@@ -376,6 +434,21 @@ func (c *SQLite) doRun(input <-chan baker.OutputRecord) error {
 			return fmt.Errorf("cannot insert to SQLite file: %s", err)
 		}
 		c.nEvents++
+
+		if c.cfg.BatchSize > 0 && c.nEvents%int64(c.cfg.BatchSize) == 0 {
+			// Commit the batch and start the next one.
+			insert.Close()
+			if err = c.tx.Commit(); err != nil {
+				c.tx = nil
+				return fmt.Errorf("cannot commit SQLite transaction: %s", err)
+			}
+			if c.tx, err = c.conn.Begin(); err != nil {
+				return fmt.Errorf("Cannot start transaction: %s", err)
+			}
+			if insert, err = c.prepInsertStatement(c.tx); err != nil {
+				return fmt.Errorf("build insert statement: %s", err)
+			}
+		}
 	}
 	insert.Close()
 
@@ -5,8 +5,11 @@ package output
 import (
 	"database/sql"
 	"fmt"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/baker"
 	"github.com/AdRoll/baker/testutil"
@@ -26,7 +29,7 @@ func makeWriter(t *testing.T, raw bool, path string, truncate bool) baker.Output
 			RecordBlobName: "raw_record",
 		}
 	} else {
-		cfg = &SQLiteWriterConfig{
+		cfg = &SQLiteConfig{
 			PathString: path,
 			TableName:  "lines",
 			Clear:      truncate,
@@ -66,7 +69,7 @@ func makeWriter(t *testing.T, raw bool, path string, truncate bool) baker.Output
 			FieldName:     fieldName,
 		},
 	}
-	writer, err := newSQLiteWriter(raw)(params)
+	writer, err := NewSQLite(raw)(params)
 	if err != nil {
 		t.Fatalf("SQLite writer creation failed: %s", err)
 	}
@@ -259,7 +262,7 @@ func TestSQLitePrePostCommands(t *testing.T) {
 	fn, rm := testutil.TempFile(t)
 	defer rm()
 
-	config := SQLiteWriterConfig{
+	config := SQLiteConfig{
 		PathString: fn,
 		TableName:  "lines",
 		PreRun:     []string{"CREATE TABLE footable ( v INT )", "INSERT INTO footable ( v ) VALUES ( 55 )"},
@@ -299,7 +302,7 @@ func TestSQLitePrePostCommands(t *testing.T) {
 			FieldName:     fieldName,
 		},
 	}
-	writer, err := newSQLiteWriter(false)(cfg)
+	writer, err := NewSQLite(false)(cfg)
 	if err != nil {
 		t.Fatalf("SQLite writer creation failed: %s", err)
 	}
@@ -354,11 +357,33 @@ func TestSQLiteBadConfig(t *testing.T) {
 	tests := []struct {
 		name       string
 		pathstring string
+		columns    []string
+		batchSize  int
 	}{
 		{
 			name:       "bad template",
 			pathstring: "{{\x00",
 		},
+		{
+			name:       "too many columns",
+			pathstring: ":memory:",
+			columns:    []string{"a", "b"},
+		},
+		{
+			name:       "unsupported column type",
+			pathstring: ":memory:",
+			columns:    []string{"a:DATE"},
+		},
+		{
+			name:       "empty column name",
+			pathstring: ":memory:",
+			columns:    []string{":TEXT"},
+		},
+		{
+			name:       "negative batch size",
+			pathstring: ":memory:",
+			batchSize:  -1,
+		},
 	}
 
 	for _, tt := range tests {
@@ -368,6 +393,8 @@ func TestSQLiteBadConfig(t *testing.T) {
 				TableName:      "lines",
 				Clear:          false,
 				RecordBlobName: "blob",
+				Columns:        tt.columns,
+				BatchSize:      tt.batchSize,
 			}
 
 			params := baker.OutputParams{
@@ -379,10 +406,94 @@ func TestSQLiteBadConfig(t *testing.T) {
 					FieldName:     func(baker.FieldIndex) string { return "name" },
 				},
 			}
-			_, err := newSQLiteWriter(true)(params)
+			_, err := NewSQLite(true)(params)
 			if err == nil {
 				t.Fatalf("want error, got nil")
 			}
 		})
 	}
 }
+
+func TestSQLiteColumnsBatches(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	const nrecords, batchSize = 25, 10
+	fname := filepath.Join(t.TempDir(), "test.sqlite")
+
+	params := baker.OutputParams{
+		Fields: []baker.FieldIndex{0, 1, 2},
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &SQLiteConfig{
+				PathString: fname,
+				TableName:  "lines",
+				Columns:    []string{"name", "n:integer", "tags:TEXT"},
+				BatchSize:  batchSize,
+			},
+			FieldName: func(i baker.FieldIndex) string { return fmt.Sprintf("field%d", i) },
+		},
+	}
+	writer, err := NewSQLite(false)(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() (int, error) {
+		conn, err := sql.Open("sqlite3", fname)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		var n int
+		err = conn.QueryRow("SELECT COUNT(*) FROM lines").Scan(&n)
+		return n, err
+	}
+
+	outch := make(chan baker.OutputRecord)
+	upch := make(chan string, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- writer.Run(outch, upch) }()
+
+	for i := 0; i < nrecords; i++ {
+		outch <- baker.OutputRecord{Fields: []string{fmt.Sprintf("rec%d", i), strconv.Itoa(i), "a,b"}}
+	}
+
+	// The first 2 batches are committed while the output is still running.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := count()
+		if err == nil && n == 2*batchSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rows committed before exit = %d (err: %v), want %d", n, err, 2*batchSize)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(outch)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := count(); err != nil || n != nrecords {
+		t.Fatalf("rows = %d (err: %v), want %d", n, err, nrecords)
+	}
+
+	conn, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var (
+		name, typ, tags string
+		n               int
+	)
+	err = conn.QueryRow("SELECT name, n, typeof(n), tags FROM lines WHERE n = 17").Scan(&name, &n, &typ, &tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "rec17" || n != 17 || typ != "integer" || tags != "a,b" {
+		t.Errorf("row = %q, %d, %q, %q, want %q, %d, %q, %q", name, n, typ, tags, "rec17", 17, "integer", "a,b")
+	}
+}
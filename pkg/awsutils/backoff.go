@@ -6,6 +6,15 @@ import (
 	"github.com/jpillora/backoff"
 )
 
+// Backoff computes the time to wait between consecutive failed attempts.
+// A pointer to a copy of DefaultBackoff implements it.
+type Backoff interface {
+	// Duration returns the time to wait before the next attempt.
+	Duration() time.Duration
+	// Reset resets the backoff after a successful attempt.
+	Reset()
+}
+
 // DefaultBackoff is an exponential backoff counter with jitter enabled.
 var DefaultBackoff = backoff.Backoff{
 	Min:    1 * time.Second,
@@ -0,0 +1,67 @@
+package awsutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPConfig holds the settings of the HTTP client used for AWS calls.
+type HTTPConfig struct {
+	Proxy          string        // Proxy, if set, is the URL of the proxy all requests go through, rather than the one set in the environment
+	CABundlePath   string        // CABundlePath, if set, is the path of a PEM file of the certificate authorities to trust, rather than the system ones
+	ConnectTimeout time.Duration // ConnectTimeout, if set, is the maximum time to establish a connection, TLS handshake included
+	ReadTimeout    time.Duration // ReadTimeout, if set, is the maximum time to wait for the response headers of a request
+}
+
+// isZero reports whether cfg is the default configuration.
+func (cfg HTTPConfig) isZero() bool {
+	return cfg == HTTPConfig{}
+}
+
+// NewHTTPClient returns an HTTP client configured with cfg. Settings that are
+// not set keep the values of http.DefaultTransport.
+func NewHTTPClient(cfg HTTPConfig) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: scheme and host are required", cfg.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	if cfg.CABundlePath != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", cfg.CABundlePath)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if cfg.ConnectTimeout > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		tr.TLSHandshakeTimeout = cfg.ConnectTimeout
+	}
+	if cfg.ReadTimeout > 0 {
+		tr.ResponseHeaderTimeout = cfg.ReadTimeout
+	}
+
+	return &http.Client{Transport: tr}, nil
+}
@@ -0,0 +1,109 @@
+package awsutils
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func transportOf(t *testing.T, client *http.Client) *http.Transport {
+	t.Helper()
+	tr, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport is %T, want *http.Transport", client.Transport)
+	}
+	return tr
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	t.Run("proxy", func(t *testing.T) {
+		const proxy = "http://proxy.internal:3128"
+		client, err := NewHTTPClient(HTTPConfig{Proxy: proxy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "https://sqs.us-west-2.amazonaws.com/", nil)
+		u, err := transportOf(t, client).Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u == nil || u.String() != proxy {
+			t.Errorf("proxy = %v, want %s", u, proxy)
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		client, err := NewHTTPClient(HTTPConfig{ConnectTimeout: 3 * time.Second, ReadTimeout: 7 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := transportOf(t, client)
+		if tr.TLSHandshakeTimeout != 3*time.Second {
+			t.Errorf("TLSHandshakeTimeout = %v, want 3s", tr.TLSHandshakeTimeout)
+		}
+		if tr.ResponseHeaderTimeout != 7*time.Second {
+			t.Errorf("ResponseHeaderTimeout = %v, want 7s", tr.ResponseHeaderTimeout)
+		}
+		if client.Timeout != 0 {
+			t.Errorf("client timeout = %v, want none", client.Timeout)
+		}
+	})
+
+	t.Run("CA bundle", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer srv.Close()
+
+		// Without the bundle, the certificate of the test server isn't trusted.
+		if resp, err := http.DefaultClient.Get(srv.URL); err == nil {
+			resp.Body.Close()
+			t.Fatal("got no error with the system CAs, want a certificate error")
+		}
+
+		path := filepath.Join(t.TempDir(), "ca.pem")
+		buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewHTTPClient(HTTPConfig{CABundlePath: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request with the CA bundle: %v", err)
+		}
+		resp.Body.Close()
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		empty := filepath.Join(t.TempDir(), "empty.pem")
+		if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name string
+			cfg  HTTPConfig
+		}{
+			{name: "proxy without scheme", cfg: HTTPConfig{Proxy: "proxy.internal:3128"}},
+			{name: "malformed proxy", cfg: HTTPConfig{Proxy: "http://[::1"}},
+			{name: "missing CA bundle", cfg: HTTPConfig{CABundlePath: filepath.Join(t.TempDir(), "nope.pem")}},
+			{name: "CA bundle without certificates", cfg: HTTPConfig{CABundlePath: empty}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if _, err := NewHTTPClient(tt.cfg); err == nil {
+					t.Errorf("got no error, want one")
+				}
+				if _, err := NewSession(SessionConfig{Region: "us-west-2", HTTP: tt.cfg}); err == nil {
+					t.Errorf("NewSession: got no error, want one")
+				}
+			})
+		}
+	})
+}
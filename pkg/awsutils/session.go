@@ -0,0 +1,55 @@
+package awsutils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// SessionConfig holds the settings used to create an AWS session.
+type SessionConfig struct {
+	Region   string // Region is the AWS region to connect to
+	Endpoint string // Endpoint, if set, overrides the default endpoint of the services (e.g. for LocalStack)
+	Profile  string // Profile, if set, is the name of the profile to use from the shared credentials/config files
+	RoleARN  string // RoleARN, if set, is the ARN of a role to assume via STS
+
+	// HTTP configures the HTTP client of the session. The default client of
+	// the AWS SDK is used if it's not set.
+	HTTP HTTPConfig
+}
+
+// NewSession creates an AWS session from cfg.
+//
+// When cfg.Endpoint is set, path-style addressing is also forced for S3,
+// since custom endpoints (like LocalStack) usually don't support
+// virtual-hosted buckets.
+func NewSession(cfg SessionConfig) (*session.Session, error) {
+	awscfg := aws.NewConfig().WithRegion(cfg.Region)
+	if cfg.Endpoint != "" {
+		awscfg = awscfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if !cfg.HTTP.isZero() {
+		client, err := NewHTTPClient(cfg.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		awscfg = awscfg.WithHTTPClient(client)
+	}
+
+	opts := session.Options{Config: *awscfg}
+	if cfg.Profile != "" {
+		opts.Profile = cfg.Profile
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RoleARN != "" {
+		sess = sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, cfg.RoleARN)})
+	}
+
+	return sess, nil
+}
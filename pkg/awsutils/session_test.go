@@ -0,0 +1,69 @@
+package awsutils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestNewSession(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		sess, err := NewSession(SessionConfig{Region: "us-west-2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aws.StringValue(sess.Config.Region); got != "us-west-2" {
+			t.Errorf("region = %q, want %q", got, "us-west-2")
+		}
+		if got := aws.StringValue(sess.Config.Endpoint); got != "" {
+			t.Errorf("endpoint = %q, want the default one", got)
+		}
+		if aws.BoolValue(sess.Config.S3ForcePathStyle) {
+			t.Errorf("S3ForcePathStyle = true, want false")
+		}
+	})
+
+	t.Run("custom endpoint", func(t *testing.T) {
+		const endpoint = "http://localhost:4566"
+		sess, err := NewSession(SessionConfig{Region: "us-east-1", Endpoint: endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aws.StringValue(sess.Config.Endpoint); got != endpoint {
+			t.Errorf("endpoint = %q, want %q", got, endpoint)
+		}
+		if !aws.BoolValue(sess.Config.S3ForcePathStyle) {
+			t.Errorf("S3ForcePathStyle = false, want true")
+		}
+	})
+
+	t.Run("custom HTTP client", func(t *testing.T) {
+		const proxy = "http://proxy.internal:3128"
+		sess, err := NewSession(SessionConfig{Region: "us-east-1", HTTP: HTTPConfig{Proxy: proxy}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Config.HTTPClient == nil {
+			t.Fatal("HTTP client = nil, want the custom one")
+		}
+		req, _ := http.NewRequest("GET", "https://s3.amazonaws.com/", nil)
+		u, err := transportOf(t, sess.Config.HTTPClient).Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u == nil || u.String() != proxy {
+			t.Errorf("proxy = %v, want %s", u, proxy)
+		}
+	})
+
+	t.Run("assume role", func(t *testing.T) {
+		sess, err := NewSession(SessionConfig{Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/baker"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Config.Credentials == nil {
+			t.Errorf("credentials = nil, want STS credentials")
+		}
+	})
+}
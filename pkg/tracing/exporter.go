@@ -0,0 +1,31 @@
+package tracing
+
+import "sync"
+
+// MemoryExporter is an Exporter keeping the spans in memory, for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewMemoryExporter returns an empty MemoryExporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// ExportSpan implements Exporter.
+func (e *MemoryExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, span)
+	e.mu.Unlock()
+}
+
+// Shutdown implements Exporter.
+func (e *MemoryExporter) Shutdown() error { return nil }
+
+// Spans returns the exported spans, in the order they ended.
+func (e *MemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
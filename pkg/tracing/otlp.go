@@ -0,0 +1,267 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// otlpBatchSize is the maximum number of spans sent in a request.
+	otlpBatchSize = 512
+	// otlpInterval is the maximum time a span waits before being sent.
+	otlpInterval = 5 * time.Second
+	// otlpMaxPending is the maximum number of spans waiting to be sent,
+	// spans ending past that while the collector is slow are dropped.
+	otlpMaxPending = 16 * otlpBatchSize
+)
+
+// OTLPExporter is an Exporter sending the spans, in batches, to an
+// OpenTelemetry collector supporting the OTLP/HTTP protocol with JSON
+// encoding.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending []SpanData
+	dropped int64
+
+	flushc chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewOTLPExporter returns an exporter sending the spans to the collector
+// at endpoint (e.g. "http://localhost:4318"), as spans of the given service.
+func NewOTLPExporter(endpoint, service string) (*OTLPExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: want an http or https URL", endpoint)
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	e := &OTLPExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		flushc:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// ExportSpan implements Exporter.
+func (e *OTLPExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	if len(e.pending) >= otlpMaxPending {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.pending = append(e.pending, span)
+	full := len(e.pending) >= otlpBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flushc <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Shutdown implements Exporter, by sending the pending spans.
+func (e *OTLPExporter) Shutdown() error {
+	close(e.done)
+	e.wg.Wait()
+	return e.flush()
+}
+
+func (e *OTLPExporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.flushc:
+		}
+		if err := e.flush(); err != nil {
+			log.WithError(err).Warn("can't export spans")
+		}
+	}
+}
+
+// flush sends the pending spans.
+func (e *OTLPExporter) flush() error {
+	for {
+		e.mu.Lock()
+		n := len(e.pending)
+		if n > otlpBatchSize {
+			n = otlpBatchSize
+		}
+		batch := e.pending[:n:n]
+		e.pending = e.pending[n:]
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+
+		if dropped > 0 {
+			log.WithField("spans", dropped).Warn("spans dropped, the collector is too slow")
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := e.send(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// send sends spans to the collector.
+func (e *OTLPExporter) send(spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types are the JSON encoding of an OTLP
+// ExportTraceServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.SpanContext.TraceID.String(),
+			SpanID:            s.SpanContext.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: otlpTime(s.Start),
+			EndTimeUnixNano:   otlpTime(s.End),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		for _, ev := range s.Events {
+			span.Events = append(span.Events, otlpEvent{
+				TimeUnixNano: otlpTime(ev.Time),
+				Name:         ev.Name,
+				Attributes:   otlpAttributes(ev.Attributes),
+			})
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		out = append(out, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", e.service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/AdRoll/baker"}, Spans: out}},
+	}}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch val := a.Value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case int64:
+			// 64-bit integers are strings in the JSON encoding of protobuf.
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
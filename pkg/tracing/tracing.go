@@ -0,0 +1,343 @@
+// Package tracing provides a minimal tracer compatible with OpenTelemetry,
+// used by Baker to emit spans of the processing of the files read by its
+// inputs. Spans are exported with an Exporter, like OTLPExporter.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so that tracing is
+// almost free when disabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TraceID identifies a trace, that is a tree of spans.
+type TraceID [16]byte
+
+// String returns the hex representation of id.
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id isn't all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// A SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the hex representation of id.
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id isn't all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext identifies a span, possibly of another service.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether sc has both a trace and a span ID.
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent returns the W3C Trace Context traceparent representation of sc.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-01"
+}
+
+// ParseTraceparent parses a W3C Trace Context traceparent, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if len(parts[1]) != 2*len(sc.TraceID) || len(parts[2]) != 2*len(sc.SpanID) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %v", s, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %v", s, err)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q: zero trace or span ID", s)
+	}
+	return sc, nil
+}
+
+// An Attribute is a key-value pair describing a span or an event. Values are
+// strings, int64, float64 or bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int64) Attribute { return Attribute{key, value} }
+
+// An Event is something that happened at a given time during a span.
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// SpanData is an ended span, as exported.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanID // zero for a root span
+	Start, End  time.Time
+	Attributes  []Attribute
+	Events      []Event
+	Error       string // error of the span, empty if it succeeded
+}
+
+// An Exporter exports the ended spans.
+type Exporter interface {
+	// ExportSpan is called once a span has ended. It's called concurrently
+	// and must not block.
+	ExportSpan(span SpanData)
+	// Shutdown exports the pending spans, if any, and releases the exporter.
+	Shutdown() error
+}
+
+// A Tracer starts spans and sends them to its exporter once ended.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer exporting its spans with exp.
+func NewTracer(exp Exporter) *Tracer {
+	return &Tracer{exporter: exp}
+}
+
+// Start starts a span, child of the span carried by ctx, if any, and returns
+// a copy of ctx carrying the new span. If t is nil, Start returns ctx and a
+// nil span.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.data.SpanContext
+	} else if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = sc
+	}
+	s := t.newSpan(parent, name, attrs)
+	return ContextWithSpan(ctx, s), s
+}
+
+// Shutdown shuts the exporter down, exporting the pending spans.
+func (t *Tracer) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Shutdown()
+}
+
+func (t *Tracer) newSpan(parent SpanContext, name string, attrs []Attribute) *Span {
+	s := &Span{tracer: t}
+	s.data.Name = name
+	s.data.Start = time.Now()
+	s.data.Attributes = attrs
+	if parent.IsValid() {
+		s.data.SpanContext.TraceID = parent.TraceID
+		s.data.Parent = parent.SpanID
+	} else {
+		rand.Read(s.data.SpanContext.TraceID[:])
+	}
+	rand.Read(s.data.SpanContext.SpanID[:])
+	return s
+}
+
+// A Span is an operation being traced. It's safe for concurrent use.
+//
+// By default, a span ends when End is called. A span shared by asynchronous
+// operations can be held by each of them with Hold, it then ends when End
+// has been called and all holds have been released.
+type Span struct {
+	tracer *Tracer
+
+	mu      sync.Mutex
+	data    SpanData
+	holds   int
+	ending  bool             // End has been called
+	ended   bool             // the span has been exported
+	tracked map[string]*Span // children extended by Track
+}
+
+// SpanContext returns the identifiers of s, which are zero if s is nil.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// StartChild starts a span, child of s.
+func (s *Span) StartChild(name string, attrs ...Attribute) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(s.data.SpanContext, name, attrs)
+}
+
+// SetAttributes adds attributes to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+	s.mu.Unlock()
+}
+
+// AddEvent records an event happening now.
+func (s *Span) AddEvent(name string, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Events = append(s.data.Events, Event{Name: name, Time: time.Now(), Attributes: attrs})
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// Track extends the interval, from start to end, of the child of s with the
+// given name, creating it on the first call. It's meant for operations
+// repeated many times, like writing records, which are traced as a single
+// span covering all of them. Tracked children end with s.
+func (s *Span) Track(name string, start, end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	child := s.tracked[name]
+	if child == nil {
+		if s.tracked == nil {
+			s.tracked = make(map[string]*Span)
+		}
+		child = s.tracer.newSpan(s.data.SpanContext, name, nil)
+		child.data.Start = start
+		s.tracked[name] = child
+	}
+	if start.Before(child.data.Start) {
+		child.data.Start = start
+	}
+	if end.After(child.data.End) {
+		child.data.End = end
+	}
+}
+
+// Hold delays the end of s until Release is called.
+func (s *Span) Hold() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.holds++
+	s.mu.Unlock()
+}
+
+// Release releases a hold set by Hold, ending s if End has already been
+// called and it was the last hold.
+func (s *Span) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.holds--
+	s.endLocked()
+}
+
+// End ends s, unless it's still held, in which case it ends with the release
+// of the last hold.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.ending = true
+	s.endLocked()
+}
+
+// endLocked exports s if it's ending and not held anymore, and unlocks s.mu.
+func (s *Span) endLocked() {
+	if !s.ending || s.holds > 0 || s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	spans := make([]SpanData, 0, len(s.tracked)+1)
+	for _, child := range s.tracked {
+		spans = append(spans, child.data)
+	}
+	spans = append(spans, s.data)
+	s.mu.Unlock()
+
+	for _, data := range spans {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s, the parent of the spans
+// started with it.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent returns a copy of ctx in which the spans started
+// without a parent span are children of sc, a span of another service, so
+// that they continue its trace.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// MetadataKey is the key of the span of the file a record has been read
+// from in its metadata, set for the files being traced.
+const MetadataKey = "trace_span"
+
+// FromMetadata returns the span stored at MetadataKey in md, or nil.
+func FromMetadata(md map[string]interface{}) *Span {
+	s, _ := md[MetadataKey].(*Span)
+	return s
+}
@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{in: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantErr: true},
+		{in: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4zz-00f067aa0ba902b7-01", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		sc, err := ParseTraceparent(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTraceparent(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || err == nil && sc.SpanID.String() != "00f067aa0ba902b7" {
+			t.Errorf("ParseTraceparent(%q) = %s, %s", tt.in, sc.TraceID, sc.SpanID)
+		}
+	}
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if got, want := sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got != want {
+		t.Errorf("Traceparent() = %q, want %q", got, want)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exp := NewMemoryExporter()
+	tracer := NewTracer(exp)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteParent(context.Background(), remote)
+	ctx, root := tracer.Start(ctx, "root", String("k", "v"))
+	if SpanFromContext(ctx) != root {
+		t.Fatalf("context doesn't carry the started span")
+	}
+	_, child := tracer.Start(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.End()
+
+	// A held span ends with the release of its last hold.
+	root.Hold()
+	root.Hold()
+	now := time.Now()
+	root.Track("tracked", now, now.Add(time.Millisecond))
+	root.Track("tracked", now.Add(-time.Millisecond), now)
+	root.End()
+	root.Release()
+	if n := len(exp.Spans()); n != 1 {
+		t.Fatalf("%d spans exported before the last release, want 1", n)
+	}
+	root.Release()
+	root.End() // no-op once ended
+
+	spans := exp.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans exported, want 3", len(spans))
+	}
+	got, tracked, gotRoot := spans[0], spans[1], spans[2]
+	if got.Name != "child" || got.Error != "failed" || got.Parent != root.SpanContext().SpanID {
+		t.Errorf("child span = %+v", got)
+	}
+	if tracked.Name != "tracked" || tracked.Parent != root.SpanContext().SpanID {
+		t.Errorf("tracked span = %+v", tracked)
+	}
+	if d := tracked.End.Sub(tracked.Start); d != 2*time.Millisecond {
+		t.Errorf("tracked span lasted %v, want 2ms", d)
+	}
+	if gotRoot.Name != "root" || gotRoot.Parent != remote.SpanID || gotRoot.SpanContext.TraceID != remote.TraceID {
+		t.Errorf("root span = %+v, want a child of %s", gotRoot, remote.Traceparent())
+	}
+
+	// A nil tracer and its nil spans do nothing.
+	var nilTracer *Tracer
+	ctx, span := nilTracer.Start(context.Background(), "nothing")
+	span.StartChild("child").End()
+	span.Hold()
+	span.End()
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Errorf("nil tracer started a span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	reqs := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request to %s with content type %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		reqs <- req
+	}))
+	defer srv.Close()
+
+	exp, err := NewOTLPExporter(srv.URL, "test-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exp)
+	_, span := tracer.Start(context.Background(), "file", String("file", "a.log.gz"), Int("size", 42))
+	span.StartChild("parse").End()
+	span.End()
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-reqs
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request = %+v", req)
+	}
+	if attrs := req.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value["stringValue"] != "test-service" {
+		t.Errorf("resource attributes = %+v", attrs)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans sent, want 2", len(spans))
+	}
+	parse, file := spans[0], spans[1]
+	if file.Name != "file" || file.ParentSpanID != "" || file.SpanID != span.SpanContext().SpanID.String() {
+		t.Errorf("file span = %+v", file)
+	}
+	if parse.Name != "parse" || parse.ParentSpanID != file.SpanID || parse.TraceID != file.TraceID {
+		t.Errorf("parse span = %+v", parse)
+	}
+	if len(file.Attributes) != 2 || file.Attributes[1].Value["intValue"] != "42" {
+		t.Errorf("file span attributes = %+v", file.Attributes)
+	}
+
+	if _, err := NewOTLPExporter("localhost:4318", "baker"); err == nil {
+		t.Errorf("NewOTLPExporter accepted an endpoint without scheme")
+	}
+}
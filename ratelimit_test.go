@@ -0,0 +1,109 @@
+package baker_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/output"
+)
+
+// countingFilter counts the records it receives.
+type countingFilter struct {
+	filtertest.Base
+	n int64
+}
+
+func (f *countingFilter) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.n, 1)
+	next(l)
+}
+
+func TestMaxRecordsPerSecond(t *testing.T) {
+	const rate = 500
+
+	in := &channelInput{ch: make(chan []byte)}
+	counter := &countingFilter{}
+
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{{
+			Name:   "Counter",
+			New:    func(baker.FilterParams) (baker.Filter, error) { return counter, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	cfg := baker.Config{
+		General: baker.ConfigGeneral{MaxRecordsPerSecond: rate},
+		// A small input channel for the input to quickly feel the backpressure.
+		Input:  baker.ConfigInput{Name: "Channel", ChanSize: 1},
+		Filter: []baker.ConfigFilter{{Name: "Counter"}},
+		Output: []baker.ConfigOutput{{Name: "Nop", Fields: []string{"f0"}}},
+		Fields: baker.ConfigFields{Names: []string{"f0", "f1"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+
+	// Feed the topology as fast as it accepts records.
+	quit := make(chan struct{})
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		for {
+			select {
+			case <-quit:
+				close(in.ch)
+				return
+			case in.ch <- []byte("a,b\nc,d\ne,f\ng,h\ni,j\n"):
+			}
+		}
+	}()
+
+	const interval = time.Second
+	time.Sleep(interval)
+	got := atomic.LoadInt64(&counter.n)
+
+	close(quit)
+	<-fed
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rate limiter allows an initial burst of a tenth of the rate, on top
+	// of which we accept a 10% tolerance.
+	max := int64(rate*interval.Seconds()*1.1) + rate/10
+	min := int64(rate * interval.Seconds() / 2)
+	if got > max || got < min {
+		t.Errorf("%d records processed in %v, want between %d and %d", got, interval, min, max)
+	}
+}
+
+func TestMaxRecordsPerSecondNegative(t *testing.T) {
+	comp := baker.Components{
+		Inputs:  []baker.InputDesc{{Name: "Channel", New: func(baker.InputParams) (baker.Input, error) { return &channelInput{}, nil }, Config: &struct{}{}}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+	cfg := baker.Config{
+		General: baker.ConfigGeneral{MaxRecordsPerSecond: -1},
+		Input:   baker.ConfigInput{Name: "Channel"},
+		Output:  []baker.ConfigOutput{{Name: "Nop", Fields: []string{"f0"}}},
+		Fields:  baker.ConfigFields{Names: []string{"f0"}},
+	}
+
+	if _, err := baker.New(comp, cfg); err == nil {
+		t.Fatal("baker.New() with a negative max_records_per_second: err = nil, want an error")
+	}
+}
@@ -27,6 +27,9 @@ type Record interface {
 	//  src.Parse(dst.ToText(), nil)
 	//
 	// but Record implementations should provide a more efficient way.
+	//
+	// The copy must not share memory with the original record, since it may
+	// outlive the buffer the latter was parsed from.
 	Copy() Record
 
 	// Clear clears the record internal state, making it empty.
@@ -71,6 +74,17 @@ type Record interface {
 	Cache() *Cache
 }
 
+// MetadataRecord is a Record able to return all of its metadata at once.
+// The metadata of such records is passed to the outputs, see
+// OutputRecord.Meta.
+type MetadataRecord interface {
+	Record
+
+	// Metadata returns the metadata attached to the record, which must not
+	// be modified.
+	Metadata() Metadata
+}
+
 // Cache is a per-record cache.
 type Cache map[string]interface{}
 
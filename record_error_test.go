@@ -0,0 +1,325 @@
+package baker_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/input/inpututils"
+	"github.com/AdRoll/baker/output/outputtest"
+	"github.com/AdRoll/baker/testutil"
+)
+
+var errFailingOutput = errors.New("can't write record")
+
+// failingOutput is an output failing to write all records.
+type failingOutput struct {
+	outputtest.Base
+	report baker.ErrorReporter
+}
+
+func (o *failingOutput) Run(input <-chan baker.OutputRecord, _ chan<- string) error {
+	for rec := range input {
+		o.report.Report(baker.RecordError{Fields: rec.Fields, Err: errFailingOutput})
+	}
+	return nil
+}
+
+func TestTopologyErrorHandler(t *testing.T) {
+	toml := `
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="Records"
+
+[output]
+name="Failing"
+procs=1
+fields=["f1"]
+`
+	c := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.RecordsDesc},
+		Outputs: []baker.OutputDesc{{
+			Name: "Failing",
+			New: func(cfg baker.OutputParams) (baker.Output, error) {
+				return &failingOutput{report: cfg.ReportError}, nil
+			},
+			Config: &struct{}{},
+		}},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []baker.RecordError
+	)
+	topology.SetErrorHandler(func(e baker.RecordError) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, e)
+	})
+
+	const nrecords = 10
+	in := topology.Input.(*inputtest.Records)
+	for i := 0; i < nrecords; i++ {
+		ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		ll.Set(1, []byte("value1"))
+		in.Records = append(in.Records, &ll)
+	}
+
+	topology.Start()
+	topology.Wait()
+
+	if len(errs) != nrecords {
+		t.Fatalf("got %d errors, want %d", len(errs), nrecords)
+	}
+	for _, e := range errs {
+		if e.Component != "Failing" {
+			t.Errorf("error component = %q, want %q", e.Component, "Failing")
+		}
+		if !errors.Is(e.Err, errFailingOutput) {
+			t.Errorf("error = %v, want %v", e.Err, errFailingOutput)
+		}
+		if len(e.Fields) != 1 || e.Fields[0] != "value1" {
+			t.Errorf("error fields = %q, want %q", e.Fields, []string{"value1"})
+		}
+	}
+}
+
+func TestErrorReporterNil(t *testing.T) {
+	// A nil ErrorReporter, as received by components created outside of a
+	// topology, must be safe to use.
+	var r baker.ErrorReporter
+	r.Report(baker.RecordError{Err: errFailingOutput})
+}
+
+// fakeS3 serves a single gzipped object.
+type fakeS3 struct {
+	s3iface.S3API
+	content string
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(f.content))
+	w.Close()
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(buf),
+		ContentLength: aws.Int64(int64(buf.Len())),
+		LastModified:  aws.Time(time.Now()),
+	}, nil
+}
+
+// s3FileInput reads a single S3 file.
+type s3FileInput struct {
+	*inpututils.S3Input
+	fn string
+}
+
+func (in *s3FileInput) Run(output chan<- *baker.Data) error {
+	in.SetOutputChannel(output)
+	return in.ParseFile(in.fn)
+}
+
+// newS3FileTopology returns a topology reading content as a single S3 file.
+func newS3FileTopology(t *testing.T, toml, content string, validate baker.ValidationFunc) *baker.Topology {
+	t.Helper()
+
+	svc := &fakeS3{content: content}
+	c := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name: "S3File",
+			New: func(baker.InputParams) (baker.Input, error) {
+				return &s3FileInput{inpututils.NewS3InputWithClient(svc, "bucket"), "dir/file.log.gz"}, nil
+			},
+			Config: &struct{}{},
+		}},
+		Outputs:  []baker.OutputDesc{outputtest.RecorderDesc},
+		Validate: validate,
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topology
+}
+
+func TestTopologyParseErrors(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	toml := `
+[general]
+expected_fields=2
+
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="S3File"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0"]
+`
+	// The third line has too many fields.
+	topology := newS3FileTopology(t, toml, "a,1\nb,2\nc,3,extra\nd,4\n", nil)
+
+	var errs []baker.RecordError
+	topology.SetErrorHandler(func(e baker.RecordError) { errs = append(errs, e) })
+
+	topology.Start()
+	topology.Wait()
+
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+	}
+	e := errs[0]
+	if e.Component != "S3File" {
+		t.Errorf("error component = %q, want %q", e.Component, "S3File")
+	}
+	if e.Line != 3 {
+		t.Errorf("error line = %d, want 3", e.Line)
+	}
+	if key := e.Meta[inpututils.MetadataS3Key]; key != "dir/file.log.gz" {
+		t.Errorf("error S3 key = %v, want %q", key, "dir/file.log.gz")
+	}
+	if bucket := e.Meta[inpututils.MetadataS3Bucket]; bucket != "bucket" {
+		t.Errorf("error S3 bucket = %v, want %q", bucket, "bucket")
+	}
+	if string(e.Record) != "c,3,extra" {
+		t.Errorf("error record = %q, want %q", e.Record, "c,3,extra")
+	}
+	if !strings.Contains(e.Error(), "line 3") {
+		t.Errorf("error message %q doesn't mention line 3", e.Error())
+	}
+
+	if n := len(topology.Output[0].(*outputtest.Recorder).Records); n != 3 {
+		t.Errorf("got %d output records, want 3", n)
+	}
+}
+
+func TestTopologyFailOnRecordError(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	const tomlFmt = `
+[general]
+expected_fields=2
+fail_on_record_error=%t
+
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="S3File"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0"]
+`
+	// The third line has too many fields.
+	const content = "a,1\nb,2\nc,3,extra\nd,4\n"
+
+	t.Run("lenient", func(t *testing.T) {
+		topology := newS3FileTopology(t, fmt.Sprintf(tomlFmt, false), content, nil)
+		topology.Start()
+		topology.Wait()
+
+		if err := topology.Error(); err != nil {
+			t.Fatalf("topology error = %v, want nil", err)
+		}
+		if n := len(topology.Output[0].(*outputtest.Recorder).Records); n != 3 {
+			t.Errorf("got %d output records, want 3", n)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		topology := newS3FileTopology(t, fmt.Sprintf(tomlFmt, true), content, nil)
+		topology.Start()
+		topology.Wait()
+
+		err := topology.Error()
+		if err == nil {
+			t.Fatal("topology error = nil, want an error")
+		}
+		var rerr baker.RecordError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("topology error = %v, want a RecordError", err)
+		}
+		if rerr.Line != 3 {
+			t.Errorf("error line = %d, want 3", rerr.Line)
+		}
+	})
+}
+
+func TestTopologyFailOnInvalidRecord(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	toml := `
+[general]
+fail_on_record_error=true
+
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="S3File"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0"]
+`
+	// Records are valid if f1 is a number.
+	validate := func(r baker.Record) (bool, baker.FieldIndex) {
+		if _, err := strconv.Atoi(string(r.Get(1))); err != nil {
+			return false, 1
+		}
+		return true, 0
+	}
+	topology := newS3FileTopology(t, toml, "a,1\nb,x\nc,3\n", validate)
+	topology.Start()
+	topology.Wait()
+
+	var rerr baker.RecordError
+	if err := topology.Error(); !errors.As(err, &rerr) {
+		t.Fatalf("topology error = %v, want a RecordError", err)
+	}
+	if rerr.Line != 2 {
+		t.Errorf("error line = %d, want 2", rerr.Line)
+	}
+	if !strings.Contains(rerr.Error(), "f1") {
+		t.Errorf("error message %q doesn't mention the invalid field", rerr.Error())
+	}
+}
@@ -0,0 +1,156 @@
+package baker_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// tsvRecord is a custom record type: tab-separated LogLine records,
+// optionally upper-cased.
+type tsvRecord struct {
+	*baker.LogLine
+	upper bool
+}
+
+func (r *tsvRecord) Parse(buf []byte, meta baker.Metadata) error {
+	if r.upper {
+		buf = bytes.ToUpper(buf)
+	}
+	return r.LogLine.Parse(buf, meta)
+}
+
+type tsvRecordConfig struct {
+	Upper bool `help:"If true, records are upper-cased"`
+}
+
+func tsvRecordDesc(created *int64) baker.RecordDesc {
+	return baker.RecordDesc{
+		Name:   "TSV",
+		Config: &tsvRecordConfig{},
+		Help:   "Tab-separated records",
+		New: func(params baker.RecordParams) (func() baker.Record, error) {
+			dcfg := params.DecodedConfig.(*tsvRecordConfig)
+			return func() baker.Record {
+				atomic.AddInt64(created, 1)
+				return &tsvRecord{LogLine: &baker.LogLine{FieldSeparator: '\t'}, upper: dcfg.Upper}
+			}, nil
+		},
+	}
+}
+
+func TestRecordType(t *testing.T) {
+	toml := `
+[general]
+record_type="tsv"
+
+[record.config]
+Upper=true
+
+[fields]
+names=["f0", "f1"]
+
+[input]
+name="Channel"
+
+[output]
+name="Recorder"
+procs=1
+fields=["f0", "f1"]
+`
+	var created int64
+	in := &channelInput{ch: make(chan []byte, 1)}
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+		Records: []baker.RecordDesc{tsvRecordDesc(&created)},
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	in.ch <- []byte("a\tb,c\nd\te\n")
+	close(in.ch)
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]string
+	for _, r := range topo.Output[0].(*outputtest.Recorder).Records {
+		got = append(got, r.Fields)
+	}
+	if want := [][]string{{"A", "B,C"}, {"D", "E"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+	if atomic.LoadInt64(&created) == 0 {
+		t.Errorf("no record created by the TSV record type")
+	}
+}
+
+func TestRecordTypeConfigErrors(t *testing.T) {
+	var created int64
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Channel",
+			New:    func(baker.InputParams) (baker.Input, error) { return &channelInput{}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+		Records: []baker.RecordDesc{tsvRecordDesc(&created)},
+	}
+	const rest = `
+[fields]
+names=["f0"]
+
+[input]
+name="Channel"
+
+[output]
+name="Recorder"
+fields=["f0"]
+`
+	tests := []struct {
+		name         string
+		toml         string
+		createRecord bool // sets Components.CreateRecord
+		wantErr      string
+	}{
+		{name: "LogLine", toml: `[general]` + "\n" + `record_type="logline"`},
+		{name: "unknown", toml: `[general]` + "\n" + `record_type="xml"`, wantErr: `record type does not exist: "xml"`},
+		{name: "with CreateRecord", toml: `[general]` + "\n" + `record_type="tsv"`, createRecord: true, wantErr: "Components.CreateRecord"},
+		{name: "config without record type", toml: `[record.config]` + "\n" + `Upper=true`, wantErr: "invalid keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := comp
+			if tt.createRecord {
+				c.CreateRecord = func() baker.Record { return &baker.LogLine{FieldSeparator: ','} }
+			}
+			_, err := baker.NewConfigFromToml(strings.NewReader(tt.toml+rest), c)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewConfigFromToml: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewConfigFromToml error = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package baker_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+// chanInput is an input sending the data it receives from a channel.
+type chanInput struct {
+	inputtest.Base
+	ch chan *baker.Data
+}
+
+func (in *chanInput) Run(output chan<- *baker.Data) error {
+	for data := range in.ch {
+		output <- data
+	}
+	return nil
+}
+
+type samplingConfig struct {
+	Rate int64 // keep one every Rate records
+}
+
+// samplingFilter is a reloadable filter keeping one every Rate records.
+type samplingFilter struct {
+	filtertest.Base
+
+	rate      int64
+	processed int64
+	kept      int64
+}
+
+func (f *samplingFilter) Process(l baker.Record, next func(baker.Record)) {
+	n := atomic.AddInt64(&f.processed, 1)
+	if n%atomic.LoadInt64(&f.rate) == 0 {
+		atomic.AddInt64(&f.kept, 1)
+		next(l)
+	}
+}
+
+func (f *samplingFilter) Reload(cfg baker.FilterParams) error {
+	rate := cfg.DecodedConfig.(*samplingConfig).Rate
+	if rate <= 0 {
+		return fmt.Errorf("rate must be positive, got %d", rate)
+	}
+	atomic.StoreInt64(&f.rate, rate)
+	return nil
+}
+
+func TestTopologyReload(t *testing.T) {
+	const src = `
+[fields]
+names=["f0"]
+
+[filterchain]
+procs=1
+
+[input]
+name="chan"
+
+[[filter]]
+name="sampling"
+
+	[filter.config]
+	rate=%s
+
+[output]
+name="nop"
+fields=["f0"]
+`
+	input := &chanInput{ch: make(chan *baker.Data)}
+	filter := &samplingFilter{}
+
+	components := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "chan",
+			New:    func(baker.InputParams) (baker.Input, error) { return input, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{{
+			Name: "sampling",
+			New: func(cfg baker.FilterParams) (baker.Filter, error) {
+				filter.rate = cfg.DecodedConfig.(*samplingConfig).Rate
+				return filter, nil
+			},
+			Config: &samplingConfig{},
+		}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	config := func(rate string) *baker.Config {
+		t.Helper()
+		cfg, err := baker.NewConfigFromToml(strings.NewReader(strings.Replace(src, "%s", rate, 1)), components)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	topo, err := baker.NewTopologyFromConfig(config("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+
+	send := func(n int) {
+		input.ch <- &baker.Data{Bytes: []byte(strings.Repeat("foo\n", n))}
+	}
+	waitProcessed := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&filter.processed) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %d processed records", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// All records are kept with rate=1.
+	send(100)
+	waitProcessed(100)
+
+	// Reload with rate=10, mid-run.
+	if err := topo.Reload(config("10")); err != nil {
+		t.Fatal(err)
+	}
+	send(100)
+	waitProcessed(200)
+
+	// A changed filter chain can't be reloaded, and the old configuration
+	// is kept.
+	cfg := config("1")
+	cfg.Filter = nil
+	if err := topo.Reload(cfg); err == nil {
+		t.Errorf("Reload() with a different filter chain: err = nil, want an error")
+	}
+	send(100)
+	waitProcessed(300)
+
+	close(input.ch)
+	topo.Wait()
+
+	if got, want := atomic.LoadInt64(&filter.kept), int64(100+10+10); got != want {
+		t.Errorf("kept %d records, want %d", got, want)
+	}
+}
+
+func TestTopologyReloadRollback(t *testing.T) {
+	const src = `
+[fields]
+names=["f0"]
+
+[input]
+name="chan"
+
+[[filter]]
+name="sampling"
+
+	[filter.config]
+	rate=%d
+
+[[filter]]
+name="sampling"
+
+	[filter.config]
+	rate=%d
+
+[output]
+name="nop"
+fields=["f0"]
+`
+	var filters []*samplingFilter
+	components := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "chan",
+			New:    func(baker.InputParams) (baker.Input, error) { return &chanInput{}, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{{
+			Name: "sampling",
+			New: func(cfg baker.FilterParams) (baker.Filter, error) {
+				f := &samplingFilter{rate: cfg.DecodedConfig.(*samplingConfig).Rate}
+				filters = append(filters, f)
+				return f, nil
+			},
+			Config: &samplingConfig{},
+		}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+	config := func(rate1, rate2 int) *baker.Config {
+		t.Helper()
+		cfg, err := baker.NewConfigFromToml(strings.NewReader(fmt.Sprintf(src, rate1, rate2)), components)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	topo, err := baker.NewTopologyFromConfig(config(2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rates := func() []int64 {
+		return []int64{atomic.LoadInt64(&filters[0].rate), atomic.LoadInt64(&filters[1].rate)}
+	}
+
+	// The second filter rejects its new configuration, so the first one
+	// gets its old configuration back.
+	if err := topo.Reload(config(10, 0)); err == nil {
+		t.Fatalf("Reload() with an invalid rate: err = nil, want an error")
+	}
+	if got, want := rates(), []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rates after a failed reload = %v, want %v", got, want)
+	}
+
+	if err := topo.Reload(config(10, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rates(), []int64{10, 20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rates after reload = %v, want %v", got, want)
+	}
+
+	// A failed reload restores the last applied configuration.
+	if err := topo.Reload(config(5, -1)); err == nil {
+		t.Fatalf("Reload() with an invalid rate: err = nil, want an error")
+	}
+	if got, want := rates(), []int64{10, 20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rates after a failed reload = %v, want %v", got, want)
+	}
+}
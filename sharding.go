@@ -0,0 +1,94 @@
+package baker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// shardingHashes are the hash functions that can be selected with the
+// shardingfunc key of the [output] section.
+var shardingHashes = map[string]func([]byte) uint64{
+	"fnv":     fnvHash,
+	"crc32":   crc32Hash,
+	"murmur3": murmur3Hash,
+}
+
+// newFieldShardingFunc returns a ShardingFunc that calculates the sharding
+// value by hashing the value of the given field with the hash function named
+// name, among the ones in shardingHashes.
+func newFieldShardingFunc(name string, field FieldIndex) (ShardingFunc, error) {
+	hash, ok := shardingHashes[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(shardingHashes))
+		for n := range shardingHashes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown sharding function %q, supported: %s", name, strings.Join(names, ", "))
+	}
+
+	return func(r Record) uint64 { return hash(r.Get(field)) }, nil
+}
+
+// fnvHash returns the 64-bit FNV-1 hash of b.
+func fnvHash(b []byte) uint64 {
+	h := fnv.New64()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// crc32Hash returns the CRC-32 checksum of b, using the IEEE polynomial.
+func crc32Hash(b []byte) uint64 {
+	return uint64(crc32.ChecksumIEEE(b))
+}
+
+// murmur3Hash returns the 32-bit MurmurHash3 (x86_32 variant, seed 0) of b.
+func murmur3Hash(b []byte) uint64 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	var h uint32
+	n := len(b)
+	for ; len(b) >= 4; b = b[4:] {
+		k := binary.LittleEndian.Uint32(b)
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(b) {
+	case 3:
+		k ^= uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(b[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return uint64(h)
+}
@@ -0,0 +1,81 @@
+package baker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestShardingHashes(t *testing.T) {
+	// Known values, to ensure the sharding is stable across runs and versions.
+	tests := []struct {
+		hash string
+		in   string
+		want uint64
+	}{
+		{hash: "fnv", in: "hello", want: 0x7b495389bdbdd4c7},
+		{hash: "crc32", in: "", want: 0},
+		{hash: "crc32", in: "hello", want: 0x3610a686},
+		{hash: "murmur3", in: "", want: 0},
+		{hash: "murmur3", in: "hello", want: 0x248bfa47},
+		{hash: "murmur3", in: "The quick brown fox jumps over the lazy dog", want: 0x2e4ff723},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hash+"/"+tt.in, func(t *testing.T) {
+			shard, err := newFieldShardingFunc(tt.hash, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l := &LogLine{FieldSeparator: DefaultLogLineFieldSeparator}
+			l.Set(0, []byte(tt.in))
+			if got := shard(l); got != tt.want {
+				t.Errorf("%s(%q) = %#x, want %#x", tt.hash, tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardingHashesDistribution(t *testing.T) {
+	const (
+		nshards = 16
+		nkeys   = 100000
+	)
+
+	rnd := rand.New(rand.NewSource(0))
+	keys := make([][]byte, nkeys)
+	for i := range keys {
+		keys[i] = make([]byte, 4+rnd.Intn(28))
+		rnd.Read(keys[i])
+	}
+
+	for name := range shardingHashes {
+		t.Run(name, func(t *testing.T) {
+			shard, err := newFieldShardingFunc(name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var counts [nshards]int
+			l := &LogLine{FieldSeparator: DefaultLogLineFieldSeparator}
+			for _, k := range keys {
+				l.Set(0, k)
+				counts[shard(l)%nshards]++
+			}
+
+			// Accept a 5% deviation from a perfectly uniform distribution.
+			const want = nkeys / nshards
+			for i, n := range counts {
+				if n < want*95/100 || n > want*105/100 {
+					t.Errorf("shard %d got %d keys, want ~%d", i, n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFieldShardingFuncUnknown(t *testing.T) {
+	if _, err := newFieldShardingFunc("md5", 0); err == nil {
+		t.Errorf("newFieldShardingFunc(%q) err = nil, want an error", "md5")
+	}
+}
@@ -0,0 +1,111 @@
+package baker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ShutdownPhase is a phase of the topology shutdown. The phases happen in
+// order, each one starting once the previous one is complete, so that no
+// component is stopped while records it may receive are still in flight:
+//   - ShutdownInput: the input stops sending data (Input.Run returns)
+//   - ShutdownFilters: the filter chain processes the records in flight
+//   - ShutdownOutputs: the outputs flush the records they've received (Output.Run returns)
+//   - ShutdownUpload: the upload sends the files of the outputs (Upload.Run returns)
+//
+// Components implementing ShutdownHook are stopped at the end of the phase
+// they belong to. Each phase, hooks included, is bounded by
+// [general] shutdown_timeout.
+type ShutdownPhase int
+
+// Shutdown phases, in their order.
+const (
+	ShutdownInput ShutdownPhase = iota + 1
+	ShutdownFilters
+	ShutdownOutputs
+	ShutdownUpload
+)
+
+func (p ShutdownPhase) String() string {
+	switch p {
+	case ShutdownInput:
+		return "input"
+	case ShutdownFilters:
+		return "filters"
+	case ShutdownOutputs:
+		return "outputs"
+	case ShutdownUpload:
+		return "upload"
+	}
+	return fmt.Sprintf("ShutdownPhase(%d)", int(p))
+}
+
+// shutdownHooks returns the components implementing ShutdownHook that belong
+// to phase, in the order of the topology.
+func (t *Topology) shutdownHooks(phase ShutdownPhase) []ShutdownHook {
+	var hooks []ShutdownHook
+	add := func(comp interface{}) {
+		if h, ok := comp.(ShutdownHook); ok && h.ShutdownPhase() == phase {
+			hooks = append(hooks, h)
+		}
+	}
+
+	add(t.Input)
+	for _, f := range t.Filters {
+		add(f)
+	}
+	for _, out := range t.Output {
+		add(out)
+	}
+	if t.Upload != nil {
+		add(t.Upload)
+	}
+	return hooks
+}
+
+// waitPhase waits for the components of phase run by wg, then stops the
+// components implementing ShutdownHook that belong to phase. It returns false
+// if that didn't complete within the shutdown timeout, in which case the
+// shutdown must be aborted.
+func (t *Topology) waitPhase(phase ShutdownPhase, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		for _, h := range t.shutdownHooks(phase) {
+			if err := h.Shutdown(); err != nil {
+				log.WithError(err).WithFields(log.Fields{"phase": phase, "component": fmt.Sprintf("%T", h)}).Error("shutdown error")
+			}
+		}
+		close(done)
+	}()
+
+	if phase == ShutdownInput {
+		// The input runs until it's done or asked to stop, only then does
+		// its shutdown begin.
+		select {
+		case <-done:
+			return true
+		case <-t.stopping:
+		}
+	}
+
+	if t.shutdownTimeout <= 0 {
+		<-done
+		return true
+	}
+
+	timer := time.NewTimer(t.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		err := fmt.Errorf("shutdown aborted: %s phase not complete after %v", phase, t.shutdownTimeout)
+		t.shutdownErr.Store(err)
+		log.WithError(err).Error("shutdown timeout")
+		return false
+	}
+}
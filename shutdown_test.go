@@ -0,0 +1,247 @@
+package baker_test
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+	"github.com/AdRoll/baker/upload/uploadtest"
+)
+
+// shutdownLog records the shutdown events of the components, in order.
+type shutdownLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *shutdownLog) add(event string) {
+	l.mu.Lock()
+	l.events = append(l.events, event)
+	l.mu.Unlock()
+}
+
+func (l *shutdownLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// hook is a ShutdownHook recording its call.
+type hook struct {
+	log   *shutdownLog
+	name  string
+	phase baker.ShutdownPhase
+}
+
+func (h hook) ShutdownPhase() baker.ShutdownPhase { return h.phase }
+func (h hook) Shutdown() error {
+	h.log.add(h.name + " hook")
+	return nil
+}
+
+// stoppableInput sends records until it's stopped.
+type stoppableInput struct {
+	inputtest.Base
+	hook
+	stop chan struct{}
+	sent chan struct{} // closed once some records have been sent
+	n    int64         // number of records sent
+}
+
+func (in *stoppableInput) Run(output chan<- *baker.Data) error {
+	for i := 0; ; i++ {
+		if i == 10 {
+			close(in.sent)
+		}
+		select {
+		case <-in.stop:
+			in.log.add("input stopped")
+			return nil
+		case output <- &baker.Data{Bytes: []byte("a,b\n")}:
+			in.n++
+		}
+	}
+}
+
+func (in *stoppableInput) Stop() { close(in.stop) }
+
+// slowFilter passes records through after a delay, so that records are still
+// in flight in the filter chain when the input stops.
+type slowFilter struct {
+	filtertest.Base
+	hook
+}
+
+func (f *slowFilter) Process(l baker.Record, next func(baker.Record)) {
+	time.Sleep(time.Millisecond)
+	next(l)
+}
+
+// countingOutput counts the records it receives, until it's released.
+type countingOutput struct {
+	outputtest.Base
+	hook
+	release chan struct{}
+	n       int64
+}
+
+func (o *countingOutput) Run(input <-chan baker.OutputRecord, upch chan<- string) error {
+	for range input {
+		atomic.AddInt64(&o.n, 1)
+	}
+	<-o.release
+	o.log.add("output stopped")
+	return nil
+}
+
+type recordingUpload struct {
+	uploadtest.Base
+	hook
+}
+
+func (u *recordingUpload) Run(upch <-chan string) error {
+	for range upch {
+	}
+	u.log.add("upload stopped")
+	return nil
+}
+
+func newShutdownTopology(t *testing.T, events *shutdownLog, timeout time.Duration) (*baker.Topology, *stoppableInput, *countingOutput) {
+	t.Helper()
+
+	in := &stoppableInput{
+		hook: hook{events, "input", baker.ShutdownInput},
+		stop: make(chan struct{}),
+		sent: make(chan struct{}),
+	}
+	out := &countingOutput{
+		hook:    hook{events, "output", baker.ShutdownOutputs},
+		release: make(chan struct{}),
+	}
+	comp := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "Stoppable",
+			New:    func(baker.InputParams) (baker.Input, error) { return in, nil },
+			Config: &struct{}{},
+		}},
+		Filters: []baker.FilterDesc{
+			{
+				Name: "Slow",
+				New: func(baker.FilterParams) (baker.Filter, error) {
+					return &slowFilter{hook: hook{events, "filter", baker.ShutdownFilters}}, nil
+				},
+				Config: &struct{}{},
+			},
+			{
+				// A filter sharing a resource with the outputs, that must
+				// only be released once they've stopped.
+				Name: "Shared",
+				New: func(baker.FilterParams) (baker.Filter, error) {
+					return &slowFilter{hook: hook{events, "shared filter", baker.ShutdownOutputs}}, nil
+				},
+				Config: &struct{}{},
+			},
+		},
+		Outputs: []baker.OutputDesc{{
+			Name:   "Counting",
+			New:    func(baker.OutputParams) (baker.Output, error) { return out, nil },
+			Config: &struct{}{},
+		}},
+		Uploads: []baker.UploadDesc{{
+			Name: "Recording",
+			New: func(baker.UploadParams) (baker.Upload, error) {
+				return &recordingUpload{hook: hook{events, "upload", baker.ShutdownUpload}}, nil
+			},
+			Config: &struct{}{},
+		}},
+	}
+	cfg := baker.Config{
+		General:     baker.ConfigGeneral{ShutdownTimeout: timeout},
+		Input:       baker.ConfigInput{Name: "Stoppable", ChanSize: 10},
+		Filter:      []baker.ConfigFilter{{Name: "Slow"}, {Name: "Shared"}},
+		FilterChain: baker.ConfigFilterChain{Procs: 2},
+		Output:      []baker.ConfigOutput{{Name: "Counting", Procs: 1, Fields: []string{"f0"}}},
+		Upload:      baker.ConfigUpload{Name: "Recording"},
+		Fields:      baker.ConfigFields{Names: []string{"f0", "f1"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topo, in, out
+}
+
+func TestShutdownOrder(t *testing.T) {
+	events := &shutdownLog{}
+	topo, in, out := newShutdownTopology(t, events, time.Minute)
+
+	topo.Start()
+	<-in.sent
+	topo.Stop()
+	close(out.release)
+	topo.Wait()
+
+	if err := topo.Error(); err != nil {
+		t.Fatalf("Error() = %v", err)
+	}
+
+	want := []string{
+		"input stopped",
+		"input hook",
+		"filter hook",
+		"output stopped",
+		"shared filter hook",
+		"output hook",
+		"upload stopped",
+		"upload hook",
+	}
+	if got := events.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("shutdown events:\n got %q\nwant %q", got, want)
+	}
+
+	// All the records sent by the input went through the filters before the
+	// outputs were stopped.
+	if out.n != in.n {
+		t.Errorf("output got %d records, want %d", out.n, in.n)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	events := &shutdownLog{}
+	topo, in, out := newShutdownTopology(t, events, 200*time.Millisecond)
+	defer close(out.release)
+
+	topo.Start()
+	<-in.sent
+	topo.Stop()
+
+	// The output never stops, so Wait gives up on the outputs phase.
+	done := make(chan struct{})
+	go func() {
+		topo.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after the shutdown timeout")
+	}
+
+	err := topo.Error()
+	if err == nil || !strings.Contains(err.Error(), "outputs phase") {
+		t.Errorf("Error() = %v, want an outputs phase timeout", err)
+	}
+
+	want := []string{"input stopped", "input hook", "filter hook"}
+	if got := events.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("shutdown events:\n got %q\nwant %q", got, want)
+	}
+}
@@ -1,11 +1,16 @@
 package baker
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,14 +20,62 @@ import (
 type StatsDumper struct {
 	t       *Topology
 	start   time.Time
-	w       io.Writer     // stats destination
-	metrics MetricsClient // metrics implementation to use
+	w       io.Writer        // stats destination
+	metrics MetricsClient    // metrics implementation to use
+	tick    <-chan time.Time // if set, replaces the ticker of the stats dumps
 
 	lock             sync.Mutex
 	prevwlines       int64
 	prevrlines       int64
 	prevUploads      int64
 	prevUploadErrors int64
+	prevAdmitted     int64
+	prevTime         time.Time
+	last             *statsSnapshot // most recent stats, served over HTTP
+}
+
+// statsSnapshot holds the aggregated stats of all the components of a
+// topology, as served by the stats HTTP endpoint.
+type statsSnapshot struct {
+	Time             time.Time        `json:"time"`
+	Input            inputSnapshot    `json:"input"`
+	Filters          []filterSnapshot `json:"filters"`
+	Outputs          []outputSnapshot `json:"outputs"`
+	Upload           *uploadSnapshot  `json:"upload,omitempty"`
+	ParseErrors      int64            `json:"parse_errors"`
+	ValidationErrors map[string]int64 `json:"validation_errors"`
+	EmittedLines     int64            `json:"emitted_lines"`
+	DroppedLines     map[string]int64 `json:"dropped_lines,omitempty"`
+}
+
+type inputSnapshot struct {
+	Name           string            `json:"name"`
+	ProcessedLines int64             `json:"processed_lines"`
+	CustomStats    map[string]string `json:"custom_stats,omitempty"`
+	Metrics        *MetricsBag       `json:"metrics,omitempty"`
+}
+
+type filterSnapshot struct {
+	Name           string      `json:"name"`
+	ProcessedLines int64       `json:"processed_lines"`
+	FilteredLines  int64       `json:"filtered_lines"`
+	Metrics        *MetricsBag `json:"metrics,omitempty"`
+}
+
+type outputSnapshot struct {
+	Name           string            `json:"name"`
+	ProcessedLines int64             `json:"processed_lines"`
+	ErrorLines     int64             `json:"error_lines"`
+	CustomStats    map[string]string `json:"custom_stats,omitempty"`
+	Metrics        *MetricsBag       `json:"metrics,omitempty"`
+}
+
+type uploadSnapshot struct {
+	Name           string            `json:"name"`
+	ProcessedFiles int64             `json:"processed_files"`
+	ErrorFiles     int64             `json:"error_files"`
+	CustomStats    map[string]string `json:"custom_stats,omitempty"`
+	Metrics        *MetricsBag       `json:"metrics,omitempty"`
 }
 
 // NewStatsDumper creates and initializes a StatsDumper using the given
@@ -41,12 +94,19 @@ func NewStatsDumper(t *Topology) (sd *StatsDumper) {
 // SetWriter must be called before Run().
 func (sd *StatsDumper) SetWriter(w io.Writer) { sd.w = w }
 
-func (sd *StatsDumper) dumpNow() {
+// SetTicker sets the channel on which each received time triggers a dump of
+// the stats as of that time, in place of the default ticker, firing every
+// second. SetTicker must be called before Run().
+func (sd *StatsDumper) SetTicker(tick <-chan time.Time) { sd.tick = tick }
+
+// dumpNow dumps the stats, as of now.
+func (sd *StatsDumper) dumpNow(now time.Time) {
 	sd.lock.Lock()
 	defer sd.lock.Unlock()
 
 	t := sd.t
-	nsec := int64(time.Now().UTC().Sub(sd.start).Seconds())
+	now = now.UTC()
+	nsec := int64(now.Sub(sd.start).Seconds())
 	if nsec == 0 {
 		return
 	}
@@ -60,26 +120,58 @@ func (sd *StatsDumper) dumpNow() {
 	istats := t.Input.Stats()
 	currlines := istats.NumProcessedLines
 
+	snap := &statsSnapshot{
+		Time: now,
+		Input: inputSnapshot{
+			Name:           fmt.Sprintf("%T", t.Input),
+			ProcessedLines: currlines,
+			CustomStats:    istats.CustomStats,
+			Metrics:        istats.Metrics,
+		},
+		ValidationErrors: make(map[string]int64),
+		EmittedLines:     atomic.LoadInt64(&t.emitted),
+	}
+
 	// Collect metrics from input, filters and outputs that we can
 	// forward to statsd
-	allMetrics := make(MetricsBag)
+	allMetrics := &MetricsBag{}
 	allMetrics.Merge(istats.Metrics)
 
 	var filtered int64
 	filteredMap := make(map[string]int64)
-	for _, f := range t.Filters {
+	for i, f := range t.Filters {
 		stats := f.Stats()
+		name := fmt.Sprintf("%T", f)
+		if i < len(t.filterNames) {
+			name = t.filterNames[i]
+		}
+		snap.Filters = append(snap.Filters, filterSnapshot{
+			Name:           name,
+			ProcessedLines: stats.NumProcessedLines,
+			FilteredLines:  stats.NumFilteredLines,
+			Metrics:        stats.Metrics,
+		})
 		if stats.NumFilteredLines > 0 {
 			filtered += stats.NumFilteredLines
 			filteredMap[fmt.Sprintf("%T", f)] += filtered
 		}
 		allMetrics.Merge(stats.Metrics)
+		if i < len(t.timings) {
+			t.timings[i].report(sd.metrics, i, name)
+		}
 	}
 
 	outErrors := int64(0)
 	for _, o := range t.Output {
 		stats := o.Stats()
 		outErrors += stats.NumErrorLines
+		snap.Outputs = append(snap.Outputs, outputSnapshot{
+			Name:           fmt.Sprintf("%T", o),
+			ProcessedLines: stats.NumProcessedLines,
+			ErrorLines:     stats.NumErrorLines,
+			CustomStats:    stats.CustomStats,
+			Metrics:        stats.Metrics,
+		})
 		allMetrics.Merge(stats.Metrics)
 	}
 
@@ -88,6 +180,13 @@ func (sd *StatsDumper) dumpNow() {
 		uStats := t.Upload.Stats()
 		numUploads = uStats.NumProcessedFiles
 		numUploadErrors = uStats.NumErrorFiles
+		snap.Upload = &uploadSnapshot{
+			Name:           fmt.Sprintf("%T", t.Upload),
+			ProcessedFiles: numUploads,
+			ErrorFiles:     numUploadErrors,
+			CustomStats:    uStats.CustomStats,
+			Metrics:        uStats.Metrics,
+		}
 		sd.metrics.RawCount("uploads", numUploads)
 		sd.metrics.RawCount("upload_errors", numUploadErrors)
 		allMetrics.Merge(uStats.Metrics)
@@ -98,11 +197,13 @@ func (sd *StatsDumper) dumpNow() {
 	}
 
 	invalid := sd.countInvalid()
-	parseErrors := t.malformed
+	parseErrors := atomic.LoadInt64(&t.malformed)
+	snap.ParseErrors = parseErrors
 	totalErrors := invalid + parseErrors + filtered + outErrors
 	sd.metrics.RawCount("error_lines", totalErrors)
 
-	for k, v := range allMetrics {
+	metrics := allMetrics.Snapshot()
+	for k, v := range metrics {
 		switch k[0] {
 		case 'c':
 			sd.metrics.RawCount(k[2:], v.(int64))
@@ -110,6 +211,19 @@ func (sd *StatsDumper) dumpNow() {
 			sd.metrics.DeltaCount(k[2:], v.(int64))
 		case 'g':
 			sd.metrics.Gauge(k[2:], v.(float64))
+		case 'h':
+			if hb, ok := sd.metrics.(HistogramBucketer); ok {
+				if buckets, ok := metrics["b:"+k[2:]]; ok {
+					hb.SetHistogramBuckets(k[2:], buckets.([]float64))
+				}
+			}
+			for _, val := range v.([]float64) {
+				sd.metrics.Histogram(k[2:], val)
+			}
+		case 't':
+			for _, val := range v.([]time.Duration) {
+				sd.metrics.Duration(k[2:], val)
+			}
 		}
 	}
 
@@ -134,6 +248,7 @@ func (sd *StatsDumper) dumpNow() {
 				name := sd.t.fieldName(FieldIndex(f))
 				value := t.invalid[f]
 				m[name] = value
+				snap.ValidationErrors[name] = value
 				sd.metrics.RawCount("error_lines."+name, int64(value))
 			}
 		}
@@ -143,7 +258,36 @@ func (sd *StatsDumper) dumpNow() {
 	if filtered > 0 {
 		fmt.Fprintf(sd.w, "--- Filtered lines: %v\n", filteredMap)
 	}
+
+	// Records dropped by the outputs overflow policies
+	for _, to := range t.outputs {
+		if to.overflow == OverflowBlock {
+			continue
+		}
+		if snap.DroppedLines == nil {
+			snap.DroppedLines = make(map[string]int64)
+		}
+		snap.DroppedLines[to.name] += atomic.LoadInt64(&to.dropped)
+	}
+	for name, dropped := range snap.DroppedLines {
+		sd.metrics.RawCount("dropped_lines."+name, dropped)
+	}
+	if len(snap.DroppedLines) > 0 {
+		fmt.Fprintf(sd.w, "--- Dropped lines: %v\n", snap.DroppedLines)
+	}
 	sd.metrics.RawCount("filtered_lines", filtered)
+	sd.metrics.RawCount("emitted_lines", atomic.LoadInt64(&t.emitted))
+
+	// Rate limiter stats
+	if t.limiter != nil {
+		admitted := atomic.LoadInt64(&t.admitted)
+		if elapsed := now.Sub(sd.prevTime).Seconds(); elapsed > 0 {
+			sd.metrics.Gauge("ratelimit.rate", float64(admitted-sd.prevAdmitted)/elapsed)
+		}
+		sd.metrics.RawCount("ratelimit.throttled", atomic.LoadInt64(&t.throttled))
+		sd.prevAdmitted = admitted
+	}
+	sd.prevTime = now
 
 	// Go stats
 	sd.metrics.Gauge("runtime.numgoroutines", float64(runtime.NumGoroutine()))
@@ -159,6 +303,7 @@ func (sd *StatsDumper) dumpNow() {
 	sd.metrics.Gauge("runtime.memstats.stacksys", float64(memstats.StackSys))
 	sd.metrics.Gauge("runtime.memstats.numgc", float64(memstats.NumGC))
 
+	sd.last = snap
 	sd.prevwlines = curwlines
 	sd.prevrlines = currlines
 	sd.prevUploads = numUploads
@@ -180,23 +325,90 @@ func (sd *StatsDumper) countInvalid() int64 {
 // stop periodically dumping stats, this prints stats one last time.
 func (sd *StatsDumper) Run() (stop func()) {
 	sd.start = time.Now().UTC()
+	sd.prevTime = sd.start
 
 	quit := make(chan struct{})
 	done := make(chan struct{})
+	tick := sd.tick
+	var ticker *time.Ticker
+	if tick == nil {
+		ticker = time.NewTicker(1 * time.Second)
+		tick = ticker.C
+	}
 	go func() {
-		tick := time.NewTicker(1 * time.Second)
-		defer tick.Stop()
+		if ticker != nil {
+			defer ticker.Stop()
+		}
 
 		for {
 			select {
 			case <-quit:
 				close(done)
 				return
-			case <-tick.C:
-				sd.dumpNow()
+			case now := <-tick:
+				sd.dumpNow(now)
 			}
 		}
 	}()
 
-	return func() { close(quit); <-done; sd.dumpNow() }
+	return func() { close(quit); <-done; sd.dumpNow(time.Now()) }
+}
+
+// ServeHTTP implements http.Handler. It replies with the JSON encoding of
+// the stats of all the topology components, as they were aggregated the last
+// time they've been dumped, or with 503 Service Unavailable if they haven't
+// been dumped yet.
+func (sd *StatsDumper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sd.lock.Lock()
+	snap := sd.last
+	sd.lock.Unlock()
+
+	if snap == nil {
+		http.Error(w, "stats not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The snapshot is never modified once created, so it can be encoded
+	// without holding the lock.
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("can't encode stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// ListenAndServe starts serving the stats as JSON on the /stats path of an
+// HTTP server listening on addr. Call stop() to gracefully shut the server
+// down.
+func (sd *StatsDumper) ListenAndServe(addr string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't serve stats: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/stats", sd)
+	srv := &http.Server{Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.WithError(err).Error("stats server")
+		}
+	}()
+
+	log.WithField("addr", ln.Addr().String()).Info("serving stats")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("stats server shutdown")
+		}
+		<-done
+	}, nil
 }
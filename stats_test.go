@@ -2,12 +2,17 @@ package baker_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,10 +28,13 @@ import (
 type statsInput struct{ inputtest.Base }
 
 func (statsInput) Stats() baker.InputStats {
-	bag := baker.MetricsBag{}
+	bag := &baker.MetricsBag{}
+	bag.SetHistogramBuckets("hist", []float64{1, 10, 100})
 	bag.AddDeltaCounter("delta_counter", 1)
 	bag.AddGauge("gauge", math.Pi)
-	bag.AddHistogram("hist", []float64{1, 2, 3})
+	for _, v := range []float64{1, 2, 3} {
+		bag.AddHistogram("hist", v)
+	}
 	bag.AddTimings("timings", []time.Duration{1 * time.Second, 10 * time.Second, 100 * time.Second})
 
 	return baker.InputStats{
@@ -39,10 +47,12 @@ func (statsInput) Stats() baker.InputStats {
 type statsFilter struct{ filtertest.Base }
 
 func (statsFilter) Stats() baker.FilterStats {
-	bag := baker.MetricsBag{}
+	bag := &baker.MetricsBag{}
 	bag.AddDeltaCounter("delta_counter", 3)
 	bag.AddGauge("gauge", math.Pi*2)
-	bag.AddHistogram("hist", []float64{4, 5, 6, 7})
+	for _, v := range []float64{4, 5, 6, 7} {
+		bag.AddHistogram("hist", v)
+	}
 	bag.AddTimings("timings", []time.Duration{1 * time.Minute, 10 * time.Minute, 100 * time.Minute})
 
 	return baker.FilterStats{
@@ -55,10 +65,12 @@ func (statsFilter) Stats() baker.FilterStats {
 type statsOutput struct{ outputtest.Base }
 
 func (statsOutput) Stats() baker.OutputStats {
-	bag := baker.MetricsBag{}
+	bag := &baker.MetricsBag{}
 	bag.AddDeltaCounter("delta_counter", 7)
 	bag.AddGauge("gauge", math.Pi*3)
-	bag.AddHistogram("hist", []float64{8, 9, 10, 11})
+	for _, v := range []float64{8, 9, 10, 11} {
+		bag.AddHistogram("hist", v)
+	}
 	bag.AddTimings("timings", []time.Duration{1 * time.Hour, 10 * time.Hour, 100 * time.Hour})
 
 	return baker.OutputStats{
@@ -72,10 +84,12 @@ func (statsOutput) Stats() baker.OutputStats {
 type statsUpload struct{ uploadtest.Base }
 
 func (statsUpload) Stats() baker.UploadStats {
-	bag := baker.MetricsBag{}
+	bag := &baker.MetricsBag{}
 	bag.AddDeltaCounter("delta_counter", 9)
 	bag.AddGauge("gauge", math.Pi*4)
-	bag.AddHistogram("hist", []float64{8, 9, 10, 11})
+	for _, v := range []float64{8, 9, 10, 11} {
+		bag.AddHistogram("hist", v)
+	}
 	bag.AddTimings("timings", []time.Duration{1 * time.Microsecond, 10 * time.Microsecond, 100 * time.Microsecond})
 
 	return baker.UploadStats{
@@ -219,3 +233,365 @@ fields=["field0"]
 		t.Errorf("StatsDumper validation error line doesn't contain %q\nline:\n\t%q", out[1], want)
 	}
 }
+
+// recordingMetrics is a baker.HistogramBucketer recording histogram and
+// duration samples, histogram buckets, the last value of raw counters and
+// the number of stats dumps.
+type recordingMetrics struct {
+	baker.NopMetrics
+
+	mu        sync.Mutex
+	histogram map[string][]float64
+	buckets   map[string][]float64
+	durations map[string][]time.Duration
+	counters  map[string]int64
+	gauges    map[string]float64
+	dumps     int
+}
+
+func (m *recordingMetrics) RawCount(name string, value int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]int64)
+	}
+	m.counters[name] = value
+	if name == "processed_lines" {
+		// Reported once per dump.
+		m.dumps++
+	}
+}
+
+func (m *recordingMetrics) RawCountWithTags(name string, value int64, tags []string) {
+	m.RawCount(name+"|"+strings.Join(tags, ","), value)
+}
+
+func (m *recordingMetrics) GaugeWithTags(name string, value float64, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.gauges == nil {
+		m.gauges = make(map[string]float64)
+	}
+	m.gauges[name+"|"+strings.Join(tags, ",")] = value
+}
+
+func (m *recordingMetrics) Histogram(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.histogram[name] = append(m.histogram[name], value)
+}
+
+func (m *recordingMetrics) SetHistogramBuckets(name string, buckets []float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets == nil {
+		m.buckets = make(map[string][]float64)
+	}
+	m.buckets[name] = buckets
+}
+
+func (m *recordingMetrics) Duration(name string, value time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[name] = append(m.durations[name], value)
+}
+
+func TestStatsDumperHistograms(t *testing.T) {
+	toml := `
+[input]
+name="stats"
+
+[output]
+name="nop"
+fields=["field0"]
+
+[metrics]
+name="recorder"
+`
+	metrics := &recordingMetrics{
+		histogram: make(map[string][]float64),
+		durations: make(map[string][]time.Duration),
+	}
+
+	components := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "stats",
+			New:    func(baker.InputParams) (baker.Input, error) { return &statsInput{}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+		Metrics: []baker.MetricsDesc{{
+			Name:   "recorder",
+			New:    func(interface{}) (baker.MetricsClient, error) { return metrics, nil },
+			Config: &struct{}{},
+		}},
+		FieldByName: func(n string) (baker.FieldIndex, bool) { return 0, n == "field0" },
+		FieldName:   func(baker.FieldIndex) string { return "field0" },
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := baker.NewStatsDumper(topo)
+	sd.SetWriter(ioutil.Discard)
+	tick := make(chan time.Time)
+	sd.SetTicker(tick)
+	stop := sd.Run()
+	// The ticker is unbuffered, so the first dump is over once the second
+	// tick is received, and stop waits for the second one.
+	tick <- time.Now().Add(1 * time.Second)
+	tick <- time.Now().Add(2 * time.Second)
+	stop()
+
+	// Each dump reports all the samples of the input bag (stop dumps the
+	// stats one last time, unless it's called within the first second).
+	if metrics.dumps < 2 {
+		t.Fatalf("stats dumped %d times, want at least 2", metrics.dumps)
+	}
+	var wantHist []float64
+	var wantDur []time.Duration
+	for i := 0; i < metrics.dumps; i++ {
+		wantHist = append(wantHist, 1, 2, 3)
+		wantDur = append(wantDur, 1*time.Second, 10*time.Second, 100*time.Second)
+	}
+	if got := metrics.histogram["hist"]; !reflect.DeepEqual(got, wantHist) {
+		t.Errorf("histogram samples = %v, want %v", got, wantHist)
+	}
+	if got, want := metrics.buckets["hist"], []float64{1, 10, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("histogram buckets = %v, want %v", got, want)
+	}
+	if got := metrics.durations["timings"]; !reflect.DeepEqual(got, wantDur) {
+		t.Errorf("duration samples = %v, want %v", got, wantDur)
+	}
+}
+
+func TestStatsDumperServeHTTP(t *testing.T) {
+	tp := &baker.Topology{
+		Input:   &statsInput{},
+		Filters: []baker.Filter{&statsFilter{}},
+		Output:  []baker.Output{&statsOutput{}, &statsOutput{}},
+		Upload:  &statsUpload{},
+	}
+	sd := baker.NewStatsDumper(tp)
+	sd.SetWriter(ioutil.Discard)
+
+	srv := httptest.NewServer(sd)
+	defer srv.Close()
+
+	get := func() (int, []byte) {
+		t.Helper()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, buf
+	}
+
+	// No stats have been dumped yet.
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	stop := sd.Run()
+	// Scrape concurrently with the stats dumper.
+	deadline := time.Now().Add(1100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		get()
+		time.Sleep(50 * time.Millisecond)
+	}
+	stop()
+
+	code, buf := get()
+	if code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d, body:\n%s", code, http.StatusOK, buf)
+	}
+
+	var stats struct {
+		Input struct {
+			Name           string            `json:"name"`
+			ProcessedLines int64             `json:"processed_lines"`
+			CustomStats    map[string]string `json:"custom_stats"`
+			Metrics        map[string]interface{}
+		} `json:"input"`
+		Filters []struct {
+			ProcessedLines int64 `json:"processed_lines"`
+			FilteredLines  int64 `json:"filtered_lines"`
+		} `json:"filters"`
+		Outputs []struct {
+			ProcessedLines int64 `json:"processed_lines"`
+			ErrorLines     int64 `json:"error_lines"`
+		} `json:"outputs"`
+		Upload struct {
+			ProcessedFiles int64 `json:"processed_files"`
+			ErrorFiles     int64 `json:"error_files"`
+		} `json:"upload"`
+	}
+	if err := json.Unmarshal(buf, &stats); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf)
+	}
+
+	if stats.Input.Name != "*baker_test.statsInput" {
+		t.Errorf("input name = %q, want %q", stats.Input.Name, "*baker_test.statsInput")
+	}
+	if stats.Input.ProcessedLines != 93 {
+		t.Errorf("input processed lines = %d, want 93", stats.Input.ProcessedLines)
+	}
+	if got := stats.Input.CustomStats["k1"]; got != "v1" {
+		t.Errorf("input custom stats k1 = %q, want %q", got, "v1")
+	}
+	if got := stats.Input.Metrics["g:gauge"]; got != math.Pi {
+		t.Errorf("input metrics g:gauge = %v, want %v", got, math.Pi)
+	}
+	if len(stats.Filters) != 1 || stats.Filters[0].ProcessedLines != 67 || stats.Filters[0].FilteredLines != 7 {
+		t.Errorf("filters stats = %+v, want 1 filter with 67 processed and 7 filtered lines", stats.Filters)
+	}
+	if len(stats.Outputs) != 2 || stats.Outputs[1].ProcessedLines != 53 || stats.Outputs[1].ErrorLines != 7 {
+		t.Errorf("outputs stats = %+v, want 2 outputs with 53 processed and 7 error lines", stats.Outputs)
+	}
+	if stats.Upload.ProcessedFiles != 17 || stats.Upload.ErrorFiles != 3 {
+		t.Errorf("upload stats = %+v, want 17 processed and 3 error files", stats.Upload)
+	}
+}
+
+func TestStatsDumperListenAndServe(t *testing.T) {
+	sd := baker.NewStatsDumper(&baker.Topology{Input: &statsInput{}})
+
+	stop, err := sd.ListenAndServe("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	if _, err := sd.ListenAndServe("not-an-address"); err == nil {
+		t.Errorf("ListenAndServe() with an invalid address: err = nil, want an error")
+	}
+}
+
+// sleepFilter sleeps before passing the records through, and drops every
+// other record if drop is set.
+type sleepFilter struct {
+	filtertest.Base
+	d    time.Duration
+	drop bool
+	n    int
+}
+
+func (f *sleepFilter) Process(l baker.Record, next func(baker.Record)) {
+	time.Sleep(f.d)
+	f.n++
+	if f.drop && f.n%2 == 0 {
+		return
+	}
+	next(l)
+}
+
+func TestStatsDumperFilterTimings(t *testing.T) {
+	toml := `
+[fields]
+names=["field0"]
+
+[input]
+name="Records"
+
+[[filter]]
+name="Fast"
+
+[[filter]]
+name="Slow"
+
+[filterchain]
+procs=1
+
+[output]
+name="nop"
+fields=["field0"]
+
+[metrics]
+name="recorder"
+`
+	metrics := &recordingMetrics{}
+	filterDesc := func(name string, f *sleepFilter) baker.FilterDesc {
+		return baker.FilterDesc{
+			Name:   name,
+			New:    func(baker.FilterParams) (baker.Filter, error) { return f, nil },
+			Config: &struct{}{},
+		}
+	}
+
+	components := baker.Components{
+		Inputs: []baker.InputDesc{inputtest.RecordsDesc},
+		Filters: []baker.FilterDesc{
+			filterDesc("Fast", &sleepFilter{d: 100 * time.Microsecond, drop: true}),
+			filterDesc("Slow", &sleepFilter{d: 2 * time.Millisecond}),
+		},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+		Metrics: []baker.MetricsDesc{{
+			Name:   "recorder",
+			New:    func(interface{}) (baker.MetricsClient, error) { return metrics, nil },
+			Config: &struct{}{},
+		}},
+	}
+
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), components)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := topo.Input.(*inputtest.Records)
+	for i := 0; i < 20; i++ {
+		ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+		ll.Set(0, []byte("value"))
+		in.Records = append(in.Records, &ll)
+	}
+	topo.Start()
+	topo.Wait()
+
+	sd := baker.NewStatsDumper(topo)
+	sd.SetWriter(ioutil.Discard)
+	stop := sd.Run()
+	// StatsDumper does not print anything the first second
+	time.Sleep(1050 * time.Millisecond)
+	stop()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	fastTags, slowTags := "|filter:Fast,filter_index:0", "|filter:Slow,filter_index:1"
+	want := map[string]int64{
+		"filter.processed_lines" + fastTags: 20,
+		"filter.dropped_lines" + fastTags:   10,
+		"filter.processed_lines" + slowTags: 10,
+		"filter.dropped_lines" + slowTags:   0,
+	}
+	for name, n := range want {
+		if got, ok := metrics.counters[name]; !ok || got != n {
+			t.Errorf("%s = %d (reported: %t), want %d", name, got, ok, n)
+		}
+	}
+
+	fastTime := metrics.gauges["filter.processing_time_per_record"+fastTags]
+	slowTime := metrics.gauges["filter.processing_time_per_record"+slowTags]
+	if fastTime <= 0 || slowTime <= fastTime {
+		t.Errorf("processing time per record: fast = %vs, slow = %vs, want 0 < fast < slow", fastTime, slowTime)
+	}
+	// The time of a filter doesn't include the time of the next ones.
+	if fastTime >= 0.002 {
+		t.Errorf("processing time per record of the fast filter = %vs, want less than the slow filter sleep (2ms)", fastTime)
+	}
+}
@@ -0,0 +1,121 @@
+package baker_test
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/filter"
+	"github.com/AdRoll/baker/filter/filtertest"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output/outputtest"
+)
+
+// markFilter sets the second field of the records it processes to "marked".
+type markFilter struct {
+	filtertest.Base
+	calls int64
+}
+
+func (f *markFilter) Process(l baker.Record, next func(baker.Record)) {
+	atomic.AddInt64(&f.calls, 1)
+	l.Set(1, []byte("marked"))
+	next(l)
+}
+
+func TestStopChain(t *testing.T) {
+	toml := `
+[fields]
+names=["id", "status"]
+
+[input]
+name="Records"
+
+[[filter]]
+name="StopChain"
+
+	[filter.config]
+	field="id"
+	strings=["allowed"]
+
+[[filter]]
+name="Mark"
+
+[output]
+name="Recorder"
+procs=1
+fields=["id", "status"]
+`
+	for _, withMetrics := range []bool{false, true} {
+		name := "without metrics"
+		if withMetrics {
+			// The filters execution is measured, through another code path.
+			name = "with metrics"
+		}
+		t.Run(name, func(t *testing.T) {
+			mark := &markFilter{}
+			c := baker.Components{
+				Inputs: []baker.InputDesc{inputtest.RecordsDesc},
+				Filters: []baker.FilterDesc{
+					filter.StopChainDesc,
+					{
+						Name:   "Mark",
+						New:    func(baker.FilterParams) (baker.Filter, error) { return mark, nil },
+						Config: &struct{}{},
+					},
+				},
+				Outputs: []baker.OutputDesc{outputtest.RecorderDesc},
+				Metrics: []baker.MetricsDesc{{
+					Name:   "recorder",
+					New:    func(interface{}) (baker.MetricsClient, error) { return &recordingMetrics{}, nil },
+					Config: &struct{}{},
+				}},
+			}
+
+			src := toml
+			if withMetrics {
+				src += "\n[metrics]\nname=\"recorder\"\n"
+			}
+			cfg, err := baker.NewConfigFromToml(strings.NewReader(src), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topology, err := baker.NewTopologyFromConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in := topology.Input.(*inputtest.Records)
+			for _, id := range []string{"allowed", "other", "allowed"} {
+				ll := baker.LogLine{FieldSeparator: baker.DefaultLogLineFieldSeparator}
+				ll.Set(0, []byte(id))
+				ll.Set(1, []byte("new"))
+				in.Records = append(in.Records, &ll)
+			}
+
+			topology.Start()
+			topology.Wait()
+			if err := topology.Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the record that didn't match went through the Mark filter,
+			// but all of them reached the output.
+			if mark.calls != 1 {
+				t.Errorf("Mark filter called %d times, want 1", mark.calls)
+			}
+
+			var got []string
+			for _, r := range topology.Output[0].(*outputtest.Recorder).Records {
+				got = append(got, strings.Join(r.Fields, ":"))
+			}
+			sort.Strings(got)
+			want := "allowed:new allowed:new other:marked"
+			if strings.Join(got, " ") != want {
+				t.Errorf("output records = %q, want %q", strings.Join(got, " "), want)
+			}
+		})
+	}
+}
@@ -3,12 +3,19 @@ package baker
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/juju/ratelimit"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/AdRoll/baker/pkg/tracing"
 )
 
 // Topology defines the baker topology, that is how to retrieve records (input),
@@ -19,23 +26,27 @@ type Topology struct {
 	Output  []Output
 	Upload  Upload
 
-	inerr     atomic.Value
-	inch      chan *Data
-	outch     []chan OutputRecord
-	rawOutput bool
-	upch      chan string
+	inerr       atomic.Value
+	recordErr   atomic.Value // first record error, with failOnRecordError
+	shutdownErr atomic.Value
+	inch        chan *Data
+	outputs     []*topologyOutput
+	upch        chan string
 
 	metrics   MetricsClient
 	malformed int64 // count parse or empty records
+	emitted   int64 // count records out of the filter chain
+	admitted  int64 // count records let through by the rate limiter
+	throttled int64 // count records delayed by the rate limiter
 
 	mu      sync.RWMutex         // protects invalid map
 	invalid map[FieldIndex]int64 // tracks validation errors (by field)
 
-	shard func(l Record) uint64
-	chain func(l Record)
+	chain   func(l Record)
+	limiter *ratelimit.Bucket // nil if the input rate isn't limited
+	tracer  *tracing.Tracer   // nil if tracing is disabled
 
 	filterProcs int
-	outFields   []FieldIndex
 	linePool    sync.Pool
 
 	wginp sync.WaitGroup
@@ -43,17 +54,131 @@ type Topology struct {
 	wgout sync.WaitGroup
 	wgupl sync.WaitGroup
 
-	validate  ValidationFunc
-	fieldName func(FieldIndex) string // Used by StatsDumper
+	stopping        chan struct{} // closed when Stop is called
+	stopOnce        sync.Once
+	shutdownTimeout time.Duration // maximum duration of a shutdown phase, no limit if 0
+
+	validate          ValidationFunc
+	lenientFieldCount bool                    // if true, records with an unexpected number of fields are kept
+	fieldName         func(FieldIndex) string // Used by StatsDumper
+
+	filterNames  []string
+	filterParams []FilterParams   // current configuration of each filter, see Reload
+	timings      []*filterTiming  // per-filter execution stats, nil if metrics are disabled
+	batchers     []*filterBatcher // per-filter batcher, nil for filters not implementing BatchFilter
+	reload       func() (*Config, error)
+
+	errHandler        func(RecordError)
+	failOnRecordError bool          // if true, the first record error stops the topology
+	failOnce          sync.Once     // stops the topology on the first record error
+	inputName         string        // reporting the parse errors
+	noSignals         bool          // if true, Start doesn't install signal handlers
+	signalsDone       chan struct{} // closed to stop handling the signals
+	signalsOnce       sync.Once
+
+	maxRecords  int64         // if not 0, the topology stops after that many records
+	maxDuration time.Duration // if not 0, the topology stops after running that long
+	taken       int64         // number of records sent through the filter chain, if maxRecords is set
+	limitOnce   sync.Once     // stops the topology on the first limit reached
+	limited     int32         // set to 1 once the topology is stopped by a limit
+	limitTimer  *time.Timer   // fires after maxDuration
+}
+
+// topologyOutput holds the state of one of the configured outputs, that is
+// all the instances (procs) of that output and the channels feeding them.
+type topologyOutput struct {
+	procs    []Output
+	outch    []chan OutputRecord
+	raw      bool
+	discard  bool // the output discards the records, it needs no fields
+	fields   []FieldIndex
+	shard    func(l Record) uint64
+	overflow string // overflow policy
+	name     string
+	dropped  int64 // count records dropped because of the overflow policy
+
+	tee      bool       // if true, only the records selected by teeRate and teeField are sent
+	teeRate  float64    // fraction of the records sent, all if 0
+	teeField FieldIndex // if teeValue isn't nil, only records with this field set to teeValue are sent
+	teeValue []byte
+}
+
+// Overflow policies of the outputs, see ConfigOutput.OverflowPolicy.
+const (
+	OverflowBlock      = "block"
+	OverflowDropNewest = "drop_newest"
+	OverflowDropOldest = "drop_oldest"
+)
+
+// New creates a Topology from a configuration built programmatically, for
+// programs embedding baker rather than using MainCLI. Components listed in
+// cfg are matched by name with those in comp, which can contain custom
+// components as well as baker ones. A component whose DecodedConfig is nil
+// receives its description default Config.
+//
+// The returned topology doesn't handle signals: the embedding program is
+// responsible for calling Stop to perform a clean shutdown, then Wait.
+func New(comp Components, cfg Config) (*Topology, error) {
+	if err := cfg.resolveComponents(comp); err != nil {
+		return nil, err
+	}
+
+	// Components without configuration get a zero one.
+	fill := func(dcfg *interface{}, def interface{}) {
+		if *dcfg == nil {
+			*dcfg = cloneConfig(def)
+		}
+	}
+
+	fill(&cfg.Input.DecodedConfig, cfg.Input.desc.Config)
+	cfg.Filter = append([]ConfigFilter(nil), cfg.Filter...)
+	for idx := range cfg.Filter {
+		fill(&cfg.Filter[idx].DecodedConfig, cfg.Filter[idx].desc.Config)
+	}
+	cfg.Output = append([]ConfigOutput(nil), cfg.Output...)
+	for idx := range cfg.Output {
+		fill(&cfg.Output[idx].DecodedConfig, cfg.Output[idx].desc.Config)
+	}
+	if cfg.Upload.desc != nil {
+		fill(&cfg.Upload.DecodedConfig, cfg.Upload.desc.Config)
+	}
+	if cfg.Metrics.desc != nil {
+		fill(&cfg.Metrics.DecodedConfig, cfg.Metrics.desc.Config)
+	}
+	if cfg.Record.desc != nil {
+		fill(&cfg.Record.DecodedConfig, cfg.Record.desc.Config)
+	}
+
+	mappingErr := assignFieldMapping(&cfg, comp)
+	if err := cfg.validateAfter(mappingErr); err != nil {
+		return nil, err
+	}
+
+	cfg.shardingFuncs = comp.ShardingFuncs
+	cfg.validate = comp.Validate
+	cfg.createRecord = comp.CreateRecord
+	cfg.spanExporter = comp.SpanExporter
+	if err := cfg.fillDefaults(); err != nil {
+		return nil, err
+	}
+
+	t, err := NewTopologyFromConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.noSignals = true
+	return t, nil
 }
 
 // NewTopologyFromConfig gets a baker configuration and returns a Topology
 func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 	var err error
 
+	// Configure logging before any component gets created.
+	cfg.General.applyLogging()
+
 	tp := &Topology{
 		filterProcs: cfg.FilterChain.Procs,
-		rawOutput:   cfg.Output.desc.Raw,
 		validate:    cfg.validate,
 		fieldName:   cfg.fieldName,
 		linePool: sync.Pool{
@@ -61,17 +186,37 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 				return cfg.createRecord()
 			},
 		},
-		invalid: make(map[FieldIndex]int64),
+		invalid:         make(map[FieldIndex]int64),
+		reload:          cfg.reload,
+		stopping:        make(chan struct{}),
+		signalsDone:     make(chan struct{}),
+		shutdownTimeout: cfg.General.ShutdownTimeout,
+
+		failOnRecordError: cfg.General.FailOnRecordError,
+		maxRecords:        cfg.General.MaxRecords,
+		maxDuration:       cfg.General.MaxDuration,
 	}
 
 	// Create the metrics client first since it's injected into components parameters.
 	if cfg.Metrics.Name != "" {
 		tp.metrics, err = cfg.Metrics.desc.New(cfg.Metrics.DecodedConfig)
 		if err != nil {
-			return nil, fmt.Errorf("error creating metrics interface: %q: %v", cfg.Metrics.Name, err)
+			return nil, componentError("metrics", cfg.Metrics.Name, "[metrics]", err)
 		}
 	}
 
+	// Likewise for the tracer, injected into the input parameters.
+	switch {
+	case cfg.spanExporter != nil:
+		tp.tracer = tracing.NewTracer(cfg.spanExporter)
+	case cfg.General.TracingEndpoint != "":
+		exp, err := tracing.NewOTLPExporter(cfg.General.TracingEndpoint, cfg.General.TracingServiceName)
+		if err != nil {
+			return nil, fmt.Errorf("[general] tracing_endpoint: %v", err)
+		}
+		tp.tracer = tracing.NewTracer(exp)
+	}
+
 	// Assign a dummy client if no one was installed
 	if tp.metrics == nil {
 		tp.metrics = NopMetrics{}
@@ -86,11 +231,13 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 			CreateRecord:   cfg.createRecord,
 			ValidateRecord: cfg.validate,
 			Metrics:        tp.metrics,
+			Tracer:         tp.tracer,
 		},
 	}
 	tp.Input, err = cfg.Input.desc.New(inCfg)
+	tp.inputName = cfg.Input.Name
 	if err != nil {
-		return nil, fmt.Errorf("error creating input: %v", err)
+		return nil, componentError("input", cfg.Input.Name, "[input]", err)
 	}
 
 	// * Create filters
@@ -103,124 +250,351 @@ func NewTopologyFromConfig(cfg *Config) (*Topology, error) {
 				CreateRecord:   cfg.createRecord,
 				ValidateRecord: cfg.validate,
 				Metrics:        tp.metrics,
+				ReportError:    tp.errorReporter(cfg.Filter[idx].Name),
 			},
 		}
 		fil, err := cfg.Filter[idx].desc.New(filCfg)
 		if err != nil {
-			return nil, fmt.Errorf("error creating filter: %v", err)
+			return nil, componentError("filter", cfg.Filter[idx].Name, fmt.Sprintf("[[filter]] #%d", idx+1), err)
 		}
 		tp.Filters = append(tp.Filters, fil)
+		tp.filterNames = append(tp.filterNames, cfg.Filter[idx].Name)
+		tp.filterParams = append(tp.filterParams, filCfg)
 	}
 
 	// * Create outputs
-	if len(cfg.Output.Fields) == 0 && !tp.rawOutput {
-		return nil, fmt.Errorf("error creating output: no \"fields\" specified in [output]")
+	for idx := range cfg.Output {
+		section := "[output]"
+		if len(cfg.Output) > 1 {
+			section = fmt.Sprintf("[[output]] #%d", idx+1)
+		}
+		out, err := newTopologyOutput(cfg, &cfg.Output[idx], section, tp.metrics, tp.errorReporter(cfg.Output[idx].Name))
+		if err != nil {
+			return nil, err
+		}
+		tp.outputs = append(tp.outputs, out)
+		tp.Output = append(tp.Output, out.procs...)
+	}
+
+	// Create the input-to-filter channel
+	tp.inch = make(chan *Data, cfg.Input.ChanSize)
+
+	if cfg.Upload.Name != "" {
+		upCfg := UploadParams{
+			ComponentParams{
+				DecodedConfig:  cfg.Upload.DecodedConfig,
+				FieldByName:    cfg.fieldByName,
+				FieldName:      cfg.fieldName,
+				CreateRecord:   cfg.createRecord,
+				ValidateRecord: cfg.validate,
+				Metrics:        tp.metrics,
+			},
+		}
+		tp.Upload, err = cfg.Upload.desc.New(upCfg)
+		if err != nil {
+			return nil, componentError("upload", cfg.Upload.Name, "[upload]", err)
+		}
 	}
+	tp.upch = make(chan string)
 
-	for _, fname := range cfg.Output.Fields {
+	// Create the filter chain. When metrics are enabled, the execution of
+	// each filter is measured, otherwise filters are called directly so that
+	// there's no overhead.
+	if cfg.Metrics.Name != "" {
+		tp.timings = make([]*filterTiming, len(tp.Filters))
+	}
+	// Filters implementing BatchFilter are passed their records through a
+	// batcher instead, and those implementing SerialFilter are called by one
+	// goroutine at a time.
+	end := tp.filterChainEnd
+	next := end
+	tp.batchers = make([]*filterBatcher, len(tp.Filters))
+	for i := len(tp.Filters) - 1; i >= 0; i-- {
+		nf := next
+		f := tp.Filters[i]
+		if tp.timings != nil {
+			tp.timings[i] = &filterTiming{}
+		}
+		serial := false
+		if sf, ok := f.(SerialFilter); ok {
+			serial = sf.RequiresSerialization()
+		}
+		if bf, ok := f.(BatchFilter); ok {
+			process := bf.ProcessBatch
+			if tp.timings != nil {
+				process = tp.timings[i].wrapBatch(bf)
+			}
+			if serial {
+				process = serializeBatch(process)
+			}
+			size, interval := cfg.Filter[i].BatchSize, cfg.Filter[i].BatchInterval
+			if size == 0 {
+				size = defaultBatchSize
+			}
+			if interval == 0 {
+				interval = defaultBatchInterval
+			}
+			tp.batchers[i] = newFilterBatcher(process, nf, size, interval)
+			next = tp.batchers[i].add
+			continue
+		}
+		if cfg.Filter[i].BatchSize != 0 || cfg.Filter[i].BatchInterval != 0 {
+			return nil, componentError("filter", cfg.Filter[i].Name, fmt.Sprintf("[[filter]] #%d", i+1),
+				fmt.Errorf("batchsize and batchinterval require a filter processing batches"))
+		}
+		switch cs, ok := f.(ChainStopper); {
+		case tp.timings != nil:
+			next = tp.timings[i].wrap(f, nf, end)
+		case ok:
+			next = func(l Record) {
+				cs.ProcessChain(l, nf, end)
+			}
+		default:
+			next = func(l Record) {
+				f.Process(l, nf)
+			}
+		}
+		if serial {
+			next = serialize(next)
+		}
+	}
+	tp.chain = func(l Record) {
+		next(l)
+		l.Clear()
+		tp.linePool.Put(l)
+	}
+
+	if cfg.General.MaxRecordsPerSecond > 0 {
+		// Allow bursts of a tenth of a second worth of records, so that
+		// sleep inaccuracies don't reduce the effective rate.
+		rate := cfg.General.MaxRecordsPerSecond
+		burst := int64(rate/10) + 1
+		tp.limiter = ratelimit.NewBucketWithRate(float64(rate), burst)
+	}
+
+	// Disable validation if required
+	if cfg.General.DontValidateFields {
+		tp.validate = nil
+		tp.lenientFieldCount = true
+	}
+
+	if cfg.General.ValidateOnStart {
+		if err := tp.validateComponents(); err != nil {
+			return nil, err
+		}
+	}
+
+	return tp, nil
+}
+
+// validateComponents calls Validate on all the components implementing
+// StartupValidator.
+func (t *Topology) validateComponents() error {
+	validate := func(typ string, comp interface{}) error {
+		v, ok := comp.(StartupValidator)
+		if !ok {
+			return nil
+		}
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("%s %T failed validation: %v", typ, comp, err)
+		}
+		return nil
+	}
+
+	if err := validate("input", t.Input); err != nil {
+		return err
+	}
+	for _, f := range t.Filters {
+		if err := validate("filter", f); err != nil {
+			return err
+		}
+	}
+	for _, to := range t.outputs {
+		// All procs of an output share the same configuration.
+		if err := validate("output", to.procs[0]); err != nil {
+			return err
+		}
+	}
+	if t.Upload != nil {
+		if err := validate("upload", t.Upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTopologyOutput creates all the instances (procs) of the output described
+// by ocfg, and the channels feeding them.
+func newTopologyOutput(cfg *Config, ocfg *ConfigOutput, section string, metrics MetricsClient, report ErrorReporter) (*topologyOutput, error) {
+	to := &topologyOutput{raw: ocfg.desc.Raw, discard: ocfg.desc.Discard, name: ocfg.Name}
+
+	switch strings.ToLower(ocfg.OverflowPolicy) {
+	case "", OverflowBlock:
+		to.overflow = OverflowBlock
+	case OverflowDropNewest, OverflowDropOldest:
+		to.overflow = strings.ToLower(ocfg.OverflowPolicy)
+	default:
+		return nil, fmt.Errorf("error creating output %q: unsupported overflowpolicy %q", ocfg.Name, ocfg.OverflowPolicy)
+	}
+
+	if tee := ocfg.Tee; tee != nil {
+		if tee.Rate < 0 || tee.Rate > 1 {
+			return nil, fmt.Errorf("error creating output %q: tee rate must be between 0 and 1, got %v", ocfg.Name, tee.Rate)
+		}
+		if tee.Rate == 0 && tee.Field == "" {
+			return nil, fmt.Errorf("error creating output %q: tee requires a rate or a field", ocfg.Name)
+		}
+		to.tee = true
+		to.teeRate = tee.Rate
+		if tee.Field != "" {
+			fidx, ok := cfg.fieldByName(tee.Field)
+			if !ok {
+				return nil, fmt.Errorf("error creating output %q: tee: unknown field: %q", ocfg.Name, tee.Field)
+			}
+			to.teeField = fidx
+			to.teeValue = []byte(tee.Value)
+		}
+	}
+
+	// Discarding outputs don't need any field.
+	if len(ocfg.Fields) == 0 && !to.raw && !to.discard {
+		return nil, fmt.Errorf("error creating output %q: no \"fields\" specified in [output]", ocfg.Name)
+	}
+
+	for _, fname := range ocfg.Fields {
 		fidx, ok := cfg.fieldByName(fname)
 		if !ok {
-			return nil, fmt.Errorf("error creating output: unknown field: %q", fname)
+			return nil, fmt.Errorf("error creating output %q: unknown field: %q", ocfg.Name, fname)
 		}
-		tp.outFields = append(tp.outFields, fidx)
+		to.fields = append(to.fields, fidx)
 	}
 
-	for i := 0; i < cfg.Output.Procs; i++ {
+	for i := 0; i < ocfg.Procs; i++ {
 		outCfg := OutputParams{
 			ComponentParams: ComponentParams{
-				DecodedConfig:  cfg.Output.DecodedConfig,
+				DecodedConfig:  ocfg.DecodedConfig,
 				FieldByName:    cfg.fieldByName,
 				FieldName:      cfg.fieldName,
 				CreateRecord:   cfg.createRecord,
 				ValidateRecord: cfg.validate,
-				Metrics:        tp.metrics,
+				Metrics:        metrics,
+				ReportError:    report,
 			},
 			Index:  i,
-			Fields: tp.outFields,
+			Fields: to.fields,
 		}
-		out, err := cfg.Output.desc.New(outCfg)
+		out, err := ocfg.desc.New(outCfg)
 		if err != nil {
-			return nil, fmt.Errorf("error creating output: %v", err)
+			return nil, componentError("output", ocfg.Name, section, err)
 		}
-		tp.Output = append(tp.Output, out)
+		to.procs = append(to.procs, out)
 	}
 
-	// Create the input-to-filter channel
-	tp.inch = make(chan *Data, cfg.Input.ChanSize)
-
 	// Initialize the sharding functions and the output channels.
 	// If a sharding function is present, we need one channel per each
 	// output worker, and the sharding function will decided where to
 	// send each output; if there is no sharding, we create one
 	// channel, and the output workers will all fetch from the same.
-	tp.outch = make([]chan OutputRecord, cfg.Output.Procs)
+	to.outch = make([]chan OutputRecord, ocfg.Procs)
+
+	if ocfg.Sharding == "" && ocfg.ShardingFunc != "" {
+		return nil, fmt.Errorf("shardingfunc %q requires a sharding field", ocfg.ShardingFunc)
+	}
 
-	if cfg.Output.Sharding != "" {
-		field, ok := cfg.fieldByName(cfg.Output.Sharding)
+	if ocfg.Sharding != "" {
+		field, ok := cfg.fieldByName(ocfg.Sharding)
 		if !ok {
-			return nil, fmt.Errorf("invalid field: %q", cfg.Output.Sharding)
+			return nil, fmt.Errorf("invalid field: %q", ocfg.Sharding)
 		}
 
-		tp.shard, ok = cfg.shardingFuncs[field]
-		if tp.shard == nil {
-			return nil, fmt.Errorf("field not supported for sharding: %q", cfg.Output.Sharding)
+		if ocfg.ShardingFunc != "" {
+			var err error
+			to.shard, err = newFieldShardingFunc(ocfg.ShardingFunc, field)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			to.shard = cfg.shardingFuncs[field]
+			if to.shard == nil {
+				return nil, fmt.Errorf("field not supported for sharding: %q", ocfg.Sharding)
+			}
 		}
 
-		if !tp.Output[0].CanShard() {
-			return nil, fmt.Errorf("output component %q does not support sharding", cfg.Output.Name)
+		if !to.procs[0].CanShard() {
+			return nil, fmt.Errorf("output component %q does not support sharding", ocfg.Name)
 		}
 
-		for i := range tp.outch {
-			tp.outch[i] = make(chan OutputRecord, cfg.Output.ChanSize)
+		for i := range to.outch {
+			to.outch[i] = make(chan OutputRecord, ocfg.ChanSize)
 		}
 	} else {
-		tp.outch[0] = make(chan OutputRecord, cfg.Output.ChanSize)
+		to.outch[0] = make(chan OutputRecord, ocfg.ChanSize)
 	}
 
-	if cfg.Upload.Name != "" {
-		upCfg := UploadParams{
-			ComponentParams{
-				DecodedConfig:  cfg.Upload.DecodedConfig,
-				FieldByName:    cfg.fieldByName,
-				FieldName:      cfg.fieldName,
-				CreateRecord:   cfg.createRecord,
-				ValidateRecord: cfg.validate,
-				Metrics:        tp.metrics,
-			},
+	return to, nil
+}
+
+// componentError wraps err, returned by the New function of a component, with
+// the type and name of the component and the TOML section configuring it.
+func componentError(typ, name, section string, err error) error {
+	return fmt.Errorf("error creating %s %q (configured in %s): %w", typ, name, section, err)
+}
+
+// SetErrorHandler installs h as the handler of the per-record errors reported
+// by filters and outputs (see ErrorReporter), and of the records that can't
+// be parsed or don't pass the validation, reported with the name of the input.
+// h is called synchronously, from the goroutine of the reporting component, so
+// it should return quickly, and it must be safe for concurrent use. SetErrorHandler must be called before
+// Start. If no handler is installed, reported errors are ignored.
+func (t *Topology) SetErrorHandler(h func(RecordError)) {
+	t.errHandler = h
+}
+
+// errorReporter returns the ErrorReporter of the component named name.
+func (t *Topology) errorReporter(name string) ErrorReporter {
+	return func(e RecordError) {
+		if !t.handlesRecordErrors() {
+			return
 		}
-		tp.Upload, err = cfg.Upload.desc.New(upCfg)
-		if err != nil {
-			return nil, fmt.Errorf("error creating upload: %v", err)
+		e.Component = name
+		if t.errHandler != nil {
+			t.errHandler(e)
 		}
-	}
-	tp.upch = make(chan string)
-
-	// Create the filter chain
-	next := tp.filterChainEnd
-	for i := len(tp.Filters) - 1; i >= 0; i-- {
-		nf := next
-		f := tp.Filters[i]
-		next = func(l Record) {
-			f.Process(l, nf)
+		if t.failOnRecordError {
+			t.failOnce.Do(func() {
+				log.WithError(e).Error("record error, stopping the topology (fail_on_record_error)")
+				t.recordErr.Store(fmt.Errorf("record error: %w", e))
+				go t.Stop()
+			})
 		}
 	}
-	tp.chain = func(l Record) {
-		next(l)
-		l.Clear()
-		tp.linePool.Put(l)
-	}
+}
 
-	// Disable validation if required
-	if cfg.General.DontValidateFields {
-		tp.validate = nil
-	}
+// handlesRecordErrors reports whether per-record errors have to be reported,
+// which is only the case if there's an error handler or if they abort the
+// topology.
+func (t *Topology) handlesRecordErrors() bool {
+	return t.errHandler != nil || t.failOnRecordError
+}
 
-	return tp, nil
+// reportParseError reports that the i-th line of data, the record line,
+// couldn't be parsed.
+func (t *Topology) reportParseError(data *Data, line []byte, i int64, err error) {
+	e := RecordError{
+		Record: append([]byte(nil), line...),
+		Meta:   data.Meta,
+		Err:    err,
+	}
+	if data.FirstLine > 0 {
+		e.Line = data.FirstLine + i
+	}
+	t.errorReporter(t.inputName)(e)
 }
 
 // Start starts the Topology, that is start all components.
 // This function also intercepts the interrupt signal (ctrl+c)
-// starting the graceful shutdown (calling Topology.Stop())
+// starting the graceful shutdown (calling Topology.Stop()),
+// unless the topology has been created with New.
 func (t *Topology) Start() {
 	// Start the uploader
 	t.wgupl.Add(1)
@@ -238,23 +612,31 @@ func (t *Topology) Start() {
 		t.wgupl.Done()
 	}()
 
-	// Start the output. We might either have one channel per process
-	// (in case sharding is active), or just one channel (if there's no sharding)
-	for idx, out := range t.Output {
-		t.wgout.Add(1)
-		ch := t.outch[idx]
-		if ch == nil {
-			ch = t.outch[0]
-		}
-		go func(out Output) {
-			if err := out.Run(ch, t.upch); err != nil {
-				log.WithError(err).Fatal("Output returned an error")
+	// Start the outputs. For each output, we might either have one channel
+	// per process (in case sharding is active), or just one channel (if
+	// there's no sharding)
+	for _, to := range t.outputs {
+		for idx, out := range to.procs {
+			t.wgout.Add(1)
+			ch := to.outch[idx]
+			if ch == nil {
+				ch = to.outch[0]
 			}
-			t.wgout.Done()
-		}(out)
+			go func(out Output) {
+				if err := out.Run(ch, t.upch); err != nil {
+					log.WithError(err).Fatal("Output returned an error")
+				}
+				t.wgout.Done()
+			}(out)
+		}
 	}
 
 	// Start the filters
+	for _, b := range t.batchers {
+		if b != nil {
+			b.start()
+		}
+	}
 	for i := 0; i < t.filterProcs; i++ {
 		t.wgfil.Add(1)
 		go func() {
@@ -273,13 +655,143 @@ func (t *Topology) Start() {
 		t.wginp.Done()
 	}()
 
+	if t.maxDuration > 0 {
+		t.limitTimer = time.AfterFunc(t.maxDuration, func() { t.stopOnLimit("max_duration") })
+	}
+
+	if t.noSignals {
+		return
+	}
+
+	// The signals are handled until the topology is stopped, or done.
 	stopch := make(chan os.Signal, 1)
 	signal.Notify(stopch, os.Interrupt)
 	go func() {
-		<-stopch
-		log.Warn("CTRL+C caught, doing clean shutdown (use CTRL+\\ aka SIGQUIT to abort)")
-		t.Stop()
+		defer signal.Stop(stopch)
+		select {
+		case <-stopch:
+			log.Warn("CTRL+C caught, doing clean shutdown (use CTRL+\\ aka SIGQUIT to abort)")
+			t.Stop()
+		case <-t.signalsDone:
+		}
 	}()
+
+	if t.reload != nil {
+		hupch := make(chan os.Signal, 1)
+		signal.Notify(hupch, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(hupch)
+			for {
+				select {
+				case <-hupch:
+				case <-t.signalsDone:
+					return
+				}
+				log.Info("SIGHUP caught, reloading configuration")
+				cfg, err := t.reload()
+				if err == nil {
+					err = t.Reload(cfg)
+				}
+				if err != nil {
+					log.WithError(err).Error("can't reload configuration, keeping the current one")
+				}
+			}
+		}()
+	}
+}
+
+// stopSignals stops the handling of the signals installed by Start.
+func (t *Topology) stopSignals() {
+	t.signalsOnce.Do(func() { close(t.signalsDone) })
+}
+
+// Reload applies the filters configuration of cfg to the running topology.
+// The filter chain described in cfg must be the same as the one of the
+// running topology, in number, order and names of the filters; only their
+// configuration can change. Filters implementing ReloadableFilter are passed
+// their new configuration, while other filters, as well as all other
+// components, keep running with their old configuration.
+//
+// The reload is all or nothing: if a filter fails to apply its new
+// configuration, the filters already reloaded are passed their old one back,
+// so that the whole chain keeps running with the old configuration.
+func (t *Topology) Reload(cfg *Config) error {
+	if len(cfg.Filter) != len(t.Filters) {
+		return fmt.Errorf("filter chain has changed: got %d filters, want %d", len(cfg.Filter), len(t.Filters))
+	}
+	for idx := range cfg.Filter {
+		if !strings.EqualFold(cfg.Filter[idx].Name, t.filterNames[idx]) {
+			return fmt.Errorf("filter chain has changed: got filter %q at position %d, want %q", cfg.Filter[idx].Name, idx, t.filterNames[idx])
+		}
+	}
+
+	// Prepare and validate all the new configurations before applying any.
+	params := make([]FilterParams, len(t.Filters))
+	for idx := range t.Filters {
+		fcfg := &cfg.Filter[idx]
+		if fcfg.DecodedConfig != nil {
+			if req := CheckRequiredFields(fcfg.DecodedConfig); req != "" {
+				return fmt.Errorf("error reloading filter %q: %w", t.filterNames[idx], ErrorRequiredField{req})
+			}
+			if v, ok := fcfg.DecodedConfig.(ConfigValidator); ok {
+				if err := v.ValidateConfig(cfg.fieldByName); err != nil {
+					return fmt.Errorf("error reloading filter %q: %v", t.filterNames[idx], err)
+				}
+			}
+		}
+		params[idx] = FilterParams{
+			ComponentParams{
+				DecodedConfig:  fcfg.DecodedConfig,
+				FieldByName:    cfg.fieldByName,
+				FieldName:      cfg.fieldName,
+				CreateRecord:   cfg.createRecord,
+				ValidateRecord: cfg.validate,
+				Metrics:        t.metrics,
+				ReportError:    t.errorReporter(t.filterNames[idx]),
+			},
+		}
+	}
+
+	var reloaded []int
+	for idx, f := range t.Filters {
+		rf, ok := f.(ReloadableFilter)
+		if !ok {
+			log.WithField("filter", t.filterNames[idx]).Warn("filter is not reloadable, keeping its old configuration")
+			continue
+		}
+		if err := rf.Reload(params[idx]); err != nil {
+			t.rollbackReload(reloaded)
+			return fmt.Errorf("error reloading filter %q: %v", t.filterNames[idx], err)
+		}
+		reloaded = append(reloaded, idx)
+	}
+
+	for _, idx := range reloaded {
+		t.filterParams[idx] = params[idx]
+		log.WithField("filter", t.filterNames[idx]).Info("filter configuration reloaded")
+	}
+	return nil
+}
+
+// rollbackReload passes their current configuration back to the filters at
+// the given indexes, which have been reloaded by a failed Reload.
+func (t *Topology) rollbackReload(reloaded []int) {
+	for i := len(reloaded) - 1; i >= 0; i-- {
+		idx := reloaded[i]
+		if err := t.Filters[idx].(ReloadableFilter).Reload(t.filterParams[idx]); err != nil {
+			log.WithError(err).WithField("filter", t.filterNames[idx]).Error("can't restore the filter configuration")
+		}
+	}
+}
+
+// stopOnLimit stops the topology because the limit named name, from the
+// [general] section, has been reached.
+func (t *Topology) stopOnLimit(name string) {
+	t.limitOnce.Do(func() {
+		log.WithField("limit", name).Info("limit reached, stopping the topology")
+		atomic.StoreInt32(&t.limited, 1)
+		go t.Stop()
+	})
 }
 
 // Stop requires the currently running topology stop safely,
@@ -287,60 +799,175 @@ func (t *Topology) Start() {
 // triggers the chain of stops from the components (managed
 // into Topology.Wait)
 func (t *Topology) Stop() {
+	t.stopOnce.Do(func() { close(t.stopping) })
+	t.stopSignals()
 	t.Input.Stop()
 }
 
 // Wait until the topology shuts itself down. This can happen
 // because the input component exits (in a batch topology), or
 // in response to a SIGINT signal, that is handled as a clean
-// shutdown request.
+// shutdown request. The shutdown goes through the phases
+// described in ShutdownPhase; if one of them times out, Wait
+// returns without waiting for the next ones and Error reports it.
 func (t *Topology) Wait() {
-	t.wginp.Wait()
+	defer t.stopSignals()
+
+	if !t.waitPhase(ShutdownInput, &t.wginp) {
+		return
+	}
+	if t.limitTimer != nil {
+		t.limitTimer.Stop()
+	}
 	close(t.inch)
-	t.wgfil.Wait()
-	for _, ch := range t.outch {
-		if ch != nil {
-			close(ch)
+	if !t.waitPhase(ShutdownFilters, &t.wgfil) {
+		return
+	}
+	// Process the partial batches, in chain order since a batch filter
+	// sends records to the batches of the next ones.
+	for _, b := range t.batchers {
+		if b != nil {
+			b.stop()
+			b.flush()
+		}
+	}
+	for _, to := range t.outputs {
+		for _, ch := range to.outch {
+			if ch != nil {
+				close(ch)
+			}
 		}
 	}
-	t.wgout.Wait()
+	if !t.waitPhase(ShutdownOutputs, &t.wgout) {
+		return
+	}
 	close(t.upch)
-	t.wgupl.Wait()
+	if !t.waitPhase(ShutdownUpload, &t.wgupl) {
+		return
+	}
+	if err := t.tracer.Shutdown(); err != nil {
+		log.WithError(err).Warn("can't export the last spans")
+	}
 }
 
 // Return the global (sticky) error state of the topology.
 // Calling this function makes sense after Wait() is complete
 // (before that, it is potentially subject to races).
 // Errors from the input components are returned here, because
-// they are considered fatals for the topology; all other
-// errors (like transient network stuff during output) are not
-// considered fatal, and are supposed to be handled within
-// the components themselves.
+// they are considered fatals for the topology, as well as
+// a shutdown timeout, and the first record error when
+// [general] fail_on_record_error is set; all other errors (like
+// transient network stuff during output) are not considered fatal,
+// and are supposed to be handled within the components themselves.
+// Input errors are ignored when the topology has been stopped by
+// [general] max_records or max_duration, since the input may fail
+// because it's stopped.
 func (t *Topology) Error() error {
-	if err := t.inerr.Load(); err != nil {
+	if err := t.inerr.Load(); err != nil && atomic.LoadInt32(&t.limited) == 0 {
+		return err.(error)
+	}
+	if err := t.recordErr.Load(); err != nil {
+		return err.(error)
+	}
+	if err := t.shutdownErr.Load(); err != nil {
 		return err.(error)
 	}
 	return nil
 }
 
 func (t *Topology) filterChainEnd(l Record) {
+	atomic.AddInt64(&t.emitted, 1)
+
+	// Every record is sent to all the outputs. By default, sending is
+	// blocking so that an output that can't keep up slows down the whole
+	// topology, rather than having records dropped for any of the outputs,
+	// unless the output overflow policy says otherwise.
+	var span *tracing.Span
+	var start time.Time
+	if t.tracer != nil {
+		if span = recordSpan(l); span != nil {
+			start = time.Now()
+		}
+	}
+	for _, to := range t.outputs {
+		to.send(l)
+	}
+	span.Track("output", start, time.Now())
+}
+
+// recordSpan returns the span of the chunk l has been read from, if traced.
+func recordSpan(l Record) *tracing.Span {
+	v, _ := l.Meta(tracing.MetadataKey)
+	span, _ := v.(*tracing.Span)
+	return span
+}
+
+// selects reports whether the record l is sent to the output, which is
+// always the case unless it's a tee.
+func (to *topologyOutput) selects(l Record) bool {
+	if !to.tee {
+		return true
+	}
+	if to.teeValue != nil && !bytes.Equal(l.Get(to.teeField), to.teeValue) {
+		return false
+	}
+	return to.teeRate == 0 || rand.Float64() < to.teeRate
+}
+
+func (to *topologyOutput) send(l Record) {
+	if !to.selects(l) {
+		return
+	}
+
 	// Extract fields for output
 	var rawOut []byte
-	out := make([]string, len(t.outFields))
-	if t.rawOutput {
+	out := make([]string, len(to.fields))
+	if to.raw {
 		rawOut = l.ToText(rawOut)
 	}
-	for idx, f := range t.outFields {
+	for idx, f := range to.fields {
 		out[idx] = string(l.Get(f))
 	}
 
 	// Calculate sharding
-	outch := t.outch[0]
-	if t.shard != nil {
-		idx := t.shard(l)
-		outch = t.outch[int(idx%uint64(len(t.outch)))]
+	outch := to.outch[0]
+	if to.shard != nil {
+		idx := to.shard(l)
+		outch = to.outch[int(idx%uint64(len(to.outch)))]
+	}
+	rec := OutputRecord{Record: rawOut, Fields: out}
+	if mr, ok := l.(MetadataRecord); ok {
+		rec.Meta = mr.Metadata()
+	}
+	if line, ok := l.Meta(MetadataLine); ok {
+		rec.Line, _ = line.(int64)
+	}
+
+	switch to.overflow {
+	case OverflowDropNewest:
+		select {
+		case outch <- rec:
+		default:
+			atomic.AddInt64(&to.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case outch <- rec:
+				return
+			default:
+			}
+			// Make room by discarding the oldest record, unless the output
+			// just took it.
+			select {
+			case <-outch:
+				atomic.AddInt64(&to.dropped, 1)
+			default:
+			}
+		}
+	default:
+		outch <- rec
 	}
-	outch <- OutputRecord{Record: rawOut, Fields: out}
 }
 
 func (t *Topology) runFilterChain() {
@@ -348,8 +975,23 @@ func (t *Topology) runFilterChain() {
 
 	for bakerData := range t.inch {
 		data := bakerData.Bytes
+		meta := bakerData.Meta
 
-		for len(data) > 0 {
+		// The chunks of a traced file are traced by a child span of the
+		// file span, carried by the metadata of their records.
+		var fileSpan, chunkSpan *tracing.Span
+		if t.tracer != nil {
+			if fileSpan = tracing.FromMetadata(meta); fileSpan != nil && len(data) > 0 {
+				chunkSpan = fileSpan.StartChild("filter_chain")
+				meta = make(Metadata, len(bakerData.Meta))
+				for k, v := range bakerData.Meta {
+					meta[k] = v
+				}
+				meta[tracing.MetadataKey] = chunkSpan
+			}
+		}
+
+		for i := int64(0); len(data) > 0; i++ {
 			// Split the lines on newlines (without doing memory allocations)
 			var line []byte
 			if nl := bytes.IndexByte(data, '\n'); nl >= 0 {
@@ -360,12 +1002,32 @@ func (t *Topology) runFilterChain() {
 				data = nil
 			}
 
+			// Block until the rate limiter lets the record through. Since
+			// the input channel fills up meanwhile, this slows the input down.
+			if t.limiter != nil {
+				if d := t.limiter.Take(1); d > 0 {
+					atomic.AddInt64(&t.throttled, 1)
+					time.Sleep(d)
+				}
+				atomic.AddInt64(&t.admitted, 1)
+			}
+
 			// Get a new record from the pool and decode the buffer into it.
 			record := t.linePool.Get().(Record)
-			err := record.Parse(line, bakerData.Meta)
+			err := record.Parse(line, meta)
+			if ll, ok := record.(*LogLine); ok && bakerData.FirstLine > 0 {
+				ll.line = bakerData.FirstLine + i
+			}
+			if err == ErrLogLineFieldCount && t.lenientFieldCount {
+				// Let records with an unexpected number of fields through.
+				err = nil
+			}
 			if err != nil || len(line) == 0 {
 				// Count parse errors or empty records
 				atomic.AddInt64(&t.malformed, 1)
+				if err != nil && t.handlesRecordErrors() {
+					t.reportParseError(bakerData, line, i, err)
+				}
 				continue
 			}
 
@@ -377,6 +1039,23 @@ func (t *Topology) runFilterChain() {
 					t.mu.Lock()
 					t.invalid[idx]++
 					t.mu.Unlock()
+					if t.handlesRecordErrors() {
+						t.reportParseError(bakerData, line, i, fmt.Errorf("invalid field %q", t.fieldName(idx)))
+					}
+					continue
+				}
+			}
+
+			// Past [general] max_records, the records are discarded while
+			// the topology stops.
+			if t.maxRecords > 0 {
+				n := atomic.AddInt64(&t.taken, 1)
+				if n >= t.maxRecords {
+					t.stopOnLimit("max_records")
+				}
+				if n > t.maxRecords {
+					record.Clear()
+					t.linePool.Put(record)
 					continue
 				}
 			}
@@ -385,6 +1064,12 @@ func (t *Topology) runFilterChain() {
 			t.chain(record)
 		}
 
+		if chunkSpan != nil {
+			chunkSpan.SetAttributes(tracing.Int("bytes", int64(len(bakerData.Bytes))))
+			chunkSpan.End()
+		}
+		fileSpan.Release()
+
 		// zero out the common metadata struct.  this doesn't allocate:
 		bakerData.Meta = mdZero
 
@@ -2,6 +2,8 @@ package baker
 
 import (
 	"net/url"
+	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -71,3 +73,45 @@ func TestRunFilterChainMetadata(t *testing.T) {
 		},
 	}
 }
+
+func TestOutputOverflowPolicy(t *testing.T) {
+	const chanSize, nrecords = 3, 5
+
+	tests := []struct {
+		policy      string
+		want        []string
+		wantDropped int64
+	}{
+		{policy: OverflowDropNewest, want: []string{"0", "1", "2"}, wantDropped: 2},
+		{policy: OverflowDropOldest, want: []string{"2", "3", "4"}, wantDropped: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			// Nobody reads from the channel, as if the output was stuck.
+			to := &topologyOutput{
+				outch:    []chan OutputRecord{make(chan OutputRecord, chanSize)},
+				fields:   []FieldIndex{0},
+				overflow: tt.policy,
+			}
+
+			for i := 0; i < nrecords; i++ {
+				l := &LogLine{FieldSeparator: DefaultLogLineFieldSeparator}
+				l.Set(0, []byte(strconv.Itoa(i)))
+				to.send(l)
+			}
+			close(to.outch[0])
+
+			var got []string
+			for rec := range to.outch[0] {
+				got = append(got, rec.Fields[0])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buffered records = %q, want %q", got, tt.want)
+			}
+			if to.dropped != tt.wantDropped {
+				t.Errorf("dropped = %d, want %d", to.dropped, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package baker_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input"
+	"github.com/AdRoll/baker/output/outputtest"
+	"github.com/AdRoll/baker/pkg/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(zw, "%d\n", i)
+	}
+	zw.Close()
+	fn := filepath.Join(t.TempDir(), "file.log.gz")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	toml := fmt.Sprintf(`
+[fields]
+names=["id"]
+
+[input]
+name="List"
+[input.config]
+files=[%q]
+
+[output]
+name="Recorder"
+procs=1
+fields=["id"]
+`, fn)
+	exp := tracing.NewMemoryExporter()
+	comp := baker.Components{
+		Inputs:       []baker.InputDesc{input.ListDesc},
+		Outputs:      []baker.OutputDesc{outputtest.RecorderDesc},
+		SpanExporter: exp,
+	}
+	cfg, err := baker.NewConfigFromToml(strings.NewReader(toml), comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := baker.NewTopologyFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(topo.Output[0].(*outputtest.Recorder).Records); n != 100 {
+		t.Fatalf("output received %d records, want 100", n)
+	}
+
+	spans := exp.Spans()
+	byID := make(map[tracing.SpanID]tracing.SpanData)
+	for _, s := range spans {
+		byID[s.SpanContext.SpanID] = s
+	}
+	// path returns the names of the span and its ancestors, from the root.
+	path := func(s tracing.SpanData) string {
+		names := []string{s.Name}
+		for s.Parent.IsValid() {
+			parent, ok := byID[s.Parent]
+			if !ok {
+				return "orphan " + s.Name
+			}
+			names = append([]string{parent.Name}, names...)
+			s = parent
+		}
+		return strings.Join(names, "/")
+	}
+
+	count := make(map[string]int)
+	var file tracing.SpanData
+	for _, s := range spans {
+		count[path(s)]++
+		if s.Name == "file" {
+			file = s
+		}
+		if s.SpanContext.TraceID != spans[0].SpanContext.TraceID {
+			t.Errorf("span %q has trace ID %s, want all the spans in one trace", s.Name, s.SpanContext.TraceID)
+		}
+	}
+	// Each chunk of the file is traced, and the file fits in a single one.
+	want := map[string]int{
+		"file":                     1,
+		"file/download":            1,
+		"file/parse":               1,
+		"file/filter_chain":        1,
+		"file/filter_chain/output": 1,
+	}
+	for p, n := range want {
+		if count[p] != n {
+			t.Errorf("%d %q spans, want %d (spans: %v)", count[p], p, n, count)
+		}
+	}
+	if len(spans) != len(want) {
+		t.Errorf("%d spans exported, want %d: %v", len(spans), len(want), count)
+	}
+
+	// The file span covers the processing of its chunks.
+	for _, s := range spans {
+		if s.Start.Before(file.Start) || s.End.After(file.End) {
+			t.Errorf("span %q (%v - %v) not within the file span (%v - %v)", s.Name, s.Start, s.End, file.Start, file.End)
+		}
+	}
+}
@@ -9,14 +9,15 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/jpillora/backoff"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/pkg/awsutils"
 )
 
 var S3Desc = baker.UploadDesc{
@@ -40,15 +41,22 @@ var S3Desc = baker.UploadDesc{
 // All files received by the uploader should be absolute and rooted at
 // SourceBasePath.
 type S3Config struct {
-	SourceBasePath string        `help:"Base path used to consider the final S3 path." default:"/tmp/baker/ologs/"`
-	Region         string        `help:"S3 region to upload to" default:"us-east-1"`
-	Bucket         string        `help:"S3 bucket to upload to"  required:"true"`
-	Prefix         string        `help:"Prefix on the destination bucket" default:"/"`
-	StagingPath    string        `help:"Local staging area to copy files to before upload." default:"/tmp/baker/ologs/staging/"`
-	Retries        int           `help:"Number of retries before a failed upload" default:"3"`
-	Concurrency    int           `help:"Number of concurrent workers" default:"5"`
-	Interval       time.Duration `help:"Period at which the source path is scanned" default:"15s"`
-	ExitOnError    bool          `help:"Exit at first error, instead of logging all errors" default:"false"`
+	SourceBasePath    string        `help:"Base path used to consider the final S3 path." default:"/tmp/baker/ologs/"`
+	Region            string        `help:"S3 region to upload to" default:"us-east-1"`
+	Bucket            string        `help:"S3 bucket to upload to"  required:"true"`
+	Prefix            string        `help:"Prefix on the destination bucket" default:"/"`
+	StagingPath       string        `help:"Local staging area to copy files to before upload." default:"/tmp/baker/ologs/staging/"`
+	Retries           int           `help:"Number of retries before a failed upload" default:"3"`
+	Concurrency       int           `help:"Number of concurrent workers" default:"5"`
+	UploadConcurrency int           `help:"Number of files concurrently uploaded as soon as they're received, rather than at the next scan of the staging path. 0 disables immediate uploads" default:"0"`
+	Interval          time.Duration `help:"Period at which the source path is scanned" default:"15s"`
+	ExitOnError       bool          `help:"Exit at first error, instead of logging all errors" default:"false"`
+	SSE               string        `help:"Server-side encryption algorithm used to store the uploaded files on S3: AES256 or aws:kms. Empty means no encryption"`
+	SSEKMSKeyID       string        `help:"ID of the AWS KMS key to use when SSE is aws:kms. If empty, the default KMS key is used"`
+	HTTPProxy         string        `help:"If provided, URL of the proxy the S3 requests go through, overriding the HTTP_PROXY and HTTPS_PROXY environment variables"`
+	CABundlePath      string        `help:"If provided, path of a PEM file of the certificate authorities trusted for the S3 connections, instead of the system ones"`
+	ConnectTimeout    time.Duration `help:"If greater than 0, maximum time to establish a connection to S3" default:"0"`
+	ReadTimeout       time.Duration `help:"If greater than 0, maximum time to wait for the response headers of a S3 request" default:"0"`
 }
 
 func (cfg *S3Config) fillDefaults() error {
@@ -82,10 +90,23 @@ func (cfg *S3Config) fillDefaults() error {
 		cfg.Concurrency = 5
 	}
 
+	if cfg.UploadConcurrency < 0 {
+		return fmt.Errorf("UploadConcurrency: invalid number: %v", cfg.UploadConcurrency)
+	}
+
 	if cfg.Interval == 0 {
 		cfg.Interval = 15 * time.Second
 	}
 
+	switch cfg.SSE {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("SSE: unsupported server-side encryption: %q", cfg.SSE)
+	}
+	if cfg.SSEKMSKeyID != "" && cfg.SSE != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("SSEKMSKeyID: can only be set if SSE is %q", s3.ServerSideEncryptionAwsKms)
+	}
+
 	return nil
 }
 
@@ -93,14 +114,22 @@ type S3 struct {
 	Cfg *S3Config
 
 	uploader *s3manager.Uploader
+	backoff  backoff.Backoff // backoff between failed upload attempts
 	ticker   *time.Ticker
 	wgUpload sync.WaitGroup
 	quit     chan struct{}
 	stopOnce sync.Once
 
-	totaln   int64
-	totalerr int64
-	queuedn  int64
+	sem      sem             // bounds the number of immediate uploads
+	wgFiles  sync.WaitGroup  // immediate uploads
+	mu       sync.Mutex      // protects inflight
+	inflight map[string]bool // staging paths being uploaded
+
+	totaln    int64 // number of files received
+	totalerr  int64 // number of failed upload attempts
+	queuedn   int64 // number of files waiting to be uploaded
+	uploadedn int64 // number of files successfully uploaded
+	failedn   int64 // number of files not uploaded after all retries
 }
 
 func NewS3(cfg baker.UploadParams) (baker.Upload, error) {
@@ -116,17 +145,34 @@ func NewS3(cfg baker.UploadParams) (baker.Upload, error) {
 		return nil, fmt.Errorf("staging path creation error: %v", err)
 	}
 
-	s3svc := s3.New(session.New(&aws.Config{Region: aws.String(dcfg.Region)}))
+	sess, err := awsutils.NewSession(awsutils.SessionConfig{
+		Region: dcfg.Region,
+		HTTP: awsutils.HTTPConfig{
+			Proxy:          dcfg.HTTPProxy,
+			CABundlePath:   dcfg.CABundlePath,
+			ConnectTimeout: dcfg.ConnectTimeout,
+			ReadTimeout:    dcfg.ReadTimeout,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("upload.s3: can't create AWS session: %v", err)
+	}
+	s3svc := s3.New(sess)
 	return &S3{
 		Cfg:      dcfg,
 		uploader: s3manager.NewUploaderWithClient(s3svc),
+		backoff:  awsutils.DefaultBackoff,
 		quit:     make(chan struct{}),
+		sem:      make(sem, dcfg.UploadConcurrency),
+		inflight: make(map[string]bool),
 	}, nil
 }
 
 func (u *S3) Run(upch <-chan string) error {
-	// Stop blocks until the upload goroutine has exited.
+	// Stop blocks until the upload goroutine has exited, after its last
+	// upload of the staging path, which retries the failed immediate uploads.
 	defer u.Stop()
+	defer u.wgFiles.Wait()
 
 	// Use a buffered channel to allow an extra message to be pushed by
 	// the deferred function in the goroutine when the Run function
@@ -174,7 +220,7 @@ func (u *S3) Run(upch <-chan string) error {
 			if !more {
 				return nil
 			}
-			err := u.move(sourceFilePath)
+			stagedPath, err := u.move(sourceFilePath)
 			atomic.AddInt64(&u.totaln, int64(1))
 			atomic.AddInt64(&u.queuedn, int64(1))
 			if err != nil {
@@ -182,25 +228,74 @@ func (u *S3) Run(upch <-chan string) error {
 					return fmt.Errorf("couldn't move: %v", err)
 				}
 				log.WithFields(log.Fields{"filepath": sourceFilePath}).WithError(err).Error("couldn't move")
+				continue
+			}
+			if u.Cfg.UploadConcurrency > 0 {
+				u.uploadNow(stagedPath, errCh)
 			}
 		}
 	}
 }
 
-func (u *S3) move(sourceFilePath string) error {
+// move moves a file to the staging area and returns its new path.
+func (u *S3) move(sourceFilePath string) (string, error) {
 	relPath, err := filepath.Rel(u.Cfg.SourceBasePath, sourceFilePath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	destinationPath := filepath.Join(u.Cfg.StagingPath, relPath)
 
 	dir := path.Dir(destinationPath)
 	if err := os.MkdirAll(dir, 0777); err != nil {
-		return err
+		return "", err
+	}
+
+	return destinationPath, os.Rename(sourceFilePath, destinationPath)
+}
+
+// uploadNow starts the upload of a file of the staging area, without waiting
+// for the next scan of the staging path. At most UploadConcurrency files are
+// uploaded at the same time. If the upload fails, the file is left in the
+// staging area. With ExitOnError, the upload error is sent to errCh, unless
+// another error is pending.
+func (u *S3) uploadNow(fpath string, errCh chan<- error) {
+	if !u.claim(fpath) {
+		return
+	}
+
+	u.wgFiles.Add(1)
+	go func() {
+		u.sem.incr()
+		defer func() { u.sem.decr(); u.release(fpath); u.wgFiles.Done() }()
+
+		if err := u.uploadWithRetries(fpath, func() bool { return false }); err != nil {
+			select {
+			case errCh <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// claim marks a file of the staging area as being uploaded, so that a file
+// is never uploaded twice at the same time. It returns false if the file is
+// already being uploaded.
+func (u *S3) claim(fpath string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.inflight[fpath] {
+		return false
 	}
+	u.inflight[fpath] = true
+	return true
+}
 
-	return os.Rename(sourceFilePath, destinationPath)
+// release unmarks a file claimed with claim.
+func (u *S3) release(fpath string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.inflight, fpath)
 }
 
 func (u *S3) Stop() {
@@ -217,8 +312,10 @@ func (u *S3) Stop() {
 }
 
 func (u *S3) Stats() baker.UploadStats {
-	bag := make(baker.MetricsBag)
+	bag := &baker.MetricsBag{}
 	bag.AddGauge("s3upload.queuedn", float64(atomic.LoadInt64(&u.queuedn)))
+	bag.AddRawCounter("s3upload.uploaded", atomic.LoadInt64(&u.uploadedn))
+	bag.AddRawCounter("s3upload.failed", atomic.LoadInt64(&u.failedn))
 
 	return baker.UploadStats{
 		NumProcessedFiles: atomic.LoadInt64(&u.totaln),
@@ -241,6 +338,10 @@ func (u *S3) uploadDirectory() error {
 	ctx.Info("Starting to walk...")
 	exitErr := atomic.Value{}
 	err := filepath.Walk(u.Cfg.StagingPath, func(fpath string, info os.FileInfo, walkErr error) error {
+		if os.IsNotExist(walkErr) {
+			// Uploaded meanwhile.
+			return nil
+		}
 		if walkErr != nil {
 			return walkErr
 		}
@@ -253,28 +354,22 @@ func (u *S3) uploadDirectory() error {
 		if info.IsDir() {
 			return nil
 		}
+		// Skip the files being uploaded as soon as they were received.
+		if !u.claim(fpath) {
+			return nil
+		}
+		if _, err := os.Stat(fpath); os.IsNotExist(err) {
+			u.release(fpath)
+			return nil
+		}
 		ctx.WithFields(log.Fields{"fpath": fpath}).Info("Upload scheduled")
 		wg.Add(1)
 		sem.incr()
 		go func(fpath string) {
-			defer func() { sem.decr(); wg.Done() }()
-
-			for i := 0; i < u.Cfg.Retries; i++ {
-				if exitErr.Load() != nil {
-					return
-				}
-				err := s3UploadFile(u.uploader, u.Cfg.Bucket, u.Cfg.Prefix, u.Cfg.StagingPath, fpath)
-				if err == nil {
-					atomic.AddInt64(&u.queuedn, int64(-1))
-					break
-				}
+			defer func() { sem.decr(); u.release(fpath); wg.Done() }()
 
-				atomic.AddInt64(&u.totalerr, int64(1))
-				if u.Cfg.ExitOnError {
-					exitErr.Store(err)
-					return
-				}
-				log.WithError(err).WithFields(log.Fields{"retry#": i + 1}).Error("failed upload")
+			if err := u.uploadWithRetries(fpath, func() bool { return exitErr.Load() != nil }); err != nil {
+				exitErr.Store(err)
 			}
 		}(fpath)
 		return nil
@@ -286,7 +381,42 @@ func (u *S3) uploadDirectory() error {
 	return err
 }
 
-func s3UploadFile(uploader *s3manager.Uploader, bucket, prefix, localPath, fpath string) error {
+// uploadWithRetries uploads a file of the staging area, retrying failed
+// uploads with backoff, until stopped returns true. The file is kept in the
+// staging area if it couldn't be uploaded, so that it's retried during the
+// next walk of the staging directory. It only returns an error if ExitOnError
+// is set.
+func (u *S3) uploadWithRetries(fpath string, stopped func() bool) error {
+	backoff := u.backoff
+	for i := 0; i < u.Cfg.Retries; i++ {
+		if stopped() {
+			return nil
+		}
+		if i > 0 {
+			time.Sleep(backoff.Duration())
+		}
+		err := u.uploadFile(fpath)
+		if err == nil {
+			atomic.AddInt64(&u.queuedn, int64(-1))
+			atomic.AddInt64(&u.uploadedn, int64(1))
+			return nil
+		}
+
+		atomic.AddInt64(&u.totalerr, int64(1))
+		if u.Cfg.ExitOnError {
+			return err
+		}
+		log.WithError(err).WithFields(log.Fields{"retry#": i + 1}).Error("failed upload")
+	}
+
+	atomic.AddInt64(&u.failedn, int64(1))
+	return nil
+}
+
+// uploadFile uploads a single file from the staging area to S3. The file
+// is only removed from the staging area once the upload has succeeded.
+func (u *S3) uploadFile(fpath string) error {
+	bucket, prefix, localPath := u.Cfg.Bucket, u.Cfg.Prefix, u.Cfg.StagingPath
 	ctx := log.WithFields(log.Fields{"localPath": localPath, "filepath": fpath})
 
 	rel, err := filepath.Rel(localPath, fpath)
@@ -305,11 +435,19 @@ func s3UploadFile(uploader *s3manager.Uploader, bucket, prefix, localPath, fpath
 	}()
 
 	ctx.WithFields(log.Fields{"key": filepath.Join(prefix, rel)}).Info("Uploading")
-	result, err := uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket: &bucket,
 		Key:    aws.String(filepath.Join(prefix, rel)),
 		Body:   file,
-	})
+	}
+	if u.Cfg.SSE != "" {
+		input.ServerSideEncryption = aws.String(u.Cfg.SSE)
+	}
+	if u.Cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.Cfg.SSEKMSKeyID)
+	}
+
+	result, err := u.uploader.Upload(input)
 	if err != nil {
 		actualS3Path := fmt.Sprintf("s3://%s/%s/%s", bucket, prefix, rel)
 		return fmt.Errorf("error uploading %s to %s: %s", fpath, actualS3Path, err)
@@ -9,11 +9,15 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
 	"github.com/AdRoll/baker/testutil"
+	"github.com/jpillora/backoff"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -86,6 +90,9 @@ func mockS3Service(wantErr bool) (svc *s3.S3, ops *[]string, params *[]interface
 	return svc, ops, params
 }
 
+// testBackoff is a short backoff, used to not slow down tests of failed uploads.
+var testBackoff = backoff.Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+
 // prepareUploadS3TestFolder creates a temp forlder and the selected number of files in it
 func prepareUploadS3TestFolder(t *testing.T, numFiles int) (string, []string) {
 	t.Helper()
@@ -260,6 +267,7 @@ func TestS3_uploadDirectoryError(t *testing.T) {
 		s, _, _ := mockS3Service(true)
 		u := iu.(*S3)
 		u.uploader = s3manager.NewUploaderWithClient(s)
+		u.backoff = testBackoff
 
 		if err := u.uploadDirectory(); err != nil {
 			log.Fatal(err)
@@ -293,6 +301,7 @@ func TestS3_uploadDirectoryError(t *testing.T) {
 		s, _, _ := mockS3Service(true)
 		u := iu.(*S3)
 		u.uploader = s3manager.NewUploaderWithClient(s)
+		u.backoff = testBackoff
 
 		if err := u.uploadDirectory(); err == nil {
 			t.Fatalf("expected error")
@@ -331,6 +340,7 @@ func TestS3RunExitOnError(t *testing.T) {
 	s, _, _ := mockS3Service(true)
 	u := iu.(*S3)
 	u.uploader = s3manager.NewUploaderWithClient(s)
+	u.backoff = testBackoff
 
 	ch := make(chan string)
 	go func() {
@@ -380,6 +390,7 @@ func TestS3RunNotExitOnError(t *testing.T) {
 	s, _, _ := mockS3Service(true)
 	u := iu.(*S3)
 	u.uploader = s3manager.NewUploaderWithClient(s)
+	u.backoff = testBackoff
 
 	ch := make(chan string)
 	go func() {
@@ -419,9 +430,13 @@ func TestS3_move(t *testing.T) {
 		},
 	}
 
-	if err := s3.move(srcFile); err != nil {
+	dst, err := s3.move(srcFile)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if dst != trgtFile {
+		t.Errorf("moved file path = %q, want %q", dst, trgtFile)
+	}
 
 	if _, err := os.Stat(trgtFile); err != nil {
 		t.Error("moved file not found")
@@ -431,3 +446,225 @@ func TestS3_move(t *testing.T) {
 		t.Error("source file still there")
 	}
 }
+
+func TestS3_uploadDirectorySSE(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srcDir, _ := prepareUploadS3TestFolder(t, 3)
+
+	cfg := baker.UploadParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &S3Config{
+				SourceBasePath: srcDir,
+				StagingPath:    srcDir,
+				Bucket:         "my-bucket",
+				SSE:            "aws:kms",
+				SSEKMSKeyID:    "my-key",
+			},
+		},
+	}
+	iu, err := NewS3(cfg)
+	if err != nil {
+		t.Fatalf("NewS3Upload(%+v) = %q", cfg, err)
+	}
+	s, _, params := mockS3Service(false)
+	u := iu.(*S3)
+	u.uploader = s3manager.NewUploaderWithClient(s)
+
+	if err := u.uploadDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range *params {
+		putObj := (*params)[i].(*s3.PutObjectInput)
+		if aws.StringValue(putObj.ServerSideEncryption) != "aws:kms" {
+			t.Errorf("params[%d].ServerSideEncryption = %q, want %q", i, aws.StringValue(putObj.ServerSideEncryption), "aws:kms")
+		}
+		if aws.StringValue(putObj.SSEKMSKeyId) != "my-key" {
+			t.Errorf("params[%d].SSEKMSKeyId = %q, want %q", i, aws.StringValue(putObj.SSEKMSKeyId), "my-key")
+		}
+	}
+
+	if u.uploadedn != 3 || u.failedn != 0 {
+		t.Errorf("uploaded, failed = %d, %d, want 3, 0", u.uploadedn, u.failedn)
+	}
+
+	// Files have been uploaded, they must have been removed.
+	files, _ := ioutil.ReadDir(srcDir)
+	if len(files) != 0 {
+		t.Errorf("got %d files in staging path, want 0", len(files))
+	}
+}
+
+func TestS3_uploadDirectoryKeepsFailedFiles(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	const numFiles = 3
+	srcDir, _ := prepareUploadS3TestFolder(t, numFiles)
+
+	cfg := baker.UploadParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &S3Config{
+				SourceBasePath: srcDir,
+				StagingPath:    srcDir,
+				Bucket:         "my-bucket",
+				Retries:        2,
+			},
+		},
+	}
+	iu, err := NewS3(cfg)
+	if err != nil {
+		t.Fatalf("NewS3Upload(%+v) = %q", cfg, err)
+	}
+	s, _, _ := mockS3Service(true)
+	u := iu.(*S3)
+	u.uploader = s3manager.NewUploaderWithClient(s)
+	u.backoff = testBackoff
+
+	if err := u.uploadDirectory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.uploadedn != 0 || u.failedn != numFiles {
+		t.Errorf("uploaded, failed = %d, %d, want 0, %d", u.uploadedn, u.failedn, numFiles)
+	}
+
+	// No upload succeeded, all files must still be in the staging path.
+	files, _ := ioutil.ReadDir(srcDir)
+	if len(files) != numFiles {
+		t.Errorf("got %d files in staging path, want %d", len(files), numFiles)
+	}
+}
+
+func TestS3ConfigSSE(t *testing.T) {
+	tests := []struct {
+		sse, key string
+		wantErr  bool
+	}{
+		{sse: "", key: ""},
+		{sse: "AES256", key: ""},
+		{sse: "aws:kms", key: ""},
+		{sse: "aws:kms", key: "my-key"},
+		{sse: "foo", key: "", wantErr: true},
+		{sse: "AES256", key: "my-key", wantErr: true},
+		{sse: "", key: "my-key", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := &S3Config{Bucket: "my-bucket", SSE: tt.sse, SSEKMSKeyID: tt.key}
+		if err := cfg.fillDefaults(); (err != nil) != tt.wantErr {
+			t.Errorf("SSE=%q SSEKMSKeyID=%q: fillDefaults() error = %v, wantErr %t", tt.sse, tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestS3UploadConcurrencyShards(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srcDir := t.TempDir()
+	stagingDir := t.TempDir()
+
+	params := baker.UploadParams{
+		ComponentParams: baker.ComponentParams{
+			DecodedConfig: &S3Config{
+				SourceBasePath:    srcDir,
+				StagingPath:       stagingDir,
+				Bucket:            "my-bucket",
+				UploadConcurrency: 3,
+				// Only the immediate uploads and the last scan happen.
+				Interval: time.Hour,
+			},
+		},
+	}
+	iu, err := NewS3(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, _, _ := mockS3Service(false)
+	u := iu.(*S3)
+	u.uploader = s3manager.NewUploaderWithClient(svc)
+	u.backoff = testBackoff
+
+	// The first upload attempt of each file fails.
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := *r.Params.(*s3.PutObjectInput).Key
+		attempts[key]++
+		if attempts[key] == 1 {
+			r.HTTPResponse = &http.Response{StatusCode: 500, Body: ioutil.NopCloser(strings.NewReader(""))}
+		}
+	})
+
+	const nrecords, maxRecords = 95, 10
+	var lines []*baker.LogLine
+	for i := 0; i < nrecords; i++ {
+		ll := &baker.LogLine{FieldSeparator: ','}
+		ll.Set(0, []byte(fmt.Sprintf("record-%d", i)))
+		lines = append(lines, ll)
+	}
+
+	comp := baker.Components{
+		Inputs:  []baker.InputDesc{inputtest.LogLineDesc},
+		Outputs: []baker.OutputDesc{output.FileWriterDesc},
+		Uploads: []baker.UploadDesc{{
+			Name:   "Fake",
+			New:    func(baker.UploadParams) (baker.Upload, error) { return u, nil },
+			Config: &struct{}{},
+		}},
+	}
+	cfg := baker.Config{
+		Input: baker.ConfigInput{Name: "LogLine", DecodedConfig: &inputtest.LogLineConfig{Lines: lines}},
+		Output: []baker.ConfigOutput{{
+			Name:  "FileWriter",
+			Procs: 1,
+			DecodedConfig: &output.FileWriterConfig{
+				PathString:     filepath.Join(srcDir, "{{.UUID}}-{{.Rotation}}.log.gz"),
+				RotateInterval: -1,
+				MaxRecords:     maxRecords,
+			},
+		}},
+		Upload: baker.ConfigUpload{Name: "Fake"},
+		Fields: baker.ConfigFields{Names: []string{"f0"}},
+	}
+
+	topo, err := baker.New(comp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo.Start()
+	topo.Wait()
+	if err := topo.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	const nshards = (nrecords + maxRecords - 1) / maxRecords
+	if len(attempts) != nshards {
+		t.Errorf("%d shards uploaded, want %d", len(attempts), nshards)
+	}
+	for key, n := range attempts {
+		if n != 2 {
+			t.Errorf("shard %s: %d upload attempts, want 2 (1 failure, 1 success)", key, n)
+		}
+	}
+	if got := atomic.LoadInt64(&u.uploadedn); got != nshards {
+		t.Errorf("uploaded = %d, want %d", got, nshards)
+	}
+
+	// Local files are removed once uploaded.
+	for _, dir := range []string{srcDir, stagingDir} {
+		var left []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				left = append(left, path)
+			}
+			return nil
+		})
+		if len(left) != 0 {
+			t.Errorf("files left in %s: %q", dir, left)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package baker_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/baker"
+	"github.com/AdRoll/baker/input/inputtest"
+	"github.com/AdRoll/baker/output"
+)
+
+// invalidInput is an input always failing startup validation.
+type invalidInput struct{ inputtest.Base }
+
+func (invalidInput) Validate() error { return errors.New("access denied") }
+
+func TestValidateOnStart(t *testing.T) {
+	const src = `
+[general]
+validate_on_start=%t
+
+[fields]
+names=["f0"]
+
+[input]
+name="invalid"
+
+[output]
+name="nop"
+fields=["f0"]
+`
+	components := baker.Components{
+		Inputs: []baker.InputDesc{{
+			Name:   "invalid",
+			New:    func(baker.InputParams) (baker.Input, error) { return &invalidInput{}, nil },
+			Config: &struct{}{},
+		}},
+		Outputs: []baker.OutputDesc{output.NopDesc},
+	}
+
+	for _, validate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("validate_on_start=%t", validate), func(t *testing.T) {
+			cfg, err := baker.NewConfigFromToml(strings.NewReader(fmt.Sprintf(src, validate)), components)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = baker.NewTopologyFromConfig(cfg)
+			if validate && (err == nil || !strings.Contains(err.Error(), "access denied")) {
+				t.Errorf("NewTopologyFromConfig() err = %v, want validation error", err)
+			}
+			if !validate && err != nil {
+				t.Errorf("NewTopologyFromConfig() err = %v, want nil", err)
+			}
+		})
+	}
+}